@@ -0,0 +1,439 @@
+package querystore
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+type accumulator interface {
+	add(v any)
+	// merge folds in an accumulator of the same type that saw other rows.
+	merge(o accumulator)
+	result() any
+}
+
+// weightedAccumulator is implemented by accumulators of aggregations with a
+// Weight, which are given its value for each value added.
+type weightedAccumulator interface {
+	addWeighted(v, weight any)
+}
+
+// vectorAccumulator is implemented by accumulators that can add a value from
+// a vector without boxing it.
+type vectorAccumulator interface {
+	addVector(v *vector, j int)
+}
+
+var accumulators = map[AggregatorType]func(a Aggregation) accumulator{
+	AggregatorCount: func(Aggregation) accumulator { return &countAccumulator{} },
+	AggregatorSum:   func(Aggregation) accumulator { return &sumAccumulator{} },
+	AggregatorMin:   func(Aggregation) accumulator { return &extremeAccumulator{sign: -1} },
+	AggregatorMax:   func(Aggregation) accumulator { return &extremeAccumulator{sign: 1} },
+	AggregatorAvg:   func(Aggregation) accumulator { return &avgAccumulator{} },
+
+	AggregatorPercentile: func(a Aggregation) accumulator { return newPercentileAccumulator(a.Percentile) },
+	AggregatorHistogram:  func(a Aggregation) accumulator { return newHistogramAccumulator(a.Buckets) },
+	AggregatorTopK:       func(a Aggregation) accumulator { return newTopKAccumulator(a.K, a.Weight != "") },
+
+	AggregatorApproxDistinct: func(Aggregation) accumulator { return &hllSketch{} },
+}
+
+type countAccumulator struct {
+	n int64
+}
+
+func (a *countAccumulator) add(v any) { a.n++ }
+
+func (a *countAccumulator) addVector(v *vector, j int) { a.n++ }
+
+func (a *countAccumulator) merge(o accumulator) { a.n += o.(*countAccumulator).n }
+
+func (a *countAccumulator) result() any { return a.n }
+
+type sumAccumulator struct {
+	i       int64
+	u       uint64
+	f       float64
+	isUint  bool
+	isFloat bool
+}
+
+func (a *sumAccumulator) add(v any) {
+	switch v := v.(type) {
+	case int64:
+		a.i += v
+	case uint64:
+		a.u += v
+		a.isUint = true
+	case float64:
+		a.f += v
+		a.isFloat = true
+	}
+}
+
+func (a *sumAccumulator) addVector(v *vector, j int) {
+	switch v.typ {
+	case ColumnTypeInt64, ColumnTypeInt32:
+		a.i += int64(v.bits[j])
+	case ColumnTypeUint64:
+		a.u += v.bits[j]
+		a.isUint = true
+	case ColumnTypeFloat64:
+		a.f += math.Float64frombits(v.bits[j])
+		a.isFloat = true
+	}
+}
+
+func (a *sumAccumulator) merge(o accumulator) {
+	b := o.(*sumAccumulator)
+	a.i += b.i
+	a.u += b.u
+	a.f += b.f
+	a.isUint = a.isUint || b.isUint
+	a.isFloat = a.isFloat || b.isFloat
+}
+
+func (a *sumAccumulator) result() any {
+	if a.isFloat {
+		return a.f + float64(a.i) + float64(a.u)
+	}
+	if a.isUint {
+		return a.u + uint64(a.i)
+	}
+	return a.i
+}
+
+// extremeAccumulator tracks the minimum (sign -1) or maximum (sign 1) value.
+type extremeAccumulator struct {
+	sign int
+	v    any
+}
+
+func (a *extremeAccumulator) add(v any) {
+	if a.v == nil || compareValues(v, a.v)*a.sign > 0 {
+		a.v = v
+	}
+}
+
+func (a *extremeAccumulator) addVector(v *vector, j int) {
+	switch v.typ {
+	case ColumnTypeInt64, ColumnTypeInt32:
+		addExtreme(a, int64(v.bits[j]))
+	case ColumnTypeUint64:
+		addExtreme(a, v.bits[j])
+	case ColumnTypeFloat64:
+		addExtreme(a, math.Float64frombits(v.bits[j]))
+	default:
+		a.add(v.box(j))
+	}
+}
+
+// addExtreme adds a value to an extreme accumulator, boxing it only if it is
+// a new extreme.
+func addExtreme[T cmp.Ordered](a *extremeAccumulator, x T) {
+	if a.v == nil || cmp.Compare(x, a.v.(T))*a.sign > 0 {
+		a.v = x
+	}
+}
+
+func (a *extremeAccumulator) merge(o accumulator) {
+	if v := o.(*extremeAccumulator).v; v != nil {
+		a.add(v)
+	}
+}
+
+func (a *extremeAccumulator) result() any { return a.v }
+
+type avgAccumulator struct {
+	sum float64
+	n   int64
+}
+
+func (a *avgAccumulator) add(v any) {
+	switch v.(type) {
+	case int64, uint64, float64:
+		a.sum += valueToFloat64(v)
+		a.n++
+	}
+}
+
+func (a *avgAccumulator) addVector(v *vector, j int) {
+	switch v.typ {
+	case ColumnTypeInt64, ColumnTypeInt32:
+		a.sum += float64(int64(v.bits[j]))
+	case ColumnTypeUint64:
+		a.sum += float64(v.bits[j])
+	case ColumnTypeFloat64:
+		a.sum += math.Float64frombits(v.bits[j])
+	default:
+		return
+	}
+	a.n++
+}
+
+func (a *avgAccumulator) merge(o accumulator) {
+	b := o.(*avgAccumulator)
+	a.sum += b.sum
+	a.n += b.n
+}
+
+func (a *avgAccumulator) result() any {
+	if a.n == 0 {
+		return nil
+	}
+	return a.sum / float64(a.n)
+}
+
+type aggregateGroup struct {
+	key  any
+	accs []accumulator
+}
+
+// aggregateState accumulates the aggregations of a query, optionally
+// partitioned by the values of group-by columns and by intervals of time.
+type aggregateState struct {
+	aggs    []Aggregation
+	groupBy []string
+	// bucket is the length of the intervals of the times in timeCol, when
+	// positive, by which groups are also partitioned, keyed by timeGroup.
+	bucket  int64
+	timeCol string
+	groups  map[any]*aggregateGroup
+	order   []*aggregateGroup
+}
+
+// timeGroup keys the group of an interval, starting at start, of a query
+// grouped by time.
+type timeGroup struct {
+	start int64
+	key   any
+}
+
+// groupKey keys the group of a combination of values of several group-by
+// columns, holding the value of the first and the key of the others.
+type groupKey struct {
+	value, rest any
+}
+
+// jsonGroupKey keys a group by a JSON value, which maps cannot hold, in its
+// encoded form.
+type jsonGroupKey string
+
+// groupValue returns the key of a group-by column value.
+func groupValue(v any) any {
+	switch v.(type) {
+	case []any, map[string]any:
+		return jsonGroupKey(encodeJSONValue(v))
+	}
+	return v
+}
+
+// keyValue returns the group-by column value of a key.
+func keyValue(key any) any {
+	if k, ok := key.(jsonGroupKey); ok {
+		return decodeJSONValue([]byte(k))
+	}
+	return key
+}
+
+// newAggregateState returns the state of aggregations grouped by the given
+// columns, ignoring empty names.
+func newAggregateState(aggs []Aggregation, groupBy ...string) (*aggregateState, error) {
+	return newBucketedAggregateState(aggs, groupBy, "", 0, nil)
+}
+
+// newBucketedAggregateState returns the state of aggregations also grouped
+// by intervals of the times in timeCol, by default the append times, if
+// bucket is positive. Aggregations of the columns typeOf knows, if not nil,
+// are checked against their types.
+func newBucketedAggregateState(aggs []Aggregation, groupBy []string, timeCol string, bucket time.Duration, typeOf func(col string) (ColumnType, error)) (*aggregateState, error) {
+	for _, a := range aggs {
+		if _, ok := accumulators[a.Type]; !ok {
+			return nil, fmt.Errorf("unknown aggregator: %v", a.Type)
+		}
+		if a.Attribute == "" && a.Type != AggregatorCount {
+			return nil, fmt.Errorf("aggregator %v requires an attribute", a.Type)
+		}
+		if err := a.validateParams(); err != nil {
+			return nil, err
+		}
+		if typeOf == nil || a.Attribute == "" {
+			continue
+		}
+		if typ, err := typeOf(a.Attribute); err == nil {
+			if err := checkAggregateType(a, typ); err != nil {
+				return nil, err
+			}
+		}
+	}
+	s := &aggregateState{aggs: aggs, groups: map[any]*aggregateGroup{}}
+	for _, col := range groupBy {
+		switch {
+		case col == "":
+			continue
+		case slices.Contains(s.groupBy, col):
+			return nil, fmt.Errorf("cannot group by column %s twice", col)
+		case col == TimeBucketColumn && bucket > 0:
+			return nil, fmt.Errorf("cannot group by column %s and time", col)
+		}
+		s.groupBy = append(s.groupBy, col)
+	}
+	if bucket > 0 {
+		s.bucket, s.timeCol = int64(bucket), cmp.Or(timeCol, TimestampColumn)
+	} else if len(s.groupBy) == 0 {
+		s.group(nil)
+	}
+	return s, nil
+}
+
+// checkAggregateType fails if an aggregation cannot be computed over a column
+// of a type: only counts, minimums, maximums, top-k and distinct counts take
+// columns that are not numeric.
+func checkAggregateType(a Aggregation, typ ColumnType) error {
+	numeric := slices.Contains([]ColumnType{ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64, ColumnTypeJSON}, typ)
+	if !slices.Contains([]AggregatorType{AggregatorCount, AggregatorMin, AggregatorMax, AggregatorTopK, AggregatorApproxDistinct}, a.Type) && !numeric {
+		return fmt.Errorf("cannot %s %s column %s", a.Type, typ, a.Attribute)
+	}
+	return nil
+}
+
+// keyOf returns the key of the group of the values of the group-by columns,
+// which is the value itself when grouping by a single column.
+func (s *aggregateState) keyOf(value func(i int) any) any {
+	if len(s.groupBy) == 0 {
+		return nil
+	}
+	key := groupValue(value(len(s.groupBy) - 1))
+	for i := len(s.groupBy) - 2; i >= 0; i-- {
+		key = groupKey{value: groupValue(value(i)), rest: key}
+	}
+	return key
+}
+
+// rowKey returns the key of the group of a row, leaving out its interval of
+// time.
+func (s *aggregateState) rowKey(row map[string]any) any {
+	return s.keyOf(func(i int) any { return row[s.groupBy[i]] })
+}
+
+func (s *aggregateState) group(key any) *aggregateGroup {
+	g := s.groups[key]
+	if g == nil {
+		g = &aggregateGroup{key: key, accs: make([]accumulator, len(s.aggs))}
+		for i, a := range s.aggs {
+			g.accs[i] = accumulators[a.Type](a)
+		}
+		s.groups[key] = g
+		s.order = append(s.order, g)
+	}
+	return g
+}
+
+// add folds a matched row into its group. Columns without a value for the row
+// are skipped, except by a bare count which counts rows.
+func (s *aggregateState) add(row map[string]any) {
+	key := s.rowKey(row)
+	if s.bucket > 0 {
+		var ts int64
+		switch t := row[s.timeCol].(type) {
+		case int64:
+			ts = t
+		case time.Time:
+			ts = t.UnixNano()
+		default:
+			return
+		}
+		// Intervals start at multiples of their length since the epoch.
+		start := ts - ts%s.bucket
+		if ts%s.bucket < 0 {
+			start -= s.bucket
+		}
+		key = timeGroup{start: start, key: key}
+	}
+	g := s.group(key)
+	for i, a := range s.aggs {
+		if a.Attribute == "" {
+			g.accs[i].add(nil)
+			continue
+		}
+		if v := row[a.Attribute]; v == nil {
+			continue
+		} else if a.Weight != "" {
+			g.accs[i].(weightedAccumulator).addWeighted(v, row[a.Weight])
+		} else {
+			g.accs[i].add(v)
+		}
+	}
+}
+
+// merge folds in the state of the same aggregations over later rows. Groups
+// first seen by o are ordered after those of s.
+func (s *aggregateState) merge(o *aggregateState) {
+	for _, og := range o.order {
+		g := s.group(og.key)
+		for i, acc := range og.accs {
+			g.accs[i].merge(acc)
+		}
+	}
+}
+
+// addBatch folds the rows of a batch selected by mask into their groups,
+// reading values from the vectors of the aggregated columns and the group-by
+// columns. Nil vectors are columns without values.
+func (s *aggregateState) addBatch(mask []bool, vecs []*vector, groups []*vector) {
+	var g *aggregateGroup
+	for j, ok := range mask {
+		if !ok {
+			continue
+		}
+		if g == nil || len(groups) > 0 {
+			g = s.group(s.keyOf(func(i int) any {
+				if groups[i] == nil {
+					return nil
+				}
+				return groups[i].box(j)
+			}))
+		}
+		for i, v := range vecs {
+			switch {
+			case s.aggs[i].Attribute == "":
+				g.accs[i].add(nil)
+			case v == nil || !v.valid[j]:
+			default:
+				if acc, ok := g.accs[i].(vectorAccumulator); ok {
+					acc.addVector(v, j)
+				} else {
+					g.accs[i].add(v.box(j))
+				}
+			}
+		}
+	}
+}
+
+func (s *aggregateState) results() []map[string]any {
+	rows := make([]map[string]any, 0, len(s.order))
+	for _, g := range s.order {
+		row := map[string]any{}
+		key := g.key
+		if tg, ok := key.(timeGroup); ok {
+			row[TimeBucketColumn] = time.Unix(0, tg.start).UTC()
+			key = tg.key
+		}
+		for i, col := range s.groupBy {
+			if i == len(s.groupBy)-1 {
+				row[col] = keyValue(key)
+			} else {
+				k := key.(groupKey)
+				row[col], key = keyValue(k.value), k.rest
+			}
+		}
+		for i, a := range s.aggs {
+			row[a.Name()] = g.accs[i].result()
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
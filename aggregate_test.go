@@ -0,0 +1,168 @@
+package querystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleAggregations(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 10 {
+		rec := map[string]any{
+			"val":     i,
+			"latency": float64(i) * 1.5,
+			"region":  []string{"us", "eu"}[i%2],
+		}
+		require.NoError(t, cs.Append(rec))
+	}
+
+	rows, err := cs.Query(&Query{
+		Aggregations: []Aggregation{
+			{Type: AggregatorCount},
+			{Type: AggregatorSum, Attribute: "val"},
+			{Type: AggregatorMax, Attribute: "latency"},
+			{Type: AggregatorAvg, Attribute: "val", Alias: "mean"},
+		},
+		Filters: []Filter{{Attribute: "val", Condition: ConditionLessThan, Value: 6}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(6), rows[0]["count"])
+	assert.Equal(t, int64(15), rows[0]["sum(val)"])
+	assert.Equal(t, 7.5, rows[0]["max(latency)"])
+	assert.Equal(t, 2.5, rows[0]["mean"])
+
+	rows, err = cs.Query(&Query{
+		Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorMin, Attribute: "val"}},
+		GroupBy:      "region",
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, map[string]any{"region": "us", "count": int64(5), "min(val)": int64(0)}, rows[0])
+	assert.Equal(t, map[string]any{"region": "eu", "count": int64(5), "min(val)": int64(1)}, rows[1])
+}
+
+func TestAggregateTypes(t *testing.T) {
+	cs := newTestStore(t)
+	require.NoError(t, cs.Append(map[string]any{"val": 1, "region": "us", "ok": true, "at": time.Unix(0, 0)}))
+	for _, a := range []Aggregation{
+		{Type: AggregatorSum, Attribute: "region"},
+		{Type: AggregatorAvg, Attribute: "ok"},
+		{Type: AggregatorSum, Attribute: "at"},
+	} {
+		_, err := cs.Query(&Query{Aggregations: []Aggregation{a}})
+		assert.ErrorContains(t, err, "cannot "+a.Type.String(), a.Name())
+		_, err = cs.Query(&Query{Aggregations: []Aggregation{a}, Parallelism: 2})
+		assert.Error(t, err, a.Name())
+	}
+	_, err := cs.Query(&Query{
+		Computed:     []ComputedColumn{{Name: "label", Expr: "region"}},
+		Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "label"}},
+	})
+	assert.ErrorContains(t, err, "cannot sum string column label")
+
+	rows, err := cs.Query(&Query{Aggregations: []Aggregation{
+		{Type: AggregatorMax, Attribute: "region"},
+		{Type: AggregatorSum, Attribute: "missing"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, "us", rows[0]["max(region)"])
+}
+
+func TestGroupByColumns(t *testing.T) {
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := range 3000 {
+		row := map[string]any{"region": []string{"us", "eu"}[i%2], "status": int64([]int{200, 404, 500}[i%3]), "val": int64(i % 10)}
+		if i%7 == 0 {
+			delete(row, "status")
+		}
+		rows = append(rows, row)
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	expected := map[[2]any]int64{}
+	for _, row := range rows {
+		expected[[2]any{row["region"], row["status"]}]++
+	}
+	check := func(q *Query) {
+		res, err := cs.Query(q)
+		require.NoError(t, err)
+		got := map[[2]any]int64{}
+		for _, row := range res {
+			got[[2]any{row["region"], row["status"]}] = row["count"].(int64)
+		}
+		assert.Equal(t, expected, got)
+	}
+	q, err := NewQuery().Count().GroupBy("region", "status").BuildFor(cs)
+	require.NoError(t, err)
+	check(q)
+	q.Parallelism = 3
+	check(q)
+	// Rows in a time range are aggregated row by row.
+	check(&Query{Aggregations: q.Aggregations, GroupBy: "region", GroupByColumns: []string{"status"}, TimeRange: TimeRange{End: time.Now().Add(time.Hour)}})
+
+	q, err = ParseQuery("| count, sum(val) by region, status | sort region, status desc | limit 2")
+	require.NoError(t, err)
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, []any{"eu", "eu"}, lo.Map(res, func(row map[string]any, _ int) any { return row["region"] }))
+	assert.Equal(t, []any{int64(500), int64(404)}, lo.Map(res, func(row map[string]any, _ int) any { return row["status"] }))
+
+	q, err = QueryFromSQL("SELECT status, region, COUNT(*) AS n FROM t GROUP BY region, status ORDER BY n DESC LIMIT 1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"region", "status"}, q.groupColumns())
+	_, err = QueryFromSQL("SELECT status, val, COUNT(*) FROM t GROUP BY region, status")
+	assert.ErrorContains(t, err, "must be grouped by")
+
+	_, err = cs.Query(&Query{Aggregations: q.Aggregations, GroupBy: "region", GroupByColumns: []string{"region"}})
+	assert.ErrorContains(t, err, "twice")
+
+	// Views key their rows by every group column.
+	into, err := OpenColumnFSWithOptions(t.TempDir(), Options{PrimaryKey: "key"})
+	require.NoError(t, err)
+	defer into.Close()
+	derived := NewColumnarStore(into)
+	view, err := cs.Materialize(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, GroupByColumns: []string{"region", "status"}}, 0, derived)
+	require.NoError(t, err)
+	require.NoError(t, view.Refresh(context.Background()))
+	require.NoError(t, view.Close())
+	res, err = derived.Query(&Query{Select: []string{"key", "count"}, Where: And(Where("region", ConditionEquals, "us"), Where("status", ConditionEquals, int64(200)))})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "0/us/200", res[0]["key"])
+	assert.Equal(t, expected[[2]any{"us", int64(200)}], res[0]["count"])
+}
+
+func TestGroupByJSONColumn(t *testing.T) {
+	cs := newTestStore(t)
+	for i := range 6 {
+		require.NoError(t, cs.Append(map[string]any{
+			"labels": map[string]any{"env": []string{"prod", "dev"}[i%2], "zone": "a"},
+			"tags":   []any{"x", i % 3},
+			"region": "us",
+		}))
+	}
+	rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, GroupBy: "labels"})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"labels": map[string]any{"env": "prod", "zone": "a"}, "count": int64(3)},
+		{"labels": map[string]any{"env": "dev", "zone": "a"}, "count": int64(3)},
+	}, rows)
+
+	rows, err = cs.Query(&Query{
+		Aggregations:   []Aggregation{{Type: AggregatorCount}},
+		GroupByColumns: []string{"tags", "region"},
+		OrderBy:        []Order{{Attribute: "tags"}},
+		Parallelism:    2,
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, map[string]any{"tags": []any{"x", float64(0)}, "region": "us", "count": int64(2)}, rows[0])
+}
@@ -0,0 +1,847 @@
+package querystore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+// ExportArrow writes the results of a query to w as an Apache Arrow IPC
+// stream, with the columns ExportCSV would write. Rows are read as they are
+// written, in record batches of arrowBatchSize rows. Columns are typed by the
+// store, or else by their first value in the first batch, and map to the
+// Arrow types bool, int32, int64, uint64, float64, timestamp[ns, UTC] and
+// utf8. JSON columns are utf8, with the arrow.json extension.
+func (s *ColumnarStore) ExportArrow(w io.Writer, q *Query) error {
+	q, columns := s.exportColumns(q)
+	types, err := s.exportTypes(q, columns)
+	if err != nil {
+		return err
+	}
+	// Rows are held until their batch is written.
+	q.ReuseRows = false
+	it, err := s.QueryIter(q)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	bw := bufio.NewWriter(w)
+	aw := &arrowWriter{w: bw, columns: columns, types: types}
+	for it.Next() {
+		aw.rows = append(aw.rows, it.Row())
+		if len(aw.rows) == arrowBatchSize {
+			if err := aw.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if err := aw.close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// arrowBatchSize is the number of rows in the record batches ExportArrow
+// writes.
+var arrowBatchSize = 64 * 1024
+
+// arrowExtensionKey is the field metadata key naming an extension type.
+const arrowExtensionKey = "ARROW:extension:name"
+
+// An Arrow IPC stream is a sequence of messages, each
+//
+//	0xFFFFFFFF | metadata length int32 | Message | body
+//
+// where Message is a FlatBuffers table of the Arrow format padded to 8
+// bytes, and the body holds the buffers the message describes, each padded
+// to 8 bytes. A schema message is followed by record batches, and the stream
+// ends with a message of length 0.
+const arrowContinuation = 0xFFFFFFFF
+
+// Arrow metadata version V5, message header types, and the Arrow types
+// stores read and write.
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema          = 1
+	arrowHeaderDictionaryBatch = 2
+	arrowHeaderRecordBatch     = 3
+
+	arrowInt           = 2
+	arrowFloatingPoint = 3
+	arrowUtf8          = 5
+	arrowBool          = 6
+	arrowTimestamp     = 10
+	arrowLargeUtf8     = 20
+
+	arrowPrecisionSingle = 1
+	arrowPrecisionDouble = 2
+	arrowNanosecond      = 3
+)
+
+// arrowWriter writes rows as the record batches of an IPC stream.
+type arrowWriter struct {
+	w       io.Writer
+	columns []string
+	types   map[string]ColumnType
+	// fields is set once the schema is written.
+	fields []arrowField
+	rows   []map[string]any
+}
+
+// arrowField describes a column of a stream, with the Arrow type its values
+// are read or written as.
+type arrowField struct {
+	name string
+	typ  ColumnType
+	// json is set for utf8 columns with the arrow.json extension.
+	json bool
+	// width is the byte width of integers, signed those of signed ones, and
+	// unit the nanoseconds in a unit of timestamps.
+	width  int
+	signed bool
+	unit   int64
+}
+
+// arrowArray holds the buffers of a column of a record batch.
+type arrowArray struct {
+	nullCount int
+	// validity is a bitmap with a set bit for each row holding a value,
+	// least significant bit first. It is empty when no value is null.
+	validity []byte
+	// offsets holds the offsets into data of the values of utf8 columns.
+	offsets []byte
+	// data holds the values: bit-packed for bools, little endian for
+	// numbers and times, and concatenated for utf8 columns. Null rows hold
+	// zeros.
+	data []byte
+}
+
+// flush writes the buffered rows as a record batch, after the schema if not
+// written yet.
+func (aw *arrowWriter) flush() error {
+	if aw.fields == nil {
+		if err := aw.writeSchema(); err != nil {
+			return err
+		}
+	}
+	var nodes, buffers []byte
+	var body []byte
+	for _, field := range aw.fields {
+		arr, err := buildArrowArray(field, aw.rows)
+		if err != nil {
+			return err
+		}
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(len(aw.rows)))
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(arr.nullCount))
+		bufs := [][]byte{arr.validity, arr.data}
+		if arr.offsets != nil {
+			bufs = [][]byte{arr.validity, arr.offsets, arr.data}
+		}
+		for _, b := range bufs {
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+			buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(b)))
+			body = append(body, b...)
+			body = append(body, make([]byte, padding(len(body), 8))...)
+		}
+	}
+	batch := flatTable{int64(len(aw.rows)), flatStructs{len(aw.fields), nodes}, flatStructs{len(buffers) / 16, buffers}}
+	aw.rows = aw.rows[:0]
+	return writeArrowMessage(aw.w, arrowHeaderRecordBatch, batch, body)
+}
+
+// writeSchema types the columns, those without a known type by their first
+// value, and writes the schema message.
+func (aw *arrowWriter) writeSchema() error {
+	aw.fields = make([]arrowField, 0, len(aw.columns))
+	var fields []flatTable
+	for _, name := range aw.columns {
+		typ, ok := aw.types[name]
+		if !ok {
+			typ = ColumnTypeString
+			for _, row := range aw.rows {
+				if v := row[name]; v != nil {
+					typ = valueColumnType(v)
+					break
+				}
+			}
+		}
+		aw.fields = append(aw.fields, arrowField{name: name, typ: typ})
+		var typeID uint8
+		var arrowType flatTable
+		switch typ {
+		case ColumnTypeBool:
+			typeID, arrowType = arrowBool, flatTable{}
+		case ColumnTypeInt32:
+			typeID, arrowType = arrowInt, flatTable{int32(32), true}
+		case ColumnTypeInt64:
+			typeID, arrowType = arrowInt, flatTable{int32(64), true}
+		case ColumnTypeUint64:
+			typeID, arrowType = arrowInt, flatTable{int32(64), false}
+		case ColumnTypeFloat64:
+			typeID, arrowType = arrowFloatingPoint, flatTable{int16(arrowPrecisionDouble)}
+		case ColumnTypeTime:
+			typeID, arrowType = arrowTimestamp, flatTable{int16(arrowNanosecond), "UTC"}
+		default:
+			typeID, arrowType = arrowUtf8, flatTable{}
+		}
+		// Field: name, nullable, type, dictionary, children, metadata.
+		field := flatTable{name, true, typeID, arrowType, nil, []flatTable{}, nil}
+		if typ == ColumnTypeJSON {
+			field[6] = []flatTable{{arrowExtensionKey, "arrow.json"}}
+		}
+		fields = append(fields, field)
+	}
+	return writeArrowMessage(aw.w, arrowHeaderSchema, flatTable{nil, fields}, nil)
+}
+
+// close writes the buffered rows, the schema if no rows were, and the end of
+// the stream.
+func (aw *arrowWriter) close() error {
+	if len(aw.rows) > 0 || aw.fields == nil {
+		if err := aw.flush(); err != nil {
+			return err
+		}
+	}
+	_, err := aw.w.Write(binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, arrowContinuation), 0))
+	return err
+}
+
+// writeArrowMessage writes a message with a header table and body.
+func writeArrowMessage(w io.Writer, headerType uint8, header flatTable, body []byte) error {
+	meta := encodeFlatBuffer(flatTable{int16(arrowMetadataV5), headerType, header, int64(len(body))})
+	meta = append(meta, make([]byte, padding(len(meta), 8))...)
+	prefix := binary.LittleEndian.AppendUint32(nil, arrowContinuation)
+	prefix = binary.LittleEndian.AppendUint32(prefix, uint32(len(meta)))
+	for _, b := range [][]byte{prefix, meta, body} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// padding returns the bytes needed to pad n bytes to a multiple of align.
+func padding(n, align int) int {
+	return (align - n%align) % align
+}
+
+func buildArrowArray(field arrowField, rows []map[string]any) (arrowArray, error) {
+	var arr arrowArray
+	validity := make([]byte, (len(rows)+7)/8)
+	switch field.typ {
+	case ColumnTypeBool:
+		arr.data = make([]byte, (len(rows)+7)/8)
+	case ColumnTypeString, ColumnTypeJSON:
+		arr.offsets = make([]byte, 4, 4*(len(rows)+1))
+	}
+	for i, row := range rows {
+		v := row[field.name]
+		if v != nil {
+			validity[i/8] |= 1 << (i % 8)
+		} else {
+			arr.nullCount++
+		}
+		var fits bool
+		switch field.typ {
+		case ColumnTypeBool:
+			b, ok := v.(bool)
+			if b {
+				arr.data[i/8] |= 1 << (i % 8)
+			}
+			fits = ok
+		case ColumnTypeInt32:
+			var n int64
+			if fits = valueFitsColumnType(v, ColumnTypeInt32); fits && v != nil {
+				n = valueToInt64(v)
+			}
+			arr.data = binary.LittleEndian.AppendUint32(arr.data, uint32(int32(n)))
+		case ColumnTypeInt64, ColumnTypeUint64:
+			var n uint64
+			if fits = valueFitsColumnType(v, field.typ); fits && v != nil {
+				n = toUint64(v)
+			}
+			arr.data = binary.LittleEndian.AppendUint64(arr.data, n)
+		case ColumnTypeFloat64:
+			var f float64
+			if fits = valueColumnType(v) == ColumnTypeFloat64; fits {
+				f = valueToFloat64(v)
+			}
+			arr.data = binary.LittleEndian.AppendUint64(arr.data, math.Float64bits(f))
+		case ColumnTypeTime:
+			var ns int64
+			// The timestamp column holds UnixNano integers.
+			if t := valueColumnType(v); t == ColumnTypeTime || t == ColumnTypeInt64 {
+				ns, fits = valueToTime(v).UnixNano(), true
+			}
+			arr.data = binary.LittleEndian.AppendUint64(arr.data, uint64(ns))
+		case ColumnTypeJSON:
+			if v != nil {
+				arr.data = append(arr.data, encodeJSONValue(v)...)
+			}
+			arr.offsets, fits = binary.LittleEndian.AppendUint32(arr.offsets, uint32(len(arr.data))), true
+		default:
+			s, ok := v.(string)
+			arr.data = append(arr.data, s...)
+			arr.offsets, fits = binary.LittleEndian.AppendUint32(arr.offsets, uint32(len(arr.data))), ok
+		}
+		if v != nil && !fits {
+			return arr, fmt.Errorf("column %s holds a %T value, which is not a %s", field.name, v, field.typ)
+		}
+	}
+	if len(arr.data) > math.MaxInt32 {
+		return arr, fmt.Errorf("column %s holds more than 2 GiB in a record batch", field.name)
+	}
+	if arr.nullCount > 0 {
+		arr.validity = validity
+	}
+	return arr, nil
+}
+
+// ImportArrow appends the rows of an Apache Arrow IPC stream, such as
+// ExportArrow writes, a record batch at a time, returning the number of rows
+// appended. Index and timestamp columns are skipped, and utf8 columns with
+// the arrow.json extension are appended as JSON values. Columns must be of
+// the Arrow types bool, integers, float32, float64, timestamps, utf8 or
+// large_utf8; dictionaries and compressed batches are not supported.
+func (s *ColumnarStore) ImportArrow(r io.Reader) (int64, error) {
+	br := bufio.NewReader(r)
+	var fields []arrowField
+	var appended int64
+	for {
+		typ, header, body, err := readArrowMessage(br)
+		if err == io.EOF {
+			return appended, nil
+		}
+		if err != nil {
+			return appended, err
+		}
+		switch {
+		case typ == arrowHeaderSchema && fields == nil:
+			if fields, err = readArrowSchema(header); err != nil {
+				return appended, err
+			}
+		case typ == arrowHeaderRecordBatch && fields != nil:
+			rows, err := readArrowBatch(fields, header, body)
+			if err != nil {
+				return appended, err
+			}
+			if len(rows) == 0 {
+				continue
+			}
+			if err := s.AppendBatch(rows); err != nil {
+				return appended, err
+			}
+			appended += int64(len(rows))
+		case typ == arrowHeaderDictionaryBatch:
+			return appended, errors.New("arrow dictionaries are not supported")
+		default:
+			return appended, fmt.Errorf("unexpected arrow message of type %d", typ)
+		}
+	}
+}
+
+var errArrowCorrupt = errors.New("arrow stream is corrupt")
+
+// readArrowMessage reads the next message of a stream, returning io.EOF at
+// its end.
+func readArrowMessage(r io.Reader) (uint8, flatReader, []byte, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, flatReader{}, nil, err
+	}
+	size := binary.LittleEndian.Uint32(b[:])
+	// Streams written before Arrow 0.15 have no continuation marker.
+	if size == arrowContinuation {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, flatReader{}, nil, unexpectedEOF(err)
+		}
+		size = binary.LittleEndian.Uint32(b[:])
+	}
+	if size == 0 {
+		return 0, flatReader{}, nil, io.EOF
+	}
+	var meta bytes.Buffer
+	if _, err := io.CopyN(&meta, r, int64(size)); err != nil {
+		return 0, flatReader{}, nil, unexpectedEOF(err)
+	}
+	msg, err := readFlatBuffer(meta.Bytes())
+	if err != nil {
+		return 0, flatReader{}, nil, err
+	}
+	header, ok := msg.table(2)
+	bodyLength := msg.int64(3)
+	if !ok || bodyLength < 0 {
+		return 0, flatReader{}, nil, errArrowCorrupt
+	}
+	var body bytes.Buffer
+	if _, err := io.CopyN(&body, r, bodyLength); err != nil {
+		return 0, flatReader{}, nil, unexpectedEOF(err)
+	}
+	return msg.uint8(1), header, body.Bytes(), nil
+}
+
+// readArrowSchema returns the fields of a schema message.
+func readArrowSchema(schema flatReader) ([]arrowField, error) {
+	fields := []arrowField{}
+	for _, f := range schema.tables(1) {
+		field := arrowField{name: f.string(0)}
+		if _, ok := f.table(4); ok {
+			return nil, fmt.Errorf("arrow column %s is dictionary encoded, which is not supported", field.name)
+		}
+		for _, kv := range f.tables(6) {
+			if kv.string(0) == arrowExtensionKey && kv.string(1) == "arrow.json" {
+				field.json = true
+			}
+		}
+		t, _ := f.table(3)
+		switch typ := f.uint8(2); typ {
+		case arrowBool:
+			field.typ = ColumnTypeBool
+		case arrowInt:
+			field.width, field.signed = int(t.int32(0))/8, t.bool(1)
+			switch {
+			case !slices.Contains([]int{1, 2, 4, 8}, field.width):
+				return nil, fmt.Errorf("arrow column %s has integers of %d bits", field.name, t.int32(0))
+			case field.width == 4 && field.signed:
+				field.typ = ColumnTypeInt32
+			case field.width == 8 && !field.signed:
+				field.typ = ColumnTypeUint64
+			default:
+				field.typ = ColumnTypeInt64
+			}
+		case arrowFloatingPoint:
+			switch t.int16(0) {
+			case arrowPrecisionSingle:
+				field.width = 4
+			case arrowPrecisionDouble:
+				field.width = 8
+			default:
+				return nil, fmt.Errorf("arrow column %s has half precision floats, which are not supported", field.name)
+			}
+			field.typ = ColumnTypeFloat64
+		case arrowTimestamp:
+			unit := t.int16(0)
+			if unit < 0 || unit > arrowNanosecond {
+				return nil, fmt.Errorf("arrow column %s has an unknown time unit %d", field.name, unit)
+			}
+			field.typ, field.unit = ColumnTypeTime, int64(math.Pow10(9-3*int(unit)))
+		case arrowUtf8, arrowLargeUtf8:
+			field.typ, field.width = ColumnTypeString, 4
+			if typ == arrowLargeUtf8 {
+				field.width = 8
+			}
+			if field.json {
+				field.typ = ColumnTypeJSON
+			}
+		default:
+			return nil, fmt.Errorf("arrow column %s has type %d, which is not supported", field.name, typ)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// readArrowBatch returns the rows of a record batch message.
+func readArrowBatch(fields []arrowField, batch flatReader, body []byte) ([]map[string]any, error) {
+	if _, ok := batch.table(3); ok {
+		return nil, errors.New("compressed arrow record batches are not supported")
+	}
+	n := batch.int64(0)
+	nodes, buffers := batch.structs(1, 16), batch.structs(2, 16)
+	if n < 0 || len(nodes) != len(fields) {
+		return nil, errArrowCorrupt
+	}
+	// buffer returns the next buffer of the body, which must hold size
+	// bytes.
+	buffer := func(size int64) ([]byte, error) {
+		if len(buffers) == 0 {
+			return nil, errArrowCorrupt
+		}
+		offset, length := int64(binary.LittleEndian.Uint64(buffers[0])), int64(binary.LittleEndian.Uint64(buffers[0][8:]))
+		buffers = buffers[1:]
+		if offset < 0 || length < size || offset > int64(len(body)) || length > int64(len(body))-offset {
+			return nil, errArrowCorrupt
+		}
+		return body[offset : offset+length], nil
+	}
+	rows := make([]map[string]any, n)
+	for i := range rows {
+		rows[i] = map[string]any{}
+	}
+	for c, field := range fields {
+		length, nulls := int64(binary.LittleEndian.Uint64(nodes[c])), int64(binary.LittleEndian.Uint64(nodes[c][8:]))
+		if length != n {
+			return nil, errArrowCorrupt
+		}
+		validity, err := buffer(0)
+		if err != nil {
+			return nil, err
+		}
+		if nulls > 0 && int64(len(validity)) < (n+7)/8 {
+			return nil, fmt.Errorf("arrow column %s has a short validity bitmap", field.name)
+		}
+		var offsets []byte
+		size := n * int64(field.width)
+		switch field.typ {
+		case ColumnTypeBool:
+			size = (n + 7) / 8
+		case ColumnTypeTime:
+			size = 8 * n
+		case ColumnTypeString, ColumnTypeJSON:
+			if offsets, err = buffer(size + int64(field.width)); err != nil {
+				return nil, err
+			}
+			size = 0
+		}
+		data, err := buffer(size)
+		if err != nil {
+			return nil, err
+		}
+		if field.name == IndexColumn || field.name == TimestampColumn {
+			continue
+		}
+		for i, row := range rows {
+			if nulls > 0 && validity[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			var v any
+			switch field.typ {
+			case ColumnTypeBool:
+				v = data[i/8]&(1<<(i%8)) != 0
+			case ColumnTypeFloat64:
+				if field.width == 4 {
+					v = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[4*i:])))
+				} else {
+					v = math.Float64frombits(binary.LittleEndian.Uint64(data[8*i:]))
+				}
+			case ColumnTypeTime:
+				v = time.Unix(0, int64(binary.LittleEndian.Uint64(data[8*i:]))*field.unit).UTC()
+			case ColumnTypeString, ColumnTypeJSON:
+				start, end := arrowOffset(offsets, field.width, i), arrowOffset(offsets, field.width, i+1)
+				if start < 0 || start > end || end > int64(len(data)) {
+					return nil, fmt.Errorf("arrow column %s has invalid offsets", field.name)
+				}
+				if field.typ == ColumnTypeJSON {
+					v = json.RawMessage(data[start:end])
+				} else {
+					v = string(data[start:end])
+				}
+			default:
+				v = arrowInteger(field, data[i*field.width:])
+			}
+			row[field.name] = v
+		}
+	}
+	return rows, nil
+}
+
+// arrowOffset returns offset i of a utf8 column with offsets of width bytes.
+func arrowOffset(offsets []byte, width, i int) int64 {
+	if width == 8 {
+		return int64(binary.LittleEndian.Uint64(offsets[8*i:]))
+	}
+	return int64(int32(binary.LittleEndian.Uint32(offsets[4*i:])))
+}
+
+// arrowInteger returns the integer at the start of b as the value of an
+// integer column: int32 for signed 32-bit integers, uint64 for unsigned
+// 64-bit ones, and int64 for others.
+func arrowInteger(field arrowField, b []byte) any {
+	switch {
+	case field.width == 1 && field.signed:
+		return int64(int8(b[0]))
+	case field.width == 1:
+		return int64(b[0])
+	case field.width == 2 && field.signed:
+		return int64(int16(binary.LittleEndian.Uint16(b)))
+	case field.width == 2:
+		return int64(binary.LittleEndian.Uint16(b))
+	case field.width == 4 && field.signed:
+		return int32(binary.LittleEndian.Uint32(b))
+	case field.width == 4:
+		return int64(binary.LittleEndian.Uint32(b))
+	case field.signed:
+		return int64(binary.LittleEndian.Uint64(b))
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+// flatTable is a FlatBuffers table to encode, holding the value of each field
+// by field ID, or nil for fields left out. Values are bool, uint8, int16,
+// int32 and int64 scalars, strings, tables, vectors of tables ([]flatTable)
+// and vectors of structs (flatStructs). Union fields are a uint8 type
+// followed by a table.
+type flatTable []any
+
+// flatStructs is a vector of n structs aligned to 8 bytes, encoded in data.
+type flatStructs struct {
+	n    int
+	data []byte
+}
+
+// encodeFlatBuffer returns the FlatBuffers encoding of a root table. Objects
+// are laid out front to back, each table after its vtable and before the
+// objects it refers to.
+func encodeFlatBuffer(root flatTable) []byte {
+	e := &flatEncoder{buf: make([]byte, 4)}
+	binary.LittleEndian.PutUint32(e.buf, uint32(e.table(root)))
+	return e.buf
+}
+
+type flatEncoder struct {
+	buf []byte
+}
+
+// align pads the buffer until the byte written skip bytes after its end is
+// aligned to align bytes.
+func (e *flatEncoder) align(align, skip int) {
+	e.buf = append(e.buf, make([]byte, padding(len(e.buf)+skip, align))...)
+}
+
+// flatSize returns the size of a field within its table.
+func flatSize(v any) int {
+	switch v.(type) {
+	case bool, uint8:
+		return 1
+	case int16:
+		return 2
+	case int64:
+		return 8
+	}
+	return 4
+}
+
+// table encodes a table, returning its position.
+func (e *flatEncoder) table(t flatTable) int {
+	// Fields are placed largest first, after the offset to the vtable, so
+	// that each is aligned.
+	offsets := make([]int, len(t))
+	size := 4
+	for _, n := range []int{8, 4, 2, 1} {
+		for id, v := range t {
+			if v != nil && flatSize(v) == n {
+				size += padding(size, n)
+				offsets[id], size = size, size+n
+			}
+		}
+	}
+	e.align(2, 0)
+	vtable := len(e.buf)
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(4+2*len(t)))
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(size))
+	for _, o := range offsets {
+		e.buf = binary.LittleEndian.AppendUint16(e.buf, uint16(o))
+	}
+	e.align(8, 0)
+	pos := len(e.buf)
+	e.buf = append(e.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(e.buf[pos:], uint32(pos-vtable))
+	for id, v := range t {
+		field := pos + offsets[id]
+		switch v := v.(type) {
+		case nil:
+		case bool:
+			if v {
+				e.buf[field] = 1
+			}
+		case uint8:
+			e.buf[field] = v
+		case int16:
+			binary.LittleEndian.PutUint16(e.buf[field:], uint16(v))
+		case int32:
+			binary.LittleEndian.PutUint32(e.buf[field:], uint32(v))
+		case int64:
+			binary.LittleEndian.PutUint64(e.buf[field:], uint64(v))
+		default:
+			// Objects are appended, so the buffer is indexed only after.
+			offset := e.object(v) - field
+			binary.LittleEndian.PutUint32(e.buf[field:], uint32(offset))
+		}
+	}
+	return pos
+}
+
+// object encodes a string, table or vector, returning its position.
+func (e *flatEncoder) object(v any) int {
+	switch v := v.(type) {
+	case string:
+		e.align(4, 0)
+		pos := len(e.buf)
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, uint32(len(v)))
+		e.buf = append(append(e.buf, v...), 0)
+		return pos
+	case flatTable:
+		return e.table(v)
+	case []flatTable:
+		e.align(4, 0)
+		pos := len(e.buf)
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, uint32(len(v)))
+		e.buf = append(e.buf, make([]byte, 4*len(v))...)
+		for i, t := range v {
+			elem := pos + 4 + 4*i
+			offset := e.table(t) - elem
+			binary.LittleEndian.PutUint32(e.buf[elem:], uint32(offset))
+		}
+		return pos
+	case flatStructs:
+		e.align(8, 4)
+		pos := len(e.buf)
+		e.buf = binary.LittleEndian.AppendUint32(e.buf, uint32(v.n))
+		e.buf = append(e.buf, v.data...)
+		return pos
+	}
+	panic(fmt.Sprintf("cannot encode %T in a FlatBuffer", v))
+}
+
+// flatReader reads a FlatBuffers table. Fields that are absent, or out of the
+// bounds of the buffer, read as zero values.
+type flatReader struct {
+	buf []byte
+	// pos is the position of the table, and vtable that of its vtable.
+	pos, vtable int
+	vsize, size int
+}
+
+// readFlatBuffer returns the root table of a FlatBuffer.
+func readFlatBuffer(buf []byte) (flatReader, error) {
+	if len(buf) < 4 {
+		return flatReader{}, errArrowCorrupt
+	}
+	t, ok := flatTableAt(buf, int64(binary.LittleEndian.Uint32(buf)))
+	if !ok {
+		return flatReader{}, errArrowCorrupt
+	}
+	return t, nil
+}
+
+func flatTableAt(buf []byte, pos int64) (flatReader, bool) {
+	if pos < 0 || pos > int64(len(buf))-4 {
+		return flatReader{}, false
+	}
+	vtable := pos - int64(int32(binary.LittleEndian.Uint32(buf[pos:])))
+	if vtable < 0 || vtable > int64(len(buf))-4 {
+		return flatReader{}, false
+	}
+	t := flatReader{buf: buf, pos: int(pos), vtable: int(vtable)}
+	t.vsize = int(binary.LittleEndian.Uint16(buf[vtable:]))
+	t.size = int(binary.LittleEndian.Uint16(buf[vtable+2:]))
+	if t.vsize < 4 || t.vtable+t.vsize > len(buf) || t.size < 4 || t.pos+t.size > len(buf) {
+		return flatReader{}, false
+	}
+	return t, true
+}
+
+// field returns the position of a field of n bytes, or -1 if it is absent.
+func (t flatReader) field(id, n int) int {
+	entry := 4 + 2*id
+	if entry+2 > t.vsize {
+		return -1
+	}
+	offset := int(binary.LittleEndian.Uint16(t.buf[t.vtable+entry:]))
+	if offset < 4 || offset+n > t.size {
+		return -1
+	}
+	return t.pos + offset
+}
+
+func (t flatReader) uint8(id int) uint8 {
+	if p := t.field(id, 1); p >= 0 {
+		return t.buf[p]
+	}
+	return 0
+}
+
+func (t flatReader) bool(id int) bool {
+	return t.uint8(id) != 0
+}
+
+func (t flatReader) int16(id int) int16 {
+	if p := t.field(id, 2); p >= 0 {
+		return int16(binary.LittleEndian.Uint16(t.buf[p:]))
+	}
+	return 0
+}
+
+func (t flatReader) int32(id int) int32 {
+	if p := t.field(id, 4); p >= 0 {
+		return int32(binary.LittleEndian.Uint32(t.buf[p:]))
+	}
+	return 0
+}
+
+func (t flatReader) int64(id int) int64 {
+	if p := t.field(id, 8); p >= 0 {
+		return int64(binary.LittleEndian.Uint64(t.buf[p:]))
+	}
+	return 0
+}
+
+// ref returns the position of the object a field refers to.
+func (t flatReader) ref(id int) (int64, bool) {
+	p := t.field(id, 4)
+	if p < 0 {
+		return 0, false
+	}
+	return int64(p) + int64(binary.LittleEndian.Uint32(t.buf[p:])), true
+}
+
+func (t flatReader) table(id int) (flatReader, bool) {
+	pos, ok := t.ref(id)
+	if !ok {
+		return flatReader{}, false
+	}
+	return flatTableAt(t.buf, pos)
+}
+
+// vector returns the position of the elements of a vector of elements of
+// size bytes, and their number.
+func (t flatReader) vector(id, size int) (int64, int) {
+	pos, ok := t.ref(id)
+	if !ok || pos > int64(len(t.buf))-4 {
+		return 0, 0
+	}
+	n := int64(binary.LittleEndian.Uint32(t.buf[pos:]))
+	if n*int64(size) > int64(len(t.buf))-pos-4 {
+		return 0, 0
+	}
+	return pos + 4, int(n)
+}
+
+func (t flatReader) string(id int) string {
+	pos, n := t.vector(id, 1)
+	return string(t.buf[pos : pos+int64(n)])
+}
+
+func (t flatReader) tables(id int) []flatReader {
+	pos, n := t.vector(id, 4)
+	var tables []flatReader
+	for i := range int64(n) {
+		elem := pos + 4*i
+		if table, ok := flatTableAt(t.buf, elem+int64(binary.LittleEndian.Uint32(t.buf[elem:]))); ok {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// structs returns the encodings of the structs of size bytes in a vector.
+func (t flatReader) structs(id, size int) [][]byte {
+	pos, n := t.vector(id, size)
+	structs := make([][]byte, n)
+	for i := range structs {
+		start := pos + int64(i*size)
+		structs[i] = t.buf[start : start+int64(size)]
+	}
+	return structs
+}
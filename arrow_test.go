@@ -0,0 +1,99 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrow(t *testing.T) {
+	cs := newTestStore(t)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"name": "ab", "n": 1, "ok": true, "at": at, "meta": map[string]any{"k": 1}},
+		{"name": "c", "ok": false, "score": 1.5},
+		{"n": 3, "ok": true},
+	}))
+
+	defer func(n int) { arrowBatchSize = n }(arrowBatchSize)
+	arrowBatchSize = 2
+	var buf bytes.Buffer
+	require.NoError(t, cs.ExportArrow(&buf, &Query{Select: []string{"name", "n", "ok", "at", "meta", "score"}}))
+	stream := bytes.Clone(buf.Bytes())
+	assert.Equal(t, uint32(arrowContinuation), binary.LittleEndian.Uint32(stream))
+	assert.Zero(t, binary.LittleEndian.Uint32(stream[4:])%8, "metadata is padded to 8 bytes")
+	assert.Equal(t, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, stream[len(stream)-8:])
+	assert.Contains(t, buf.String(), "arrow.json")
+
+	// A schema is followed by a batch of 2 rows and one of 1.
+	var types []uint8
+	r := bytes.NewReader(stream)
+	for {
+		typ, _, _, err := readArrowMessage(r)
+		if err != nil {
+			break
+		}
+		types = append(types, typ)
+	}
+	assert.Equal(t, []uint8{arrowHeaderSchema, arrowHeaderRecordBatch, arrowHeaderRecordBatch}, types)
+
+	copied := newTestStore(t)
+	n, err := copied.ImportArrow(bytes.NewReader(stream))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	q := &Query{Select: []string{"name", "n", "ok", "at", "meta.k", "score"}}
+	want, err := cs.Query(q)
+	require.NoError(t, err)
+	got, err := copied.Query(q)
+	require.NoError(t, err)
+	for i := range want {
+		delete(want[i], TimestampColumn)
+		delete(got[i], TimestampColumn)
+	}
+	assert.Equal(t, want, got)
+
+	// Empty results are a schema and the end of the stream.
+	buf.Reset()
+	require.NoError(t, cs.ExportArrow(&buf, &Query{Select: []string{"name"}, Where: Where("name", ConditionEquals, "zz")}))
+	n, err = copied.ImportArrow(&buf)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// Streams cut within a message are errors.
+	for _, i := range []int{6, 20, len(stream) - 12} {
+		_, err := newTestStore(t).ImportArrow(bytes.NewReader(stream[:i]))
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF, "stream cut at %d", i)
+	}
+	corrupt := bytes.Clone(stream)
+	for i := 8; i < len(corrupt); i += 3 {
+		corrupt[i] ^= 0x5a
+	}
+	assert.NotPanics(t, func() { newTestStore(t).ImportArrow(bytes.NewReader(corrupt)) })
+}
+
+func TestFlatBuffer(t *testing.T) {
+	buf := encodeFlatBuffer(flatTable{int16(4), uint8(3), flatTable{"name", true, []flatTable{{"k", "v"}}}, int64(1 << 40), nil, flatStructs{1, make([]byte, 16)}})
+	root, err := readFlatBuffer(buf)
+	require.NoError(t, err)
+	assert.Equal(t, int16(4), root.int16(0))
+	assert.Equal(t, uint8(3), root.uint8(1))
+	assert.Equal(t, int64(1<<40), root.int64(3))
+	assert.Zero(t, root.int32(4), "absent fields are zero")
+	assert.Zero(t, root.int32(9))
+	child, ok := root.table(2)
+	require.True(t, ok)
+	assert.Equal(t, "name", child.string(0))
+	assert.True(t, child.bool(1))
+	kvs := child.tables(2)
+	require.Len(t, kvs, 1)
+	assert.Equal(t, "v", kvs[0].string(1))
+	structs := root.structs(5, 16)
+	require.Len(t, structs, 1)
+	pos, _ := root.vector(5, 16)
+	assert.Zero(t, pos%8, "structs are aligned to 8 bytes")
+}
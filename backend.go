@@ -0,0 +1,97 @@
+package querystore
+
+import (
+	"io"
+	"os"
+)
+
+// ColumnBackend stores the files of a store, which are otherwise kept in the
+// operating system's file system, letting stores live in memory, in an
+// fs.FS, or behind a layer such as encryption. Its methods behave as the os
+// functions of the same name: paths are slash-separated, and errors for
+// missing files satisfy os.IsNotExist. Files removed or renamed over while
+// open must remain readable through the open file, and a backend must be
+// safe for concurrent use.
+type ColumnBackend interface {
+	OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	MkdirAll(name string, perm os.FileMode) error
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+}
+
+// BackendFile is an open file of a ColumnBackend, which *os.File implements.
+// Stores open files with os.O_RDONLY, os.O_WRONLY or os.O_RDWR, combined
+// with os.O_CREATE, os.O_APPEND, os.O_TRUNC or os.O_EXCL.
+type BackendFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// OSBackend stores files in the operating system's file system. It is the
+// default backend.
+type OSBackend struct{}
+
+func (OSBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	fp, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (OSBackend) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (OSBackend) ReadDir(name string) ([]os.DirEntry, error) { return os.ReadDir(name) }
+func (OSBackend) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(name, perm)
+}
+func (OSBackend) Rename(oldname, newname string) error { return os.Rename(oldname, newname) }
+func (OSBackend) Remove(name string) error             { return os.Remove(name) }
+func (OSBackend) RemoveAll(name string) error          { return os.RemoveAll(name) }
+
+// readFile reads the whole of a file of a backend.
+func readFile(b ColumnBackend, name string) ([]byte, error) {
+	fp, err := b.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return io.ReadAll(fp)
+}
+
+// writeFile replaces the contents of a file of a backend, creating it if
+// needed.
+func writeFile(b ColumnBackend, name string, data []byte) error {
+	fp, err := b.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write(data)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// truncateFile changes the size of a file of a backend.
+func truncateFile(b ColumnBackend, name string, size int64) error {
+	fp, err := b.OpenFile(name, os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+	err = fp.Truncate(size)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
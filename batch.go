@@ -0,0 +1,601 @@
+package querystore
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// batchSize is the number of rows whose filters are evaluated together.
+const batchSize = 1024
+
+// vector holds the values of a column for a batch of rows, decoded without
+// boxing. valid marks the rows with a value. Fixed-width values are held in
+// bits as in rawValue, and strings in strs.
+type vector struct {
+	typ   ColumnType
+	valid []bool
+	bits  []uint64
+	strs  []string
+	// arena collects the bytes of a batch's strings while it is decoded, and
+	// spans locates each row's string in it. The strings are then cut from
+	// a single allocation.
+	arena []byte
+	spans [][2]int
+}
+
+func newVector(typ ColumnType) *vector {
+	v := &vector{typ: typ, valid: make([]bool, batchSize)}
+	if typ == ColumnTypeString {
+		v.strs = make([]string, batchSize)
+		v.spans = make([][2]int, batchSize)
+	} else {
+		v.bits = make([]uint64, batchSize)
+	}
+	return v
+}
+
+// box returns the value of row j of the batch.
+func (v *vector) box(j int) any {
+	switch {
+	case !v.valid[j]:
+		return nil
+	case v.typ == ColumnTypeString:
+		return v.strs[j]
+	}
+	return rawValue{bits: v.bits[j]}.box(v.typ)
+}
+
+// set stores the value v of a record over rows [from, to) of the batch.
+func (v *vector) set(from, to int, raw rawValue) {
+	if raw.null {
+		return
+	}
+	if v.typ == ColumnTypeString {
+		span := [2]int{len(v.arena), len(v.arena) + len(raw.data)}
+		v.arena = append(v.arena, raw.data...)
+		for j := from; j < to; j++ {
+			v.valid[j], v.spans[j] = true, span
+		}
+		return
+	}
+	for j := from; j < to; j++ {
+		v.valid[j], v.bits[j] = true, raw.bits
+	}
+}
+
+// cutStrings sets the strings of a decoded batch of n rows from the arena.
+func (v *vector) cutStrings(n int) {
+	if v.typ != ColumnTypeString {
+		return
+	}
+	arena := string(v.arena)
+	for j, ok := range v.valid[:n] {
+		if ok {
+			v.strs[j] = arena[v.spans[j][0]:v.spans[j][1]]
+		}
+	}
+	v.arena = v.arena[:0]
+}
+
+// rawFromValue converts a value decoded by decodeRecord back to a rawValue.
+func rawFromValue(typ ColumnType, v any) rawValue {
+	switch v := v.(type) {
+	case nil:
+		return rawValue{null: true}
+	case bool:
+		if v {
+			return rawValue{bits: 1}
+		}
+		return rawValue{}
+	case int64:
+		return rawValue{bits: uint64(v)}
+	case uint64:
+		return rawValue{bits: v}
+	case float64:
+		return rawValue{bits: math.Float64bits(v)}
+	case time.Time:
+		return rawValue{bits: uint64(v.UnixNano())}
+	case string:
+		return rawValue{data: []byte(v)}
+	}
+	panic(fmt.Sprintf("unsupported type: %T", v))
+}
+
+// readBatch decodes the values of the rows [start, start+n) into v. Like
+// SeekToIndex it only moves forward, and leaves the reader at the first
+// record after the batch.
+func (cr *ColumnReader) readBatch(start int64, n int, v *vector) error {
+	end := start + int64(n)
+	clear(v.valid[:n])
+	if cr.nextBlock < len(cr.blocks) && start >= cr.blocks[cr.nextBlock].firstIndex && start > cr.curIndex {
+		if err := cr.skipTo(start); err != nil {
+			return err
+		}
+	}
+	// The record last read may cover rows of the batch.
+	if cr.curVal != nil && cr.curIndex < end {
+		from, to := max(cr.curIndex, start), min(max(cr.runEnd, cr.curIndex+1), end)
+		if from < to {
+			v.set(int(from-start), int(to-start), rawFromValue(cr.typ, cr.curVal))
+		}
+	}
+	for !cr.eof && cr.curIndex < end && cr.runEnd < end {
+		index, raw, run, err := cr.readRawRecord()
+		if err == io.EOF {
+			cr.eof = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		cr.curIndex, cr.runEnd, cr.curVal = index, index+run, nil
+		if index+run > end {
+			// Keep the record for the next batch or seek.
+			cr.curVal = raw.box(cr.typ)
+		}
+		if from, to := max(index, start), min(index+run, end); from < to {
+			v.set(int(from-start), int(to-start), raw)
+		}
+	}
+	v.cutStrings(n)
+	return nil
+}
+
+// batchPredicate is a predicate evaluated over batches of rows.
+type batchPredicate interface {
+	// evalBatch sets the mask of rows [start, start+n) that match.
+	evalBatch(start int64, n int) ([]bool, error)
+	// record adds the values that eval would record for row j of the last
+	// batch, which must have matched.
+	record(j int, row map[string]any) error
+	// nextCandidate returns the lowest row at or after end that may match,
+	// given the batch that ended there.
+	nextCandidate(end int64) int64
+	// lastMask returns the mask of the last batch evaluated.
+	lastMask() []bool
+}
+
+// batchColumn holds the vector of a column for the current batch, shared by
+// the filters on the column.
+type batchColumn struct {
+	cr    *ColumnReader
+	vec   *vector
+	start int64
+	n     int
+}
+
+// load decodes the batch [start, start+n) unless it is already loaded.
+func (c *batchColumn) load(start int64, n int) error {
+	if c.vec != nil && c.start == start && c.n == n {
+		return nil
+	}
+	if c.vec == nil {
+		c.vec = newVector(c.cr.typ)
+	}
+	if err := c.cr.readBatch(start, n, c.vec); err != nil {
+		c.vec = nil
+		return err
+	}
+	c.start, c.n = start, n
+	return nil
+}
+
+// compileBatchPredicate binds an expression to batch columns, or returns nil
+// if some filter of the expression cannot be evaluated in batches, such as
+// filters on JSON paths or missing columns.
+func compileBatchPredicate(e *FilterExpression, readers map[string]valueReader, columns map[string]*batchColumn, prepared map[*Filter]*compiledFilter) (batchPredicate, error) {
+	switch {
+	case e.Filter != nil:
+		cr, ok := readers[e.Filter.Attribute].(*ColumnReader)
+		if !ok {
+			return nil, nil
+		}
+		return compileBatchFilter(*e.Filter, cr, columns, prepared[e.Filter])
+	case e.Not != nil:
+		p, err := compileBatchPredicate(e.Not, readers, columns, prepared)
+		if p == nil {
+			return nil, err
+		}
+		return &batchNot{p: p, mask: make([]bool, batchSize)}, nil
+	}
+	exprs, or := e.And, false
+	if len(e.Or) > 0 {
+		exprs, or = e.Or, true
+	}
+	ps := make([]batchPredicate, len(exprs))
+	for i, sub := range exprs {
+		p, err := compileBatchPredicate(sub, readers, columns, prepared)
+		if p == nil {
+			return nil, err
+		}
+		ps[i] = p
+	}
+	return &batchCombination{ps: ps, or: or, mask: make([]bool, batchSize)}, nil
+}
+
+// batchCombination is an AND or OR of predicates. Like the row predicates,
+// it stops evaluating once the result is known for every row of a batch.
+type batchCombination struct {
+	ps   []batchPredicate
+	or   bool
+	mask []bool
+	// evaluated is the number of predicates evaluated for the last batch.
+	evaluated int
+}
+
+func (b *batchCombination) evalBatch(start int64, n int) ([]bool, error) {
+	mask := b.mask[:n]
+	for j := range mask {
+		mask[j] = !b.or
+	}
+	b.evaluated = 0
+	for _, p := range b.ps {
+		sub, err := p.evalBatch(start, n)
+		if err != nil {
+			return nil, err
+		}
+		b.evaluated++
+		decided := true
+		for j, ok := range sub {
+			if b.or {
+				mask[j] = mask[j] || ok
+			} else {
+				mask[j] = mask[j] && ok
+			}
+			decided = decided && mask[j] == b.or
+		}
+		if decided {
+			break
+		}
+	}
+	return mask, nil
+}
+
+func (b *batchCombination) record(j int, row map[string]any) error {
+	for _, p := range b.ps[:b.evaluated] {
+		if err := p.record(j, row); err != nil {
+			return err
+		}
+		// Stop where eval would have stopped for the row.
+		if p.lastMask()[j] == b.or {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *batchCombination) lastMask() []bool { return b.mask }
+
+func (b *batchCombination) nextCandidate(end int64) int64 {
+	if b.or {
+		next := int64(math.MaxInt64)
+		for _, p := range b.ps {
+			next = min(next, p.nextCandidate(end))
+		}
+		return next
+	}
+	next := end
+	for _, p := range b.ps[:b.evaluated] {
+		next = max(next, p.nextCandidate(end))
+	}
+	return next
+}
+
+type batchNot struct {
+	p    batchPredicate
+	mask []bool
+}
+
+func (b *batchNot) evalBatch(start int64, n int) ([]bool, error) {
+	sub, err := b.p.evalBatch(start, n)
+	if err != nil {
+		return nil, err
+	}
+	mask := b.mask[:n]
+	for j, ok := range sub {
+		mask[j] = !ok
+	}
+	return mask, nil
+}
+
+func (b *batchNot) record(j int, row map[string]any) error { return b.p.record(j, row) }
+
+func (b *batchNot) lastMask() []bool { return b.mask }
+
+func (b *batchNot) nextCandidate(end int64) int64 { return end }
+
+// batchFilter evaluates a filter over the vector of its column.
+type batchFilter struct {
+	f     *compiledFilter
+	col   *batchColumn
+	mask  []bool
+	start int64
+	n     int
+	// skipped is set when zone maps ruled out the last batch, and zoneNext
+	// is then the first row after it that may match.
+	skipped  bool
+	zoneNext int64
+	// test checks a value present in the vector.
+	test func(v *vector, j int) bool
+}
+
+// vectorType reports whether columns of a type can be decoded into vectors.
+func vectorType(typ ColumnType) bool {
+	return typ != ColumnTypeJSON
+}
+
+func compileBatchFilter(f Filter, cr *ColumnReader, columns map[string]*batchColumn, prepared *compiledFilter) (batchPredicate, error) {
+	if !vectorType(cr.typ) {
+		return nil, nil
+	}
+	cf, err := compileFilter(f, cr, prepared)
+	if err != nil {
+		return nil, err
+	}
+	test, ok := vectorTest(cf)
+	if !ok {
+		return nil, nil
+	}
+	col := columns[f.Attribute]
+	if col == nil {
+		col = &batchColumn{cr: cr}
+		columns[f.Attribute] = col
+	}
+	return &batchFilter{f: cf, col: col, mask: make([]bool, batchSize), test: test}, nil
+}
+
+func (b *batchFilter) evalBatch(start int64, n int) ([]bool, error) {
+	b.start, b.n, b.skipped = start, n, false
+	mask := b.mask[:n]
+	if b.f.indexed {
+		clear(mask)
+		for i := b.f.nextRow(start); i < start+int64(n); i = b.f.nextRow(i + 1) {
+			mask[i-start] = true
+		}
+		return mask, nil
+	}
+	if b.f.zoned {
+		if next, _ := b.col.cr.skipBlocks(start, b.f.blockMayMatch); next >= start+int64(n) {
+			clear(mask)
+			b.skipped, b.zoneNext = true, next
+			return mask, nil
+		}
+	}
+	if err := b.col.load(start, n); err != nil {
+		return nil, err
+	}
+	v := b.col.vec
+	switch b.f.Condition {
+	case ConditionIsNull:
+		for j := range mask {
+			mask[j] = !v.valid[j]
+		}
+	case ConditionIsNotNull:
+		copy(mask, v.valid)
+	default:
+		for j := range mask {
+			mask[j] = v.valid[j] && b.test(v, j)
+		}
+	}
+	return mask, nil
+}
+
+func (b *batchFilter) record(j int, row map[string]any) error {
+	if b.f.Condition == ConditionIsNull {
+		return nil
+	}
+	if err := b.col.load(b.start, b.n); err != nil {
+		return err
+	}
+	if v := b.col.vec.box(j); v != nil {
+		row[b.f.Attribute] = v
+	}
+	return nil
+}
+
+func (b *batchFilter) lastMask() []bool { return b.mask }
+
+func (b *batchFilter) nextCandidate(end int64) int64 {
+	switch {
+	case b.f.indexed:
+		return b.f.nextRow(end)
+	case b.skipped:
+		return max(end, b.zoneNext)
+	case b.f.Condition == ConditionIsNull:
+		return end
+	}
+	return b.col.cr.nextIndex(end - 1)
+}
+
+// vectorTest returns a test of vector values equivalent to a bound filter's
+// comparison, or false if the filter has none.
+func vectorTest(f *compiledFilter) (func(v *vector, j int) bool, bool) {
+	switch f.Condition {
+	case ConditionIsNull, ConditionIsNotNull:
+		return nil, true
+	}
+	if !f.bound {
+		return nil, false
+	}
+	switch f.typ {
+	case ColumnTypeBool:
+		test, ok := comparableTest(f, func(v any) bool { return v.(bool) })
+		return func(v *vector, j int) bool { return test(v.bits[j] == 1) }, ok
+	case ColumnTypeInt64:
+		test, ok := orderedTest(f, func(v any) int64 { return v.(int64) })
+		return func(v *vector, j int) bool { return test(int64(v.bits[j])) }, ok
+	case ColumnTypeTime:
+		test, ok := orderedTest(f, func(v any) int64 { return v.(time.Time).UnixNano() })
+		return func(v *vector, j int) bool { return test(int64(v.bits[j])) }, ok
+	case ColumnTypeUint64:
+		test, ok := orderedTest(f, func(v any) uint64 { return v.(uint64) })
+		return func(v *vector, j int) bool { return test(v.bits[j]) }, ok
+	case ColumnTypeFloat64:
+		test, ok := orderedTest(f, func(v any) float64 { return v.(float64) })
+		return func(v *vector, j int) bool { return test(math.Float64frombits(v.bits[j])) }, ok
+	case ColumnTypeString:
+		test, ok := stringTest(f)
+		return func(v *vector, j int) bool { return test(v.strs[j]) }, ok
+	}
+	return nil, false
+}
+
+func comparableTest[T comparable](f *compiledFilter, cast func(any) T) (func(T) bool, bool) {
+	switch f.Condition {
+	case ConditionEquals:
+		target := cast(f.value)
+		return func(x T) bool { return x == target }, true
+	case ConditionNotEquals:
+		target := cast(f.value)
+		return func(x T) bool { return x != target }, true
+	case ConditionIn, ConditionNotIn:
+		set := make(map[T]bool, len(f.value.(valueSet)))
+		for v := range f.value.(valueSet) {
+			set[cast(v)] = true
+		}
+		in := f.Condition == ConditionIn
+		return func(x T) bool { return set[x] == in }, true
+	}
+	return nil, false
+}
+
+func orderedTest[T cmp.Ordered](f *compiledFilter, cast func(any) T) (func(T) bool, bool) {
+	switch f.Condition {
+	case ConditionLessThan:
+		target := cast(f.value)
+		return func(x T) bool { return x < target }, true
+	case ConditionLessThanOrEquals:
+		target := cast(f.value)
+		return func(x T) bool { return x <= target }, true
+	case ConditionGreaterThan:
+		target := cast(f.value)
+		return func(x T) bool { return x > target }, true
+	case ConditionGreaterThanOrEquals:
+		target := cast(f.value)
+		return func(x T) bool { return x >= target }, true
+	}
+	return comparableTest(f, cast)
+}
+
+func stringTest(f *compiledFilter) (func(string) bool, bool) {
+	switch f.Condition {
+	case ConditionContains:
+		target := f.value.(string)
+		return func(s string) bool { return strings.Contains(s, target) }, true
+	case ConditionStartsWith:
+		target := f.value.(string)
+		return func(s string) bool { return strings.HasPrefix(s, target) }, true
+	case ConditionEndsWith:
+		target := f.value.(string)
+		return func(s string) bool { return strings.HasSuffix(s, target) }, true
+	case ConditionMatches:
+		re := f.value.(*regexp.Regexp)
+		return re.MatchString, true
+	}
+	return orderedTest(f, func(v any) string { return v.(string) })
+}
+
+// bindAggregateColumns binds the attributes of the cursor's aggregations to
+// batch columns, reporting false if some cannot be decoded into vectors.
+func (c *cursor) bindAggregateColumns() bool {
+	// Weights are read along with the values they weigh, from rows.
+	if slices.ContainsFunc(c.agg.aggs, func(a Aggregation) bool { return a.Weight != "" }) {
+		return false
+	}
+	// Columns are only added to batchCols once all are bound, as rows read
+	// the columns in batchCols from vectors.
+	added := map[string]*batchColumn{}
+	bind := func(attr string) (*batchColumn, bool) {
+		if c.readers[attr] == nil {
+			return nil, true
+		}
+		cr, ok := c.readers[attr].(*ColumnReader)
+		if !ok || !vectorType(cr.typ) {
+			return nil, false
+		}
+		col := cmp.Or(c.batchCols[attr], added[attr])
+		if col == nil {
+			col = &batchColumn{cr: cr}
+			added[attr] = col
+		}
+		return col, true
+	}
+	c.aggCols = make([]*batchColumn, len(c.agg.aggs))
+	for i, a := range c.agg.aggs {
+		var ok bool
+		if c.aggCols[i], ok = bind(a.Attribute); !ok {
+			return false
+		}
+	}
+	c.groupCols = make([]*batchColumn, len(c.agg.groupBy))
+	for i, col := range c.agg.groupBy {
+		var ok bool
+		if c.groupCols[i], ok = bind(col); !ok {
+			return false
+		}
+	}
+	maps.Copy(c.batchCols, added)
+	return true
+}
+
+// aggregateBatches aggregates the remaining rows a batch at a time, adding
+// values straight from vectors rather than building rows.
+func (c *cursor) aggregateBatches() error {
+	all := make([]bool, batchSize)
+	for j := range all {
+		all[j] = true
+	}
+	vecs := make([]*vector, len(c.aggCols))
+	groups := make([]*vector, len(c.groupCols))
+	for c.next < c.lastID {
+		if err := c.ctx.Err(); err != nil {
+			return err
+		}
+		start := c.next
+		n := int(min(batchSize, c.lastID-start))
+		end := start + int64(n)
+		mask := all[:n]
+		c.scanned += n
+		if c.batch != nil {
+			var err error
+			if mask, err = c.batch.evalBatch(start, n); err != nil {
+				return err
+			}
+			if !slices.Contains(mask, true) {
+				c.next = max(end, min(c.batch.nextCandidate(end), c.lastID))
+				continue
+			}
+		}
+		load := func(col *batchColumn) (*vector, error) {
+			if col == nil {
+				return nil, nil
+			}
+			if err := col.load(start, n); err != nil {
+				return nil, err
+			}
+			return col.vec, nil
+		}
+		for i, col := range c.aggCols {
+			var err error
+			if vecs[i], err = load(col); err != nil {
+				return err
+			}
+		}
+		for i, col := range c.groupCols {
+			var err error
+			if groups[i], err = load(col); err != nil {
+				return err
+			}
+		}
+		c.agg.addBatch(mask, vecs, groups)
+		c.next = end
+	}
+	return nil
+}
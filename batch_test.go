@@ -0,0 +1,156 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchFilters(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 64
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{
+		{Name: "n", Type: ColumnTypeInt64},
+		{Name: "f", Type: ColumnTypeFloat64},
+		{Name: "s", Type: ColumnTypeString, Codec: CodecFlate},
+		{Name: "b", Type: ColumnTypeBool, Encoding: EncodingRLE},
+		{Name: "t", Type: ColumnTypeTime},
+		{Name: "doc", Type: ColumnTypeJSON},
+	}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	base := time.Unix(1700000000, 0).UTC()
+	var rows []map[string]any
+	for i := 0; i < 3000; i++ {
+		row := map[string]any{"f": float64(i) / 2, "s": fmt.Sprintf("k%02d", i%50), "b": i/100%2 == 0}
+		if i%5 != 0 {
+			row["n"] = int64(i)
+		}
+		if i%400 < 10 {
+			row["t"] = base.Add(time.Duration(i) * time.Second)
+			row["doc"] = map[string]any{"n": i}
+		}
+		rows = append(rows, row)
+		if len(rows) == 700 {
+			require.NoError(t, cs.AppendBatch(rows))
+			rows = nil
+		}
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	indexes := func(where *FilterExpression) []int64 {
+		rows, err := cs.Query(&Query{Where: where, Select: []string{"n"}})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) int64 { return row[IndexColumn].(int64) })
+	}
+	expect := func(match func(i int) bool) []int64 {
+		var out []int64
+		for i := 0; i < 3000; i++ {
+			if match(i) {
+				out = append(out, int64(i))
+			}
+		}
+		return out
+	}
+
+	assert.Equal(t, expect(func(i int) bool { return i%5 != 0 && i >= 2990 }), indexes(Where("n", ConditionGreaterThanOrEquals, 2990)))
+	assert.Equal(t, expect(func(i int) bool { return i%5 == 0 }), indexes(Where("n", ConditionIsNull, nil)))
+	assert.Equal(t, expect(func(i int) bool { return i%5 != 0 && i != 7 }), indexes(Where("n", ConditionNotEquals, 7)))
+	assert.Equal(t, expect(func(i int) bool { return i%5 != 0 && (i == 3 || i == 2999) }), indexes(Where("n", ConditionIn, []int{3, 5, 2999})))
+	assert.Equal(t, expect(func(i int) bool { return float64(i)/2 < 3 }), indexes(Where("f", ConditionLessThan, 3)))
+	assert.Equal(t, expect(func(i int) bool { return i%50 == 42 }), indexes(Where("s", ConditionEquals, "k42")))
+	assert.Equal(t, expect(func(i int) bool { return i%50 >= 40 }), indexes(Where("s", ConditionStartsWith, "k4")))
+	assert.Equal(t, expect(func(i int) bool { return i%50 < 10 }), indexes(Where("s", ConditionMatches, "^k0")))
+	assert.Equal(t, expect(func(i int) bool { return i/100%2 == 1 }), indexes(Where("b", ConditionEquals, false)))
+	assert.Equal(t, expect(func(i int) bool { return i%400 < 10 && i >= 5 }), indexes(Where("t", ConditionGreaterThanOrEquals, base.Add(5*time.Second))))
+	assert.Equal(t, expect(func(i int) bool { return i/100%2 == 0 && i%50 == 1 || i == 2998 }),
+		indexes(Or(And(Where("b", ConditionEquals, true), Where("s", ConditionEquals, "k01")), Where("f", ConditionEquals, 1499))))
+	assert.Equal(t, expect(func(i int) bool { return !(i%400 < 10) && i%50 == 0 }),
+		indexes(And(Not(Where("t", ConditionIsNotNull, nil)), Where("s", ConditionEndsWith, "00"))))
+	// Filters on JSON paths are evaluated row by row alongside batch filters.
+	assert.Equal(t, expect(func(i int) bool { return i%400 < 10 && i > 2000 }),
+		indexes(And(Where("doc.n", ConditionGreaterThan, 2000), Where("f", ConditionGreaterThan, 1000))))
+
+	// Rows hold the values read by the filters, as with row-by-row
+	// evaluation.
+	got, err := cs.Query(&Query{Where: Or(Where("n", ConditionEquals, 52), Where("s", ConditionEquals, "k02")), Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"n": int64(2), "s": "k02"}, {"n": int64(52)}}, lo.Map(got, func(row map[string]any, _ int) map[string]any {
+		return lo.OmitByKeys(row, []string{IndexColumn, TimestampColumn})
+	}))
+}
+
+func TestVectorAggregates(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	var rows []map[string]any
+	for i := 0; i < 5000; i++ {
+		row := map[string]any{"val": i - 1000, "price": float64(i) / 8, "group": strconv.Itoa(i % 3)}
+		if i%4 == 0 {
+			row["big"] = uint64(i)
+			row["name"] = fmt.Sprintf("n%04d", i)
+		}
+		rows = append(rows, row)
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	aggs := []Aggregation{
+		{Type: AggregatorCount},
+		{Type: AggregatorCount, Attribute: "big"},
+		{Type: AggregatorSum, Attribute: "val"},
+		{Type: AggregatorSum, Attribute: "big"},
+		{Type: AggregatorMin, Attribute: "val"},
+		{Type: AggregatorMax, Attribute: "price"},
+		{Type: AggregatorMin, Attribute: "name"},
+		{Type: AggregatorAvg, Attribute: "price"},
+		{Type: AggregatorMax, Attribute: "missing"},
+	}
+	queries := []*Query{
+		{Aggregations: aggs},
+		{Aggregations: aggs, GroupBy: "group"},
+		{Aggregations: aggs, GroupBy: "missing"},
+		{Aggregations: aggs, GroupBy: "name", Where: Where("val", ConditionLessThan, -900)},
+		{Aggregations: aggs, GroupBy: "group", Where: Or(Where("big", ConditionGreaterThan, 4000), Where("price", ConditionLessThan, 10))},
+	}
+	for _, q := range queries {
+		rows, err := cs.Query(q)
+		require.NoError(t, err)
+		require.NotEmpty(t, rows)
+		// A time range makes the query aggregate row by row.
+		rq := *q
+		rq.TimeRange = TimeRange{Start: time.Unix(0, 1)}
+		want, err := cs.Query(&rq)
+		require.NoError(t, err)
+		assert.Equal(t, want, rows)
+	}
+
+	rows, err = cs.Query(&Query{Aggregations: aggs})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"count":        int64(5000),
+		"count(big)":   int64(1250),
+		"sum(val)":     int64(5000*4999/2 - 5000*1000),
+		"sum(big)":     uint64(4 * 1249 * 1250 / 2),
+		"min(val)":     int64(-1000),
+		"max(price)":   4999.0 / 8,
+		"min(name)":    "n0000",
+		"avg(price)":   4999.0 / 16,
+		"max(missing)": nil,
+	}, rows[0])
+}
@@ -0,0 +1,173 @@
+package querystore
+
+import (
+	"math"
+	"math/bits"
+	"slices"
+)
+
+// bitmap is a compressed set of rows in the style of roaring bitmaps. Rows
+// are split by their high bits into chunks of 65536, each stored as a sorted
+// array of low bits while sparse and as a bitset once dense. Rows are added
+// in increasing order, so appends only modify the last chunk.
+type bitmap struct {
+	keys   []int64
+	chunks []*chunk
+}
+
+// chunkArrayMax is the most rows a chunk holds as an array, beyond which a
+// bitset is smaller.
+const chunkArrayMax = 4096
+
+type chunk struct {
+	array []uint16
+	bits  []uint64
+}
+
+func (c *chunk) add(low uint16) {
+	if c.bits != nil {
+		c.bits[low/64] |= 1 << (low % 64)
+		return
+	}
+	if n := len(c.array); n > 0 && c.array[n-1] == low {
+		return
+	}
+	c.array = append(c.array, low)
+	if len(c.array) > chunkArrayMax {
+		c.bits = make([]uint64, 1024)
+		for _, v := range c.array {
+			c.bits[v/64] |= 1 << (v % 64)
+		}
+		c.array = nil
+	}
+}
+
+// next returns the first low bits at or after low in the chunk, or -1.
+func (c *chunk) next(low int) int {
+	if c.bits == nil {
+		i, _ := slices.BinarySearch(c.array, uint16(low))
+		if i == len(c.array) {
+			return -1
+		}
+		return int(c.array[i])
+	}
+	w := low / 64
+	word := c.bits[w] >> (low % 64)
+	if word != 0 {
+		return low + bits.TrailingZeros64(word)
+	}
+	for w++; w < len(c.bits); w++ {
+		if c.bits[w] != 0 {
+			return w*64 + bits.TrailingZeros64(c.bits[w])
+		}
+	}
+	return -1
+}
+
+func (c *chunk) contains(low uint16) bool {
+	if c.bits != nil {
+		return c.bits[low/64]&(1<<(low%64)) != 0
+	}
+	_, ok := slices.BinarySearch(c.array, low)
+	return ok
+}
+
+func (c *chunk) clone() *chunk {
+	return &chunk{array: slices.Clone(c.array), bits: slices.Clone(c.bits)}
+}
+
+// add adds a row, which must not be below any row already in the bitmap.
+func (b *bitmap) add(row int64) {
+	key := row >> 16
+	if n := len(b.keys); n == 0 || b.keys[n-1] != key {
+		b.keys = append(b.keys, key)
+		b.chunks = append(b.chunks, &chunk{})
+	}
+	b.chunks[len(b.chunks)-1].add(uint16(row))
+}
+
+// next returns the first row at or after row in the bitmap, or math.MaxInt64
+// if there is none.
+func (b *bitmap) next(row int64) int64 {
+	i, _ := slices.BinarySearch(b.keys, row>>16)
+	for low := int(uint16(row)); i < len(b.keys); i, low = i+1, 0 {
+		if b.keys[i] > row>>16 {
+			low = 0
+		}
+		if v := b.chunks[i].next(low); v >= 0 {
+			return b.keys[i]<<16 | int64(v)
+		}
+	}
+	return math.MaxInt64
+}
+
+func (b *bitmap) contains(row int64) bool {
+	i, ok := slices.BinarySearch(b.keys, row>>16)
+	return ok && b.chunks[i].contains(uint16(row))
+}
+
+// count returns the number of rows in [start, end) in the bitmap.
+func (b *bitmap) count(start, end int64) int64 {
+	var n int64
+	for row := b.next(start); row < end; row = b.next(row + 1) {
+		n++
+	}
+	return n
+}
+
+// fill sets mask[j] for the rows start+j in the bitmap, clearing the rest.
+func (b *bitmap) fill(mask []bool, start int64) {
+	clear(mask)
+	end := start + int64(len(mask))
+	for row := b.next(start); row < end; row = b.next(row + 1) {
+		mask[row-start] = true
+	}
+}
+
+// snapshot returns a copy of the bitmap that later adds leave unchanged.
+// Only the last chunk can change, so the others are shared.
+func (b *bitmap) snapshot() *bitmap {
+	s := &bitmap{keys: slices.Clone(b.keys), chunks: slices.Clone(b.chunks)}
+	if n := len(s.chunks); n > 0 {
+		s.chunks[n-1] = s.chunks[n-1].clone()
+	}
+	return s
+}
+
+// andBitmaps returns the rows in both a and b.
+func andBitmaps(a, b *bitmap) *bitmap {
+	out := &bitmap{}
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		switch {
+		case a.keys[i] < b.keys[j]:
+			i++
+		case a.keys[i] > b.keys[j]:
+			j++
+		default:
+			base := a.keys[i] << 16
+			x, y := a.chunks[i], b.chunks[j]
+			if x.bits != nil && y.bits == nil {
+				x, y = y, x
+			}
+			for low := x.next(0); low >= 0; low = x.next(low + 1) {
+				if y.contains(uint16(low)) {
+					out.add(base | int64(low))
+				}
+				if low == math.MaxUint16 {
+					break
+				}
+			}
+			i, j = i+1, j+1
+		}
+	}
+	return out
+}
+
+// orBitmaps returns the rows in a or b.
+func orBitmaps(a, b *bitmap) *bitmap {
+	out := &bitmap{}
+	for row := min(a.next(0), b.next(0)); row != math.MaxInt64; row = min(a.next(row+1), b.next(row+1)) {
+		out.add(row)
+	}
+	return out
+}
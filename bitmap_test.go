@@ -0,0 +1,75 @@
+package querystore
+
+import (
+	"math"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBitmapIndexes(t *testing.T) {
+	var a, b bitmap
+	var wantAnd, wantOr []int64
+	for row := range int64(200000) {
+		inA, inB := row%3 == 0 || row > 140000, row%7 == 0 && row < 150000
+		if inA {
+			a.add(row)
+		}
+		if inB {
+			b.add(row)
+		}
+		if inA && inB {
+			wantAnd = append(wantAnd, row)
+		}
+		if inA || inB {
+			wantOr = append(wantOr, row)
+		}
+	}
+	members := func(b *bitmap) []int64 {
+		var out []int64
+		for row := b.next(0); row != math.MaxInt64; row = b.next(row + 1) {
+			out = append(out, row)
+		}
+		return out
+	}
+	assert.Equal(t, wantAnd, members(andBitmaps(&a, &b)))
+	assert.Equal(t, wantOr, members(orBitmaps(&a, &b)))
+	assert.Equal(t, int64(len(wantAnd)), andBitmaps(&a, &b).count(0, 200000))
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFSWithOptions(dir, Options{BitmapIndexes: []string{"flag", "color"}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	colors := []string{"red", "green", "blue"}
+	var recs []map[string]any
+	for i := range 3000 {
+		recs = append(recs, map[string]any{"val": i, "flag": i%4 == 0, "color": colors[i%3]})
+	}
+	require.NoError(t, cs.AppendBatch(recs))
+
+	count := func(where *FilterExpression) any {
+		rows, err := cs.Query(&Query{Where: where, Aggregations: []Aggregation{{Type: AggregatorCount}}})
+		require.NoError(t, err)
+		return rows[0]["count"]
+	}
+	redFlags := And(Where("flag", ConditionEquals, true), Where("color", ConditionEquals, "red"))
+	assert.Equal(t, int64(250), count(redFlags))
+	assert.Equal(t, int64(125), count(And(redFlags, Where("val", ConditionLessThan, 1500))))
+	assert.Equal(t, int64(2250), count(Or(Where("flag", ConditionEquals, true), And(Where("color", ConditionIn, []string{"red", "green"}), Where("flag", ConditionEquals, false)))))
+
+	rows, err := cs.Query(&Query{Select: []string{"val"}, Where: And(redFlags, Where("val", ConditionGreaterThan, 2950))})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(2952), int64(2964), int64(2976), int64(2988)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+
+	p, err := cs.Plan(&Query{Where: redFlags})
+	require.NoError(t, err)
+	assert.True(t, p.Filters[0].Bitmap)
+	assert.Equal(t, int64(750), p.Filters[0].EstimatedRows)
+	assert.Equal(t, int64(250), p.EstimatedRows)
+}
@@ -0,0 +1,289 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"slices"
+	"sort"
+)
+
+// blockIndexInterval is the number of records in each block of a column file.
+// The block index records where each block starts so that readers can skip
+// directly to the block holding a row.
+var blockIndexInterval int64 = 4096
+
+// blockIndexExt is appended to a column file's path to name its block index.
+const blockIndexExt = ".idx"
+
+// blockEntry locates the first record of a block. Block index files are a
+// sequence of entries, each encoded as two little-endian int64s.
+type blockEntry struct {
+	firstIndex int64
+	offset     int64
+}
+
+func (ch *ColumnHandle) blockIndexPath() string {
+	return ch.path + blockIndexExt
+}
+
+// loadBlockIndex loads the block index and file size of the column on first
+// use. Entries missing from the index file, because it was lost or predates
+// the last appends, are rebuilt by scanning the end of the column file.
+func (ch *ColumnHandle) loadBlockIndex() error {
+	if ch.blocksLoaded {
+		return nil
+	}
+	fi, err := ch.backend.Stat(ch.path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		ch.size = fi.Size()
+	}
+
+	data, err := readFile(ch.backend, ch.blockIndexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var blocks []blockEntry
+	for len(data) >= 16 {
+		e := blockEntry{
+			firstIndex: int64(binary.LittleEndian.Uint64(data[:8])),
+			offset:     int64(binary.LittleEndian.Uint64(data[8:16])),
+		}
+		if e.offset < ch.dataOffset || e.offset >= ch.size {
+			break
+		}
+		if n := len(blocks); n > 0 && (e.offset <= blocks[n-1].offset || e.firstIndex <= blocks[n-1].firstIndex) {
+			break
+		}
+		blocks = append(blocks, e)
+		data = data[16:]
+	}
+	stale := len(data) > 0
+
+	// Count the records of the last block, adding entries for any blocks
+	// after it.
+	fill := blockIndexInterval
+	start := ch.dataOffset
+	if len(blocks) > 0 {
+		fill, start = 0, blocks[len(blocks)-1].offset
+	}
+	if ch.size > start {
+		cr, err := ch.createReaderAt(start)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		for {
+			offset := cr.position()
+			index, v, run, err := cr.readRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if ch.rle() && ch.codec == nil {
+				ch.lastRun = &rleRun{start: index, end: index + run, value: v, countOffset: cr.position() - 4, written: true}
+			}
+			if fill >= blockIndexInterval && (len(blocks) == 0 || offset > blocks[len(blocks)-1].offset) {
+				blocks = append(blocks, blockEntry{firstIndex: index, offset: offset})
+				fill = 0
+				stale = true
+			}
+			fill++
+		}
+	}
+
+	if stale && !ch.readOnly {
+		if err := writeFile(ch.backend, ch.blockIndexPath(), encodeBlockEntries(nil, blocks)); err != nil {
+			return err
+		}
+	}
+	ch.blocks = blocks
+	ch.blockFill = fill
+	if err := ch.loadZones(); err != nil {
+		return err
+	}
+	if err := ch.loadBlooms(); err != nil {
+		return err
+	}
+	if err := ch.loadSketches(); err != nil {
+		return err
+	}
+	if err := ch.loadChecksums(); err != nil {
+		return err
+	}
+	if err := ch.loadValueIndex(); err != nil {
+		return err
+	}
+	ch.blocksLoaded = true
+	return nil
+}
+
+func encodeBlockEntries(dst []byte, blocks []blockEntry) []byte {
+	for _, e := range blocks {
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(e.firstIndex))
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(e.offset))
+	}
+	return dst
+}
+
+// appendBlockEntries records new blocks in memory and in the index file.
+func (ch *ColumnHandle) appendBlockEntries(blocks []blockEntry) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+	ch.blocks = append(ch.blocks, blocks...)
+	if ch.idxFp == nil {
+		fp, err := ch.backend.OpenFile(ch.blockIndexPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+		if err != nil {
+			return err
+		}
+		ch.idxFp = fp
+	}
+	_, err := ch.idxFp.Write(encodeBlockEntries(nil, blocks))
+	return err
+}
+
+// resetBlockIndex discards the block index, zone map, bloom filters,
+// distinct sketches, checksums and value indexes, which are rebuilt on next use.
+func (ch *ColumnHandle) resetBlockIndex() error {
+	ch.unloadBlockIndex()
+	for _, path := range ch.sidecarPaths() {
+		if err := ch.backend.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// unloadBlockIndex closes the sidecar files of a column and drops what was
+// loaded from them, to be loaded again on next use.
+func (ch *ColumnHandle) unloadBlockIndex() {
+	for _, fp := range []BackendFile{ch.idxFp, ch.zoneFp, ch.bloomFp, ch.sketchFp, ch.crcFp, ch.tailFp} {
+		if fp != nil {
+			fp.Close()
+		}
+	}
+	ch.idxFp, ch.zoneFp, ch.bloomFp, ch.sketchFp, ch.crcFp, ch.tailFp = nil, nil, nil, nil, nil, nil
+	ch.blocks, ch.blockFill, ch.zones, ch.sums, ch.tail, ch.lastRun, ch.blocksLoaded = nil, 0, nil, nil, blockTail{}, nil, false
+	ch.blooms, ch.sketches, ch.values, ch.bitmaps = nil, nil, nil, nil
+}
+
+// sidecarPaths returns the paths of the files kept beside a column file.
+func (ch *ColumnHandle) sidecarPaths() []string {
+	return []string{ch.blockIndexPath(), ch.zoneMapPath(), ch.bloomPath(), ch.sketchPath(), ch.checksumPath(), ch.tailChecksumPath()}
+}
+
+// dataEnd returns the offset at which the next record will be written.
+func (ch *ColumnHandle) dataEnd() int64 {
+	if ch.size == 0 && ch.version >= formatVersion {
+		return headerSize
+	}
+	return ch.size
+}
+
+// skipTo moves the reader to the start of the block holding targetIndex, if
+// that is ahead of its current position.
+func (cr *ColumnReader) skipTo(targetIndex int64) error {
+	i := sort.Search(len(cr.blocks), func(i int) bool { return cr.blocks[i].firstIndex > targetIndex }) - 1
+	cr.nextBlock = i + 1
+	if i < 0 {
+		return nil
+	}
+	e := cr.blocks[i]
+	if e.offset <= cr.position() {
+		return nil
+	}
+	if err := cr.jump(e.offset); err != nil {
+		return err
+	}
+	cr.curIndex = e.firstIndex - 1
+	cr.curVal = nil
+	cr.runEnd = 0
+	return nil
+}
+
+// jump repositions the reader at a file offset.
+func (cr *ColumnReader) jump(offset int64) error {
+	cr.frame, cr.framePos = cr.frame[:0], 0
+	switch {
+	case cr.mapped != nil:
+		cr.buf, cr.pos, cr.bufOffset = cr.mapped[offset:], 0, offset
+	case offset < cr.bufOffset+int64(len(cr.buf)):
+		cr.pos = int(offset - cr.bufOffset)
+	default:
+		if _, err := cr.fp.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		cr.buf, cr.pos, cr.bufOffset = cr.buf[:0], 0, offset
+	}
+	return nil
+}
+
+// blockSnapshot returns the block entries of the column for a reader. Entries
+// are never modified once written, so the slice can be shared.
+func (ch *ColumnHandle) blockSnapshot() []blockEntry {
+	return slices.Clip(ch.blocks)
+}
+
+// timestampAt reads the append timestamp of a row from the index file, whose
+// records have a fixed size.
+func (fs *ColumnFS) timestampAt(index int64) (int64, error) {
+	fp, err := fs.backend.OpenFile(fs.indexHandle.path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	return readTimestampAt(fp, fs.indexHandle.dataOffset, index)
+}
+
+func readTimestampAt(fp io.ReaderAt, dataOffset, index int64) (int64, error) {
+	var b [8]byte
+	if _, err := fp.ReadAt(b[:], dataOffset+16*index+8); err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+// rowRange returns the rows [start, end) that may have been appended within
+// a time range, using the fact that timestamps never decrease.
+func (fs *ColumnFS) rowRange(r TimeRange) (start, end int64, err error) {
+	end = fs.nextID
+	if r.IsZero() || end == 0 {
+		return 0, end, nil
+	}
+	fp, err := fs.backend.OpenFile(fs.indexHandle.path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fp.Close()
+
+	// firstAtOrAfter finds the first row stamped at or after t.
+	firstAtOrAfter := func(t int64) (int64, error) {
+		var searchErr error
+		i := sort.Search(int(end), func(i int) bool {
+			ts, err := readTimestampAt(fp, fs.indexHandle.dataOffset, int64(i))
+			if err != nil {
+				searchErr = err
+				return true
+			}
+			return ts >= t
+		})
+		return int64(i), searchErr
+	}
+	if !r.Start.IsZero() {
+		if start, err = firstAtOrAfter(r.Start.UnixNano()); err != nil {
+			return 0, 0, err
+		}
+	}
+	if !r.End.IsZero() {
+		if end, err = firstAtOrAfter(r.End.UnixNano()); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, max(start, end), nil
+}
@@ -0,0 +1,95 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockIndex(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 50 {
+		rec := map[string]any{"val": i}
+		if i%10 == 0 {
+			rec["sparse"] = fmt.Sprintf("s%d", i)
+		}
+		require.NoError(t, cs.Append(rec))
+	}
+	assert.Len(t, fs.columnHandles["val"].blocks, 13)
+
+	check := func(cs *ColumnarStore) {
+		rows, err := cs.Query(&Query{Select: []string{"val", "sparse"}, Offset: 37, Limit: 4})
+		require.NoError(t, err)
+		assert.Equal(t, []any{int64(37), int64(38), int64(39), int64(40)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+		assert.Equal(t, "s40", rows[3]["sparse"])
+
+		rows, err = cs.Query(&Query{Select: []string{"sparse"}, Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThan, Value: 44}}})
+		require.NoError(t, err)
+		assert.Len(t, rows, 5)
+
+		ts, err := cs.fs.timestampAt(45)
+		require.NoError(t, err)
+		rows, err = cs.Query(&Query{Select: []string{"val"}, TimeRange: TimeRange{Start: time.Unix(0, ts)}})
+		require.NoError(t, err)
+		require.NotEmpty(t, rows)
+		assert.LessOrEqual(t, rows[0]["val"], int64(45))
+		assert.Equal(t, int64(49), rows[len(rows)-1]["val"])
+	}
+	check(cs)
+	require.NoError(t, fs.Close())
+
+	// Lost or stale block indexes are rebuilt on open.
+	require.NoError(t, os.Remove(fs.columnHandles["val"].blockIndexPath()))
+	require.NoError(t, os.Truncate(fs.columnHandles["sparse"].blockIndexPath(), 20))
+	fs, err = OpenColumnFSWithOptions(dir, Options{MemoryMap: true})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	check(cs)
+	assert.Len(t, fs.columnHandles["val"].blocks, 13)
+	assert.Len(t, fs.columnHandles["sparse"].blocks, 2)
+	require.NoError(t, cs.Append(map[string]any{"val": 50, "sparse": "s50"}))
+	assert.Len(t, fs.columnHandles["val"].blocks, 13)
+	assert.Len(t, fs.columnHandles["sparse"].blocks, 2)
+}
+
+func TestSparseColumnFilters(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 100 {
+		rec := map[string]any{"val": i}
+		if i >= 40 && i < 45 {
+			rec["a"] = i
+		}
+		if i%30 == 0 {
+			rec["b"] = "x"
+		}
+		require.NoError(t, cs.Append(rec))
+	}
+
+	vals := func(where *FilterExpression) []any {
+		rows, err := cs.Query(&Query{Select: []string{"val"}, Where: where})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] })
+	}
+	assert.Equal(t, []any{int64(43), int64(44)}, vals(Where("a", ConditionGreaterThan, 42)))
+	assert.Equal(t, []any{int64(0), int64(30), int64(42), int64(60), int64(90)},
+		vals(Or(Where("a", ConditionEquals, 42), Where("b", ConditionEquals, "x"))))
+	assert.Empty(t, vals(And(Where("a", ConditionIsNotNull, nil), Where("b", ConditionIsNotNull, nil))))
+	assert.Len(t, vals(Not(Where("a", ConditionIsNotNull, nil))), 95)
+	assert.Len(t, vals(Where("a", ConditionIsNull, nil)), 95)
+	assert.Empty(t, vals(Where("missing", ConditionEquals, 1)))
+}
@@ -0,0 +1,259 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// bloomExt is appended to a column file's path to name its bloom filters,
+// which hold a filter of the values of every completed block. Each filter is
+// stored as its number of hash functions and of 64-bit words, as
+// little-endian uint32s, followed by its words.
+const bloomExt = ".bloom"
+
+// bloomFilter is a bloom filter of the values of a block. It is never
+// modified once shared with readers; writes update a copy.
+type bloomFilter struct {
+	k    uint32
+	bits []uint64
+}
+
+// hasBloomFilter reports whether blocks of a column type can keep bloom
+// filters.
+func hasBloomFilter(typ ColumnType) bool {
+	switch typ {
+	case ColumnTypeString, ColumnTypeInt64, ColumnTypeInt32:
+		return true
+	}
+	return false
+}
+
+// newBloomFilter sizes a filter for a block of blockIndexInterval values at a
+// false positive rate.
+func newBloomFilter(rate float64) *bloomFilter {
+	n := float64(blockIndexInterval)
+	m := math.Ceil(-n * math.Log(rate) / (math.Ln2 * math.Ln2))
+	words := max(int(m+63)/64, 1)
+	k := max(uint32(math.Round(float64(words*64)/n*math.Ln2)), 1)
+	return &bloomFilter{k: k, bits: make([]uint64, words)}
+}
+
+func (b *bloomFilter) clone() *bloomFilter {
+	return &bloomFilter{k: b.k, bits: slices.Clone(b.bits)}
+}
+
+// bloomHash hashes a value, cast to its column's type, into the two hashes
+// from which the filter's k hashes are derived.
+func bloomHash(v any) (uint32, uint32) {
+	h := fnv.New64a()
+	switch v := v.(type) {
+	case string:
+		h.Write([]byte(v))
+	case int64:
+		h.Write(binary.LittleEndian.AppendUint64(nil, uint64(v)))
+	}
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum>>32) | 1
+}
+
+func (b *bloomFilter) add(v any) {
+	h1, h2 := bloomHash(v)
+	m := uint32(len(b.bits) * 64)
+	for i := range b.k {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) mayContain(v any) bool {
+	h1, h2 := bloomHash(v)
+	m := uint32(len(b.bits) * 64)
+	for i := range b.k {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) encode(dst []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, b.k)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b.bits)))
+	for _, w := range b.bits {
+		dst = binary.LittleEndian.AppendUint64(dst, w)
+	}
+	return dst
+}
+
+// decodeBloomFilter decodes a filter, returning the number of bytes read, or
+// zero if data does not hold a complete filter.
+func decodeBloomFilter(data []byte) (*bloomFilter, int) {
+	if len(data) < 8 {
+		return nil, 0
+	}
+	k, words := binary.LittleEndian.Uint32(data), int(binary.LittleEndian.Uint32(data[4:]))
+	n := 8 + 8*words
+	if k == 0 || words == 0 || len(data) < n {
+		return nil, 0
+	}
+	b := &bloomFilter{k: k, bits: make([]uint64, words)}
+	for i := range b.bits {
+		b.bits[i] = binary.LittleEndian.Uint64(data[8+8*i:])
+	}
+	return b, n
+}
+
+// bloomed reports whether a column keeps bloom filters. Encrypted columns do
+// not, as their filters would confirm guesses of their values.
+func (ch *ColumnHandle) bloomed() bool {
+	return ch.bloomRate > 0 && !ch.encrypted()
+}
+
+func (ch *ColumnHandle) bloomPath() string {
+	return ch.path + bloomExt
+}
+
+// loadBlooms loads the bloom filters of a column whose block index is loaded,
+// computing filters missing from the bloom file by scanning their blocks.
+func (ch *ColumnHandle) loadBlooms() error {
+	if !ch.bloomed() {
+		return nil
+	}
+	data, err := readFile(ch.backend, ch.bloomPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var blooms []*bloomFilter
+	for len(blooms) < len(ch.blocks)-1 {
+		b, n := decodeBloomFilter(data)
+		if n == 0 {
+			break
+		}
+		blooms = append(blooms, b)
+		data = data[n:]
+	}
+	stale := len(data) > 0
+
+	if len(blooms) < len(ch.blocks) {
+		cr, err := ch.createReaderAt(ch.blocks[len(blooms)].offset)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		blooms = append(blooms, newBloomFilter(ch.bloomRate))
+		for {
+			index, v, _, err := cr.readRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if len(blooms) < len(ch.blocks) && index >= ch.blocks[len(blooms)].firstIndex {
+				blooms = append(blooms, newBloomFilter(ch.bloomRate))
+				stale = true
+			}
+			if v != nil {
+				blooms[len(blooms)-1].add(castValueToColumnType(v, ch.typ))
+			}
+		}
+	}
+
+	if stale && !ch.readOnly {
+		var buf []byte
+		for _, b := range blooms[:max(len(blooms)-1, 0)] {
+			buf = b.encode(buf)
+		}
+		if err := writeFile(ch.backend, ch.bloomPath(), buf); err != nil {
+			return err
+		}
+	}
+	ch.blooms = blooms
+	return nil
+}
+
+// noteBloom adds a value of a pending write to the filter of its block.
+// blockStarted is set if the value starts a block.
+func (p *pendingWrite) noteBloom(v any, blockStarted bool) {
+	if !p.ch.bloomed() {
+		return
+	}
+	switch {
+	case blockStarted || len(p.blooms) == 0 && len(p.ch.blooms) == 0:
+		p.blooms = append(p.blooms, newBloomFilter(p.ch.bloomRate))
+	case len(p.blooms) == 0:
+		p.blooms = append(p.blooms, p.ch.blooms[len(p.ch.blooms)-1].clone())
+		p.replacesOpen = true
+	}
+	if v != nil {
+		p.blooms[len(p.blooms)-1].add(castValueToColumnType(v, p.ch.typ))
+	}
+}
+
+// appendBlooms records the filters of blocks written by p, replacing that of
+// the block open before the write if p added to it, and appends the filters
+// of blocks completed by the write to the bloom file.
+func (ch *ColumnHandle) appendBlooms(p *pendingWrite) error {
+	if !ch.bloomed() || len(p.blooms) == 0 {
+		return nil
+	}
+	blooms := p.blooms
+	if p.replacesOpen {
+		ch.blooms[len(ch.blooms)-1] = blooms[0]
+		blooms = blooms[1:]
+	}
+	completed := len(ch.blooms) - 1
+	ch.blooms = append(ch.blooms, blooms...)
+	var buf []byte
+	for i := max(completed, 0); i < len(ch.blooms)-1; i++ {
+		buf = ch.blooms[i].encode(buf)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if ch.bloomFp == nil {
+		var err error
+		if ch.bloomFp, err = ch.backend.OpenFile(ch.bloomPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm); err != nil {
+			return err
+		}
+	}
+	_, err := ch.bloomFp.Write(buf)
+	return err
+}
+
+// bloomSnapshot returns the bloom filters of a column for a reader. Filters
+// are replaced rather than modified, so they can be shared.
+func (ch *ColumnHandle) bloomSnapshot() []*bloomFilter {
+	return slices.Clone(ch.blooms)
+}
+
+// bloomMayMatch reports whether a block with the given filter may hold a
+// value passing an equality or IN filter.
+func (f *compiledFilter) bloomMayMatch(b *bloomFilter) bool {
+	switch f.Condition {
+	case ConditionEquals:
+		return b.mayContain(f.value)
+	case ConditionIn:
+		for v := range f.value.(valueSet) {
+			if b.mayContain(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// usesBlooms reports whether a filter can skip blocks using bloom filters.
+func (f *compiledFilter) usesBlooms() bool {
+	cr, ok := f.reader.(*ColumnReader)
+	if !ok || !f.bound || len(cr.blooms) == 0 {
+		return false
+	}
+	return f.Condition == ConditionEquals || f.Condition == ConditionIn
+}
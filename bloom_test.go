@@ -0,0 +1,64 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilters(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 16
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "id", Type: ColumnTypeInt64, BloomFilterRate: 0.01},
+		{Name: "name", Type: ColumnTypeString, BloomFilterRate: 0.01},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	// Values are scattered, so zone maps cannot skip blocks.
+	for i := range 200 {
+		id := (i * 7919) % 1000
+		require.NoError(t, cs.Append(map[string]any{"id": id, "name": fmt.Sprintf("user-%d", id)}))
+	}
+
+	check := func(cs *ColumnarStore) {
+		rows, err := cs.Query(&Query{Where: Where("id", ConditionEquals, (123*7919)%1000)})
+		require.NoError(t, err)
+		require.Len(t, rows, 1)
+		assert.Equal(t, int64(123), rows[0][IndexColumn])
+		rows, err = cs.Query(&Query{Select: []string{"id"}, Where: Where("name", ConditionIn, []string{"user-0", "user-919", "user-1"})})
+		require.NoError(t, err)
+		assert.Equal(t, []any{int64(0), int64(919)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["id"] }))
+
+		p, err := cs.Plan(&Query{Where: Where("name", ConditionEquals, "user-1")})
+		require.NoError(t, err)
+		f := p.Filters[0]
+		assert.True(t, f.BloomFilter)
+		assert.Equal(t, 13, f.Blocks)
+		assert.GreaterOrEqual(t, f.SkippedBlocks, 11)
+	}
+	check(cs)
+	blooms := fs.columnHandles["name"].blooms
+	require.Len(t, blooms, 13)
+	require.NoError(t, fs.Close())
+
+	// Lost bloom filters are rebuilt on open.
+	require.NoError(t, os.Remove(fs.columnHandles["name"].bloomPath()))
+	fs, err = OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	defer fs.Close()
+	check(NewColumnarStore(fs))
+	assert.Equal(t, blooms, fs.columnHandles["name"].blooms)
+
+	_, err = OpenColumnFSWithSchema(t.TempDir(), &Schema{Columns: []ColumnSpec{{Name: "ok", Type: ColumnTypeBool, BloomFilterRate: 0.01}}})
+	assert.ErrorContains(t, err, "bloom filters are not supported")
+}
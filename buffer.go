@@ -0,0 +1,132 @@
+package querystore
+
+import (
+	"maps"
+	"time"
+)
+
+// writeBuffer holds rows appended to a store with a write buffer until they
+// are written together. See Options.WriteBufferRows.
+type writeBuffer struct {
+	rows   []map[string]any
+	stamps []int64
+	// sizes estimates the bytes buffered for each column.
+	sizes map[string]int64
+	// types holds the types buffered rows give the columns they create.
+	types map[string]ColumnType
+}
+
+// bufferedSize estimates the bytes a value takes in a column file.
+func bufferedSize(v any) int64 {
+	switch v := v.(type) {
+	case string:
+		return int64(len(v)) + 4
+	case []byte:
+		return int64(len(v)) + 4
+	case []any, map[string]any:
+		return int64(len(encodeJSONValue(v))) + 4
+	}
+	return 8
+}
+
+// bufferRows adds rows stamped with the current time to the write buffer,
+// writing the buffer once it is full. The caller must hold fs.lock.
+func (fs *ColumnFS) bufferRows(rows []map[string]any) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	// Rows are validated now, so that schema violations are reported by
+	// the append that made them.
+	if err := fs.checkRows(rows); err != nil {
+		return err
+	}
+	fs.invalidateCache()
+	ts := fs.nextTimestamp()
+	if fs.buffer.sizes == nil {
+		fs.buffer.sizes = map[string]int64{}
+		fs.buffer.types = map[string]ColumnType{}
+	}
+	full := false
+	for _, row := range rows {
+		fs.buffer.rows = append(fs.buffer.rows, maps.Clone(row))
+		fs.buffer.stamps = append(fs.buffer.stamps, ts)
+		for name, v := range row {
+			if _, ok := fs.buffer.types[name]; !ok && v != nil && fs.columnHandles[name] == nil {
+				fs.buffer.types[name] = valueColumnType(v)
+			}
+			fs.buffer.sizes[name] += bufferedSize(v)
+			if limit := fs.opts.WriteBufferBytes; limit > 0 && fs.buffer.sizes[name] >= limit {
+				full = true
+			}
+		}
+	}
+	if limit := fs.opts.WriteBufferRows; limit > 0 && len(fs.buffer.rows) >= limit {
+		full = true
+	}
+	if full {
+		return fs.flushBuffer()
+	}
+	return nil
+}
+
+// flushBuffer writes the rows of the write buffer in a single write. Rows
+// that fail to be written stay buffered, to be written by the next flush.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) flushBuffer() error {
+	if len(fs.buffer.rows) == 0 {
+		return nil
+	}
+	first := fs.nextID
+	if err := fs.commitRows(fs.buffer.rows, fs.buffer.stamps); err != nil {
+		// Partitioned stores commit the rows of each partition in turn, so
+		// those of partitions before the failure are written.
+		if n := int(fs.nextID - first); n > 0 {
+			fs.buffer.rows, fs.buffer.stamps = fs.buffer.rows[n:], fs.buffer.stamps[n:]
+			fs.buffer.sizes = map[string]int64{}
+			for _, row := range fs.buffer.rows {
+				for name, v := range row {
+					fs.buffer.sizes[name] += bufferedSize(v)
+				}
+			}
+		}
+		return err
+	}
+	fs.buffer = writeBuffer{}
+	return nil
+}
+
+// startFlusher starts writing the write buffer every Options.FlushInterval.
+func (fs *ColumnFS) startFlusher() {
+	fs.stopFlush = make(chan struct{})
+	fs.flushDone = make(chan struct{})
+	go func() {
+		defer close(fs.flushDone)
+		ticker := time.NewTicker(fs.opts.FlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fs.lock.Lock()
+				// Errors resurface when the store is closed.
+				if err := fs.flushBuffer(); err != nil {
+					fs.flushErr = err
+				}
+				fs.lock.Unlock()
+			case <-fs.stopFlush:
+				return
+			}
+		}
+	}()
+}
+
+// stopFlusher stops the background flusher, if running.
+func (fs *ColumnFS) stopFlusher() {
+	if fs.stopFlush != nil {
+		close(fs.stopFlush)
+		<-fs.flushDone
+		fs.stopFlush = nil
+	}
+}
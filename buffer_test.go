@@ -0,0 +1,113 @@
+package querystore
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBuffer(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{
+		WriteBufferRows: 100,
+		Partitioning:    PartitionHourly,
+		Clock:           func() time.Time { return now },
+		Schema:          &Schema{Columns: []ColumnSpec{{Name: "val", Type: ColumnTypeInt64}, {Name: "name", Type: ColumnTypeString}}},
+	}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 150 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i)}))
+		if i == 120 {
+			now = now.Add(time.Hour)
+		}
+	}
+	assert.Len(t, fs.buffer.rows, 50, "the first 100 rows are written together")
+	assert.Equal(t, int64(100), fs.Partitions()[0].Rows)
+	assert.ErrorContains(t, cs.Append(map[string]any{"val": "x"}), "val")
+
+	count := func() int64 {
+		res, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}})
+		require.NoError(t, err)
+		return res[0]["count"].(int64)
+	}
+	assert.Equal(t, int64(150), count(), "queries see buffered rows")
+	assert.Empty(t, fs.buffer.rows)
+	assert.Equal(t, []int64{121, 29}, lo.Map(fs.Partitions(), func(p PartitionInfo, _ int) int64 { return p.Rows }))
+
+	require.NoError(t, cs.Append(map[string]any{"val": int64(150), "name": "last"}))
+	require.NoError(t, fs.Close())
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	assert.Equal(t, int64(151), count(), "Close writes buffered rows")
+
+	// Columns are written once any of them holds WriteBufferBytes.
+	bytesFS, err := OpenColumnFSWithOptions(t.TempDir(), Options{WriteBufferBytes: 64})
+	require.NoError(t, err)
+	defer bytesFS.Close()
+	require.NoError(t, bytesFS.WriteRows([]map[string]any{{"s": strings.Repeat("x", 40)}}))
+	assert.Len(t, bytesFS.buffer.rows, 1)
+	require.NoError(t, bytesFS.WriteRows([]map[string]any{{"s": strings.Repeat("y", 40)}}))
+	assert.Empty(t, bytesFS.buffer.rows)
+
+	_, err = OpenColumnFSWithOptions(t.TempDir(), Options{WriteBufferRows: 10, Durability: DurabilityEveryWrite})
+	assert.ErrorContains(t, err, "DurabilityEveryWrite")
+}
+
+func TestWriteBufferFailure(t *testing.T) {
+	// Rows whose write fails stay buffered until written.
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fs, err := OpenColumnFSWithOptions(dir, Options{
+		WriteBufferRows: 4,
+		Partitioning:    PartitionHourly,
+		Clock:           func() time.Time { return now },
+	})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 0}, {"val": 1}}))
+	now = now.Add(time.Hour)
+	// A file in the way of the next partition's directory fails its write.
+	blocked := filepath.Join(dir, now.Format(PartitionHourly.layout()))
+	require.NoError(t, os.WriteFile(blocked, nil, 0644))
+	assert.Error(t, cs.AppendBatch([]map[string]any{{"val": 2}, {"val": 3}}))
+	assert.Len(t, fs.buffer.rows, 2, "rows of the first partition are written")
+	assert.Equal(t, int64(2), fs.Partitions()[0].Rows)
+	assert.Error(t, fs.Flush())
+
+	require.NoError(t, os.Remove(blocked))
+	require.NoError(t, fs.Flush())
+	assert.Empty(t, fs.buffer.rows)
+	rows, err := cs.Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(0), int64(1), int64(2), int64(3)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+}
+
+func TestWriteBufferTypes(t *testing.T) {
+	// Buffered rows type the columns they create for later appends.
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{WriteBufferRows: 10})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"x": 1}))
+	assert.ErrorIs(t, cs.Append(map[string]any{"x": "abc"}), ErrTypeMismatch)
+	assert.Len(t, fs.buffer.rows, 1)
+
+	rows, err := cs.Query(&Query{Select: []string{"x"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(1), rows[0]["x"])
+	require.NoError(t, cs.Append(map[string]any{"x": 2}))
+	require.NoError(t, fs.Flush())
+}
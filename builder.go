@@ -0,0 +1,414 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Short names of conditions for use with QueryBuilder.
+const (
+	Eq = ConditionEquals
+	Ne = ConditionNotEquals
+	Lt = ConditionLessThan
+	Le = ConditionLessThanOrEquals
+	Gt = ConditionGreaterThan
+	Ge = ConditionGreaterThanOrEquals
+)
+
+// QueryBuilder builds a Query with chained calls, such as
+//
+//	q, err := NewQuery().Where("val", Gt, 10).GroupBy("region").Sum("latency").Limit(100).BuildFor(store)
+//
+// Build and BuildFor check the query against the columns it will run on and
+// report every problem found, rather than the query failing or panicking when
+// it runs.
+type QueryBuilder struct {
+	q     Query
+	where []*FilterExpression
+	errs  []error
+}
+
+// NewQuery returns a builder of a query matching every row.
+func NewQuery() *QueryBuilder {
+	return &QueryBuilder{}
+}
+
+// Select adds columns to return for each matched row; "*" selects every
+// column.
+func (b *QueryBuilder) Select(columns ...string) *QueryBuilder {
+	b.q.Select = append(b.q.Select, columns...)
+	return b
+}
+
+// Compute defines a column computed from an expression over the stored
+// columns, which the query may then select, filter and aggregate by name. See
+// ComputedColumn.
+func (b *QueryBuilder) Compute(name, expr string) *QueryBuilder {
+	b.q.Computed = append(b.q.Computed, ComputedColumn{Name: name, Expr: expr})
+	return b
+}
+
+// Enrich adds virtual columns to matched rows by looking up the value of a
+// column. See Enricher.
+func (b *QueryBuilder) Enrich(column string, lookup func(v any) map[string]any, columns ...string) *QueryBuilder {
+	b.q.Enrichers = append(b.q.Enrichers, Enricher{Column: column, Columns: columns, Lookup: lookup})
+	return b
+}
+
+// Where restricts the query to rows whose attribute passes a condition. It
+// is ANDed with other conditions.
+func (b *QueryBuilder) Where(attribute string, cond ConditionType, value any) *QueryBuilder {
+	return b.WhereExpr(Where(attribute, cond, value))
+}
+
+// WhereExpr restricts the query to rows matching a filter expression. It is
+// ANDed with other conditions.
+func (b *QueryBuilder) WhereExpr(expr *FilterExpression) *QueryBuilder {
+	b.where = append(b.where, expr)
+	return b
+}
+
+// Between restricts the query to rows appended within [start, end).
+func (b *QueryBuilder) Between(start, end time.Time) *QueryBuilder {
+	b.q.TimeRange = TimeRange{Start: start, End: end}
+	return b
+}
+
+// GroupBy computes the query's aggregations for each value of a column, or
+// each combination of values of several.
+func (b *QueryBuilder) GroupBy(columns ...string) *QueryBuilder {
+	b.q.GroupBy, b.q.GroupByColumns = "", columns
+	return b
+}
+
+// GroupByTime computes the query's aggregations for each interval of the
+// time rows were appended, or of a time column if one is given.
+func (b *QueryBuilder) GroupByTime(interval time.Duration, column ...string) *QueryBuilder {
+	b.q.GroupByTime = interval
+	if len(column) > 0 {
+		b.q.GroupByTimeColumn = column[0]
+	}
+	return b
+}
+
+// Count counts the matched rows.
+func (b *QueryBuilder) Count() *QueryBuilder {
+	return b.Aggregate(AggregatorCount, "")
+}
+
+// Sum sums a column over the matched rows.
+func (b *QueryBuilder) Sum(column string) *QueryBuilder {
+	return b.Aggregate(AggregatorSum, column)
+}
+
+// Min computes the least value of a column over the matched rows.
+func (b *QueryBuilder) Min(column string) *QueryBuilder {
+	return b.Aggregate(AggregatorMin, column)
+}
+
+// Max computes the greatest value of a column over the matched rows.
+func (b *QueryBuilder) Max(column string) *QueryBuilder {
+	return b.Aggregate(AggregatorMax, column)
+}
+
+// Avg averages a column over the matched rows.
+func (b *QueryBuilder) Avg(column string) *QueryBuilder {
+	return b.Aggregate(AggregatorAvg, column)
+}
+
+// Percentile estimates a percentile, from 0 to 100, of a column over the
+// matched rows.
+func (b *QueryBuilder) Percentile(column string, p float64) *QueryBuilder {
+	b.q.Aggregations = append(b.q.Aggregations, Aggregation{Type: AggregatorPercentile, Attribute: column, Percentile: p})
+	return b
+}
+
+// Histogram counts the values of a column over the matched rows in the
+// buckets bounded by ascending upper bounds. See Aggregation.Buckets.
+func (b *QueryBuilder) Histogram(column string, bounds ...float64) *QueryBuilder {
+	b.q.Aggregations = append(b.q.Aggregations, Aggregation{Type: AggregatorHistogram, Attribute: column, Buckets: bounds})
+	return b
+}
+
+// TopK finds the k most frequent values of a column over the matched rows.
+// See AggregatorTopK.
+func (b *QueryBuilder) TopK(column string, k int) *QueryBuilder {
+	b.q.Aggregations = append(b.q.Aggregations, Aggregation{Type: AggregatorTopK, Attribute: column, K: k})
+	return b
+}
+
+// TopKBySum finds the k values of a column with the greatest sum of the
+// weight column over the matched rows holding them.
+func (b *QueryBuilder) TopKBySum(column, weight string, k int) *QueryBuilder {
+	b.q.Aggregations = append(b.q.Aggregations, Aggregation{Type: AggregatorTopK, Attribute: column, K: k, Weight: weight})
+	return b
+}
+
+// ApproxDistinct estimates the number of distinct values of a column over the
+// matched rows. See AggregatorApproxDistinct.
+func (b *QueryBuilder) ApproxDistinct(column string) *QueryBuilder {
+	return b.Aggregate(AggregatorApproxDistinct, column)
+}
+
+// Aggregate adds an aggregation of a column to compute.
+func (b *QueryBuilder) Aggregate(typ AggregatorType, column string) *QueryBuilder {
+	b.q.Aggregations = append(b.q.Aggregations, Aggregation{Type: typ, Attribute: column})
+	return b
+}
+
+// As names the result of the last aggregation added.
+func (b *QueryBuilder) As(alias string) *QueryBuilder {
+	if len(b.q.Aggregations) == 0 {
+		b.errs = append(b.errs, fmt.Errorf("alias %s does not follow an aggregation", alias))
+		return b
+	}
+	b.q.Aggregations[len(b.q.Aggregations)-1].Alias = alias
+	return b
+}
+
+// OrderBy sorts the results by a column in ascending order, after any
+// earlier orders.
+func (b *QueryBuilder) OrderBy(column string) *QueryBuilder {
+	b.q.OrderBy = append(b.q.OrderBy, Order{Attribute: column})
+	return b
+}
+
+// OrderByDesc sorts the results by a column in descending order, after any
+// earlier orders.
+func (b *QueryBuilder) OrderByDesc(column string) *QueryBuilder {
+	b.q.OrderBy = append(b.q.OrderBy, Order{Attribute: column, Descending: true})
+	return b
+}
+
+// Limit caps the number of results.
+func (b *QueryBuilder) Limit(n int) *QueryBuilder {
+	if n < 0 {
+		b.errs = append(b.errs, fmt.Errorf("limit cannot be negative, got %d", n))
+	}
+	b.q.Limit = n
+	return b
+}
+
+// Offset skips the first n results.
+func (b *QueryBuilder) Offset(n int) *QueryBuilder {
+	if n < 0 {
+		b.errs = append(b.errs, fmt.Errorf("offset cannot be negative, got %d", n))
+	}
+	b.q.Offset = n
+	return b
+}
+
+// Build returns the query, checked against the columns of a schema.
+func (b *QueryBuilder) Build(schema *Schema) (*Query, error) {
+	types := map[string]ColumnType{}
+	if schema != nil {
+		for _, c := range schema.Columns {
+			types[c.Name] = c.Type
+		}
+	}
+	return b.build(types)
+}
+
+// BuildFor returns the query, checked against the columns of a store and its
+// schema.
+func (b *QueryBuilder) BuildFor(s *ColumnarStore) (*Query, error) {
+	types, err := s.fs.columnTypes()
+	if err != nil {
+		return nil, err
+	}
+	return b.build(types)
+}
+
+func (b *QueryBuilder) build(types map[string]ColumnType) (*Query, error) {
+	q := b.q
+	q.Select = slices.Clone(q.Select)
+	q.Computed = slices.Clone(q.Computed)
+	q.Enrichers = slices.Clone(q.Enrichers)
+	q.Aggregations = slices.Clone(q.Aggregations)
+	q.OrderBy = slices.Clone(q.OrderBy)
+	switch len(b.where) {
+	case 0:
+	case 1:
+		q.Where = b.where[0]
+	default:
+		q.Where = And(b.where...)
+	}
+
+	errs := slices.Clone(b.errs)
+	check := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	typeOf := func(col string) (ColumnType, error) {
+		if col == IndexColumn {
+			return ColumnTypeInt64, nil
+		}
+		if col == TimestampColumn {
+			return ColumnTypeTime, nil
+		}
+		if typ, ok := types[col]; ok {
+			return typ, nil
+		}
+		if parent, _, ok := strings.Cut(col, "."); ok && types[parent] == ColumnTypeJSON {
+			return ColumnTypeJSON, nil
+		}
+		return 0, fmt.Errorf("unknown column %s", col)
+	}
+	if computed, err := compileComputed(q.Computed, typeOf); err != nil {
+		check(err)
+	} else {
+		types = maps.Clone(types)
+		for name, e := range computed {
+			types[name] = e.typ
+		}
+	}
+
+	for _, col := range q.Select {
+		if col != "*" {
+			_, err := typeOf(col)
+			check(err)
+		}
+	}
+	q.Where.walkFilters(func(f Filter) {
+		typ, err := typeOf(f.Attribute)
+		if err != nil {
+			check(err)
+			return
+		}
+		check(checkFilter(f, typ))
+	})
+	if groupBy := q.groupColumns(); len(groupBy) > 0 {
+		for _, col := range groupBy {
+			_, err := typeOf(col)
+			check(err)
+		}
+		if len(q.Aggregations) == 0 {
+			check(fmt.Errorf("group by %s needs an aggregation to compute", strings.Join(groupBy, ", ")))
+		}
+	}
+	if q.GroupByTime > 0 {
+		if q.GroupByTimeColumn != "" {
+			if typ, err := typeOf(q.GroupByTimeColumn); err != nil {
+				check(err)
+			} else if typ != ColumnTypeTime && typ != ColumnTypeInt64 {
+				check(fmt.Errorf("cannot group by time of %s column %s", typ, q.GroupByTimeColumn))
+			}
+		}
+		if len(q.Aggregations) == 0 {
+			check(fmt.Errorf("group by time needs an aggregation to compute"))
+		}
+	}
+	names := map[string]bool{TimeBucketColumn: q.GroupByTime > 0}
+	for _, col := range q.groupColumns() {
+		names[col] = true
+	}
+	for _, a := range q.Aggregations {
+		names[a.Name()] = true
+		if a.Attribute == "" {
+			if a.Type != AggregatorCount {
+				check(fmt.Errorf("%s needs a column", a.Type))
+			}
+			continue
+		}
+		typ, err := typeOf(a.Attribute)
+		if err != nil {
+			check(err)
+			continue
+		}
+		check(checkAggregateType(a, typ))
+		if a.Weight != "" {
+			typ, err := typeOf(a.Weight)
+			if err != nil {
+				check(err)
+			} else if !slices.Contains([]ColumnType{ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64, ColumnTypeJSON}, typ) {
+				check(fmt.Errorf("cannot weigh by %s column %s", typ, a.Weight))
+			}
+		}
+	}
+	for _, e := range q.Enrichers {
+		if e.Lookup == nil {
+			check(fmt.Errorf("enrichment of %s needs a lookup", e.Column))
+		}
+		_, err := typeOf(e.Column)
+		check(err)
+	}
+	for _, o := range q.OrderBy {
+		if len(q.Aggregations) > 0 {
+			if !names[o.Attribute] {
+				check(fmt.Errorf("cannot order aggregated results by %s, which is neither the group nor an aggregation", o.Attribute))
+			}
+			continue
+		}
+		if slices.ContainsFunc(q.Enrichers, func(e Enricher) bool { return slices.Contains(e.Columns, o.Attribute) }) {
+			continue
+		}
+		_, err := typeOf(o.Attribute)
+		check(err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// checkFilter reports a filter whose condition or value does not suit the
+// type of its column. Filters on JSON paths are checked as they run.
+func checkFilter(f Filter, typ ColumnType) error {
+	if typ == ColumnTypeJSON || f.Condition == ConditionIsNull || f.Condition == ConditionIsNotNull {
+		return nil
+	}
+	if _, err := conditionalFor(f.Condition, typ); err != nil {
+		return fmt.Errorf("condition %s is not supported for %s column %s", f.Condition, typ, f.Attribute)
+	}
+	switch f.Condition {
+	case ConditionMatches:
+		if _, err := compileRegexp(f.Value); err != nil {
+			return fmt.Errorf("filter on %s: %w", f.Attribute, err)
+		}
+		return nil
+	case ConditionIn, ConditionNotIn:
+		rv := reflect.ValueOf(f.Value)
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return fmt.Errorf("filter on %s: %s takes a slice of values, got %T", f.Attribute, f.Condition, f.Value)
+		}
+		for i := range rv.Len() {
+			if v := rv.Index(i).Interface(); !filterValueFits(v, typ) {
+				return fmt.Errorf("filter on %s: cannot compare %s column to %T value", f.Attribute, typ, v)
+			}
+		}
+		return nil
+	}
+	if !filterValueFits(f.Value, typ) {
+		return fmt.Errorf("filter on %s: cannot compare %s column to %T value", f.Attribute, typ, f.Value)
+	}
+	return nil
+}
+
+// filterValueFits reports whether a filter value can be compared to the
+// values of a column type.
+func filterValueFits(v any, typ ColumnType) bool {
+	if v == nil {
+		return false
+	}
+	vt := valueColumnType(v)
+	switch typ {
+	case ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64:
+		return vt == ColumnTypeInt64 || vt == ColumnTypeUint64 || vt == ColumnTypeFloat64
+	case ColumnTypeTime:
+		if s, ok := v.(string); ok {
+			_, err := time.Parse(time.RFC3339Nano, s)
+			return err == nil
+		}
+		return vt == ColumnTypeTime
+	case ColumnTypeString:
+		_, ok := v.(string)
+		return ok
+	}
+	return vt == typ
+}
@@ -0,0 +1,50 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	cs := newTestStore(t)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"region": []string{"us", "eu"}[i%2], "latency": i * 100, "meta": map[string]any{"k": i}}))
+	}
+
+	q, err := NewQuery().Where("latency", Gt, 100).GroupBy("region").Sum("latency").As("total").Count().OrderByDesc("total").Limit(1).BuildFor(cs)
+	require.NoError(t, err)
+	rows, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "eu", rows[0]["region"])
+	assert.EqualValues(t, 2400, rows[0]["total"])
+	assert.EqualValues(t, 4, rows[0]["count"])
+
+	q, err = NewQuery().Select("latency").Where("meta.k", Ge, 8).Where("region", ConditionIn, []string{"us"}).BuildFor(cs)
+	require.NoError(t, err)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.EqualValues(t, 800, rows[0]["latency"])
+
+	_, err = NewQuery().Select("nope").Where("latency", Eq, "fast").Where("region", ConditionIn, []any{1}).Sum("region").OrderBy("latency").Limit(-1).BuildFor(cs)
+	require.Error(t, err)
+	for _, msg := range []string{
+		"unknown column nope",
+		"cannot compare int64 column to string value",
+		"cannot compare string column to int value",
+		"cannot sum string column region",
+		"cannot order aggregated results by latency",
+		"limit cannot be negative",
+	} {
+		assert.ErrorContains(t, err, msg)
+	}
+
+	schema := &Schema{Columns: []ColumnSpec{{Name: "ok", Type: ColumnTypeBool}}}
+	_, err = NewQuery().Where("ok", ConditionStartsWith, "t").Build(schema)
+	assert.ErrorContains(t, err, "not supported for bool column ok")
+	_, err = NewQuery().Where("ok", Eq, true).Build(schema)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,387 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"slices"
+)
+
+// checksumExt is appended to a column file's path to name its checksum file,
+// which holds the CRC-32C of every completed block as a little-endian uint32.
+// The open last block is checksummed by its tail checksum file until the next
+// block starts.
+const checksumExt = ".crc"
+
+// tailChecksumExt is appended to a column file's path to name the checksum of
+// its open last block, rewritten by every append as
+//
+//	block offset int64 | end offset int64 | CRC-32C uint32 | last [4]byte
+//
+// where the CRC covers the block up to the end offset but for its last 4
+// bytes, which are held as they are. Those are the length of the last run of
+// a run-length encoded column, which appends patch in place, so readers of
+// such columns leave them unchecked.
+const tailChecksumExt = ".crc.tail"
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrChecksumMismatch is returned, wrapped with the column file, block and
+// offset, when a block read from a column file does not match its checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func (ch *ColumnHandle) checksumPath() string {
+	return ch.path + checksumExt
+}
+
+func (ch *ColumnHandle) tailChecksumPath() string {
+	return ch.path + tailChecksumExt
+}
+
+// blockTail is the checksum of the bytes [start, end) of the open last block
+// of a column file, or of no bytes if end is not after start.
+type blockTail struct {
+	start, end int64
+	// sum is the CRC-32C of the bytes but for the last 4, which last holds.
+	sum  uint32
+	last [4]byte
+}
+
+// newBlockTail returns the checksum of the block starting at start holding
+// data.
+func newBlockTail(start int64, data []byte) blockTail {
+	t := blockTail{start: start, end: start}
+	t.extend(data)
+	return t
+}
+
+// extend adds data appended to the block.
+func (t *blockTail) extend(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	t.end += int64(len(data))
+	held := t.last[:min(t.end-t.start-int64(len(data)), 4)]
+	if len(data) < 4 {
+		data = append(slices.Clone(held), data...)
+		held = nil
+	}
+	n := len(data) - min(len(data), 4)
+	t.sum = crc32.Update(crc32.Update(t.sum, crcTable, held), crcTable, data[:n])
+	t.last = [4]byte{}
+	copy(t.last[:], data[n:])
+}
+
+// patch updates the checksum for 4 bytes overwritten at off, reporting false
+// if they are not the block's last.
+func (t *blockTail) patch(off int64, b []byte) bool {
+	if off != t.end-4 || t.end-t.start < 4 {
+		return false
+	}
+	copy(t.last[:], b)
+	return true
+}
+
+// matches reports whether data, the bytes [start, end) of the block, match
+// the checksum. The last 4 bytes are left unchecked if skipLast is set.
+func (t blockTail) matches(data []byte, skipLast bool) bool {
+	n := len(data) - min(len(data), 4)
+	if crc32.Checksum(data[:n], crcTable) != t.sum {
+		return false
+	}
+	return skipLast || bytes.Equal(data[n:], t.last[:len(data)-n])
+}
+
+func (t blockTail) encode() []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(t.start))
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.end))
+	b = binary.LittleEndian.AppendUint32(b, t.sum)
+	return append(b, t.last[:]...)
+}
+
+// decodeBlockTail decodes a tail checksum file, reporting false if it is
+// malformed.
+func decodeBlockTail(b []byte) (blockTail, bool) {
+	if len(b) != 24 {
+		return blockTail{}, false
+	}
+	t := blockTail{
+		start: int64(binary.LittleEndian.Uint64(b)),
+		end:   int64(binary.LittleEndian.Uint64(b[8:])),
+		sum:   binary.LittleEndian.Uint32(b[16:]),
+	}
+	copy(t.last[:], b[20:])
+	return t, t.end >= t.start
+}
+
+// loadChecksums loads the checksums of a column whose block index is loaded.
+// Checksums missing from the checksum file are computed from the blocks.
+func (ch *ColumnHandle) loadChecksums() error {
+	data, err := readFile(ch.backend, ch.checksumPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	completed := max(len(ch.blocks)-1, 0)
+	n := min(len(data)/4, completed)
+	sums := make([]uint32, n, completed)
+	for i := range sums {
+		sums[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	stale := len(data) != 4*n
+	if n < completed {
+		computed, err := ch.blockChecksums(n)
+		if err != nil {
+			return err
+		}
+		sums = append(sums, computed...)
+		stale = true
+	}
+
+	if stale && !ch.readOnly {
+		if err := writeFile(ch.backend, ch.checksumPath(), encodeChecksums(nil, sums)); err != nil {
+			return err
+		}
+	}
+	ch.sums = sums
+	return ch.loadTail()
+}
+
+// loadTail loads the checksum of the open last block of a column whose block
+// index is loaded. A checksum that is missing is computed from the block, and
+// one that ends before the end of the file, as when writes are replayed from
+// the write-ahead log, is extended over the rest of it. One that does not
+// match the block is kept as it is, so that reads of the block fail.
+func (ch *ColumnHandle) loadTail() error {
+	if len(ch.blocks) == 0 {
+		ch.tail = blockTail{}
+		return nil
+	}
+	start := ch.blocks[len(ch.blocks)-1].offset
+	data, err := readFile(ch.backend, ch.tailChecksumPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	t, ok := decodeBlockTail(data)
+	if ok && t.start == start && t.end == ch.size {
+		ch.tail = t
+		return nil
+	}
+	block, err := ch.readBlock(start, ch.size)
+	if err != nil {
+		return err
+	}
+	switch {
+	case !ok || t.start != start || t.end > ch.size:
+		t = newBlockTail(start, block)
+	case !t.matches(block[:t.end-start], false):
+		ch.tail = t
+		return nil
+	default:
+		t.extend(block[t.end-start:])
+	}
+	ch.tail = t
+	if ch.readOnly {
+		return nil
+	}
+	return writeFile(ch.backend, ch.tailChecksumPath(), t.encode())
+}
+
+// readBlock reads the bytes [start, end) of a column file.
+func (ch *ColumnHandle) readBlock(start, end int64) ([]byte, error) {
+	fp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	data := make([]byte, end-start)
+	if _, err := fp.ReadAt(data, start); err != nil && !(errors.Is(err, io.EOF) && end == start) {
+		return nil, err
+	}
+	return data, nil
+}
+
+func encodeChecksums(dst []byte, sums []uint32) []byte {
+	for _, sum := range sums {
+		dst = binary.LittleEndian.AppendUint32(dst, sum)
+	}
+	return dst
+}
+
+// blockChecksums computes the checksums of the completed blocks from block i
+// on.
+func (ch *ColumnHandle) blockChecksums(i int) ([]uint32, error) {
+	fp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	var sums []uint32
+	var buf []byte
+	for ; i < len(ch.blocks)-1; i++ {
+		start, end := ch.blocks[i].offset, ch.blocks[i+1].offset
+		buf = slices.Grow(buf[:0], int(end-start))[:end-start]
+		if _, err := fp.ReadAt(buf, start); err != nil {
+			return nil, err
+		}
+		sums = append(sums, crc32.Checksum(buf, crcTable))
+	}
+	return sums, nil
+}
+
+// appendChecksums records the checksums of blocks completed by a write of
+// data, and of the open last block it leaves.
+func (ch *ColumnHandle) appendChecksums(data []byte, patch *rleRun) error {
+	sums, err := ch.blockChecksums(len(ch.sums))
+	if err != nil {
+		return err
+	}
+	if len(sums) > 0 {
+		ch.sums = append(ch.sums, sums...)
+		if ch.crcFp == nil {
+			fp, err := ch.backend.OpenFile(ch.checksumPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+			if err != nil {
+				return err
+			}
+			ch.crcFp = fp
+		}
+		if _, err := ch.crcFp.Write(encodeChecksums(nil, sums)); err != nil {
+			return err
+		}
+	}
+	if err := ch.extendTail(data, patch); err != nil {
+		return err
+	}
+	if ch.tailFp == nil {
+		fp, err := ch.backend.OpenFile(ch.tailChecksumPath(), os.O_WRONLY|os.O_CREATE, filePerm)
+		if err != nil {
+			return err
+		}
+		ch.tailFp = fp
+	}
+	_, err = ch.tailFp.WriteAt(ch.tail.encode(), 0)
+	return err
+}
+
+// extendTail updates the checksum of the open last block for a write of data
+// to the end of the file, after patching the length of a run.
+func (ch *ColumnHandle) extendTail(data []byte, patch *rleRun) error {
+	start := ch.blocks[len(ch.blocks)-1].offset
+	written := ch.size - int64(len(data))
+	if start >= written {
+		// The write started the block.
+		ch.tail = newBlockTail(start, data[start-written:])
+		return nil
+	}
+	if ch.tail.start == start && ch.tail.end != written {
+		// The block does not match its checksum, which is kept as it is.
+		return nil
+	}
+	if patch != nil {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(patch.end-patch.start))
+		if ch.tail.start != start || !ch.tail.patch(patch.countOffset, b[:]) {
+			// Only the last run of the block is patched, so this is
+			// not expected; the checksum is computed from the file.
+			block, err := ch.readBlock(start, ch.size)
+			if err != nil {
+				return err
+			}
+			ch.tail = newBlockTail(start, block)
+			return nil
+		}
+	}
+	ch.tail.extend(data)
+	return nil
+}
+
+// checksumSnapshot returns the checksums of a column for a reader. Like block
+// entries, they are never modified once written.
+func (ch *ColumnHandle) checksumSnapshot() []uint32 {
+	return slices.Clip(ch.sums)
+}
+
+// checkBlocks reads the blocks of a column that end by end, returning an
+// error wrapping ErrChecksumMismatch if one does not match its checksum.
+func (ch *ColumnHandle) checkBlocks(end int64) error {
+	for i, sum := range ch.sums {
+		start, next := ch.blocks[i].offset, ch.blocks[i+1].offset
+		if next > end {
+			return nil
+		}
+		block, err := ch.readBlock(start, next)
+		if err != nil {
+			return err
+		}
+		if crc32.Checksum(block, crcTable) != sum {
+			return fmt.Errorf("column file %s: block %d at offset %d: %w", ch.path, i, start, ErrChecksumMismatch)
+		}
+	}
+	t := ch.tail
+	if t.end <= t.start || t.end > end {
+		return nil
+	}
+	block, err := ch.readBlock(t.start, t.end)
+	if err != nil {
+		return err
+	}
+	if !t.matches(block, false) {
+		return fmt.Errorf("column file %s: block %d at offset %d: %w", ch.path, len(ch.sums), t.start, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// verifyBlock checks the block starting at the reader's position against its
+// checksum, if it has one. Blocks the reader enters partway through, by
+// starting or jumping past their start, are not checked. The open last block
+// is checked as it was when the reader was created, but for the length of the
+// last run of a run-length encoded column, which appends patch in place.
+func (cr *ColumnReader) verifyBlock() error {
+	pos := cr.position()
+	for cr.nextCheck <= len(cr.sums) && cr.blocks[cr.nextCheck].offset < pos {
+		cr.nextCheck++
+	}
+	if cr.nextCheck > len(cr.sums) || cr.blocks[cr.nextCheck].offset != pos {
+		return nil
+	}
+	i := cr.nextCheck
+	cr.nextCheck++
+	if i == len(cr.sums) {
+		return cr.verifyTail(i)
+	}
+	size := int(cr.blocks[i+1].offset - pos)
+	for len(cr.buf)-cr.pos < size {
+		if err := cr.fill(); err == io.EOF {
+			return fmt.Errorf("column file %s: block %d at offset %d is truncated", cr.path, i, pos)
+		} else if err != nil {
+			return err
+		}
+	}
+	if crc32.Checksum(cr.buf[cr.pos:cr.pos+size], crcTable) != cr.sums[i] {
+		return fmt.Errorf("column file %s: block %d at offset %d: %w", cr.path, i, pos, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// verifyTail checks the open last block, block i, at the reader's position.
+func (cr *ColumnReader) verifyTail(i int) error {
+	pos := cr.position()
+	if cr.tail.start != pos {
+		return nil
+	}
+	size := int(cr.tail.end - pos)
+	for len(cr.buf)-cr.pos < size {
+		if err := cr.fill(); err == io.EOF {
+			return fmt.Errorf("column file %s: block %d at offset %d is truncated", cr.path, i, pos)
+		} else if err != nil {
+			return err
+		}
+	}
+	if !cr.tail.matches(cr.buf[cr.pos:cr.pos+size], cr.rle) {
+		return fmt.Errorf("column file %s: block %d at offset %d: %w", cr.path, i, pos, ErrChecksumMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksums(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, cs.Append(map[string]any{"val": i}))
+	}
+	ch := fs.columnHandles["val"]
+	require.NoError(t, ch.loadBlockIndex())
+	assert.Len(t, ch.sums, len(ch.blocks)-1)
+	query := func() error {
+		_, err := cs.Query(&Query{Select: []string{"val"}})
+		return err
+	}
+	require.NoError(t, query())
+
+	// Checksums missing from the checksum file are rebuilt.
+	sums := ch.sums
+	require.NoError(t, ch.resetBlockIndex())
+	require.NoError(t, ch.loadBlockIndex())
+	assert.Equal(t, sums, ch.sums)
+
+	// Flip a bit in the value of the first record of the second block.
+	fp := lo.Must(os.OpenFile(ch.path, os.O_RDWR, filePerm))
+	b := make([]byte, 1)
+	offset := ch.blocks[1].offset + 8
+	lo.Must(fp.ReadAt(b, offset))
+	b[0] ^= 1
+	lo.Must(fp.WriteAt(b, offset))
+	require.NoError(t, fp.Close())
+
+	err = query()
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, fmt.Sprintf("block 1 at offset %d", ch.blocks[1].offset))
+}
+
+func TestTailChecksum(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "flag", Type: ColumnTypeBool, Encoding: EncodingRLE},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, cs.Append(map[string]any{"val": i, "flag": true}))
+	}
+	query := func() error {
+		_, err := cs.Query(&Query{Select: []string{"val", "flag"}})
+		return err
+	}
+	require.NoError(t, query())
+	ch := fs.columnHandles["val"]
+	require.NoError(t, ch.loadBlockIndex())
+	last := ch.blocks[len(ch.blocks)-1].offset
+	assert.Equal(t, blockTail{start: last, end: ch.size}, blockTail{start: ch.tail.start, end: ch.tail.end})
+
+	// The checksum kept by appends matches the one computed from the file,
+	// including for the run patched in place by each append.
+	for _, name := range []string{"val", "flag"} {
+		ch := fs.columnHandles[name]
+		tail := ch.tail
+		require.NoError(t, ch.resetBlockIndex())
+		require.NoError(t, ch.loadBlockIndex())
+		assert.Equal(t, tail, ch.tail, name)
+	}
+	require.NoError(t, fs.Close())
+
+	// Flip a bit in the value of the last record of the open last block.
+	fp := lo.Must(os.OpenFile(ch.path, os.O_RDWR, filePerm))
+	b := make([]byte, 1)
+	offset := ch.size - 8
+	lo.Must(fp.ReadAt(b, offset))
+	b[0] ^= 1
+	lo.Must(fp.WriteAt(b, offset))
+	require.NoError(t, fp.Close())
+
+	fs, err = OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	err = query()
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.ErrorContains(t, err, fmt.Sprintf("block %d at offset %d", len(ch.blocks)-1, last))
+	problems, err := fs.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, []VerifyProblem{{File: ch.path, Offset: last, Message: fmt.Sprintf("block %d: %v", len(ch.blocks)-1, ErrChecksumMismatch)}}, problems)
+}
+
+func TestRecoveryChecksBlocks(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, cs.Append(map[string]any{"val": i}))
+	}
+	ch := fs.columnHandles["val"]
+	require.NoError(t, ch.loadBlockIndex())
+	offset := ch.blocks[1].offset + 8
+	require.NoError(t, fs.Close())
+
+	// A corrupt block followed by a torn record is not rebuilt over.
+	fp := lo.Must(os.OpenFile(ch.path, os.O_RDWR, filePerm))
+	b := make([]byte, 1)
+	lo.Must(fp.ReadAt(b, offset))
+	b[0] ^= 1
+	lo.Must(fp.WriteAt(b, offset))
+	lo.Must(fp.WriteAt([]byte{1, 2, 3}, lo.Must(fp.Stat()).Size()))
+	require.NoError(t, fp.Close())
+
+	_, err = OpenColumnFS(dir)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+	assert.FileExists(t, ch.checksumPath())
+}
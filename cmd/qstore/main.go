@@ -0,0 +1,338 @@
+// Command qstore inspects, loads and queries a querystore directory.
+//
+//	qstore info DIR
+//	qstore append DIR [JSON object...]
+//	qstore import [-format jsonl|csv] [-comma C] DIR [FILE]
+//	qstore query [-sql] [-format jsonl|csv|table] DIR QUERY
+//	qstore export [-format jsonl|csv|parquet] [-o FILE] [-sql] DIR [QUERY]
+//	qstore compact DIR
+//	qstore verify DIR
+//
+// append reads JSON objects from standard input when none are given, one per
+// line, as import does from standard input when no file is given. Queries
+// are in the text form of querystore.ParseQuery, or SQL with -sql. info and
+// verify open the store read-only, so torn writes are reported rather than
+// repaired as opening it for writing does. qstore exits with status 1 if a
+// command fails, and 2 if it is used wrongly.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/davidbyttow/querystore"
+)
+
+// command runs a qstore command with its arguments, writing its output to
+// stdout and its progress to stderr.
+type command func(args []string, stdout, stderr io.Writer) error
+
+var commands = map[string]command{
+	"info":    info,
+	"append":  appendRows,
+	"import":  importRows,
+	"query":   query,
+	"export":  export,
+	"compact": compact,
+	"verify":  verify,
+}
+
+// stdin is read by append and import when given no rows or file.
+var stdin io.Reader = os.Stdin
+
+// errUsage reports invalid flags or arguments, which have already been
+// reported.
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command named by args[0] and returns the exit code: 0 on
+// success, 1 if the command fails and 2 for invalid usage.
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) < 1 || commands[args[0]] == nil {
+		fmt.Fprintln(stderr, "usage: qstore info|append|import|query|export|compact|verify [flags] DIR [args]")
+		return 2
+	}
+	err := commands[args[0]](args[1:], stdout, stderr)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errUsage):
+		return 2
+	}
+	fmt.Fprintln(stderr, "qstore:", err)
+	return 1
+}
+
+// newFlagSet returns the flag set of a command, reporting errors to stderr.
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	fset := flag.NewFlagSet(name, flag.ContinueOnError)
+	fset.SetOutput(stderr)
+	return fset
+}
+
+// parse parses a command's flags and returns its store directory and the
+// rest of its arguments.
+func parse(fset *flag.FlagSet, args []string, minArgs, maxArgs int) (string, []string, error) {
+	if err := fset.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return "", nil, err
+		}
+		return "", nil, errUsage
+	}
+	rest := fset.Args()
+	if len(rest) < 1+minArgs || len(rest) > 1+maxArgs {
+		fmt.Fprintf(fset.Output(), "%s: wrong number of arguments\n", fset.Name())
+		fset.Usage()
+		return "", nil, errUsage
+	}
+	return rest[0], rest[1:], nil
+}
+
+// withStore runs fn on the store in dir, closing it afterwards. Missing
+// stores are created if create is set.
+func withStore(dir string, create bool, fn func(fs *querystore.ColumnFS, s *querystore.ColumnarStore) error) error {
+	return withStoreOptions(dir, create, querystore.Options{}, fn)
+}
+
+// withReadOnlyStore runs fn on the store in dir opened read-only, so that its
+// files are left as they are rather than repaired.
+func withReadOnlyStore(dir string, fn func(fs *querystore.ColumnFS, s *querystore.ColumnarStore) error) error {
+	return withStoreOptions(dir, false, querystore.Options{ReadOnly: true}, fn)
+}
+
+func withStoreOptions(dir string, create bool, opts querystore.Options, fn func(fs *querystore.ColumnFS, s *querystore.ColumnarStore) error) error {
+	if _, err := os.Stat(dir); err != nil && !(create && os.IsNotExist(err)) {
+		return err
+	}
+	fs, err := querystore.OpenColumnFSWithOptions(dir, opts)
+	if err != nil {
+		return err
+	}
+	err = fn(fs, querystore.NewColumnarStore(fs))
+	return errors.Join(err, fs.Close())
+}
+
+func info(args []string, stdout, stderr io.Writer) error {
+	dir, _, err := parse(newFlagSet("info", stderr), args, 0, 0)
+	if err != nil {
+		return err
+	}
+	return withReadOnlyStore(dir, func(fs *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		rows, err := s.Query(&querystore.Query{Aggregations: []querystore.Aggregation{{Type: querystore.AggregatorCount}}})
+		if err != nil {
+			return err
+		}
+		cols, err := fs.Columns()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "rows: %v\n", rows[0]["count"])
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "COLUMN\tTYPE\tVALUES\tBYTES")
+		for _, c := range cols {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", c.Name, c.Type, c.Count, c.Size)
+		}
+		if parts := fs.Partitions(); len(parts) > 0 {
+			fmt.Fprintf(tw, "\npartitions: %d\n", len(parts))
+		}
+		return tw.Flush()
+	})
+}
+
+func appendRows(args []string, stdout, stderr io.Writer) error {
+	dir, objects, err := parse(newFlagSet("append", stderr), args, 0, 1<<20)
+	if err != nil {
+		return err
+	}
+	return withStore(dir, true, func(_ *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		r := stdin
+		if len(objects) > 0 {
+			r = strings.NewReader(strings.Join(objects, "\n"))
+		}
+		n, err := s.ReadJSONL(r)
+		fmt.Fprintf(stderr, "appended %d rows\n", n)
+		return err
+	})
+}
+
+func importRows(args []string, stdout, stderr io.Writer) error {
+	fset := newFlagSet("import", stderr)
+	format := fset.String("format", "jsonl", "input format: jsonl or csv")
+	comma := fset.String("comma", ",", "CSV field delimiter")
+	dir, files, err := parse(fset, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	r := stdin
+	if len(files) > 0 {
+		f, err := os.Open(files[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	r = bufio.NewReader(r)
+	return withStore(dir, true, func(_ *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		var n int64
+		var err error
+		switch *format {
+		case "jsonl":
+			n, err = s.ReadJSONL(r)
+		case "csv":
+			c, size := utf8.DecodeRuneInString(*comma)
+			if size != len(*comma) || c == utf8.RuneError {
+				return fmt.Errorf("invalid delimiter %q", *comma)
+			}
+			n, err = s.ImportCSV(r, querystore.CSVOptions{Comma: c})
+		default:
+			return fmt.Errorf("unknown format %q", *format)
+		}
+		fmt.Fprintf(stderr, "imported %d rows\n", n)
+		return err
+	})
+}
+
+// parseQuery parses a query in the text form, or SQL.
+func parseQuery(text string, sql bool) (*querystore.Query, error) {
+	if sql {
+		return querystore.QueryFromSQL(text)
+	}
+	return querystore.ParseQuery(text)
+}
+
+func query(args []string, stdout, stderr io.Writer) error {
+	fset := newFlagSet("query", stderr)
+	sql := fset.Bool("sql", false, "parse the query as SQL")
+	format := fset.String("format", "jsonl", "output format: jsonl, csv or table")
+	dir, rest, err := parse(fset, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	q, err := parseQuery(rest[0], *sql)
+	if err != nil {
+		return err
+	}
+	return withStore(dir, false, func(_ *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		w := bufio.NewWriter(stdout)
+		var err error
+		switch *format {
+		case "jsonl":
+			err = s.WriteJSONL(w, q)
+		case "csv":
+			err = s.ExportCSV(w, q)
+		case "table":
+			err = writeTable(w, s, q)
+		default:
+			return fmt.Errorf("unknown format %q", *format)
+		}
+		return errors.Join(err, w.Flush())
+	})
+}
+
+// writeTable writes query results as aligned columns.
+func writeTable(w io.Writer, s *querystore.ColumnarStore, q *querystore.Query) error {
+	var buf bytes.Buffer
+	if err := s.ExportCSV(&buf, q); err != nil {
+		return err
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, rec := range records {
+		for i, field := range rec {
+			// Keep each row on one line.
+			rec[i] = strings.NewReplacer("\n", `\n`, "\t", `\t`).Replace(field)
+		}
+		fmt.Fprintln(tw, strings.Join(rec, "\t"))
+	}
+	return tw.Flush()
+}
+
+func export(args []string, stdout, stderr io.Writer) error {
+	fset := newFlagSet("export", stderr)
+	sql := fset.Bool("sql", false, "parse the query as SQL")
+	format := fset.String("format", "jsonl", "output format: jsonl, csv or parquet")
+	out := fset.String("o", "", "output file, standard output by default")
+	dir, rest, err := parse(fset, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	var q *querystore.Query
+	if len(rest) > 0 {
+		if q, err = parseQuery(rest[0], *sql); err != nil {
+			return err
+		}
+	}
+	return withStore(dir, false, func(_ *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		var file *os.File
+		if *out != "" {
+			var err error
+			if file, err = os.Create(*out); err != nil {
+				return err
+			}
+			stdout = file
+		}
+		w := bufio.NewWriter(stdout)
+		var err error
+		switch *format {
+		case "jsonl":
+			err = s.WriteJSONL(w, q)
+		case "csv":
+			err = s.ExportCSV(w, q)
+		case "parquet":
+			err = s.ExportParquet(w, q)
+		default:
+			err = fmt.Errorf("unknown format %q", *format)
+		}
+		err = errors.Join(err, w.Flush())
+		if file != nil {
+			err = errors.Join(err, file.Close())
+		}
+		return err
+	})
+}
+
+func compact(args []string, stdout, stderr io.Writer) error {
+	dir, _, err := parse(newFlagSet("compact", stderr), args, 0, 0)
+	if err != nil {
+		return err
+	}
+	return withStore(dir, false, func(_ *querystore.ColumnFS, s *querystore.ColumnarStore) error {
+		return s.Compact()
+	})
+}
+
+func verify(args []string, stdout, stderr io.Writer) error {
+	dir, _, err := parse(newFlagSet("verify", stderr), args, 0, 0)
+	if err != nil {
+		return err
+	}
+	return withReadOnlyStore(dir, func(fs *querystore.ColumnFS, _ *querystore.ColumnarStore) error {
+		problems, err := fs.Verify()
+		if err != nil {
+			return err
+		}
+		for _, p := range problems {
+			fmt.Fprintln(stdout, p)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%d problems found", len(problems))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runQstore runs qstore with args, returning its exit code and output.
+func runQstore(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// newStore returns the directory of a store holding three rows.
+func newStore(t *testing.T) string {
+	dir := filepath.Join(t.TempDir(), "store")
+	code, _, stderr := runQstore(t, "append", dir,
+		`{"region":"us","latency":100}`,
+		`{"region":"eu","latency":300}`,
+		`{"region":"us","latency":500}`)
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "appended 3 rows\n", stderr)
+	return dir
+}
+
+func TestUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"drop"}} {
+		code, _, stderr := runQstore(t, args...)
+		assert.Equal(t, 2, code)
+		assert.Contains(t, stderr, "usage: qstore")
+	}
+	code, _, stderr := runQstore(t, "query", "-bogus", t.TempDir(), "| count")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "flag provided but not defined: -bogus")
+	code, _, stderr = runQstore(t, "info", "-h")
+	assert.Equal(t, 0, code)
+	assert.Contains(t, stderr, "Usage of info")
+
+	code, _, stderr = runQstore(t, "info")
+	assert.Equal(t, 2, code)
+	assert.True(t, strings.HasPrefix(stderr, "info: wrong number of arguments\nUsage of info"), stderr)
+	code, _, stderr = runQstore(t, "query", t.TempDir(), "| count", "extra")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "query: wrong number of arguments")
+	missing := filepath.Join(t.TempDir(), "missing")
+	code, _, _ = runQstore(t, "query", missing, "| count")
+	assert.Equal(t, 1, code)
+	assert.NoDirExists(t, missing, "only append and import create stores")
+}
+
+func TestInfo(t *testing.T) {
+	dir := newStore(t)
+	code, stdout, _ := runQstore(t, "info", dir)
+	require.Equal(t, 0, code)
+	lines := strings.Split(stdout, "\n")
+	assert.Equal(t, "rows: 3", lines[0])
+	assert.Equal(t, []string{"COLUMN", "TYPE", "VALUES", "BYTES"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"latency", "int64", "3"}, strings.Fields(lines[2])[:3])
+	assert.Equal(t, []string{"region", "string", "3"}, strings.Fields(lines[3])[:3])
+}
+
+func TestAppendImport(t *testing.T) {
+	dir := newStore(t)
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(`{"region":"ap","latency":50}` + "\n")
+	code, _, stderr := runQstore(t, "append", dir)
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "appended 1 rows\n", stderr)
+
+	file := filepath.Join(t.TempDir(), "rows.csv")
+	require.NoError(t, os.WriteFile(file, []byte("region;latency\neu;70\nus;80\n"), 0o644))
+	code, _, stderr = runQstore(t, "import", "-format", "csv", "-comma", ";", dir, file)
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "imported 2 rows\n", stderr)
+
+	code, _, stderr = runQstore(t, "import", "-format", "csv", "-comma", ";;", dir, file)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "invalid delimiter")
+	code, _, stderr = runQstore(t, "import", "-format", "xml", dir, file)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown format "xml"`)
+	code, _, stderr = runQstore(t, "append", dir, `{"latency":"slow"}`)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "appended 0 rows\nqstore: ")
+
+	code, stdout, _ := runQstore(t, "query", dir, "| count")
+	require.Equal(t, 0, code)
+	assert.Equal(t, `{"count":6}`+"\n", stdout)
+}
+
+func TestQuery(t *testing.T) {
+	dir := newStore(t)
+	code, stdout, stderr := runQstore(t, "query", dir, "latency > 200 | select region, latency")
+	require.Equal(t, 0, code, stderr)
+	var rows []map[string]any
+	dec := json.NewDecoder(strings.NewReader(stdout))
+	for dec.More() {
+		var row map[string]any
+		require.NoError(t, dec.Decode(&row))
+		rows = append(rows, map[string]any{"region": row["region"], "latency": row["latency"]})
+	}
+	assert.Equal(t, []map[string]any{{"region": "eu", "latency": 300.0}, {"region": "us", "latency": 500.0}}, rows)
+
+	code, stdout, stderr = runQstore(t, "query", "-sql", "-format", "csv", dir, "SELECT region, COUNT(*) AS n FROM t GROUP BY region ORDER BY region")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "region,n\neu,1\nus,2\n", stdout)
+
+	code, stdout, stderr = runQstore(t, "query", "-format", "table", dir, "| count by region | sort region")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "region  count\neu      1\nus      2\n", stdout)
+
+	code, _, stderr = runQstore(t, "query", dir, "latency >")
+	assert.Equal(t, 1, code)
+	assert.True(t, strings.HasPrefix(stderr, "qstore: "), stderr)
+	code, _, stderr = runQstore(t, "query", "-format", "xml", dir, "| count")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown format "xml"`)
+}
+
+func TestExport(t *testing.T) {
+	dir := newStore(t)
+	code, stdout, stderr := runQstore(t, "export", "-format", "csv", "-sql", dir, "SELECT region FROM t WHERE latency < 400")
+	require.Equal(t, 0, code, stderr)
+	assert.Equal(t, "region\nus\neu\n", stdout)
+
+	out := filepath.Join(t.TempDir(), "rows.parquet")
+	code, stdout, stderr = runQstore(t, "export", "-format", "parquet", "-o", out, dir)
+	require.Equal(t, 0, code, stderr)
+	assert.Empty(t, stdout)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(data, []byte("PAR1")) && bytes.HasSuffix(data, []byte("PAR1")))
+
+	code, _, stderr = runQstore(t, "export", "-format", "xml", dir)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, `unknown format "xml"`)
+}
+
+func TestCompactVerify(t *testing.T) {
+	dir := newStore(t)
+	code, _, stderr := runQstore(t, "compact", dir)
+	require.Equal(t, 0, code, stderr)
+	code, stdout, stderr := runQstore(t, "verify", dir)
+	require.Equal(t, 0, code, stderr)
+	assert.Empty(t, stdout)
+
+	// A torn record is reported, and left for recovery to repair.
+	files, err := filepath.Glob(filepath.Join(dir, "latency.*"))
+	require.NoError(t, err)
+	var column string
+	for _, f := range files {
+		if strings.Count(filepath.Base(f), ".") == 2 {
+			column = f
+		}
+	}
+	require.NotEmpty(t, column, files)
+	f, err := os.OpenFile(column, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	code, stdout, stderr = runQstore(t, "verify", dir)
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stdout, column+": offset ")
+	assert.Contains(t, stdout, "truncated record of 3 bytes at end of file")
+	assert.Equal(t, "qstore: 1 problems found\n", stderr)
+	code, stdout, _ = runQstore(t, "verify", dir)
+	assert.Equal(t, 1, code)
+	assert.NotEmpty(t, stdout)
+}
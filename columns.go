@@ -0,0 +1,431 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// ColumnInfo describes a column stored in a ColumnFS.
+type ColumnInfo struct {
+	Name string
+	Type ColumnType
+	// Size is the size of the column file in bytes.
+	Size int64
+	// Count is the number of values written to the column.
+	Count int64
+	// FirstIndex and LastIndex are the lowest and highest row indexes with a
+	// value in the column, or -1 if the column is empty.
+	FirstIndex int64
+	LastIndex  int64
+}
+
+type columnStats struct {
+	size       int64
+	count      int64
+	firstIndex int64
+	lastIndex  int64
+}
+
+func newColumnStats() *columnStats {
+	return &columnStats{firstIndex: -1, lastIndex: -1}
+}
+
+func (s *columnStats) add(index int64) {
+	if s.firstIndex < 0 {
+		s.firstIndex = index
+	}
+	s.lastIndex = index
+	s.count++
+}
+
+// loadStats scans the column file to compute its stats, if not already known.
+func (ch *ColumnHandle) loadStats() (*columnStats, error) {
+	if ch.stats != nil {
+		return ch.stats, nil
+	}
+	stats := newColumnStats()
+	fi, err := ch.backend.Stat(ch.path)
+	if os.IsNotExist(err) {
+		ch.stats = stats
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stats.size = fi.Size()
+
+	cr, err := ch.createReader()
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+	for {
+		if _, err := cr.SeekToIndex(cr.curIndex + 1); err != nil {
+			return nil, err
+		}
+		if cr.eof {
+			break
+		}
+		stats.add(cr.curIndex)
+	}
+	ch.stats = stats
+	return stats, nil
+}
+
+// noteAppend folds the stats of newly appended records into the handle's
+// stats. Unloaded stats are left to be computed from the file later.
+func (ch *ColumnHandle) noteAppend(appended *columnStats, size int64) {
+	if ch.stats == nil {
+		return
+	}
+	if ch.stats.firstIndex < 0 {
+		ch.stats.firstIndex = appended.firstIndex
+	}
+	ch.stats.lastIndex = appended.lastIndex
+	ch.stats.count += appended.count
+	ch.stats.size += size
+}
+
+// Columns returns metadata for every column in the store, sorted by name.
+func (fs *ColumnFS) Columns() ([]ColumnInfo, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.flushBuffer(); err != nil {
+		return nil, err
+	}
+
+	if fs.partitions != nil {
+		return fs.partitionColumns()
+	}
+	var infos []ColumnInfo
+	for name, ch := range fs.columnHandles {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		stats, err := ch.loadStats()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, ColumnInfo{
+			Name:       name,
+			Type:       ch.typ,
+			Size:       stats.size,
+			Count:      stats.count,
+			FirstIndex: stats.firstIndex,
+			LastIndex:  stats.lastIndex,
+		})
+	}
+	slices.SortFunc(infos, func(a, b ColumnInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos, nil
+}
+
+// columnTypes returns the types of the store's columns, including those its
+// schema declares.
+func (fs *ColumnFS) columnTypes() (map[string]ColumnType, error) {
+	infos, err := fs.Columns()
+	if err != nil {
+		return nil, err
+	}
+	types := map[string]ColumnType{}
+	for _, info := range infos {
+		types[info.Name] = info.Type
+	}
+	if fs.opts.Schema != nil {
+		for _, c := range fs.opts.Schema.Columns {
+			types[c.Name] = c.Type
+		}
+	}
+	return types, nil
+}
+
+// partitionColumns is Columns for partitioned stores, combining the columns
+// of every partition. Columns whose type differs between partitions report
+// that of the latest. The caller must hold fs.lock.
+func (fs *ColumnFS) partitionColumns() ([]ColumnInfo, error) {
+	byName := map[string]*ColumnInfo{}
+	for _, p := range fs.partitions {
+		infos, err := p.fs.Columns()
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.FirstIndex >= 0 {
+				info.FirstIndex += p.base
+				info.LastIndex += p.base
+			}
+			merged := byName[info.Name]
+			if merged == nil {
+				byName[info.Name] = &info
+				continue
+			}
+			merged.Type = info.Type
+			merged.Size += info.Size
+			merged.Count += info.Count
+			if merged.FirstIndex < 0 {
+				merged.FirstIndex = info.FirstIndex
+			}
+			if info.LastIndex >= 0 {
+				merged.LastIndex = info.LastIndex
+			}
+		}
+	}
+	infos := []ColumnInfo{}
+	for _, info := range byName {
+		infos = append(infos, *info)
+	}
+	slices.SortFunc(infos, func(a, b ColumnInfo) int { return strings.Compare(a.Name, b.Name) })
+	return infos, nil
+}
+
+// RenameColumn renames a column, with its files and indexes. Stores with a
+// schema rename the column in their schema, which must be declared under the
+// new name when the store is next opened. Each file is renamed atomically,
+// the column file last, so that a crash leaves the column under one name or
+// the other; sidecars left behind are rebuilt.
+func (fs *ColumnFS) RenameColumn(oldName, newName string) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := checkColumnName(newName); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	fs.invalidateCache()
+	if err := fs.checkColumnChange(oldName, newName); err != nil {
+		return err
+	}
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		if err := p.fs.RenameColumn(oldName, newName); err != nil && !errors.Is(err, errNoColumn) {
+			return err
+		}
+	}
+	if fs.opts.Schema != nil {
+		schema := &Schema{Columns: slices.Clone(fs.opts.Schema.Columns)}
+		for i, c := range schema.Columns {
+			if c.Name == oldName {
+				schema.Columns[i].Name = newName
+			}
+		}
+		fs.opts.Schema = schema
+		if fs.schema != nil {
+			fs.schema = schema
+		}
+	}
+	ch := fs.columnHandles[oldName]
+	if ch == nil {
+		// Partitioned stores hold their columns in their partitions.
+		return nil
+	}
+	if err := ch.Close(); err != nil {
+		return err
+	}
+	ch.unloadBlockIndex()
+	// File names keep the type and version that follow the column name.
+	next := &ColumnHandle{path: path.Join(fs.dir, newName+strings.TrimPrefix(path.Base(ch.path), oldName))}
+	for i, from := range ch.sidecarPaths() {
+		to := next.sidecarPaths()[i]
+		if err := fs.backend.Remove(to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := fs.backend.Rename(from, to); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := fs.backend.Rename(ch.path, next.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ch.path = next.path
+	ch.indexed = fs.isIndexed(newName, ch.typ)
+	ch.bitmapped = fs.hasBitmapIndex(newName, ch.typ)
+	delete(fs.columnHandles, oldName)
+	fs.columnHandles[newName] = ch
+	return nil
+}
+
+// MigrateColumn changes the type of a column, for fixing columns created
+// with the wrong type. Its file is rewritten with each value converted by
+// convert, whose results must fit the new type, and values converted to nil
+// are dropped. Without convert, values are coerced as in TypeModeLenient.
+// Stores with a schema change the column's type in their schema, which must
+// declare the new type when the store is next opened.
+//
+// The new file is written beside the old one and renamed into place before
+// the old one is removed, as with Compact. Rows pruned or deleted are not
+// copied.
+func (fs *ColumnFS) MigrateColumn(name string, newType ColumnType, convert func(v any) (any, error)) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if _, ok := columnTypeToSuffix[newType]; !ok {
+		return fmt.Errorf("%w %d", ErrUnknownColumnType, newType)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	fs.invalidateCache()
+	if err := fs.checkColumnChange(name, ""); err != nil {
+		return err
+	}
+	var schema *Schema
+	if fs.opts.Schema != nil {
+		schema = &Schema{Columns: slices.Clone(fs.opts.Schema.Columns)}
+		for i, c := range schema.Columns {
+			if c.Name == name {
+				schema.Columns[i].Type = newType
+			}
+		}
+		if err := schema.validate(); err != nil {
+			return err
+		}
+	}
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		if err := p.fs.MigrateColumn(name, newType, convert); err != nil && !errors.Is(err, errNoColumn) {
+			return err
+		}
+	}
+	if schema != nil {
+		fs.opts.Schema = schema
+		if fs.schema != nil {
+			fs.schema = schema
+		}
+	}
+	ch := fs.columnHandles[name]
+	if ch == nil {
+		return nil
+	}
+	next := fs.newColumnHandle(name, newType)
+	next.flags, next.codec, next.bloomRate, next.sketched = ch.flags, ch.codec, ch.bloomRate, ch.sketched
+	if !supportsRLE(newType) {
+		next.flags &^= flagRLE
+	}
+	conv := func(v any) (any, error) {
+		if convert != nil {
+			c, err := convert(v)
+			if err != nil || c == nil {
+				return nil, err
+			}
+			return fs.columnValue(name, newType, c)
+		}
+		if c, ok := coerceValue(v, newType); ok && !valueFitsColumnType(v, newType) {
+			v = c
+		}
+		return fs.columnValue(name, newType, v)
+	}
+	if err := fs.compactColumn(ch, next, conv); err != nil {
+		return fmt.Errorf("migrating %s: %w", ch.path, err)
+	}
+	ch.typ = newType
+	ch.indexed = fs.isIndexed(name, newType)
+	ch.bitmapped = fs.hasBitmapIndex(name, newType)
+	return nil
+}
+
+// DropColumn removes a column, with its files and indexes. Stores with a
+// schema drop the column from their schema, which must not declare it when
+// the store is next opened. The column file is removed last, so that a crash
+// leaves the column whole or gone.
+func (fs *ColumnFS) DropColumn(name string) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	fs.invalidateCache()
+	if err := fs.checkColumnChange(name, ""); err != nil {
+		return err
+	}
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		if err := p.fs.DropColumn(name); err != nil && !errors.Is(err, errNoColumn) {
+			return err
+		}
+	}
+	if fs.opts.Schema != nil {
+		schema := &Schema{Columns: slices.DeleteFunc(slices.Clone(fs.opts.Schema.Columns), func(c ColumnSpec) bool {
+			return c.Name == name
+		})}
+		fs.opts.Schema = schema
+		if fs.schema != nil {
+			fs.schema = schema
+		}
+	}
+	ch := fs.columnHandles[name]
+	if ch == nil {
+		return nil
+	}
+	if err := ch.Close(); err != nil {
+		return err
+	}
+	if err := ch.resetBlockIndex(); err != nil {
+		return err
+	}
+	if err := fs.backend.Remove(ch.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(fs.columnHandles, name)
+	return nil
+}
+
+// errNoColumn reports a column missing from a store, which partitions
+// lacking the columns of others skip.
+var errNoColumn = errors.New("no such column")
+
+// checkColumnChange fails unless a store holds the column oldName and, if set,
+// not newName. Partitioned stores hold the columns of their partitions, which
+// must be held on disk rather than offloaded. The caller must hold fs.lock.
+func (fs *ColumnFS) checkColumnChange(oldName, newName string) error {
+	has := func(fs *ColumnFS, name string) bool {
+		_, ok := fs.columnHandles[name]
+		return ok && !strings.HasPrefix(name, "__")
+	}
+	found := has(fs, oldName)
+	for _, p := range fs.partitions {
+		if !has(p.fs, oldName) {
+			continue
+		}
+		if p.offloaded {
+			return fmt.Errorf("column %s is held by offloaded partition %s", oldName, p.fs.dir)
+		}
+		if newName != "" && has(p.fs, newName) {
+			return fmt.Errorf("column %s already exists", newName)
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", errNoColumn, oldName)
+	}
+	if newName != "" && has(fs, newName) {
+		return fmt.Errorf("column %s already exists", newName)
+	}
+	return nil
+}
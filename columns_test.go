@@ -0,0 +1,138 @@
+package querystore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenameDropColumn(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+	dir := t.TempDir()
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64, BloomFilterRate: 0.01},
+		{Name: "tag", Type: ColumnTypeString},
+	}}
+	fs, err := OpenColumnFSWithOptions(dir, Options{Schema: schema, Indexes: []string{"tag"}})
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 20 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i), "tag": fmt.Sprint("t", i%2)}))
+	}
+	_, err = cs.Query(&Query{Where: Where("val", ConditionEquals, int64(3))})
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(dir, "val.int64.dat.bloom"))
+
+	assert.ErrorContains(t, fs.RenameColumn("missing", "x"), "no such column")
+	assert.ErrorContains(t, fs.RenameColumn("val", "tag"), "already exists")
+	assert.ErrorContains(t, fs.RenameColumn("val", "__val"), "cannot start with '__'")
+	require.NoError(t, fs.RenameColumn("val", "value"))
+	assert.NoFileExists(t, filepath.Join(dir, "val.int64.dat"))
+	assert.FileExists(t, filepath.Join(dir, "value.int64.dat.bloom"), "sidecars are renamed")
+	assert.Equal(t, "val", schema.Columns[0].Name, "the caller's schema is left alone")
+	require.Error(t, cs.Append(map[string]any{"val": int64(1)}))
+	require.NoError(t, cs.Append(map[string]any{"value": int64(20), "tag": "t0"}))
+	res, err := cs.Query(&Query{Where: Where("value", ConditionGreaterThanOrEquals, int64(18)), Select: []string{"value"}})
+	require.NoError(t, err)
+	assert.Len(t, res, 3)
+
+	require.NoError(t, fs.DropColumn("tag"))
+	assert.ErrorContains(t, fs.DropColumn("tag"), "no such column")
+	assert.NoFileExists(t, filepath.Join(dir, "tag.str.dat"))
+	cols, err := fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"value"}, lo.Map(cols, func(c ColumnInfo, _ int) string { return c.Name }))
+	require.NoError(t, fs.Close())
+
+	_, err = OpenColumnFSWithOptions(dir, Options{Schema: schema})
+	assert.ErrorContains(t, err, "is not declared in the schema", "the schema must be updated")
+	fs, err = OpenColumnFSWithOptions(dir, Options{Schema: &Schema{Columns: []ColumnSpec{{Name: "value", Type: ColumnTypeInt64, BloomFilterRate: 0.01}}}})
+	require.NoError(t, err)
+	cs = NewColumnarStore(fs)
+	res, err = cs.Query(&Query{Where: Where("value", ConditionEquals, int64(20))})
+	require.NoError(t, err)
+	assert.Len(t, res, 1)
+	require.NoError(t, fs.Close())
+
+	// Partitioned stores rename the columns of each partition.
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	fs, err = OpenColumnFSWithOptions(t.TempDir(), Options{Partitioning: PartitionHourly, Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	for i := range 3 {
+		now = now.Add(time.Hour)
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i)}))
+	}
+	require.NoError(t, cs.Append(map[string]any{"extra": "x"}))
+	require.NoError(t, fs.RenameColumn("val", "v"))
+	require.NoError(t, fs.DropColumn("extra"))
+	res, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "v"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res[0]["sum(v)"])
+	cols, err = fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"v"}, lo.Map(cols, func(c ColumnInfo, _ int) string { return c.Name }))
+}
+
+func TestColumnNames(t *testing.T) {
+	// Appends, schemas and renames name columns by the same rule.
+	cs := newTestStore(t)
+	require.NoError(t, cs.Append(map[string]any{"val": int64(1)}))
+	for _, name := range []string{"", "__val", "a/b", `a\b`} {
+		assert.Error(t, cs.Append(map[string]any{name: int64(1)}), name)
+		assert.Error(t, cs.fs.RenameColumn("val", name), name)
+		_, err := OpenColumnFSWithSchema(t.TempDir(), &Schema{Columns: []ColumnSpec{{Name: name, Type: ColumnTypeInt64}}})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestMigrateColumn(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"n": fmt.Sprint(i), "s": "x"}))
+	}
+	require.NoError(t, cs.Append(map[string]any{"n": "bad"}))
+
+	err = fs.MigrateColumn("n", ColumnTypeInt64, nil)
+	assert.ErrorIs(t, err, ErrTypeMismatch)
+	assert.FileExists(t, filepath.Join(dir, "n.str.dat"), "failed migrations leave the column alone")
+	assert.NoFileExists(t, filepath.Join(dir, "n.int64.dat.compact"))
+	assert.ErrorContains(t, fs.MigrateColumn("missing", ColumnTypeInt64, nil), "no such column")
+
+	require.NoError(t, fs.MigrateColumn("n", ColumnTypeInt64, func(v any) (any, error) {
+		if v == "bad" {
+			return nil, nil
+		}
+		return strconv.ParseInt(v.(string), 10, 64)
+	}))
+	assert.NoFileExists(t, filepath.Join(dir, "n.str.dat"))
+	res, err := cs.Query(&Query{Where: Where("n", ConditionGreaterThanOrEquals, int64(7)), Select: []string{"n"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(7), int64(8), int64(9)}, lo.Map(res, func(r map[string]any, _ int) any { return r["n"] }))
+	require.NoError(t, cs.Append(map[string]any{"n": int64(11)}))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cols, err := fs.columnTypes()
+	require.NoError(t, err)
+	assert.Equal(t, ColumnTypeInt64, cols["n"])
+	res, err = NewColumnarStore(fs).Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "n"}, {Type: AggregatorCount, Attribute: "n"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(56), res[0]["sum(n)"])
+	assert.Equal(t, int64(11), res[0]["count(n)"])
+}
@@ -0,0 +1,236 @@
+package querystore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// compactExt is appended to a column file's path to name the file it is
+// compacted into, which is renamed over it once complete.
+const compactExt = ".compact"
+
+// CompactOptions configures CompactWithOptions.
+type CompactOptions struct {
+	// Codec, if set, compresses every column with it, and Decompress stores
+	// every column uncompressed. Otherwise columns keep their codec.
+	Codec      Codec
+	Decompress bool
+	// Encodings changes the encoding of the named columns. Stores opened
+	// with a schema must then declare the new encodings.
+	Encodings map[string]Encoding
+}
+
+// Compact rewrites every column file densely. Records of pruned and deleted
+// rows are dropped, the frames of compressed columns written by many small
+// appends are merged into one per block, files of older formats are
+// upgraded, and block indexes, zone maps, bloom filters and checksums are
+// rebuilt. Each file is written beside the old one and renamed over it, so
+// queries already running keep reading the old files. Appends wait until it completes.
+func (fs *ColumnFS) Compact() error {
+	return fs.CompactWithOptions(CompactOptions{})
+}
+
+// CompactWithOptions is Compact, re-encoding columns as opts sets.
+func (fs *ColumnFS) CompactWithOptions(opts CompactOptions) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := registerStoreCodec(opts.Codec); err != nil {
+		return err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	if opts.Codec != nil {
+		fs.compactCodec = opts.Codec
+	}
+
+	for name, enc := range opts.Encodings {
+		ch, ok := fs.columnHandles[name]
+		switch {
+		case fs.partitioning != PartitionNone:
+		case !ok || strings.HasPrefix(name, "__"):
+			return fmt.Errorf("cannot re-encode unknown column %s", name)
+		case enc == EncodingRLE && !supportsRLE(ch.typ):
+			return fmt.Errorf("run-length encoding is not supported for %s column %s", ch.typ, name)
+		case enc != EncodingPlain && enc != EncodingRLE:
+			return fmt.Errorf("unknown encoding %d for column %s", enc, name)
+		}
+	}
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		// Partitions lack the columns appended only to others.
+		popts := opts
+		popts.Encodings = map[string]Encoding{}
+		for name, enc := range opts.Encodings {
+			if _, ok := p.fs.columnHandles[name]; ok {
+				popts.Encodings[name] = enc
+			}
+		}
+		if err := p.fs.CompactWithOptions(popts); err != nil {
+			return err
+		}
+	}
+	for name, ch := range fs.columnHandles {
+		if ch == fs.indexHandle {
+			continue
+		}
+		next := &ColumnHandle{path: ch.path, typ: ch.typ, version: formatVersion, flags: ch.flags, codec: ch.codec, bloomRate: ch.bloomRate, sketched: ch.sketched, backend: ch.backend}
+		if !strings.HasPrefix(name, "__") {
+			next.path = path.Join(fs.dir, makeColumnFileName(name, ch.typ))
+		}
+		if enc, ok := opts.Encodings[name]; ok {
+			next.flags = next.flags&^flagRLE | enc.flags()
+		}
+		switch {
+		case opts.Decompress:
+			next.codec = nil
+		case opts.Codec != nil:
+			next.codec = opts.Codec
+		}
+		if err := fs.compactColumn(ch, next, nil); err != nil {
+			return fmt.Errorf("compacting %s: %w", ch.path, err)
+		}
+	}
+	return nil
+}
+
+// compactColumn copies the records of the rows kept by pruning and not
+// deleted into the file of next, a block per write, then swaps it and its
+// sidecars in place of the column's files. Values are converted by convert,
+// if set. The caller must hold fs.lock.
+func (fs *ColumnFS) compactColumn(ch, next *ColumnHandle, convert func(any) (any, error)) error {
+	target := next.path
+	next.path += compactExt
+	if err := next.resetBlockIndex(); err != nil {
+		return err
+	}
+	if err := fs.backend.Remove(next.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := fs.copyRecords(ch, next, convert); err != nil {
+		next.Close()
+		next.resetBlockIndex()
+		fs.backend.Remove(next.path)
+		return err
+	}
+	if next.writeFp != nil {
+		if err := next.writeFp.Sync(); err != nil {
+			next.Close()
+			return err
+		}
+	}
+	if err := next.Close(); err != nil {
+		return err
+	}
+
+	// Sidecars missing once the column is renamed are rebuilt on next use,
+	// so the old ones are removed first.
+	if err := ch.Close(); err != nil {
+		return err
+	}
+	if err := ch.resetBlockIndex(); err != nil {
+		return err
+	}
+	if next.size == 0 {
+		// Columns without rows kept are left empty rather than headerless.
+		if err := writeFileSync(fs.backend, next.path, next.header().encode()); err != nil {
+			return err
+		}
+	}
+	if err := fs.backend.Rename(next.path, target); err != nil {
+		return err
+	}
+	for _, ext := range []string{blockIndexExt, zoneMapExt, bloomExt, hllExt, checksumExt, tailChecksumExt} {
+		if err := fs.backend.Rename(next.path+ext, target+ext); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if target != ch.path {
+		if err := fs.backend.Remove(ch.path); err != nil {
+			return err
+		}
+	}
+	ch.path, ch.version, ch.flags, ch.codec, ch.dataOffset = target, formatVersion, next.flags, next.codec, headerSize
+	ch.stats, ch.size = nil, 0
+	return nil
+}
+
+// copyRecords appends the records of ch for the rows kept by pruning and not
+// deleted to next, converting their values by convert if set. Values
+// converted to nil are dropped.
+func (fs *ColumnFS) copyRecords(ch, next *ColumnHandle, convert func(any) (any, error)) error {
+	if err := ch.loadBlockIndex(); err != nil {
+		return err
+	}
+	if ch.size <= ch.dataOffset {
+		return nil
+	}
+	start := ch.dataOffset
+	// Blocks before the one holding the first row kept are skipped.
+	if i := sort.Search(len(ch.blocks), func(i int) bool { return ch.blocks[i].firstIndex > fs.pruned }) - 1; i >= 0 {
+		start = ch.blocks[i].offset
+	}
+	cr, err := ch.createReaderAt(start)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	var p *pendingWrite
+	var rows int64
+	for {
+		index, v, run, err := cr.readRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if index < fs.pruned {
+			run, index = max(run-(fs.pruned-index), 0), fs.pruned
+		}
+		if convert != nil && run > 0 {
+			if v, err = convert(v); err != nil {
+				return fmt.Errorf("row %d: %w", index, err)
+			}
+			if v == nil {
+				continue
+			}
+		}
+		for i := index; i < index+run; i++ {
+			if fs.deleted(i) {
+				continue
+			}
+			if p == nil {
+				if p, err = next.newPendingWrite(); err != nil {
+					return err
+				}
+			}
+			if err := p.add(i, v); err != nil {
+				return err
+			}
+			if rows++; rows%blockIndexInterval == 0 {
+				if err := p.commit(); err != nil {
+					return err
+				}
+				p = nil
+			}
+		}
+	}
+	if p != nil {
+		return p.commit()
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package querystore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 16
+
+	dir := t.TempDir()
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	opts := Options{Codec: CodecFlate, Clock: func() time.Time { return now }, Indexes: []string{"kind"}}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 100 {
+		rec := map[string]any{"val": i, "kind": []string{"a", "b"}[i/50]}
+		if i%10 == 0 {
+			rec["sparse"] = float64(i)
+		}
+		require.NoError(t, cs.Append(rec))
+		now = now.Add(time.Minute)
+	}
+	query := func() []map[string]any {
+		rows, err := cs.Query(&Query{Select: []string{"*"}, Where: Where("kind", ConditionEquals, "b")})
+		require.NoError(t, err)
+		return rows
+	}
+	before := query()
+	require.Len(t, before, 50)
+	sizes := func() map[string]int64 {
+		infos, err := fs.Columns()
+		require.NoError(t, err)
+		return lo.SliceToMap(infos, func(c ColumnInfo) (string, int64) { return c.Name, c.Size })
+	}
+	uncompacted := sizes()
+
+	// Frames written a row at a time are merged.
+	require.NoError(t, cs.Compact())
+	assert.Less(t, sizes()["val"], uncompacted["val"])
+	assert.Equal(t, before, query())
+
+	// Records of pruned rows are dropped, and columns can be re-encoded.
+	_, err = fs.PruneBefore(now.Add(-30 * time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, fs.CompactWithOptions(CompactOptions{Decompress: true, Encodings: map[string]Encoding{"kind": EncodingRLE}}))
+	infos, err := fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []ColumnInfo{
+		{Name: "kind", Type: ColumnTypeString, Size: infos[0].Size, Count: 30, FirstIndex: 70, LastIndex: 99},
+		{Name: "sparse", Type: ColumnTypeFloat64, Size: infos[1].Size, Count: 3, FirstIndex: 70, LastIndex: 90},
+		{Name: "val", Type: ColumnTypeInt64, Size: infos[2].Size, Count: 30, FirstIndex: 70, LastIndex: 99},
+	}, infos)
+	assert.Equal(t, before[20:], query())
+	require.NoError(t, cs.Append(map[string]any{"val": 100, "kind": "b"}))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	rows := query()
+	require.Len(t, rows, 31)
+	assert.Equal(t, before[20:], rows[:30])
+	assert.Equal(t, int64(100), rows[30]["val"])
+	assert.ErrorContains(t, fs.CompactWithOptions(CompactOptions{Encodings: map[string]Encoding{"missing": EncodingRLE}}), "unknown column")
+}
@@ -0,0 +1,233 @@
+package querystore
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// Codec compresses the data of column files. Compressed column files hold a
+// sequence of frames, each the records of one write:
+//
+//	uncompressed length uint32 | compressed length uint32 | compressed records
+//
+// Frames are decompressed as readers reach them, and skipped whole when the
+// block index lets a reader jump past them. Each write is its own frame, so
+// appending a row at a time compresses each row alone, adding a frame header
+// and the codec's overhead to every row: files may then be larger than
+// uncompressed ones. Batch writes with AppendBatch or Options.WriteBufferRows,
+// or merge the frames of small appends with Compact, which writes one frame
+// per block.
+type Codec interface {
+	// ID identifies the codec in column file headers. ID 0 means no
+	// compression, and IDs below 128 are reserved for built-in codecs.
+	ID() uint8
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst.
+	Decompress(dst, src []byte) ([]byte, error)
+}
+
+// CodecFlate compresses column files with DEFLATE.
+var CodecFlate Codec = flateCodec{}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[uint8]Codec{CodecFlate.ID(): CodecFlate}
+)
+
+// RegisterCodec makes a codec available for reading column files, for
+// example to plug in snappy or zstd. Codecs passed in Options or a Schema are
+// registered automatically, except encryption codecs: they hold the keys of
+// the stores they are passed to, which resolve them themselves.
+func RegisterCodec(c Codec) error {
+	if _, ok := c.(*encryptionCodec); ok {
+		return errors.New("encryption codecs are not registered; pass them in Options or a Schema")
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if c.ID() == 0 {
+		return fmt.Errorf("codec ID 0 is reserved for uncompressed files")
+	}
+	if existing, ok := codecs[c.ID()]; ok && reflect.TypeOf(existing) != reflect.TypeOf(c) {
+		return fmt.Errorf("codec ID %d is already registered", c.ID())
+	}
+	codecs[c.ID()] = c
+	return nil
+}
+
+// registerStoreCodec registers a codec passed in Options, a Schema or
+// CompactOptions, unless it is an encryption codec.
+func registerStoreCodec(c Codec) error {
+	if _, ok := c.(*encryptionCodec); c == nil || ok {
+		return nil
+	}
+	return RegisterCodec(c)
+}
+
+// codec returns the codec of the ID in the header of a column's file. The
+// codecs the store was given are found first, so that stores opened with
+// different encryption keys each read with their own; other IDs are looked up
+// in the registry.
+func (fs *ColumnFS) codec(name string, id uint8) (Codec, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	if fs.opts.Schema != nil {
+		for _, c := range fs.opts.Schema.Columns {
+			if c.Name == name && c.Codec != nil && c.Codec.ID() == id {
+				return c.Codec, nil
+			}
+		}
+	}
+	for _, c := range []Codec{fs.opts.Codec, fs.compactCodec} {
+		if c != nil && c.ID() == id {
+			return c, nil
+		}
+	}
+	if id == encryptionCodecID {
+		return nil, fmt.Errorf("column %s is encrypted, and the store has no encryption codec", name)
+	}
+	return codecByID(id)
+}
+
+func codecByID(id uint8) (Codec, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec ID %d", id)
+	}
+	return c, nil
+}
+
+func codecID(c Codec) uint8 {
+	if c == nil {
+		return 0
+	}
+	return c.ID()
+}
+
+type flateCodec struct{}
+
+// Compressors and decompressors are reused across frames, as allocating
+// their state dominates the cost of compressing the small frames of single
+// appends.
+var (
+	flateWriters = sync.Pool{New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	flateReaders = sync.Pool{New: func() any { return flate.NewReader(bytes.NewReader(nil)) }}
+)
+
+func (flateCodec) ID() uint8 {
+	return 1
+}
+
+func (flateCodec) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) Decompress(dst, src []byte) ([]byte, error) {
+	r := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(r)
+	if err := r.(flate.Resetter).Reset(bytes.NewReader(src), nil); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(dst)
+	if _, err := io.Copy(buf, r); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const frameHeaderSize = 8
+
+// encodeFrame compresses records into a frame.
+func encodeFrame(codec Codec, records []byte) ([]byte, error) {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(records)/2)
+	frame, err := codec.Compress(frame, records)
+	if err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(records)))
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(frame)-frameHeaderSize))
+	return frame, nil
+}
+
+// readFrameRecord decodes the next record of a compressed column file,
+// decompressing the next frame when the current one is exhausted.
+func (cr *ColumnReader) readFrameRecord() (int64, rawValue, int64, error) {
+	for cr.framePos >= len(cr.frame) {
+		if err := cr.nextFrame(); err != nil {
+			return 0, rawValue{}, 0, err
+		}
+	}
+	b := cr.frame[cr.framePos:]
+	index, val, n, err := decodeRawRecord(cr.typ, cr.version, b)
+	run := int64(1)
+	if err == nil && cr.rle {
+		run, n, err = decodeRunLength(b, n)
+	}
+	if err == errShortRecord {
+		return 0, rawValue{}, 0, fmt.Errorf("corrupt frame at offset %d", cr.frameOffset)
+	}
+	if err != nil {
+		return 0, rawValue{}, 0, err
+	}
+	cr.framePos += n
+	return index, val, run, nil
+}
+
+func (cr *ColumnReader) nextFrame() error {
+	offset := cr.position()
+	header, err := cr.rawBytes(frameHeaderSize)
+	if err != nil {
+		return err
+	}
+	size := int(binary.LittleEndian.Uint32(header[0:4]))
+	payload, err := cr.rawBytes(int(binary.LittleEndian.Uint32(header[4:8])))
+	if err != nil {
+		return err
+	}
+	frame, err := cr.codec.Decompress(cr.frame[:0], payload)
+	if err != nil {
+		return fmt.Errorf("decompressing frame at offset %d: %w", offset, err)
+	}
+	if len(frame) != size {
+		return fmt.Errorf("frame at offset %d decompressed to %d bytes, expected %d", offset, len(frame), size)
+	}
+	cr.frame, cr.framePos, cr.frameOffset = frame, 0, offset
+	return nil
+}
+
+// rawBytes consumes the next n bytes of the file. A frame cut short by the end
+// of the file reads as io.EOF, like a partial record.
+func (cr *ColumnReader) rawBytes(n int) ([]byte, error) {
+	for len(cr.buf)-cr.pos < n {
+		if err := cr.fill(); err != nil {
+			return nil, err
+		}
+	}
+	b := cr.buf[cr.pos : cr.pos+n]
+	cr.pos += n
+	return b, nil
+}
@@ -0,0 +1,79 @@
+package querystore
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompression(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 16
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "up", Type: ColumnTypeBool, Encoding: EncodingRLE},
+		{Name: "raw", Type: ColumnTypeInt64, Codec: noCodec{}},
+	}}
+	fs, err := OpenColumnFSWithOptions(dir, Options{Schema: schema, Codec: CodecFlate})
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for batch := range 4 {
+		var rows []map[string]any
+		for i := batch * 50; i < (batch+1)*50; i++ {
+			rows = append(rows, map[string]any{"val": i, "name": "host-" + strconv.Itoa(i%3), "up": i%100 < 90, "raw": i})
+		}
+		require.NoError(t, cs.AppendBatch(rows))
+	}
+	require.NoError(t, cs.Append(map[string]any{"val": 200, "name": "host-2", "up": true, "raw": 200}))
+
+	infos, err := fs.Columns()
+	require.NoError(t, err)
+	sizes := lo.SliceToMap(infos, func(info ColumnInfo) (string, int64) { return info.Name, info.Size })
+	assert.Less(t, sizes["val"], int64(201*16)/2)
+	assert.Less(t, sizes["name"], int64(201*18)/4)
+	require.NoError(t, fs.Close())
+
+	for _, mmap := range []bool{false, true} {
+		fs, err = OpenColumnFSWithOptions(dir, Options{Schema: schema, MemoryMap: mmap})
+		require.NoError(t, err)
+		cs = NewColumnarStore(fs)
+		rows, err := cs.Query(&Query{Select: []string{"val", "name", "raw"}, Offset: 120, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []any{int64(120), int64(121)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+		assert.Equal(t, "host-0", rows[0]["name"])
+		assert.Equal(t, int64(121), rows[1]["raw"])
+
+		rows, err = cs.Query(&Query{
+			Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorSum, Attribute: "val"}},
+			Where:        And(Where("up", ConditionEquals, false), Where("val", ConditionGreaterThan, 150)),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, int64(10), rows[0]["count"])
+		assert.Equal(t, int64(1945), rows[0]["sum(val)"])
+		require.NoError(t, fs.Close())
+	}
+}
+
+// noCodec stores frames uncompressed.
+type noCodec struct{}
+
+func (noCodec) ID() uint8 {
+	return 200
+}
+
+func (noCodec) Compress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
+
+func (noCodec) Decompress(dst, src []byte) ([]byte, error) {
+	return append(dst, src...), nil
+}
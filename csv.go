@@ -0,0 +1,339 @@
+package querystore
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// CSVOptions configures ImportCSV.
+type CSVOptions struct {
+	// Comma is the field delimiter, ',' by default.
+	Comma rune
+	// NoHeader marks input whose first record is a row rather than the
+	// column names. Columns then name the columns, or else they are named
+	// col1, col2 and so on.
+	NoHeader bool
+	// Columns names the columns, overriding the header.
+	Columns []string
+	// Types sets the types of columns. Columns the store already has keep
+	// their type, and the type of others is inferred from the values in the
+	// first batch: the first of bool, int64, float64, time (RFC 3339) and
+	// string that every value parses as.
+	Types map[string]ColumnType
+	// NullTokens are the field values imported as nulls, which leave the
+	// column without a value in the row. Empty fields are always null.
+	NullTokens []string
+	// BatchSize is the number of rows appended at a time, 1000 by default.
+	BatchSize int
+	// OnError is called with each record that cannot be imported, which is
+	// skipped unless OnError returns an error, which ends the import. If
+	// OnError is nil, the first such record ends the import.
+	OnError func(err *CSVError) error
+}
+
+// CSVError is a record of CSV input that cannot be imported.
+type CSVError struct {
+	// Line is the line of the record in the input.
+	Line int
+	// Column is the column whose value is invalid, if any.
+	Column string
+	Err    error
+}
+
+func (e *CSVError) Error() string {
+	if e.Column != "" {
+		return fmt.Sprintf("csv line %d, column %s: %v", e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("csv line %d: %v", e.Line, e.Err)
+}
+
+func (e *CSVError) Unwrap() error { return e.Err }
+
+// defaultImportBatchSize is the number of rows bulk imports append at a time.
+const defaultImportBatchSize = 1000
+
+// inferredTypes are the types CSV values are inferred as, in order of
+// preference.
+var inferredTypes = []ColumnType{ColumnTypeBool, ColumnTypeInt64, ColumnTypeFloat64, ColumnTypeTime, ColumnTypeString}
+
+// ImportCSV appends the records of CSV input as rows, a batch at a time,
+// returning the number of rows appended.
+func (s *ColumnarStore) ImportCSV(r io.Reader, opts CSVOptions) (int64, error) {
+	cr := csv.NewReader(r)
+	if opts.Comma != 0 {
+		cr.Comma = opts.Comma
+	}
+	cr.FieldsPerRecord = -1
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatchSize
+	}
+	types, err := s.fs.columnTypes()
+	if err != nil {
+		return 0, err
+	}
+	for name, typ := range opts.Types {
+		types[name] = typ
+	}
+	isNull := func(field string) bool {
+		return field == "" || slices.Contains(opts.NullTokens, field)
+	}
+	reject := func(e *CSVError) error {
+		if opts.OnError == nil {
+			return e
+		}
+		return opts.OnError(e)
+	}
+
+	columns := opts.Columns
+	if !opts.NoHeader {
+		header, err := cr.Read()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if columns == nil {
+			columns = slices.Clone(header)
+		}
+	}
+
+	var imported int64
+	var pending []csvRecord
+	flush := func() error {
+		inferCSVTypes(types, columns, pending, isNull)
+		rows := make([]map[string]any, 0, len(pending))
+	records:
+		for _, rec := range pending {
+			if len(rec.fields) > len(columns) {
+				if err := reject(&CSVError{Line: rec.line, Err: fmt.Errorf("record has %d fields, but there are %d columns", len(rec.fields), len(columns))}); err != nil {
+					return err
+				}
+				continue
+			}
+			row := make(map[string]any, len(rec.fields))
+			for i, field := range rec.fields {
+				if isNull(field) {
+					continue
+				}
+				v, err := parseTextValue(field, types[columns[i]])
+				if err != nil {
+					if err := reject(&CSVError{Line: rec.line, Column: columns[i], Err: err}); err != nil {
+						return err
+					}
+					continue records
+				}
+				row[columns[i]] = v
+			}
+			rows = append(rows, row)
+		}
+		pending = pending[:0]
+		if err := s.AppendBatch(rows); err != nil {
+			return err
+		}
+		imported += int64(len(rows))
+		return nil
+	}
+
+	for {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var perr *csv.ParseError
+			if !errors.As(err, &perr) {
+				return imported, err
+			}
+			if err := reject(&CSVError{Line: perr.Line, Err: perr.Err}); err != nil {
+				return imported, err
+			}
+			continue
+		}
+		for len(columns) < len(fields) && (opts.NoHeader && opts.Columns == nil) {
+			columns = append(columns, "col"+strconv.Itoa(len(columns)+1))
+		}
+		line, _ := cr.FieldPos(0)
+		pending = append(pending, csvRecord{line: line, fields: fields})
+		if len(pending) == batchSize {
+			if err := flush(); err != nil {
+				return imported, err
+			}
+		}
+	}
+	if len(pending) > 0 {
+		if err := flush(); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// csvRecord is a record read from CSV input and the line it starts on.
+type csvRecord struct {
+	line   int
+	fields []string
+}
+
+// inferCSVTypes infers the types of the columns without one from the values
+// of the records.
+func inferCSVTypes(types map[string]ColumnType, columns []string, records []csvRecord, isNull func(string) bool) {
+	for i, name := range columns {
+		if _, ok := types[name]; ok {
+			continue
+		}
+		candidates := slices.Clone(inferredTypes)
+		seen := false
+		for _, rec := range records {
+			if i >= len(rec.fields) || isNull(rec.fields[i]) {
+				continue
+			}
+			seen = true
+			candidates = slices.DeleteFunc(candidates, func(typ ColumnType) bool {
+				_, err := parseTextValue(rec.fields[i], typ)
+				return err != nil
+			})
+		}
+		if seen {
+			types[name] = candidates[0]
+		}
+	}
+}
+
+// parseTextValue parses the text form of a value of a column type.
+func parseTextValue(s string, typ ColumnType) (any, error) {
+	switch typ {
+	case ColumnTypeBool:
+		return strconv.ParseBool(s)
+	case ColumnTypeInt64:
+		return strconv.ParseInt(s, 10, 64)
+	case ColumnTypeInt32:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return int32(v), err
+	case ColumnTypeUint64:
+		return strconv.ParseUint(s, 10, 64)
+	case ColumnTypeFloat64:
+		return strconv.ParseFloat(s, 64)
+	case ColumnTypeTime:
+		return time.Parse(time.RFC3339Nano, s)
+	case ColumnTypeJSON:
+		if !json.Valid([]byte(s)) {
+			return nil, errors.New("invalid JSON")
+		}
+		return json.RawMessage(s), nil
+	}
+	return s, nil
+}
+
+// ExportCSV writes the results of a query to w as CSV, streaming them when
+// the query allows, with a header row naming the columns. Row queries
+// export their selected columns in order, with "*" expanding to the index,
+// timestamp and stored columns in name order; queries without Select and a
+// nil query export every column. Aggregate queries export the group and then
+// each aggregation.
+func (s *ColumnarStore) ExportCSV(w io.Writer, q *Query) error {
+	q, columns := s.exportColumns(q)
+	it, err := s.QueryIter(q)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	cw := csv.NewWriter(w)
+	if err := cw.Write(columns); err != nil {
+		return err
+	}
+	record := make([]string, len(columns))
+	for it.Next() {
+		row := it.Row()
+		for i, col := range columns {
+			record[i] = formatTextValue(row[col])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportColumns returns the query to run for an export of the results of q,
+// and the columns of its results in the order they are exported.
+func (s *ColumnarStore) exportColumns(q *Query) (*Query, []string) {
+	if q == nil {
+		q = &Query{}
+	}
+	qc := *q
+	q = &qc
+	var columns []string
+	if aggs := q.aggregations(); len(aggs) > 0 {
+		columns = append(columns, q.groupColumns()...)
+		for _, a := range aggs {
+			columns = append(columns, a.Name())
+		}
+		return q, columns
+	}
+	if len(q.Select) == 0 {
+		q.Select = []string{"*"}
+	}
+	q.ReuseRows = true
+	s.fs.lock.Lock()
+	defer s.fs.lock.Unlock()
+	for _, col := range q.Select {
+		if col == "*" {
+			columns = append(columns, IndexColumn, TimestampColumn)
+			columns = append(columns, s.fs.columnNames()...)
+		} else {
+			columns = append(columns, col)
+		}
+	}
+	return q, lo.Uniq(columns)
+}
+
+// exportTypes returns the types of the columns of an export known before the
+// query runs. Row queries export stored columns with their type, and paths
+// into JSON columns as JSON; other columns are typed by their values.
+func (s *ColumnarStore) exportTypes(q *Query, columns []string) (map[string]ColumnType, error) {
+	known := map[string]ColumnType{}
+	if len(q.aggregations()) > 0 {
+		return known, nil
+	}
+	types, err := s.fs.columnTypes()
+	if err != nil {
+		return nil, err
+	}
+	types[IndexColumn], types[TimestampColumn] = ColumnTypeInt64, ColumnTypeTime
+	for _, name := range columns {
+		if typ, ok := types[name]; ok {
+			known[name] = typ
+		} else if parent, _, ok := strings.Cut(name, "."); ok && types[parent] == ColumnTypeJSON {
+			known[name] = ColumnTypeJSON
+		}
+	}
+	return known, nil
+}
+
+// formatTextValue formats a value as text that parseTextValue parses back.
+func formatTextValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case json.RawMessage:
+		return string(v)
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, string, time.Time:
+		return valueToString(v)
+	}
+	return string(encodeJSONValue(v))
+}
@@ -0,0 +1,96 @@
+package querystore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportCSV(t *testing.T) {
+	cs := newTestStore(t)
+	input := "name;ok;count;score;at\n" +
+		"a;true;1;1.5;2024-01-02T03:04:05Z\n" +
+		"b;false;NA;2;2024-01-02T03:04:06Z\n" +
+		"c;true;x;3;2024-01-02T03:04:07Z\n"
+	var rejected []*CSVError
+	n, err := cs.ImportCSV(strings.NewReader(input), CSVOptions{
+		Comma:      ';',
+		NullTokens: []string{"NA"},
+		Types:      map[string]ColumnType{"count": ColumnTypeInt64},
+		OnError: func(err *CSVError) error {
+			rejected = append(rejected, err)
+			return nil
+		},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	require.Len(t, rejected, 1)
+	assert.Equal(t, 4, rejected[0].Line)
+	assert.Equal(t, "count", rejected[0].Column)
+
+	rows, err := cs.Query(&Query{Select: []string{"name", "ok", "count", "score", "at"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "a", rows[0]["name"])
+	assert.Equal(t, true, rows[0]["ok"])
+	assert.Equal(t, int64(1), rows[0]["count"])
+	assert.Equal(t, 1.5, rows[0]["score"])
+	assert.True(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Equal(rows[0]["at"].(time.Time)))
+	assert.Nil(t, rows[1]["count"])
+	assert.Equal(t, 2.0, rows[1]["score"])
+
+	_, err = cs.ImportCSV(strings.NewReader("name,count\nd,y\n"), CSVOptions{})
+	var csvErr *CSVError
+	require.ErrorAs(t, err, &csvErr)
+	assert.Equal(t, 2, csvErr.Line)
+
+	n, err = cs.ImportCSV(strings.NewReader("e,4\n"), CSVOptions{NoHeader: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	rows, err = cs.Query(&Query{Select: []string{"col1", "col2"}, Where: Where("col1", ConditionEquals, "e")})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(4), rows[0]["col2"])
+}
+
+func TestExportCSV(t *testing.T) {
+	cs := newTestStore(t)
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"name": "a, b", "score": 1.5, "tags": map[string]any{"x": 1}},
+		{"name": "say \"hi\"", "score": 2.0},
+		{"score": 3.0},
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, cs.ExportCSV(&buf, &Query{Select: []string{"score", "name"}}))
+	assert.Equal(t, "score,name\n1.5,\"a, b\"\n2,\"say \"\"hi\"\"\"\n3,\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, cs.ExportCSV(&buf, nil))
+	header, _, _ := strings.Cut(buf.String(), "\n")
+	assert.Equal(t, "__index,__timestamp,name,score,tags", header)
+	assert.Contains(t, buf.String(), `"{""x"":1}"`)
+
+	buf.Reset()
+	require.NoError(t, cs.ExportCSV(&buf, &Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "score"}, {Type: AggregatorCount}}}))
+	assert.Equal(t, "sum(score),count\n6.5,3\n", buf.String())
+
+	copied := newTestStore(t)
+	buf.Reset()
+	require.NoError(t, cs.ExportCSV(&buf, &Query{Select: []string{"name", "score"}}))
+	n, err := copied.ImportCSV(&buf, CSVOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	want, err := cs.Query(&Query{Select: []string{"name", "score"}})
+	require.NoError(t, err)
+	got, err := copied.Query(&Query{Select: []string{"name", "score"}})
+	require.NoError(t, err)
+	for i := range want {
+		assert.Equal(t, want[i]["name"], got[i]["name"])
+		assert.Equal(t, want[i]["score"], got[i]["score"])
+	}
+}
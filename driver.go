@@ -0,0 +1,196 @@
+package querystore
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// DriverName is the name the database/sql driver is registered under. Its
+// data source names are store directories, opened with OpenColumnFS and
+// shared by the connections to them. Statements are SELECTs in the dialect
+// of QueryFromSQL, with ? placeholders for values; stores are read-only through the driver.
+//
+//	db, err := sql.Open(querystore.DriverName, "/var/lib/events")
+//	rows, err := db.Query("SELECT name, latency FROM events WHERE latency > ? LIMIT 10", 500)
+const DriverName = "querystore"
+
+func init() {
+	sql.Register(DriverName, &sqlDriver{stores: map[string]*sharedStore{}})
+}
+
+// NewConnector returns a connector for sql.OpenDB that queries an open
+// store. Closing the sql.DB leaves the store open.
+func NewConnector(store *ColumnarStore) driver.Connector {
+	return &sqlConnector{store: store}
+}
+
+type sqlDriver struct {
+	lock   sync.Mutex
+	stores map[string]*sharedStore
+}
+
+// sharedStore is a store opened by the driver, closed once the last
+// connection to it is.
+type sharedStore struct {
+	store *ColumnarStore
+	conns int
+}
+
+func (d *sqlDriver) Open(dir string) (driver.Conn, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	shared := d.stores[dir]
+	if shared == nil {
+		fs, err := OpenColumnFS(dir)
+		if err != nil {
+			return nil, err
+		}
+		shared = &sharedStore{store: NewColumnarStore(fs)}
+		d.stores[dir] = shared
+	}
+	shared.conns++
+	return &sqlConn{store: shared.store, release: func() error {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if shared.conns--; shared.conns > 0 {
+			return nil
+		}
+		delete(d.stores, dir)
+		return shared.store.fs.Close()
+	}}, nil
+}
+
+type sqlConnector struct {
+	store *ColumnarStore
+}
+
+func (c *sqlConnector) Connect(context.Context) (driver.Conn, error) {
+	return &sqlConn{store: c.store}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return &sqlDriver{stores: map[string]*sharedStore{}}
+}
+
+type sqlConn struct {
+	store   *ColumnarStore
+	release func() error
+}
+
+var errReadOnly = errors.New("querystore: only SELECT statements are supported")
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := parseSQL(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{conn: c, stmt: stmt}, nil
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	stmt, err := c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.(*sqlStmt).QueryContext(ctx, args)
+}
+
+func (c *sqlConn) Close() error {
+	if c.release == nil {
+		return nil
+	}
+	return c.release()
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return nil, errReadOnly
+}
+
+type sqlStmt struct {
+	conn *sqlConn
+	stmt *sqlStatement
+}
+
+func (s *sqlStmt) Close() error  { return nil }
+func (s *sqlStmt) NumInput() int { return s.stmt.params }
+
+func (s *sqlStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errReadOnly
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return s.QueryContext(context.Background(), named)
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) != s.stmt.params {
+		return nil, fmt.Errorf("querystore: statement takes %d arguments, got %d", s.stmt.params, len(args))
+	}
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	q := *s.stmt.q
+	q.Where = bindSQLParams(q.Where, values)
+	bound, columns := s.conn.store.exportColumns(&q)
+	if s.stmt.columns != nil {
+		columns = s.stmt.columns
+	}
+	it, err := s.conn.store.QueryIterContext(ctx, bound)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlRows{it: it, columns: columns}, nil
+}
+
+type sqlRows struct {
+	it      *Rows
+	columns []string
+}
+
+func (r *sqlRows) Columns() []string { return r.columns }
+func (r *sqlRows) Close() error      { return r.it.Close() }
+
+func (r *sqlRows) Next(dest []driver.Value) error {
+	if !r.it.Next() {
+		if err := r.it.Err(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	row := r.it.Row()
+	for i, col := range r.columns {
+		dest[i] = driverValue(row[col])
+	}
+	return nil
+}
+
+// driverValue converts a result value to one of the types database/sql
+// drivers return.
+func driverValue(v any) driver.Value {
+	switch v := v.(type) {
+	case nil, bool, int64, float64, string, time.Time:
+		return v
+	case uint64:
+		if v > math.MaxInt64 {
+			return valueToString(v)
+		}
+		return int64(v)
+	case int, int8, int16, int32, uint, uint8, uint16, uint32:
+		return valueToInt64(v)
+	case float32:
+		return float64(v)
+	}
+	return encodeJSONValue(v)
+}
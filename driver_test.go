@@ -0,0 +1,63 @@
+package querystore
+
+import (
+	"database/sql"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDriver(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"name": "n" + strconv.Itoa(i), "val": i, "ok": i%2 == 0}))
+	}
+	require.NoError(t, fs.Close())
+
+	db, err := sql.Open(DriverName, dir)
+	require.NoError(t, err)
+	defer db.Close()
+	rows, err := db.Query(`SELECT name, val FROM events WHERE val >= ? AND ok = TRUE AND name != 'n''8' LIMIT 2 OFFSET 1`, 3)
+	require.NoError(t, err)
+	cols, err := rows.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"name", "val"}, cols)
+	var names []string
+	for rows.Next() {
+		var name string
+		var val int
+		require.NoError(t, rows.Scan(&name, &val))
+		names = append(names, name+"="+strconv.Itoa(val))
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"n6=6", "n8=8"}, names)
+
+	var count int
+	require.NoError(t, db.QueryRow("select val from t where name is not null and val < 1").Scan(&count))
+	assert.Zero(t, count)
+	rows, err = db.Query("SELECT count(*) AS n, ok FROM t WHERE val IN (?, ?, ?) GROUP BY ok ORDER BY ok DESC", 1, 2, 4)
+	require.NoError(t, err)
+	cols, err = rows.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"n", "ok"}, cols)
+	require.True(t, rows.Next())
+	var ok bool
+	require.NoError(t, rows.Scan(&count, &ok))
+	assert.Equal(t, 2, count)
+	assert.True(t, ok)
+	require.NoError(t, rows.Close())
+	_, err = db.Exec("DELETE FROM t")
+	assert.Error(t, err)
+	_, err = db.Query("SELECT name FROM t WHERE")
+	assert.ErrorContains(t, err, "end of statement")
+
+	db2 := sql.OpenDB(NewConnector(newTestStore(t)))
+	defer db2.Close()
+	var n int
+	assert.ErrorIs(t, db2.QueryRow("SELECT * FROM t").Scan(&n), sql.ErrNoRows)
+}
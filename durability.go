@@ -0,0 +1,134 @@
+package querystore
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// Durability chooses when writes are flushed to stable storage, trading
+// throughput for crash safety.
+type Durability int
+
+const (
+	// DurabilityNone leaves flushing to the operating system. Writes survive
+	// a crash of the process, but not of the machine.
+	DurabilityNone Durability = iota
+	// DurabilityEveryWrite syncs the write-ahead log before each write and
+	// the written files after it, so a write survives a machine crash once it
+	// returns.
+	DurabilityEveryWrite
+	// DurabilityInterval syncs written files every Options.SyncInterval, so a
+	// machine crash loses at most the writes of the last interval.
+	DurabilityInterval
+)
+
+// defaultSyncInterval is used by DurabilityInterval when Options.SyncInterval
+// is not set.
+const defaultSyncInterval = time.Second
+
+// markDirty records files written since they were last synced.
+func (fs *ColumnFS) markDirty(writes []*pendingWrite) {
+	if fs.dirty == nil {
+		fs.dirty = map[*ColumnHandle]bool{}
+	}
+	for _, p := range writes {
+		fs.dirty[p.ch] = true
+	}
+}
+
+// syncDirty flushes the files written since the last sync to stable storage.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) syncDirty() error {
+	var errs []error
+	for ch := range fs.dirty {
+		if ch.writeFp != nil {
+			errs = append(errs, ch.writeFp.Sync())
+		}
+		delete(fs.dirty, ch)
+	}
+	return errors.Join(errs...)
+}
+
+// Flush hands any data buffered by the store to the operating system,
+// writing the rows of the write buffer. Without a write buffer, Flush only
+// waits for writes in progress to finish.
+func (fs *ColumnFS) Flush() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	for _, p := range fs.partitions {
+		if err := p.fs.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync flushes every write made so far to stable storage, whatever the
+// durability policy, for example before snapshotting the store's directory.
+func (fs *ColumnFS) Sync() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	if err := fs.syncDirty(); err != nil {
+		return err
+	}
+	for _, p := range fs.partitions {
+		if err := p.fs.Sync(); err != nil {
+			return err
+		}
+	}
+	return syncDir(fs.backend, fs.dir)
+}
+
+// syncDir flushes a directory's entries to stable storage.
+func syncDir(b ColumnBackend, dir string) error {
+	fp, err := b.OpenFile(dir, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
+
+// startSyncer starts the background sync of DurabilityInterval.
+func (fs *ColumnFS) startSyncer() {
+	interval := fs.opts.SyncInterval
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+	fs.stopSync = make(chan struct{})
+	fs.syncDone = make(chan struct{})
+	go func() {
+		defer close(fs.syncDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fs.lock.Lock()
+				// Errors resurface when the files are synced on Close.
+				if err := fs.syncDirty(); err != nil {
+					fs.syncErr = err
+				}
+				fs.lock.Unlock()
+			case <-fs.stopSync:
+				return
+			}
+		}
+	}()
+}
+
+// stopSyncer stops the background sync, if running.
+func (fs *ColumnFS) stopSyncer() {
+	if fs.stopSync != nil {
+		close(fs.stopSync)
+		<-fs.syncDone
+		fs.stopSync = nil
+	}
+}
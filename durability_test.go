@@ -0,0 +1,50 @@
+package querystore
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDurability(t *testing.T) {
+	for _, opts := range []Options{
+		{Durability: DurabilityNone},
+		{Durability: DurabilityEveryWrite},
+		{Durability: DurabilityInterval, SyncInterval: time.Millisecond},
+	} {
+		dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+		defer os.RemoveAll(dir)
+
+		fs, err := OpenColumnFSWithOptions(dir, opts)
+		require.NoError(t, err)
+		cs := NewColumnarStore(fs)
+		require.NoError(t, cs.AppendBatch(benchmarkRows(10)))
+		switch opts.Durability {
+		case DurabilityNone:
+			assert.NotEmpty(t, fs.dirty)
+			require.NoError(t, cs.Flush())
+			require.NoError(t, cs.Sync())
+			assert.Empty(t, fs.dirty)
+		case DurabilityEveryWrite:
+			assert.Empty(t, fs.dirty)
+		case DurabilityInterval:
+			assert.Eventually(t, func() bool {
+				fs.lock.Lock()
+				defer fs.lock.Unlock()
+				return len(fs.dirty) == 0
+			}, time.Second, time.Millisecond)
+		}
+		require.NoError(t, fs.Close())
+
+		fs, err = OpenColumnFSWithOptions(dir, opts)
+		require.NoError(t, err)
+		rows, err := NewColumnarStore(fs).Query(&Query{})
+		require.NoError(t, err)
+		assert.Len(t, rows, 10)
+		require.NoError(t, fs.Close())
+	}
+}
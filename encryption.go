@@ -0,0 +1,170 @@
+package querystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// KeyProvider returns the AES key with an ID, of 16, 24 or 32 bytes, for
+// example from a key management service. Keys are fetched once per codec.
+type KeyProvider func(id uint32) ([]byte, error)
+
+// StaticKey returns a provider of a single key, with ID 0.
+func StaticKey(key []byte) KeyProvider {
+	return func(id uint32) ([]byte, error) {
+		if id != 0 {
+			return nil, fmt.Errorf("unknown key ID %d", id)
+		}
+		return key, nil
+	}
+}
+
+// encryptionCodecID is the ID of codecs returned by EncryptionCodec. They are
+// never registered: each store reads with the encryption codec it was
+// given, so stores with different keys can be open at once.
+const encryptionCodecID = 2
+
+// Encrypted frames hold a random nonce, then their header and records
+// sealed together:
+//
+//	nonce | sealed(inner codec ID uint8 | records)
+//
+// Frames do not record their key, which is found by trying each key the
+// codec knows of until one opens the frame.
+
+// EncryptionCodec returns a codec encrypting the frames of column files with
+// AES-GCM under the key keyID of keys, after compressing them with inner
+// unless it is nil. Pass it as Options.Codec or ColumnSpec.Codec of sensitive
+// columns. Encrypted columns keep neither zone maps nor bloom filters, which
+// would reveal their values; the index file, and the block indexes and
+// distinct sketches of columns, are not encrypted.
+//
+// Frames are read with the key keyID or one of previousKeyIDs, which must
+// name every key that frames of the stores the codec reads were written
+// with. To rotate keys, reopen the store with a codec of a new key ID listing
+// the old one in previousKeyIDs, and compact it, which encrypts every frame
+// again with the new key.
+func EncryptionCodec(keyID uint32, keys KeyProvider, inner Codec, previousKeyIDs ...uint32) Codec {
+	ids := append([]uint32{keyID}, previousKeyIDs...)
+	return &encryptionCodec{keyID: keyID, keyIDs: ids, keys: keys, inner: inner, aeads: map[uint32]cipher.AEAD{}}
+}
+
+type encryptionCodec struct {
+	keyID uint32
+	// keyIDs lists the keys frames are read with, the last to open a frame
+	// first.
+	keyIDs []uint32
+	keys   KeyProvider
+	inner  Codec
+
+	mu    sync.Mutex
+	aeads map[uint32]cipher.AEAD
+}
+
+// encrypted reports whether a column's frames are encrypted.
+func (ch *ColumnHandle) encrypted() bool {
+	_, ok := ch.codec.(*encryptionCodec)
+	return ok
+}
+
+func (c *encryptionCodec) ID() uint8 {
+	return encryptionCodecID
+}
+
+// aead returns the cipher of a key.
+func (c *encryptionCodec) aead(id uint32) (cipher.AEAD, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aead, ok := c.aeads[id]; ok {
+		return aead, nil
+	}
+	key, err := c.keys(id)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %d: %w", id, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key %d: %w", id, err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+func (c *encryptionCodec) Compress(dst, src []byte) ([]byte, error) {
+	aead, err := c.aead(c.keyID)
+	if err != nil {
+		return nil, err
+	}
+	if c.inner != nil {
+		if src, err = c.inner.Compress(nil, src); err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	plain := append([]byte{codecID(c.inner)}, src...)
+	return aead.Seal(append(dst, nonce...), nonce, plain, nil), nil
+}
+
+func (c *encryptionCodec) Decompress(dst, src []byte) ([]byte, error) {
+	plain, err := c.open(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 {
+		return nil, errors.New("encrypted frame has no header")
+	}
+	inner := c.inner
+	if id := plain[0]; id != codecID(inner) {
+		if inner, err = codecByID(id); err != nil {
+			return nil, err
+		}
+	}
+	if inner == nil {
+		return append(dst, plain[1:]...), nil
+	}
+	return inner.Decompress(dst, plain[1:])
+}
+
+// open decrypts a frame with the first of the codec's keys to open it, and
+// tries that key first for the next.
+func (c *encryptionCodec) open(src []byte) ([]byte, error) {
+	c.mu.Lock()
+	ids := slices.Clone(c.keyIDs)
+	c.mu.Unlock()
+	var errs []error
+	for i, id := range ids {
+		aead, err := c.aead(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(src) < aead.NonceSize()+aead.Overhead() {
+			return nil, errors.New("encrypted frame is too short")
+		}
+		nonce := src[:aead.NonceSize()]
+		plain, err := aead.Open(nil, nonce, src[aead.NonceSize():], nil)
+		if err == nil {
+			if i > 0 {
+				c.mu.Lock()
+				if j := slices.Index(c.keyIDs, id); j > 0 {
+					c.keyIDs = slices.Insert(slices.Delete(c.keyIDs, j, j+1), 0, id)
+				}
+				c.mu.Unlock()
+			}
+			return plain, nil
+		}
+		errs = append(errs, fmt.Errorf("encryption key %d: %w", id, err))
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,147 @@
+package querystore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptionCodec(t *testing.T) {
+	dir := t.TempDir()
+	keys := map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32), 2: bytes.Repeat([]byte{2}, 16)}
+	provider := func(id uint32) ([]byte, error) {
+		if key, ok := keys[id]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("no key %d", id)
+	}
+	fs, err := OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(1, provider, CodecFlate)})
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	var rows []map[string]any
+	for i := range 1000 {
+		rows = append(rows, map[string]any{"ssn": fmt.Sprintf("secret-%d", i), "n": int64(i)})
+	}
+	require.NoError(t, cs.AppendBatch(rows[:500]))
+	require.NoError(t, cs.AppendBatch(rows[500:]))
+	ssnPath := fs.columnHandles["ssn"].path
+	require.NoError(t, fs.Close())
+
+	data, err := os.ReadFile(ssnPath)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "secret")
+
+	query := func() ([]map[string]any, error) {
+		return cs.Query(&Query{Select: []string{"ssn"}, Filters: []Filter{{Attribute: "n", Condition: ConditionEquals, Value: int64(742)}}})
+	}
+	// Frames do not record their key, so it must be listed to be read.
+	fs, err = OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(2, provider, nil)})
+	if err == nil {
+		_, err = NewColumnarStore(fs).Query(&Query{Select: []string{"ssn"}})
+		require.NoError(t, fs.Close())
+	}
+	assert.ErrorContains(t, err, "authentication failed")
+
+	// Keys are rotated by compacting with a codec of the new key.
+	fs, err = OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(2, provider, nil, 1)})
+	require.NoError(t, err)
+	cs = NewColumnarStore(fs)
+	res, err := query()
+	require.NoError(t, err)
+	assert.Equal(t, "secret-742", res[0]["ssn"])
+	require.NoError(t, fs.Compact())
+	require.NoError(t, fs.Close())
+
+	delete(keys, 1)
+	fs, err = OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(2, provider, nil)})
+	require.NoError(t, err)
+	cs = NewColumnarStore(fs)
+	res, err = query()
+	require.NoError(t, err)
+	assert.Equal(t, "secret-742", res[0]["ssn"])
+	require.NoError(t, fs.Close())
+
+	// Files are not repaired when their key is wrong.
+	correct := keys[2]
+	keys[2] = bytes.Repeat([]byte{3}, 16)
+	_, err = OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(2, provider, nil)})
+	assert.ErrorContains(t, err, "authentication failed")
+	keys[2] = correct
+	fs, err = OpenColumnFSWithOptions(dir, Options{Codec: EncryptionCodec(2, provider, nil)})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	res, err = query()
+	require.NoError(t, err)
+	assert.Equal(t, "secret-742", res[0]["ssn"])
+}
+
+func TestEncryptionSidecars(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := t.TempDir()
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "ssn", Type: ColumnTypeString, BloomFilterRate: 0.01, DistinctSketch: true},
+		{Name: "n", Type: ColumnTypeInt64},
+	}}
+	opts := Options{Schema: schema, Codec: EncryptionCodec(0, StaticKey(bytes.Repeat([]byte{1}, 32)), CodecFlate)}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 20 {
+		require.NoError(t, cs.Append(map[string]any{"ssn": fmt.Sprintf("secret-%d", i), "n": int64(i)}))
+	}
+	res, err := cs.Query(&Query{Select: []string{"n"}, Filters: []Filter{{Attribute: "ssn", Condition: ConditionEquals, Value: "secret-7"}}})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, int64(7), res[0]["n"])
+	require.NoError(t, fs.Close())
+
+	// No file holds the values of the encrypted column.
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "secret", p)
+		return nil
+	}))
+	assert.NoFileExists(t, filepath.Join(dir, "ssn.str.dat.zone"))
+	assert.NoFileExists(t, filepath.Join(dir, "ssn.str.dat.bloom"))
+}
+
+func TestEncryptionStores(t *testing.T) {
+	// Each store reads with its own codec, whichever was opened last.
+	open := func(dir string, key byte, readOnly bool) *ColumnFS {
+		fs, err := OpenColumnFSWithOptions(dir, Options{ReadOnly: readOnly, Codec: EncryptionCodec(0, StaticKey(bytes.Repeat([]byte{key}, 32)), nil)})
+		require.NoError(t, err)
+		t.Cleanup(func() { fs.Close() })
+		return fs
+	}
+	dirA, dirB := t.TempDir(), t.TempDir()
+	writer := open(dirA, 1, false)
+	require.NoError(t, NewColumnarStore(writer).Append(map[string]any{"ssn": "secret-a"}))
+	follower := open(dirA, 1, true)
+	require.NoError(t, NewColumnarStore(open(dirB, 2, false)).Append(map[string]any{"ssn": "secret-b"}))
+
+	require.NoError(t, NewColumnarStore(writer).Append(map[string]any{"ssn": "secret-c"}))
+	grew, err := follower.Refresh()
+	require.NoError(t, err)
+	assert.True(t, grew)
+	res, err := NewColumnarStore(follower).Query(&Query{Select: []string{"ssn"}})
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, "secret-c", res[1]["ssn"])
+
+	// Encrypted stores cannot be read without their codec.
+	_, err = OpenColumnFSWithOptions(dirB, Options{ReadOnly: true})
+	assert.ErrorContains(t, err, "no encryption codec")
+	assert.Error(t, RegisterCodec(EncryptionCodec(0, StaticKey(bytes.Repeat([]byte{1}, 32)), nil)))
+}
@@ -0,0 +1,53 @@
+package querystore
+
+// Enricher adds virtual columns to the rows of a query by looking up the
+// value of one of their columns, a lighter alternative to joining a small
+// dimension table, such as one mapping country codes to regions.
+type Enricher struct {
+	// Column holds the values looked up.
+	Column string
+	// Columns names the virtual columns. Rows hold each of them, as nil if
+	// the lookup does not return it; other returned columns are ignored.
+	Columns []string
+	// Lookup returns the virtual columns for a value of Column, and is not
+	// called for rows without one. It must be safe for concurrent use by
+	// parallel queries.
+	Lookup func(v any) map[string]any
+}
+
+// LookupMap returns a lookup of the entries of m, for use by an Enricher.
+// Values not of the key type of m find nothing.
+func LookupMap[K comparable](m map[K]map[string]any) func(v any) map[string]any {
+	return func(v any) map[string]any {
+		k, ok := v.(K)
+		if !ok {
+			return nil
+		}
+		return m[k]
+	}
+}
+
+// enrichColumns returns the columns the query's enrichers look up.
+func (q *Query) enrichColumns() []string {
+	var cols []string
+	for _, e := range q.Enrichers {
+		cols = append(cols, e.Column)
+	}
+	return cols
+}
+
+// enrich adds the virtual columns of the query's enrichers to out, looking up
+// the values of row. Columns already in out are left alone.
+func (c *cursor) enrich(row, out map[string]any) {
+	for _, e := range c.q.Enrichers {
+		var found map[string]any
+		if v := row[e.Column]; v != nil && e.Lookup != nil {
+			found = e.Lookup(v)
+		}
+		for _, col := range e.Columns {
+			if out[col] == nil {
+				out[col] = found[col]
+			}
+		}
+	}
+}
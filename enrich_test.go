@@ -0,0 +1,43 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichers(t *testing.T) {
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := range 100 {
+		rows = append(rows, map[string]any{"country": []string{"us", "de", "jp", "xx"}[i%4], "val": int64(i)})
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	regions := LookupMap(map[string]map[string]any{
+		"us": {"region": "amer", "currency": "usd"},
+		"de": {"region": "emea", "currency": "eur"},
+		"jp": {"region": "apac", "currency": "jpy"},
+	})
+	q, err := NewQuery().Select("val").Enrich("country", regions, "region").Where("val", Ge, int64(90)).OrderBy("region").BuildFor(cs)
+	require.NoError(t, err)
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	// Countries without an entry have no region, which sorts first.
+	assert.Equal(t, []any{nil, nil, nil, "amer", "amer", "apac", "apac", "apac", "emea", "emea"},
+		lo.Map(res, func(row map[string]any, _ int) any { return row["region"] }))
+	assert.NotContains(t, res[3], "currency")
+	assert.Equal(t, int64(92), res[3]["val"])
+
+	q.Parallelism = 3
+	q.OrderBy = nil
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, "apac", res[0]["region"])
+
+	_, err = NewQuery().Enrich("missing", regions, "region").BuildFor(cs)
+	assert.ErrorContains(t, err, "unknown column missing")
+}
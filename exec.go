@@ -0,0 +1,674 @@
+package querystore
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// cursor walks the rows of a store that match a query's filters, in index
+// order.
+type cursor struct {
+	ctx    context.Context
+	q      *Query
+	lastID int64
+	next   int64
+	// scanned counts the rows visited row by row or in batches. The context
+	// is checked every batchSize rows, and before each batch.
+	scanned int
+	// readers are keyed by attribute, and columns by column name.
+	readers map[string]valueReader
+	columns map[string]*ColumnReader
+	// computed holds the expressions of the query's computed columns.
+	computed map[string]*expr
+	tsReader *ColumnReader
+	pred     predicate
+	agg      *aggregateState
+	// extraCols are read for rows that pass the filters.
+	extraCols []string
+	selected  []string
+	// sortCols are the columns ordered by but not selected, which are read
+	// to sort the rows and dropped from them once sorted.
+	sortCols []string
+	// masks replace the values of the restricted columns selected by
+	// unauthorized queries. See ColumnPolicy.
+	masks map[string]func(any) any
+	// batch evaluates the filters over batches of rows, when they all allow
+	// it, decoding the values of batchCols into vectors. mask holds the
+	// matches of the batch [batchStart, batchEnd).
+	batch      batchPredicate
+	batchCols  map[string]*batchColumn
+	mask       []bool
+	batchStart int64
+	batchEnd   int64
+	// rowBuf and projBuf are reused for every row if set, when rows are
+	// not kept past the next one.
+	rowBuf  map[string]any
+	projBuf map[string]any
+	// aggCols are the columns of the aggregations, and groupCols those of the
+	// group-by attributes, when aggregates are computed from vectors instead
+	// of rows. Attributes without a column have nil entries.
+	vectorAgg bool
+	// sketchAgg is set when the aggregates are merged from the distinct
+	// sketches of the columns' blocks.
+	sketchAgg bool
+	aggCols   []*batchColumn
+	groupCols []*batchColumn
+	// parts are cursors over consecutive ranges of the rows, which parallel
+	// queries scan concurrently in place of the cursor itself. Cursors over
+	// partitions have a part per partition, read in turn when streamed from
+	// part. base is the index of a part's first row in the store.
+	parts []*cursor
+	part  int
+	base  int64
+}
+
+// openCursor snapshots the rows committed so far and opens readers limited to
+// them. Once open, the cursor reads without the lock, so appends can proceed
+// concurrently.
+func openCursor(ctx context.Context, fs *ColumnFS, q *Query) (*cursor, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	// Prepared queries were checked when prepared.
+	if q.plan == nil {
+		if err := fs.checkPolicies(q); err != nil {
+			return nil, invalidQuery(err)
+		}
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return nil, err
+	}
+	if fs.partitioning != PartitionNone {
+		return openPartitionCursor(ctx, fs, q)
+	}
+
+	start, end, err := fs.rowRange(q.TimeRange)
+	if err != nil {
+		return nil, err
+	}
+	start, end = max(start, fs.pruned), max(end, fs.pruned)
+	if q.Parallelism <= 1 {
+		return newCursor(ctx, fs, q, start, end)
+	}
+	c := &cursor{ctx: ctx, q: q, next: start, lastID: end}
+	if c.agg, err = newQueryAggregates(q, nil); err != nil {
+		return nil, err
+	}
+	if c.agg == nil {
+		c.sortCols = q.sortColumns(q.selectedColumns(fs))
+	}
+	n := int64(q.Parallelism)
+	for i := range n {
+		partStart, partEnd := start+(end-start)*i/n, start+(end-start)*(i+1)/n
+		if partStart == partEnd {
+			continue
+		}
+		part, err := newCursor(ctx, fs, q, partStart, partEnd)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		c.parts = append(c.parts, part)
+	}
+	return c, nil
+}
+
+func newQueryAggregates(q *Query, typeOf func(col string) (ColumnType, error)) (*aggregateState, error) {
+	aggs := q.aggregations()
+	if len(aggs) == 0 {
+		return nil, nil
+	}
+	if q.GroupByTime < 0 {
+		return nil, invalidQuery(errors.New("negative time interval to group by"))
+	}
+	agg, err := newBucketedAggregateState(aggs, q.groupColumns(), q.GroupByTimeColumn, q.GroupByTime, typeOf)
+	return agg, invalidQuery(err)
+}
+
+// newCursor opens a cursor over the rows [start, end). The caller must hold
+// fs.lock.
+func newCursor(ctx context.Context, fs *ColumnFS, q *Query, start, end int64) (*cursor, error) {
+	c := &cursor{
+		ctx:       ctx,
+		q:         q,
+		next:      start,
+		lastID:    end,
+		readers:   map[string]valueReader{},
+		columns:   map[string]*ColumnReader{},
+		batchCols: map[string]*batchColumn{},
+	}
+	var err error
+	if c.computed, err = compileComputed(q.Computed, fs.exprColumnType); err != nil {
+		return nil, invalidQuery(err)
+	}
+	typeOf := func(col string) (ColumnType, error) {
+		if e := c.computed[col]; e != nil {
+			return e.typ, nil
+		}
+		return fs.exprColumnType(col)
+	}
+	if c.agg, err = newQueryAggregates(q, typeOf); err != nil {
+		return nil, err
+	}
+	aggs := q.aggregations()
+
+	cols := map[string]bool{}
+	where := q.filterExpression()
+	where.walkFilters(func(f Filter) {
+		cols[f.Attribute] = true
+	})
+	c.selected, c.masks = fs.restrictSelected(q, q.selectedColumns(fs))
+	if c.agg == nil {
+		c.sortCols = q.sortColumns(q.selectedColumns(fs))
+		if c.selected != nil {
+			c.selected = append(slices.Clip(c.selected), c.sortCols...)
+		}
+	}
+	if c.agg != nil {
+		for _, a := range aggs {
+			c.extraCols = append(c.extraCols, a.columns()...)
+		}
+		c.extraCols = append(c.extraCols, q.groupColumns()...)
+		if q.GroupByTime > 0 && q.GroupByTimeColumn != "" && q.GroupByTimeColumn != TimestampColumn {
+			c.extraCols = append(c.extraCols, q.GroupByTimeColumn)
+		}
+	} else {
+		c.extraCols = c.selected
+		for _, col := range append(q.enrichColumns(), c.sortCols...) {
+			if !slices.Contains(c.extraCols, col) {
+				c.extraCols = append(slices.Clip(c.extraCols), col)
+			}
+		}
+	}
+	for _, col := range c.extraCols {
+		cols[col] = true
+	}
+
+	for attr := range cols {
+		if err := c.openReader(fs, attr); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+
+	if where != nil {
+		if c.pred, err = compilePredicate(where, c.readers, q.plan.filters()); err != nil {
+			c.close()
+			return nil, err
+		}
+		if c.batch, err = compileBatchPredicate(where, c.readers, c.batchCols, q.plan.filters()); err != nil {
+			c.close()
+			return nil, err
+		}
+		c.restrictToBitmaps()
+	}
+	c.excludeDeleted(fs.tombstones)
+
+	if c.agg == nil || !q.TimeRange.IsZero() || c.agg.timeCol == TimestampColumn {
+		if c.tsReader, err = fs.createReader(fs.indexHandle); err != nil {
+			c.close()
+			return nil, err
+		}
+		c.traceReader(fs, TimestampColumn, c.tsReader)
+	}
+	if c.agg != nil {
+		// Aggregated rows are discarded once added.
+		c.reuseRows()
+		c.vectorAgg = c.tsReader == nil && c.agg.bucket == 0 && (c.pred == nil || c.batch != nil) && c.bindAggregateColumns()
+		c.sketchAgg = c.usesSketches()
+	}
+	return c, nil
+}
+
+// openReader opens a reader for an attribute, which is either a column or a
+// path within a JSON column. Attributes matching neither have no reader.
+func (c *cursor) openReader(fs *ColumnFS, attr string) error {
+	if e, ok := c.computed[attr]; ok {
+		if e == nil {
+			return nil
+		}
+		return c.openComputed(fs, attr, e)
+	}
+	col, path := attr, []string(nil)
+	if fs.columnHandles[col] == nil {
+		var ok bool
+		if col, path, ok = fs.resolveJSONPath(attr); !ok {
+			return nil
+		}
+	}
+	cr := c.columns[col]
+	if cr == nil {
+		var err error
+		if cr, err = fs.createReader(fs.columnHandles[col]); err != nil {
+			return err
+		}
+		c.traceReader(fs, col, cr)
+		c.columns[col] = cr
+	}
+	if path != nil {
+		c.readers[attr] = &pathReader{cr: cr, path: path}
+	} else {
+		c.readers[attr] = cr
+	}
+	return nil
+}
+
+// nextRow returns the next matching row, or nil once the scan is exhausted.
+func (c *cursor) nextRow() (map[string]any, error) {
+	if c.parts != nil {
+		return c.nextPartRow()
+	}
+	if c.batch != nil {
+		return c.nextBatchRow()
+	}
+	for ; c.next < c.lastID; c.next++ {
+		if c.scanned++; c.scanned%batchSize == 0 {
+			if err := c.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+		i := c.next
+		row, err := c.newRow(i)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			continue
+		}
+		if c.pred != nil {
+			ok, err := c.pred.eval(i, row)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				// Skip rows the predicate cannot match; the loop
+				// increments next once more.
+				c.next = min(c.pred.nextCandidate(i), c.lastID) - 1
+				continue
+			}
+		}
+		c.next++
+		return c.finishRow(i, row)
+	}
+	return nil, nil
+}
+
+// nextPartRow is nextRow for cursors split into parts, which are read in
+// turn.
+func (c *cursor) nextPartRow() (map[string]any, error) {
+	for ; c.part < len(c.parts); c.part++ {
+		row, err := c.parts[c.part].nextRow()
+		if err != nil || row != nil {
+			return row, err
+		}
+	}
+	return nil, nil
+}
+
+// nextBatchRow is nextRow for cursors that evaluate their filters in
+// batches.
+func (c *cursor) nextBatchRow() (map[string]any, error) {
+	for c.next < c.lastID {
+		if c.next >= c.batchEnd {
+			if err := c.ctx.Err(); err != nil {
+				return nil, err
+			}
+			n := int(min(batchSize, c.lastID-c.next))
+			c.scanned += n
+			mask, err := c.batch.evalBatch(c.next, n)
+			if err != nil {
+				return nil, err
+			}
+			c.mask, c.batchStart, c.batchEnd = mask, c.next, c.next+int64(n)
+			if !slices.Contains(mask, true) {
+				c.next = max(c.batchEnd, min(c.batch.nextCandidate(c.batchEnd), c.lastID))
+				continue
+			}
+		}
+		i := c.next
+		c.next++
+		if !c.mask[i-c.batchStart] {
+			continue
+		}
+		row, err := c.newRow(i)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			continue
+		}
+		if err := c.batch.record(int(i-c.batchStart), row); err != nil {
+			return nil, err
+		}
+		return c.finishRow(i, row)
+	}
+	return nil, nil
+}
+
+// newRow starts the row for index i, or returns nil if the row is outside the
+// query's time range.
+func (c *cursor) newRow(i int64) (map[string]any, error) {
+	var ts any
+	if c.tsReader != nil {
+		var err error
+		if ts, err = c.tsReader.SeekToIndex(i); err != nil {
+			return nil, err
+		}
+		if ts == nil || !c.q.TimeRange.contains(ts.(int64)) {
+			return nil, nil
+		}
+	}
+	if c.rowBuf != nil {
+		clear(c.rowBuf)
+		c.rowBuf[IndexColumn], c.rowBuf[TimestampColumn] = c.base+i, ts
+		return c.rowBuf, nil
+	}
+	return map[string]any{
+		IndexColumn:     c.base + i,
+		TimestampColumn: ts,
+	}, nil
+}
+
+// finishRow adds the extra columns to a matched row. Columns decoded in
+// batches are read from their vectors, as their readers are past the row.
+func (c *cursor) finishRow(i int64, row map[string]any) (map[string]any, error) {
+	for _, col := range c.extraCols {
+		var v any
+		if bc := c.batchCols[col]; bc != nil {
+			if err := bc.load(c.batchStart, int(c.batchEnd-c.batchStart)); err != nil {
+				return nil, err
+			}
+			v = bc.vec.box(int(i - c.batchStart))
+		} else if cr := c.readers[col]; cr != nil {
+			var err error
+			if v, err = cr.SeekToIndex(i); err != nil {
+				return nil, err
+			}
+		}
+		if v != nil {
+			row[col] = v
+		}
+	}
+	if c.agg != nil {
+		return row, nil
+	}
+	out := row
+	if c.selected != nil {
+		if c.rowBuf != nil {
+			c.projBuf = projectRow(c.projBuf, row, c.selected)
+			out = c.projBuf
+		} else {
+			out = projectRow(nil, row, c.selected)
+		}
+	}
+	c.maskRow(out)
+	c.enrich(row, out)
+	return out, nil
+}
+
+// rowsScanned returns the number of rows the cursor and its parts visited.
+func (c *cursor) rowsScanned() int64 {
+	n := int64(c.scanned)
+	for _, part := range c.parts {
+		n += part.rowsScanned()
+	}
+	return n
+}
+
+// reuseRows makes the cursor return the same maps for every row.
+func (c *cursor) reuseRows() {
+	c.rowBuf = map[string]any{}
+	for _, part := range c.parts {
+		part.reuseRows()
+	}
+}
+
+// scan reads the remaining rows, aggregating them or returning them. If keep
+// is positive, only the first keep rows are read, or the last keep rows kept
+// if tail is set.
+func (c *cursor) scan(keep int, tail bool) ([]map[string]any, error) {
+	if c.sketchAgg {
+		return nil, c.aggregateSketches()
+	}
+	if c.vectorAgg {
+		return nil, c.aggregateBatches()
+	}
+	var rows []map[string]any
+	for {
+		row, err := c.nextRow()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return rows, nil
+		}
+		if c.agg != nil {
+			c.agg.add(row)
+			continue
+		}
+		rows = append(rows, row)
+		if keep > 0 && len(rows) >= keep {
+			if !tail {
+				return rows, nil
+			}
+			rows = rows[len(rows)-keep:]
+		}
+	}
+}
+
+// scanParts scans the parts of the cursor, concurrently for parallel
+// queries, then merges their aggregates or returns their rows in index order.
+func (c *cursor) scanParts(keep int, tail bool) ([]map[string]any, error) {
+	results := make([][]map[string]any, len(c.parts))
+	errs := make([]error, len(c.parts))
+	var wg sync.WaitGroup
+	for i, part := range c.parts {
+		if c.q.Parallelism <= 1 {
+			results[i], errs[i] = part.scan(keep, tail)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = part.scan(keep, tail)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.agg != nil {
+		for _, part := range c.parts {
+			c.agg.merge(part.agg)
+		}
+		return nil, nil
+	}
+	rows := slices.Concat(results...)
+	if keep > 0 && len(rows) > keep {
+		if tail {
+			rows = rows[len(rows)-keep:]
+		} else {
+			rows = rows[:keep]
+		}
+	}
+	return rows, nil
+}
+
+func (c *cursor) close() error {
+	var errs []error
+	for _, part := range c.parts {
+		errs = append(errs, part.close())
+	}
+	for _, cr := range c.columns {
+		errs = append(errs, cr.Close())
+	}
+	for _, r := range c.readers {
+		if r, ok := r.(*computedReader); ok {
+			errs = append(errs, r.Close())
+		}
+	}
+	if c.tsReader != nil {
+		errs = append(errs, c.tsReader.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Rows is an iterator over the results of a query.
+//
+//	rows, err := store.QueryIter(q)
+//	...
+//	defer rows.Close()
+//	for rows.Next() {
+//		row := rows.Row()
+//	}
+//	if err := rows.Err(); err != nil {
+//		...
+//	}
+type Rows struct {
+	q   *Query
+	cur *cursor
+	// fs is the store queried, which waits for the query to close before it
+	// shuts down. The query started at start, and is traced by span.
+	fs    *ColumnFS
+	start time.Time
+	span  Span
+	// buffered holds the full result set of materialized queries.
+	buffered     []map[string]any
+	materialized bool
+	skipped      int
+	emitted      int
+	row          map[string]any
+	err          error
+}
+
+// materialize runs the scan to completion, aggregating, sorting and
+// paginating the results into the buffer.
+func (r *Rows) materialize() error {
+	keep, tail := 0, false
+	if byIndex, descending := r.q.ordersByIndex(); r.cur.agg == nil && byIndex && r.q.Limit > 0 {
+		// Append order only needs the first offset+limit rows, or the last
+		// ones if descending.
+		keep, tail = r.q.Offset+r.q.Limit, descending
+	}
+	scan := r.cur.scan
+	if len(r.cur.parts) > 0 {
+		scan = r.cur.scanParts
+	}
+	name := "querystore.scan"
+	if r.cur.agg != nil {
+		name = "querystore.aggregate"
+	}
+	_, span := r.fs.startSpan(r.cur.ctx, name)
+	rows, err := scan(keep, tail)
+	if err != nil {
+		span.End(err)
+		return err
+	}
+	if r.cur.agg != nil {
+		rows = r.cur.agg.results()
+		span.SetAttribute("method", r.cur.aggregateMethod())
+		span.SetAttribute("groups", len(rows))
+	} else {
+		span.SetAttribute("rows", len(rows))
+	}
+	span.End(nil)
+	r.q.sortRows(rows)
+	r.buffered = r.q.paginate(rows)
+	for _, row := range r.buffered {
+		for _, col := range r.cur.sortCols {
+			delete(row, col)
+		}
+	}
+	r.materialized = true
+	return nil
+}
+
+// Next advances to the next result row, returning false when the results are
+// exhausted or an error occurs.
+func (r *Rows) Next() bool {
+	r.row = nil
+	if r.err != nil || r.cur == nil {
+		return false
+	}
+	if r.materialized {
+		if len(r.buffered) == 0 {
+			return false
+		}
+		r.row, r.buffered = r.buffered[0], r.buffered[1:]
+		r.emitted++
+		return true
+	}
+	if r.q.Limit > 0 && r.emitted >= r.q.Limit {
+		return false
+	}
+	for {
+		row, err := r.cur.nextRow()
+		if err != nil {
+			r.err = err
+			return false
+		}
+		if row == nil {
+			return false
+		}
+		if r.skipped < r.q.Offset {
+			r.skipped++
+			continue
+		}
+		r.emitted++
+		r.row = row
+		return true
+	}
+}
+
+// Row returns the current result row. The map is owned by the caller, unless
+// the query set ReuseRows.
+func (r *Rows) Row() map[string]any {
+	return r.row
+}
+
+// Scan copies the current row's fields into dest, clearing it first.
+func (r *Rows) Scan(dest map[string]any) error {
+	if r.row == nil {
+		return errors.New("querystore: Scan called without a current row")
+	}
+	clear(dest)
+	maps.Copy(dest, r.row)
+	return nil
+}
+
+// ScanStruct populates the struct pointed to by dst from the current row,
+// using the same field mapping as AppendStruct.
+func (r *Rows) ScanStruct(dst any) error {
+	if r.row == nil {
+		return errors.New("querystore: ScanStruct called without a current row")
+	}
+	return fieldsToStruct(r.row, dst)
+}
+
+// Err returns the error, if any, encountered during iteration.
+func (r *Rows) Err() error {
+	return r.err
+}
+
+// Close releases the column readers held by the iterator. It is safe to call
+// more than once.
+func (r *Rows) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	scanned := r.cur.rowsScanned()
+	r.fs.finishQuery(r.q, r.start, scanned, r.emitted, r.err)
+	err := r.cur.close()
+	r.span.SetAttribute("rows_scanned", scanned)
+	r.span.SetAttribute("rows", r.emitted)
+	r.span.End(r.err)
+	r.cur = nil
+	r.buffered = nil
+	r.fs.endQuery()
+	return err
+}
@@ -0,0 +1,219 @@
+package querystore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func BenchmarkQueryScan(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		b.Run(fmt.Sprintf("mmap=%v", mmap), func(b *testing.B) {
+			dir := b.TempDir()
+			fs := lo.Must(OpenColumnFSWithOptions(dir, Options{MemoryMap: mmap}))
+			defer fs.Close()
+			cs := NewColumnarStore(fs)
+			for range 100 {
+				if err := cs.AppendBatch(benchmarkRows(1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			q := &Query{
+				Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorSum, Attribute: "val"}},
+				Filters:      []Filter{{Attribute: "name", Condition: ConditionStartsWith, Value: "99"}},
+			}
+			b.ResetTimer()
+			for range b.N {
+				if _, err := cs.Query(q); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 16
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "flag", Type: ColumnTypeBool, Encoding: EncodingRLE},
+	}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			batch := make([]map[string]any, 10)
+			for j := range batch {
+				batch[j] = map[string]any{"val": 10*i + j, "flag": true}
+			}
+			if err := cs.AppendBatch(batch); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	last := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		rows, err := cs.Query(&Query{Select: []string{"val", "flag"}})
+		require.NoError(t, err)
+		// Every query sees whole batches, with every value of each row.
+		require.Zero(t, len(rows)%10)
+		require.GreaterOrEqual(t, len(rows), last)
+		for _, row := range rows {
+			require.Equal(t, row[IndexColumn], row["val"])
+			require.Equal(t, true, row["flag"])
+		}
+		last = len(rows)
+	}
+	assert.Equal(t, 2000, last)
+}
+
+func TestParallelQueries(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 16
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	var rows []map[string]any
+	for i := 0; i < 1000; i++ {
+		row := map[string]any{"val": i, "group": strconv.Itoa(i % 7)}
+		if i%3 == 0 {
+			row["price"] = float64(i) / 4
+		}
+		rows = append(rows, row)
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	queries := []*Query{
+		{Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 100}}, Select: []string{"*"}},
+		{Where: Or(Where("price", ConditionLessThan, 50), Where("group", ConditionEquals, "3")), Limit: 10, Offset: 5},
+		{OrderBy: []Order{{Attribute: IndexColumn, Descending: true}}, Limit: 20, Offset: 3},
+		{OrderBy: []Order{{Attribute: "price", Descending: true}}, Select: []string{"price"}, Limit: 15},
+		{
+			Aggregations: []Aggregation{
+				{Type: AggregatorCount},
+				{Type: AggregatorSum, Attribute: "val"},
+				{Type: AggregatorMin, Attribute: "price"},
+				{Type: AggregatorMax, Attribute: "price"},
+				{Type: AggregatorAvg, Attribute: "price"},
+			},
+			GroupBy: "group",
+		},
+	}
+	for _, q := range queries {
+		want, err := cs.Query(q)
+		require.NoError(t, err)
+		require.NotEmpty(t, want)
+		for _, n := range []int{2, 3, 16, 5000} {
+			pq := *q
+			pq.Parallelism = n
+			got, err := cs.Query(&pq)
+			require.NoError(t, err)
+			assert.Equal(t, want, got, "parallelism %d", n)
+		}
+	}
+}
+
+func TestReuseRows(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 1}, {"val": 2}, {"val": 3}}))
+
+	for _, q := range []*Query{{ReuseRows: true, Where: Where("val", ConditionGreaterThan, 0)}, {ReuseRows: true, Select: []string{"val"}}} {
+		rows, err := cs.QueryIter(q)
+		require.NoError(t, err)
+		var vals []any
+		var first map[string]any
+		for rows.Next() {
+			row := rows.Row()
+			if first == nil {
+				first = row
+			}
+			assert.Equal(t, reflect.ValueOf(first).Pointer(), reflect.ValueOf(row).Pointer())
+			vals = append(vals, row["val"])
+		}
+		require.NoError(t, rows.Err())
+		require.NoError(t, rows.Close())
+		assert.Equal(t, []any{int64(1), int64(2), int64(3)}, vals)
+	}
+
+	// Rows that are sorted are kept, so are not reused.
+	rows, err := cs.Query(&Query{ReuseRows: true, Select: []string{"val"}, OrderBy: []Order{{Attribute: "val", Descending: true}}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(3), int64(2), int64(1)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+}
+
+func TestQueryContext(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatchContext(context.Background(), benchmarkRows(3*batchSize)))
+
+	// Cancelling mid-scan ends iteration within a batch of rows.
+	for _, q := range []*Query{{}, {Where: Where("val", ConditionGreaterThanOrEquals, 0)}} {
+		ctx, cancel := context.WithCancel(context.Background())
+		rows, err := cs.QueryIterContext(ctx, q)
+		require.NoError(t, err)
+		n := 0
+		for rows.Next() {
+			if n++; n == 1 {
+				cancel()
+			}
+		}
+		assert.ErrorIs(t, rows.Err(), context.Canceled)
+		assert.Less(t, n, 2*batchSize)
+		require.NoError(t, rows.Close())
+		cancel()
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = cs.QueryContext(ctx, &Query{Parallelism: 2, Aggregations: []Aggregation{{Type: AggregatorCount}}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Appends with a cancelled context write nothing.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, cs.AppendContext(ctx, map[string]any{"val": -1}), context.Canceled)
+	rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3*batchSize), rows[0]["count"])
+}
@@ -0,0 +1,530 @@
+package querystore
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/samber/lo"
+)
+
+// ComputedColumn is a column whose value for each row is computed from an
+// expression over the row's stored columns, such as "latency_ns / 1e6" or
+// "a + b > c". Queries select, filter, group, aggregate and sort by computed
+// columns by name, like stored ones.
+//
+// Expressions combine columns, numbers, single-quoted strings, true and false
+// with the arithmetic operators +, -, *, / and %, the comparisons =, !=, <,
+// <=, > and >=, and parentheses. They are typed against the store's columns:
+// arithmetic on integers yields int64, or uint64 if both operands are, and
+// on any float64 yields float64; + also joins strings, and comparisons yield
+// bools. Values of JSON paths are float64. Dividing by zero yields no value,
+// as does any operand without one.
+type ComputedColumn struct {
+	Name string
+	Expr string
+}
+
+// errUnknownExprColumn is returned by the column type lookups of expressions
+// for columns the store does not have.
+var errUnknownExprColumn = errors.New("unknown column")
+
+// expr is a node of a parsed expression. Leaves are columns, read by reader
+// once bound, and constants; other nodes apply op to l, and r if binary.
+type expr struct {
+	op     string
+	col    string
+	value  any
+	l, r   *expr
+	typ    ColumnType
+	reader valueReader
+}
+
+const (
+	exprColumn   = "column"
+	exprConstant = "constant"
+	exprNegate   = "negate"
+)
+
+// compileComputed parses the expressions of computed columns and types them,
+// looking up the columns they use with typeOf. Columns whose expressions use
+// unknown columns map to nil, as they have no values.
+func compileComputed(cols []ComputedColumn, typeOf func(col string) (ColumnType, error)) (map[string]*expr, error) {
+	computed := map[string]*expr{}
+	for _, cc := range cols {
+		if cc.Name == "" {
+			return nil, errors.New("computed column name cannot be empty")
+		}
+		if strings.HasPrefix(cc.Name, "__") {
+			return nil, fmt.Errorf("column name cannot start with '__': %s", cc.Name)
+		}
+		if _, ok := computed[cc.Name]; ok {
+			return nil, fmt.Errorf("duplicate computed column: %s", cc.Name)
+		}
+		if _, err := typeOf(cc.Name); err == nil {
+			return nil, fmt.Errorf("computed column %s shadows a stored column", cc.Name)
+		}
+		e, err := parseExpr(cc.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("computed column %s: %w", cc.Name, err)
+		}
+		if err := e.check(typeOf); errors.Is(err, errUnknownExprColumn) {
+			e = nil
+		} else if err != nil {
+			return nil, fmt.Errorf("computed column %s: %w", cc.Name, err)
+		}
+		computed[cc.Name] = e
+	}
+	return computed, nil
+}
+
+type exprToken struct {
+	text string
+	// quoted is set for string literals.
+	quoted bool
+}
+
+func lexExpr(s string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, exprToken{text: s[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case strings.ContainsRune("!<>=", c) && i+1 < len(s) && s[i+1] == '=':
+			toks = append(toks, exprToken{text: s[i : i+2]})
+			i += 2
+		case strings.ContainsRune("+-*/%()<>=", c):
+			toks = append(toks, exprToken{text: s[i : i+1]})
+			i++
+		case c == '_' || c == '.' || unicode.IsLetter(c) || unicode.IsDigit(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				// Exponents of numbers may be signed.
+				if (s[j] == 'e' || s[j] == 'E') && j+1 < len(s) && (s[j+1] == '+' || s[j+1] == '-') && unicode.IsDigit(rune(s[i])) {
+					j++
+				}
+				j++
+			}
+			toks = append(toks, exprToken{text: s[i:j]})
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return toks, nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	pos  int
+}
+
+func parseExpr(s string) (*expr, error) {
+	toks, err := lexExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	e, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return e, nil
+}
+
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	if p.pos < len(p.toks) && !p.toks[p.pos].quoted && slices.Contains(ops, p.toks[p.pos].text) {
+		p.pos++
+		return p.toks[p.pos-1].text, true
+	}
+	return "", false
+}
+
+func (p *exprParser) parseComparison() (*expr, error) {
+	l, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("=", "==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return l, nil
+	}
+	r, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+	if op == "==" {
+		op = "="
+	}
+	return &expr{op: op, l: l, r: r}, nil
+}
+
+func (p *exprParser) parseSum() (*expr, error) {
+	l, err := p.parseProduct()
+	for err == nil {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return l, nil
+		}
+		var r *expr
+		r, err = p.parseProduct()
+		l = &expr{op: op, l: l, r: r}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parseProduct() (*expr, error) {
+	l, err := p.parseUnary()
+	for err == nil {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return l, nil
+		}
+		var r *expr
+		r, err = p.parseUnary()
+		l = &expr{op: op, l: l, r: r}
+	}
+	return nil, err
+}
+
+func (p *exprParser) parseUnary() (*expr, error) {
+	if _, ok := p.accept("-"); ok {
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &expr{op: exprNegate, l: e}, nil
+	}
+	if _, ok := p.accept("("); ok {
+		e, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, errors.New("expected )")
+		}
+		return e, nil
+	}
+	if p.pos >= len(p.toks) {
+		return nil, errors.New("unexpected end of expression")
+	}
+	tok := p.toks[p.pos]
+	p.pos++
+	switch {
+	case tok.quoted:
+		return &expr{op: exprConstant, value: tok.text}, nil
+	case tok.text == "true" || tok.text == "false":
+		return &expr{op: exprConstant, value: tok.text == "true"}, nil
+	case unicode.IsDigit(rune(tok.text[0])):
+		if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return &expr{op: exprConstant, value: n}, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok.text)
+		}
+		return &expr{op: exprConstant, value: f}, nil
+	case strings.ContainsAny(tok.text[:1], "+-*/%()<>=!"):
+		return nil, fmt.Errorf("unexpected %q", tok.text)
+	}
+	return &expr{op: exprColumn, col: tok.text}, nil
+}
+
+func isIntegerType(typ ColumnType) bool {
+	return typ == ColumnTypeInt64 || typ == ColumnTypeInt32 || typ == ColumnTypeUint64
+}
+
+func isNumericType(typ ColumnType) bool {
+	return isIntegerType(typ) || typ == ColumnTypeFloat64 || typ == ColumnTypeJSON
+}
+
+// check types the expression and the nodes below it.
+func (e *expr) check(typeOf func(col string) (ColumnType, error)) error {
+	switch e.op {
+	case exprColumn:
+		typ, err := typeOf(e.col)
+		if err != nil {
+			return err
+		}
+		e.typ = typ
+		return nil
+	case exprConstant:
+		e.typ = valueColumnType(e.value)
+		return nil
+	}
+	for _, sub := range []*expr{e.l, e.r} {
+		if sub != nil {
+			if err := sub.check(typeOf); err != nil {
+				return err
+			}
+		}
+	}
+	l := e.l.typ
+	if e.op == exprNegate {
+		if !isNumericType(l) {
+			return fmt.Errorf("cannot negate %s", l)
+		}
+		e.typ = numericResultType(l, ColumnTypeInt64)
+		return nil
+	}
+	r := e.r.typ
+	switch e.op {
+	case "=", "!=", "<", "<=", ">", ">=":
+		comparable := isNumericType(l) && isNumericType(r) || l == r && l != ColumnTypeJSON
+		if !comparable || l == ColumnTypeBool && e.op != "=" && e.op != "!=" {
+			return fmt.Errorf("cannot compare %s %s %s", l, e.op, r)
+		}
+		e.typ = ColumnTypeBool
+	case "+":
+		if l == ColumnTypeString && r == ColumnTypeString {
+			e.typ = ColumnTypeString
+			return nil
+		}
+		fallthrough
+	default:
+		if !isNumericType(l) || !isNumericType(r) || e.op == "%" && (!isIntegerType(l) || !isIntegerType(r)) {
+			return fmt.Errorf("cannot compute %s %s %s", l, e.op, r)
+		}
+		e.typ = numericResultType(l, r)
+	}
+	return nil
+}
+
+// numericResultType returns the type of arithmetic on operands of numeric
+// types.
+func numericResultType(l, r ColumnType) ColumnType {
+	switch {
+	case !isIntegerType(l) || !isIntegerType(r):
+		return ColumnTypeFloat64
+	case l == ColumnTypeUint64 && r == ColumnTypeUint64:
+		return ColumnTypeUint64
+	}
+	return ColumnTypeInt64
+}
+
+// columns returns the columns the expression uses.
+func (e *expr) columns() []string {
+	if e.op == exprColumn {
+		return []string{e.col}
+	}
+	var cols []string
+	for _, sub := range []*expr{e.l, e.r} {
+		if sub != nil {
+			cols = append(cols, sub.columns()...)
+		}
+	}
+	return lo.Uniq(cols)
+}
+
+// bind sets the readers of the expression's columns.
+func (e *expr) bind(readers map[string]valueReader) {
+	if e.op == exprColumn {
+		e.reader = readers[e.col]
+	}
+	for _, sub := range []*expr{e.l, e.r} {
+		if sub != nil {
+			sub.bind(readers)
+		}
+	}
+}
+
+// eval computes the expression for row i, or returns nil if an operand has
+// no value.
+func (e *expr) eval(i int64) (any, error) {
+	switch e.op {
+	case exprConstant:
+		return e.value, nil
+	case exprColumn:
+		v, err := e.reader.SeekToIndex(i)
+		if err != nil || v == nil || e.typ != ColumnTypeJSON {
+			return v, err
+		}
+		if f, ok := numericValue(v); ok {
+			return f, nil
+		}
+		return nil, nil
+	}
+	l, err := e.l.eval(i)
+	if err != nil || l == nil {
+		return nil, err
+	}
+	if e.op == exprNegate {
+		switch e.typ {
+		case ColumnTypeFloat64:
+			f, _ := numericValue(l)
+			return -f, nil
+		}
+		return -exprInt(l), nil
+	}
+	r, err := e.r.eval(i)
+	if err != nil || r == nil {
+		return nil, err
+	}
+	if e.typ == ColumnTypeBool {
+		c := compareExprValues(l, r, e.l.typ, e.r.typ)
+		switch e.op {
+		case "=":
+			return c == 0, nil
+		case "!=":
+			return c != 0, nil
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}
+	switch e.typ {
+	case ColumnTypeString:
+		return l.(string) + r.(string), nil
+	case ColumnTypeFloat64:
+		a, _ := numericValue(l)
+		b, _ := numericValue(r)
+		return applyArithmetic(e.op, a, b), nil
+	case ColumnTypeUint64:
+		a, b := l.(uint64), r.(uint64)
+		if e.op == "%" && b != 0 {
+			return a % b, nil
+		}
+		return applyArithmetic(e.op, a, b), nil
+	}
+	a, b := exprInt(l), exprInt(r)
+	if e.op == "%" && b != 0 {
+		return a % b, nil
+	}
+	return applyArithmetic(e.op, a, b), nil
+}
+
+// exprInt returns an integer operand as an int64.
+func exprInt(v any) int64 {
+	if u, ok := v.(uint64); ok {
+		return int64(u)
+	}
+	return v.(int64)
+}
+
+// applyArithmetic applies an arithmetic operator, returning nil when dividing
+// by zero.
+func applyArithmetic[T int64 | uint64 | float64](op string, a, b T) any {
+	switch op {
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	}
+	if b == 0 {
+		return nil
+	}
+	return a / b
+}
+
+// compareExprValues compares two operands of comparable types.
+func compareExprValues(l, r any, lt, rt ColumnType) int {
+	switch {
+	case lt == ColumnTypeBool:
+		if l.(bool) == r.(bool) {
+			return 0
+		}
+		return 1
+	case lt == ColumnTypeString:
+		return strings.Compare(l.(string), r.(string))
+	case lt == ColumnTypeTime:
+		return l.(time.Time).Compare(r.(time.Time))
+	case lt == ColumnTypeUint64 && rt == ColumnTypeUint64:
+		return cmp.Compare(l.(uint64), r.(uint64))
+	case isIntegerType(lt) && isIntegerType(rt):
+		return cmp.Compare(exprInt(l), exprInt(r))
+	}
+	a, _ := numericValue(l)
+	b, _ := numericValue(r)
+	return cmp.Compare(a, b)
+}
+
+// computedReader reads a computed column, evaluating its expression over
+// readers of its own for the columns it uses, as readers shared with the rest
+// of a cursor may have read past the row in batches.
+type computedReader struct {
+	e       *expr
+	readers []valueReader
+}
+
+func (r *computedReader) SeekToIndex(index int64) (any, error) {
+	return r.e.eval(index)
+}
+
+// nextIndex returns the next row after i where every column used has a
+// value, at the earliest.
+func (r *computedReader) nextIndex(i int64) int64 {
+	next := i + 1
+	for _, cr := range r.readers {
+		next = max(next, cr.nextIndex(i))
+	}
+	return next
+}
+
+func (r *computedReader) Close() error {
+	var errs []error
+	for _, cr := range r.readers {
+		errs = append(errs, cr.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// openComputed opens the reader of a computed column. The caller must hold
+// fs.lock.
+func (c *cursor) openComputed(fs *ColumnFS, attr string, e *expr) error {
+	r := &computedReader{e: e}
+	readers := map[string]valueReader{}
+	for _, col := range e.columns() {
+		name, path := col, []string(nil)
+		if fs.columnHandles[name] == nil {
+			name, path, _ = fs.resolveJSONPath(col)
+		}
+		cr, err := fs.createReader(fs.columnHandles[name])
+		if err != nil {
+			r.Close()
+			return err
+		}
+		if path != nil {
+			readers[col] = &pathReader{cr: cr, path: path}
+		} else {
+			readers[col] = cr
+		}
+		r.readers = append(r.readers, readers[col])
+	}
+	e.bind(readers)
+	c.readers[attr] = r
+	return nil
+}
+
+// exprColumnType returns the type of a column used by an expression. The
+// caller must hold fs.lock.
+func (fs *ColumnFS) exprColumnType(col string) (ColumnType, error) {
+	if ch := fs.columnHandles[col]; ch != nil {
+		return ch.typ, nil
+	}
+	if _, _, ok := fs.resolveJSONPath(col); ok {
+		return ColumnTypeJSON, nil
+	}
+	return 0, fmt.Errorf("%w %s", errUnknownExprColumn, col)
+}
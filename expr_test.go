@@ -0,0 +1,89 @@
+package querystore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputedColumns(t *testing.T) {
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := range 2000 {
+		row := map[string]any{"latency_ns": int64(i * 1e5), "a": int64(i % 10), "b": int64(i % 7), "c": int64(8), "name": fmt.Sprintf("n%d", i%3), "meta": map[string]any{"w": i % 4}}
+		if i%5 == 0 {
+			delete(row, "b")
+		}
+		rows = append(rows, row)
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	q, err := NewQuery().
+		Compute("latency_ms", "latency_ns / 1e6").
+		Compute("over", "a + b > c").
+		Compute("label", "name + '-' + name").
+		Select("latency_ms", "label").
+		Where("over", Eq, true).
+		Where("latency_ms", Lt, 1.0).
+		BuildFor(cs)
+	require.NoError(t, err)
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	var expected []map[string]any
+	for i, row := range rows[:10] {
+		if b, ok := row["b"].(int64); ok && row["a"].(int64)+b > 8 {
+			expected = append(expected, map[string]any{IndexColumn: int64(i), TimestampColumn: res[0][TimestampColumn], "latency_ms": float64(i) / 10, "label": row["name"].(string) + "-" + row["name"].(string)})
+		}
+	}
+	require.NotEmpty(t, expected)
+	for i := range res {
+		expected[i][TimestampColumn] = res[i][TimestampColumn]
+	}
+	assert.Equal(t, expected, res)
+
+	// Computed columns group and aggregate, over JSON paths too.
+	res, err = cs.Query(&Query{
+		Computed: []ComputedColumn{
+			{Name: "parity", Expr: "a % 2"},
+			{Name: "weighted", Expr: "(a - b) * meta.w"},
+			{Name: "ratio", Expr: "a / (b - b)"},
+		},
+		Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "weighted"}, {Type: AggregatorCount, Attribute: "ratio"}},
+		GroupBy:      "parity",
+		OrderBy:      []Order{{Attribute: "parity"}},
+	})
+	require.NoError(t, err)
+	sums := map[int64]float64{}
+	for i, row := range rows {
+		if b, ok := row["b"].(int64); ok {
+			sums[row["a"].(int64)%2] += float64((row["a"].(int64) - b) * int64(i%4))
+		}
+	}
+	require.Len(t, res, 2)
+	assert.Equal(t, []any{int64(0), int64(1)}, []any{res[0]["parity"], res[1]["parity"]})
+	assert.Equal(t, []any{sums[0], sums[1]}, []any{res[0]["sum(weighted)"], res[1]["sum(weighted)"]})
+	// Dividing by zero yields no value.
+	assert.Equal(t, int64(0), res[0]["count(ratio)"])
+
+	// Expressions over columns the store lacks have no values.
+	res, err = cs.Query(&Query{Computed: []ComputedColumn{{Name: "x", Expr: "missing + 1"}}, Select: []string{"x"}, Where: Where("x", ConditionIsNull, nil), Limit: 1})
+	require.NoError(t, err)
+	assert.Len(t, res, 1)
+
+	for expr, msg := range map[string]string{
+		"name + a":    "cannot compute string + int64",
+		"a < name":    "cannot compare int64 < string",
+		"a + ":        "unexpected end",
+		"(a + b":      "expected )",
+		"missing * 2": "unknown column missing",
+	} {
+		_, err := NewQuery().Compute("x", expr).Select("x").BuildFor(cs)
+		assert.ErrorContains(t, err, msg, expr)
+	}
+	_, err = cs.Query(&Query{Computed: []ComputedColumn{{Name: "a", Expr: "b"}}})
+	assert.ErrorContains(t, err, "shadows")
+	_, err = NewQuery().Compute("x", "a > b").Where("x", Gt, 1).BuildFor(cs)
+	assert.Error(t, err)
+}
@@ -0,0 +1,345 @@
+package querystore
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// FilterExpression is a boolean combination of filters. Exactly one of its
+// fields is set; use Where, And, Or and Not to build expressions.
+type FilterExpression struct {
+	Filter *Filter
+	And    []*FilterExpression
+	Or     []*FilterExpression
+	Not    *FilterExpression
+}
+
+// Where returns an expression matching a single filter.
+func Where(attribute string, cond ConditionType, value any) *FilterExpression {
+	return &FilterExpression{Filter: &Filter{Attribute: attribute, Condition: cond, Value: value}}
+}
+
+// And returns an expression matching rows that match every sub-expression.
+func And(exprs ...*FilterExpression) *FilterExpression {
+	return &FilterExpression{And: exprs}
+}
+
+// Or returns an expression matching rows that match any sub-expression.
+func Or(exprs ...*FilterExpression) *FilterExpression {
+	return &FilterExpression{Or: exprs}
+}
+
+// Not returns an expression matching rows that do not match expr. Rows
+// without a value for a column match no conditions on it but null checks, so
+// unlike SQL NOT, Not matches them: Not(Where(col, ConditionEquals, x))
+// matches rows without a value for col, including every row if the store
+// has no column col, where Where(col, ConditionNotEquals, x) does not. And
+// it with Where(col, ConditionIsNotNull, nil) to leave them out.
+func Not(expr *FilterExpression) *FilterExpression {
+	return &FilterExpression{Not: expr}
+}
+
+// walkFilters calls fn for every filter leaf in the expression.
+func (e *FilterExpression) walkFilters(fn func(f Filter)) {
+	switch {
+	case e == nil:
+	case e.Filter != nil:
+		fn(*e.Filter)
+	case e.Not != nil:
+		e.Not.walkFilters(fn)
+	default:
+		for _, sub := range e.And {
+			sub.walkFilters(fn)
+		}
+		for _, sub := range e.Or {
+			sub.walkFilters(fn)
+		}
+	}
+}
+
+type predicate interface {
+	// eval reports whether row i matches, recording any column values it
+	// reads into row.
+	eval(i int64, row map[string]any) (bool, error)
+	// nextCandidate returns the lowest row after i that may match, given that
+	// row i was just evaluated. Filters on sparse columns use it to skip the
+	// rows their column has no values for.
+	nextCandidate(i int64) int64
+}
+
+// compilePredicate binds an expression to the column readers of a query.
+func compilePredicate(e *FilterExpression, readers map[string]valueReader, prepared map[*Filter]*compiledFilter) (predicate, error) {
+	switch {
+	case e.Filter != nil:
+		return compileFilter(*e.Filter, readers[e.Filter.Attribute], prepared[e.Filter])
+	case e.Not != nil:
+		p, err := compilePredicate(e.Not, readers, prepared)
+		if err != nil {
+			return nil, err
+		}
+		return notPredicate{p}, nil
+	case len(e.And) > 0:
+		ps, err := compilePredicates(e.And, readers, prepared)
+		if err != nil {
+			return nil, err
+		}
+		return andPredicate(ps), nil
+	case len(e.Or) > 0:
+		ps, err := compilePredicates(e.Or, readers, prepared)
+		if err != nil {
+			return nil, err
+		}
+		return orPredicate(ps), nil
+	}
+	return nil, invalidQuery(fmt.Errorf("empty filter expression"))
+}
+
+func compilePredicates(exprs []*FilterExpression, readers map[string]valueReader, prepared map[*Filter]*compiledFilter) ([]predicate, error) {
+	ps := make([]predicate, len(exprs))
+	for i, e := range exprs {
+		p, err := compilePredicate(e, readers, prepared)
+		if err != nil {
+			return nil, err
+		}
+		ps[i] = p
+	}
+	return ps, nil
+}
+
+type andPredicate []predicate
+
+func (ps andPredicate) eval(i int64, row map[string]any) (bool, error) {
+	for _, p := range ps {
+		if ok, err := p.eval(i, row); err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (ps andPredicate) nextCandidate(i int64) int64 {
+	next := i + 1
+	for _, p := range ps {
+		next = max(next, p.nextCandidate(i))
+	}
+	return next
+}
+
+type orPredicate []predicate
+
+func (ps orPredicate) eval(i int64, row map[string]any) (bool, error) {
+	for _, p := range ps {
+		if ok, err := p.eval(i, row); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (ps orPredicate) nextCandidate(i int64) int64 {
+	next := int64(math.MaxInt64)
+	for _, p := range ps {
+		next = min(next, p.nextCandidate(i))
+	}
+	return next
+}
+
+type notPredicate struct {
+	p predicate
+}
+
+func (n notPredicate) eval(i int64, row map[string]any) (bool, error) {
+	ok, err := n.p.eval(i, row)
+	return !ok && err == nil, err
+}
+
+func (n notPredicate) nextCandidate(i int64) int64 {
+	return i + 1
+}
+
+// valueReader reads the values of a query attribute row by row.
+type valueReader interface {
+	SeekToIndex(index int64) (any, error)
+	// nextIndex returns a lower bound on the next row after i with a value,
+	// or math.MaxInt64 if no rows after i have values.
+	nextIndex(i int64) int64
+	Close() error
+}
+
+// compiledFilter is a Filter bound to the reader of its attribute, with the
+// comparison and filter value resolved for the column's type. Filters on JSON
+// paths are bound lazily to the type of each value read.
+type compiledFilter struct {
+	Filter
+	// given is the filter's condition, which bind may resolve to another.
+	given  ConditionType
+	reader valueReader
+	bound  bool
+	typ    ColumnType
+	fn     ConditionalFunc
+	value  any
+	// zoned filters skip blocks whose zones or bloom filters cannot match. Rows below
+	// zoneEnd are in a block already found to possibly match.
+	zoned   bool
+	zoneEnd int64
+	// rejected is the last row that failed the filter.
+	rejected int64
+	// indexed filters are resolved by a value index to the rows they match,
+	// listed in order in rows, or held by bits for bitmap indexes.
+	indexed bool
+	rows    []int64
+	bits    *bitmap
+}
+
+// compileFilter compiles a filter for the reader of its attribute. Filters of
+// prepared queries start from the filter as prepared, whose value is reused
+// if bound for the type read.
+func compileFilter(f Filter, r valueReader, prepared *compiledFilter) (*compiledFilter, error) {
+	cf := &compiledFilter{Filter: f, given: f.Condition, reader: r, rejected: -1}
+	if prepared != nil {
+		cf.value = prepared.value
+	} else if f.Condition == ConditionMatches {
+		re, err := compileRegexp(f.Value)
+		if err != nil {
+			return nil, invalidQuery(err)
+		}
+		cf.value = re
+	}
+	if f.Condition == ConditionIsNull || f.Condition == ConditionIsNotNull {
+		return cf, nil
+	}
+	if cr, ok := r.(*ColumnReader); ok {
+		if prepared != nil && prepared.bound && prepared.typ == cr.typ {
+			cf.Condition, cf.fn, cf.typ, cf.bound = prepared.Condition, prepared.fn, prepared.typ, true
+		} else if err := cf.bind(cr.typ); err != nil {
+			return nil, err
+		}
+		cf.zoned = cf.usesZones() || cf.usesBlooms()
+		cf.lookupRows(cr)
+	}
+	if cr, ok := r.(*computedReader); ok {
+		if err := cf.bind(cr.e.typ); err != nil {
+			return nil, err
+		}
+	}
+	return cf, nil
+}
+
+// bind resolves the comparison and filter value for a column type.
+// Fractional values are compared with integer columns as they would be in
+// float64: v > 2.5 is bound as v > 2, and v = 2.5 as an IN filter matching
+// nothing.
+func (f *compiledFilter) bind(typ ColumnType) error {
+	f.Condition = f.given
+	value := f.Value
+	if x, ok := fractionalValue(value); ok && isIntegerType(typ) {
+		switch f.Condition {
+		case ConditionGreaterThan, ConditionLessThanOrEquals:
+			value = math.Floor(x)
+		case ConditionGreaterThanOrEquals, ConditionLessThan:
+			value = math.Ceil(x)
+		case ConditionEquals:
+			f.Condition, value = ConditionIn, []any{}
+		case ConditionNotEquals:
+			f.Condition, value = ConditionNotIn, []any{}
+		}
+	}
+	fn, err := conditionalFor(f.Condition, typ)
+	if err != nil {
+		return invalidQuery(err)
+	}
+	switch f.Condition {
+	case ConditionMatches:
+	case ConditionIn, ConditionNotIn:
+		if f.value, err = newValueSet(value, typ); err != nil {
+			return invalidQuery(err)
+		}
+	default:
+		if f.value, err = convertValue(value, typ); err != nil {
+			return invalidQuery(fmt.Errorf("filter on %s: %w", f.Attribute, err))
+		}
+	}
+	f.fn, f.typ, f.bound = fn, typ, true
+	return nil
+}
+
+// eval reports whether row i passes the filter. Rows without a value for the
+// attribute only pass null checks, and JSON values the condition cannot
+// compare never pass.
+func (f *compiledFilter) eval(i int64, row map[string]any) (bool, error) {
+	ok, err := f.evalValue(i, row)
+	if !ok && err == nil {
+		f.rejected = i
+	}
+	return ok, err
+}
+
+func (f *compiledFilter) evalValue(i int64, row map[string]any) (bool, error) {
+	if f.indexed && f.nextRow(i) != i {
+		return false, nil
+	}
+	var v any
+	if f.reader != nil {
+		var err error
+		if v, err = f.reader.SeekToIndex(i); err != nil {
+			return false, err
+		}
+	}
+	switch {
+	case f.Condition == ConditionIsNull:
+		return v == nil, nil
+	case f.Condition == ConditionIsNotNull:
+		if v != nil {
+			row[f.Attribute] = v
+		}
+		return v != nil, nil
+	case v == nil:
+		return false, nil
+	}
+	row[f.Attribute] = v
+	if _, ok := f.reader.(*pathReader); ok {
+		if typ := valueColumnType(v); !f.bound || typ != f.typ {
+			if err := f.bind(typ); err != nil {
+				f.bound = false
+				return false, nil
+			}
+		}
+	}
+	return f.fn(v, f.value), nil
+}
+
+func (f *compiledFilter) nextCandidate(i int64) int64 {
+	switch {
+	case f.indexed:
+		return f.nextRow(i + 1)
+	case f.Condition == ConditionIsNull:
+		return i + 1
+	case f.reader == nil:
+		return math.MaxInt64
+	}
+	next := f.reader.nextIndex(i)
+	if cr, ok := f.reader.(*ColumnReader); ok && f.rejected == i && cr.curIndex == i {
+		// The rest of the run has the same value, so fails too.
+		next = max(next, cr.runEnd)
+	}
+	if f.zoned && next >= f.zoneEnd {
+		next, f.zoneEnd = f.reader.(*ColumnReader).skipBlocks(next, f.blockMayMatch)
+	}
+	return next
+}
+
+func compileRegexp(v any) (*regexp.Regexp, error) {
+	switch v := v.(type) {
+	case *regexp.Regexp:
+		return v, nil
+	case string:
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for match filter: %w", err)
+		}
+		return re, nil
+	default:
+		return nil, fmt.Errorf("match filter value must be a string or *regexp.Regexp, got %T", v)
+	}
+}
@@ -0,0 +1,144 @@
+package querystore
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// ErrStoreReadOnly is returned when writing to a store opened with
+// Options.ReadOnly.
+var ErrStoreReadOnly = errors.New("store is open read-only")
+
+// Refresh extends the view of a read-only store to the rows its writer has
+// appended since the store was opened or last refreshed, reporting whether
+// there were any. The store's files are reloaded when rows were appended or
+// the writer compacted the store; queries already running keep their view,
+// and subscriptions are sent the new rows. Partitioned stores also reload
+// their list of partitions, opening those the writer created or offloaded
+// and closing those it dropped. Stores opened for writing are always current,
+// so refreshing them does nothing.
+func (fs *ColumnFS) Refresh() (bool, error) {
+	if !fs.opts.ReadOnly {
+		return false, nil
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.partitioning != PartitionNone || len(fs.partitions) > 0 || fs.nextID == 0 {
+		// Stores without rows may be about to be partitioned.
+		grew, err := fs.refreshPartitions()
+		if err != nil || len(fs.partitions) > 0 {
+			return grew, err
+		}
+	}
+
+	fi, err := fs.backend.Stat(fs.indexHandle.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if fs.indexInfo != nil && os.SameFile(fs.indexInfo, fi) && fi.Size() == fs.indexInfo.Size() {
+		return false, nil
+	}
+	// The rows are counted before the column files are loaded, which hold
+	// at least those rows.
+	rows, err := fs.indexHandle.committedRows()
+	if err != nil {
+		return false, err
+	}
+	if err := fs.loadHandles(); err != nil {
+		return false, err
+	}
+	if fs.schema != nil {
+		if err := fs.applySchema(fs.schema); err != nil {
+			return false, err
+		}
+	}
+	fs.indexInfo = fi
+	fs.invalidateCache()
+	grew := rows > fs.nextID
+	fs.nextID = rows
+	fs.tombstones = nil
+	if err := fs.loadPruned(); err != nil {
+		return false, err
+	}
+	if err := fs.loadTombstones(); err != nil {
+		return false, err
+	}
+	if fs.nextID > 0 {
+		if fs.lastTimestamp, err = fs.timestampAt(fs.nextID - 1); err != nil {
+			return false, err
+		}
+	}
+	if grew && fs.appended != nil {
+		close(fs.appended)
+		fs.appended = nil
+	}
+	return grew, nil
+}
+
+// refreshPartitions refreshes the partitions of a read-only store, then
+// reloads its list of partitions. The caller must hold fs.lock.
+func (fs *ColumnFS) refreshPartitions() (bool, error) {
+	rows, dirs := fs.nextID, len(fs.partitions)
+	changed := false
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		grew, err := p.fs.Refresh()
+		if err != nil {
+			return false, err
+		}
+		changed = changed || grew
+	}
+	fs.nextID = 0
+	if err := fs.openPartitions(); err != nil {
+		return false, err
+	}
+	if len(fs.partitions) == 0 {
+		fs.nextID = rows
+		return false, nil
+	}
+	if changed || len(fs.partitions) != dirs || fs.nextID != rows {
+		fs.invalidateCache()
+	}
+	grew := fs.nextID > rows
+	if grew && fs.appended != nil {
+		close(fs.appended)
+		fs.appended = nil
+	}
+	return grew, nil
+}
+
+// startRefresher starts refreshing the store every Options.RefreshInterval.
+func (fs *ColumnFS) startRefresher() {
+	fs.stopRefresh = make(chan struct{})
+	fs.refreshDone = make(chan struct{})
+	go func() {
+		defer close(fs.refreshDone)
+		ticker := time.NewTicker(fs.opts.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := fs.Refresh(); err != nil {
+					fs.logger().Error("querystore: refresh failed", "dir", fs.dir, "err", err)
+				}
+			case <-fs.stopRefresh:
+				return
+			}
+		}
+	}()
+}
+
+// stopRefresher stops the background refreshes, if running.
+func (fs *ColumnFS) stopRefresher() {
+	if fs.stopRefresh != nil {
+		close(fs.stopRefresh)
+		<-fs.refreshDone
+		fs.stopRefresh = nil
+	}
+}
@@ -0,0 +1,116 @@
+package querystore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadOnlyFollower(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 64
+
+	dir := t.TempDir()
+	writer, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer writer.Close()
+	appendRows := func(from, to int, extra bool) {
+		var rows []map[string]any
+		for i := from; i < to; i++ {
+			row := map[string]any{"val": int64(i)}
+			if extra {
+				row["tag"] = "new"
+			}
+			rows = append(rows, row)
+		}
+		require.NoError(t, writer.WriteRows(rows))
+	}
+	appendRows(0, 100, false)
+
+	reader, err := OpenColumnFSWithOptions(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer reader.Close()
+	rs := NewColumnarStore(reader)
+	count := func(q *Query) int64 {
+		q.Aggregations = []Aggregation{{Type: AggregatorCount}}
+		res, err := rs.Query(q)
+		require.NoError(t, err)
+		return res[0]["count"].(int64)
+	}
+	above := &Query{Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThan, Value: int64(120)}}}
+	assert.Equal(t, int64(100), count(&Query{}))
+	assert.Equal(t, int64(0), count(above))
+
+	appendRows(100, 150, true)
+	assert.Equal(t, int64(100), count(&Query{}))
+	grew, err := reader.Refresh()
+	require.NoError(t, err)
+	assert.True(t, grew)
+	assert.Equal(t, int64(150), count(&Query{}))
+	// Rows appended to the block open when the reader first loaded it are
+	// not skipped by its zone map.
+	assert.Equal(t, int64(29), count(above))
+	assert.Equal(t, int64(50), count(&Query{Filters: []Filter{{Attribute: "tag", Condition: ConditionEquals, Value: "new"}}}))
+	grew, err = reader.Refresh()
+	require.NoError(t, err)
+	assert.False(t, grew)
+
+	assert.ErrorIs(t, rs.Append(map[string]any{"val": int64(1)}), ErrStoreReadOnly)
+	assert.ErrorIs(t, reader.Compact(), ErrStoreReadOnly)
+
+	follower, err := OpenColumnFSWithOptions(dir, Options{ReadOnly: true, RefreshInterval: 5 * time.Millisecond})
+	require.NoError(t, err)
+	defer follower.Close()
+	appendRows(150, 160, false)
+	assert.Eventually(t, func() bool {
+		res, err := NewColumnarStore(follower).Query(&Query{Select: []string{"val"}})
+		return err == nil && len(res) == 160
+	}, time.Second, 5*time.Millisecond)
+
+	_, err = OpenColumnFSWithOptions(filepath.Join(dir, "missing"), Options{ReadOnly: true})
+	assert.ErrorContains(t, err, "does not exist")
+}
+
+func TestReadOnlyPartitions(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	dir := t.TempDir()
+	writer, err := OpenColumnFSWithOptions(dir, Options{Partitioning: PartitionHourly, Clock: clock})
+	require.NoError(t, err)
+	defer writer.Close()
+	require.NoError(t, writer.WriteRows([]map[string]any{{"val": int64(0)}, {"val": int64(1)}}))
+
+	reader, err := OpenColumnFSWithOptions(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer reader.Close()
+	rs := NewColumnarStore(reader)
+	values := func() []any {
+		res, err := rs.Query(&Query{Select: []string{"val"}})
+		require.NoError(t, err)
+		return lo.Map(res, func(row map[string]any, _ int) any { return row["val"] })
+	}
+	assert.Equal(t, []any{int64(0), int64(1)}, values())
+
+	// Rows appended to open partitions and to new ones are read, and
+	// dropped partitions are no longer.
+	require.NoError(t, writer.WriteRows([]map[string]any{{"val": int64(2)}}))
+	now = now.Add(time.Hour)
+	require.NoError(t, writer.WriteRows([]map[string]any{{"val": int64(3)}}))
+	grew, err := reader.Refresh()
+	require.NoError(t, err)
+	assert.True(t, grew)
+	assert.Equal(t, []any{int64(0), int64(1), int64(2), int64(3)}, values())
+	assert.Len(t, reader.Partitions(), 2)
+
+	_, err = writer.DropPartitionsBefore(now.Truncate(time.Hour))
+	require.NoError(t, err)
+	grew, err = reader.Refresh()
+	require.NoError(t, err)
+	assert.False(t, grew)
+	assert.Equal(t, []any{int64(3)}, values())
+	assert.Len(t, reader.Partitions(), 1)
+}
@@ -0,0 +1,230 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Column file format versions. Versions 1 and 2 have no header, and are
+// identified by the file name: version 1 files are named "name.type.dat" and
+// prefix variable-length values with a uint16 length, version 2 files are
+// named "name.type.v2.dat" and use a uint32 length. From version 3 every file
+// starts with a header recording its version, type and flags.
+const (
+	formatVersion         = 3
+	lastHeaderlessVersion = 2
+
+	headerSize = 16
+)
+
+// nullIndexBit is set in the row index of a record to mark an explicit null,
+// in which case the record has no value. Row indexes are never negative, so
+// the bit is otherwise unused.
+const nullIndexBit = uint64(1) << 63
+
+// Header flags.
+const (
+	// flagRLE marks a run-length encoded column file.
+	flagRLE uint8 = 1 << iota
+)
+
+var headerMagic = [4]byte{'Q', 'S', 'C', 'F'}
+
+// fileHeader is the header at the start of each column file:
+//
+//	magic [4]byte | version uint16 | column type uint8 | flags uint8 | codec uint8 | reserved [7]byte
+type fileHeader struct {
+	version int
+	typ     ColumnType
+	flags   uint8
+	codec   uint8
+}
+
+func (h fileHeader) encode() []byte {
+	buf := make([]byte, headerSize)
+	copy(buf, headerMagic[:])
+	binary.LittleEndian.PutUint16(buf[4:6], uint16(h.version))
+	buf[6] = uint8(h.typ)
+	buf[7] = h.flags
+	buf[8] = h.codec
+	return buf
+}
+
+// readFileHeader reads the header of a column file, reporting false if the
+// file is empty or predates headers.
+func readFileHeader(r io.Reader) (fileHeader, bool, error) {
+	var buf [headerSize]byte
+	n, err := io.ReadFull(r, buf[:])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fileHeader{}, false, nil
+	}
+	if err != nil || n < headerSize {
+		return fileHeader{}, false, err
+	}
+	if !bytes.Equal(buf[:4], headerMagic[:]) {
+		return fileHeader{}, false, nil
+	}
+	h := fileHeader{
+		version: int(binary.LittleEndian.Uint16(buf[4:6])),
+		typ:     ColumnType(buf[6]),
+		flags:   buf[7],
+		codec:   buf[8],
+	}
+	if h.version <= lastHeaderlessVersion || h.version > formatVersion {
+		return fileHeader{}, false, fmt.Errorf("unsupported format version %d", h.version)
+	}
+	return h, true, nil
+}
+
+// loadHeader validates the header of an existing column file, setting the
+// handle's version and data offset, and its codec to the one codecs returns
+// for the header's codec ID. Headerless files keep the version implied by
+// their name.
+func (ch *ColumnHandle) loadHeader(codecs func(id uint8) (Codec, error)) error {
+	fp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		ch.version = formatVersion
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	h, ok, err := readFileHeader(fp)
+	if err != nil {
+		return fmt.Errorf("column file %s: %w", ch.path, err)
+	}
+	if !ok {
+		fi, err := fp.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() == 0 {
+			// An empty file gets a header on its first write.
+			ch.version = formatVersion
+		}
+		return nil
+	}
+	if h.typ != ch.typ {
+		return fmt.Errorf("column file %s has type %s in its header, expected %s", ch.path, h.typ, ch.typ)
+	}
+	if ch.codec, err = codecs(h.codec); err != nil {
+		return fmt.Errorf("column file %s: %w", ch.path, err)
+	}
+	ch.version = h.version
+	ch.flags = h.flags
+	ch.dataOffset = headerSize
+	return nil
+}
+
+// MigrateFormat rewrites column files created by older versions in the
+// current format, adding headers to headerless files. The store must not be
+// in use while it runs.
+func (fs *ColumnFS) MigrateFormat() error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		if err := p.fs.MigrateFormat(); err != nil {
+			return err
+		}
+	}
+	for name, ch := range fs.columnHandles {
+		if ch.version >= formatVersion {
+			continue
+		}
+		newPath := ch.path
+		if !strings.HasPrefix(name, "__") {
+			newPath = path.Join(fs.dir, makeColumnFileName(name, ch.typ))
+		}
+		if err := ch.rewrite(newPath); err != nil {
+			return fmt.Errorf("migrating %s: %w", ch.path, err)
+		}
+	}
+	return nil
+}
+
+// rewrite copies every record of the column into a new file in the current
+// format, then swaps it in place of the old file.
+func (ch *ColumnHandle) rewrite(newPath string) error {
+	if err := ch.Close(); err != nil {
+		return err
+	}
+	cr, err := ch.createReader()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	next := &ColumnHandle{path: newPath, typ: ch.typ, version: formatVersion, dataOffset: headerSize, backend: ch.backend}
+	data := next.header().encode()
+	for {
+		if _, err := cr.SeekToIndex(cr.curIndex + 1); err != nil {
+			return err
+		}
+		if cr.eof {
+			break
+		}
+		if data, err = next.appendRecord(data, cr.curIndex, cr.curVal); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := newPath + ".tmp"
+	if err := writeFileSync(ch.backend, tmpPath, data); err != nil {
+		return err
+	}
+	if err := ch.backend.Rename(tmpPath, newPath); err != nil {
+		return err
+	}
+	if err := ch.resetBlockIndex(); err != nil {
+		return err
+	}
+	if newPath != ch.path {
+		if err := ch.backend.Remove(ch.path); err != nil {
+			return err
+		}
+	}
+	ch.path, ch.version, ch.flags, ch.dataOffset = newPath, formatVersion, next.flags, headerSize
+	ch.stats, ch.size = nil, 0
+	return nil
+}
+
+func (ch *ColumnHandle) header() fileHeader {
+	return fileHeader{version: ch.version, typ: ch.typ, flags: ch.flags, codec: codecID(ch.codec)}
+}
+
+// writeFileSync writes a file and flushes it to stable storage.
+func writeFileSync(b ColumnBackend, name string, data []byte) error {
+	fp, err := b.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Sync(); err != nil {
+		fp.Close()
+		return err
+	}
+	return fp.Close()
+}
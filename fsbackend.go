@@ -0,0 +1,118 @@
+package querystore
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+// FSBackend returns a backend reading the files of an fs.FS, such as a store
+// embedded in a binary or shipped in an archive. Stores on it must be opened
+// with Options.ReadOnly; paths are relative to the root of fsys, with "."
+// naming the root itself. Files that cannot be read at an offset are read
+// into memory when opened.
+func FSBackend(fsys fs.FS) ColumnBackend {
+	return fsBackend{fsys: fsys}
+}
+
+type fsBackend struct {
+	fsys fs.FS
+}
+
+// name returns the fs.FS name of a path.
+func (b fsBackend) name(name string) string {
+	if name = strings.TrimPrefix(path.Clean(name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (b fsBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	name = b.name(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrStoreReadOnly}
+	}
+	f, err := b.fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	file := &fsFile{f: f, name: name}
+	if r, ok := f.(readSeekerAt); ok {
+		file.r = r
+		return file, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var data []byte
+	if !fi.IsDir() {
+		if data, err = io.ReadAll(f); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	file.r = bytes.NewReader(data)
+	return file, nil
+}
+
+func (b fsBackend) Stat(name string) (os.FileInfo, error) {
+	return fs.Stat(b.fsys, b.name(name))
+}
+
+func (b fsBackend) ReadDir(name string) ([]os.DirEntry, error) {
+	return fs.ReadDir(b.fsys, b.name(name))
+}
+
+func (b fsBackend) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: b.name(name), Err: ErrStoreReadOnly}
+}
+
+func (b fsBackend) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: b.name(oldname), New: b.name(newname), Err: ErrStoreReadOnly}
+}
+
+func (b fsBackend) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: b.name(name), Err: ErrStoreReadOnly}
+}
+
+func (b fsBackend) RemoveAll(name string) error {
+	return &os.PathError{Op: "remove", Path: b.name(name), Err: ErrStoreReadOnly}
+}
+
+type readSeekerAt interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+}
+
+// fsFile is an open file of an fs.FS.
+type fsFile struct {
+	f    fs.File
+	name string
+	r    readSeekerAt
+}
+
+func (f *fsFile) Name() string                                 { return f.name }
+func (f *fsFile) Stat() (os.FileInfo, error)                   { return f.f.Stat() }
+func (f *fsFile) Read(p []byte) (int, error)                   { return f.r.Read(p) }
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error)      { return f.r.ReadAt(p, off) }
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) { return f.r.Seek(offset, whence) }
+func (f *fsFile) Sync() error                                  { return nil }
+func (f *fsFile) Close() error                                 { return f.f.Close() }
+
+func (f *fsFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrStoreReadOnly}
+}
+
+func (f *fsFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrStoreReadOnly}
+}
+
+func (f *fsFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: ErrStoreReadOnly}
+}
@@ -0,0 +1,61 @@
+package querystore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSBackend(t *testing.T) {
+	dir := t.TempDir()
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "tag", Type: ColumnTypeString},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 100 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i), "tag": strconv.Itoa(i % 3)}))
+	}
+	require.NoError(t, fs.Close())
+
+	mapFS := fstest.MapFS{}
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, de := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, de.Name()))
+		require.NoError(t, err)
+		mapFS["data/store/"+de.Name()] = &fstest.MapFile{Data: data}
+	}
+
+	for name, b := range map[string]struct {
+		backend ColumnBackend
+		dir     string
+	}{
+		"dir": {FSBackend(os.DirFS(dir)), "."},
+		"map": {FSBackend(mapFS), "data/store"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := OpenColumnFSWithOptions(b.dir, Options{Backend: b.backend})
+			assert.ErrorIs(t, err, ErrStoreReadOnly)
+
+			fs, err := OpenColumnFSWithOptions(b.dir, Options{Backend: b.backend, ReadOnly: true})
+			require.NoError(t, err)
+			defer fs.Close()
+			res, err := NewColumnarStore(fs).Query(&Query{
+				Filters:      []Filter{{Attribute: "tag", Condition: ConditionEquals, Value: "1"}},
+				Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorSum, Attribute: "val"}},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, int64(33), res[0]["count"])
+			assert.Equal(t, int64(1617), res[0]["sum(val)"])
+			assert.ErrorIs(t, fs.WriteRows([]map[string]any{{"val": int64(1)}}), ErrStoreReadOnly)
+		})
+	}
+}
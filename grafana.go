@@ -0,0 +1,271 @@
+package querystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxGrafanaPoints bounds the number of intervals of a time series target.
+const maxGrafanaPoints = 10000
+
+// GrafanaHandler serves a store as a Grafana JSON (SimpleJSON) datasource.
+// Targets and annotation queries are queries in the text form read by
+// ParseQuery, run over the dashboard's time range:
+//
+//   - Time series targets with aggregations are computed for each interval of
+//     the range, with a series for each aggregation and group, such as
+//     `status = "error" | count, avg(latency) by region`.
+//   - Time series targets without aggregations plot the numeric values of
+//     their selected columns at the time their rows were appended, such as
+//     `region = "us" | select latency`.
+//   - Table targets return the rows of the query as ExportCSV would.
+//
+// /search lists the columns of the store, and annotations are the rows
+// matching their query, titled by the annotation name.
+func GrafanaHandler(s *ColumnarStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /search", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Target string `json:"target"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.fs.lock.Lock()
+		names := s.fs.columnNames()
+		s.fs.lock.Unlock()
+		names = slices.DeleteFunc(names, func(name string) bool { return !strings.Contains(name, req.Target) })
+		writeHTTPJSON(w, names)
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		var req grafanaQueryRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		results := []any{}
+		for _, target := range req.Targets {
+			if target.Hide || strings.TrimSpace(target.Target) == "" {
+				continue
+			}
+			q, err := ParseQuery(target.Target)
+			if err != nil {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("target %s: %w", target.RefID, err))
+				return
+			}
+			q.TimeRange = TimeRange{Start: req.Range.From, End: req.Range.To}
+			var res []any
+			if target.Type == "table" {
+				res, err = s.grafanaTable(q)
+			} else {
+				res, err = s.grafanaTimeSeries(q, req.step())
+			}
+			if err != nil {
+				writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("target %s: %w", target.RefID, err))
+				return
+			}
+			results = append(results, res...)
+		}
+		writeHTTPJSON(w, results)
+	})
+	mux.HandleFunc("POST /annotations", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Range      grafanaRange `json:"range"`
+			Annotation struct {
+				Name  string `json:"name"`
+				Query string `json:"query"`
+			} `json:"annotation"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		q, err := ParseQuery(req.Annotation.Query)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(q.aggregations()) > 0 {
+			writeHTTPError(w, http.StatusBadRequest, errors.New("annotation queries cannot aggregate"))
+			return
+		}
+		q.TimeRange = TimeRange{Start: req.Range.From, End: req.Range.To}
+		q, columns := s.exportColumns(q)
+		q.Select = append(slices.Clone(q.Select), TimestampColumn)
+		q.ReuseRows = false
+		rows, err := s.Query(q)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		annotations := []map[string]any{}
+		for _, row := range rows {
+			var text []string
+			for _, col := range columns {
+				if v := row[col]; v != nil && col != IndexColumn && col != TimestampColumn {
+					text = append(text, col+"="+formatTextValue(v))
+				}
+			}
+			annotations = append(annotations, map[string]any{
+				"annotation": req.Annotation,
+				"time":       valueToTime(row[TimestampColumn]).UnixMilli(),
+				"title":      req.Annotation.Name,
+				"text":       strings.Join(text, " "),
+				"tags":       []string{},
+			})
+		}
+		writeHTTPJSON(w, annotations)
+	})
+	return mux
+}
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaQueryRequest struct {
+	Range         grafanaRange `json:"range"`
+	IntervalMs    int64        `json:"intervalMs"`
+	MaxDataPoints int64        `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		RefID  string `json:"refId"`
+		Type   string `json:"type"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+// step returns the interval between points of time series, which keeps
+// their number within maxDataPoints and maxGrafanaPoints.
+func (req *grafanaQueryRequest) step() time.Duration {
+	span := req.Range.To.Sub(req.Range.From)
+	step := time.Duration(req.IntervalMs) * time.Millisecond
+	limit := int64(maxGrafanaPoints)
+	if req.MaxDataPoints > 0 {
+		limit = min(limit, req.MaxDataPoints)
+	}
+	return max(step, span/time.Duration(limit), time.Millisecond)
+}
+
+// grafanaTimeSeries returns the series of a time series target.
+func (s *ColumnarStore) grafanaTimeSeries(q *Query, step time.Duration) ([]any, error) {
+	if q.TimeRange.Start.IsZero() || !q.TimeRange.Start.Before(q.TimeRange.End) {
+		return nil, errors.New("invalid time range")
+	}
+	var names []string
+	points := map[string][][2]any{}
+	add := func(name string, v any, t time.Time) {
+		switch valueColumnType(v) {
+		case ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64:
+		default:
+			return
+		}
+		if _, ok := points[name]; !ok {
+			names = append(names, name)
+		}
+		points[name] = append(points[name], [2]any{valueToFloat64(v), t.UnixMilli()})
+	}
+
+	if aggs := q.aggregations(); len(aggs) > 0 {
+		r := q.TimeRange
+		for start := r.Start; start.Before(r.End); start = start.Add(step) {
+			qc := *q
+			qc.TimeRange = TimeRange{Start: start, End: start.Add(step)}
+			if qc.TimeRange.End.After(r.End) {
+				qc.TimeRange.End = r.End
+			}
+			rows, err := s.Query(&qc)
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range rows {
+				for _, a := range aggs {
+					name := a.Name()
+					if groupBy := q.groupColumns(); len(groupBy) > 0 {
+						labels := make([]string, len(groupBy))
+						for i, col := range groupBy {
+							labels[i] = col + "=" + formatTextValue(row[col])
+						}
+						name = fmt.Sprintf("%s{%s}", name, strings.Join(labels, ","))
+					}
+					add(name, row[a.Name()], start)
+				}
+			}
+		}
+	} else {
+		q, columns := s.exportColumns(q)
+		columns = slices.DeleteFunc(columns, func(col string) bool { return col == IndexColumn || col == TimestampColumn })
+		q.Select = append(slices.Clone(q.Select), TimestampColumn)
+		it, err := s.QueryIter(q)
+		if err != nil {
+			return nil, err
+		}
+		defer it.Close()
+		for it.Next() {
+			row := it.Row()
+			t := valueToTime(row[TimestampColumn])
+			for _, col := range columns {
+				add(col, row[col], t)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	series := make([]any, len(names))
+	for i, name := range names {
+		series[i] = map[string]any{"target": name, "datapoints": points[name]}
+	}
+	return series, nil
+}
+
+// grafanaTable returns the table of a table target.
+func (s *ColumnarStore) grafanaTable(q *Query) ([]any, error) {
+	q, columns := s.exportColumns(q)
+	q.ReuseRows = false
+	rows, err := s.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	types, err := s.exportTypes(q, columns)
+	if err != nil {
+		return nil, err
+	}
+	cols := make([]map[string]string, len(columns))
+	for i, name := range columns {
+		typ := "string"
+		switch types[name] {
+		case ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64:
+			typ = "number"
+		case ColumnTypeTime:
+			typ = "time"
+		}
+		if _, ok := types[name]; !ok && len(q.aggregations()) > 0 && !slices.Contains(q.groupColumns(), name) {
+			typ = "number"
+		}
+		cols[i] = map[string]string{"text": name, "type": typ}
+	}
+	values := make([][]any, len(rows))
+	for i, row := range rows {
+		values[i] = make([]any, len(columns))
+		for j, name := range columns {
+			v := row[name]
+			if cols[j]["type"] == "time" && v != nil {
+				v = valueToTime(v).UnixMilli()
+			}
+			values[i][j] = v
+		}
+	}
+	return []any{map[string]any{"type": "table", "columns": cols, "rows": values}}, nil
+}
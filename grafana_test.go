@@ -0,0 +1,68 @@
+package querystore
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGrafanaHandler(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := t0
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 6 {
+		now = t0.Add(time.Duration(i) * 30 * time.Second)
+		region := []string{"us", "eu"}[i%2]
+		require.NoError(t, cs.Append(map[string]any{"region": region, "latency": int64(100 * i), "deploy": i == 3}))
+	}
+	server := httptest.NewServer(GrafanaHandler(cs))
+	defer server.Close()
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(b)
+	}
+
+	resp, err := http.Get(server.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	code, body := post("/search", `{"target":"re"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `["region"]`, body)
+
+	rng := `"range":{"from":"2024-01-01T00:00:00Z","to":"2024-01-01T00:03:00Z"}`
+	code, body = post("/query", `{`+rng+`,"intervalMs":60000,"targets":[
+		{"refId":"A","target":"| count by region"},
+		{"refId":"B","target":"region = \"us\" | select latency"},
+		{"refId":"C","target":"| max(latency) as worst by region | sort worst desc","type":"table"},
+		{"refId":"D","target":"| count","hide":true}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[
+		{"target":"count{region=us}","datapoints":[[1,1704067200000],[1,1704067260000],[1,1704067320000]]},
+		{"target":"count{region=eu}","datapoints":[[1,1704067200000],[1,1704067260000],[1,1704067320000]]},
+		{"target":"latency","datapoints":[[0,1704067200000],[200,1704067260000],[400,1704067320000]]},
+		{"type":"table","columns":[{"text":"region","type":"string"},{"text":"worst","type":"number"}],
+		 "rows":[["eu",500],["us",400]]}]`, body)
+
+	code, body = post("/annotations", `{`+rng+`,"annotation":{"name":"deploys","query":"deploy = true | select region"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[{"annotation":{"name":"deploys","query":"deploy = true | select region"},
+		"time":1704067290000,"title":"deploys","text":"region=eu","tags":[]}]`, body)
+
+	code, _ = post("/query", `{`+rng+`,"targets":[{"refId":"A","target":"region ="}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,199 @@
+package querystore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/davidbyttow/querystore/proto/querystorepb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// GRPCServer serves a store as the QueryStore service of
+// proto/querystore.proto, for registration with
+// querystorepb.RegisterQueryStoreServer. Clients are created with
+// querystorepb.NewQueryStoreClient.
+//
+// The service mirrors HTTPHandler: rows are appended as ReadJSONL appends
+// their JSON form, queries take the fields read by DecodeQueryJSON, and
+// query rows are streamed as they are read, in their JSON form. AppendBatch
+// appends its rows atomically. Invalid rows and queries fail with
+// codes.InvalidArgument. Queries are not authorized, so the store's column
+// policies apply to them.
+func GRPCServer(s *ColumnarStore) querystorepb.QueryStoreServer {
+	return &grpcServer{s: s}
+}
+
+type grpcServer struct {
+	querystorepb.UnimplementedQueryStoreServer
+	s *ColumnarStore
+}
+
+func (g *grpcServer) Append(ctx context.Context, req *querystorepb.AppendRequest) (*querystorepb.AppendResponse, error) {
+	return g.append(ctx, []*querystorepb.Row{req.GetRow()})
+}
+
+func (g *grpcServer) AppendBatch(ctx context.Context, req *querystorepb.AppendBatchRequest) (*querystorepb.AppendResponse, error) {
+	return g.append(ctx, req.GetRows())
+}
+
+func (g *grpcServer) append(ctx context.Context, rows []*querystorepb.Row) (*querystorepb.AppendResponse, error) {
+	records := make([]jsonlRecord, len(rows))
+	for i, row := range rows {
+		b, err := protojson.Marshal(row.GetFields())
+		if err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+		if records[i], err = parseJSONLRecord(i+1, b); err != nil {
+			return nil, grpcError(codes.InvalidArgument, err)
+		}
+	}
+	types, err := g.s.fs.columnTypes()
+	if err != nil {
+		return nil, grpcError(codes.Internal, err)
+	}
+	values, err := jsonlRows(types, records)
+	if err != nil {
+		return nil, grpcError(codes.InvalidArgument, err)
+	}
+	if err := g.s.AppendBatchContext(ctx, values); err != nil {
+		return nil, grpcError(codes.InvalidArgument, err)
+	}
+	return &querystorepb.AppendResponse{Appended: int64(len(values))}, nil
+}
+
+func (g *grpcServer) Query(req *querystorepb.QueryRequest, stream querystorepb.QueryStore_QueryServer) error {
+	q, err := grpcQuery(req)
+	if err != nil {
+		return grpcError(codes.InvalidArgument, err)
+	}
+	q.ReuseRows = true
+	it, err := g.s.QueryIterContext(stream.Context(), q)
+	if err != nil {
+		return grpcError(codes.InvalidArgument, err)
+	}
+	defer it.Close()
+	for it.Next() {
+		b, err := json.Marshal(it.Row())
+		if err != nil {
+			return grpcError(codes.Internal, err)
+		}
+		fields := &structpb.Struct{}
+		if err := protojson.Unmarshal(b, fields); err != nil {
+			return grpcError(codes.Internal, err)
+		}
+		if err := stream.Send(&querystorepb.Row{Fields: fields}); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return grpcError(codes.Internal, err)
+	}
+	return nil
+}
+
+func (g *grpcServer) Schema(ctx context.Context, req *querystorepb.SchemaRequest) (*querystorepb.SchemaResponse, error) {
+	cols, err := g.s.fs.Columns()
+	if err != nil {
+		return nil, grpcError(codes.Internal, err)
+	}
+	resp := &querystorepb.SchemaResponse{}
+	for _, c := range cols {
+		resp.Columns = append(resp.Columns, &querystorepb.SchemaResponse_Column{
+			Name: c.Name, Type: c.Type.String(), Count: c.Count, Size: c.Size,
+		})
+	}
+	return resp, nil
+}
+
+// grpcError returns the status of an error, or of the context error it wraps.
+func grpcError(code codes.Code, err error) error {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcQuery returns the query of a QueryRequest, read as DecodeQueryJSON
+// reads its JSON form.
+func grpcQuery(req *querystorepb.QueryRequest) (*Query, error) {
+	qj := queryJSON{
+		Select:      req.GetSelect(),
+		GroupBy:     req.GetGroupBy(),
+		GroupByCols: req.GetGroupByColumns(),
+		GroupByTime: req.GetGroupByTime(),
+		TimeColumn:  req.GetGroupByTimeColumn(),
+		Limit:       int(req.GetLimit()),
+		Offset:      int(req.GetOffset()),
+	}
+	if req.GetStart() != nil {
+		qj.Start = req.GetStart().AsTime()
+	}
+	if req.GetEnd() != nil {
+		qj.End = req.GetEnd().AsTime()
+	}
+	if req.GetWhere() != nil {
+		where, err := grpcFilter(req.GetWhere())
+		if err != nil {
+			return nil, err
+		}
+		qj.Where = where
+	}
+	for _, c := range req.GetComputed() {
+		qj.Computed = append(qj.Computed, computedJSON{Name: c.GetName(), Expr: c.GetExpr()})
+	}
+	for _, a := range req.GetAggregations() {
+		qj.Aggregations = append(qj.Aggregations, aggregationJSON{
+			Op:         a.GetOp(),
+			Column:     a.GetColumn(),
+			As:         a.GetAs(),
+			Percentile: a.GetPercentile(),
+			Buckets:    a.GetBuckets(),
+			K:          int(a.GetK()),
+			Weight:     a.GetWeight(),
+		})
+	}
+	for _, o := range req.GetOrderBy() {
+		qj.OrderBy = append(qj.OrderBy, orderJSON{Column: o.GetColumn(), Desc: o.GetDesc()})
+	}
+	return qj.query()
+}
+
+// grpcFilter returns the JSON form of a Filter.
+func grpcFilter(f *querystorepb.Filter) (*filterJSON, error) {
+	list := func(l *querystorepb.Filter_List) ([]*filterJSON, error) {
+		fjs := []*filterJSON{}
+		for _, f := range l.GetFilters() {
+			fj, err := grpcFilter(f)
+			if err != nil {
+				return nil, err
+			}
+			fjs = append(fjs, fj)
+		}
+		return fjs, nil
+	}
+	var fj filterJSON
+	var err error
+	switch e := f.GetExpr().(type) {
+	case *querystorepb.Filter_Condition_:
+		fj.Column, fj.Op = e.Condition.GetColumn(), e.Condition.GetOp()
+		if v := e.Condition.GetValue(); v != nil {
+			if fj.Value, err = protojson.Marshal(v); err != nil {
+				return nil, err
+			}
+		}
+	case *querystorepb.Filter_And:
+		fj.And, err = list(e.And)
+	case *querystorepb.Filter_Or:
+		fj.Or, err = list(e.Or)
+	case *querystorepb.Filter_Not:
+		fj.Not, err = grpcFilter(e.Not)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fj, nil
+}
@@ -0,0 +1,115 @@
+package querystore
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/davidbyttow/querystore/proto/querystorepb"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestGRPCServer(t *testing.T) {
+	cs := newTestStore(t)
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	querystorepb.RegisterQueryStoreServer(server, GRPCServer(cs))
+	go server.Serve(lis)
+	defer server.Stop()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer conn.Close()
+	client := querystorepb.NewQueryStoreClient(conn)
+	ctx := context.Background()
+
+	row := func(fields map[string]any) *querystorepb.Row {
+		return &querystorepb.Row{Fields: lo.Must(structpb.NewStruct(fields))}
+	}
+	resp, err := client.Append(ctx, &querystorepb.AppendRequest{Row: row(map[string]any{"region": "us", "latency": 100, "status": "ok"})})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), resp.Appended)
+	resp, err = client.AppendBatch(ctx, &querystorepb.AppendBatchRequest{Rows: []*querystorepb.Row{
+		row(map[string]any{"region": "eu", "latency": 300, "status": "error"}),
+		row(map[string]any{"region": "us", "latency": 500, "status": "error"}),
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), resp.Appended)
+
+	query := func(req *querystorepb.QueryRequest) ([]map[string]any, error) {
+		stream, err := client.Query(ctx, req)
+		require.NoError(t, err)
+		var rows []map[string]any
+		for {
+			row, err := stream.Recv()
+			if err == io.EOF {
+				return rows, nil
+			}
+			if err != nil {
+				return rows, err
+			}
+			rows = append(rows, row.Fields.AsMap())
+		}
+	}
+	cond := func(column, op string, v *structpb.Value) *querystorepb.Filter {
+		return &querystorepb.Filter{Expr: &querystorepb.Filter_Condition_{Condition: &querystorepb.Filter_Condition{Column: column, Op: op, Value: v}}}
+	}
+	rows, err := query(&querystorepb.QueryRequest{
+		Select: []string{"region", "latency"},
+		Where: &querystorepb.Filter{Expr: &querystorepb.Filter_And{And: &querystorepb.Filter_List{Filters: []*querystorepb.Filter{
+			cond("status", "=", structpb.NewStringValue("error")),
+			{Expr: &querystorepb.Filter_Not{Not: cond("latency", "in", structpb.NewListValue(&structpb.ListValue{Values: []*structpb.Value{structpb.NewNumberValue(300)}}))}},
+		}}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "us", rows[0]["region"])
+	assert.Equal(t, 500.0, rows[0]["latency"])
+	assert.Equal(t, 2.0, rows[0][IndexColumn])
+
+	rows, err = query(&querystorepb.QueryRequest{
+		Aggregations: []*querystorepb.Aggregation{{Op: "count"}, {Op: "max", Column: "latency", As: "worst"}},
+		GroupBy:      "region",
+		OrderBy:      []*querystorepb.Order{{Column: "count", Desc: true}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"region": "us", "count": 2.0, "worst": 500.0},
+		{"region": "eu", "count": 1.0, "worst": 300.0},
+	}, rows)
+
+	for _, req := range []*querystorepb.QueryRequest{
+		{Limit: -1},
+		{Where: cond("a", "~", structpb.NewNumberValue(1))},
+		{Where: &querystorepb.Filter{}},
+		{Aggregations: []*querystorepb.Aggregation{{Op: "median"}}},
+	} {
+		_, err := query(req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), req.String())
+	}
+	_, err = client.Append(ctx, &querystorepb.AppendRequest{Row: row(map[string]any{"latency": "slow"})})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.AppendBatch(ctx, &querystorepb.AppendBatchRequest{Rows: []*querystorepb.Row{
+		row(map[string]any{"region": "ap"}),
+		row(map[string]any{"../escaped": 1}),
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	schema, err := client.Schema(ctx, &querystorepb.SchemaRequest{})
+	require.NoError(t, err)
+	require.Len(t, schema.Columns, 3)
+	assert.Equal(t, "latency", schema.Columns[0].Name)
+	assert.Equal(t, "int64", schema.Columns[0].Type)
+	assert.Equal(t, int64(3), schema.Columns[0].Count, "failed batches append no rows")
+	assert.Equal(t, int64(3), schema.Columns[1].Count)
+}
@@ -0,0 +1,212 @@
+package querystore
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// validateParams checks the parameters of percentile, histogram and top-K
+// aggregations.
+func (a Aggregation) validateParams() error {
+	if a.Weight != "" && a.Type != AggregatorTopK {
+		return fmt.Errorf("%s aggregations cannot be weighted", a.Type)
+	}
+	switch a.Type {
+	case AggregatorTopK:
+		if a.K <= 0 || a.K > maxTopK {
+			return fmt.Errorf("top-K of %s needs a K from 1 to %d", a.Attribute, maxTopK)
+		}
+	case AggregatorPercentile:
+		if !(a.Percentile >= 0 && a.Percentile <= 100) {
+			return fmt.Errorf("percentile %v is not between 0 and 100", a.Percentile)
+		}
+	case AggregatorHistogram:
+		if len(a.Buckets) == 0 {
+			return fmt.Errorf("histogram of %s needs buckets", a.Attribute)
+		}
+		for i, b := range a.Buckets {
+			if math.IsNaN(b) || i > 0 && b <= a.Buckets[i-1] {
+				return fmt.Errorf("histogram buckets of %s are not ascending", a.Attribute)
+			}
+		}
+	}
+	return nil
+}
+
+// numericValue returns a numeric value as a float64.
+func numericValue(v any) (float64, bool) {
+	switch v := v.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// numericVectorValue returns a value of a numeric vector as a float64.
+func numericVectorValue(v *vector, j int) (float64, bool) {
+	switch v.typ {
+	case ColumnTypeInt64, ColumnTypeInt32:
+		return float64(int64(v.bits[j])), true
+	case ColumnTypeUint64:
+		return float64(v.bits[j]), true
+	case ColumnTypeFloat64:
+		return math.Float64frombits(v.bits[j]), true
+	}
+	return 0, false
+}
+
+// sketchAccuracy is the relative accuracy of the values estimated by
+// percentile sketches.
+const sketchAccuracy = 0.01
+
+var (
+	sketchGamma    = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+	sketchLogGamma = math.Log(sketchGamma)
+)
+
+// percentileAccumulator estimates a percentile with a DDSketch: values are
+// counted in buckets whose bounds grow geometrically, so every value of a
+// bucket is within sketchAccuracy of its midpoint, and the number of buckets
+// grows only with the logarithm of the range of values.
+type percentileAccumulator struct {
+	// q is the percentile as a fraction.
+	q float64
+	// pos and neg count positive values and the magnitudes of negative ones
+	// by bucket.
+	pos, neg map[int]int64
+	zero     int64
+	n        int64
+}
+
+func newPercentileAccumulator(p float64) *percentileAccumulator {
+	return &percentileAccumulator{q: p / 100, pos: map[int]int64{}, neg: map[int]int64{}}
+}
+
+func (a *percentileAccumulator) add(v any) {
+	if x, ok := numericValue(v); ok {
+		a.addFloat(x)
+	}
+}
+
+func (a *percentileAccumulator) addVector(v *vector, j int) {
+	if x, ok := numericVectorValue(v, j); ok {
+		a.addFloat(x)
+	}
+}
+
+func (a *percentileAccumulator) addFloat(x float64) {
+	switch {
+	case math.IsNaN(x) || math.IsInf(x, 0):
+		return
+	case x > 0:
+		a.pos[sketchBucket(x)]++
+	case x < 0:
+		a.neg[sketchBucket(-x)]++
+	default:
+		a.zero++
+	}
+	a.n++
+}
+
+// sketchBucket returns the bucket of a positive value.
+func sketchBucket(x float64) int {
+	return int(math.Ceil(math.Log(x) / sketchLogGamma))
+}
+
+// sketchValue returns the value estimating those of a bucket, which is
+// within sketchAccuracy of all of them.
+func sketchValue(k int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(k)) / (sketchGamma + 1)
+}
+
+func (a *percentileAccumulator) merge(o accumulator) {
+	b := o.(*percentileAccumulator)
+	for k, c := range b.pos {
+		a.pos[k] += c
+	}
+	for k, c := range b.neg {
+		a.neg[k] += c
+	}
+	a.zero += b.zero
+	a.n += b.n
+}
+
+func (a *percentileAccumulator) result() any {
+	if a.n == 0 {
+		return nil
+	}
+	// The value of the given rank in ascending order, from the negative
+	// values of greatest magnitude up.
+	rank := int64(math.Round(a.q * float64(a.n-1)))
+	negs := sortedKeys(a.neg)
+	for i := len(negs) - 1; i >= 0; i-- {
+		if rank -= a.neg[negs[i]]; rank < 0 {
+			return -sketchValue(negs[i])
+		}
+	}
+	if rank -= a.zero; rank < 0 {
+		return 0.0
+	}
+	var x float64
+	for _, k := range sortedKeys(a.pos) {
+		x = sketchValue(k)
+		if rank -= a.pos[k]; rank < 0 {
+			break
+		}
+	}
+	return x
+}
+
+func sortedKeys(m map[int]int64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// histogramAccumulator counts values in buckets bounded by ascending upper
+// bounds, with a last bucket for the values above them.
+type histogramAccumulator struct {
+	bounds []float64
+	counts []int64
+}
+
+func newHistogramAccumulator(bounds []float64) *histogramAccumulator {
+	return &histogramAccumulator{bounds: bounds, counts: make([]int64, len(bounds)+1)}
+}
+
+func (a *histogramAccumulator) add(v any) {
+	if x, ok := numericValue(v); ok {
+		a.addFloat(x)
+	}
+}
+
+func (a *histogramAccumulator) addVector(v *vector, j int) {
+	if x, ok := numericVectorValue(v, j); ok {
+		a.addFloat(x)
+	}
+}
+
+func (a *histogramAccumulator) addFloat(x float64) {
+	if !math.IsNaN(x) {
+		a.counts[sort.SearchFloat64s(a.bounds, x)]++
+	}
+}
+
+func (a *histogramAccumulator) merge(o accumulator) {
+	for i, c := range o.(*histogramAccumulator).counts {
+		a.counts[i] += c
+	}
+}
+
+func (a *histogramAccumulator) result() any {
+	return slices.Clone(a.counts)
+}
@@ -0,0 +1,41 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentileAndHistogram(t *testing.T) {
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := 1; i <= 1000; i++ {
+		rows = append(rows, map[string]any{"latency": float64(i), "region": []string{"us", "eu"}[i%2]})
+	}
+	rows = append(rows, map[string]any{"region": "us"})
+	require.NoError(t, cs.AppendBatch(rows))
+
+	q, err := ParseQuery("| p50(latency), p99.9(latency), histogram(latency, 10, 500.5) as hist")
+	require.NoError(t, err)
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.InEpsilon(t, 500.0, res[0]["p50(latency)"], 0.01)
+	assert.InEpsilon(t, 999.0, res[0]["p99.9(latency)"], 0.01)
+	assert.Equal(t, []int64{10, 490, 500}, res[0]["hist"])
+
+	q, err = NewQuery().Percentile("latency", 100).Percentile("latency", 0).GroupBy("region").OrderBy("region").BuildFor(cs)
+	require.NoError(t, err)
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.InEpsilon(t, 999.0, res[0]["p100(latency)"], 0.01)
+	assert.InEpsilon(t, 1.0, res[0]["p0(latency)"], 0.01)
+	assert.InEpsilon(t, 1000.0, res[1]["p100(latency)"], 0.01)
+
+	_, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorHistogram, Attribute: "latency", Buckets: []float64{2, 1}}}})
+	assert.ErrorContains(t, err, "not ascending")
+	_, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorPercentile, Attribute: "latency", Percentile: 101}}})
+	assert.ErrorContains(t, err, "not between 0 and 100")
+}
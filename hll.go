@@ -0,0 +1,409 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"slices"
+	"time"
+)
+
+// hllExt is appended to a column file's path to name its distinct sketches,
+// which hold a HyperLogLog sketch of the values of every completed block.
+// Each sketch is stored as its number of nonzero registers, as a
+// little-endian uint32, followed by those registers as a little-endian
+// uint16 position and a byte each, or by every register if that is shorter.
+const hllExt = ".hll"
+
+// hllPrecision is the number of hash bits selecting a register of a sketch.
+// Sketches of 2^12 registers estimate distinct counts within about 1.6%.
+const hllPrecision = 12
+
+const hllRegisters = 1 << hllPrecision
+
+// hllSketch estimates the number of distinct values added to it with the
+// HyperLogLog algorithm: each value's hash selects a register, which keeps
+// the longest run of leading zeros seen in the rest of the hashes it selects.
+// Sketches merge by keeping the longer run of each register, so the sketches
+// of blocks combine into that of their union. Registers are allocated on the
+// first value. Like bloom filters, sketches shared with readers are never
+// modified; writes update a copy.
+type hllSketch struct {
+	regs []uint8
+}
+
+// hasDistinctSketch reports whether blocks of a column type can keep
+// distinct sketches.
+func hasDistinctSketch(typ ColumnType) bool {
+	return hasZoneMap(typ)
+}
+
+func (s *hllSketch) clone() *hllSketch {
+	return &hllSketch{regs: slices.Clone(s.regs)}
+}
+
+func (s *hllSketch) add(v any) {
+	if v != nil {
+		s.addHash(hllHash(v))
+	}
+}
+
+func (s *hllSketch) addVector(v *vector, j int) {
+	if v.typ == ColumnTypeString {
+		s.addHash(hllHashString(v.strs[j]))
+		return
+	}
+	s.addHash(hllMix(v.bits[j]))
+}
+
+func (s *hllSketch) addHash(h uint64) {
+	if s.regs == nil {
+		s.regs = make([]uint8, hllRegisters)
+	}
+	i := h >> (64 - hllPrecision)
+	// The marker bit bounds the run when the remaining bits are zero.
+	rho := uint8(bits.LeadingZeros64(h<<hllPrecision|1<<(hllPrecision-1))) + 1
+	s.regs[i] = max(s.regs[i], rho)
+}
+
+func (s *hllSketch) merge(o accumulator) {
+	s.mergeSketch(o.(*hllSketch))
+}
+
+func (s *hllSketch) mergeSketch(o *hllSketch) {
+	if o.regs == nil {
+		return
+	}
+	if s.regs == nil {
+		s.regs = make([]uint8, hllRegisters)
+	}
+	for i, r := range o.regs {
+		s.regs[i] = max(s.regs[i], r)
+	}
+}
+
+func (s *hllSketch) result() any {
+	return s.estimate()
+}
+
+// estimate returns the estimated distinct count, counting empty registers
+// instead while few registers are set, which is more accurate for small
+// counts.
+func (s *hllSketch) estimate() int64 {
+	if s.regs == nil {
+		return 0
+	}
+	m := float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, r := range s.regs {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(est))
+}
+
+// hllHash hashes a value as its column's vectors hash it, so that values
+// read from rows and from vectors land in the same registers.
+func hllHash(v any) uint64 {
+	switch v := v.(type) {
+	case string:
+		return hllHashString(v)
+	case int64:
+		return hllMix(uint64(v))
+	case uint64:
+		return hllMix(v)
+	case float64:
+		return hllMix(math.Float64bits(v))
+	case bool:
+		if v {
+			return hllMix(1)
+		}
+		return hllMix(0)
+	case time.Time:
+		return hllMix(uint64(v.UnixNano()))
+	}
+	return hllHashString(string(encodeJSONValue(v)))
+}
+
+// hllHashString hashes a string with FNV-1a, mixed as the bits of fixed
+// width values are, as HyperLogLog relies on the leading bits of hashes.
+func hllHashString(s string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= 1099511628211
+	}
+	return hllMix(h)
+}
+
+// hllMix is the 64-bit finalizer of MurmurHash3.
+func hllMix(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb3fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func (s *hllSketch) encode(dst []byte) []byte {
+	n := 0
+	for _, r := range s.regs {
+		if r != 0 {
+			n++
+		}
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(n))
+	if 3*n >= hllRegisters {
+		return append(dst, s.regs...)
+	}
+	for i, r := range s.regs {
+		if r != 0 {
+			dst = binary.LittleEndian.AppendUint16(dst, uint16(i))
+			dst = append(dst, r)
+		}
+	}
+	return dst
+}
+
+// decodeHLLSketch decodes a sketch, returning the number of bytes read, or
+// zero if data does not hold a complete sketch.
+func decodeHLLSketch(data []byte) (*hllSketch, int) {
+	if len(data) < 4 {
+		return nil, 0
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	s := &hllSketch{}
+	switch {
+	case n > hllRegisters:
+		return nil, 0
+	case n == 0:
+		return s, 4
+	case 3*n >= hllRegisters:
+		if len(data) < 4+hllRegisters {
+			return nil, 0
+		}
+		s.regs = slices.Clone(data[4 : 4+hllRegisters])
+		return s, 4 + hllRegisters
+	}
+	if len(data) < 4+3*n {
+		return nil, 0
+	}
+	s.regs = make([]uint8, hllRegisters)
+	for i := range n {
+		e := data[4+3*i:]
+		pos := binary.LittleEndian.Uint16(e)
+		if int(pos) >= hllRegisters {
+			return nil, 0
+		}
+		s.regs[pos] = e[2]
+	}
+	return s, 4 + 3*n
+}
+
+func (ch *ColumnHandle) sketchPath() string {
+	return ch.path + hllExt
+}
+
+// loadSketches loads the distinct sketches of a column whose block index is
+// loaded, computing sketches missing from the sketch file by scanning their
+// blocks.
+func (ch *ColumnHandle) loadSketches() error {
+	if !ch.sketched {
+		return nil
+	}
+	data, err := readFile(ch.backend, ch.sketchPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var sketches []*hllSketch
+	for len(sketches) < len(ch.blocks)-1 {
+		s, n := decodeHLLSketch(data)
+		if n == 0 {
+			break
+		}
+		sketches = append(sketches, s)
+		data = data[n:]
+	}
+	stale := len(data) > 0
+
+	if len(sketches) < len(ch.blocks) {
+		cr, err := ch.createReaderAt(ch.blocks[len(sketches)].offset)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		sketches = append(sketches, &hllSketch{})
+		for {
+			index, v, _, err := cr.readRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if len(sketches) < len(ch.blocks) && index >= ch.blocks[len(sketches)].firstIndex {
+				sketches = append(sketches, &hllSketch{})
+				stale = true
+			}
+			sketches[len(sketches)-1].add(v)
+		}
+	}
+
+	if stale && !ch.readOnly {
+		var buf []byte
+		for _, s := range sketches[:max(len(sketches)-1, 0)] {
+			buf = s.encode(buf)
+		}
+		if err := writeFile(ch.backend, ch.sketchPath(), buf); err != nil {
+			return err
+		}
+	}
+	ch.sketches = sketches
+	return nil
+}
+
+// noteSketch adds a value of a pending write to the sketch of its block.
+// blockStarted is set if the value starts a block.
+func (p *pendingWrite) noteSketch(v any, blockStarted bool) {
+	if !p.ch.sketched {
+		return
+	}
+	switch {
+	case blockStarted || len(p.sketches) == 0 && len(p.ch.sketches) == 0:
+		p.sketches = append(p.sketches, &hllSketch{})
+	case len(p.sketches) == 0:
+		p.sketches = append(p.sketches, p.ch.sketches[len(p.ch.sketches)-1].clone())
+		p.replacesOpenSketch = true
+	}
+	if v != nil {
+		p.sketches[len(p.sketches)-1].add(castValueToColumnType(v, p.ch.typ))
+	}
+}
+
+// appendSketches records the sketches of blocks written by p, as
+// appendBlooms records their filters.
+func (ch *ColumnHandle) appendSketches(p *pendingWrite) error {
+	if !ch.sketched || len(p.sketches) == 0 {
+		return nil
+	}
+	sketches := p.sketches
+	if p.replacesOpenSketch {
+		ch.sketches[len(ch.sketches)-1] = sketches[0]
+		sketches = sketches[1:]
+	}
+	completed := len(ch.sketches) - 1
+	ch.sketches = append(ch.sketches, sketches...)
+	var buf []byte
+	for i := max(completed, 0); i < len(ch.sketches)-1; i++ {
+		buf = ch.sketches[i].encode(buf)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if ch.sketchFp == nil {
+		var err error
+		if ch.sketchFp, err = ch.backend.OpenFile(ch.sketchPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm); err != nil {
+			return err
+		}
+	}
+	_, err := ch.sketchFp.Write(buf)
+	return err
+}
+
+// sketchSnapshot returns the distinct sketches of a column for a reader.
+func (ch *ColumnHandle) sketchSnapshot() []*hllSketch {
+	return slices.Clone(ch.sketches)
+}
+
+// usesSketches reports whether the cursor's aggregates can be computed from
+// distinct sketches: they must all be approximate distinct counts of
+// columns keeping sketches, over every row in the scan, ungrouped.
+func (c *cursor) usesSketches() bool {
+	if !c.vectorAgg || c.batch != nil || len(c.agg.groupBy) > 0 {
+		return false
+	}
+	for i, a := range c.agg.aggs {
+		if a.Type != AggregatorApproxDistinct {
+			return false
+		}
+		if col := c.aggCols[i]; col != nil && len(col.cr.sketches) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregateSketches computes approximate distinct counts by merging the
+// sketches of the blocks within the scan, reading values only from the
+// blocks it covers in part.
+func (c *cursor) aggregateSketches() error {
+	if c.next >= c.lastID {
+		return nil
+	}
+	g := c.agg.group(nil)
+	sketched := map[*batchColumn]*hllSketch{}
+	for i, col := range c.aggCols {
+		if col == nil {
+			continue
+		}
+		s := sketched[col]
+		if s == nil {
+			s = &hllSketch{}
+			if err := c.sketchColumn(col, s); err != nil {
+				return err
+			}
+			sketched[col] = s
+		}
+		g.accs[i].merge(s)
+	}
+	c.next = c.lastID
+	return nil
+}
+
+// sketchColumn adds the values of a column over the scan to s.
+func (c *cursor) sketchColumn(col *batchColumn, s *hllSketch) error {
+	read := func(from, to int64) error {
+		for from < to {
+			if err := c.ctx.Err(); err != nil {
+				return err
+			}
+			n := int(min(batchSize, to-from))
+			if err := col.load(from, n); err != nil {
+				return err
+			}
+			for j := range n {
+				if col.vec.valid[j] {
+					s.addVector(col.vec, j)
+				}
+			}
+			from += int64(n)
+		}
+		return nil
+	}
+	cr, from := col.cr, c.next
+	// The last block is still open, and has no sketch on file.
+	for b := 0; b+1 < len(cr.blocks) && b < len(cr.sketches); b++ {
+		start, end := cr.blocks[b].firstIndex, cr.blocks[b+1].firstIndex
+		if start < from {
+			continue
+		}
+		if end > c.lastID {
+			break
+		}
+		if err := read(from, start); err != nil {
+			return err
+		}
+		s.mergeSketch(cr.sketches[b])
+		from = end
+	}
+	return read(from, c.lastID)
+}
@@ -0,0 +1,79 @@
+package querystore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApproxDistinct(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 64
+
+	dir := t.TempDir()
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "user", Type: ColumnTypeString, DistinctSketch: true},
+		{Name: "id", Type: ColumnTypeInt64, DistinctSketch: true},
+		{Name: "region", Type: ColumnTypeString},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	plain := newTestStore(t)
+	for i := range 10 {
+		var rows []map[string]any
+		for j := range 500 {
+			n := i*500 + j
+			rows = append(rows, map[string]any{"user": fmt.Sprintf("user-%d", n%3000), "id": int64(n), "region": []string{"us", "eu"}[n%2]})
+		}
+		require.NoError(t, cs.AppendBatch(rows))
+		require.NoError(t, plain.AppendBatch(rows))
+	}
+
+	q, err := ParseQuery("| approx_distinct(user) as users, approx_distinct(id)")
+	require.NoError(t, err)
+	c, err := openCursor(context.Background(), fs, q)
+	require.NoError(t, err)
+	assert.True(t, c.sketchAgg)
+	require.NoError(t, c.close())
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.InEpsilon(t, 3000, res[0]["users"], 0.05)
+	assert.InEpsilon(t, 5000, res[0]["approx_distinct(id)"], 0.05)
+	// Block sketches merge into the sketch of every value, so stores without
+	// them estimate the same.
+	expected, err := plain.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, expected, res)
+
+	// Filtered and grouped counts read the values.
+	q, err = QueryFromSQL("SELECT region, APPROX_DISTINCT(user) AS users FROM t WHERE id < 1000 GROUP BY region ORDER BY region")
+	require.NoError(t, err)
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, "eu", res[0]["region"])
+	assert.InEpsilon(t, 500, res[0]["users"], 0.05)
+	assert.InEpsilon(t, 500, res[1]["users"], 0.05)
+
+	// Lost sketches are rebuilt on open.
+	sketches := fs.columnHandles["user"].sketches
+	require.Len(t, sketches, 79)
+	require.NoError(t, fs.Close())
+	require.NoError(t, os.Remove(fs.columnHandles["user"].sketchPath()))
+	fs, err = OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	defer fs.Close()
+	res, err = NewColumnarStore(fs).Query(&Query{Aggregations: []Aggregation{{Type: AggregatorApproxDistinct, Attribute: "user"}}})
+	require.NoError(t, err)
+	assert.Equal(t, expected[0]["users"], res[0]["approx_distinct(user)"])
+	assert.Equal(t, sketches, fs.columnHandles["user"].sketches)
+
+	_, err = OpenColumnFSWithSchema(t.TempDir(), &Schema{Columns: []ColumnSpec{{Name: "ok", Type: ColumnTypeBool, DistinctSketch: true}}})
+	assert.ErrorContains(t, err, "distinct sketches are not supported")
+}
@@ -0,0 +1,436 @@
+package querystore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTPHandler serves a store to clients in other languages with the
+// endpoints
+//
+//	POST /append   append the newline-delimited JSON objects of the body, as
+//	               ReadJSONL does, and respond {"appended": n}
+//	POST /query    run the query in the body, in the form read by
+//	               DecodeQueryJSON, and respond with a JSON array of rows
+//	GET  /schema   respond {"columns": [{"name", "type", "count", "size"}]}
+//
+// Query rows are streamed as they are read. An error after the first row
+// truncates the array and is reported in the Querystore-Error trailer; other
+// errors respond {"error": message} with a 4xx status for invalid requests
+// and queries, and 500 for failures to read the store. Queries are not
+// authorized, so the store's column policies apply to them.
+func HTTPHandler(s *ColumnarStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /append", func(w http.ResponseWriter, r *http.Request) {
+		n, err := s.ReadJSONL(r.Body)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("appended %d rows: %w", n, err))
+			return
+		}
+		writeHTTPJSON(w, map[string]any{"appended": n})
+	})
+	mux.HandleFunc("POST /query", func(w http.ResponseWriter, r *http.Request) {
+		q, err := DecodeQueryJSON(r.Body)
+		if err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+		q.ReuseRows = true
+		it, err := s.QueryIterContext(r.Context(), q)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, ErrInvalidQuery) {
+				status = http.StatusBadRequest
+			}
+			writeHTTPError(w, status, err)
+			return
+		}
+		defer it.Close()
+		streamHTTPRows(w, it)
+	})
+	mux.HandleFunc("GET /schema", func(w http.ResponseWriter, r *http.Request) {
+		cols, err := s.fs.Columns()
+		if err != nil {
+			writeHTTPError(w, http.StatusInternalServerError, err)
+			return
+		}
+		type column struct {
+			Name  string `json:"name"`
+			Type  string `json:"type"`
+			Count int64  `json:"count"`
+			Size  int64  `json:"size"`
+		}
+		out := []column{}
+		for _, c := range cols {
+			out = append(out, column{Name: c.Name, Type: c.Type.String(), Count: c.Count, Size: c.Size})
+		}
+		writeHTTPJSON(w, map[string]any{"columns": out})
+	})
+	return mux
+}
+
+// httpErrorTrailer reports errors that occur after a response has started.
+const httpErrorTrailer = "Querystore-Error"
+
+// httpFlushRows is the number of rows streamed between flushes.
+const httpFlushRows = 1000
+
+func streamHTTPRows(w http.ResponseWriter, it *Rows) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", httpErrorTrailer)
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	bw.WriteString("[")
+	var n int
+	for it.Next() {
+		if n > 0 {
+			bw.WriteString(",")
+		}
+		if err := enc.Encode(it.Row()); err != nil {
+			w.Header().Set(httpErrorTrailer, err.Error())
+			return
+		}
+		if n++; n%httpFlushRows == 0 && flusher != nil {
+			bw.Flush()
+			flusher.Flush()
+		}
+	}
+	if err := it.Err(); err != nil {
+		bw.Flush()
+		w.Header().Set(httpErrorTrailer, err.Error())
+		return
+	}
+	bw.WriteString("]\n")
+	bw.Flush()
+}
+
+func writeHTTPJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// queryJSON is the JSON form of a Query.
+type queryJSON struct {
+	Select       []string          `json:"select"`
+	Computed     []computedJSON    `json:"computed"`
+	Where        *filterJSON       `json:"where"`
+	Aggregations []aggregationJSON `json:"aggregations"`
+	GroupBy      string            `json:"group_by"`
+	GroupByCols  []string          `json:"group_by_columns"`
+	GroupByTime  string            `json:"group_by_time"`
+	TimeColumn   string            `json:"group_by_time_column"`
+	OrderBy      []orderJSON       `json:"order_by"`
+	Limit        int               `json:"limit"`
+	Offset       int               `json:"offset"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+}
+
+type filterJSON struct {
+	Column string          `json:"column"`
+	Op     string          `json:"op"`
+	Value  json.RawMessage `json:"value"`
+	And    []*filterJSON   `json:"and"`
+	Or     []*filterJSON   `json:"or"`
+	Not    *filterJSON     `json:"not"`
+}
+
+type aggregationJSON struct {
+	Op         string    `json:"op"`
+	Column     string    `json:"column"`
+	As         string    `json:"as"`
+	Percentile float64   `json:"percentile"`
+	Buckets    []float64 `json:"buckets"`
+	K          int       `json:"k"`
+	Weight     string    `json:"weight"`
+}
+
+type computedJSON struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+type orderJSON struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+// DecodeQueryJSON reads a query in JSON form, such as
+//
+//	{
+//	  "select": ["region", "latency_ms"],
+//	  "computed": [{"name": "latency_ms", "expr": "latency_ns / 1e6"}],
+//	  "where": {"and": [
+//	    {"column": "status", "op": "=", "value": "error"},
+//	    {"not": {"column": "region", "op": "in", "value": ["us", "eu"]}}
+//	  ]},
+//	  "aggregations": [{"op": "count"}, {"op": "avg", "column": "latency", "as": "mean"}],
+//	  "group_by": "region",
+//	  "group_by_time": "1m",
+//	  "order_by": [{"column": "count", "desc": true}],
+//	  "limit": 10,
+//	  "offset": 0,
+//	  "start": "2024-01-01T00:00:00Z",
+//	  "end": "2024-02-01T00:00:00Z"
+//	}
+//
+// where every field is optional. computed defines the columns computed from
+// expressions, as described by ComputedColumn. group_by_columns lists further
+// columns to group by, or all of them in place of group_by. group_by_time
+// groups by intervals of the time rows were appended, or of the column in
+// group_by_time_column. The percentile aggregation takes its percentile in
+// "percentile", and the histogram aggregation its bucket bounds in
+// "buckets". The top aggregation takes the number of values in "k", and
+// ranks them by the sum of the column in "weight" if given. Filter ops are
+// named as by ConditionType.String, and "is null" and "is not null" take no
+// value.
+// Integral numbers become int64 values, and other numbers float64.
+func DecodeQueryJSON(r io.Reader) (*Query, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var qj queryJSON
+	if err := dec.Decode(&qj); err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
+	}
+	return qj.query()
+}
+
+// query returns the query of its JSON form.
+func (qj *queryJSON) query() (*Query, error) {
+	q := &Query{
+		Select:            qj.Select,
+		GroupBy:           qj.GroupBy,
+		GroupByColumns:    qj.GroupByCols,
+		GroupByTimeColumn: qj.TimeColumn,
+		Limit:             qj.Limit,
+		Offset:            qj.Offset,
+		TimeRange:         TimeRange{Start: qj.Start, End: qj.End},
+	}
+	if qj.Limit < 0 || qj.Offset < 0 {
+		return nil, errors.New("invalid query: limit and offset cannot be negative")
+	}
+	if qj.GroupByTime != "" {
+		d, err := time.ParseDuration(qj.GroupByTime)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid query: invalid group_by_time %q", qj.GroupByTime)
+		}
+		q.GroupByTime = d
+	}
+	if qj.Where != nil {
+		where, err := qj.Where.expression()
+		if err != nil {
+			return nil, fmt.Errorf("invalid query: %w", err)
+		}
+		q.Where = where
+	}
+	for _, a := range qj.Aggregations {
+		typ, ok := lookupName(aggregatorNames, strings.ToLower(a.Op))
+		if !ok {
+			return nil, fmt.Errorf("invalid query: unknown aggregation %q", a.Op)
+		}
+		q.Aggregations = append(q.Aggregations, Aggregation{Type: typ, Attribute: a.Column, Alias: a.As, Percentile: a.Percentile, Buckets: a.Buckets, K: a.K, Weight: a.Weight})
+	}
+	for _, c := range qj.Computed {
+		q.Computed = append(q.Computed, ComputedColumn{Name: c.Name, Expr: c.Expr})
+	}
+	for _, o := range qj.OrderBy {
+		q.OrderBy = append(q.OrderBy, Order{Attribute: o.Column, Descending: o.Desc})
+	}
+	return q, nil
+}
+
+// EncodeQueryJSON returns the JSON form of a query read by DecodeQueryJSON,
+// leaving out empty fields. Enrichers and the options of how a query runs,
+// such as Parallelism and Authorized, are not encoded.
+func EncodeQueryJSON(q *Query) ([]byte, error) {
+	out := map[string]any{}
+	if len(q.Select) > 0 {
+		out["select"] = q.Select
+	}
+	if len(q.Computed) > 0 {
+		computed := make([]computedJSON, len(q.Computed))
+		for i, c := range q.Computed {
+			computed[i] = computedJSON{Name: c.Name, Expr: c.Expr}
+		}
+		out["computed"] = computed
+	}
+	if where := q.filterExpression(); where != nil {
+		out["where"] = encodeFilterJSON(where)
+	}
+	var aggs []map[string]any
+	for _, a := range q.aggregations() {
+		aj := map[string]any{"op": a.Type.String()}
+		for key, v := range map[string]any{"column": a.Attribute, "as": a.Alias, "weight": a.Weight} {
+			if v != "" {
+				aj[key] = v
+			}
+		}
+		if a.Type == AggregatorPercentile {
+			aj["percentile"] = a.Percentile
+		}
+		if a.Buckets != nil {
+			aj["buckets"] = a.Buckets
+		}
+		if a.K != 0 {
+			aj["k"] = a.K
+		}
+		aggs = append(aggs, aj)
+	}
+	if aggs != nil {
+		out["aggregations"] = aggs
+	}
+	if q.GroupBy != "" {
+		out["group_by"] = q.GroupBy
+	}
+	if len(q.GroupByColumns) > 0 {
+		out["group_by_columns"] = q.GroupByColumns
+	}
+	if q.GroupByTime != 0 {
+		out["group_by_time"] = q.GroupByTime.String()
+	}
+	if q.GroupByTimeColumn != "" {
+		out["group_by_time_column"] = q.GroupByTimeColumn
+	}
+	if len(q.OrderBy) > 0 {
+		orders := make([]orderJSON, len(q.OrderBy))
+		for i, o := range q.OrderBy {
+			orders[i] = orderJSON{Column: o.Attribute, Desc: o.Descending}
+		}
+		out["order_by"] = orders
+	}
+	if q.Limit != 0 {
+		out["limit"] = q.Limit
+	}
+	if q.Offset != 0 {
+		out["offset"] = q.Offset
+	}
+	if !q.TimeRange.Start.IsZero() {
+		out["start"] = q.TimeRange.Start
+	}
+	if !q.TimeRange.End.IsZero() {
+		out["end"] = q.TimeRange.End
+	}
+	return json.Marshal(out)
+}
+
+// encodeFilterJSON returns the JSON form of a filter expression.
+func encodeFilterJSON(e *FilterExpression) map[string]any {
+	children := func(exprs []*FilterExpression) []map[string]any {
+		out := make([]map[string]any, len(exprs))
+		for i, e := range exprs {
+			out[i] = encodeFilterJSON(e)
+		}
+		return out
+	}
+	switch {
+	case e.Filter != nil:
+		f := map[string]any{"column": e.Filter.Attribute, "op": e.Filter.Condition.String()}
+		if e.Filter.Condition != ConditionIsNull && e.Filter.Condition != ConditionIsNotNull {
+			f["value"] = e.Filter.Value
+		}
+		return f
+	case e.And != nil:
+		return map[string]any{"and": children(e.And)}
+	case e.Or != nil:
+		return map[string]any{"or": children(e.Or)}
+	case e.Not != nil:
+		return map[string]any{"not": encodeFilterJSON(e.Not)}
+	}
+	return map[string]any{"and": []map[string]any{}}
+}
+
+func (f *filterJSON) expression() (*FilterExpression, error) {
+	var set int
+	for _, ok := range []bool{f.Op != "", f.And != nil, f.Or != nil, f.Not != nil} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("a filter needs exactly one of op, and, or and not")
+	}
+	children := func(fjs []*filterJSON) ([]*FilterExpression, error) {
+		exprs := make([]*FilterExpression, len(fjs))
+		for i, fj := range fjs {
+			var err error
+			if exprs[i], err = fj.expression(); err != nil {
+				return nil, err
+			}
+		}
+		return exprs, nil
+	}
+	switch {
+	case f.And != nil:
+		exprs, err := children(f.And)
+		return And(exprs...), err
+	case f.Or != nil:
+		exprs, err := children(f.Or)
+		return Or(exprs...), err
+	case f.Not != nil:
+		expr, err := f.Not.expression()
+		return Not(expr), err
+	}
+	cond, ok := lookupName(conditionNames, strings.ToLower(f.Op))
+	if !ok {
+		return nil, fmt.Errorf("unknown filter op %q", f.Op)
+	}
+	if f.Column == "" {
+		return nil, fmt.Errorf("filter op %q needs a column", f.Op)
+	}
+	if cond == ConditionIsNull || cond == ConditionIsNotNull {
+		return Where(f.Column, cond, nil), nil
+	}
+	if f.Value == nil {
+		return nil, fmt.Errorf("filter on %s needs a value", f.Column)
+	}
+	dec := json.NewDecoder(bytes.NewReader(f.Value))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("filter on %s: %w", f.Column, err)
+	}
+	return Where(f.Column, cond, jsonFilterValue(v)), nil
+}
+
+// jsonFilterValue converts decoded JSON numbers to int64 or float64.
+func jsonFilterValue(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = jsonFilterValue(v[i])
+		}
+	}
+	return v
+}
+
+// lookupName returns the key of names whose value is name.
+func lookupName[K comparable](names map[K]string, name string) (K, bool) {
+	for k, n := range names {
+		if n == name {
+			return k, true
+		}
+	}
+	var zero K
+	return zero, false
+}
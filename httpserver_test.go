@@ -0,0 +1,128 @@
+package querystore
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	cs := newTestStore(t)
+	server := httptest.NewServer(HTTPHandler(cs))
+	defer server.Close()
+	post := func(path, body string) (int, string) {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Trailer.Get("Querystore-Error"))
+		return resp.StatusCode, string(b)
+	}
+
+	code, body := post("/append", `{"region":"us","latency":100,"status":"ok"}
+{"region":"eu","latency":300,"status":"error"}
+{"region":"us","latency":500,"status":"error"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"appended":3}`, body)
+
+	code, body = post("/query", `{"select":["region","latency"],"where":{"and":[
+		{"column":"status","op":"=","value":"error"},
+		{"not":{"column":"latency","op":"in","value":[300]}}]}}`)
+	assert.Equal(t, http.StatusOK, code)
+	var rows []map[string]any
+	require.NoError(t, json.Unmarshal([]byte(body), &rows))
+	require.Len(t, rows, 1)
+	assert.Equal(t, "us", rows[0]["region"])
+	assert.Equal(t, 500.0, rows[0]["latency"])
+	assert.Equal(t, 2.0, rows[0][IndexColumn])
+
+	code, body = post("/query", `{"aggregations":[{"op":"count"},{"op":"avg","column":"latency","as":"mean"}],
+		"group_by":"region","order_by":[{"column":"count","desc":true}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[{"region":"us","count":2,"mean":300},{"region":"eu","count":1,"mean":300}]`, body)
+
+	code, body = post("/query", `{"where":{"column":"region","op":"is null"}}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[]`, body)
+
+	for _, q := range []string{`{"limit":-1}`, `{"where":{"column":"a","op":"~","value":1}}`, `{"where":{"op":"="}}`, `{"selct":["a"]}`, `{"aggregations":[{"op":"median"}]}`} {
+		code, body = post("/query", q)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+		assert.Contains(t, body, `"error"`, q)
+	}
+	for _, q := range []string{
+		`{"where":{"column":"latency","op":">","value":"slow"}}`,
+		`{"where":{"column":"region","op":"matches","value":"("}}`,
+		`{"computed":[{"name":"x","expr":"latency +"}]}`,
+		`{"aggregations":[{"op":"sum","column":"region"}]}`,
+	} {
+		code, body = post("/query", q)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+		assert.Contains(t, body, `"error"`, q)
+	}
+	code, _ = post("/append", `{"region":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	resp, err := http.Get(server.URL + "/schema")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var schema struct {
+		Columns []struct {
+			Name  string
+			Type  string
+			Count int64
+		}
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&schema))
+	require.Len(t, schema.Columns, 3)
+	assert.Equal(t, "latency", schema.Columns[0].Name)
+	assert.Equal(t, "int64", schema.Columns[0].Type)
+	assert.Equal(t, int64(3), schema.Columns[0].Count)
+}
+
+func TestHTTPQueryFailure(t *testing.T) {
+	// Queries failing to read the store are not the client's error.
+	cs := newTestStore(t)
+	require.NoError(t, cs.Append(map[string]any{"latency": 100}))
+	files, err := filepath.Glob(filepath.Join(cs.fs.dir, "latency.*"))
+	require.NoError(t, err)
+	for _, f := range files {
+		require.NoError(t, os.Truncate(f, 0))
+	}
+	server := httptest.NewServer(HTTPHandler(cs))
+	defer server.Close()
+	resp, err := http.Post(server.URL+"/query", "application/json", strings.NewReader(`{"aggregations":[{"op":"sum","column":"latency"}]}`))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, string(body))
+}
+
+func TestHTTPAppendColumnName(t *testing.T) {
+	// Column names cannot reach outside the store directory.
+	parent := t.TempDir()
+	fs, err := OpenColumnFS(filepath.Join(parent, "store"))
+	require.NoError(t, err)
+	defer fs.Close()
+	server := httptest.NewServer(HTTPHandler(NewColumnarStore(fs)))
+	defer server.Close()
+	for _, body := range []string{`{"../escaped":1}`, `{"":1}`} {
+		resp, err := http.Post(server.URL+"/append", "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	escaped, err := filepath.Glob(filepath.Join(parent, "escaped*"))
+	require.NoError(t, err)
+	assert.Empty(t, escaped)
+}
@@ -0,0 +1,399 @@
+package querystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"time"
+)
+
+// An increment holds rows of a store in a compact binary form, for copying
+// rows appended since an earlier export to another store:
+//
+//	magic [4]byte | rows... | [deleted rows] | 0 | row count uvarint |
+//	CRC-32 uint32
+//
+// where each row is
+//
+//	1 | index delta uvarint | timestamp delta varint | field count uvarint |
+//	fields...
+//
+// and each field is its name as a uvarint length and bytes, its ColumnType as
+// a byte, and its value. Index deltas count the rows skipped since the
+// previous row, or give the index of the first row. Timestamps are deltas
+// from the previous row's. The rows the store had deleted follow, if any, as
+//
+//	2 | count uvarint | index deltas uvarint...
+//
+// with index deltas counted in the same way. The CRC-32 covers everything
+// before it.
+var incrementMagic = [4]byte{'Q', 'S', 'I', 'N'}
+
+// ExportIncrement writes the rows from index start on to w as an increment,
+// returning the index to start the next increment from. Deleted rows are
+// left out, and every row the store has deleted, including rows before
+// start and rows superseded by upserts, is listed for ImportIncrement to
+// delete.
+func (s *ColumnarStore) ExportIncrement(w io.Writer, start int64) (int64, error) {
+	s.fs.lock.Lock()
+	if err := s.fs.flushBuffer(); err != nil {
+		s.fs.lock.Unlock()
+		return 0, err
+	}
+	var r TimeRange
+	ts, ok, err := s.fs.rowTimestamp(start)
+	if ok {
+		// Earlier rows stamped at the same time are skipped by index.
+		r.Start = time.Unix(0, ts)
+	}
+	s.fs.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return s.exportIncrement(w, start, r)
+}
+
+// ExportIncrementSince is ExportIncrement for the rows appended at or after t.
+func (s *ColumnarStore) ExportIncrementSince(w io.Writer, t time.Time) (int64, error) {
+	return s.exportIncrement(w, 0, TimeRange{Start: t})
+}
+
+func (s *ColumnarStore) exportIncrement(w io.Writer, start int64, r TimeRange) (int64, error) {
+	// Rows the query does not return before end were deleted.
+	end := s.fs.appendStatus().Rows
+	it, err := s.QueryIter(&Query{Select: []string{"*"}, TimeRange: r, ReuseRows: true})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	bw.Write(incrementMagic[:])
+	var buf []byte
+	var rows uint64
+	next, prevTs := start, int64(0)
+	first := true
+	for it.Next() {
+		row := it.Row()
+		index, ts := row[IndexColumn].(int64), row[TimestampColumn].(int64)
+		if index < start {
+			continue
+		}
+		delta := index - next
+		if first {
+			delta, first = index, false
+		}
+		buf = append(buf[:0], 1)
+		buf = binary.AppendUvarint(buf, uint64(delta))
+		buf = binary.AppendVarint(buf, ts-prevTs)
+		fields := 0
+		for name, v := range row {
+			if v != nil && name != IndexColumn && name != TimestampColumn {
+				fields++
+			}
+		}
+		buf = binary.AppendUvarint(buf, uint64(fields))
+		for name, v := range row {
+			if v == nil || name == IndexColumn || name == TimestampColumn {
+				continue
+			}
+			buf = binary.AppendUvarint(buf, uint64(len(name)))
+			buf = append(buf, name...)
+			buf = appendIncrementValue(buf, v)
+		}
+		if _, err := bw.Write(buf); err != nil {
+			return 0, err
+		}
+		next, prevTs = index+1, ts
+		rows++
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	next = max(next, end)
+	if deleted := s.fs.deletedRows(next); len(deleted) > 0 {
+		buf = binary.AppendUvarint(append(buf[:0], 2), uint64(len(deleted)))
+		prev := int64(0)
+		for _, row := range deleted {
+			buf = binary.AppendUvarint(buf, uint64(row-prev))
+			prev = row + 1
+		}
+		bw.Write(buf)
+	}
+	buf = binary.AppendUvarint(append(buf[:0], 0), rows)
+	bw.Write(buf)
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	_, err = w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return next, err
+}
+
+// rowTimestamp returns the timestamp of a row, if the store holds it. The
+// caller must hold fs.lock.
+func (fs *ColumnFS) rowTimestamp(row int64) (int64, bool, error) {
+	if fs.partitioning == PartitionNone {
+		if row < 0 || row >= fs.nextID {
+			return 0, false, nil
+		}
+		ts, err := fs.timestampAt(row)
+		return ts, err == nil, err
+	}
+	for _, p := range fs.partitions {
+		if row >= p.base && row < p.base+p.fs.nextID {
+			p.fs.lock.Lock()
+			defer p.fs.lock.Unlock()
+			return p.fs.rowTimestamp(row - p.base)
+		}
+	}
+	return 0, false, nil
+}
+
+func appendIncrementValue(dst []byte, v any) []byte {
+	typ := valueColumnType(v)
+	dst = append(dst, byte(typ))
+	switch typ {
+	case ColumnTypeBool:
+		if v.(bool) {
+			return append(dst, 1)
+		}
+		return append(dst, 0)
+	case ColumnTypeInt64:
+		return binary.AppendVarint(dst, valueToInt64(v))
+	case ColumnTypeUint64:
+		return binary.AppendUvarint(dst, valueToUint64(v))
+	case ColumnTypeFloat64:
+		return binary.LittleEndian.AppendUint64(dst, math.Float64bits(valueToFloat64(v)))
+	case ColumnTypeTime:
+		return binary.AppendVarint(dst, valueToTime(v).UnixNano())
+	case ColumnTypeJSON:
+		b := encodeJSONValue(v)
+		return append(binary.AppendUvarint(dst, uint64(len(b))), b...)
+	default:
+		s := valueToString(v)
+		return append(binary.AppendUvarint(dst, uint64(len(s))), s...)
+	}
+}
+
+// crcReader reads bytes, adding them to a checksum.
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	return n, err
+}
+
+func (r *crcReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// incrementRow is a row read from an increment.
+type incrementRow struct {
+	index, ts int64
+	fields    map[string]any
+}
+
+// ImportIncrement appends the rows of an increment written by
+// ExportIncrement, returning how many were appended. Rows keep their index
+// and timestamp: rows the store already holds are skipped, and rows missing
+// from the increment before one it holds are appended and deleted. Rows the
+// increment lists as deleted are deleted, those the store does not hold yet
+// being appended first. The increment is read in full before any row is
+// appended, and its rows are appended together.
+func (s *ColumnarStore) ImportIncrement(r io.Reader) (int64, error) {
+	rows, deletions, err := readIncrement(r)
+	if err != nil {
+		return 0, err
+	}
+	fs := s.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	var imported int64
+	var deleted []int64
+	for i := 0; i < len(rows); {
+		row := rows[i]
+		if row.index < fs.nextID {
+			i++
+			continue
+		}
+		batch := []map[string]any{}
+		for fs.nextID+int64(len(batch)) < row.index {
+			deleted = append(deleted, fs.nextID+int64(len(batch)))
+			batch = append(batch, map[string]any{})
+		}
+		// Consecutive rows with the same timestamp are written together.
+		for ; i < len(rows) && rows[i].ts == row.ts && rows[i].index == fs.nextID+int64(len(batch)); i++ {
+			batch = append(batch, rows[i].fields)
+			imported++
+		}
+		if err := fs.writeAt(batch, max(row.ts, fs.lastTimestamp)); err != nil {
+			return imported, err
+		}
+	}
+	if n := len(deletions); n > 0 && deletions[n-1] >= fs.nextID {
+		batch := make([]map[string]any, deletions[n-1]+1-fs.nextID)
+		for i := range batch {
+			deleted = append(deleted, fs.nextID+int64(i))
+			batch[i] = map[string]any{}
+		}
+		if err := fs.writeAt(batch, fs.lastTimestamp); err != nil {
+			return imported, err
+		}
+	}
+	_, err = fs.tombstoneRows(append(deleted, deletions...))
+	return imported, err
+}
+
+// readIncrement reads the rows of an increment, and the rows it lists as
+// deleted, in order.
+func readIncrement(r io.Reader) ([]incrementRow, []int64, error) {
+	cr := &crcReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	var magic [4]byte
+	if _, err := io.ReadFull(cr, magic[:]); err != nil {
+		return nil, nil, err
+	}
+	if magic != incrementMagic {
+		return nil, nil, errors.New("not an increment")
+	}
+	var rows []incrementRow
+	var deleted []int64
+	next, ts := int64(0), int64(0)
+	for {
+		marker, err := cr.ReadByte()
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		if marker == 0 {
+			break
+		}
+		if marker == 2 {
+			if deleted, err = readIncrementDeleted(cr); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		delta, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		tsDelta, err := binary.ReadVarint(cr)
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		n, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, nil, unexpectedEOF(err)
+		}
+		row := incrementRow{index: next + int64(delta), ts: ts + tsDelta, fields: make(map[string]any, n)}
+		for range n {
+			name, err := readIncrementBytes(cr)
+			if err != nil {
+				return nil, nil, err
+			}
+			if row.fields[string(name)], err = readIncrementValue(cr); err != nil {
+				return nil, nil, err
+			}
+		}
+		rows = append(rows, row)
+		next, ts = row.index+1, row.ts
+	}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	sum := cr.crc.Sum32()
+	var b [4]byte
+	if _, err := io.ReadFull(cr.r, b[:]); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	if count != uint64(len(rows)) || binary.LittleEndian.Uint32(b[:]) != sum {
+		return nil, nil, errors.New("increment is corrupt")
+	}
+	return rows, deleted, nil
+}
+
+// readIncrementDeleted reads the rows an increment lists as deleted.
+func readIncrementDeleted(r *crcReader) ([]int64, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var rows []int64
+	next := int64(0)
+	for range n {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		rows = append(rows, next+int64(delta))
+		next = rows[len(rows)-1] + 1
+	}
+	return rows, nil
+}
+
+func readIncrementBytes(r *crcReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+func readIncrementValue(r *crcReader) (any, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	switch ColumnType(typ) {
+	case ColumnTypeBool:
+		b, err := r.ReadByte()
+		return b == 1, unexpectedEOF(err)
+	case ColumnTypeInt64:
+		v, err := binary.ReadVarint(r)
+		return v, unexpectedEOF(err)
+	case ColumnTypeUint64:
+		v, err := binary.ReadUvarint(r)
+		return v, unexpectedEOF(err)
+	case ColumnTypeFloat64:
+		var b [8]byte
+		_, err := io.ReadFull(r, b[:])
+		return math.Float64frombits(binary.LittleEndian.Uint64(b[:])), unexpectedEOF(err)
+	case ColumnTypeTime:
+		v, err := binary.ReadVarint(r)
+		return time.Unix(0, v).UTC(), unexpectedEOF(err)
+	case ColumnTypeJSON:
+		b, err := readIncrementBytes(r)
+		return json.RawMessage(b), err
+	case ColumnTypeString:
+		b, err := readIncrementBytes(r)
+		return string(b), err
+	}
+	return nil, fmt.Errorf("increment holds a value of unknown type %d", typ)
+}
+
+// unexpectedEOF reports an increment that ends early as io.ErrUnexpectedEOF.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
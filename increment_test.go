@@ -0,0 +1,77 @@
+package querystore
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncrements(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	opts := Options{Clock: func() time.Time { return now }}
+	src, err := OpenColumnFSWithOptions(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer src.Close()
+	dst, err := OpenColumnFSWithOptions(t.TempDir(), opts)
+	require.NoError(t, err)
+	defer dst.Close()
+	from, to := NewColumnarStore(src), NewColumnarStore(dst)
+
+	appendRows := func(n int) {
+		for i := range n {
+			require.NoError(t, from.Append(map[string]any{
+				"n": i, "ok": i%2 == 0, "f": float64(i) / 2, "s": strconv.Itoa(i), "u": uint64(i),
+				"at": now, "doc": map[string]any{"i": i},
+			}))
+			now = now.Add(time.Second)
+		}
+	}
+	all := func(cs *ColumnarStore) []map[string]any {
+		rows, err := cs.Query(&Query{Select: []string{"*"}})
+		require.NoError(t, err)
+		return rows
+	}
+	replicate := func(start int64) (int64, int64) {
+		var buf bytes.Buffer
+		next, err := from.ExportIncrement(&buf, start)
+		require.NoError(t, err)
+		n, err := to.ImportIncrement(&buf)
+		require.NoError(t, err)
+		return next, n
+	}
+
+	appendRows(5)
+	_, err = from.Delete(&Query{Where: Where("n", ConditionEquals, 1)})
+	require.NoError(t, err)
+	next, n := replicate(0)
+	assert.Equal(t, int64(5), next)
+	assert.Equal(t, int64(4), n)
+	assert.Equal(t, all(from), all(to))
+
+	// Later increments only hold new rows, and rows already imported are
+	// skipped.
+	appendRows(3)
+	_, err = from.Delete(&Query{Where: Where("n", ConditionEquals, 0), TimeRange: TimeRange{Start: now.Add(-3 * time.Second)}})
+	require.NoError(t, err)
+	next, n = replicate(next)
+	assert.Equal(t, int64(8), next)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, all(from), all(to))
+	_, n = replicate(0)
+	assert.Zero(t, n)
+
+	var buf bytes.Buffer
+	_, err = from.ExportIncrementSince(&buf, now.Add(-2*time.Second))
+	require.NoError(t, err)
+	data := buf.Bytes()
+	data[len(data)-5] ^= 1
+	_, err = to.ImportIncrement(bytes.NewReader(data))
+	assert.ErrorContains(t, err, "corrupt")
+	_, err = to.ImportIncrement(bytes.NewReader(data[:len(data)/2]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
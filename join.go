@@ -0,0 +1,167 @@
+package querystore
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+)
+
+// JoinType selects which rows of the left side of a join are returned.
+type JoinType int
+
+const (
+	// JoinInner returns left rows paired with each matching right row.
+	JoinInner JoinType = iota
+	// JoinLeft also returns left rows without a match, with nil right
+	// columns.
+	JoinLeft
+)
+
+// Join describes a hash join of the rows of a store with those of another,
+// on equal values of a column of each, such as events.user_id = users.id.
+type Join struct {
+	// Right is the store joined with, typically a dimension table. Its
+	// matching rows are held in memory.
+	Right *ColumnarStore
+	// Query selects and filters the rows of Right; nil joins every row. Its
+	// order, limit and offset are ignored.
+	Query *Query
+	// LeftKey and RightKey name the columns whose values are joined on. Rows
+	// without a key never match.
+	LeftKey  string
+	RightKey string
+	// Prefix is prepended to the names of the right columns in joined rows.
+	// Left columns take precedence over right columns of the same name.
+	Prefix string
+	Type   JoinType
+}
+
+// jsonJoinKey is the hash key of a JSON value, which maps cannot hold.
+type jsonJoinKey string
+
+// joinKey returns the hash key of a join column value, or nil if the value
+// never matches. Unsigned integers that fit match signed ones, and JSON
+// values match by their encoding.
+func joinKey(v any) any {
+	switch k := v.(type) {
+	case nil:
+		return nil
+	case uint64:
+		if int64(k) >= 0 {
+			return int64(k)
+		}
+		return k
+	case []any, map[string]any:
+		return jsonJoinKey(encodeJSONValue(k))
+	}
+	return v
+}
+
+// joinSelect returns the columns to select from one side of a join, which
+// include its key. Joins select every column by default.
+func joinSelect(sel []string, key string) (cols []string, added bool) {
+	if len(sel) == 0 || slices.Contains(sel, "*") {
+		return []string{"*"}, false
+	}
+	if slices.Contains(sel, key) {
+		return sel, false
+	}
+	return append(slices.Clone(sel), key), true
+}
+
+// QueryJoin runs a row query and joins its rows with those of another store.
+// The rows of j.Right are read first and hashed by their key, then the rows
+// of q are streamed past them. Joined rows keep the index and timestamp of
+// their left row, and are ordered and limited as q specifies; OrderBy may
+// name right columns with their prefix.
+func (s *ColumnarStore) QueryJoin(q *Query, j *Join) ([]map[string]any, error) {
+	return s.QueryJoinContext(context.Background(), q, j)
+}
+
+// QueryJoinContext is QueryJoin with a context.
+func (s *ColumnarStore) QueryJoinContext(ctx context.Context, q *Query, j *Join) ([]map[string]any, error) {
+	if j.Right == nil || j.LeftKey == "" || j.RightKey == "" {
+		return nil, errors.New("join needs a right store and a key column on each side")
+	}
+	rq := Query{}
+	if j.Query != nil {
+		rq = *j.Query
+	}
+	if len(q.aggregations()) > 0 || len(rq.aggregations()) > 0 {
+		return nil, errors.New("joined queries cannot aggregate")
+	}
+	rq.Select, _ = joinSelect(rq.Select, j.RightKey)
+	rq.OrderBy, rq.Limit, rq.Offset, rq.ReuseRows = nil, 0, 0, false
+	right, err := j.Right.QueryContext(ctx, &rq)
+	if err != nil {
+		return nil, err
+	}
+	table := map[any][]map[string]any{}
+	var rightCols []string
+	for _, row := range right {
+		k := joinKey(row[j.RightKey])
+		if k == nil {
+			continue
+		}
+		delete(row, IndexColumn)
+		delete(row, TimestampColumn)
+		for col := range row {
+			if !slices.Contains(rightCols, col) {
+				rightCols = append(rightCols, col)
+			}
+		}
+		table[k] = append(table[k], row)
+	}
+
+	lq := *q
+	var dropKey bool
+	lq.Select, dropKey = joinSelect(q.Select, j.LeftKey)
+	lq.OrderBy, lq.Limit, lq.Offset, lq.ReuseRows = nil, 0, 0, false
+	it, err := s.QueryIterContext(ctx, &lq)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	rows := []map[string]any{}
+	// Without an order, the scan stops once the requested rows are joined.
+	done := func() bool {
+		return len(q.OrderBy) == 0 && q.Limit > 0 && len(rows) >= q.Offset+q.Limit
+	}
+	for !done() && it.Next() {
+		row := it.Row()
+		matches := table[joinKey(row[j.LeftKey])]
+		if dropKey {
+			delete(row, j.LeftKey)
+		}
+		if len(matches) == 0 {
+			if j.Type == JoinLeft {
+				for _, col := range rightCols {
+					if _, ok := row[j.Prefix+col]; !ok {
+						row[j.Prefix+col] = nil
+					}
+				}
+				rows = append(rows, row)
+			}
+			continue
+		}
+		for i, m := range matches {
+			out := row
+			if i < len(matches)-1 {
+				out = maps.Clone(row)
+			}
+			for col, v := range m {
+				if _, ok := out[j.Prefix+col]; !ok {
+					out[j.Prefix+col] = v
+				}
+			}
+			rows = append(rows, out)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	q.sortRows(rows)
+	return q.paginate(rows), nil
+}
@@ -0,0 +1,54 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryJoin(t *testing.T) {
+	events, users := newTestStore(t), newTestStore(t)
+	require.NoError(t, users.AppendBatch([]map[string]any{
+		{"id": int64(1), "name": "ann", "plan": "pro"},
+		{"id": int64(2), "name": "bob", "plan": "free"},
+		{"id": int64(3), "name": "cy", "plan": "pro"},
+	}))
+	var rows []map[string]any
+	for i := range 100 {
+		rows = append(rows, map[string]any{"user_id": int64(i%4 + 1), "name": "click", "val": int64(i)})
+	}
+	require.NoError(t, events.AppendBatch(rows))
+
+	j := &Join{Right: users, LeftKey: "user_id", RightKey: "id", Prefix: "user."}
+	res, err := events.QueryJoin(&Query{Select: []string{"val"}, OrderBy: []Order{{Attribute: "val", Descending: true}}, Limit: 3}, j)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	// Event 99 is of user 4, who is not in the users store.
+	assert.Equal(t, int64(98), res[0]["val"])
+	assert.Equal(t, "cy", res[0]["user.name"])
+	assert.Equal(t, "pro", res[0]["user.plan"])
+	assert.NotContains(t, res[0], "user_id")
+
+	j.Query = &Query{Filters: []Filter{{Attribute: "plan", Condition: ConditionEquals, Value: "pro"}}}
+	res, err = events.QueryJoin(&Query{}, j)
+	require.NoError(t, err)
+	assert.Len(t, res, 50)
+	for _, row := range res {
+		assert.Equal(t, "click", row["name"])
+		assert.Contains(t, []any{"ann", "cy"}, row["user.name"])
+		assert.Equal(t, row["user_id"], row["user.id"])
+	}
+
+	j.Type, j.Prefix = JoinLeft, ""
+	res, err = events.QueryJoin(&Query{Limit: 10}, j)
+	require.NoError(t, err)
+	require.Len(t, res, 10)
+	assert.Equal(t, "click", res[0]["name"], "left columns take precedence")
+	assert.Equal(t, "pro", res[0]["plan"])
+	assert.Nil(t, res[1]["plan"])
+	assert.Contains(t, res[1], "plan")
+
+	_, err = events.QueryJoin(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}}, j)
+	assert.ErrorContains(t, err, "cannot aggregate")
+}
@@ -0,0 +1,100 @@
+package querystore
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// isJSONValue reports whether v is a nested value stored in a JSON column:
+// a map, slice, array or struct.
+func isJSONValue(v any) bool {
+	if v == nil {
+		return false
+	}
+	switch reflect.TypeOf(v).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+func encodeJSONValue(v any) []byte {
+	if raw, ok := v.(json.RawMessage); ok {
+		return raw
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		// Values that cannot be represented in JSON are stored as null.
+		return []byte("null")
+	}
+	return b
+}
+
+func decodeJSONValue(b []byte) any {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil
+	}
+	return v
+}
+
+// jsonPath extracts the value at a path of object keys, or nil if the path
+// does not exist.
+func jsonPath(v any, path []string) any {
+	for _, key := range path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// resolveJSONPath splits a dotted attribute such as "payload.user.id" into a
+// JSON column and the path within it, using the longest matching column.
+func (fs *ColumnFS) resolveJSONPath(attribute string) (string, []string, bool) {
+	col := attribute
+	for {
+		var ok bool
+		if col, _, ok = cutLast(col, "."); !ok {
+			return "", nil, false
+		}
+		if ch := fs.columnHandles[col]; ch != nil && ch.typ == ColumnTypeJSON {
+			path := strings.Split(strings.TrimPrefix(attribute, col+"."), ".")
+			return col, path, true
+		}
+	}
+}
+
+// pathReader reads a value nested within a JSON column.
+type pathReader struct {
+	cr   *ColumnReader
+	path []string
+}
+
+func (pr *pathReader) SeekToIndex(index int64) (any, error) {
+	v, err := pr.cr.SeekToIndex(index)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	return normalizeJSONScalar(jsonPath(v, pr.path)), nil
+}
+
+func (pr *pathReader) nextIndex(i int64) int64 {
+	return pr.cr.nextIndex(i)
+}
+
+func (pr *pathReader) Close() error {
+	return pr.cr.Close()
+}
+
+// normalizeJSONScalar maps integral JSON numbers to int64 so they compare
+// like integer columns.
+func normalizeJSONScalar(v any) any {
+	if f, ok := v.(float64); ok && f == float64(int64(f)) {
+		return int64(f)
+	}
+	return v
+}
@@ -0,0 +1,37 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONColumn(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"payload": map[string]any{"user": map[string]any{"id": 7, "name": "ann"}, "tags": []string{"a"}}}))
+	require.NoError(t, cs.Append(map[string]any{"payload": map[string]any{"user": map[string]any{"id": 9}}}))
+	require.NoError(t, cs.Append(map[string]any{"payload": map[string]any{"user": "anonymous"}}))
+
+	rows, err := cs.Query(&Query{
+		Select: []string{"payload.user.name"},
+		Where:  Where("payload.user.id", ConditionLessThan, 8),
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "ann", rows[0]["payload.user.name"])
+
+	rows, err = cs.Query(&Query{Where: Where("payload.user", ConditionEquals, "anonymous")})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(2), rows[0][IndexColumn])
+
+	rows, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "payload.user.id"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(16), rows[0]["sum(payload.user.id)"])
+
+	rows, err = cs.Query(&Query{Select: []string{"payload"}, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"a"}, rows[0]["payload"].(map[string]any)["tags"])
+}
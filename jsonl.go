@@ -0,0 +1,204 @@
+package querystore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ReadJSONL appends the objects of newline-delimited JSON input as rows, a
+// batch at a time, returning the number of rows appended. Nested objects and
+// arrays are stored as JSON values and nulls leave the column without a
+// value. Numbers are stored as int64 unless a column already holds another
+// numeric type, or some number of the batch has a fraction. Fields whose
+// names start with "__", such as those WriteJSONL writes, are skipped. Blank
+// lines are ignored, and the first invalid line ends the import.
+func (s *ColumnarStore) ReadJSONL(r io.Reader) (int64, error) {
+	types, err := s.fs.columnTypes()
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(r)
+	var imported int64
+	var pending []jsonlRecord
+	flush := func() error {
+		rows, err := jsonlRows(types, pending)
+		if err != nil {
+			return err
+		}
+		pending = pending[:0]
+		if err := s.AppendBatch(rows); err != nil {
+			return err
+		}
+		imported += int64(len(rows))
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return imported, err
+		}
+		if b = bytes.TrimSpace(b); len(b) > 0 {
+			rec, perr := parseJSONLRecord(line, b)
+			if perr != nil {
+				return imported, perr
+			}
+			pending = append(pending, rec)
+			if len(pending) == defaultImportBatchSize {
+				if err := flush(); err != nil {
+					return imported, err
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	if len(pending) > 0 {
+		if err := flush(); err != nil {
+			return imported, err
+		}
+	}
+	return imported, nil
+}
+
+// jsonlRecord is an object read from JSONL input. Its numbers are kept as
+// json.Number until the types of their columns are known.
+type jsonlRecord struct {
+	line   int
+	fields map[string]any
+}
+
+func parseJSONLRecord(line int, b []byte) (jsonlRecord, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return jsonlRecord{}, fmt.Errorf("jsonl line %d: %w", line, err)
+	}
+	rec := jsonlRecord{line: line, fields: make(map[string]any, len(raw))}
+	for name, v := range raw {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		switch v[0] {
+		case 'n':
+			continue
+		case '{', '[':
+			rec.fields[name] = v
+			continue
+		}
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		var value any
+		if err := d.Decode(&value); err != nil {
+			return jsonlRecord{}, fmt.Errorf("jsonl line %d: %w", line, err)
+		}
+		rec.fields[name] = value
+	}
+	return rec, nil
+}
+
+// row converts the record's values to the types of their columns.
+func (rec jsonlRecord) row(types map[string]ColumnType) (map[string]any, error) {
+	row := make(map[string]any, len(rec.fields))
+	for name, v := range rec.fields {
+		typ := types[name]
+		var err error
+		switch v := v.(type) {
+		case json.Number:
+			row[name], err = parseTextValue(v.String(), typ)
+		case string:
+			if typ == ColumnTypeJSON {
+				row[name] = v
+			} else {
+				row[name], err = parseTextValue(v, typ)
+			}
+		default:
+			row[name] = v
+			if typ != ColumnTypeJSON && !valueFitsColumnType(v, typ) {
+				err = fmt.Errorf("cannot store %T in a %s column", v, typ)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jsonl line %d, column %s: %w", rec.line, name, err)
+		}
+	}
+	return row, nil
+}
+
+// jsonlRows converts records to rows, inferring the types of the columns
+// types lacks.
+func jsonlRows(types map[string]ColumnType, records []jsonlRecord) ([]map[string]any, error) {
+	inferJSONLTypes(types, records)
+	rows := make([]map[string]any, 0, len(records))
+	for _, rec := range records {
+		row, err := rec.row(types)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// inferJSONLTypes infers the types of the columns without one from the values
+// of the records.
+func inferJSONLTypes(types map[string]ColumnType, records []jsonlRecord) {
+	inferred := map[string]ColumnType{}
+	for _, rec := range records {
+		for name, v := range rec.fields {
+			if _, ok := types[name]; ok {
+				continue
+			}
+			typ, seen := inferred[name]
+			switch v := v.(type) {
+			case json.Number:
+				if _, err := v.Int64(); err != nil {
+					inferred[name] = ColumnTypeFloat64
+				} else if !seen {
+					inferred[name] = ColumnTypeInt64
+				}
+			case json.RawMessage:
+				inferred[name] = ColumnTypeJSON
+			default:
+				if !seen || typ == ColumnTypeInt64 || typ == ColumnTypeFloat64 {
+					inferred[name] = valueColumnType(v)
+				}
+			}
+		}
+	}
+	for name, typ := range inferred {
+		types[name] = typ
+	}
+}
+
+// WriteJSONL writes the results of a query to w as newline-delimited JSON,
+// one object per row, streaming them when the query allows. A nil query
+// writes every row with every column.
+func (s *ColumnarStore) WriteJSONL(w io.Writer, q *Query) error {
+	if q == nil {
+		q = &Query{Select: []string{"*"}}
+	}
+	qc := *q
+	qc.ReuseRows = true
+	it, err := s.QueryIter(&qc)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	for it.Next() {
+		if err := enc.Encode(it.Row()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
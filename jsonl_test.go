@@ -0,0 +1,57 @@
+package querystore
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONL(t *testing.T) {
+	cs := newTestStore(t)
+	input := `{"name": "a", "n": 1, "score": 1, "ok": true, "meta": {"k": [1, 2]}}
+
+{"name": "b", "n": 2, "score": 2.5, "ok": null, "__index": 7}
+{"name": "c", "n": 3, "score": 3}
+`
+	n, err := cs.ReadJSONL(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	rows, err := cs.Query(&Query{Select: []string{"name", "n", "score", "ok", "meta.k"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	assert.Equal(t, int64(1), rows[0]["n"])
+	assert.Equal(t, 1.0, rows[0]["score"])
+	assert.Equal(t, 2.5, rows[1]["score"])
+	assert.Equal(t, true, rows[0]["ok"])
+	assert.Nil(t, rows[1]["ok"])
+	assert.Equal(t, int64(1), rows[1][IndexColumn])
+
+	_, err = cs.ReadJSONL(strings.NewReader("{\"n\": 4}\n{\"n\": 4.5}\n"))
+	assert.ErrorContains(t, err, "jsonl line 2, column n")
+	_, err = cs.ReadJSONL(strings.NewReader("{\"n\": 4}\nnot json\n"))
+	assert.ErrorContains(t, err, "jsonl line 2")
+
+	var buf bytes.Buffer
+	require.NoError(t, cs.WriteJSONL(&buf, &Query{Select: []string{"name", "score"}, Limit: 2}))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"__index": 1, "__timestamp": `+strconv.FormatInt(rows[1][TimestampColumn].(int64), 10)+`, "name": "b", "score": 2.5}`, lines[1])
+
+	buf.Reset()
+	require.NoError(t, cs.WriteJSONL(&buf, nil))
+	copied := newTestStore(t)
+	n, err = copied.ReadJSONL(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	got, err := copied.Query(&Query{Select: []string{"name", "n", "score", "ok", "meta.k"}})
+	require.NoError(t, err)
+	for i := range rows {
+		delete(rows[i], TimestampColumn)
+		delete(got[i], TimestampColumn)
+	}
+	assert.Equal(t, rows, got)
+}
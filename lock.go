@@ -0,0 +1,47 @@
+package querystore
+
+import (
+	"errors"
+	"os"
+	"path"
+	"time"
+)
+
+// lockFileName names the file locked by the process that has the store open,
+// so that no other process appends to it at the same time.
+const lockFileName = "__lock"
+
+// lockPollInterval is how often opening retries a lock held elsewhere while
+// waiting for it.
+const lockPollInterval = 10 * time.Millisecond
+
+// ErrStoreLocked is returned when opening a store that another process, or
+// another ColumnFS in this one, has open.
+var ErrStoreLocked = errors.New("store is locked by another writer")
+
+// lockDir takes the lock of a store's directory, waiting up to timeout for it
+// to be released, or indefinitely if timeout is negative. The lock is held
+// until the returned file is closed.
+func lockDir(b ColumnBackend, dir string, timeout time.Duration) (BackendFile, error) {
+	fp, err := b.OpenFile(path.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	osFp, ok := fp.(*os.File)
+	if !ok {
+		// Files of other backends are private to the process.
+		return fp, nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := tryLockFile(osFp)
+		if err == nil {
+			return fp, nil
+		}
+		if err != ErrStoreLocked || timeout >= 0 && !time.Now().Before(deadline) {
+			fp.Close()
+			return nil, err
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
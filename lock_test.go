@@ -0,0 +1,35 @@
+package querystore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreLock(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteColumns(map[string]any{"val": int64(1)}))
+
+	_, err = OpenColumnFS(dir)
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	start := time.Now()
+	_, err = OpenColumnFSWithOptions(dir, Options{LockTimeout: 50 * time.Millisecond})
+	assert.ErrorIs(t, err, ErrStoreLocked)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// A waiting open succeeds once the store is closed.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		fs.Close()
+	}()
+	reopened, err := OpenColumnFSWithOptions(dir, Options{LockTimeout: -1})
+	require.NoError(t, err)
+	defer reopened.Close()
+	res, err := NewColumnarStore(reopened).Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Len(t, res, 1)
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package querystore
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive advisory lock on a file without waiting,
+// returning ErrStoreLocked if it is held.
+func tryLockFile(fp *os.File) error {
+	err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrStoreLocked
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package querystore
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// tryLockFile takes an exclusive lock on the first byte of a file without
+// waiting, returning ErrStoreLocked if it is held.
+func tryLockFile(fp *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(fp.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrStoreLocked
+	}
+	return err
+}
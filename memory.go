@@ -0,0 +1,340 @@
+package querystore
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStoreDir is the directory of stores opened by OpenMemoryStore.
+const memoryStoreDir = "/"
+
+// OpenMemoryStore opens an empty store whose files are held in memory, for
+// tests, ephemeral data, or buffering rows before they are copied to a store
+// on disk. It behaves as a store opened with OpenColumnFSWithOptions, except
+// that its rows are lost when it is no longer used. Memory mapping and
+// durability options have no effect. Wrap it with NewColumnarStore to query
+// it.
+func OpenMemoryStore(opts Options) (*ColumnFS, error) {
+	opts.Backend = newMemoryBackend()
+	opts.MemoryMap = false
+	opts.Durability = DurabilityNone
+	return OpenColumnFSWithOptions(memoryStoreDir, opts)
+}
+
+// memoryBackend stores files in memory. Directories exist once created by
+// MkdirAll or by creating a file in them.
+type memoryBackend struct {
+	mu    sync.Mutex
+	files map[string]*memoryData
+	dirs  map[string]time.Time
+}
+
+// memoryData is the contents of a memory file, shared by its open files.
+type memoryData struct {
+	mu      sync.RWMutex
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemoryBackend returns an empty backend holding files in memory. Stores
+// opened on it see each other's files, as stores in one directory tree do.
+func NewMemoryBackend() ColumnBackend {
+	return newMemoryBackend()
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{files: map[string]*memoryData{}, dirs: map[string]time.Time{"/": time.Now()}}
+}
+
+// clean returns the canonical form of a path.
+func (b *memoryBackend) clean(name string) string {
+	return path.Join("/", name)
+}
+
+// mkdirs creates a directory and its parents. The caller must hold b.mu.
+func (b *memoryBackend) mkdirs(dir string) {
+	for ; dir != "/"; dir = path.Dir(dir) {
+		if _, ok := b.dirs[dir]; ok {
+			return
+		}
+		b.dirs[dir] = time.Now()
+	}
+}
+
+func (b *memoryBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.dirs[name]; ok {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+		}
+		return &memoryFile{b: b, name: name, dir: true}, nil
+	}
+	d := b.files[name]
+	switch {
+	case d != nil && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case d == nil && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case d == nil:
+		d = &memoryData{modTime: time.Now()}
+		b.files[name] = d
+		b.mkdirs(path.Dir(name))
+	}
+	f := &memoryFile{b: b, d: d, name: name, flag: flag}
+	if flag&os.O_TRUNC != 0 {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (b *memoryBackend) Stat(name string) (os.FileInfo, error) {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if t, ok := b.dirs[name]; ok {
+		return memoryFileInfo{name: path.Base(name), modTime: t, dir: true}, nil
+	}
+	d := b.files[name]
+	if d == nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.info(name), nil
+}
+
+func (b *memoryBackend) ReadDir(name string) ([]os.DirEntry, error) {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.dirs[name]; !ok {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	var entries []os.DirEntry
+	for p, d := range b.files {
+		if path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(d.info(p)))
+		}
+	}
+	for p, t := range b.dirs {
+		if p != "/" && path.Dir(p) == name {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryFileInfo{name: path.Base(p), modTime: t, dir: true}))
+		}
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (b *memoryBackend) MkdirAll(name string, perm os.FileMode) error {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.files[name] != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	b.mkdirs(name)
+	return nil
+}
+
+func (b *memoryBackend) Rename(oldname, newname string) error {
+	oldname, newname = b.clean(oldname), b.clean(newname)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := b.files[oldname]
+	if d == nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: fs.ErrNotExist}
+	}
+	delete(b.files, oldname)
+	b.files[newname] = d
+	b.mkdirs(path.Dir(newname))
+	return nil
+}
+
+func (b *memoryBackend) Remove(name string) error {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.files[name] != nil {
+		delete(b.files, name)
+		return nil
+	}
+	if _, ok := b.dirs[name]; !ok || name == "/" {
+		return &os.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	for p := range b.files {
+		if strings.HasPrefix(p, name+"/") {
+			return &os.PathError{Op: "remove", Path: name, Err: fs.ErrExist}
+		}
+	}
+	delete(b.dirs, name)
+	return nil
+}
+
+func (b *memoryBackend) RemoveAll(name string) error {
+	name = b.clean(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, name)
+	if name != "/" {
+		delete(b.dirs, name)
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range b.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(b.files, p)
+		}
+	}
+	for p := range b.dirs {
+		if strings.HasPrefix(p, prefix) {
+			delete(b.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (d *memoryData) info(name string) memoryFileInfo {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return memoryFileInfo{name: path.Base(name), size: int64(len(d.data)), modTime: d.modTime}
+}
+
+// memoryFile is an open file of a memory backend. Files keep their contents
+// after they are removed or renamed over, as open operating system files do.
+type memoryFile struct {
+	b    *memoryBackend
+	d    *memoryData
+	name string
+	flag int
+	dir  bool
+	pos  int64
+}
+
+func (f *memoryFile) Name() string {
+	return f.name
+}
+
+func (f *memoryFile) Stat() (os.FileInfo, error) {
+	if f.dir {
+		return f.b.Stat(f.name)
+	}
+	return f.d.info(f.name), nil
+}
+
+func (f *memoryFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.dir || f.flag&os.O_WRONLY != 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.d.mu.RLock()
+	defer f.d.mu.RUnlock()
+	if off >= int64(len(f.d.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.d.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Write(p []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.d.mu.RLock()
+		f.pos = int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+	n, err := f.WriteAt(p, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.dir || f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.d.data)) {
+		n := len(f.d.data)
+		f.d.data = slices.Grow(f.d.data, int(end)-n)[:end]
+		clear(f.d.data[n:])
+	}
+	copy(f.d.data[off:], p)
+	f.d.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		f.d.mu.RLock()
+		offset += int64(len(f.d.data))
+		f.d.mu.RUnlock()
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if f.dir || f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.d.mu.Lock()
+	defer f.d.mu.Unlock()
+	if size <= int64(len(f.d.data)) {
+		f.d.data = f.d.data[:size]
+	} else {
+		f.d.data = append(f.d.data, make([]byte, size-int64(len(f.d.data)))...)
+	}
+	f.d.modTime = time.Now()
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi memoryFileInfo) Name() string       { return fi.name }
+func (fi memoryFileInfo) Size() int64        { return fi.size }
+func (fi memoryFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi memoryFileInfo) IsDir() bool        { return fi.dir }
+func (fi memoryFileInfo) Sys() any           { return nil }
+
+func (fi memoryFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return filePerm
+}
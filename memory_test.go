@@ -0,0 +1,72 @@
+package querystore
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64, BloomFilterRate: 0.01},
+		{Name: "tag", Type: ColumnTypeString, Encoding: EncodingRLE},
+	}}
+	fs, err := OpenMemoryStore(Options{Schema: schema, Indexes: []string{"val"}, Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	var rows []map[string]any
+	for i := range 10000 {
+		rows = append(rows, map[string]any{"val": int64(i % 100), "tag": []string{"a", "b"}[i/5000]})
+	}
+	require.NoError(t, cs.AppendBatch(rows[:5000]))
+	now = now.Add(time.Hour)
+	require.NoError(t, cs.AppendBatch(rows[5000:]))
+
+	count := func(q *Query) int64 {
+		q.Aggregations = []Aggregation{{Type: AggregatorCount}}
+		res, err := cs.Query(q)
+		require.NoError(t, err)
+		return res[0]["count"].(int64)
+	}
+	assert.Equal(t, int64(10000), count(&Query{}))
+	assert.Equal(t, int64(100), count(&Query{Filters: []Filter{{Attribute: "val", Condition: ConditionEquals, Value: int64(7)}}}))
+	assert.Equal(t, int64(5000), count(&Query{Filters: []Filter{{Attribute: "tag", Condition: ConditionEquals, Value: "b"}}}))
+
+	n, err := fs.PruneBefore(now)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5000), n)
+	require.NoError(t, fs.Compact())
+	assert.Equal(t, int64(5000), count(&Query{}))
+	assert.Equal(t, int64(0), count(&Query{Filters: []Filter{{Attribute: "tag", Condition: ConditionEquals, Value: "a"}}}))
+
+	// Snapshots of memory stores are written to disk.
+	dir := t.TempDir()
+	copied, err := fs.Snapshot(dir)
+	require.NoError(t, err)
+	snap, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	defer snap.Close()
+	res, err := NewColumnarStore(snap).Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Len(t, res, int(copied)-5000)
+
+	partitioned, err := OpenMemoryStore(Options{Partitioning: PartitionHourly, Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer partitioned.Close()
+	require.NoError(t, partitioned.WriteRows(rows[:10]))
+	now = now.Add(time.Hour)
+	require.NoError(t, partitioned.WriteRows(rows[10:20]))
+	assert.Len(t, partitioned.Partitions(), 2)
+	res, err = NewColumnarStore(partitioned).Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Len(t, res, 20)
+
+	_, err = os.Stat("/" + indexFileName)
+	assert.True(t, os.IsNotExist(err), "memory stores write no files")
+}
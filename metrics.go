@@ -0,0 +1,158 @@
+package querystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements of a store's activity, for monitoring
+// embedded stores. See Options.Metrics. Implementations must be safe for
+// concurrent use, and should return quickly, as writes hold the store's lock
+// while they are reported.
+type Metrics interface {
+	// Appended is called after each write, with the rows appended and the
+	// bytes written to their column files.
+	Appended(rows, bytes int64)
+	// Queried is called when each query is closed, or fails to start, with
+	// its latency, the rows it scanned, and the error that ended it, if any.
+	// Rows skipped by indexes or zone maps are not scanned.
+	Queried(latency time.Duration, scanned int64, err error)
+}
+
+// metricsLatencyBuckets are the upper bounds in seconds of the buckets of
+// the query latency histogram of a MetricsCollector.
+var metricsLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+// MetricsCollector is a Metrics counting rows appended, bytes written,
+// queries run and failed, and rows scanned, with a histogram of query
+// latencies. It serves its counts to Prometheus as an http.Handler, and
+// to expvar as an expvar.Var:
+//
+//	metrics := querystore.NewMetricsCollector()
+//	expvar.Publish("querystore", metrics)
+//	http.Handle("/metrics", metrics)
+type MetricsCollector struct {
+	rowsAppended atomic.Int64
+	bytesWritten atomic.Int64
+	queries      atomic.Int64
+	queryErrors  atomic.Int64
+	rowsScanned  atomic.Int64
+
+	mu sync.Mutex
+	// latencies counts the queries in each bucket of metricsLatencyBuckets,
+	// then those slower than every bound.
+	latencies  []int64
+	latencySum time.Duration
+}
+
+func NewMetricsCollector() *MetricsCollector {
+	return &MetricsCollector{latencies: make([]int64, len(metricsLatencyBuckets)+1)}
+}
+
+func (c *MetricsCollector) Appended(rows, bytes int64) {
+	c.rowsAppended.Add(rows)
+	c.bytesWritten.Add(bytes)
+}
+
+func (c *MetricsCollector) Queried(latency time.Duration, scanned int64, err error) {
+	c.queries.Add(1)
+	if err != nil {
+		c.queryErrors.Add(1)
+	}
+	c.rowsScanned.Add(scanned)
+	i := 0
+	for i < len(metricsLatencyBuckets) && latency.Seconds() > metricsLatencyBuckets[i] {
+		i++
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.latencies[i]++
+	c.latencySum += latency
+}
+
+// metricsSnapshot holds the counts of a MetricsCollector, in the form
+// reported to expvar.
+type metricsSnapshot struct {
+	RowsAppended int64 `json:"rows_appended"`
+	BytesWritten int64 `json:"bytes_written"`
+	Queries      int64 `json:"queries"`
+	QueryErrors  int64 `json:"query_errors"`
+	RowsScanned  int64 `json:"rows_scanned"`
+	// LatencyBuckets bounds the buckets counted by Latencies, in seconds.
+	LatencyBuckets    []float64 `json:"latency_buckets"`
+	Latencies         []int64   `json:"latencies"`
+	LatencySumSeconds float64   `json:"latency_sum_seconds"`
+}
+
+func (c *MetricsCollector) snapshot() metricsSnapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return metricsSnapshot{
+		RowsAppended:      c.rowsAppended.Load(),
+		BytesWritten:      c.bytesWritten.Load(),
+		Queries:           c.queries.Load(),
+		QueryErrors:       c.queryErrors.Load(),
+		RowsScanned:       c.rowsScanned.Load(),
+		LatencyBuckets:    metricsLatencyBuckets,
+		Latencies:         append([]int64(nil), c.latencies...),
+		LatencySumSeconds: c.latencySum.Seconds(),
+	}
+}
+
+// String reports the counts as a JSON object, implementing expvar.Var.
+func (c *MetricsCollector) String() string {
+	b, err := json.Marshal(c.snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// WritePrometheus writes the counts in the Prometheus text exposition
+// format.
+func (c *MetricsCollector) WritePrometheus(w io.Writer) error {
+	s := c.snapshot()
+	for _, m := range []struct {
+		name, help string
+		value      int64
+	}{
+		{"querystore_rows_appended_total", "Rows appended.", s.RowsAppended},
+		{"querystore_bytes_written_total", "Bytes written to column files.", s.BytesWritten},
+		{"querystore_queries_total", "Queries run.", s.Queries},
+		{"querystore_query_errors_total", "Queries that failed.", s.QueryErrors},
+		{"querystore_rows_scanned_total", "Rows scanned by queries.", s.RowsScanned},
+	} {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", m.name, m.help, m.name, m.name, m.value); err != nil {
+			return err
+		}
+	}
+	const name = "querystore_query_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Query latency.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	var count int64
+	for i, n := range s.Latencies {
+		count += n
+		le := "+Inf"
+		if i < len(s.LatencyBuckets) {
+			le = strconv.FormatFloat(s.LatencyBuckets[i], 'g', -1, 64)
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, le, count); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(s.LatencySumSeconds, 'g', -1, 64), name, count)
+	return err
+}
+
+// ServeHTTP serves the counts to Prometheus.
+func (c *MetricsCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WritePrometheus(w)
+}
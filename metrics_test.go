@@ -0,0 +1,42 @@
+package querystore
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetricsCollector()
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Metrics: metrics})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i), "name": "n"}))
+	}
+	assert.Equal(t, int64(10), metrics.rowsAppended.Load())
+	assert.Greater(t, metrics.bytesWritten.Load(), int64(160))
+
+	_, err = cs.Query(&Query{Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: int64(5)}}})
+	require.NoError(t, err)
+	_, err = cs.Query(&Query{Computed: []ComputedColumn{{Name: "bad", Expr: "val +"}}})
+	require.Error(t, err)
+	assert.Equal(t, int64(2), metrics.queries.Load())
+	assert.Equal(t, int64(1), metrics.queryErrors.Load())
+	assert.Equal(t, int64(10), metrics.rowsScanned.Load())
+
+	var prom strings.Builder
+	require.NoError(t, metrics.WritePrometheus(&prom))
+	assert.Contains(t, prom.String(), "querystore_rows_appended_total 10\n")
+	assert.Contains(t, prom.String(), "querystore_queries_total 2\n")
+	assert.Contains(t, prom.String(), `querystore_query_duration_seconds_bucket{le="+Inf"} 2`)
+	assert.Contains(t, prom.String(), "querystore_query_duration_seconds_count 2\n")
+
+	var vars map[string]any
+	require.NoError(t, json.Unmarshal([]byte(metrics.String()), &vars))
+	assert.Equal(t, float64(10), vars["rows_scanned"])
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package querystore
+
+import (
+	"os"
+)
+
+func mmap(fp *os.File, size int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return errMmapUnsupported
+}
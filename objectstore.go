@@ -0,0 +1,489 @@
+package querystore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectStore holds immutable objects, such as an S3 or GCS bucket, to which
+// the sealed partitions of a partitioned store are offloaded. See
+// Options.ObjectStore. Implementations adapt a client of the service, and
+// must be safe for concurrent use.
+type ObjectStore interface {
+	// Put creates or replaces an object with size bytes read from r.
+	Put(key string, r io.Reader, size int64) error
+	// GetRange reads n bytes of an object starting at off, as a ranged GET.
+	GetRange(key string, off, n int64) ([]byte, error)
+	// List describes the objects whose keys begin with prefix.
+	List(prefix string) ([]ObjectInfo, error)
+	// Delete deletes an object, succeeding if it does not exist.
+	Delete(key string) error
+}
+
+// ObjectInfo describes an object of an ObjectStore.
+type ObjectInfo struct {
+	Key  string
+	Size int64
+}
+
+// Objects are read in blocks of objectBlockSize bytes, which are cached in
+// memory up to Options.ObjectCacheSize.
+const (
+	objectBlockSize        = 256 << 10
+	defaultObjectCacheSize = 64 << 20
+)
+
+// objectBackend reads the files of a store's offloaded partitions from an
+// object store. Object keys are the paths of files relative to the store's
+// directory, such as "2024-01-02T15/__index.dat". The object store is listed
+// once when the store is opened, so it must not be shared with other stores
+// writing the same keys. Files cannot be written, but RemoveAll deletes
+// their objects.
+type objectBackend struct {
+	store ObjectStore
+	dir   string
+	cache *blockCache
+
+	mu    sync.Mutex
+	sizes map[string]int64
+}
+
+func newObjectBackend(store ObjectStore, dir string, cacheSize int64) (*objectBackend, error) {
+	if cacheSize <= 0 {
+		cacheSize = defaultObjectCacheSize
+	}
+	objects, err := store.List("")
+	if err != nil {
+		return nil, err
+	}
+	b := &objectBackend{store: store, dir: path.Clean(dir), cache: newBlockCache(cacheSize), sizes: map[string]int64{}}
+	for _, o := range objects {
+		b.sizes[o.Key] = o.Size
+	}
+	return b, nil
+}
+
+// key returns the object key of a path.
+func (b *objectBackend) key(name string) string {
+	if name = path.Clean(name); name == b.dir {
+		return ""
+	}
+	return strings.TrimPrefix(name, b.dir+"/")
+}
+
+// partitions returns the directory names of the partitions whose base file
+// has been uploaded, which are uploaded last.
+func (b *objectBackend) partitions() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for key := range b.sizes {
+		if dir, file := path.Split(key); file == partitionBaseFileName {
+			names = append(names, strings.TrimSuffix(dir, "/"))
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// upload uploads the files of a partition's directory from src, its base
+// file last.
+func (b *objectBackend) upload(src ColumnBackend, dir string) error {
+	entries, err := src.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	slices.SortStableFunc(entries, func(x, y os.DirEntry) int {
+		return compareBool(x.Name() == partitionBaseFileName, y.Name() == partitionBaseFileName)
+	})
+	for _, de := range entries {
+		if de.IsDir() || de.Name() == lockFileName {
+			continue
+		}
+		if err := b.put(src, path.Join(dir, de.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *objectBackend) put(src ColumnBackend, name string) error {
+	fp, err := src.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	key := b.key(name)
+	if err := b.store.Put(key, io.NewSectionReader(fp, 0, fi.Size()), fi.Size()); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	b.mu.Lock()
+	b.sizes[key] = fi.Size()
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *objectBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	key := b.key(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_APPEND|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrStoreReadOnly}
+	}
+	fi, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return &objectFile{b: b, key: key, name: name, info: fi.(memoryFileInfo)}, nil
+}
+
+func (b *objectBackend) Stat(name string) (os.FileInfo, error) {
+	key := b.key(name)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if size, ok := b.sizes[key]; ok {
+		return memoryFileInfo{name: path.Base(key), size: size}, nil
+	}
+	for k := range b.sizes {
+		if key == "" || strings.HasPrefix(k, key+"/") {
+			return memoryFileInfo{name: path.Base(name), dir: true}, nil
+		}
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (b *objectBackend) ReadDir(name string) ([]os.DirEntry, error) {
+	key := b.key(name)
+	prefix := key + "/"
+	if key == "" {
+		prefix = ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	found := map[string]os.DirEntry{}
+	for k, size := range b.sizes {
+		rest, ok := strings.CutPrefix(k, prefix)
+		if !ok {
+			continue
+		}
+		if child, _, isDir := strings.Cut(rest, "/"); isDir {
+			found[child] = fs.FileInfoToDirEntry(memoryFileInfo{name: child, dir: true})
+		} else {
+			found[child] = fs.FileInfoToDirEntry(memoryFileInfo{name: child, size: size})
+		}
+	}
+	if len(found) == 0 {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries := make([]os.DirEntry, 0, len(found))
+	for _, de := range found {
+		entries = append(entries, de)
+	}
+	slices.SortFunc(entries, func(x, y os.DirEntry) int { return strings.Compare(x.Name(), y.Name()) })
+	return entries, nil
+}
+
+func (b *objectBackend) MkdirAll(name string, perm os.FileMode) error {
+	return &os.PathError{Op: "mkdir", Path: name, Err: ErrStoreReadOnly}
+}
+
+func (b *objectBackend) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: ErrStoreReadOnly}
+}
+
+func (b *objectBackend) Remove(name string) error {
+	return &os.PathError{Op: "remove", Path: name, Err: ErrStoreReadOnly}
+}
+
+// RemoveAll deletes the objects of the files under a directory. A
+// partition's base file is deleted first, so partitions partly deleted are
+// not found again.
+func (b *objectBackend) RemoveAll(name string) error {
+	key := b.key(name)
+	b.mu.Lock()
+	var keys []string
+	for k := range b.sizes {
+		if k == key || key == "" || strings.HasPrefix(k, key+"/") {
+			keys = append(keys, k)
+		}
+	}
+	b.mu.Unlock()
+	slices.SortStableFunc(keys, func(x, y string) int {
+		return -compareBool(path.Base(x) == partitionBaseFileName, path.Base(y) == partitionBaseFileName)
+	})
+	for _, k := range keys {
+		if err := b.store.Delete(k); err != nil {
+			return fmt.Errorf("deleting %s: %w", k, err)
+		}
+		b.mu.Lock()
+		delete(b.sizes, k)
+		b.mu.Unlock()
+	}
+	return nil
+}
+
+// compareBool orders false before true.
+func compareBool(x, y bool) int {
+	switch {
+	case x == y:
+		return 0
+	case x:
+		return 1
+	}
+	return -1
+}
+
+// objectFile is an open file of an object backend.
+type objectFile struct {
+	b    *objectBackend
+	key  string
+	name string
+	info memoryFileInfo
+	pos  int64
+}
+
+func (f *objectFile) Name() string               { return f.name }
+func (f *objectFile) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *objectFile) Sync() error                { return nil }
+func (f *objectFile) Close() error               { return nil }
+
+func (f *objectFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.pos)
+	f.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt reads the blocks of the object p spans, from the cache if they are
+// held there.
+func (f *objectFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.info.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: fs.ErrInvalid}
+	}
+	n := 0
+	for n < len(p) && off < f.info.size {
+		block := off / objectBlockSize
+		data, err := f.block(block)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-block*objectBlockSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *objectFile) block(i int64) ([]byte, error) {
+	key := blockKey{key: f.key, block: i}
+	if data, ok := f.b.cache.get(key); ok {
+		return data, nil
+	}
+	off := i * objectBlockSize
+	data, err := f.b.store.GetRange(f.key, off, min(objectBlockSize, f.info.size-off))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", f.key, err)
+	}
+	if int64(len(data)) != min(objectBlockSize, f.info.size-off) {
+		return nil, fmt.Errorf("reading %s: %w", f.key, io.ErrUnexpectedEOF)
+	}
+	f.b.cache.put(key, data)
+	return data, nil
+}
+
+func (f *objectFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: fs.ErrInvalid}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *objectFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrStoreReadOnly}
+}
+
+func (f *objectFile) WriteAt(p []byte, off int64) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.name, Err: ErrStoreReadOnly}
+}
+
+func (f *objectFile) Truncate(size int64) error {
+	return &os.PathError{Op: "truncate", Path: f.name, Err: ErrStoreReadOnly}
+}
+
+type blockKey struct {
+	key   string
+	block int64
+}
+
+// blockCache holds the most recently read blocks of objects, up to a total
+// size.
+type blockCache struct {
+	mu      sync.Mutex
+	size    int64
+	maxSize int64
+	order   *list.List
+	blocks  map[blockKey]*list.Element
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(maxSize int64) *blockCache {
+	return &blockCache{maxSize: maxSize, order: list.New(), blocks: map[blockKey]*list.Element{}}
+}
+
+func (c *blockCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.blocks[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedBlock).data, true
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+	c.blocks[key] = c.order.PushFront(&cachedBlock{key: key, data: data})
+	c.size += int64(len(data))
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		e := c.order.Back()
+		b := c.order.Remove(e).(*cachedBlock)
+		delete(c.blocks, b.key)
+		c.size -= int64(len(b.data))
+	}
+}
+
+// offloadedOptions returns the options of the stores of offloaded
+// partitions.
+func (fs *ColumnFS) offloadedOptions() Options {
+	opts := fs.partitionOptions()
+	opts.Backend = fs.objects
+	opts.ReadOnly = true
+	opts.RefreshInterval = 0
+	opts.MemoryMap = false
+	opts.Durability = DurabilityNone
+	return opts
+}
+
+// openOffloadedPartitions opens the partitions found only in the object
+// store, taking those already open from kept. The caller must hold fs.lock.
+func (fs *ColumnFS) openOffloadedPartitions(kept map[string]*partition) error {
+	for _, name := range fs.objects.partitions() {
+		start, end, ok := parsePartitionDir(name)
+		dir := path.Join(fs.dir, name)
+		if !ok || slices.ContainsFunc(fs.partitions, func(p *partition) bool { return p.fs.dir == dir }) {
+			continue
+		}
+		if p := kept[dir]; p != nil && p.offloaded {
+			delete(kept, dir)
+			fs.partitions = append(fs.partitions, p)
+			continue
+		}
+		data, err := readFile(fs.objects, path.Join(dir, partitionBaseFileName))
+		if err != nil {
+			return err
+		}
+		if len(data) != 8 {
+			return fmt.Errorf("partition %s has a corrupt base file", dir)
+		}
+		pfs, err := OpenColumnFSWithOptions(dir, fs.offloadedOptions())
+		if err != nil {
+			return err
+		}
+		fs.partitions = append(fs.partitions, &partition{start: start, end: end, base: int64(binary.LittleEndian.Uint64(data)), fs: pfs, offloaded: true})
+	}
+	return nil
+}
+
+// OffloadPartitionsBefore uploads the partitions whose rows were all appended
+// before t to Options.ObjectStore and deletes their directories, returning
+// how many were offloaded. Partitions still open to appends are kept. Their
+// rows are then read from the object store, through a cache of recently read
+// blocks, and cannot be deleted, compacted or pruned until the partition is
+// dropped. Queries already running keep reading the local files.
+func (fs *ColumnFS) OffloadPartitionsBefore(t time.Time) (int, error) {
+	if fs.opts.ReadOnly {
+		return 0, ErrStoreReadOnly
+	}
+	if fs.objects == nil {
+		return 0, errors.New("no object store is configured")
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	n := 0
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		if p.end.After(t) || p.end.After(fs.now()) {
+			break
+		}
+		if err := fs.offloadPartition(p); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// offloadPartition uploads a sealed partition, reopening it from the object
+// store. The caller must hold fs.lock.
+func (fs *ColumnFS) offloadPartition(p *partition) error {
+	if err := p.fs.Close(); err != nil {
+		return err
+	}
+	dir := p.fs.dir
+	err := fs.objects.upload(fs.backend, dir)
+	var pfs *ColumnFS
+	if err == nil {
+		pfs, err = OpenColumnFSWithOptions(dir, fs.offloadedOptions())
+	}
+	if err != nil {
+		// The partition is read locally until it is offloaded again.
+		pfs, openErr := OpenColumnFSWithOptions(dir, fs.partitionOptions())
+		if openErr != nil {
+			return errors.Join(err, openErr)
+		}
+		p.fs = pfs
+		return err
+	}
+	p.fs, p.offloaded = pfs, true
+	// Local directories without a base file are ignored, so a partly
+	// removed one is never read.
+	if err := fs.backend.Remove(path.Join(dir, partitionBaseFileName)); err != nil {
+		return err
+	}
+	return fs.backend.RemoveAll(dir)
+}
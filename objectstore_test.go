@@ -0,0 +1,137 @@
+package querystore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testObjectStore is an ObjectStore holding objects in memory.
+type testObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *testObjectStore) Put(key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("object %s has %d bytes, not %d", key, len(data), size)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *testObjectStore) GetRange(key string, off, n int64) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return bytes.Clone(data[off : off+n]), nil
+}
+
+func (s *testObjectStore) List(prefix string) ([]ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var infos []ObjectInfo
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, ObjectInfo{Key: key, Size: int64(len(data))})
+		}
+	}
+	return infos, nil
+}
+
+func (s *testObjectStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestOffloadPartitions(t *testing.T) {
+	dir := t.TempDir()
+	objects := &testObjectStore{objects: map[string][]byte{}}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{
+		Partitioning: PartitionHourly,
+		ObjectStore:  objects,
+		Clock:        func() time.Time { return now },
+		Schema:       &Schema{Columns: []ColumnSpec{{Name: "val", Type: ColumnTypeInt64}}},
+	}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	for hour := range 3 {
+		for i := range 10 {
+			require.NoError(t, fs.WriteRows([]map[string]any{{"val": int64(hour*10 + i)}}))
+		}
+		now = now.Add(time.Hour)
+	}
+	now = now.Add(-30 * time.Minute)
+
+	sum := func(fs *ColumnFS) any {
+		res, err := NewColumnarStore(fs).Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "val"}}})
+		require.NoError(t, err)
+		return res[0]["sum(val)"]
+	}
+	n, err := fs.OffloadPartitionsBefore(now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n, "the partition open to appends is kept")
+	assert.Equal(t, []bool{true, true, false}, lo.Map(fs.Partitions(), func(p PartitionInfo, _ int) bool { return p.Offloaded }))
+	assert.NoDirExists(t, fs.Partitions()[0].Dir)
+	assert.Contains(t, objects.objects, "2024-01-01T00/"+indexFileName)
+	assert.Equal(t, int64(435), sum(fs))
+	gets := objects.gets
+	assert.Equal(t, int64(435), sum(fs))
+	assert.Equal(t, gets, objects.gets, "blocks are cached")
+
+	res, err := NewColumnarStore(fs).Query(&Query{
+		Select:    []string{"val"},
+		TimeRange: TimeRange{Start: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), End: time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)},
+	})
+	require.NoError(t, err)
+	assert.Len(t, res, 10)
+	assert.Equal(t, int64(10), res[0]["val"])
+	assert.Equal(t, int64(10), res[0][IndexColumn])
+	require.NoError(t, fs.Compact())
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	assert.Len(t, fs.Partitions(), 3)
+	assert.Equal(t, int64(435), sum(fs))
+	// Snapshots copy offloaded partitions to disk.
+	snapDir := t.TempDir()
+	_, err = fs.Snapshot(snapDir)
+	require.NoError(t, err)
+	snap, err := OpenColumnFS(snapDir)
+	require.NoError(t, err)
+	assert.Equal(t, int64(435), sum(snap))
+	require.NoError(t, snap.Close())
+	require.NoError(t, fs.WriteRows([]map[string]any{{"val": int64(1)}}))
+	assert.Equal(t, int64(436), sum(fs))
+
+	dropped, err := fs.DropPartitionsBefore(now)
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	assert.Empty(t, objects.objects)
+	assert.Equal(t, int64(246), sum(fs))
+	require.NoError(t, fs.Close())
+}
@@ -0,0 +1,554 @@
+package querystore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxOTLPSize bounds the size of an OTLP request body.
+const maxOTLPSize = 64 << 20
+
+// OTLPHandler receives OpenTelemetry spans and log records over OTLP/HTTP,
+// at /v1/traces and /v1/logs, and appends a row for each. Requests may use
+// the JSON or the binary protobuf encoding, optionally gzip compressed, and
+// are answered in the same encoding.
+//
+// Span rows hold the columns trace_id, span_id, parent_span_id, name, kind,
+// start_time, end_time, duration (in nanoseconds), status_code,
+// status_message, scope_name and scope_version. Log rows hold time,
+// severity_number, severity_text, body, trace_id, span_id, scope_name and
+// scope_version. Both hold their attributes in columns named
+// "attributes.<key>" and those of their resource in "resource.<key>", where
+// arrays and key-value lists are stored as JSON. Trace and span IDs are hex
+// encoded, and bytes values base64 encoded, as in the JSON encoding.
+func OTLPHandler(s *ColumnarStore) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/traces", func(w http.ResponseWriter, r *http.Request) {
+		var req otlpTraceRequest
+		contentType, ok := readOTLPRequest(w, r, &req)
+		if !ok {
+			return
+		}
+		var rows []map[string]any
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					row := span.row()
+					ss.Scope.addTo(row)
+					addOTLPAttributes(row, "resource.", rs.Resource.Attributes)
+					rows = append(rows, row)
+				}
+			}
+		}
+		writeOTLPResponse(w, contentType, s.AppendBatchContext(r.Context(), rows))
+	})
+	mux.HandleFunc("POST /v1/logs", func(w http.ResponseWriter, r *http.Request) {
+		var req otlpLogsRequest
+		contentType, ok := readOTLPRequest(w, r, &req)
+		if !ok {
+			return
+		}
+		var rows []map[string]any
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				for _, rec := range sl.LogRecords {
+					row := rec.row()
+					sl.Scope.addTo(row)
+					addOTLPAttributes(row, "resource.", rl.Resource.Attributes)
+					rows = append(rows, row)
+				}
+			}
+		}
+		writeOTLPResponse(w, contentType, s.AppendBatchContext(r.Context(), rows))
+	})
+	return mux
+}
+
+// Media types of the OTLP encodings.
+const (
+	otlpJSON     = "application/json"
+	otlpProtobuf = "application/x-protobuf"
+)
+
+// otlpMessage is an OTLP request decodable from either encoding.
+type otlpMessage interface {
+	decodeProto(b []byte) error
+}
+
+// readOTLPRequest decodes an OTLP request into v, returning the media type of
+// its encoding. It responds with an error and returns false if it cannot.
+func readOTLPRequest(w http.ResponseWriter, r *http.Request, v otlpMessage) (string, bool) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != otlpJSON && mt != otlpProtobuf {
+		http.Error(w, "OTLP requests must be JSON or protobuf encoded", http.StatusUnsupportedMediaType)
+		return "", false
+	}
+	var body io.Reader = io.LimitReader(r.Body, maxOTLPSize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+		defer zr.Close()
+		body = io.LimitReader(zr, maxOTLPSize)
+	}
+	var err error
+	if mt == otlpJSON {
+		err = json.NewDecoder(body).Decode(v)
+	} else {
+		var data []byte
+		if data, err = io.ReadAll(body); err == nil {
+			err = v.decodeProto(data)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return mt, true
+}
+
+// writeOTLPResponse writes the empty response of a request in its encoding,
+// or the error appending its rows.
+func writeOTLPResponse(w http.ResponseWriter, contentType string, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if contentType == otlpJSON {
+		w.Write([]byte("{}"))
+	}
+}
+
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (sc otlpScope) addTo(row map[string]any) {
+	if sc.Name != "" {
+		row["scope_name"] = sc.Name
+	}
+	if sc.Version != "" {
+		row["scope_version"] = sc.Version
+	}
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              otlpInt        `json:"kind"`
+	StartTimeUnixNano otlpInt        `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpInt        `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            struct {
+		Code    otlpInt `json:"code"`
+		Message string  `json:"message"`
+	} `json:"status"`
+}
+
+func (span *otlpSpan) row() map[string]any {
+	row := map[string]any{
+		"trace_id":    span.TraceID,
+		"span_id":     span.SpanID,
+		"name":        span.Name,
+		"kind":        int64(span.Kind),
+		"start_time":  time.Unix(0, int64(span.StartTimeUnixNano)).UTC(),
+		"end_time":    time.Unix(0, int64(span.EndTimeUnixNano)).UTC(),
+		"duration":    int64(span.EndTimeUnixNano - span.StartTimeUnixNano),
+		"status_code": int64(span.Status.Code),
+	}
+	if span.ParentSpanID != "" {
+		row["parent_span_id"] = span.ParentSpanID
+	}
+	if span.Status.Message != "" {
+		row["status_message"] = span.Status.Message
+	}
+	addOTLPAttributes(row, "attributes.", span.Attributes)
+	return row
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       otlpInt        `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 *otlpAnyValue  `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceID              string         `json:"traceId"`
+	SpanID               string         `json:"spanId"`
+}
+
+func (rec *otlpLogRecord) row() map[string]any {
+	ts := rec.TimeUnixNano
+	if ts == 0 {
+		ts = rec.ObservedTimeUnixNano
+	}
+	row := map[string]any{
+		"time":            time.Unix(0, int64(ts)).UTC(),
+		"severity_number": int64(rec.SeverityNumber),
+	}
+	if rec.SeverityText != "" {
+		row["severity_text"] = rec.SeverityText
+	}
+	if v := rec.Body.value(); v != nil {
+		row["body"] = v
+	}
+	if rec.TraceID != "" {
+		row["trace_id"] = rec.TraceID
+	}
+	if rec.SpanID != "" {
+		row["span_id"] = rec.SpanID
+	}
+	addOTLPAttributes(row, "attributes.", rec.Attributes)
+	return row
+}
+
+type otlpKeyValue struct {
+	Key   string        `json:"key"`
+	Value *otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue"`
+	BoolValue   *bool    `json:"boolValue"`
+	IntValue    *otlpInt `json:"intValue"`
+	DoubleValue *float64 `json:"doubleValue"`
+	BytesValue  *string  `json:"bytesValue"`
+	ArrayValue  *struct {
+		Values []*otlpAnyValue `json:"values"`
+	} `json:"arrayValue"`
+	KvlistValue *struct {
+		Values []otlpKeyValue `json:"values"`
+	} `json:"kvlistValue"`
+}
+
+// value returns the value as a column value, with arrays and key-value
+// lists as JSON.
+func (v *otlpAnyValue) value() any {
+	switch {
+	case v == nil:
+		return nil
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		b, _ := json.Marshal(v.jsonValue())
+		return json.RawMessage(b)
+	}
+	return v.jsonValue()
+}
+
+func (v *otlpAnyValue) jsonValue() any {
+	switch {
+	case v == nil:
+		return nil
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		// Bytes are kept base64 encoded, as sent.
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]any, len(v.ArrayValue.Values))
+		for i, e := range v.ArrayValue.Values {
+			values[i] = e.jsonValue()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := map[string]any{}
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.jsonValue()
+		}
+		return values
+	}
+	return nil
+}
+
+func addOTLPAttributes(row map[string]any, prefix string, attrs []otlpKeyValue) {
+	for _, kv := range attrs {
+		if v := kv.Value.value(); v != nil {
+			row[prefix+kv.Key] = v
+		}
+	}
+}
+
+// otlpInt is a 64-bit integer, which the OTLP JSON encoding sends as a
+// string or a number.
+type otlpInt int64
+
+func (n *otlpInt) UnmarshalJSON(b []byte) error {
+	b = bytes.Trim(b, `"`)
+	v, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("otlp: invalid integer %s", b)
+	}
+	*n = otlpInt(v)
+	return nil
+}
+
+// The decodeProto methods decode the messages of the protobuf encoding of
+// OTLP, whose field numbers are those of the opentelemetry-proto definitions.
+// Unknown fields are skipped.
+
+func (req *otlpTraceRequest) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+		if field != 1 || wire != protoBytes {
+			return nil
+		}
+		var rs otlpResourceSpans
+		err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+			switch {
+			case field == 1 && wire == protoBytes:
+				return rs.Resource.decodeProto(b)
+			case field == 2 && wire == protoBytes:
+				var ss otlpScopeSpans
+				err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+					switch {
+					case field == 1 && wire == protoBytes:
+						return ss.Scope.decodeProto(b)
+					case field == 2 && wire == protoBytes:
+						var span otlpSpan
+						if err := span.decodeProto(b); err != nil {
+							return err
+						}
+						ss.Spans = append(ss.Spans, span)
+					}
+					return nil
+				})
+				rs.ScopeSpans = append(rs.ScopeSpans, ss)
+				return err
+			}
+			return nil
+		})
+		req.ResourceSpans = append(req.ResourceSpans, rs)
+		return err
+	})
+}
+
+func (req *otlpLogsRequest) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+		if field != 1 || wire != protoBytes {
+			return nil
+		}
+		var rl otlpResourceLogs
+		err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+			switch {
+			case field == 1 && wire == protoBytes:
+				return rl.Resource.decodeProto(b)
+			case field == 2 && wire == protoBytes:
+				var sl otlpScopeLogs
+				err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+					switch {
+					case field == 1 && wire == protoBytes:
+						return sl.Scope.decodeProto(b)
+					case field == 2 && wire == protoBytes:
+						var rec otlpLogRecord
+						if err := rec.decodeProto(b); err != nil {
+							return err
+						}
+						sl.LogRecords = append(sl.LogRecords, rec)
+					}
+					return nil
+				})
+				rl.ScopeLogs = append(rl.ScopeLogs, sl)
+				return err
+			}
+			return nil
+		})
+		req.ResourceLogs = append(req.ResourceLogs, rl)
+		return err
+	})
+}
+
+func (res *otlpResource) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+		if field == 1 && wire == protoBytes {
+			return appendOTLPKeyValue(&res.Attributes, b)
+		}
+		return nil
+	})
+}
+
+func (sc *otlpScope) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+		switch {
+		case field == 1 && wire == protoBytes:
+			sc.Name = string(b)
+		case field == 2 && wire == protoBytes:
+			sc.Version = string(b)
+		}
+		return nil
+	})
+}
+
+func (span *otlpSpan) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, n uint64) error {
+		switch {
+		case field == 1 && wire == protoBytes:
+			span.TraceID = hex.EncodeToString(b)
+		case field == 2 && wire == protoBytes:
+			span.SpanID = hex.EncodeToString(b)
+		case field == 4 && wire == protoBytes:
+			span.ParentSpanID = hex.EncodeToString(b)
+		case field == 5 && wire == protoBytes:
+			span.Name = string(b)
+		case field == 6 && wire == protoVarint:
+			span.Kind = otlpInt(n)
+		case field == 7 && wire == protoFixed64:
+			span.StartTimeUnixNano = otlpInt(n)
+		case field == 8 && wire == protoFixed64:
+			span.EndTimeUnixNano = otlpInt(n)
+		case field == 9 && wire == protoBytes:
+			return appendOTLPKeyValue(&span.Attributes, b)
+		case field == 15 && wire == protoBytes:
+			// Status: string message = 2, StatusCode code = 3.
+			return readProtoFields(b, func(field int, wire int, b []byte, n uint64) error {
+				switch {
+				case field == 2 && wire == protoBytes:
+					span.Status.Message = string(b)
+				case field == 3 && wire == protoVarint:
+					span.Status.Code = otlpInt(n)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+}
+
+func (rec *otlpLogRecord) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, n uint64) error {
+		switch {
+		case field == 1 && wire == protoFixed64:
+			rec.TimeUnixNano = otlpInt(n)
+		case field == 2 && wire == protoVarint:
+			rec.SeverityNumber = otlpInt(n)
+		case field == 3 && wire == protoBytes:
+			rec.SeverityText = string(b)
+		case field == 5 && wire == protoBytes:
+			rec.Body = &otlpAnyValue{}
+			return rec.Body.decodeProto(b)
+		case field == 6 && wire == protoBytes:
+			return appendOTLPKeyValue(&rec.Attributes, b)
+		case field == 9 && wire == protoBytes:
+			rec.TraceID = hex.EncodeToString(b)
+		case field == 10 && wire == protoBytes:
+			rec.SpanID = hex.EncodeToString(b)
+		case field == 11 && wire == protoFixed64:
+			rec.ObservedTimeUnixNano = otlpInt(n)
+		}
+		return nil
+	})
+}
+
+// appendOTLPKeyValue decodes a KeyValue and appends it to kvs.
+func appendOTLPKeyValue(kvs *[]otlpKeyValue, b []byte) error {
+	var kv otlpKeyValue
+	err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+		switch {
+		case field == 1 && wire == protoBytes:
+			kv.Key = string(b)
+		case field == 2 && wire == protoBytes:
+			kv.Value = &otlpAnyValue{}
+			return kv.Value.decodeProto(b)
+		}
+		return nil
+	})
+	*kvs = append(*kvs, kv)
+	return err
+}
+
+func (v *otlpAnyValue) decodeProto(b []byte) error {
+	return readProtoFields(b, func(field int, wire int, b []byte, n uint64) error {
+		switch {
+		case field == 1 && wire == protoBytes:
+			s := string(b)
+			v.StringValue = &s
+		case field == 2 && wire == protoVarint:
+			t := n != 0
+			v.BoolValue = &t
+		case field == 3 && wire == protoVarint:
+			i := otlpInt(n)
+			v.IntValue = &i
+		case field == 4 && wire == protoFixed64:
+			f := math.Float64frombits(n)
+			v.DoubleValue = &f
+		case field == 5 && wire == protoBytes:
+			v.ArrayValue = &struct {
+				Values []*otlpAnyValue `json:"values"`
+			}{}
+			return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+				if field != 1 || wire != protoBytes {
+					return nil
+				}
+				e := &otlpAnyValue{}
+				v.ArrayValue.Values = append(v.ArrayValue.Values, e)
+				return e.decodeProto(b)
+			})
+		case field == 6 && wire == protoBytes:
+			v.KvlistValue = &struct {
+				Values []otlpKeyValue `json:"values"`
+			}{}
+			return readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+				if field != 1 || wire != protoBytes {
+					return nil
+				}
+				return appendOTLPKeyValue(&v.KvlistValue.Values, b)
+			})
+		case field == 7 && wire == protoBytes:
+			// Bytes are base64 encoded, as the JSON encoding sends them.
+			s := base64.StdEncoding.EncodeToString(b)
+			v.BytesValue = &s
+		}
+		return nil
+	})
+}
@@ -0,0 +1,168 @@
+package querystore
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOTLPHandler(t *testing.T) {
+	cs := newTestStore(t)
+	server := httptest.NewServer(OTLPHandler(cs))
+	defer server.Close()
+	post := func(path, contentType string, body []byte, gzipped bool) int {
+		req, err := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	traces := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeSpans":[{"scope":{"name":"http"},"spans":[{"traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174",
+		"name":"GET /users","kind":2,"startTimeUnixNano":"1704067200000000000","endTimeUnixNano":"1704067200250000000",
+		"attributes":[{"key":"http.status_code","value":{"intValue":"500"}},{"key":"tags","value":{"arrayValue":{"values":[{"stringValue":"a"},{"boolValue":true}]}}}],
+		"status":{"code":2,"message":"boom"}}]}]}]}`
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(traces))
+	require.NoError(t, zw.Close())
+	assert.Equal(t, http.StatusOK, post("/v1/traces", "application/json", gz.Bytes(), true))
+
+	logs := `{"resourceLogs":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+		"scopeLogs":[{"logRecords":[{"timeUnixNano":1704067201000000000,"severityNumber":17,"severityText":"ERROR",
+		"body":{"stringValue":"request failed"},"traceId":"5b8efff798038103d269b633813fc60c",
+		"attributes":[{"key":"retry","value":{"doubleValue":1.5}}]}]}]}]}`
+	assert.Equal(t, http.StatusOK, post("/v1/logs", "application/json; charset=utf-8", []byte(logs), false))
+
+	rows, err := cs.Query(&Query{Where: Where("kind", ConditionEquals, 2), Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	span := rows[0]
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", span["trace_id"])
+	assert.Equal(t, "GET /users", span["name"])
+	assert.Equal(t, int64(250*time.Millisecond), span["duration"])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), span["start_time"])
+	assert.Equal(t, int64(500), span["attributes.http.status_code"])
+	assert.Equal(t, []any{"a", true}, span["attributes.tags"])
+	assert.Equal(t, "api", span["resource.service.name"])
+	assert.Equal(t, "http", span["scope_name"])
+	assert.Equal(t, "boom", span["status_message"])
+
+	rows, err = cs.Query(&Query{Where: Where("severity_text", ConditionEquals, "ERROR"), Select: []string{"body", "trace_id", "attributes.retry", "time"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "request failed", rows[0]["body"])
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", rows[0]["trace_id"])
+	assert.Equal(t, 1.5, rows[0]["attributes.retry"])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), rows[0]["time"])
+
+	assert.Equal(t, http.StatusUnsupportedMediaType, post("/v1/traces", "text/plain", nil, false))
+	assert.Equal(t, http.StatusBadRequest, post("/v1/logs", "application/json", []byte(`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"timeUnixNano":"x"}]}]}]}`), false))
+}
+
+func TestOTLPHandlerProtobuf(t *testing.T) {
+	cs := newTestStore(t)
+	server := httptest.NewServer(OTLPHandler(cs))
+	defer server.Close()
+
+	field := func(b []byte, num int, data []byte) []byte {
+		b = binary.AppendUvarint(b, uint64(num<<3|2))
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		return append(b, data...)
+	}
+	varint := func(b []byte, num int, n uint64) []byte {
+		return binary.AppendUvarint(binary.AppendUvarint(b, uint64(num<<3)), n)
+	}
+	fixed64 := func(b []byte, num int, n uint64) []byte {
+		return binary.LittleEndian.AppendUint64(binary.AppendUvarint(b, uint64(num<<3|1)), n)
+	}
+	keyValue := func(key string, value []byte) []byte {
+		return field(field(nil, 1, []byte(key)), 2, value)
+	}
+	post := func(path string, body []byte) *http.Response {
+		resp, err := http.Post(server.URL+path, "application/x-protobuf", bytes.NewReader(body))
+		require.NoError(t, err)
+		return resp
+	}
+	traceID := lo.Must(hex.DecodeString("5b8efff798038103d269b633813fc60c"))
+	resource := field(nil, 1, keyValue("service.name", field(nil, 1, []byte("api"))))
+
+	var span []byte
+	span = field(span, 1, traceID)
+	span = field(span, 2, lo.Must(hex.DecodeString("eee19b7ec3c1b174")))
+	span = field(span, 5, []byte("GET /users"))
+	span = varint(span, 6, 2)
+	span = fixed64(span, 7, 1704067200000000000)
+	span = fixed64(span, 8, 1704067200250000000)
+	span = field(span, 9, keyValue("http.status_code", varint(nil, 3, 500)))
+	tags := field(field(nil, 1, field(nil, 1, []byte("a"))), 1, varint(nil, 2, 1))
+	span = field(span, 9, keyValue("tags", field(nil, 5, tags)))
+	span = field(span, 15, varint(field(nil, 2, []byte("boom")), 3, 2))
+	scopeSpans := field(field(nil, 1, field(nil, 1, []byte("http"))), 2, span)
+	traces := field(nil, 1, field(field(nil, 1, resource), 2, scopeSpans))
+	resp := post("/v1/traces", traces)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-protobuf", resp.Header.Get("Content-Type"))
+	assert.Empty(t, lo.Must(io.ReadAll(resp.Body)))
+	resp.Body.Close()
+
+	var rec []byte
+	rec = fixed64(rec, 1, 1704067201000000000)
+	rec = varint(rec, 2, 17)
+	rec = field(rec, 3, []byte("ERROR"))
+	rec = field(rec, 5, field(nil, 1, []byte("request failed")))
+	rec = field(rec, 6, keyValue("retry", fixed64(nil, 4, math.Float64bits(1.5))))
+	rec = field(rec, 6, keyValue("payload", field(nil, 7, []byte{0xff, 0})))
+	rec = field(rec, 9, traceID)
+	logs := field(nil, 1, field(field(nil, 1, resource), 2, field(nil, 2, rec)))
+	resp = post("/v1/logs", logs)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp.Body.Close()
+
+	rows, err := cs.Query(&Query{Where: Where("kind", ConditionEquals, 2), Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	span0 := rows[0]
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", span0["trace_id"])
+	assert.Equal(t, "eee19b7ec3c1b174", span0["span_id"])
+	assert.Equal(t, "GET /users", span0["name"])
+	assert.Equal(t, int64(250*time.Millisecond), span0["duration"])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), span0["start_time"])
+	assert.Equal(t, int64(500), span0["attributes.http.status_code"])
+	assert.Equal(t, []any{"a", true}, span0["attributes.tags"])
+	assert.Equal(t, "api", span0["resource.service.name"])
+	assert.Equal(t, "http", span0["scope_name"])
+	assert.Equal(t, int64(2), span0["status_code"])
+	assert.Equal(t, "boom", span0["status_message"])
+
+	rows, err = cs.Query(&Query{Where: Where("severity_text", ConditionEquals, "ERROR"), Select: []string{"body", "trace_id", "attributes.retry", "attributes.payload", "time", "severity_number"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "request failed", rows[0]["body"])
+	assert.Equal(t, "5b8efff798038103d269b633813fc60c", rows[0]["trace_id"])
+	assert.Equal(t, 1.5, rows[0]["attributes.retry"])
+	assert.Equal(t, "/wA=", rows[0]["attributes.payload"])
+	assert.Equal(t, int64(17), rows[0]["severity_number"])
+	assert.Equal(t, time.Date(2024, 1, 1, 0, 0, 1, 0, time.UTC), rows[0]["time"])
+
+	resp = post("/v1/logs", []byte{0x0a, 0x05})
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp.Body.Close()
+}
@@ -0,0 +1,470 @@
+package querystore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ExportParquet writes the results of a query to w as an Apache Parquet file,
+// with the columns ExportCSV would write. Rows are written in row groups of
+// parquetRowGroupSize rows, each column as a single uncompressed, plain
+// encoded page of optional values. Columns are typed by the store, or else by
+// their first value: times and the timestamp column are UTC nanosecond
+// TIMESTAMPs, strings are STRINGs and JSON values are JSON.
+func (s *ColumnarStore) ExportParquet(w io.Writer, q *Query) error {
+	q, columns := s.exportColumns(q)
+	types, err := s.exportTypes(q, columns)
+	if err != nil {
+		return err
+	}
+	it, err := s.QueryIter(q)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	bw := bufio.NewWriter(w)
+	pw := &parquetWriter{w: &countingWriter{w: bw}}
+	pw.columns = make([]*parquetColumn, len(columns))
+	for i, name := range columns {
+		c := &parquetColumn{name: name}
+		c.typ, c.typed = types[name]
+		pw.columns[i] = c
+	}
+	if _, err := pw.w.Write([]byte(parquetMagic)); err != nil {
+		return err
+	}
+	for it.Next() {
+		if err := pw.add(it.Row()); err != nil {
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if err := pw.close(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+const (
+	parquetMagic        = "PAR1"
+	parquetRowGroupSize = 64 * 1024
+)
+
+// Parquet physical types, converted types, encodings and repetitions.
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8   = 0
+	parquetUint64 = 14
+	parquetJSON   = 19
+
+	parquetPlain = 0
+	parquetRLE   = 3
+
+	parquetOptional = 1
+)
+
+// parquetWriter writes rows as the row groups of a Parquet file.
+type parquetWriter struct {
+	w         *countingWriter
+	columns   []*parquetColumn
+	rows      int64
+	groupRows int64
+	groups    []parquetRowGroup
+}
+
+// parquetColumn buffers the values of a column in the current row group.
+type parquetColumn struct {
+	name  string
+	typ   ColumnType
+	typed bool
+	// defined holds the definition level of each row, 1 for values and 0
+	// for nulls, and values their plain encoding.
+	defined []bool
+	values  []byte
+	bools   []bool
+}
+
+// parquetChunk locates a column chunk written to the file.
+type parquetChunk struct {
+	offset, size, values int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+func (pw *parquetWriter) add(row map[string]any) error {
+	for _, c := range pw.columns {
+		if err := c.add(row[c.name]); err != nil {
+			return err
+		}
+	}
+	pw.rows++
+	pw.groupRows++
+	if pw.groupRows == parquetRowGroupSize {
+		return pw.flush()
+	}
+	return nil
+}
+
+func (c *parquetColumn) add(v any) error {
+	if v == nil {
+		c.defined = append(c.defined, false)
+		return nil
+	}
+	if !c.typed {
+		c.typ, c.typed = valueColumnType(v), true
+	}
+	c.defined = append(c.defined, true)
+	switch c.typ {
+	case ColumnTypeBool:
+		b, ok := v.(bool)
+		if !ok {
+			return c.mismatch(v)
+		}
+		c.bools = append(c.bools, b)
+	case ColumnTypeInt32:
+		if !valueFitsColumnType(v, ColumnTypeInt32) {
+			return c.mismatch(v)
+		}
+		c.values = binary.LittleEndian.AppendUint32(c.values, uint32(int32(valueToInt64(v))))
+	case ColumnTypeInt64:
+		if !valueFitsColumnType(v, ColumnTypeInt64) {
+			return c.mismatch(v)
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(valueToInt64(v)))
+	case ColumnTypeUint64:
+		if !valueFitsColumnType(v, ColumnTypeUint64) {
+			return c.mismatch(v)
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, valueToUint64(v))
+	case ColumnTypeFloat64:
+		if valueColumnType(v) != ColumnTypeFloat64 {
+			return c.mismatch(v)
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, math.Float64bits(valueToFloat64(v)))
+	case ColumnTypeTime:
+		// The timestamp column holds UnixNano integers.
+		if t := valueColumnType(v); t != ColumnTypeTime && t != ColumnTypeInt64 {
+			return c.mismatch(v)
+		}
+		c.values = binary.LittleEndian.AppendUint64(c.values, uint64(valueToTime(v).UnixNano()))
+	case ColumnTypeJSON:
+		c.values = appendParquetBytes(c.values, encodeJSONValue(v))
+	default:
+		s, ok := v.(string)
+		if !ok {
+			return c.mismatch(v)
+		}
+		c.values = appendParquetBytes(c.values, []byte(s))
+	}
+	return nil
+}
+
+func (c *parquetColumn) mismatch(v any) error {
+	return fmt.Errorf("column %s holds a %T value, which is not a %s", c.name, v, c.typ)
+}
+
+func appendParquetBytes(dst, b []byte) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b)))
+	return append(dst, b...)
+}
+
+// physicalType returns the Parquet type of the column's values.
+func (c *parquetColumn) physicalType() int32 {
+	switch c.typ {
+	case ColumnTypeBool:
+		return parquetBoolean
+	case ColumnTypeInt32:
+		return parquetInt32
+	case ColumnTypeInt64, ColumnTypeUint64, ColumnTypeTime:
+		return parquetInt64
+	case ColumnTypeFloat64:
+		return parquetDouble
+	}
+	return parquetByteArray
+}
+
+// flush writes the buffered rows as a row group.
+func (pw *parquetWriter) flush() error {
+	group := parquetRowGroup{rows: pw.groupRows}
+	for _, c := range pw.columns {
+		chunk, err := c.writePage(pw.w)
+		if err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+	}
+	pw.groups = append(pw.groups, group)
+	pw.groupRows = 0
+	return nil
+}
+
+// writePage writes the column's buffered values as a data page.
+func (c *parquetColumn) writePage(w *countingWriter) (parquetChunk, error) {
+	// Definition levels are run-length encoded with a bit width of one.
+	var levels []byte
+	for i := 0; i < len(c.defined); {
+		j := i
+		for j < len(c.defined) && c.defined[j] == c.defined[i] {
+			j++
+		}
+		levels = binary.AppendUvarint(levels, uint64(j-i)<<1)
+		if c.defined[i] {
+			levels = append(levels, 1)
+		} else {
+			levels = append(levels, 0)
+		}
+		i = j
+	}
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+	if c.typ == ColumnTypeBool {
+		packed := make([]byte, (len(c.bools)+7)/8)
+		for i, b := range c.bools {
+			if b {
+				packed[i/8] |= 1 << (i % 8)
+			}
+		}
+		page = append(page, packed...)
+	} else {
+		page = append(page, c.values...)
+	}
+
+	var t thriftWriter
+	t.fieldI32(1, 0) // DATA_PAGE
+	t.fieldI32(2, int32(len(page)))
+	t.fieldI32(3, int32(len(page)))
+	t.fieldStruct(5)
+	t.fieldI32(1, int32(len(c.defined)))
+	t.fieldI32(2, parquetPlain)
+	t.fieldI32(3, parquetRLE)
+	t.fieldI32(4, parquetRLE)
+	t.endStruct()
+	t.endStruct()
+
+	chunk := parquetChunk{offset: w.n, size: int64(len(t.buf) + len(page)), values: int64(len(c.defined))}
+	if _, err := w.Write(t.buf); err != nil {
+		return chunk, err
+	}
+	if _, err := w.Write(page); err != nil {
+		return chunk, err
+	}
+	c.defined, c.values, c.bools = c.defined[:0], c.values[:0], c.bools[:0]
+	return chunk, nil
+}
+
+// close writes the last row group and the file footer.
+func (pw *parquetWriter) close() error {
+	if pw.groupRows > 0 {
+		if err := pw.flush(); err != nil {
+			return err
+		}
+	}
+	var t thriftWriter
+	t.fieldI32(1, 1)
+	t.fieldList(2, thriftStruct, len(pw.columns)+1)
+	t.beginStruct()
+	t.fieldBinary(4, []byte("schema"))
+	t.fieldI32(5, int32(len(pw.columns)))
+	t.endStruct()
+	for _, c := range pw.columns {
+		if !c.typed {
+			c.typ = ColumnTypeString
+		}
+		t.beginStruct()
+		t.fieldI32(1, c.physicalType())
+		t.fieldI32(3, parquetOptional)
+		t.fieldBinary(4, []byte(c.name))
+		switch c.typ {
+		case ColumnTypeString:
+			t.fieldI32(6, parquetUTF8)
+			t.fieldStruct(10)
+			t.fieldStruct(1) // STRING
+			t.endStruct()
+			t.endStruct()
+		case ColumnTypeJSON:
+			t.fieldI32(6, parquetJSON)
+			t.fieldStruct(10)
+			t.fieldStruct(12) // JSON
+			t.endStruct()
+			t.endStruct()
+		case ColumnTypeUint64:
+			t.fieldI32(6, parquetUint64)
+			t.fieldStruct(10)
+			t.fieldStruct(10) // INTEGER
+			t.fieldByte(1, 64)
+			t.fieldBool(2, false)
+			t.endStruct()
+			t.endStruct()
+		case ColumnTypeTime:
+			t.fieldStruct(10)
+			t.fieldStruct(8) // TIMESTAMP
+			t.fieldBool(1, true)
+			t.fieldStruct(2)
+			t.fieldStruct(3) // NANOS
+			t.endStruct()
+			t.endStruct()
+			t.endStruct()
+			t.endStruct()
+		}
+		t.endStruct()
+	}
+	t.fieldI64(3, pw.rows)
+	t.fieldList(4, thriftStruct, len(pw.groups))
+	for _, g := range pw.groups {
+		var size int64
+		t.beginStruct()
+		t.fieldList(1, thriftStruct, len(g.chunks))
+		for i, chunk := range g.chunks {
+			c := pw.columns[i]
+			size += chunk.size
+			t.beginStruct()
+			t.fieldI64(2, chunk.offset)
+			t.fieldStruct(3)
+			t.fieldI32(1, c.physicalType())
+			t.fieldList(2, thriftI32, 2)
+			t.i32(parquetPlain)
+			t.i32(parquetRLE)
+			t.fieldList(3, thriftBinary, 1)
+			t.binary([]byte(c.name))
+			t.fieldI32(4, 0) // UNCOMPRESSED
+			t.fieldI64(5, chunk.values)
+			t.fieldI64(6, chunk.size)
+			t.fieldI64(7, chunk.size)
+			t.fieldI64(9, chunk.offset)
+			t.endStruct()
+			t.endStruct()
+		}
+		t.fieldI64(2, size)
+		t.fieldI64(3, g.rows)
+		t.endStruct()
+	}
+	t.fieldBinary(6, []byte("querystore"))
+	t.endStruct()
+
+	footer := binary.LittleEndian.AppendUint32(t.buf, uint32(len(t.buf)))
+	footer = append(footer, parquetMagic...)
+	_, err := pw.w.Write(footer)
+	return err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the Thrift compact protocol, which Parquet
+// uses for its metadata. The outermost struct is implicit.
+type thriftWriter struct {
+	buf []byte
+	// last holds the id of the last field written in each open struct.
+	last  []int16
+	field int16
+}
+
+func (t *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - t.field; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	t.field = id
+}
+
+func (t *thriftWriter) i32(v int32) {
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) binary(b []byte) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(b)))
+	t.buf = append(t.buf, b...)
+}
+
+func (t *thriftWriter) fieldI32(id int16, v int32) {
+	t.fieldHeader(id, thriftI32)
+	t.i32(v)
+}
+
+func (t *thriftWriter) fieldI64(id int16, v int64) {
+	t.fieldHeader(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) fieldByte(id int16, v byte) {
+	t.fieldHeader(id, thriftByte)
+	t.buf = append(t.buf, v)
+}
+
+func (t *thriftWriter) fieldBool(id int16, v bool) {
+	if v {
+		t.fieldHeader(id, thriftTrue)
+	} else {
+		t.fieldHeader(id, thriftFalse)
+	}
+}
+
+func (t *thriftWriter) fieldBinary(id int16, b []byte) {
+	t.fieldHeader(id, thriftBinary)
+	t.binary(b)
+}
+
+func (t *thriftWriter) fieldList(id int16, elem byte, n int) {
+	t.fieldHeader(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|elem)
+	} else {
+		t.buf = append(t.buf, 0xf0|elem)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+// fieldStruct begins a struct field, which endStruct ends.
+func (t *thriftWriter) fieldStruct(id int16) {
+	t.fieldHeader(id, thriftStruct)
+	t.beginStruct()
+}
+
+// beginStruct begins a struct that is a list element.
+func (t *thriftWriter) beginStruct() {
+	t.last = append(t.last, t.field)
+	t.field = 0
+}
+
+func (t *thriftWriter) endStruct() {
+	t.buf = append(t.buf, 0)
+	if n := len(t.last); n > 0 {
+		t.field, t.last = t.last[n-1], t.last[:n-1]
+	}
+}
@@ -0,0 +1,111 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readThrift decodes a Thrift compact protocol struct into a map from field
+// ids to values, for checking Parquet metadata.
+func readThrift(t *testing.T, r *bytes.Reader) map[int16]any {
+	fields := map[int16]any{}
+	var id int16
+	for {
+		b := lo.Must(r.ReadByte())
+		if b == 0 {
+			return fields
+		}
+		if delta := int16(b >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(lo.Must(binary.ReadVarint(r)))
+		}
+		fields[id] = readThriftValue(t, r, b&0x0f)
+	}
+}
+
+func readThriftValue(t *testing.T, r *bytes.Reader, typ byte) any {
+	switch typ {
+	case 1, 2:
+		return typ == 1
+	case 3:
+		return lo.Must(r.ReadByte())
+	case 5, 6:
+		return lo.Must(binary.ReadVarint(r))
+	case 8:
+		b := make([]byte, lo.Must(binary.ReadUvarint(r)))
+		lo.Must(io.ReadFull(r, b))
+		return string(b)
+	case 9:
+		h := lo.Must(r.ReadByte())
+		n := uint64(h >> 4)
+		if n == 15 {
+			n = lo.Must(binary.ReadUvarint(r))
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = readThriftValue(t, r, h&0x0f)
+		}
+		return list
+	case 12:
+		return readThrift(t, r)
+	}
+	t.Fatalf("unexpected thrift type %d", typ)
+	return nil
+}
+
+func TestExportParquet(t *testing.T) {
+	cs := newTestStore(t)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"name": "a", "n": 1, "ok": true, "at": at, "meta": map[string]any{"k": 1}},
+		{"name": "b", "ok": false},
+		{"n": 3, "ok": true},
+	}))
+
+	var buf bytes.Buffer
+	require.NoError(t, cs.ExportParquet(&buf, nil))
+	data := buf.Bytes()
+	require.Equal(t, "PAR1", string(data[:4]))
+	require.Equal(t, "PAR1", string(data[len(data)-4:]))
+	footerLen := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta := readThrift(t, bytes.NewReader(data[len(data)-8-footerLen:len(data)-8]))
+	assert.Equal(t, int64(3), meta[3])
+
+	schema := meta[2].([]any)
+	var names []string
+	for _, el := range schema[1:] {
+		names = append(names, el.(map[int16]any)[4].(string))
+	}
+	assert.Equal(t, []string{"__index", "__timestamp", "at", "meta", "n", "name", "ok"}, names)
+	atSchema := schema[3].(map[int16]any)
+	assert.Equal(t, int64(2), atSchema[1])
+	assert.Contains(t, atSchema[10].(map[int16]any), int16(8))
+	assert.Equal(t, int64(19), schema[4].(map[int16]any)[6])
+
+	// The name column holds "a", "b" and a null.
+	group := meta[4].([]any)[0].(map[int16]any)
+	chunk := group[1].([]any)[5].(map[int16]any)[3].(map[int16]any)
+	assert.Equal(t, int64(3), chunk[5])
+	page := bytes.NewReader(data[chunk[9].(int64):])
+	header := readThrift(t, page)
+	body := make([]byte, header[3].(int64))
+	lo.Must(io.ReadFull(page, body))
+	levels := binary.LittleEndian.Uint32(body)
+	assert.Equal(t, []byte{2 << 1, 1, 1 << 1, 0}, body[4:4+levels])
+	assert.Equal(t, []byte("\x01\x00\x00\x00a\x01\x00\x00\x00b"), body[4+levels:])
+
+	buf.Reset()
+	require.NoError(t, cs.ExportParquet(&buf, &Query{Aggregations: []Aggregation{{Type: AggregatorCount}}}))
+	data = buf.Bytes()
+	footerLen = int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	meta = readThrift(t, bytes.NewReader(data[len(data)-8-footerLen:len(data)-8]))
+	assert.Equal(t, int64(1), meta[3])
+}
@@ -0,0 +1,327 @@
+package querystore
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+)
+
+// Partitioning splits a store's rows by time into sub-directories, one per
+// hour or day in UTC, each holding the rows appended during it. Queries
+// with a time range only open the partitions it overlaps, and old partitions
+// can be dropped wholesale with DropPartitionsBefore.
+type Partitioning int
+
+const (
+	PartitionNone Partitioning = iota
+	PartitionHourly
+	PartitionDaily
+)
+
+// Partition directory names are the start of their span in UTC.
+const (
+	hourlyPartitionLayout = "2006-01-02T15"
+	dailyPartitionLayout  = "2006-01-02"
+)
+
+// partitionBaseFileName names the file in a partition's directory holding
+// the index of its first row, as a little-endian int64. Rows keep their
+// indexes when earlier partitions are dropped.
+const partitionBaseFileName = "__base"
+
+func (p Partitioning) span() time.Duration {
+	if p == PartitionDaily {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+func (p Partitioning) layout() string {
+	if p == PartitionDaily {
+		return dailyPartitionLayout
+	}
+	return hourlyPartitionLayout
+}
+
+// partition is a span of time whose rows are stored in their own directory.
+type partition struct {
+	start, end time.Time
+	// base is the index of the partition's first row in the store.
+	base int64
+	fs   *ColumnFS
+	// offloaded is set once the partition is read from Options.ObjectStore.
+	offloaded bool
+}
+
+// PartitionInfo describes a partition of a partitioned store.
+type PartitionInfo struct {
+	// Start and End bound the append times [Start, End) of its rows.
+	Start, End time.Time
+	Dir        string
+	// FirstRow is the index of its first row, and Rows the number of rows.
+	FirstRow int64
+	Rows     int64
+	// Offloaded is set for partitions read from Options.ObjectStore.
+	Offloaded bool
+}
+
+// parsePartitionDir returns the span of a partition directory, or false if
+// name does not name one.
+func parsePartitionDir(name string) (time.Time, time.Time, bool) {
+	for _, p := range []Partitioning{PartitionHourly, PartitionDaily} {
+		if t, err := time.Parse(p.layout(), name); err == nil {
+			return t, t.Add(p.span()), true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// partitionOptions returns the options of the stores of partitions.
+func (fs *ColumnFS) partitionOptions() Options {
+	opts := fs.opts
+	opts.Partitioning = PartitionNone
+	// Partitions are pruned and rolled up by their store.
+	opts.PruneInterval = 0
+	opts.Rollup = nil
+	opts.ObjectStore = nil
+	// Queries are cached, and partitions refreshed, by their store.
+	opts.QueryCacheSize = 0
+	opts.RefreshInterval = 0
+	return opts
+}
+
+// openPartitions opens the partitions of a store, if it is partitioned or
+// its directory holds partitions. Stores found to hold partitions keep the
+// partitioning of their latest partition unless one is chosen. Partitions
+// the store has open are kept if still found, and closed otherwise.
+func (fs *ColumnFS) openPartitions() error {
+	entries, err := fs.backend.ReadDir(fs.dir)
+	if err != nil {
+		return err
+	}
+	kept := map[string]*partition{}
+	for _, p := range fs.partitions {
+		kept[p.fs.dir] = p
+	}
+	fs.partitions = nil
+	defer func() {
+		for _, p := range kept {
+			p.fs.Close()
+		}
+	}()
+	for _, de := range entries {
+		start, end, ok := parsePartitionDir(de.Name())
+		if !de.IsDir() || !ok {
+			continue
+		}
+		dir := path.Join(fs.dir, de.Name())
+		data, err := readFile(fs.backend, path.Join(dir, partitionBaseFileName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			fs.closePartitions()
+			return err
+		}
+		if len(data) != 8 {
+			fs.closePartitions()
+			return fmt.Errorf("partition %s has a corrupt base file", dir)
+		}
+		base := int64(binary.LittleEndian.Uint64(data))
+		if p := kept[dir]; p != nil && !p.offloaded && p.base == base {
+			delete(kept, dir)
+			fs.partitions = append(fs.partitions, p)
+			continue
+		}
+		pfs, err := OpenColumnFSWithOptions(dir, fs.partitionOptions())
+		if err != nil {
+			fs.closePartitions()
+			return err
+		}
+		fs.partitions = append(fs.partitions, &partition{start: start, end: end, base: base, fs: pfs})
+	}
+	if fs.opts.ObjectStore != nil {
+		if fs.objects == nil {
+			if fs.objects, err = newObjectBackend(fs.opts.ObjectStore, fs.dir, fs.opts.ObjectCacheSize); err != nil {
+				fs.closePartitions()
+				return err
+			}
+		}
+		if err := fs.openOffloadedPartitions(kept); err != nil {
+			fs.closePartitions()
+			return err
+		}
+	}
+	slices.SortFunc(fs.partitions, func(a, b *partition) int { return a.start.Compare(b.start) })
+
+	fs.partitioning = fs.opts.Partitioning
+	if fs.nextID > 0 && (len(fs.partitions) > 0 || fs.partitioning != PartitionNone) {
+		fs.closePartitions()
+		return fmt.Errorf("store %s holds unpartitioned rows, so cannot be partitioned", fs.dir)
+	}
+	if len(fs.partitions) == 0 {
+		return nil
+	}
+	last := fs.partitions[len(fs.partitions)-1]
+	if fs.partitioning == PartitionNone {
+		fs.partitioning = PartitionHourly
+		if last.end.Sub(last.start) == PartitionDaily.span() {
+			fs.partitioning = PartitionDaily
+		}
+	}
+	fs.nextID = last.base + last.fs.nextID
+	fs.lastTimestamp = last.fs.lastTimestamp
+	return nil
+}
+
+func (fs *ColumnFS) closePartitions() error {
+	var errs []error
+	for _, p := range fs.partitions {
+		errs = append(errs, p.fs.Close())
+	}
+	fs.partitions = nil
+	return errors.Join(errs...)
+}
+
+// writePartitions appends rows stamped with stamps to the partitions
+// spanning their timestamps, creating them if needed. The caller must hold
+// fs.lock.
+func (fs *ColumnFS) writePartitions(rows []map[string]any, stamps []int64) error {
+	for len(rows) > 0 {
+		p, err := fs.partitionFor(stamps[0])
+		if err != nil {
+			return err
+		}
+		n := 1
+		for n < len(rows) && stamps[n] < p.end.UnixNano() {
+			n++
+		}
+		p.fs.lock.Lock()
+		err = p.fs.writeStamped(rows[:n], stamps[:n])
+		p.fs.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		fs.nextID += int64(n)
+		fs.lastTimestamp = stamps[n-1]
+		rows, stamps = rows[n:], stamps[n:]
+	}
+	return nil
+}
+
+func (fs *ColumnFS) partitionFor(ts int64) (*partition, error) {
+	t := time.Unix(0, ts).UTC()
+	if n := len(fs.partitions); n > 0 && t.Before(fs.partitions[n-1].end) {
+		// Timestamps never go backwards, so only the last partition can
+		// span them.
+		return fs.partitions[n-1], nil
+	}
+	start := t.Truncate(fs.partitioning.span())
+	dir := path.Join(fs.dir, start.Format(fs.partitioning.layout()))
+	if err := fs.backend.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// The base file is renamed into place, so partitions without one hold
+	// no rows.
+	basePath := path.Join(dir, partitionBaseFileName)
+	if err := writeFile(fs.backend, basePath+".tmp", binary.LittleEndian.AppendUint64(nil, uint64(fs.nextID))); err != nil {
+		return nil, err
+	}
+	if err := fs.backend.Rename(basePath+".tmp", basePath); err != nil {
+		return nil, err
+	}
+	pfs, err := OpenColumnFSWithOptions(dir, fs.partitionOptions())
+	if err != nil {
+		return nil, err
+	}
+	p := &partition{start: start, end: start.Add(fs.partitioning.span()), base: fs.nextID, fs: pfs}
+	fs.partitions = append(fs.partitions, p)
+	return p, nil
+}
+
+// Partitions describes the partitions of a partitioned store, in time order.
+// Rows in the write buffer are not counted.
+func (fs *ColumnFS) Partitions() []PartitionInfo {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	infos := make([]PartitionInfo, len(fs.partitions))
+	for i, p := range fs.partitions {
+		infos[i] = PartitionInfo{Start: p.start, End: p.end, Dir: p.fs.dir, FirstRow: p.base, Rows: p.fs.nextID, Offloaded: p.offloaded}
+	}
+	return infos
+}
+
+// DropPartitionsBefore deletes the partitions whose rows were all appended
+// before t, returning how many were dropped. Queries already running keep
+// reading the rows of dropped partitions.
+func (fs *ColumnFS) DropPartitionsBefore(t time.Time) (int, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.dropPartitionsBefore(t)
+}
+
+// dropPartitionsBefore is DropPartitionsBefore for callers holding fs.lock.
+func (fs *ColumnFS) dropPartitionsBefore(t time.Time) (int, error) {
+	if fs.opts.ReadOnly {
+		return 0, ErrStoreReadOnly
+	}
+	fs.invalidateCache()
+	n := 0
+	defer func() { fs.partitions = fs.partitions[n:] }()
+	for n < len(fs.partitions) && !fs.partitions[n].end.After(t) {
+		p := fs.partitions[n]
+		if err := p.fs.Close(); err != nil {
+			return n, err
+		}
+		if err := fs.backend.RemoveAll(p.fs.dir); err != nil {
+			return n, err
+		}
+		if fs.objects != nil {
+			if err := fs.objects.RemoveAll(p.fs.dir); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// overlaps reports whether a partition may hold rows in a time range.
+func (p *partition) overlaps(r TimeRange) bool {
+	return (r.Start.IsZero() || r.Start.Before(p.end)) && (r.End.IsZero() || r.End.After(p.start))
+}
+
+// openPartitionCursor opens a cursor over the partitions a query's time range
+// overlaps, with a part for each of them. The caller must hold fs.lock.
+func openPartitionCursor(ctx context.Context, fs *ColumnFS, q *Query) (*cursor, error) {
+	c := &cursor{ctx: ctx, q: q}
+	var err error
+	if c.agg, err = newQueryAggregates(q, nil); err != nil {
+		return nil, err
+	}
+	if c.agg == nil {
+		c.sortCols = q.sortColumns(q.selectedColumns(fs))
+	}
+	// Parts are whole partitions, and select the same columns.
+	part := *q
+	part.Parallelism = 0
+	part.Select = q.selectedColumns(fs)
+	for _, p := range fs.partitions {
+		if !p.overlaps(q.TimeRange) {
+			continue
+		}
+		pc, err := openCursor(ctx, p.fs, &part)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		pc.base = p.base
+		c.parts = append(c.parts, pc)
+	}
+	return c, nil
+}
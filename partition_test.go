@@ -0,0 +1,95 @@
+package querystore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitions(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	fs, err := OpenColumnFSWithOptions(dir, Options{Partitioning: PartitionHourly, Clock: clock})
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i, at := range []string{"10:15", "10:45", "11:05", "13:30"} {
+		now = lo.Must(time.Parse("2006-01-02 15:04", "2024-03-01 "+at))
+		rec := map[string]any{"val": i}
+		if i == 3 {
+			rec["extra"] = "x"
+		}
+		require.NoError(t, cs.Append(rec))
+	}
+	parts := fs.Partitions()
+	require.Len(t, parts, 3)
+	assert.Equal(t, []int64{0, 2, 3}, lo.Map(parts, func(p PartitionInfo, _ int) int64 { return p.FirstRow }))
+	assert.Equal(t, filepath.Join(dir, "2024-03-01T11"), parts[1].Dir)
+
+	vals := func(cs *ColumnarStore, q *Query) []any {
+		rows, err := cs.Query(q)
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return []any{row[IndexColumn], row["val"], row["extra"]} })
+	}
+	all := []any{[]any{int64(0), int64(0), nil}, []any{int64(1), int64(1), nil}, []any{int64(2), int64(2), nil}, []any{int64(3), int64(3), "x"}}
+	assert.Equal(t, all, vals(cs, &Query{Select: []string{"*"}}))
+	assert.Equal(t, all[1:3], vals(cs, &Query{Select: []string{"*"}, Offset: 1, Limit: 2}))
+	assert.Equal(t, []any{all[3], all[2]}, vals(cs, &Query{Select: []string{"*"}, Limit: 2, OrderBy: []Order{{Attribute: IndexColumn, Descending: true}}}))
+	rows, err := cs.Query(&Query{Select: []string{"extra"}, OrderBy: []Order{{Attribute: "val", Descending: true}}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(3), int64(2), int64(1), int64(0)}, lo.Map(rows, func(row map[string]any, _ int) any { return row[IndexColumn] }))
+	assert.Equal(t, map[string]any{IndexColumn: int64(3), TimestampColumn: rows[0][TimestampColumn], "extra": "x"}, rows[0])
+
+	since11 := TimeRange{Start: time.Date(2024, 3, 1, 11, 0, 0, 0, time.UTC)}
+	assert.Equal(t, all[2:], vals(cs, &Query{Select: []string{"*"}, TimeRange: since11}))
+	p, err := cs.Plan(&Query{TimeRange: since11, Where: Where("val", ConditionGreaterThan, 0)})
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.Partitions)
+	assert.Equal(t, int64(2), p.StartRow)
+
+	rows, err = cs.Query(&Query{Parallelism: 2, Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "val"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), rows[0]["sum(val)"])
+	require.NoError(t, fs.Close())
+
+	// Partitions are found without the option, and appends continue in the
+	// last one.
+	fs, err = OpenColumnFSWithOptions(dir, Options{Clock: clock})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	now = now.Add(10 * time.Minute)
+	require.NoError(t, cs.Append(map[string]any{"val": 4}))
+	assert.Len(t, fs.Partitions(), 3)
+	all = append(all, []any{int64(4), int64(4), nil})
+	assert.Equal(t, all, vals(cs, &Query{Select: []string{"*"}}))
+
+	n, err := fs.DropPartitionsBefore(time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoDirExists(t, parts[0].Dir)
+	assert.Equal(t, all[3:], vals(cs, &Query{Select: []string{"*"}}))
+	infos, err := fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []ColumnInfo{{Name: "extra", Type: ColumnTypeString, Size: infos[0].Size, Count: 1, FirstIndex: 3, LastIndex: 3}, {Name: "val", Type: ColumnTypeInt64, Size: infos[1].Size, Count: 2, FirstIndex: 3, LastIndex: 4}}, infos)
+	deleted, err := cs.Delete(&Query{Where: Where("val", ConditionEquals, 3)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Equal(t, all[4:], vals(cs, &Query{Select: []string{"*"}}))
+
+	// Stores with unpartitioned rows cannot be partitioned.
+	plain := t.TempDir()
+	pfs, err := OpenColumnFS(plain)
+	require.NoError(t, err)
+	require.NoError(t, pfs.WriteColumns(map[string]any{"val": 1}))
+	require.NoError(t, pfs.Close())
+	_, err = OpenColumnFSWithOptions(plain, Options{Partitioning: PartitionDaily})
+	assert.ErrorContains(t, err, "cannot be partitioned")
+}
@@ -0,0 +1,265 @@
+package querystore
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Plan describes how a query is executed, as returned by ColumnarStore.Plan.
+type Plan struct {
+	// StartRow and EndRow bound the rows [StartRow, EndRow) in the query's
+	// time range, which are the rows scanned. TotalRows is the number of
+	// rows in the store.
+	StartRow, EndRow, TotalRows int64
+	// Partitions is the number of partitions scanned, in partitioned stores.
+	Partitions int
+	// Columns are the columns read by the scan, sorted. Timestamps is set
+	// when the timestamps of rows are read as well.
+	Columns    []string
+	Timestamps bool
+	// Filters describe the filter leaves of the query, in order.
+	Filters []FilterPlan
+	// Vectorized is set when the filters are evaluated over batches of
+	// column vectors rather than row by row, and VectorAggregates when the
+	// aggregates are computed from vectors.
+	Vectorized       bool
+	VectorAggregates bool
+	// Materialized is set when the results are computed in full before the
+	// first row is returned, rather than streamed.
+	Materialized bool
+	Parallelism  int
+	// EstimatedRows is an upper bound on the rows matching the filters,
+	// from the zone maps of their columns.
+	EstimatedRows int64
+}
+
+// FilterPlan describes how a filter is evaluated.
+type FilterPlan struct {
+	Filter Filter
+	// Column is the column read by the filter, which for JSON paths is the
+	// JSON column. It is empty if the attribute matches no column.
+	Column string
+	// Index is set when a value index resolves the filter to its rows, and
+	// EstimatedRows is then exact. Bitmap is set if the index is a bitmap
+	// index.
+	Index  bool
+	Bitmap bool
+	// ZoneMap and BloomFilter are set when the filter skips blocks using zone
+	// maps or bloom filters. Blocks is the number of blocks of the column in
+	// range, and SkippedBlocks the number they rule out.
+	ZoneMap       bool
+	BloomFilter   bool
+	Blocks        int
+	SkippedBlocks int
+	// EstimatedRows is an upper bound on the rows in range passing the
+	// filter.
+	EstimatedRows int64
+}
+
+// Plan returns the execution plan of a query without running it.
+func (s *ColumnarStore) Plan(q *Query) (*Plan, error) {
+	// Parallel cursors split their readers across parts, so the plan is
+	// read from an equivalent cursor over the whole range.
+	serial := *q
+	serial.Parallelism = 0
+	c, err := openCursor(context.Background(), s.fs, &serial)
+	if err != nil {
+		return nil, err
+	}
+	defer c.close()
+	s.fs.lock.Lock()
+	total := s.fs.nextID
+	s.fs.lock.Unlock()
+
+	byIndex, descending := q.ordersByIndex()
+	p := &Plan{
+		TotalRows:    total,
+		Materialized: c.agg != nil || !byIndex || descending || q.Parallelism > 1,
+		Parallelism:  max(q.Parallelism, 1),
+	}
+	if c.parts == nil {
+		p.add(c, true)
+		return p, nil
+	}
+	p.Partitions = len(c.parts)
+	for i, part := range c.parts {
+		p.add(part, i == 0)
+	}
+	return p, nil
+}
+
+// add describes the scan of a cursor, or of a partition by one of several
+// cursors, combining it with the other partitions unless first is set.
+func (p *Plan) add(c *cursor, first bool) {
+	var filters []FilterPlan
+	rows := c.lastID - c.next
+	if c.pred != nil {
+		rows = estimate(c, c.pred, &filters)
+	}
+	if first {
+		p.StartRow, p.EndRow = c.base+c.next, c.base+c.lastID
+		p.Vectorized, p.VectorAggregates = c.batch != nil, c.vectorAgg
+		p.Filters = filters
+	} else {
+		p.EndRow = c.base + c.lastID
+		p.Vectorized = p.Vectorized && c.batch != nil
+		p.VectorAggregates = p.VectorAggregates && c.vectorAgg
+		for i, f := range filters {
+			merged := &p.Filters[i]
+			merged.Column = cmp.Or(merged.Column, f.Column)
+			merged.Index = merged.Index || f.Index
+			merged.Bitmap = merged.Bitmap || f.Bitmap
+			merged.ZoneMap = merged.ZoneMap || f.ZoneMap
+			merged.BloomFilter = merged.BloomFilter || f.BloomFilter
+			merged.Blocks += f.Blocks
+			merged.SkippedBlocks += f.SkippedBlocks
+			merged.EstimatedRows += f.EstimatedRows
+		}
+	}
+	p.Columns = slices.AppendSeq(p.Columns, maps.Keys(c.columns))
+	slices.Sort(p.Columns)
+	p.Columns = slices.Compact(p.Columns)
+	p.Timestamps = p.Timestamps || c.tsReader != nil
+	p.EstimatedRows += rows
+}
+
+// estimate returns an upper bound on the rows in range of a cursor matching a
+// predicate, describing its filters.
+func estimate(c *cursor, pred predicate, filters *[]FilterPlan) int64 {
+	rows := c.lastID - c.next
+	switch pred := pred.(type) {
+	case andPredicate:
+		for _, sub := range pred {
+			rows = min(rows, estimate(c, sub, filters))
+		}
+		return rows
+	case orPredicate:
+		var n int64
+		for _, sub := range pred {
+			n += estimate(c, sub, filters)
+		}
+		return min(rows, n)
+	case notPredicate:
+		estimate(c, pred.p, filters)
+		return rows
+	case bitmapPredicate:
+		return pred.bits.count(c.next, c.lastID)
+	case *compiledFilter:
+		fp := FilterPlan{Filter: pred.Filter, EstimatedRows: rows}
+		var cr *ColumnReader
+		switch r := pred.reader.(type) {
+		case *ColumnReader:
+			cr = r
+		case *pathReader:
+			cr = r.cr
+		case *computedReader:
+			fp.Column = pred.Attribute
+		}
+		for name, col := range c.columns {
+			if col == cr {
+				fp.Column = name
+			}
+		}
+		if pred.reader == nil && pred.Condition != ConditionIsNull {
+			fp.EstimatedRows = 0
+		}
+		if pred.zoned {
+			fp.ZoneMap, fp.BloomFilter = pred.usesZones(), pred.usesBlooms()
+			fp.Blocks, fp.SkippedBlocks, fp.EstimatedRows = zoneEstimate(pred, cr, c.next, c.lastID)
+		}
+		if pred.indexed {
+			fp.Index, fp.Bitmap, fp.EstimatedRows = true, pred.bits != nil, pred.countRows(c.next, c.lastID)
+		}
+		*filters = append(*filters, fp)
+		return fp.EstimatedRows
+	}
+	return rows
+}
+
+// zoneEstimate counts the blocks of a column overlapping the rows
+// [start, end), the blocks a filter's zone map or bloom filters rule out, and
+// the rows in range outside them.
+func zoneEstimate(f *compiledFilter, cr *ColumnReader, start, end int64) (blocks, skipped int, rows int64) {
+	rows = end - start
+	if len(cr.blocks) > 0 {
+		// Rows before the first block hold no values of the column.
+		rows = max(0, min(cr.blocks[0].firstIndex, end)-start)
+	}
+	for b, e := range cr.blocks {
+		blockEnd := end
+		if b+1 < len(cr.blocks) {
+			blockEnd = cr.blocks[b+1].firstIndex
+		}
+		from, to := max(e.firstIndex, start), min(blockEnd, end)
+		if from >= to {
+			continue
+		}
+		blocks++
+		if !f.blockMayMatch(b) {
+			skipped++
+			continue
+		}
+		rows += to - from
+	}
+	return blocks, skipped, rows
+}
+
+// Explain describes the plan in a few lines of text.
+func (p *Plan) Explain() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "scan rows [%d, %d) of %d", p.StartRow, p.EndRow, p.TotalRows)
+	if p.Partitions > 0 {
+		fmt.Fprintf(&b, " in %d partitions", p.Partitions)
+	}
+	if p.Parallelism > 1 {
+		fmt.Fprintf(&b, " with parallelism %d", p.Parallelism)
+	}
+	if p.Materialized {
+		b.WriteString(", materialized")
+	} else {
+		b.WriteString(", streamed")
+	}
+	fmt.Fprintf(&b, "\ncolumns: %s", strings.Join(p.Columns, ", "))
+	if p.Timestamps {
+		b.WriteString(" (and timestamps)")
+	}
+	for _, f := range p.Filters {
+		fmt.Fprintf(&b, "\nfilter %s: ", f.Filter)
+		if f.Column == "" {
+			b.WriteString("no column")
+		} else {
+			fmt.Fprintf(&b, "column %s", f.Column)
+		}
+		switch {
+		case f.Bitmap:
+			b.WriteString(", bitmap index")
+		case f.Index:
+			b.WriteString(", value index")
+		}
+		switch {
+		case f.ZoneMap && f.BloomFilter:
+			fmt.Fprintf(&b, ", zone map and bloom filters skip %d of %d blocks", f.SkippedBlocks, f.Blocks)
+		case f.ZoneMap:
+			fmt.Fprintf(&b, ", zone map skips %d of %d blocks", f.SkippedBlocks, f.Blocks)
+		case f.BloomFilter:
+			fmt.Fprintf(&b, ", bloom filters skip %d of %d blocks", f.SkippedBlocks, f.Blocks)
+		}
+		fmt.Fprintf(&b, ", at most %d rows", f.EstimatedRows)
+	}
+	if len(p.Filters) > 0 {
+		if p.Vectorized {
+			b.WriteString("\nfilters evaluated in batches")
+		} else {
+			b.WriteString("\nfilters evaluated row by row")
+		}
+	}
+	if p.VectorAggregates {
+		b.WriteString("\naggregates computed in batches")
+	}
+	fmt.Fprintf(&b, "\nestimated rows: at most %d", p.EstimatedRows)
+	return b.String()
+}
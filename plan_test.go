@@ -0,0 +1,43 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 10
+
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := range 40 {
+		rows = append(rows, map[string]any{"val": i, "doc": map[string]any{"a": i}})
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	p, err := cs.Plan(&Query{Select: []string{"doc"}, Where: Or(Where("val", ConditionGreaterThanOrEquals, 35), Where("val", ConditionLessThan, 2))})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc", "val"}, p.Columns)
+	assert.True(t, p.Vectorized)
+	assert.False(t, p.Materialized)
+	require.Len(t, p.Filters, 2)
+	assert.Equal(t, FilterPlan{Filter: Filter{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 35}, Column: "val", ZoneMap: true, Blocks: 4, SkippedBlocks: 3, EstimatedRows: 10}, p.Filters[0])
+	assert.Equal(t, int64(20), p.EstimatedRows)
+
+	p, err = cs.Plan(&Query{Parallelism: 2, Aggregations: []Aggregation{{Type: AggregatorCount}}, Where: And(Where("doc.a", ConditionEquals, 3), Where("val", ConditionEquals, 3))})
+	require.NoError(t, err)
+	assert.False(t, p.Vectorized)
+	assert.True(t, p.Materialized)
+	assert.Equal(t, "doc", p.Filters[0].Column)
+	assert.False(t, p.Filters[0].ZoneMap)
+	assert.Equal(t, int64(10), p.EstimatedRows)
+	assert.Equal(t, `scan rows [0, 40) of 40 with parallelism 2, materialized
+columns: doc, val
+filter doc.a = 3: column doc, at most 40 rows
+filter val = 3: column val, zone map skips 3 of 4 blocks, at most 10 rows
+filters evaluated row by row
+estimated rows: at most 10`, p.Explain())
+}
@@ -0,0 +1,118 @@
+package querystore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ColumnPolicy restricts a sensitive column in queries not run with
+// Query.Authorized, such as those served by HTTPHandler. Such queries may
+// only select the column, not filter, group, order or aggregate by it, and
+// "*" selects it only if it is masked. Policies of JSON columns also restrict
+// the paths within them.
+type ColumnPolicy struct {
+	Column string
+	// Mask returns the value returned in place of each of the column's
+	// values, such as MaskRedact or MaskHash. Without a mask the column is
+	// left out of results, and selecting it fails.
+	Mask func(v any) any
+}
+
+// redacted replaces the values of columns masked with MaskRedact.
+const redacted = "[redacted]"
+
+// MaskRedact masks every value as "[redacted]".
+func MaskRedact(v any) any {
+	return redacted
+}
+
+// MaskHash returns a mask replacing values with a hex HMAC-SHA256 of them
+// under key, so that equal values can still be matched without being
+// revealed.
+func MaskHash(key []byte) func(v any) any {
+	return func(v any) any {
+		mac := hmac.New(sha256.New, key)
+		fmt.Fprint(mac, v)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+}
+
+// policyFor returns the policy restricting an attribute, which is a column
+// or a path within a JSON column, or nil if it is unrestricted.
+func (fs *ColumnFS) policyFor(attr string) *ColumnPolicy {
+	for i, p := range fs.opts.ColumnPolicies {
+		if attr == p.Column || strings.HasPrefix(attr, p.Column+".") {
+			return &fs.opts.ColumnPolicies[i]
+		}
+	}
+	return nil
+}
+
+// checkPolicies fails if a query not run with Query.Authorized uses a
+// restricted column other than by selecting a masked one.
+func (fs *ColumnFS) checkPolicies(q *Query) error {
+	if q.Authorized || len(fs.opts.ColumnPolicies) == 0 {
+		return nil
+	}
+	var used []string
+	q.filterExpression().walkFilters(func(f Filter) {
+		used = append(used, f.Attribute)
+	})
+	for _, a := range q.aggregations() {
+		used = append(used, a.columns()...)
+	}
+	used = append(used, q.groupColumns()...)
+	used = append(used, q.GroupByTimeColumn)
+	for _, o := range q.OrderBy {
+		used = append(used, o.Attribute)
+	}
+	used = append(used, q.enrichColumns()...)
+	for _, c := range q.Computed {
+		e, err := parseExpr(c.Expr)
+		if err != nil {
+			return fmt.Errorf("computed column %s: %w", c.Name, err)
+		}
+		used = append(used, e.columns()...)
+	}
+	for _, col := range used {
+		if fs.policyFor(col) != nil {
+			return fmt.Errorf("column %s is restricted", col)
+		}
+	}
+	for _, col := range q.Select {
+		if p := fs.policyFor(col); p != nil && p.Mask == nil {
+			return fmt.Errorf("column %s is restricted", col)
+		}
+	}
+	return nil
+}
+
+// restrictSelected leaves the columns without a mask out of the selected
+// columns of an unauthorized query, and returns the masks of the others.
+func (fs *ColumnFS) restrictSelected(q *Query, selected []string) ([]string, map[string]func(any) any) {
+	if q.Authorized || len(fs.opts.ColumnPolicies) == 0 {
+		return selected, nil
+	}
+	masks := map[string]func(any) any{}
+	selected = slices.DeleteFunc(selected, func(col string) bool {
+		p := fs.policyFor(col)
+		if p != nil && p.Mask != nil {
+			masks[col] = p.Mask
+		}
+		return p != nil && p.Mask == nil
+	})
+	return selected, masks
+}
+
+// maskRow replaces the values of masked columns in a result row.
+func (c *cursor) maskRow(out map[string]any) {
+	for col, mask := range c.masks {
+		if v := out[col]; v != nil {
+			out[col] = mask(v)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package querystore
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestColumnPolicies(t *testing.T) {
+	key := []byte("pepper")
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{
+		ColumnPolicies: []ColumnPolicy{
+			{Column: "ssn"},
+			{Column: "email", Mask: MaskHash(key)},
+			{Column: "name", Mask: MaskRedact},
+		},
+	})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"ssn": "123-45-6789", "email": "a@example.com", "name": "Ada", "age": int64(36)},
+		{"ssn": "987-65-4321", "email": "b@example.com", "name": "Bob", "age": int64(41)},
+	}))
+
+	res, err := cs.Query(&Query{Select: []string{"*"}, Filters: []Filter{{Attribute: "age", Condition: ConditionGreaterThan, Value: int64(40)}}})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.NotContains(t, res[0], "ssn")
+	assert.Equal(t, "[redacted]", res[0]["name"])
+	assert.Equal(t, MaskHash(key)("b@example.com"), res[0]["email"])
+	assert.Equal(t, int64(41), res[0]["age"])
+
+	for _, q := range []*Query{
+		{Select: []string{"ssn"}},
+		{Select: []string{"age"}, Filters: []Filter{{Attribute: "email", Condition: ConditionEquals, Value: "a@example.com"}}},
+		{Aggregations: []Aggregation{{Type: AggregatorCount}}, GroupBy: "name"},
+		{Select: []string{"age"}, OrderBy: []Order{{Attribute: "ssn"}}},
+		{Select: []string{"digits"}, Computed: []ComputedColumn{{Name: "digits", Expr: "ssn"}}},
+	} {
+		_, err := cs.Query(q)
+		assert.ErrorContains(t, err, "is restricted")
+	}
+
+	res, err = cs.Query(&Query{Select: []string{"ssn", "name"}, Filters: []Filter{{Attribute: "email", Condition: ConditionEquals, Value: "a@example.com"}}, Authorized: true})
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, "123-45-6789", res[0]["ssn"])
+	assert.Equal(t, "Ada", res[0]["name"])
+
+	server := httptest.NewServer(HTTPHandler(cs))
+	defer server.Close()
+	resp, err := http.Post(server.URL+"/query", "application/json", strings.NewReader(`{"select":["ssn"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
@@ -0,0 +1,175 @@
+package querystore
+
+import (
+	"context"
+	"slices"
+)
+
+// PreparedQuery is a query checked and compiled once by
+// ColumnarStore.Prepare, to be run repeatedly as rows are appended, as
+// dashboards polling a store do. Each run reads the rows committed when it
+// starts, as a query does. It is safe for concurrent use.
+type PreparedQuery struct {
+	s *ColumnarStore
+	q Query
+}
+
+// queryPlan holds the parts of a prepared query compiled once.
+type queryPlan struct {
+	// bound holds each filter of the query, with its regular expression
+	// compiled and its value converted for the type of its column when
+	// prepared. Runs reading a column of another type convert it again.
+	bound map[*Filter]*compiledFilter
+	// json is the JSON form of the query, keying its cached results.
+	json string
+}
+
+// filters returns the prepared filters, or nil if the query is not prepared.
+func (p *queryPlan) filters() map[*Filter]*compiledFilter {
+	if p == nil {
+		return nil
+	}
+	return p.bound
+}
+
+// Prepare checks and compiles a query, so that running it repeatedly skips
+// checking its column policies, compiling its regular expressions, and
+// converting its filter values and IN lists. The query is copied, so later
+// changes to q do not affect it. Errors a query reports when run regardless
+// of the rows, such as those of unsupported conditions or malformed computed
+// columns, are reported by Prepare.
+func (s *ColumnarStore) Prepare(q *Query) (*PreparedQuery, error) {
+	p := *q
+	p.Select = slices.Clone(q.Select)
+	p.Computed = slices.Clone(q.Computed)
+	p.Enrichers = slices.Clone(q.Enrichers)
+	p.Aggregations = slices.Clone(q.Aggregations)
+	p.GroupByColumns = slices.Clone(q.GroupByColumns)
+	p.OrderBy = slices.Clone(q.OrderBy)
+	// Filters are keyed by their place in the expression, so the query's
+	// filters are folded into a copy of it.
+	p.Where, p.Filters = q.filterExpression().clone(), nil
+	plan := &queryPlan{bound: map[*Filter]*compiledFilter{}}
+	b, err := EncodeQueryJSON(&p)
+	if err != nil {
+		return nil, err
+	}
+	plan.json = string(b)
+	if _, err := newQueryAggregates(&p, nil); err != nil {
+		return nil, err
+	}
+
+	fs := s.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.checkPolicies(&p); err != nil {
+		return nil, err
+	}
+	computed, err := compileComputed(p.Computed, fs.exprColumnType)
+	if err != nil {
+		return nil, err
+	}
+	var leaves []*Filter
+	p.Where.walkFilterPointers(func(f *Filter) {
+		leaves = append(leaves, f)
+	})
+	for _, f := range leaves {
+		cf := &compiledFilter{Filter: *f, given: f.Condition}
+		if f.Condition == ConditionMatches {
+			if cf.value, err = compileRegexp(f.Value); err != nil {
+				return nil, err
+			}
+		}
+		if f.Condition != ConditionIsNull && f.Condition != ConditionIsNotNull {
+			if typ, ok := fs.preparedType(f.Attribute, computed); ok {
+				if err := cf.bind(typ); err != nil {
+					return nil, err
+				}
+			}
+		}
+		plan.bound[f] = cf
+	}
+	p.plan = plan
+	return &PreparedQuery{s: s, q: p}, nil
+}
+
+// preparedType returns the type of a stored or computed column, or false if
+// the query names no such column or a path within a JSON column, whose
+// filters bind to the type of each value. Partitioned stores report the
+// types of their latest partition. The caller must hold fs.lock.
+func (fs *ColumnFS) preparedType(attr string, computed map[string]*expr) (ColumnType, bool) {
+	if e, ok := computed[attr]; ok {
+		if e == nil {
+			return 0, false
+		}
+		return e.typ, true
+	}
+	if len(fs.partitions) > 0 {
+		latest := fs.partitions[len(fs.partitions)-1].fs
+		latest.lock.Lock()
+		defer latest.lock.Unlock()
+		return latest.preparedType(attr, nil)
+	}
+	if ch := fs.columnHandles[attr]; ch != nil {
+		return ch.typ, true
+	}
+	return 0, false
+}
+
+// Query runs the prepared query. See ColumnarStore.Query.
+func (p *PreparedQuery) Query() ([]map[string]any, error) {
+	return p.s.QueryContext(context.Background(), &p.q)
+}
+
+// QueryContext is Query with a context.
+func (p *PreparedQuery) QueryContext(ctx context.Context) ([]map[string]any, error) {
+	return p.s.QueryContext(ctx, &p.q)
+}
+
+// QueryIter runs the prepared query, returning an iterator over its results.
+// See ColumnarStore.QueryIter.
+func (p *PreparedQuery) QueryIter() (*Rows, error) {
+	return p.s.QueryIterContext(context.Background(), &p.q)
+}
+
+// QueryIterContext is QueryIter with a context.
+func (p *PreparedQuery) QueryIterContext(ctx context.Context) (*Rows, error) {
+	return p.s.QueryIterContext(ctx, &p.q)
+}
+
+// clone returns a deep copy of an expression, or nil if e is nil.
+func (e *FilterExpression) clone() *FilterExpression {
+	if e == nil {
+		return nil
+	}
+	c := &FilterExpression{Not: e.Not.clone()}
+	if e.Filter != nil {
+		f := *e.Filter
+		c.Filter = &f
+	}
+	for _, sub := range e.And {
+		c.And = append(c.And, sub.clone())
+	}
+	for _, sub := range e.Or {
+		c.Or = append(c.Or, sub.clone())
+	}
+	return c
+}
+
+// walkFilterPointers is walkFilters, passing each filter leaf in place.
+func (e *FilterExpression) walkFilterPointers(fn func(f *Filter)) {
+	switch {
+	case e == nil:
+	case e.Filter != nil:
+		fn(e.Filter)
+	case e.Not != nil:
+		e.Not.walkFilterPointers(fn)
+	default:
+		for _, sub := range e.And {
+			sub.walkFilterPointers(fn)
+		}
+		for _, sub := range e.Or {
+			sub.walkFilterPointers(fn)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package querystore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepare(t *testing.T) {
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{ColumnPolicies: []ColumnPolicy{{Column: "secret"}}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"n": int64(i), "s": fmt.Sprint("host-", i%3), "secret": "x"}))
+	}
+	q := &Query{
+		Filters:      []Filter{{Attribute: "s", Condition: ConditionMatches, Value: "^host-[01]$"}},
+		Where:        Where("n", ConditionIn, []int{1, 2, 3, 4, 12}),
+		Aggregations: []Aggregation{{Type: AggregatorCount, Attribute: "n"}},
+	}
+	p, err := cs.Prepare(q)
+	require.NoError(t, err)
+	q.Where.Filter.Value = []int{}
+	res, err := p.Query()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), res[0]["count(n)"], "later changes to the query are ignored")
+
+	for i := 10; i < 13; i++ {
+		require.NoError(t, cs.Append(map[string]any{"n": int64(i), "s": fmt.Sprint("host-", i%3)}))
+	}
+	it, err := p.QueryIter()
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	assert.Equal(t, int64(4), it.Row()["count(n)"], "runs read the rows appended since")
+	require.NoError(t, it.Close())
+
+	_, err = cs.Prepare(&Query{Where: Where("s", ConditionMatches, "(")})
+	assert.Error(t, err)
+	_, err = cs.Prepare(&Query{Where: Where("secret", ConditionEquals, "x")})
+	assert.ErrorContains(t, err, "restricted")
+	_, err = cs.Prepare(&Query{Where: Where("n", ConditionEquals, []int{1})})
+	assert.Error(t, err)
+}
@@ -0,0 +1,259 @@
+// Service definition for serving a querystore over gRPC.
+//
+// Messages mirror the JSON forms served by querystore.HTTPHandler: rows and
+// filter values are google.protobuf.Struct and Value, and queries take the
+// fields read by querystore.DecodeQueryJSON. querystore.GRPCServer serves it,
+// and the code of package querystorepb is generated with protoc-gen-go and
+// protoc-gen-go-grpc:
+//
+//	protoc --go_out=. --go_opt=module=github.com/davidbyttow/querystore \
+//	  --go-grpc_out=. --go-grpc_opt=module=github.com/davidbyttow/querystore \
+//	  proto/querystore.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: proto/querystore.proto
+
+package querystorepb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	QueryStore_Append_FullMethodName      = "/querystore.v1.QueryStore/Append"
+	QueryStore_AppendBatch_FullMethodName = "/querystore.v1.QueryStore/AppendBatch"
+	QueryStore_Query_FullMethodName       = "/querystore.v1.QueryStore/Query"
+	QueryStore_Schema_FullMethodName      = "/querystore.v1.QueryStore/Schema"
+)
+
+// QueryStoreClient is the client API for QueryStore service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type QueryStoreClient interface {
+	// Append appends a single row.
+	Append(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error)
+	// AppendBatch appends rows atomically, as ColumnarStore.AppendBatch does.
+	AppendBatch(ctx context.Context, in *AppendBatchRequest, opts ...grpc.CallOption) (*AppendResponse, error)
+	// Query streams the rows matched by a query as they are read.
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Row], error)
+	// Schema describes the columns of the store.
+	Schema(ctx context.Context, in *SchemaRequest, opts ...grpc.CallOption) (*SchemaResponse, error)
+}
+
+type queryStoreClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewQueryStoreClient(cc grpc.ClientConnInterface) QueryStoreClient {
+	return &queryStoreClient{cc}
+}
+
+func (c *queryStoreClient) Append(ctx context.Context, in *AppendRequest, opts ...grpc.CallOption) (*AppendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendResponse)
+	err := c.cc.Invoke(ctx, QueryStore_Append_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queryStoreClient) AppendBatch(ctx context.Context, in *AppendBatchRequest, opts ...grpc.CallOption) (*AppendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(AppendResponse)
+	err := c.cc.Invoke(ctx, QueryStore_AppendBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *queryStoreClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Row], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &QueryStore_ServiceDesc.Streams[0], QueryStore_Query_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[QueryRequest, Row]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type QueryStore_QueryClient = grpc.ServerStreamingClient[Row]
+
+func (c *queryStoreClient) Schema(ctx context.Context, in *SchemaRequest, opts ...grpc.CallOption) (*SchemaResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SchemaResponse)
+	err := c.cc.Invoke(ctx, QueryStore_Schema_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// QueryStoreServer is the server API for QueryStore service.
+// All implementations must embed UnimplementedQueryStoreServer
+// for forward compatibility.
+type QueryStoreServer interface {
+	// Append appends a single row.
+	Append(context.Context, *AppendRequest) (*AppendResponse, error)
+	// AppendBatch appends rows atomically, as ColumnarStore.AppendBatch does.
+	AppendBatch(context.Context, *AppendBatchRequest) (*AppendResponse, error)
+	// Query streams the rows matched by a query as they are read.
+	Query(*QueryRequest, grpc.ServerStreamingServer[Row]) error
+	// Schema describes the columns of the store.
+	Schema(context.Context, *SchemaRequest) (*SchemaResponse, error)
+	mustEmbedUnimplementedQueryStoreServer()
+}
+
+// UnimplementedQueryStoreServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedQueryStoreServer struct{}
+
+func (UnimplementedQueryStoreServer) Append(context.Context, *AppendRequest) (*AppendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Append not implemented")
+}
+func (UnimplementedQueryStoreServer) AppendBatch(context.Context, *AppendBatchRequest) (*AppendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AppendBatch not implemented")
+}
+func (UnimplementedQueryStoreServer) Query(*QueryRequest, grpc.ServerStreamingServer[Row]) error {
+	return status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedQueryStoreServer) Schema(context.Context, *SchemaRequest) (*SchemaResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Schema not implemented")
+}
+func (UnimplementedQueryStoreServer) mustEmbedUnimplementedQueryStoreServer() {}
+func (UnimplementedQueryStoreServer) testEmbeddedByValue()                    {}
+
+// UnsafeQueryStoreServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to QueryStoreServer will
+// result in compilation errors.
+type UnsafeQueryStoreServer interface {
+	mustEmbedUnimplementedQueryStoreServer()
+}
+
+func RegisterQueryStoreServer(s grpc.ServiceRegistrar, srv QueryStoreServer) {
+	// If the following call pancis, it indicates UnimplementedQueryStoreServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&QueryStore_ServiceDesc, srv)
+}
+
+func _QueryStore_Append_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryStoreServer).Append(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QueryStore_Append_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryStoreServer).Append(ctx, req.(*AppendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QueryStore_AppendBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AppendBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryStoreServer).AppendBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QueryStore_AppendBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryStoreServer).AppendBatch(ctx, req.(*AppendBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _QueryStore_Query_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(QueryRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(QueryStoreServer).Query(m, &grpc.GenericServerStream[QueryRequest, Row]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type QueryStore_QueryServer = grpc.ServerStreamingServer[Row]
+
+func _QueryStore_Schema_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SchemaRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(QueryStoreServer).Schema(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: QueryStore_Schema_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(QueryStoreServer).Schema(ctx, req.(*SchemaRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// QueryStore_ServiceDesc is the grpc.ServiceDesc for QueryStore service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var QueryStore_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "querystore.v1.QueryStore",
+	HandlerType: (*QueryStoreServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Append",
+			Handler:    _QueryStore_Append_Handler,
+		},
+		{
+			MethodName: "AppendBatch",
+			Handler:    _QueryStore_AppendBatch_Handler,
+		},
+		{
+			MethodName: "Schema",
+			Handler:    _QueryStore_Schema_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Query",
+			Handler:       _QueryStore_Query_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/querystore.proto",
+}
@@ -1,5 +1,19 @@
 package querystore
 
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/samber/lo"
+)
+
 type ConditionType int
 
 const (
@@ -7,26 +21,394 @@ const (
 	ConditionNotEquals
 	ConditionLessThan
 	ConditionGreaterThan
+	ConditionGreaterThanOrEquals
+	ConditionLessThanOrEquals
+	ConditionContains
+	ConditionStartsWith
+	ConditionEndsWith
+	// ConditionIn and ConditionNotIn take a slice of values as Filter.Value.
+	ConditionIn
+	ConditionNotIn
+	// ConditionMatches takes a regular expression, as a string or a
+	// *regexp.Regexp, and matches it against string columns.
+	ConditionMatches
+	// ConditionIsNull matches rows whose value is null or absent, and
+	// ConditionIsNotNull rows that have a value. Both ignore Filter.Value.
+	ConditionIsNull
+	ConditionIsNotNull
 )
 
+var conditionNames = map[ConditionType]string{
+	ConditionEquals:              "=",
+	ConditionNotEquals:           "!=",
+	ConditionLessThan:            "<",
+	ConditionGreaterThan:         ">",
+	ConditionGreaterThanOrEquals: ">=",
+	ConditionLessThanOrEquals:    "<=",
+	ConditionContains:            "contains",
+	ConditionStartsWith:          "starts with",
+	ConditionEndsWith:            "ends with",
+	ConditionIn:                  "in",
+	ConditionNotIn:               "not in",
+	ConditionMatches:             "matches",
+	ConditionIsNull:              "is null",
+	ConditionIsNotNull:           "is not null",
+}
+
+func (t ConditionType) String() string {
+	if name, ok := conditionNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("ConditionType(%d)", int(t))
+}
+
 type AggregatorType int
 
 const (
 	AggregatorCount AggregatorType = iota
 	AggregatorSum
+	AggregatorMin
+	AggregatorMax
+	AggregatorAvg
+	// AggregatorPercentile estimates the Percentile of a numeric column,
+	// within 1% of the true value.
+	AggregatorPercentile
+	// AggregatorHistogram counts the values of a numeric column in the
+	// buckets bounded by Buckets.
+	AggregatorHistogram
+	// AggregatorTopK returns the K most frequent values of a column, or those
+	// with the greatest sum of their Weight column, as a list of maps holding
+	// each value in "value" and its count in "count", or sum in "sum", most
+	// frequent first. Values are counted with the Space-Saving algorithm in
+	// memory bounded by K, so the counts of values that are not among the
+	// most frequent by a wide margin may be overestimated.
+	AggregatorTopK
+	// AggregatorApproxDistinct estimates the number of distinct values of a
+	// column with a HyperLogLog sketch, within about 2%, in memory
+	// independent of the count. Columns whose schema keeps distinct sketches
+	// are estimated from the sketches of their blocks.
+	AggregatorApproxDistinct
 )
 
+var aggregatorNames = map[AggregatorType]string{
+	AggregatorCount: "count",
+	AggregatorSum:   "sum",
+	AggregatorMin:   "min",
+	AggregatorMax:   "max",
+	AggregatorAvg:   "avg",
+
+	AggregatorPercentile: "percentile",
+	AggregatorHistogram:  "histogram",
+	AggregatorTopK:       "top",
+
+	AggregatorApproxDistinct: "approx_distinct",
+}
+
+func (t AggregatorType) String() string {
+	if name, ok := aggregatorNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("AggregatorType(%d)", int(t))
+}
+
 type Filter struct {
 	Attribute string
 	Condition ConditionType
 	Value     any
 }
 
+func (f Filter) String() string {
+	if f.Condition == ConditionIsNull || f.Condition == ConditionIsNotNull {
+		return f.Attribute + " " + f.Condition.String()
+	}
+	return fmt.Sprintf("%s %s %v", f.Attribute, f.Condition, f.Value)
+}
+
+// Aggregation computes a single aggregate over the rows matched by a query.
+// An empty Attribute is only meaningful for AggregatorCount, where it counts
+// every matched row.
+type Aggregation struct {
+	Type      AggregatorType
+	Attribute string
+	// Alias names the result field. Defaults to e.g. "count", "sum(val)" or
+	// "p95(val)".
+	Alias string
+	// Percentile is the percentile computed by AggregatorPercentile, from 0
+	// to 100.
+	Percentile float64
+	// Buckets are the ascending upper bounds of the buckets of
+	// AggregatorHistogram, whose result holds the count of values in each,
+	// that is, of the values up to Buckets[0], then those up to Buckets[1],
+	// and so on, with a last count of those above every bound.
+	Buckets []float64
+	// K is the number of values returned by AggregatorTopK.
+	K int
+	// Weight, if set, names the numeric column whose sum over the rows
+	// holding a value ranks it for AggregatorTopK, in place of their count.
+	Weight string
+}
+
+// Name returns the key under which the aggregation's result is reported.
+func (a Aggregation) Name() string {
+	if a.Alias != "" {
+		return a.Alias
+	}
+	name := a.Type.String()
+	switch a.Type {
+	case AggregatorPercentile:
+		name = "p" + strconv.FormatFloat(a.Percentile, 'g', -1, 64)
+	case AggregatorTopK:
+		name = "top" + strconv.Itoa(a.K)
+	}
+	if a.Attribute == "" {
+		return name
+	}
+	if a.Weight != "" {
+		return name + "(" + a.Attribute + ", " + a.Weight + ")"
+	}
+	return name + "(" + a.Attribute + ")"
+}
+
+// columns returns the columns the aggregation reads.
+func (a Aggregation) columns() []string {
+	var cols []string
+	for _, col := range []string{a.Attribute, a.Weight} {
+		if col != "" {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// TimeRange restricts a query to rows appended within [Start, End). A zero
+// Start or End leaves that side of the range unbounded.
+type TimeRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (r TimeRange) IsZero() bool {
+	return r.Start.IsZero() && r.End.IsZero()
+}
+
+// contains reports whether a stored UnixNano timestamp falls within the range.
+func (r TimeRange) contains(ts int64) bool {
+	if !r.Start.IsZero() && ts < r.Start.UnixNano() {
+		return false
+	}
+	if !r.End.IsZero() && ts >= r.End.UnixNano() {
+		return false
+	}
+	return true
+}
+
+// TimeBucketColumn holds the start of the interval of each row of an
+// aggregate query grouped by time.
+const TimeBucketColumn = "time"
+
+// Order sorts query results by a column, which may be a result column of an
+// aggregate query such as "count" or "sum(val)".
+type Order struct {
+	Attribute  string
+	Descending bool
+}
+
+// ErrInvalidQuery is wrapped by the errors of queries that cannot run as
+// given, such as filters with values their column cannot hold, rather than
+// failing to read the store.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// invalidQueryError wraps an error making a query invalid, keeping its
+// message.
+type invalidQueryError struct {
+	err error
+}
+
+func (e invalidQueryError) Error() string   { return e.err.Error() }
+func (e invalidQueryError) Unwrap() []error { return []error{ErrInvalidQuery, e.err} }
+
+// invalidQuery returns err wrapping ErrInvalidQuery, or nil if err is nil.
+func invalidQuery(err error) error {
+	if err == nil || errors.Is(err, ErrInvalidQuery) {
+		return err
+	}
+	return invalidQueryError{err}
+}
+
 type Query struct {
-	Aggregator          AggregatorType
+	// Deprecated: use Aggregations.
+	Aggregator AggregatorType
+	// Deprecated: use Aggregations.
 	AggregatorAttribute string
-	Filters             []Filter
-	GroupBy             string
+	// Select lists the columns to return for each matched row; "*" selects
+	// every column in the store. When empty, rows hold the filtered columns.
+	// Ignored by aggregate queries.
+	Select []string
+	// Computed defines columns computed from the stored ones, which the rest
+	// of the query may name like stored columns.
+	Computed []ComputedColumn
+	// Enrichers add virtual columns to the rows of row queries once they
+	// are matched, which the results may be ordered by. Ignored by
+	// aggregate queries.
+	Enrichers    []Enricher
+	Aggregations []Aggregation
+	Filters      []Filter
+	// Where is an optional filter expression, ANDed with Filters.
+	Where *FilterExpression
+	// GroupBy computes aggregations for each value of a column, and
+	// GroupByColumns for each combination of values of several, after that
+	// of GroupBy if both are set. Results hold the value of each column.
+	GroupBy        string
+	GroupByColumns []string
+	// GroupByTime, if positive, also computes aggregations for each interval
+	// of this length, reporting its start in TimeBucketColumn. Intervals are
+	// of the time rows were appended, or of the column named by
+	// GroupByTimeColumn, which holds times or nanoseconds since the epoch;
+	// rows without such a value are left out.
+	GroupByTime       time.Duration
+	GroupByTimeColumn string
+	TimeRange         TimeRange
+	OrderBy           []Order
+	// Limit caps the number of returned rows when positive, after skipping
+	// the first Offset rows.
+	Limit  int
+	Offset int
+	// Parallelism is the number of goroutines that scan the rows of the
+	// query, each over its own range of rows. Values of one or less scan on
+	// the calling goroutine. Parallel queries are computed in full before the
+	// first row is returned.
+	Parallelism int
+	// ReuseRows makes streamed queries return the same map for every row,
+	// which is only valid until the next call to Rows.Next. It saves an
+	// allocation per row on large scans.
+	ReuseRows bool
+	// Authorized runs the query without the restrictions of the store's
+	// column policies. Queries decoded by DecodeQueryJSON are never
+	// authorized. See ColumnPolicy.
+	Authorized bool
+	// plan holds the parts of the query compiled by ColumnarStore.Prepare.
+	plan *queryPlan
+}
+
+// aggregations returns the aggregations to compute for the query, folding in
+// the legacy single Aggregator/AggregatorAttribute pair.
+func (q *Query) aggregations() []Aggregation {
+	if len(q.Aggregations) > 0 {
+		return q.Aggregations
+	}
+	if q.AggregatorAttribute != "" {
+		return []Aggregation{{Type: q.Aggregator, Attribute: q.AggregatorAttribute}}
+	}
+	return nil
+}
+
+// groupColumns returns the columns the query groups by.
+func (q *Query) groupColumns() []string {
+	if q.GroupBy == "" {
+		return q.GroupByColumns
+	}
+	return append([]string{q.GroupBy}, q.GroupByColumns...)
+}
+
+// filterExpression combines Filters and Where into a single expression, or
+// returns nil if the query matches every row.
+func (q *Query) filterExpression() *FilterExpression {
+	var exprs []*FilterExpression
+	for _, f := range q.Filters {
+		exprs = append(exprs, &FilterExpression{Filter: &f})
+	}
+	if q.Where != nil {
+		exprs = append(exprs, q.Where)
+	}
+	switch len(exprs) {
+	case 0:
+		return nil
+	case 1:
+		return exprs[0]
+	}
+	return And(exprs...)
+}
+
+// ordersByIndex reports whether results are ordered by append order, which
+// lets row queries stop scanning once enough rows are collected. Timestamps
+// are assigned in append order, so ordering by them is equivalent.
+func (q *Query) ordersByIndex() (ok bool, descending bool) {
+	switch len(q.OrderBy) {
+	case 0:
+		return true, false
+	case 1:
+		o := q.OrderBy[0]
+		return o.Attribute == IndexColumn || o.Attribute == TimestampColumn, o.Descending
+	}
+	return false, false
+}
+
+// sortRows orders rows in place by the query's OrderBy columns.
+func (q *Query) sortRows(rows []map[string]any) {
+	if len(q.OrderBy) == 0 {
+		return
+	}
+	slices.SortStableFunc(rows, func(a, b map[string]any) int {
+		for _, o := range q.OrderBy {
+			c := compareNullable(a[o.Attribute], b[o.Attribute])
+			if o.Descending {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+}
+
+// sortColumns returns the columns rows are ordered by that would otherwise be
+// missing from them: those not selected, or not looked up by enrichers if
+// selected is nil. Index, timestamp and enriched columns are in every row.
+func (q *Query) sortColumns(selected []string) []string {
+	if selected == nil {
+		selected = q.enrichColumns()
+	}
+	var cols []string
+	for _, o := range q.OrderBy {
+		col := o.Attribute
+		switch {
+		case col == IndexColumn || col == TimestampColumn:
+		case slices.Contains(selected, col) || slices.Contains(cols, col):
+		case slices.ContainsFunc(q.Enrichers, func(e Enricher) bool { return slices.Contains(e.Columns, col) }):
+		default:
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// paginate applies Offset and Limit to sorted rows.
+func (q *Query) paginate(rows []map[string]any) []map[string]any {
+	if q.Offset > 0 {
+		rows = rows[min(q.Offset, len(rows)):]
+	}
+	if q.Limit > 0 && len(rows) > q.Limit {
+		rows = rows[:q.Limit]
+	}
+	return rows
+}
+
+// selectedColumns expands Select against the columns known to fs, returning
+// nil if the query has no projection.
+func (q *Query) selectedColumns(fs *ColumnFS) []string {
+	if len(q.Select) == 0 {
+		return nil
+	}
+	var cols []string
+	for _, col := range q.Select {
+		if col == "*" {
+			cols = append(cols, fs.columnNames()...)
+		} else {
+			cols = append(cols, col)
+		}
+	}
+	return lo.Uniq(cols)
 }
 
 type ConditionalFunc func(a, b any) bool
@@ -43,26 +425,156 @@ func anyNotEquals[T comparable]() ConditionalFunc {
 	}
 }
 
+func anyLess[T cmp.Ordered]() ConditionalFunc {
+	return func(a, b any) bool {
+		return a.(T) < b.(T)
+	}
+}
+
+func anyLessOrEquals[T cmp.Ordered]() ConditionalFunc {
+	return func(a, b any) bool {
+		return a.(T) <= b.(T)
+	}
+}
+
+func anyGreater[T cmp.Ordered]() ConditionalFunc {
+	return func(a, b any) bool {
+		return a.(T) > b.(T)
+	}
+}
+
+func anyGreaterOrEquals[T cmp.Ordered]() ConditionalFunc {
+	return func(a, b any) bool {
+		return a.(T) >= b.(T)
+	}
+}
+
+// valueSet holds the values of an IN filter, cast to the column's type.
+type valueSet map[any]struct{}
+
+func newValueSet(v any, typ ColumnType) (valueSet, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("IN filter value must be a slice, got %T", v)
+	}
+	set := make(valueSet, rv.Len())
+	for i := range rv.Len() {
+		// Fractional values are equal to no integer.
+		if _, ok := fractionalValue(rv.Index(i).Interface()); ok && isIntegerType(typ) {
+			continue
+		}
+		v, err := convertValue(rv.Index(i).Interface(), typ)
+		if err != nil {
+			return nil, err
+		}
+		set[v] = struct{}{}
+	}
+	return set, nil
+}
+
+func inSet(a, b any) bool {
+	_, ok := b.(valueSet)[a]
+	return ok
+}
+
+func notInSet(a, b any) bool {
+	return !inSet(a, b)
+}
+
+func timeCompare(pred func(c int) bool) ConditionalFunc {
+	return func(a, b any) bool {
+		return pred(a.(time.Time).Compare(b.(time.Time)))
+	}
+}
+
 var conditionals = map[ConditionType]map[ColumnType]ConditionalFunc{
 	ConditionEquals: {
 		ColumnTypeBool:    anyEquals[bool](),
 		ColumnTypeInt64:   anyEquals[int64](),
+		ColumnTypeInt32:   anyEquals[int64](),
 		ColumnTypeFloat64: anyEquals[float64](),
 		ColumnTypeString:  anyEquals[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c == 0 }),
+		ColumnTypeUint64:  anyEquals[uint64](),
 	},
 	ConditionNotEquals: {
 		ColumnTypeBool:    anyNotEquals[bool](),
 		ColumnTypeInt64:   anyNotEquals[int64](),
+		ColumnTypeInt32:   anyNotEquals[int64](),
 		ColumnTypeFloat64: anyNotEquals[float64](),
 		ColumnTypeString:  anyNotEquals[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c != 0 }),
+		ColumnTypeUint64:  anyNotEquals[uint64](),
 	},
 	ConditionLessThan: {
-		ColumnTypeInt64:   func(a, b any) bool { return a.(int64) < b.(int64) },
-		ColumnTypeFloat64: func(a, b any) bool { return a.(float64) < b.(float64) },
+		ColumnTypeInt64:   anyLess[int64](),
+		ColumnTypeInt32:   anyLess[int64](),
+		ColumnTypeFloat64: anyLess[float64](),
+		ColumnTypeString:  anyLess[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c < 0 }),
+		ColumnTypeUint64:  anyLess[uint64](),
 	},
 	ConditionGreaterThan: {
-		ColumnTypeInt64:   anyNotEquals[int64](),
-		ColumnTypeFloat64: anyNotEquals[float64](),
-		ColumnTypeString:  anyNotEquals[string](),
+		ColumnTypeInt64:   anyGreater[int64](),
+		ColumnTypeInt32:   anyGreater[int64](),
+		ColumnTypeFloat64: anyGreater[float64](),
+		ColumnTypeString:  anyGreater[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c > 0 }),
+		ColumnTypeUint64:  anyGreater[uint64](),
+	},
+	ConditionGreaterThanOrEquals: {
+		ColumnTypeInt64:   anyGreaterOrEquals[int64](),
+		ColumnTypeInt32:   anyGreaterOrEquals[int64](),
+		ColumnTypeFloat64: anyGreaterOrEquals[float64](),
+		ColumnTypeString:  anyGreaterOrEquals[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c >= 0 }),
+		ColumnTypeUint64:  anyGreaterOrEquals[uint64](),
+	},
+	ConditionLessThanOrEquals: {
+		ColumnTypeInt64:   anyLessOrEquals[int64](),
+		ColumnTypeInt32:   anyLessOrEquals[int64](),
+		ColumnTypeFloat64: anyLessOrEquals[float64](),
+		ColumnTypeString:  anyLessOrEquals[string](),
+		ColumnTypeTime:    timeCompare(func(c int) bool { return c <= 0 }),
+		ColumnTypeUint64:  anyLessOrEquals[uint64](),
+	},
+	ConditionContains: {
+		ColumnTypeString: func(a, b any) bool { return strings.Contains(a.(string), b.(string)) },
+	},
+	ConditionStartsWith: {
+		ColumnTypeString: func(a, b any) bool { return strings.HasPrefix(a.(string), b.(string)) },
 	},
+	ConditionEndsWith: {
+		ColumnTypeString: func(a, b any) bool { return strings.HasSuffix(a.(string), b.(string)) },
+	},
+	ConditionMatches: {
+		ColumnTypeString: func(a, b any) bool { return b.(*regexp.Regexp).MatchString(a.(string)) },
+	},
+	ConditionIn: {
+		ColumnTypeBool:    inSet,
+		ColumnTypeInt64:   inSet,
+		ColumnTypeInt32:   inSet,
+		ColumnTypeFloat64: inSet,
+		ColumnTypeString:  inSet,
+		ColumnTypeTime:    inSet,
+		ColumnTypeUint64:  inSet,
+	},
+	ConditionNotIn: {
+		ColumnTypeBool:    notInSet,
+		ColumnTypeInt64:   notInSet,
+		ColumnTypeInt32:   notInSet,
+		ColumnTypeFloat64: notInSet,
+		ColumnTypeString:  notInSet,
+		ColumnTypeTime:    notInSet,
+		ColumnTypeUint64:  notInSet,
+	},
+}
+
+// conditionalFor looks up the comparison for a condition on a column type.
+func conditionalFor(cond ConditionType, typ ColumnType) (ConditionalFunc, error) {
+	fn := conditionals[cond][typ]
+	if fn == nil {
+		return nil, fmt.Errorf("condition %s is not supported for %s columns", cond, typ)
+	}
+	return fn, nil
 }
@@ -0,0 +1,343 @@
+package querystore
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeRange(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"val": 1}))
+	require.NoError(t, cs.Append(map[string]any{"val": 2}))
+	time.Sleep(time.Millisecond)
+	mid := time.Now()
+	require.NoError(t, cs.Append(map[string]any{"val": 3}))
+
+	q := &Query{
+		Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "val"}},
+		TimeRange:    TimeRange{Start: mid},
+	}
+	rows, err := cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rows[0]["sum(val)"])
+
+	q.TimeRange = TimeRange{End: mid}
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rows[0]["sum(val)"])
+
+	q.TimeRange = TimeRange{End: time.Unix(0, 0)}
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), rows[0]["sum(val)"])
+}
+
+func TestQueryRowMetadata(t *testing.T) {
+	cs := newTestStore(t)
+
+	before := time.Now().UnixNano()
+	for i := range 3 {
+		require.NoError(t, cs.Append(map[string]any{"val": i}))
+	}
+	after := time.Now().UnixNano()
+
+	rows, err := cs.Query(&Query{})
+	require.NoError(t, err)
+	require.Len(t, rows, 3)
+	for i, row := range rows {
+		assert.Equal(t, int64(i), row[IndexColumn])
+		ts := row[TimestampColumn].(int64)
+		assert.GreaterOrEqual(t, ts, before)
+		assert.LessOrEqual(t, ts, after)
+	}
+}
+
+func TestRangeConditions(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"val": i, "f": float64(i), "s": strconv.Itoa(i)}))
+	}
+
+	count := func(filters ...Filter) int64 {
+		rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, Filters: filters})
+		require.NoError(t, err)
+		return rows[0]["count"].(int64)
+	}
+	assert.Equal(t, int64(3), count(Filter{Attribute: "val", Condition: ConditionGreaterThan, Value: 6}))
+	assert.Equal(t, int64(4), count(Filter{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 6}))
+	assert.Equal(t, int64(7), count(Filter{Attribute: "f", Condition: ConditionLessThanOrEquals, Value: 6.0}))
+	assert.Equal(t, int64(3), count(Filter{Attribute: "s", Condition: ConditionLessThanOrEquals, Value: "2"}))
+	assert.Equal(t, int64(2), count(
+		Filter{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 4},
+		Filter{Attribute: "f", Condition: ConditionLessThanOrEquals, Value: 5},
+	))
+
+	require.NoError(t, cs.Append(map[string]any{"ok": true}))
+	_, err := cs.Query(&Query{Filters: []Filter{{Attribute: "ok", Condition: ConditionLessThan, Value: true}}})
+	assert.ErrorContains(t, err, "condition < is not supported for bool columns")
+}
+
+func TestFractionalConditions(t *testing.T) {
+	// Integer columns are compared with fractional values as in float64.
+	cs := newTestStore(t)
+	for i := range 5 {
+		require.NoError(t, cs.Append(map[string]any{"v": i, "u": uint64(i)}))
+	}
+	values := func(f Filter) []any {
+		rows, err := cs.Query(&Query{Select: []string{"v"}, Filters: []Filter{f}})
+		require.NoError(t, err)
+		p, err := cs.Prepare(&Query{Select: []string{"v"}, Filters: []Filter{f}})
+		require.NoError(t, err)
+		prepared, err := p.Query()
+		require.NoError(t, err)
+		assert.Equal(t, rows, prepared)
+		count, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, Filters: []Filter{f}})
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(rows)), count[0]["count"])
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row["v"] })
+	}
+	for _, col := range []string{"v", "u"} {
+		assert.Equal(t, []any{int64(3), int64(4)}, values(Filter{Attribute: col, Condition: ConditionGreaterThan, Value: 2.5}), col)
+		assert.Equal(t, []any{int64(3), int64(4)}, values(Filter{Attribute: col, Condition: ConditionGreaterThanOrEquals, Value: 2.5}), col)
+		assert.Equal(t, []any{int64(0), int64(1), int64(2)}, values(Filter{Attribute: col, Condition: ConditionLessThan, Value: 2.5}), col)
+		assert.Equal(t, []any{int64(0), int64(1), int64(2)}, values(Filter{Attribute: col, Condition: ConditionLessThanOrEquals, Value: 2.5}), col)
+		assert.Empty(t, values(Filter{Attribute: col, Condition: ConditionEquals, Value: 1.4}), col)
+		assert.Len(t, values(Filter{Attribute: col, Condition: ConditionNotEquals, Value: 1.4}), 5, col)
+		assert.Empty(t, values(Filter{Attribute: col, Condition: ConditionIn, Value: []any{1.4}}), col)
+		assert.Equal(t, []any{int64(2)}, values(Filter{Attribute: col, Condition: ConditionIn, Value: []any{1.4, 2.0}}), col)
+		assert.Equal(t, []any{int64(0), int64(1), int64(3), int64(4)}, values(Filter{Attribute: col, Condition: ConditionNotIn, Value: []any{1.4, 2}}), col)
+	}
+}
+
+func TestStringConditions(t *testing.T) {
+	cs := newTestStore(t)
+
+	for _, msg := range []string{"error: disk full", "warn: slow disk", "error: timeout", "info: ok"} {
+		require.NoError(t, cs.Append(map[string]any{"msg": msg, "n": 1}))
+	}
+
+	count := func(filters ...Filter) int64 {
+		rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, Filters: filters})
+		require.NoError(t, err)
+		return rows[0]["count"].(int64)
+	}
+	assert.Equal(t, int64(2), count(Filter{Attribute: "msg", Condition: ConditionStartsWith, Value: "error:"}))
+	assert.Equal(t, int64(2), count(Filter{Attribute: "msg", Condition: ConditionContains, Value: "disk"}))
+	assert.Equal(t, int64(1), count(Filter{Attribute: "msg", Condition: ConditionEndsWith, Value: "ok"}))
+	assert.Equal(t, int64(1), count(Filter{Attribute: "msg", Condition: ConditionGreaterThan, Value: "true"}))
+	assert.Equal(t, int64(3), count(Filter{Attribute: "msg", Condition: ConditionLessThan, Value: "true"}))
+
+	_, err := cs.Query(&Query{Filters: []Filter{{Attribute: "n", Condition: ConditionContains, Value: 1}}})
+	assert.Error(t, err)
+}
+
+func TestFilterExpression(t *testing.T) {
+	cs := newTestStore(t)
+
+	recs := []map[string]any{
+		{"status": "error", "latency": 100, "region": "us"},
+		{"status": "ok", "latency": 900, "region": "us"},
+		{"status": "error", "latency": 50, "region": "eu"},
+		{"status": "ok", "latency": 20, "region": "us"},
+		{"status": "ok", "latency": 700, "region": "eu"},
+	}
+	for _, rec := range recs {
+		require.NoError(t, cs.Append(rec))
+	}
+
+	rows, err := cs.Query(&Query{
+		Where: And(
+			Or(
+				Where("status", ConditionEquals, "error"),
+				Where("latency", ConditionGreaterThan, 500),
+			),
+			Not(Where("region", ConditionEquals, "eu")),
+		),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(0), int64(1)}, lo.Map(rows, func(row map[string]any, _ int) any { return row[IndexColumn] }))
+}
+
+func TestNotNulls(t *testing.T) {
+	// Not matches rows without a value for the filtered column, unlike
+	// SQL NOT and unlike the negated conditions.
+	cs := newTestStore(t)
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"region": "us"},
+		{"region": "eu"},
+		{"latency": 10},
+	}))
+	indexes := func(where *FilterExpression) []any {
+		rows, err := cs.Query(&Query{Where: where})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row[IndexColumn] })
+	}
+	assert.Equal(t, []any{int64(0), int64(2)}, indexes(Not(Where("region", ConditionEquals, "eu"))))
+	assert.Equal(t, []any{int64(0)}, indexes(Where("region", ConditionNotEquals, "eu")))
+	assert.Equal(t, []any{int64(0), int64(1), int64(2)}, indexes(Not(Where("missing", ConditionEquals, "eu"))), "columns that do not exist")
+	assert.Equal(t, []any{int64(0)}, indexes(And(Where("region", ConditionIsNotNull, nil), Not(Where("region", ConditionEquals, "eu")))))
+	assert.Equal(t, []any{int64(0), int64(1)}, indexes(Not(Where("region", ConditionIsNull, nil))))
+}
+
+func TestInConditions(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"user_id": i, "name": strconv.Itoa(i)}))
+	}
+
+	sum := func(f Filter) int64 {
+		rows, err := cs.Query(&Query{
+			Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "user_id"}},
+			Filters:      []Filter{f},
+		})
+		require.NoError(t, err)
+		return rows[0]["sum(user_id)"].(int64)
+	}
+	assert.Equal(t, int64(15), sum(Filter{Attribute: "user_id", Condition: ConditionIn, Value: []int{1, 5, 9}}))
+	assert.Equal(t, int64(30), sum(Filter{Attribute: "user_id", Condition: ConditionNotIn, Value: []int64{1, 5, 9}}))
+	assert.Equal(t, int64(5), sum(Filter{Attribute: "name", Condition: ConditionIn, Value: []any{"2", 3, "x"}}))
+
+	_, err := cs.Query(&Query{Filters: []Filter{{Attribute: "user_id", Condition: ConditionIn, Value: 1}}})
+	assert.Error(t, err)
+}
+
+func TestMatchesCondition(t *testing.T) {
+	cs := newTestStore(t)
+
+	for _, path := range []string{"/api/v1/users", "/api/v2/users/42", "/health"} {
+		require.NoError(t, cs.Append(map[string]any{"path": path}))
+	}
+
+	rows, err := cs.Query(&Query{Filters: []Filter{{Attribute: "path", Condition: ConditionMatches, Value: `^/api/v\d+/users/\d+$`}}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "/api/v2/users/42", rows[0]["path"])
+
+	_, err = cs.Query(&Query{Filters: []Filter{{Attribute: "missing", Condition: ConditionMatches, Value: `(`}}})
+	assert.Error(t, err)
+}
+
+func TestSelect(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"a": 1, "b": "x"}))
+	require.NoError(t, cs.Append(map[string]any{"a": 2, "c": true}))
+
+	rows, err := cs.Query(&Query{
+		Select:  []string{"b", "c"},
+		Filters: []Filter{{Attribute: "a", Condition: ConditionGreaterThan, Value: 0}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "x", rows[0]["b"])
+	assert.Nil(t, rows[0]["c"])
+	assert.NotContains(t, rows[0], "a")
+	assert.Equal(t, true, rows[1]["c"])
+
+	rows, err = cs.Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, int64(2), rows[1]["a"])
+	assert.Contains(t, rows[1], "b")
+	assert.Equal(t, int64(1), rows[1][IndexColumn])
+}
+
+func TestOrderByLimitOffset(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"val": (i * 7) % 10, "group": i % 3}))
+	}
+	indexes := func(rows []map[string]any, col string) []any {
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row[col] })
+	}
+
+	rows, err := cs.Query(&Query{Limit: 3, Offset: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(2), int64(3), int64(4)}, indexes(rows, IndexColumn))
+
+	rows, err = cs.Query(&Query{OrderBy: []Order{{Attribute: IndexColumn, Descending: true}}, Limit: 2, Offset: 1})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(8), int64(7)}, indexes(rows, IndexColumn))
+
+	rows, err = cs.Query(&Query{Select: []string{"val"}, OrderBy: []Order{{Attribute: "val"}}, Limit: 3})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(0), int64(1), int64(2)}, indexes(rows, "val"))
+
+	rows, err = cs.Query(&Query{
+		Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "val"}},
+		GroupBy:      "group",
+		OrderBy:      []Order{{Attribute: "sum(val)", Descending: true}},
+		Limit:        1,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{{"group": int64(1), "sum(val)": int64(24)}}, rows)
+
+	// Columns ordered by need not be selected.
+	cs = newTestStore(t)
+	for _, v := range []int{5, 1, 9, 3, 7} {
+		require.NoError(t, cs.Append(map[string]any{"val": v, "name": strconv.Itoa(v)}))
+	}
+	for _, q := range []Query{
+		{Select: []string{IndexColumn}},
+		{Select: []string{"name"}},
+		{},
+		{Select: []string{"name"}, Parallelism: 2},
+	} {
+		q.OrderBy = []Order{{Attribute: "val", Descending: true}}
+		rows, err = cs.Query(&q)
+		require.NoError(t, err)
+		assert.Equal(t, []any{int64(2), int64(4), int64(0), int64(3), int64(1)}, indexes(rows, IndexColumn), q.Select)
+		for _, row := range rows {
+			assert.NotContains(t, row, "val")
+		}
+	}
+	rows, err = cs.Query(&Query{Select: []string{"name"}, OrderBy: []Order{{Attribute: "val"}}, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"1", "3"}, indexes(rows, "name"))
+}
+
+func TestInt32Conditions(t *testing.T) {
+	fs, err := OpenColumnFSWithSchema(t.TempDir(), &Schema{Columns: []ColumnSpec{
+		{Name: "small", Type: ColumnTypeInt32},
+		{Name: "runs", Type: ColumnTypeInt32, Encoding: EncodingRLE},
+	}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 20 {
+		require.NoError(t, cs.Append(map[string]any{"small": i - 10, "runs": i / 5}))
+	}
+
+	count := func(filters ...Filter) int64 {
+		rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, Filters: filters})
+		require.NoError(t, err)
+		return rows[0]["count"].(int64)
+	}
+	for _, col := range []string{"small", "runs"} {
+		assert.Equal(t, int64(20), count(Filter{Attribute: col, Condition: ConditionIsNotNull}), col)
+	}
+	assert.Equal(t, int64(1), count(Filter{Attribute: "small", Condition: ConditionEquals, Value: -3}))
+	assert.Equal(t, int64(10), count(Filter{Attribute: "small", Condition: ConditionLessThan, Value: int32(0)}))
+	assert.Equal(t, int64(3), count(Filter{Attribute: "small", Condition: ConditionIn, Value: []int{-10, 0, 9, 42}}))
+	assert.Equal(t, int64(5), count(Filter{Attribute: "runs", Condition: ConditionEquals, Value: 2}))
+	assert.Equal(t, int64(10), count(Filter{Attribute: "runs", Condition: ConditionLessThan, Value: 2}))
+	assert.Equal(t, int64(15), count(Filter{Attribute: "runs", Condition: ConditionGreaterThanOrEquals, Value: uint64(1)}))
+	assert.Equal(t, int64(10), count(Filter{Attribute: "runs", Condition: ConditionIn, Value: []any{0, 3}}))
+	assert.Equal(t, int64(10), count(Filter{Attribute: "runs", Condition: ConditionNotIn, Value: []any{0, 3}}))
+
+	rows, err := cs.Query(&Query{
+		Select:  []string{"small"},
+		Filters: []Filter{{Attribute: "small", Condition: ConditionGreaterThan, Value: 7}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(8), int64(9)}, lo.Map(rows, func(r map[string]any, _ int) any { return r["small"] }))
+}
@@ -0,0 +1,112 @@
+package querystore
+
+import (
+	"container/list"
+	"maps"
+	"sync"
+)
+
+// queryCache holds the results of recent queries, evicting the least
+// recently used. See Options.QueryCacheSize.
+type queryCache struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List
+	entries map[queryCacheKey]*list.Element
+}
+
+// queryCacheKey identifies the results of a query over the rows of a store
+// as of a change to it. Results cached before a change are never matched
+// again, even by a query that began before it.
+type queryCacheKey struct {
+	query      string
+	authorized bool
+	rows       int64
+	changes    int64
+}
+
+type queryCacheEntry struct {
+	key  queryCacheKey
+	rows []map[string]any
+}
+
+func newQueryCache(size int) *queryCache {
+	return &queryCache{size: size, lru: list.New(), entries: map[queryCacheKey]*list.Element{}}
+}
+
+// get returns a copy of the cached results of a query, if any.
+func (c *queryCache) get(key queryCacheKey) ([]map[string]any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return cloneRows(e.Value.(*queryCacheEntry).rows), true
+}
+
+// put caches a copy of the results of a query.
+func (c *queryCache) put(key queryCacheKey, rows []map[string]any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&queryCacheEntry{key: key, rows: cloneRows(rows)})
+	for c.lru.Len() > c.size {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.entries, e.Value.(*queryCacheEntry).key)
+	}
+}
+
+// clear drops every cached result.
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	clear(c.entries)
+}
+
+func cloneRows(rows []map[string]any) []map[string]any {
+	out := make([]map[string]any, len(rows))
+	for i, row := range rows {
+		out[i] = maps.Clone(row)
+	}
+	return out
+}
+
+// queryCacheKey returns the key of a query's results, or false if they are
+// not cached: when the store has no cache or is shutting down, or the query
+// has enrichers, whose lookups are not part of its JSON form.
+func (fs *ColumnFS) queryCacheKey(q *Query) (queryCacheKey, bool) {
+	if fs.cache == nil || len(q.Enrichers) > 0 || q.ReuseRows {
+		return queryCacheKey{}, false
+	}
+	var query string
+	if q.plan != nil {
+		query = q.plan.json
+	} else {
+		b, err := EncodeQueryJSON(q)
+		if err != nil {
+			return queryCacheKey{}, false
+		}
+		query = string(b)
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.shutdown != nil {
+		return queryCacheKey{}, false
+	}
+	return queryCacheKey{query: query, authorized: q.Authorized, rows: fs.nextID, changes: fs.changes}, true
+}
+
+// invalidateCache drops the cached results of queries, on changes to the
+// store's rows or columns. The caller must hold fs.lock.
+func (fs *ColumnFS) invalidateCache() {
+	fs.changes++
+	if fs.cache != nil {
+		fs.cache.clear()
+	}
+}
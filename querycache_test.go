@@ -0,0 +1,52 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryCache(t *testing.T) {
+	metrics := NewMetricsCollector()
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{QueryCacheSize: 2, Metrics: metrics})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"n": int64(i)}))
+	}
+	q := &Query{Where: Where("n", ConditionGreaterThanOrEquals, int64(5)), Select: []string{"n"}}
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 5)
+	scanned := metrics.rowsScanned.Load()
+	res[0]["n"] = "changed"
+
+	res, err = cs.Query(&Query{Where: Where("n", ConditionGreaterThanOrEquals, int64(5)), Select: []string{"n"}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), res[0]["n"], "cached results are copied")
+	assert.Equal(t, scanned, metrics.rowsScanned.Load(), "cached results are not scanned")
+	assert.Equal(t, int64(2), metrics.queries.Load())
+
+	require.NoError(t, cs.Append(map[string]any{"n": int64(10)}))
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Len(t, res, 6, "appends invalidate the cache")
+	_, err = cs.Delete(&Query{Where: Where("n", ConditionEquals, int64(10))})
+	require.NoError(t, err)
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Len(t, res, 5, "deletions invalidate the cache")
+
+	// The least recently used results are evicted.
+	for _, lim := range []int{1, 2, 3} {
+		_, err = cs.Query(&Query{Limit: lim})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, fs.cache.lru.Len())
+	_, ok := fs.cache.get(queryCacheKey{query: `{"limit":1}`, rows: fs.nextID, changes: fs.changes})
+	assert.False(t, ok)
+	_, ok = fs.cache.get(queryCacheKey{query: `{"limit":3}`, rows: fs.nextID, changes: fs.changes})
+	assert.True(t, ok)
+}
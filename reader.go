@@ -0,0 +1,418 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// readChunkSize is how much of a column file a reader loads at a time.
+const readChunkSize = 64 << 10
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+// errShortRecord reports that a buffer ends partway through a record.
+var errShortRecord = errors.New("short record")
+
+type ColumnReader struct {
+	path    string
+	fp      BackendFile
+	typ     ColumnType
+	version int
+	// mapped is the memory mapping backing buf, if any.
+	mapped []byte
+	// buf holds file data not yet decoded, starting at pos. bufOffset is the
+	// file offset of buf[0].
+	buf       []byte
+	pos       int
+	bufOffset int64
+	// blocks is the block index of the column, and nextBlock the first
+	// entry after the reader's position.
+	blocks    []blockEntry
+	nextBlock int
+	// zones is the zone map of the column, and blooms and sketches its bloom
+	// filters and distinct sketches, if it keeps them.
+	zones    []zone
+	blooms   []*bloomFilter
+	sketches []*hllSketch
+	// sums holds the checksums of completed blocks, and tail that of the
+	// open last block. nextCheck is the first block not yet checked or
+	// passed, which is len(sums) for the open last block.
+	sums      []uint32
+	tail      blockTail
+	nextCheck int
+	// rle is set for run-length encoded columns. runEnd is the row after the
+	// run holding curIndex.
+	rle    bool
+	runEnd int64
+	// lastRun is the last run of a run-length encoded column when the reader
+	// was created. Later writes may extend it in place.
+	lastRun *rleRun
+	// codec is set for compressed columns. frame holds the decompressed
+	// records of the frame at frameOffset, decoded up to framePos.
+	codec       Codec
+	frame       []byte
+	framePos    int
+	frameOffset int64
+	// values and bitmaps are the value indexes of the column, if it keeps
+	// them. They are shared with the column's handle, so are only read under
+	// fs.lock.
+	values  map[any][]int64
+	bitmaps map[any]*bitmap
+	// end is the end of the data the reader may read. Data after it was
+	// written after the reader was created, and may be incomplete.
+	end      int64
+	curIndex int64
+	curVal   any
+	eof      bool
+	// span traces the reads of the column by a query, if traced, counting
+	// bytesRead and readTime.
+	span      Span
+	bytesRead int64
+	readTime  time.Duration
+}
+
+// SeekToIndex advances the reader to targetIndex and returns the value stored
+// for that row, or nil if the column has no value for it or the value is null.
+// Columns are sparse, so rows between calls may be skipped.
+func (cr *ColumnReader) SeekToIndex(targetIndex int64) (any, error) {
+	if cr.nextBlock < len(cr.blocks) && targetIndex >= cr.blocks[cr.nextBlock].firstIndex && targetIndex > cr.curIndex {
+		if err := cr.skipTo(targetIndex); err != nil {
+			return nil, err
+		}
+	}
+	for cr.curIndex < targetIndex {
+		if targetIndex < cr.runEnd {
+			cr.curIndex = targetIndex
+			break
+		}
+		if cr.eof {
+			return nil, nil
+		}
+		index, val, run, err := cr.readRecord()
+		if err == io.EOF {
+			cr.eof = true
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cr.curIndex = index
+		cr.curVal = val
+		cr.runEnd = index + run
+	}
+	if cr.curIndex == targetIndex {
+		return cr.curVal, nil
+	}
+	return nil, nil
+}
+
+// readRecord decodes the next record, returning its row index, value and the
+// number of rows it covers. The buffer is refilled from the file as needed, and
+// a torn record at the end of the file reads as EOF.
+func (cr *ColumnReader) readRecord() (int64, any, int64, error) {
+	index, raw, run, err := cr.readRawRecord()
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return index, raw.box(cr.typ), run, nil
+}
+
+// readRawRecord is readRecord without boxing the value. Variable-width values
+// alias the reader's buffer until the next read.
+func (cr *ColumnReader) readRawRecord() (int64, rawValue, int64, error) {
+	if cr.nextCheck <= len(cr.sums) && cr.tail.end > cr.tail.start && cr.framePos >= len(cr.frame) {
+		if err := cr.verifyBlock(); err != nil {
+			return 0, rawValue{}, 0, err
+		}
+	}
+	if cr.codec != nil {
+		return cr.readFrameRecord()
+	}
+	for {
+		index, val, n, err := decodeRawRecord(cr.typ, cr.version, cr.buf[cr.pos:])
+		run := int64(1)
+		if err == nil && cr.rle {
+			run, n, err = decodeRunLength(cr.buf[cr.pos:], n)
+			if cr.lastRun != nil && index == cr.lastRun.start {
+				run = cr.lastRun.end - index
+			}
+		}
+		if err == nil {
+			cr.pos += n
+			return index, val, run, nil
+		}
+		if err != errShortRecord {
+			return 0, rawValue{}, 0, err
+		}
+		if err := cr.fill(); err != nil {
+			return 0, rawValue{}, 0, err
+		}
+	}
+}
+
+// fill reads the next chunk of the file, keeping any undecoded bytes.
+func (cr *ColumnReader) fill() error {
+	if cr.fp == nil {
+		return io.EOF
+	}
+	rest := len(cr.buf) - cr.pos
+	cr.bufOffset += int64(cr.pos)
+	size := max(readChunkSize, 2*rest)
+	if cap(cr.buf) < size {
+		buf := make([]byte, rest, size)
+		copy(buf, cr.buf[cr.pos:])
+		cr.buf = buf
+	} else {
+		copy(cr.buf[:rest], cr.buf[cr.pos:])
+		cr.buf = cr.buf[:rest]
+	}
+	cr.pos = 0
+
+	// Stop at the end of the data, rather than read a write in progress.
+	limit := int(min(int64(cap(cr.buf)), max(cr.end-cr.bufOffset, int64(rest))))
+	n, err := cr.readTimed(cr.buf[rest:limit])
+	cr.buf = cr.buf[:rest+n]
+	if n > 0 {
+		return nil
+	}
+	if err == nil {
+		err = io.EOF
+	}
+	return err
+}
+
+// nextIndex returns a lower bound on the next row after i with a record. The
+// bound is exact once the reader has sought to i.
+func (cr *ColumnReader) nextIndex(i int64) int64 {
+	switch {
+	case cr.eof:
+		return math.MaxInt64
+	case cr.curIndex > i:
+		return cr.curIndex
+	}
+	return i + 1
+}
+
+// position returns the file offset of the next record to be decoded, or of
+// the frame holding it in compressed files.
+func (cr *ColumnReader) position() int64 {
+	if cr.framePos < len(cr.frame) {
+		return cr.frameOffset
+	}
+	return cr.bufOffset + int64(cr.pos)
+}
+
+// recordValueSize returns the size of the fixed-width part of a record's
+// value for a column type and format version.
+func recordValueSize(typ ColumnType, version int) int {
+	switch typ {
+	case ColumnTypeBool:
+		return 1
+	case ColumnTypeString, ColumnTypeJSON:
+		if version >= 2 {
+			return 4
+		}
+		return 2
+	case ColumnTypeInt32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+// rawValue is a decoded value before boxing. Fixed-width values are held in
+// bits: integers and times as their int64 value, floats as their IEEE 754
+// bits and bools as 0 or 1. Variable-width values are held in data.
+type rawValue struct {
+	null bool
+	bits uint64
+	data []byte
+}
+
+// box returns the value as decodeRecord reports it for a column type.
+func (v rawValue) box(typ ColumnType) any {
+	if v.null {
+		return nil
+	}
+	switch typ {
+	case ColumnTypeBool:
+		return v.bits == 1
+	case ColumnTypeFloat64:
+		return math.Float64frombits(v.bits)
+	case ColumnTypeTime:
+		return time.Unix(0, int64(v.bits)).UTC()
+	case ColumnTypeUint64:
+		return v.bits
+	case ColumnTypeString:
+		return string(v.data)
+	case ColumnTypeJSON:
+		return decodeJSONValue(v.data)
+	}
+	return int64(v.bits)
+}
+
+// decodeRecord decodes the record at the start of b, returning the number of
+// bytes it occupies, or errShortRecord if b holds only part of it.
+func decodeRecord(typ ColumnType, version int, b []byte) (int64, any, int, error) {
+	index, v, n, err := decodeRawRecord(typ, version, b)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return index, v.box(typ), n, nil
+}
+
+func decodeRawRecord(typ ColumnType, version int, b []byte) (int64, rawValue, int, error) {
+	if len(b) < 8 {
+		return 0, rawValue{}, 0, errShortRecord
+	}
+	rawIndex := binary.LittleEndian.Uint64(b[:8])
+	if rawIndex&nullIndexBit != 0 {
+		return int64(rawIndex &^ nullIndexBit), rawValue{null: true}, 8, nil
+	}
+	index := int64(rawIndex)
+
+	size := 8 + recordValueSize(typ, version)
+	if len(b) < size {
+		return 0, rawValue{}, 0, errShortRecord
+	}
+	switch typ {
+	case ColumnTypeBool:
+		return index, rawValue{bits: uint64(b[8])}, size, nil
+	case ColumnTypeInt64, ColumnTypeFloat64, ColumnTypeTime, ColumnTypeUint64:
+		return index, rawValue{bits: binary.LittleEndian.Uint64(b[8:16])}, size, nil
+	case ColumnTypeInt32:
+		return index, rawValue{bits: uint64(int64(int32(binary.LittleEndian.Uint32(b[8:12]))))}, size, nil
+	case ColumnTypeString, ColumnTypeJSON:
+		var n int
+		if version >= 2 {
+			n = int(binary.LittleEndian.Uint32(b[8:12]))
+		} else {
+			n = int(binary.LittleEndian.Uint16(b[8:10]))
+		}
+		if len(b) < size+n {
+			return 0, rawValue{}, 0, errShortRecord
+		}
+		return index, rawValue{data: b[size : size+n]}, size + n, nil
+	}
+	return 0, rawValue{}, 0, fmt.Errorf("%w: %d", ErrUnknownColumnType, typ)
+}
+
+func (cr *ColumnReader) Close() error {
+	cr.endSpan()
+	cr.buf = nil
+	if cr.mapped != nil {
+		err := munmap(cr.mapped)
+		cr.mapped = nil
+		return err
+	}
+	if cr.fp != nil {
+		err := cr.fp.Close()
+		cr.fp = nil
+		return err
+	}
+	return nil
+}
+
+func (ch *ColumnHandle) createReader() (*ColumnReader, error) {
+	return ch.createReaderAt(ch.dataOffset)
+}
+
+// createReaderAt returns a reader positioned at a record boundary.
+func (ch *ColumnHandle) createReaderAt(offset int64) (*ColumnReader, error) {
+	fp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		// Nothing has been written to the column yet.
+		return &ColumnReader{typ: ch.typ, version: ch.version, curIndex: -1, eof: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return &ColumnReader{path: ch.path, fp: fp, typ: ch.typ, version: ch.version, rle: ch.rle(), codec: ch.codec, bufOffset: offset, end: math.MaxInt64, curIndex: -1}, nil
+}
+
+// createMappedReader returns a reader that decodes the column file directly
+// from a read-only memory mapping, falling back to a chunked reader where
+// mapping or the backend does not support it. Only the column's loaded size
+// is mapped.
+func (ch *ColumnHandle) createMappedReader() (*ColumnReader, error) {
+	bfp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if os.IsNotExist(err) {
+		return &ColumnReader{typ: ch.typ, version: ch.version, curIndex: -1, eof: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer bfp.Close()
+	fp, ok := bfp.(*os.File)
+	if !ok {
+		return ch.createReader()
+	}
+
+	fi, err := fp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := min(fi.Size(), ch.size)
+	if size <= ch.dataOffset {
+		return &ColumnReader{typ: ch.typ, version: ch.version, curIndex: -1, eof: true}, nil
+	}
+	data, err := mmap(fp, int(size))
+	if err == errMmapUnsupported {
+		return ch.createReader()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ColumnReader{
+		path:      ch.path,
+		typ:       ch.typ,
+		version:   ch.version,
+		rle:       ch.rle(),
+		codec:     ch.codec,
+		mapped:    data,
+		buf:       data[ch.dataOffset:],
+		bufOffset: ch.dataOffset,
+		curIndex:  -1,
+	}, nil
+}
+
+// createReader opens a reader for a column that uses its block index to skip
+// ahead, honoring the MemoryMap option. The reader sees the column as it is
+// when created, so writes may continue while it is in use. The caller must
+// hold fs.lock.
+func (fs *ColumnFS) createReader(ch *ColumnHandle) (*ColumnReader, error) {
+	if err := ch.loadBlockIndex(); err != nil {
+		return nil, err
+	}
+	var cr *ColumnReader
+	var err error
+	if fs.opts.MemoryMap {
+		cr, err = ch.createMappedReader()
+	} else {
+		cr, err = ch.createReader()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cr.blocks = ch.blockSnapshot()
+	cr.zones = ch.zoneSnapshot()
+	cr.blooms = ch.bloomSnapshot()
+	cr.sketches = ch.sketchSnapshot()
+	cr.sums, cr.tail = ch.checksumSnapshot(), ch.tail
+	cr.values, cr.bitmaps = ch.values, ch.bitmaps
+	cr.end = ch.size
+	if ch.lastRun != nil {
+		run := *ch.lastRun
+		cr.lastRun = &run
+	}
+	return cr, nil
+}
@@ -0,0 +1,209 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+)
+
+// ErrCorruptIndex reports corruption of a store's index file that cannot be
+// repaired.
+var ErrCorruptIndex = errors.New("index file is corrupt")
+
+// recover checks the store's files after an unclean shutdown. Torn records at
+// the end of a file are truncated, as are column records for rows missing from
+// the index file, since their write never completed. Repairs are logged, and
+// corruption that cannot be repaired is returned as an error.
+func (fs *ColumnFS) recover() error {
+	ih := fs.indexHandle
+	if err := fs.recoverFile(ih, math.MaxInt64); err != nil {
+		return err
+	}
+	var err error
+	if fs.nextID, err = ih.committedRows(); err != nil {
+		return err
+	}
+	for _, ch := range fs.columnHandles {
+		if ch == ih {
+			continue
+		}
+		if err := fs.recoverFile(ch, fs.nextID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// committedRows returns the number of rows recorded by the index file.
+func (ih *ColumnHandle) committedRows() (int64, error) {
+	fi, err := ih.backend.Stat(ih.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rows := max(fi.Size()-ih.dataOffset, 0) / 16
+	if rows == 0 {
+		return 0, nil
+	}
+	// Records are at the offsets of their rows, so the last record holds the
+	// last row unless the file is misaligned.
+	fp, err := ih.backend.OpenFile(ih.path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	var b [8]byte
+	if _, err := fp.ReadAt(b[:], ih.dataOffset+16*(rows-1)); err != nil {
+		return 0, err
+	}
+	if index := int64(binary.LittleEndian.Uint64(b[:])); index != rows-1 {
+		return 0, fmt.Errorf("%w: %s holds row %d at the offset of row %d", ErrCorruptIndex, ih.path, index, rows-1)
+	}
+	return rows, nil
+}
+
+// corruption marks an error reporting corruption of the index file with
+// ErrCorruptIndex.
+func (fs *ColumnFS) corruption(ch *ColumnHandle, err error) error {
+	if ch == fs.indexHandle {
+		return fmt.Errorf("%w: %w", ErrCorruptIndex, err)
+	}
+	return err
+}
+
+// keptRecord is a record kept when the end of a file is rewritten.
+type keptRecord struct {
+	index int64
+	value any
+	run   int64
+}
+
+// recoverFile truncates a file after its last complete record, or before its
+// first record of a row at or after rowLimit. Records of earlier rows that
+// share a frame or run with a truncated record are written back. Blocks kept
+// must match their checksums, which are then rebuilt.
+func (fs *ColumnFS) recoverFile(ch *ColumnHandle, rowLimit int64) error {
+	fi, err := ch.backend.Stat(ch.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	size := fi.Size()
+	if size < headerSize && ch.dataOffset == 0 && tornHeader(ch.backend, ch.path, size) {
+		fs.logger().Warn("querystore: truncating column file with a torn header", "file", ch.path, "size", size)
+		if err := truncateFile(ch.backend, ch.path, 0); err != nil {
+			return err
+		}
+		ch.version = formatVersion
+		return nil
+	}
+
+	// Only the end of the file needs checking, from the last block the block
+	// index knows of.
+	if err := ch.loadBlockIndex(); err != nil {
+		return fs.corruption(ch, fmt.Errorf("column file %s is corrupt: %w", ch.path, err))
+	}
+	start := ch.dataOffset
+	if n := len(ch.blocks); n > 0 {
+		start = ch.blocks[n-1].offset
+	}
+	cr, err := ch.createReaderAt(start)
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+
+	end, cut := start, int64(-1)
+	frameStart := int64(-1)
+	var frame []keptRecord
+	for {
+		offset := cr.position()
+		index, v, run, err := cr.readRecord()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fs.corruption(ch, fmt.Errorf("column file %s is corrupt at offset %d: %w", ch.path, offset, err))
+		}
+		if offset != frameStart {
+			frameStart, frame = offset, frame[:0]
+		}
+		if index+run > rowLimit {
+			cut = frameStart
+			if index < rowLimit {
+				frame = append(frame, keptRecord{index: index, value: v, run: rowLimit - index})
+			}
+			break
+		}
+		frame = append(frame, keptRecord{index: index, value: v, run: run})
+		if cr.framePos >= len(cr.frame) {
+			end = cr.position()
+		}
+	}
+	if cut < 0 {
+		cut, frame = end, nil
+	}
+	if cut == size && len(frame) == 0 {
+		return nil
+	}
+	// The checksums are rebuilt from the blocks kept, so those must be
+	// intact.
+	if err := ch.checkBlocks(cut); err != nil {
+		return fs.corruption(ch, fmt.Errorf("column file %s is corrupt: %w", ch.path, err))
+	}
+
+	fs.logger().Warn("querystore: truncating torn or orphaned records", "file", ch.path, "offset", cut, "size", size, "rewritten", len(frame))
+	var data []byte
+	for _, r := range frame {
+		if data, err = ch.appendRecord(data, r.index, r.value); err != nil {
+			return err
+		}
+		if ch.rle() {
+			data = binary.LittleEndian.AppendUint32(data, uint32(r.run))
+		}
+	}
+	if ch.codec != nil && len(data) > 0 {
+		if data, err = encodeFrame(ch.codec, data); err != nil {
+			return err
+		}
+	}
+	fp, err := ch.backend.OpenFile(ch.path, os.O_WRONLY, filePerm)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Truncate(cut); err != nil {
+		return err
+	}
+	if _, err := fp.WriteAt(data, cut); err != nil {
+		return err
+	}
+	ch.stats = nil
+	return ch.resetBlockIndex()
+}
+
+// tornHeader reports whether a file too short for a header starts like one.
+func tornHeader(b ColumnBackend, path string, size int64) bool {
+	data, err := readFile(b, path)
+	if err != nil || int64(len(data)) != size || size == 0 {
+		return false
+	}
+	n := min(len(data), len(headerMagic))
+	return bytes.Equal(data[:n], headerMagic[:n])
+}
+
+func (fs *ColumnFS) logger() *slog.Logger {
+	if fs.opts.Logger != nil {
+		return fs.opts.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,63 @@
+package querystore
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecovery(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "flag", Type: ColumnTypeBool, Encoding: EncodingRLE},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 1, "flag": true}, {"val": 2, "flag": true}}))
+	indexPath, valPath, flagPath := fs.indexHandle.path, fs.columnHandles["val"].path, fs.columnHandles["flag"].path
+	indexSize := lo.Must(os.Stat(indexPath)).Size()
+	valData, flagData := lo.Must(os.ReadFile(valPath)), lo.Must(os.ReadFile(flagPath))
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 3, "flag": true}, {"val": 4, "flag": true}}))
+	require.NoError(t, fs.Close())
+
+	// The index file lost the last row and part of the one before it, and the
+	// column file has a torn record after the complete ones.
+	require.NoError(t, os.Truncate(indexPath, indexSize+5))
+	fp := lo.Must(os.OpenFile(valPath, os.O_WRONLY|os.O_APPEND, filePerm))
+	lo.Must(fp.Write([]byte{1, 2, 3}))
+	require.NoError(t, fp.Close())
+
+	var logs bytes.Buffer
+	fs, err = OpenColumnFSWithOptions(dir, Options{Schema: schema, Logger: slog.New(slog.NewTextHandler(&logs, nil))})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), fs.nextID)
+	assert.Equal(t, indexSize, lo.Must(os.Stat(indexPath)).Size())
+	assert.Equal(t, valData, lo.Must(os.ReadFile(valPath)))
+	// The run covering all four rows is cut back to the first two.
+	assert.Equal(t, flagData, lo.Must(os.ReadFile(flagPath)))
+	assert.Contains(t, logs.String(), valPath)
+	assert.Contains(t, logs.String(), flagPath)
+
+	cs = NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"val": 5, "flag": false}))
+	rows, err := cs.Query(&Query{Select: []string{"val", "flag"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(1), int64(2), int64(5)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+	assert.Equal(t, []any{true, true, false}, lo.Map(rows, func(row map[string]any, _ int) any { return row["flag"] }))
+	require.NoError(t, fs.Close())
+
+	// Corruption that cannot be repaired is an error.
+	require.NoError(t, os.WriteFile(path.Join(dir, "bad.xyz.dat"), nil, filePerm))
+	_, err = OpenColumnFS(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,264 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Columns of rows stored from Prometheus remote write samples.
+const (
+	RemoteWriteMetricColumn    = "metric"
+	RemoteWriteValueColumn     = "value"
+	RemoteWriteTimestampColumn = "timestamp"
+)
+
+// remoteWriteLabelPrefix prefixes labels whose names clash with the columns
+// above or start with "__".
+const remoteWriteLabelPrefix = "label_"
+
+// maxRemoteWriteSize bounds the decompressed size of a remote write request.
+const maxRemoteWriteSize = 64 << 20
+
+// RemoteWriteHandler accepts Prometheus remote write requests, snappy
+// compressed protobuf WriteRequests, and appends a row for each sample. Rows
+// hold the metric name in the metric column, each label in a column of its
+// name, the sample in the value column and its time in the timestamp column.
+// Labels named metric, value or timestamp, or starting with "__", are stored
+// with a "label_" prefix. Rows are stamped with the time they are appended,
+// since samples arrive out of order; query sample times with the timestamp
+// column. Stale markers and histograms are dropped.
+func RemoteWriteHandler(s *ColumnarStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		compressed, err := io.ReadAll(io.LimitReader(r.Body, maxRemoteWriteSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := decodeSnappy(compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, err := parseRemoteWrite(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.AppendBatchContext(r.Context(), rows); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// staleNaN is the value Prometheus writes to mark a series as stale.
+const staleNaN = 0x7ff0000000000002
+
+// parseRemoteWrite returns the rows of the samples of a WriteRequest.
+func parseRemoteWrite(data []byte) ([]map[string]any, error) {
+	var rows []map[string]any
+	err := readProtoFields(data, func(field int, wire int, b []byte, _ uint64) error {
+		if field != 1 || wire != protoBytes {
+			return nil
+		}
+		// TimeSeries: repeated Label labels = 1, repeated Sample samples = 2.
+		labels := map[string]any{}
+		var samples [][]byte
+		err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+			switch {
+			case field == 1 && wire == protoBytes:
+				var name, value string
+				err := readProtoFields(b, func(field int, wire int, b []byte, _ uint64) error {
+					if wire == protoBytes && field == 1 {
+						name = string(b)
+					} else if wire == protoBytes && field == 2 {
+						value = string(b)
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				switch name {
+				case "__name__":
+					labels[RemoteWriteMetricColumn] = value
+				case RemoteWriteMetricColumn, RemoteWriteValueColumn, RemoteWriteTimestampColumn:
+					labels[remoteWriteLabelPrefix+name] = value
+				default:
+					if strings.HasPrefix(name, "__") {
+						name = remoteWriteLabelPrefix + name
+					}
+					labels[name] = value
+				}
+			case field == 2 && wire == protoBytes:
+				samples = append(samples, b)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sample := range samples {
+			// Sample: double value = 1, int64 timestamp = 2 in milliseconds.
+			var value float64
+			var ms int64
+			err := readProtoFields(sample, func(field int, wire int, _ []byte, n uint64) error {
+				if field == 1 && wire == protoFixed64 {
+					value = math.Float64frombits(n)
+				} else if field == 2 && wire == protoVarint {
+					ms = int64(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if math.Float64bits(value) == staleNaN {
+				continue
+			}
+			row := make(map[string]any, len(labels)+2)
+			for k, v := range labels {
+				row[k] = v
+			}
+			row[RemoteWriteValueColumn] = value
+			row[RemoteWriteTimestampColumn] = time.UnixMilli(ms).UTC()
+			rows = append(rows, row)
+		}
+		return nil
+	})
+	return rows, err
+}
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// readProtoFields calls fn for each field of a protobuf message with its
+// number and wire type, and either its bytes or its numeric value.
+func readProtoFields(data []byte, fn func(field int, wire int, b []byte, n uint64) error) error {
+	for len(data) > 0 {
+		key, size := binary.Uvarint(data)
+		if size <= 0 {
+			return errors.New("protobuf: invalid field key")
+		}
+		data = data[size:]
+		field, wire := int(key>>3), int(key&7)
+		var b []byte
+		var n uint64
+		switch wire {
+		case protoVarint:
+			if n, size = binary.Uvarint(data); size <= 0 {
+				return fmt.Errorf("protobuf: invalid varint in field %d", field)
+			}
+			data = data[size:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return fmt.Errorf("protobuf: truncated field %d", field)
+			}
+			n, data = binary.LittleEndian.Uint64(data), data[8:]
+		case protoBytes:
+			length, size := binary.Uvarint(data)
+			if size <= 0 || length > uint64(len(data)-size) {
+				return fmt.Errorf("protobuf: truncated field %d", field)
+			}
+			b, data = data[size:size+int(length)], data[size+int(length):]
+		case protoFixed32:
+			if len(data) < 4 {
+				return fmt.Errorf("protobuf: truncated field %d", field)
+			}
+			n, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		default:
+			return fmt.Errorf("protobuf: unsupported wire type %d in field %d", wire, field)
+		}
+		if err := fn(field, wire, b, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeSnappy decodes a snappy block, the format of remote write bodies.
+func decodeSnappy(src []byte) ([]byte, error) {
+	errCorrupt := errors.New("snappy: corrupt input")
+	n, size := binary.Uvarint(src)
+	if size <= 0 || n > maxRemoteWriteSize {
+		return nil, errCorrupt
+	}
+	src = src[size:]
+	dst := make([]byte, 0, n)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				// The length-1 follows in 1 to 4 little endian bytes.
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if length > len(src) || len(dst)+length > int(n) {
+				return nil, errCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errCorrupt
+		}
+		// Copies may overlap their own output, so copy a byte at a time.
+		for range length {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
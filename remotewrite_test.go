@@ -0,0 +1,77 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteWrite(t *testing.T) {
+	cs := newTestStore(t)
+	server := httptest.NewServer(RemoteWriteHandler(cs))
+	defer server.Close()
+
+	field := func(b []byte, num int, data []byte) []byte {
+		b = binary.AppendUvarint(b, uint64(num<<3|2))
+		b = binary.AppendUvarint(b, uint64(len(data)))
+		return append(b, data...)
+	}
+	label := func(name, value string) []byte {
+		return field(field(nil, 1, []byte(name)), 2, []byte(value))
+	}
+	sample := func(v float64, ms int64) []byte {
+		b := binary.AppendUvarint(nil, 1<<3|1)
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+		b = binary.AppendUvarint(b, 2<<3)
+		return binary.AppendUvarint(b, uint64(ms))
+	}
+	var series []byte
+	series = field(series, 1, label("__name__", "http_requests_total"))
+	series = field(series, 1, label("job", "api"))
+	series = field(series, 1, label("value", "x"))
+	series = field(series, 2, sample(3, 1000))
+	series = field(series, 2, sample(math.Float64frombits(0x7ff0000000000002), 2000))
+	series = field(series, 2, sample(5.5, 3000))
+	req := field(nil, 1, series)
+	// Snappy blocks of literals only, of up to 60 bytes each.
+	body := binary.AppendUvarint(nil, uint64(len(req)))
+	for rest := req; len(rest) > 0; {
+		n := min(len(rest), 60)
+		body = append(body, byte(n-1)<<2)
+		body, rest = append(body, rest[:n]...), rest[n:]
+	}
+
+	resp, err := http.Post(server.URL, "application/x-protobuf", bytes.NewReader(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	rows, err := cs.Query(&Query{Select: []string{"metric", "job", "label_value", "value", "timestamp"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "http_requests_total", rows[0]["metric"])
+	assert.Equal(t, "api", rows[0]["job"])
+	assert.Equal(t, "x", rows[0]["label_value"])
+	assert.Equal(t, 3.0, rows[0]["value"])
+	assert.Equal(t, time.UnixMilli(1000).UTC(), rows[0]["timestamp"])
+	assert.Equal(t, 5.5, rows[1]["value"])
+
+	resp, err = http.Post(server.URL, "application/x-protobuf", bytes.NewReader(body[:len(body)-3]))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A literal "abc" and a copy of 6 bytes from offset 3.
+	out, err := decodeSnappy([]byte{9, 0x08, 'a', 'b', 'c', 0x09, 3})
+	require.NoError(t, err)
+	assert.Equal(t, "abcabcabc", string(out))
+	_, err = decodeSnappy([]byte{9, 0x08, 'a', 'b', 'c', 0x09, 4})
+	assert.Error(t, err)
+}
@@ -0,0 +1,222 @@
+package querystore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// LeaderStatus describes a leader store when an increment was read from it.
+type LeaderStatus struct {
+	Rows       int64
+	LastAppend time.Time
+}
+
+// ReplicationSource reads increments from a leader store for a Follower.
+type ReplicationSource interface {
+	// Fetch writes the leader's rows from index start on to w, as written by
+	// ExportIncrement, and returns the leader's status before they were read.
+	Fetch(ctx context.Context, start int64, w io.Writer) (LeaderStatus, error)
+}
+
+// LocalSource replicates a leader store in the same process.
+func LocalSource(leader *ColumnarStore) ReplicationSource {
+	return localSource{leader}
+}
+
+type localSource struct {
+	leader *ColumnarStore
+}
+
+func (s localSource) Fetch(ctx context.Context, start int64, w io.Writer) (LeaderStatus, error) {
+	if err := ctx.Err(); err != nil {
+		return LeaderStatus{}, err
+	}
+	status := s.leader.fs.appendStatus()
+	_, err := s.leader.ExportIncrement(w, start)
+	return status, err
+}
+
+// appendStatus returns the row count and last append time of the store.
+func (fs *ColumnFS) appendStatus() LeaderStatus {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	status := LeaderStatus{Rows: fs.nextID}
+	if fs.nextID > 0 {
+		status.LastAppend = time.Unix(0, fs.lastTimestamp).UTC()
+	}
+	return status
+}
+
+// Headers of replication responses carrying the leader's status.
+const (
+	replicationRowsHeader       = "Querystore-Rows"
+	replicationLastAppendHeader = "Querystore-Last-Append"
+)
+
+// ReplicationHandler serves increments of a leader store over HTTP to
+// followers using an HTTPSource. Requests give the index of the first row to
+// read in the start query parameter.
+func ReplicationHandler(leader *ColumnarStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid start row", http.StatusBadRequest)
+			return
+		}
+		status := leader.fs.appendStatus()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(replicationRowsHeader, strconv.FormatInt(status.Rows, 10))
+		w.Header().Set(replicationLastAppendHeader, strconv.FormatInt(status.LastAppend.UnixNano(), 10))
+		var buf bytes.Buffer
+		if _, err := leader.ExportIncrement(&buf, start); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(buf.Bytes())
+	})
+}
+
+// HTTPSource replicates a leader served by ReplicationHandler at URL.
+type HTTPSource struct {
+	URL string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+func (s *HTTPSource) Fetch(ctx context.Context, start int64, w io.Writer) (LeaderStatus, error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return LeaderStatus{}, err
+	}
+	q := u.Query()
+	q.Set("start", strconv.FormatInt(start, 10))
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return LeaderStatus{}, err
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return LeaderStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return LeaderStatus{}, fmt.Errorf("leader responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var status LeaderStatus
+	if status.Rows, err = strconv.ParseInt(resp.Header.Get(replicationRowsHeader), 10, 64); err != nil {
+		return LeaderStatus{}, fmt.Errorf("leader sent an invalid row count: %w", err)
+	}
+	if status.Rows > 0 {
+		ns, err := strconv.ParseInt(resp.Header.Get(replicationLastAppendHeader), 10, 64)
+		if err != nil {
+			return LeaderStatus{}, fmt.Errorf("leader sent an invalid last append time: %w", err)
+		}
+		status.LastAppend = time.Unix(0, ns).UTC()
+	}
+	_, err = io.Copy(w, resp.Body)
+	return status, err
+}
+
+// ReplicationStatus describes how far a follower is behind its leader, as of
+// its last poll.
+type ReplicationStatus struct {
+	// Leader is the leader's status when last polled successfully.
+	Leader LeaderStatus
+	// Rows and LastAppend describe the rows applied to the follower.
+	Rows       int64
+	LastAppend time.Time
+	// LastSync is when the follower last caught up with the leader's status,
+	// and Err is the error of the last poll, if it failed.
+	LastSync time.Time
+	Err      error
+}
+
+// RowsBehind returns the number of the leader's rows not yet applied.
+func (s ReplicationStatus) RowsBehind() int64 {
+	return max(s.Leader.Rows-s.Rows, 0)
+}
+
+// TimeBehind returns how much earlier the last row applied was appended than
+// the leader's last row.
+func (s ReplicationStatus) TimeBehind() time.Duration {
+	if s.Leader.LastAppend.IsZero() || s.RowsBehind() == 0 {
+		return 0
+	}
+	return max(s.Leader.LastAppend.Sub(s.LastAppend), 0)
+}
+
+// Follower replicates a leader store into a follower store, applying the
+// leader's rows in order with their indexes and timestamps. Rows deleted on
+// the leader, or superseded by its upserts, are deleted on the follower by
+// the next poll. The follower store must only be written by the Follower.
+type Follower struct {
+	store *ColumnarStore
+	src   ReplicationSource
+
+	lock   sync.Mutex
+	status ReplicationStatus
+}
+
+// NewFollower returns a follower applying the rows read from src to store.
+func NewFollower(store *ColumnarStore, src ReplicationSource) *Follower {
+	f := &Follower{store: store, src: src}
+	applied := store.fs.appendStatus()
+	f.status.Rows, f.status.LastAppend = applied.Rows, applied.LastAppend
+	return f
+}
+
+// Poll applies the rows appended to the leader since the last poll,
+// returning how many were applied.
+func (f *Follower) Poll(ctx context.Context) (int64, error) {
+	start := f.store.fs.appendStatus().Rows
+	var buf bytes.Buffer
+	leader, err := f.src.Fetch(ctx, start, &buf)
+	var n int64
+	if err == nil {
+		n, err = f.store.ImportIncrement(&buf)
+	}
+	applied := f.store.fs.appendStatus()
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status.Rows, f.status.LastAppend, f.status.Err = applied.Rows, applied.LastAppend, err
+	if err == nil {
+		f.status.Leader, f.status.LastSync = leader, time.Now()
+	}
+	return n, err
+}
+
+// Run polls the leader every interval until ctx is done, returning its
+// error. Failed polls are reported by Status and retried.
+func (f *Follower) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		f.Poll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Status returns the replication status as of the last poll.
+func (f *Follower) Status() ReplicationStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.status
+}
@@ -0,0 +1,94 @@
+package querystore
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	leaderFS, err := OpenColumnFS(t.TempDir())
+	require.NoError(t, err)
+	defer leaderFS.Close()
+	leader := NewColumnarStore(leaderFS)
+	server := httptest.NewServer(ReplicationHandler(leader))
+	defer server.Close()
+
+	for _, src := range []ReplicationSource{LocalSource(leader), &HTTPSource{URL: server.URL}} {
+		followerFS, err := OpenColumnFS(t.TempDir())
+		require.NoError(t, err)
+		follower := NewColumnarStore(followerFS)
+		f := NewFollower(follower, src)
+		n, err := f.Poll(context.Background())
+		require.NoError(t, err)
+		status := f.Status()
+		assert.Equal(t, leaderFS.appendStatus().Rows, n)
+		assert.Zero(t, status.RowsBehind())
+		assert.Zero(t, status.TimeBehind())
+
+		require.NoError(t, leader.AppendBatch([]map[string]any{{"val": 1}, {"val": 2}}))
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- f.Run(ctx, time.Millisecond) }()
+		assert.Eventually(t, func() bool { return f.Status().Rows == leaderFS.appendStatus().Rows }, time.Second, time.Millisecond)
+		cancel()
+		assert.ErrorIs(t, <-done, context.Canceled)
+
+		want, err := leader.Query(&Query{Select: []string{"*"}})
+		require.NoError(t, err)
+		got, err := follower.Query(&Query{Select: []string{"*"}})
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		require.NoError(t, followerFS.Close())
+	}
+
+	status := ReplicationStatus{Leader: LeaderStatus{Rows: 10, LastAppend: time.Unix(100, 0)}, Rows: 7, LastAppend: time.Unix(40, 0)}
+	assert.Equal(t, int64(3), status.RowsBehind())
+	assert.Equal(t, time.Minute, status.TimeBehind())
+	resp, err := http.Get(server.URL + "?start=x")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestReplicationDeletes(t *testing.T) {
+	leaderFS, err := OpenColumnFSWithOptions(t.TempDir(), Options{PrimaryKey: "id"})
+	require.NoError(t, err)
+	defer leaderFS.Close()
+	leader := NewColumnarStore(leaderFS)
+	followerFS, err := OpenColumnFS(t.TempDir())
+	require.NoError(t, err)
+	defer followerFS.Close()
+	follower := NewColumnarStore(followerFS)
+	f := NewFollower(follower, LocalSource(leader))
+
+	require.NoError(t, leaderFS.UpsertRows([]map[string]any{{"id": 1, "v": "a"}, {"id": 2, "v": "b"}, {"id": 3, "v": "c"}}))
+	_, err = f.Poll(context.Background())
+	require.NoError(t, err)
+
+	// Rows deleted or superseded after they were replicated are deleted on
+	// the follower, as are deleted rows it has not seen.
+	_, err = leader.Delete(&Query{Where: Where("id", ConditionEquals, 1)})
+	require.NoError(t, err)
+	require.NoError(t, leaderFS.UpsertRows([]map[string]any{{"id": 2, "v": "b2"}, {"id": 4, "v": "d"}}))
+	_, err = leader.Delete(&Query{Where: Where("id", ConditionEquals, 4)})
+	require.NoError(t, err)
+	n, err := f.Poll(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Zero(t, f.Status().RowsBehind())
+
+	want, err := leader.Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	got, err := follower.Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.Len(t, got, 2)
+	assert.Equal(t, "c", got[0]["v"])
+	assert.Equal(t, "b2", got[1]["v"])
+}
@@ -0,0 +1,126 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// prunedFileName names the file holding the index of the first row kept by
+// pruning, as a little-endian int64. Queries skip the rows before it.
+const prunedFileName = "__pruned"
+
+// loadPruned loads the index of the first row kept by pruning.
+func (fs *ColumnFS) loadPruned() error {
+	data, err := readFile(fs.backend, path.Join(fs.dir, prunedFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != 8 {
+		return fmt.Errorf("store %s has a corrupt %s file", fs.dir, prunedFileName)
+	}
+	fs.pruned = min(int64(binary.LittleEndian.Uint64(data)), fs.nextID)
+	return nil
+}
+
+// Prune deletes the rows appended longer ago than Options.Retention,
+// returning how many were deleted. See PruneBefore.
+func (fs *ColumnFS) Prune() (int64, error) {
+	if fs.opts.Retention <= 0 {
+		return 0, errors.New("no retention is configured")
+	}
+	return fs.PruneBefore(fs.now().Add(-fs.opts.Retention))
+}
+
+// PruneBefore deletes the rows appended before t, returning how many were
+// deleted. Partitions whose rows are all older are dropped. Otherwise the
+// index of the first row kept is recorded and queries skip the rows before
+// it, so nothing is rewritten until Compact removes their records. Queries
+// already running keep reading the rows they started with.
+func (fs *ColumnFS) PruneBefore(t time.Time) (int64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.invalidateCache()
+	if fs.partitioning == PartitionNone {
+		return fs.pruneBefore(t)
+	}
+	var rows int64
+	for _, p := range fs.partitions {
+		if p.end.After(t) {
+			break
+		}
+		rows += p.fs.nextID - p.fs.pruned
+	}
+	if _, err := fs.dropPartitionsBefore(t); err != nil {
+		return 0, err
+	}
+	if len(fs.partitions) > 0 && fs.partitions[0].start.Before(t) && !fs.partitions[0].offloaded {
+		p := fs.partitions[0]
+		p.fs.lock.Lock()
+		defer p.fs.lock.Unlock()
+		n, err := p.fs.pruneBefore(t)
+		if err != nil {
+			return 0, err
+		}
+		rows += n
+	}
+	return rows, nil
+}
+
+// pruneBefore hides the rows of an unpartitioned store appended before t.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) pruneBefore(t time.Time) (int64, error) {
+	if fs.opts.ReadOnly {
+		return 0, ErrStoreReadOnly
+	}
+	first, _, err := fs.rowRange(TimeRange{Start: t})
+	if err != nil || first <= fs.pruned {
+		return 0, err
+	}
+	prunedPath := path.Join(fs.dir, prunedFileName)
+	if err := writeFile(fs.backend, prunedPath+".tmp", binary.LittleEndian.AppendUint64(nil, uint64(first))); err != nil {
+		return 0, err
+	}
+	if err := fs.backend.Rename(prunedPath+".tmp", prunedPath); err != nil {
+		return 0, err
+	}
+	n := first - fs.pruned
+	fs.pruned = first
+	return n, nil
+}
+
+// startPruner starts pruning the store every Options.PruneInterval.
+func (fs *ColumnFS) startPruner() {
+	fs.stopPrune = make(chan struct{})
+	fs.pruneDone = make(chan struct{})
+	go func() {
+		defer close(fs.pruneDone)
+		ticker := time.NewTicker(fs.opts.PruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := fs.Prune(); err != nil {
+					fs.logger().Error("querystore: pruning failed", "dir", fs.dir, "err", err)
+				}
+			case <-fs.stopPrune:
+				return
+			}
+		}
+	}()
+}
+
+// stopPruner stops the background pruning, if running.
+func (fs *ColumnFS) stopPruner() {
+	if fs.stopPrune != nil {
+		close(fs.stopPrune)
+		<-fs.pruneDone
+		fs.stopPrune = nil
+	}
+}
@@ -0,0 +1,70 @@
+package querystore
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	var mu sync.Mutex
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	}
+	vals := func(cs *ColumnarStore) []any {
+		rows, err := cs.Query(&Query{Select: []string{"val"}})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] })
+	}
+
+	for _, partitioning := range []Partitioning{PartitionNone, PartitionHourly} {
+		dir := t.TempDir()
+		opts := Options{Partitioning: partitioning, Clock: clock, Retention: 100 * time.Minute}
+		fs, err := OpenColumnFSWithOptions(dir, opts)
+		require.NoError(t, err)
+		cs := NewColumnarStore(fs)
+		for i := range 6 {
+			require.NoError(t, cs.Append(map[string]any{"val": i}))
+			advance(30 * time.Minute)
+		}
+		// Rows 0 to 2 were appended more than 100 minutes ago.
+		n, err := cs.Prune()
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+		assert.Equal(t, []any{int64(3), int64(4), int64(5)}, vals(cs))
+		n, err = cs.Prune()
+		require.NoError(t, err)
+		assert.Zero(t, n)
+		require.NoError(t, fs.Close())
+
+		// Pruning survives reopening, and runs in the background.
+		opts.PruneInterval = time.Millisecond
+		fs, err = OpenColumnFSWithOptions(dir, opts)
+		require.NoError(t, err)
+		cs = NewColumnarStore(fs)
+		assert.Equal(t, []any{int64(3), int64(4), int64(5)}, vals(cs))
+		advance(time.Hour)
+		assert.Eventually(t, func() bool { return len(vals(cs)) == 1 }, time.Second, time.Millisecond)
+		rows, err := cs.Query(&Query{Select: []string{"val"}})
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), rows[0][IndexColumn])
+		require.NoError(t, fs.Close())
+	}
+	fs, err := OpenColumnFS(t.TempDir())
+	require.NoError(t, err)
+	defer fs.Close()
+	_, err = fs.Prune()
+	assert.ErrorContains(t, err, "no retention")
+}
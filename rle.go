@@ -0,0 +1,108 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+)
+
+// Run-length encoded columns store each run of consecutive rows with equal
+// values as a single record followed by the number of rows in the run, as a
+// uint32. Appends that continue the last run of the file extend it in place.
+
+// rleRun is a run of rows [start, end) holding the same value.
+type rleRun struct {
+	start, end int64
+	value      any
+	// countOffset is where the run's length is stored in the file, once it
+	// has been written.
+	countOffset int64
+	written     bool
+}
+
+func (ch *ColumnHandle) rle() bool {
+	return ch.flags&flagRLE != 0
+}
+
+// supportsRLE reports whether columns of a type can be run-length encoded.
+// Values of these types compare with ==.
+func supportsRLE(typ ColumnType) bool {
+	switch typ {
+	case ColumnTypeBool, ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeString:
+		return true
+	}
+	return false
+}
+
+// decodeRunLength decodes the run length following a record of n bytes at the
+// start of b.
+func decodeRunLength(b []byte, n int) (int64, int, error) {
+	if len(b) < n+4 {
+		return 0, 0, errShortRecord
+	}
+	return int64(binary.LittleEndian.Uint32(b[n:])), n + 4, nil
+}
+
+// openForAppend opens the column file for writing at its end. Run-length
+// encoded files are not opened in append mode, so that the length of their
+// last run can be updated in place.
+func (ch *ColumnHandle) openForAppend() (BackendFile, error) {
+	if !ch.rle() {
+		return ch.backend.OpenFile(ch.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+	}
+	fp, err := ch.backend.OpenFile(ch.path, os.O_WRONLY|os.O_CREATE, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fp.Seek(0, io.SeekEnd); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	return fp, nil
+}
+
+// patchRun rewrites the length of a run already in the file.
+func (ch *ColumnHandle) patchRun(r *rleRun) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(r.end-r.start))
+	_, err := ch.writeFp.WriteAt(b[:], r.countOffset)
+	return err
+}
+
+func (p *pendingWrite) addRun(index int64, v any) error {
+	if v != nil {
+		v = castValueToColumnType(v, p.ch.typ)
+	}
+	if r := p.run; r != nil && index == r.end && r.value == v && r.end-r.start < math.MaxUint32 {
+		r.end++
+		if r.written {
+			p.patch = r
+		}
+	} else {
+		if err := p.flushRun(); err != nil {
+			return err
+		}
+		p.noteRecord(index, v, p.recordOffset())
+		p.run = &rleRun{start: index, end: index + 1, value: v}
+	}
+	p.noteValue(index, v)
+	p.stats.add(index)
+	return nil
+}
+
+// flushRun encodes the last run if it is not yet in the file.
+func (p *pendingWrite) flushRun() error {
+	r := p.run
+	if r == nil || r.written {
+		return nil
+	}
+	buf, err := p.ch.appendRecord(p.buf, r.start, r.value)
+	if err != nil {
+		return err
+	}
+	r.countOffset = p.base + int64(len(buf))
+	p.buf = binary.LittleEndian.AppendUint32(buf, uint32(r.end-r.start))
+	r.written = true
+	return nil
+}
@@ -0,0 +1,208 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+)
+
+// rollupDirName names the directory of a store holding its rollup store.
+const rollupDirName = "__rollup"
+
+// Rollup downsamples the rows of a store once they are older than After,
+// replacing them with a row per Interval, and group of the GroupBy column,
+// holding the results of Aggregations, such as the sum and average of a
+// column per minute. Rollup rows are kept in a store of their own, returned
+// by ColumnarStore.Rollups, and stamped with the start of their interval.
+type Rollup struct {
+	After        time.Duration
+	Interval     time.Duration
+	GroupBy      string
+	Aggregations []Aggregation
+	// Period, if positive, is the period of a background Rollup.
+	Period time.Duration
+}
+
+func (r *Rollup) validate() error {
+	if r.Interval <= 0 || r.After <= 0 {
+		return errors.New("rollups need a positive interval and age")
+	}
+	if len(r.Aggregations) == 0 {
+		return errors.New("rollups need an aggregation")
+	}
+	if _, err := newAggregateState(r.Aggregations, r.GroupBy); err != nil {
+		return err
+	}
+	seen := map[string]bool{r.GroupBy: r.GroupBy != ""}
+	for _, a := range r.Aggregations {
+		if seen[a.Name()] {
+			return fmt.Errorf("rollup column %s is named more than once", a.Name())
+		}
+		seen[a.Name()] = true
+	}
+	return nil
+}
+
+// openRollups opens the rollup store of a store, and starts rolling up rows
+// in the background if a period is set.
+func (fs *ColumnFS) openRollups() error {
+	if err := fs.opts.Rollup.validate(); err != nil {
+		return err
+	}
+	opts := Options{
+		MemoryMap:    fs.opts.MemoryMap,
+		Codec:        fs.opts.Codec,
+		Durability:   fs.opts.Durability,
+		SyncInterval: fs.opts.SyncInterval,
+		Logger:       fs.opts.Logger,
+		ReadOnly:     fs.opts.ReadOnly,
+		Backend:      fs.opts.Backend,
+	}
+	rfs, err := OpenColumnFSWithOptions(path.Join(fs.dir, rollupDirName), opts)
+	if err != nil {
+		return err
+	}
+	fs.rollups = rfs
+	if fs.opts.Rollup.Period > 0 && !fs.opts.ReadOnly {
+		fs.stopRollup = make(chan struct{})
+		fs.rollupDone = make(chan struct{})
+		go func() {
+			defer close(fs.rollupDone)
+			ticker := time.NewTicker(fs.opts.Rollup.Period)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					if _, err := fs.Rollup(); err != nil {
+						fs.logger().Error("querystore: rollup failed", "dir", fs.dir, "err", err)
+					}
+				case <-fs.stopRollup:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+// closeRollups stops the background rollups, if running, and closes the
+// rollup store.
+func (fs *ColumnFS) closeRollups() error {
+	if fs.stopRollup != nil {
+		close(fs.stopRollup)
+		<-fs.rollupDone
+		fs.stopRollup = nil
+	}
+	if fs.rollups == nil {
+		return nil
+	}
+	err := fs.rollups.Close()
+	fs.rollups = nil
+	return err
+}
+
+// Rollup rolls up the rows older than Options.Rollup.After, returning how
+// many were rolled up. Only whole intervals are rolled up. Their rollup rows
+// are appended to the rollup store before the rows are pruned, and a rollup
+// interrupted between the two resumes after the last rollup row written, so
+// rows are never rolled up twice.
+func (fs *ColumnFS) Rollup() (int64, error) {
+	r := fs.opts.Rollup
+	if r == nil || fs.rollups == nil {
+		return 0, errors.New("no rollup is configured")
+	}
+	if fs.opts.ReadOnly {
+		return 0, ErrStoreReadOnly
+	}
+	fs.rollupLock.Lock()
+	defer fs.rollupLock.Unlock()
+
+	interval := int64(r.Interval)
+	cutoff := fs.now().Add(-r.After).UnixNano()
+	cutoff -= cutoff % interval
+	rollups := fs.rollups
+	var start int64
+	if status := rollups.appendStatus(); status.Rows > 0 {
+		start = status.LastAppend.UnixNano() + interval
+	}
+	if start >= cutoff {
+		return 0, nil
+	}
+
+	q := &Query{TimeRange: TimeRange{End: time.Unix(0, cutoff)}, ReuseRows: true}
+	if start > 0 {
+		q.TimeRange.Start = time.Unix(0, start)
+	}
+	if r.GroupBy != "" {
+		q.Select = append(q.Select, r.GroupBy)
+	}
+	for _, a := range r.Aggregations {
+		q.Select = append(q.Select, a.columns()...)
+	}
+	it, err := NewColumnarStore(fs).QueryIter(q)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	var n int64
+	var state *aggregateState
+	var bucket int64
+	// flush appends the rollup rows of the current interval.
+	flush := func() error {
+		if state == nil {
+			return nil
+		}
+		rows := state.results()
+		for _, row := range rows {
+			for col, v := range row {
+				if v == nil {
+					delete(row, col)
+				}
+			}
+		}
+		rollups.lock.Lock()
+		defer rollups.lock.Unlock()
+		return rollups.writeAt(rows, max(bucket, rollups.lastTimestamp))
+	}
+	for it.Next() {
+		row := it.Row()
+		ts := row[TimestampColumn].(int64)
+		if b := ts - ts%interval; state == nil || b != bucket {
+			if err := flush(); err != nil {
+				return 0, err
+			}
+			state, _ = newAggregateState(r.Aggregations, r.GroupBy)
+			bucket = b
+		}
+		state.add(row)
+		n++
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	if err := flush(); err != nil {
+		return 0, err
+	}
+	if _, err := fs.PruneBefore(time.Unix(0, cutoff)); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Rollup rolls up the store's old rows. See ColumnFS.Rollup.
+func (s *ColumnarStore) Rollup() (int64, error) {
+	return s.fs.Rollup()
+}
+
+// Rollups returns the store holding the rollup rows of the store, or nil if
+// no rollup is configured. Its rows are stamped with the start of the
+// interval they summarize, so queries over history read it for the times
+// before the store's rows.
+func (s *ColumnarStore) Rollups() *ColumnarStore {
+	if s.fs.rollups == nil {
+		return nil
+	}
+	return NewColumnarStore(s.fs.rollups)
+}
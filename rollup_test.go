@@ -0,0 +1,61 @@
+package querystore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollup(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	opts := Options{Clock: func() time.Time { return now }, Rollup: &Rollup{
+		After:        time.Hour,
+		Interval:     time.Minute,
+		GroupBy:      "host",
+		Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorSum, Attribute: "val", Alias: "val"}},
+	}}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i, host := range []string{"a", "b", "a", "a", "b"} {
+		now = time.Date(2024, 1, 1, 0, 0, 20*i, 0, time.UTC)
+		require.NoError(t, cs.Append(map[string]any{"host": host, "val": int64(i)}))
+	}
+
+	// Only whole intervals older than After are rolled up.
+	now = time.Date(2024, 1, 1, 1, 1, 30, 0, time.UTC)
+	n, err := cs.Rollup()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	now = time.Date(2024, 1, 1, 1, 5, 0, 0, time.UTC)
+	n, err = cs.Rollup()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = cs.Rollup()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	rows, err := cs.Query(&Query{})
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+	rows, err = cs.Rollups().Query(&Query{Select: []string{"host", "count", "val"}})
+	require.NoError(t, err)
+	got := lo.Map(rows, func(row map[string]any, _ int) []any {
+		return []any{time.Unix(0, row[TimestampColumn].(int64)).UTC().Minute(), row["host"], row["count"], row["val"]}
+	})
+	assert.Equal(t, [][]any{
+		{0, "a", int64(2), int64(2)},
+		{0, "b", int64(1), int64(1)},
+		{1, "a", int64(1), int64(3)},
+		{1, "b", int64(1), int64(4)},
+	}, got)
+}
@@ -0,0 +1,252 @@
+package querystore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encoding selects how a column's values are laid out in its file.
+type Encoding int
+
+const (
+	EncodingPlain Encoding = iota
+	// EncodingRLE stores runs of consecutive rows with equal values as single
+	// records, which suits bool and highly repetitive columns. Supported for
+	// bool, integer and string columns.
+	EncodingRLE
+)
+
+func (e Encoding) flags() uint8 {
+	if e == EncodingRLE {
+		return flagRLE
+	}
+	return 0
+}
+
+// ColumnSpec declares a column and its type.
+type ColumnSpec struct {
+	Name     string
+	Type     ColumnType
+	Encoding Encoding
+	// Codec compresses the column when it is created, overriding the store's
+	// codec.
+	Codec Codec
+	// BloomFilterRate, if positive, keeps a bloom filter of the values of
+	// every block with this false positive rate, so that equality and IN
+	// filters skip blocks without their values. Supported for string, int64
+	// and int32 columns.
+	BloomFilterRate float64
+	// DistinctSketch keeps a HyperLogLog sketch of the values of every
+	// block, so that approximate distinct counts over the column merge the
+	// sketches of whole blocks instead of reading their values. Supported
+	// for the types with zone maps.
+	DistinctSketch bool
+}
+
+// Schema declares the columns of a store up front. Stores opened with a
+// schema reject writes to undeclared columns and values whose type does not
+// match the declared column type.
+type Schema struct {
+	Columns []ColumnSpec
+}
+
+func (s *Schema) validate() error {
+	seen := map[string]bool{}
+	for _, c := range s.Columns {
+		if err := checkColumnName(c.Name); err != nil {
+			return err
+		}
+		if _, ok := columnTypeToSuffix[c.Type]; !ok {
+			return fmt.Errorf("%w %d for schema column %s", ErrUnknownColumnType, c.Type, c.Name)
+		}
+		switch c.Encoding {
+		case EncodingPlain:
+		case EncodingRLE:
+			if !supportsRLE(c.Type) {
+				return fmt.Errorf("run-length encoding is not supported for %s column %s", c.Type, c.Name)
+			}
+		default:
+			return fmt.Errorf("unknown encoding %d for schema column %s", c.Encoding, c.Name)
+		}
+		if c.BloomFilterRate != 0 {
+			if !hasBloomFilter(c.Type) {
+				return fmt.Errorf("bloom filters are not supported for %s column %s", c.Type, c.Name)
+			}
+			if c.BloomFilterRate < 0 || c.BloomFilterRate >= 1 {
+				return fmt.Errorf("bloom filter rate of schema column %s must be between 0 and 1, got %v", c.Name, c.BloomFilterRate)
+			}
+		}
+		if c.DistinctSketch && !hasDistinctSketch(c.Type) {
+			return fmt.Errorf("distinct sketches are not supported for %s column %s", c.Type, c.Name)
+		}
+		if err := registerStoreCodec(c.Codec); err != nil {
+			return err
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate schema column: %s", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	return nil
+}
+
+func (s *Schema) column(name string) (ColumnSpec, bool) {
+	for _, c := range s.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return ColumnSpec{}, false
+}
+
+// OpenColumnFSWithSchema opens a store whose columns are declared by schema.
+// Existing column files must match the declared types.
+func OpenColumnFSWithSchema(dir string, schema *Schema) (*ColumnFS, error) {
+	return OpenColumnFSWithOptions(dir, Options{Schema: schema})
+}
+
+func (fs *ColumnFS) applySchema(schema *Schema) error {
+	if err := schema.validate(); err != nil {
+		return err
+	}
+	for name, ch := range fs.columnHandles {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		spec, ok := schema.column(name)
+		if !ok {
+			return fmt.Errorf("column %s is not declared in the schema", name)
+		}
+		if spec.Type != ch.typ {
+			return fmt.Errorf("column %s has type %s, schema declares %s", name, ch.typ, spec.Type)
+		}
+		if spec.Encoding.flags() != ch.flags&flagRLE {
+			return fmt.Errorf("column %s does not have the encoding declared in the schema", name)
+		}
+		ch.bloomRate = spec.BloomFilterRate
+		ch.sketched = spec.DistinctSketch
+		if ch.blocksLoaded {
+			if err := ch.loadBlooms(); err != nil {
+				return err
+			}
+			if err := ch.loadSketches(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, spec := range schema.Columns {
+		if fs.columnHandles[spec.Name] == nil {
+			ch := fs.newColumnHandle(spec.Name, spec.Type)
+			ch.flags = spec.Encoding.flags()
+			ch.bloomRate = spec.BloomFilterRate
+			ch.sketched = spec.DistinctSketch
+			if spec.Codec != nil {
+				ch.codec = spec.Codec
+			}
+			fs.columnHandles[spec.Name] = ch
+		}
+	}
+	fs.schema = schema
+	return nil
+}
+
+// checkSchema validates a value written to a column against the schema.
+func (fs *ColumnFS) checkSchema(name string, v any) error {
+	ch := fs.columnHandles[name]
+	if ch == nil {
+		return fmt.Errorf("column %s is not declared in the schema", name)
+	}
+	_, err := fs.columnValue(name, ch.typ, v)
+	return err
+}
+
+// ErrTypeMismatch reports a value appended to a column of another type, which
+// strict stores reject and lenient stores could not coerce.
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// TypeMode chooses how appends handle values whose type does not match that
+// of their column, which is declared by the schema or taken from the first
+// value of the column.
+type TypeMode int
+
+const (
+	// TypeModeStrict rejects writes holding values that do not match their
+	// column with ErrTypeMismatch. Integers fit integer columns whose range
+	// holds them.
+	TypeModeStrict TypeMode = iota
+	// TypeModeLenient coerces such values to the type of their column:
+	// numbers and bools convert to each other, with floats rounded to
+	// integers and bools as 0 and 1; strings parse as numbers, bools (as by
+	// strconv.ParseBool) or RFC 3339 times; integers convert to times as
+	// nanoseconds since the epoch; and values of string columns are
+	// formatted. JSON columns hold any value. Values that cannot be coerced,
+	// such as strings that do not parse, integers out of range and JSON
+	// values in other columns, fail with ErrTypeMismatch.
+	TypeModeLenient
+)
+
+// columnValue returns the value to write to a column for v: v itself if it
+// fits the column, or its coercion in lenient stores.
+func (fs *ColumnFS) columnValue(name string, typ ColumnType, v any) (any, error) {
+	if valueFitsColumnType(v, typ) {
+		return v, nil
+	}
+	if fs.opts.TypeMode == TypeModeLenient {
+		if c, ok := coerceValue(v, typ); ok {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: value of type %T does not match %s column %s", ErrTypeMismatch, v, typ, name)
+}
+
+// coerceValue converts a value to a column type as documented by
+// TypeModeLenient, reporting false if it cannot.
+func coerceValue(v any, typ ColumnType) (any, bool) {
+	if typ == ColumnTypeJSON {
+		return json.RawMessage(encodeJSONValue(v)), true
+	}
+	if s, ok := v.(string); ok {
+		var err error
+		switch typ {
+		case ColumnTypeBool:
+			v, err = strconv.ParseBool(s)
+		case ColumnTypeInt64, ColumnTypeInt32:
+			v, err = strconv.ParseInt(s, 10, 64)
+		case ColumnTypeUint64:
+			v, err = strconv.ParseUint(s, 10, 64)
+		case ColumnTypeFloat64:
+			v, err = strconv.ParseFloat(s, 64)
+		case ColumnTypeTime:
+			v, err = time.Parse(time.RFC3339Nano, s)
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+	if f, ok := v.(float64); ok && isIntegerType(typ) {
+		if f = math.Round(f); f < math.MinInt64 || f >= math.MaxUint64 || math.IsNaN(f) {
+			return nil, false
+		}
+		if f > math.MaxInt64 {
+			return uint64(f), typ == ColumnTypeUint64
+		}
+		v = int64(f)
+	}
+	if f, ok := v.(float32); ok {
+		return coerceValue(float64(f), typ)
+	}
+	c, err := convertValue(v, typ)
+	if err != nil {
+		return nil, false
+	}
+	// Integers keep their value, failing if out of range.
+	if isIntegerType(valueColumnType(v)) && isIntegerType(typ) && !valueFitsColumnType(v, typ) {
+		return nil, false
+	}
+	return c, true
+}
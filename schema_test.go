@@ -0,0 +1,309 @@
+package querystore
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "status", Type: ColumnTypeString},
+		{Name: "latency", Type: ColumnTypeFloat64},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+
+	rows, err := cs.Query(&Query{Filters: []Filter{{Attribute: "latency", Condition: ConditionGreaterThan, Value: 1}}})
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+
+	require.NoError(t, cs.Append(map[string]any{"status": "ok", "latency": 1.5}))
+	assert.Error(t, cs.Append(map[string]any{"status": "ok", "latency": "slow"}))
+	assert.Error(t, cs.Append(map[string]any{"region": "us"}))
+	require.NoError(t, fs.Close())
+
+	// Reopening validates the existing files against the schema.
+	fs, err = OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	rows, err = NewColumnarStore(fs).Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, 1.5, rows[0]["latency"])
+	require.NoError(t, fs.Close())
+
+	_, err = OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{
+		{Name: "status", Type: ColumnTypeInt64},
+		{Name: "latency", Type: ColumnTypeFloat64},
+	}})
+	assert.Error(t, err)
+	_, err = OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{{Name: "status", Type: ColumnTypeString}}})
+	assert.Error(t, err)
+}
+
+func TestColumns(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"a": 1}))
+	require.NoError(t, cs.Append(map[string]any{"a": 2, "b": "x"}))
+	// Load stats, then check that later appends keep them current.
+	_, err := cs.fs.Columns()
+	require.NoError(t, err)
+	require.NoError(t, cs.Append(map[string]any{"b": "yz"}))
+	require.NoError(t, cs.Append(map[string]any{"c": true}))
+
+	cols, err := cs.fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []ColumnInfo{
+		{Name: "a", Type: ColumnTypeInt64, Size: 48, Count: 2, FirstIndex: 0, LastIndex: 1},
+		{Name: "b", Type: ColumnTypeString, Size: 43, Count: 2, FirstIndex: 1, LastIndex: 2},
+		{Name: "c", Type: ColumnTypeBool, Size: 25, Count: 1, FirstIndex: 3, LastIndex: 3},
+	}, cols)
+	assert.Equal(t, "string", ColumnTypeString.String())
+}
+
+func TestIntegerColumnTypes(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{
+		{Name: "small", Type: ColumnTypeInt32},
+		{Name: "big", Type: ColumnTypeUint64},
+	}})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	require.NoError(t, cs.Append(map[string]any{"small": -5, "big": uint64(math.MaxUint64)}))
+	require.NoError(t, cs.Append(map[string]any{"small": int32(7), "big": 1}))
+	assert.Error(t, cs.Append(map[string]any{"small": math.MaxInt32 + 1}))
+	assert.Error(t, cs.Append(map[string]any{"big": -1}))
+
+	rows, err := cs.Query(&Query{
+		Select:  []string{"*"},
+		Filters: []Filter{{Attribute: "big", Condition: ConditionGreaterThan, Value: uint64(math.MaxInt64)}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, uint64(math.MaxUint64), rows[0]["big"])
+	assert.Equal(t, int64(-5), rows[0]["small"])
+
+	rows, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "small"}, {Type: AggregatorMin, Attribute: "big"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rows[0]["sum(small)"])
+	assert.Equal(t, uint64(1), rows[0]["min(big)"])
+}
+
+func TestRLEColumns(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "up", Type: ColumnTypeBool, Encoding: EncodingRLE},
+		{Name: "code", Type: ColumnTypeInt64, Encoding: EncodingRLE},
+	}}
+	fs, err := OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+
+	for i := range 30 {
+		rec := map[string]any{"up": i < 20, "code": 200}
+		if i >= 25 {
+			rec["code"] = nil
+		}
+		require.NoError(t, cs.Append(rec))
+	}
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"up": false, "code": 500}, {"up": true}, {"up": true, "code": 500}}))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFSWithSchema(dir, schema)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"up": true, "code": 500}))
+
+	infos, err := fs.Columns()
+	require.NoError(t, err)
+	// Runs: up true×20, false×11, true×3; code 200×25, null×5, 500×1, then
+	// 500×2 after a gap.
+	assert.Equal(t, []ColumnInfo{
+		{Name: "code", Type: ColumnTypeInt64, Size: headerSize + 3*20 + 12, Count: 33, FirstIndex: 0, LastIndex: 33},
+		{Name: "up", Type: ColumnTypeBool, Size: headerSize + 3*13, Count: 34, FirstIndex: 0, LastIndex: 33},
+	}, infos)
+
+	count := func(where *FilterExpression) any {
+		rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}, Where: where})
+		require.NoError(t, err)
+		return rows[0]["count"]
+	}
+	assert.Equal(t, int64(23), count(Where("up", ConditionEquals, true)))
+	assert.Equal(t, int64(5), count(And(Where("up", ConditionEquals, false), Where("code", ConditionIsNull, nil))))
+	assert.Equal(t, int64(3), count(Where("code", ConditionEquals, 500)))
+	assert.Equal(t, int64(6), count(Where("code", ConditionIsNull, nil)))
+
+	rows, err := cs.Query(&Query{Select: []string{"up", "code"}, Offset: 30})
+	require.NoError(t, err)
+	assert.Equal(t, []map[string]any{
+		{"up": false, "code": int64(500)},
+		{"up": true, "code": nil},
+		{"up": true, "code": int64(500)},
+		{"up": true, "code": int64(500)},
+	}, lo.Map(rows, func(row map[string]any, _ int) map[string]any {
+		return lo.OmitByKeys(row, []string{IndexColumn, TimestampColumn})
+	}))
+
+	_, err = OpenColumnFSWithSchema(dir, &Schema{Columns: []ColumnSpec{{Name: "up", Type: ColumnTypeBool}, {Name: "code", Type: ColumnTypeInt64}}})
+	assert.Error(t, err)
+	_, err = OpenColumnFSWithSchema(t.TempDir(), &Schema{Columns: []ColumnSpec{{Name: "f", Type: ColumnTypeFloat64, Encoding: EncodingRLE}}})
+	assert.Error(t, err)
+}
+
+func TestErrorTypes(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"n": int64(1), "s": "a", "b": true}))
+
+	// Values that do not match their column, or have no column type, fail
+	// the whole write rather than panic.
+	type named string
+	for _, row := range []map[string]any{
+		{"s": named("a")},
+		{"p": new(int)},
+		{"c": make(chan int)},
+	} {
+		assert.ErrorIs(t, cs.Append(row), ErrUnsupportedValue, "%v", row)
+	}
+	for _, row := range []map[string]any{
+		{"n": "x"},
+		{"s": int64(2)},
+		{"b": 1.5},
+	} {
+		assert.ErrorIs(t, cs.Append(row), ErrTypeMismatch, "%v", row)
+	}
+	err = fs.WriteRows([]map[string]any{{"new": int64(1)}, {"new": "x"}})
+	assert.ErrorIs(t, err, ErrTypeMismatch, "rows of a write agree on new columns")
+	assert.NotContains(t, fs.columnHandles, "new")
+	assert.ErrorIs(t, fs.columnHandles["n"].IndexedWrite(5, "x"), ErrTypeMismatch)
+
+	// So do filters with values of the wrong type.
+	_, err = cs.Query(&Query{Filters: []Filter{{Attribute: "n", Condition: ConditionEquals, Value: struct{}{}}}})
+	assert.ErrorIs(t, err, ErrUnsupportedValue)
+	_, err = cs.Query(&Query{Filters: []Filter{{Attribute: "b", Condition: ConditionIn, Value: []any{true, time.Now()}}}})
+	assert.ErrorIs(t, err, ErrUnsupportedValue)
+	// Strings that do not parse fail rather than match the zero value.
+	require.NoError(t, cs.Append(map[string]any{"n": int64(0), "b": false, "f": 0.0, "t": time.Unix(0, 0)}))
+	for _, where := range []*FilterExpression{
+		Where("n", ConditionEquals, "abc"),
+		Where("n", ConditionIn, []any{"1", "abc"}),
+		Where("b", ConditionEquals, "maybe"),
+		Where("f", ConditionLessThan, "1e"),
+		Where("t", ConditionGreaterThan, "yesterday"),
+	} {
+		_, err = cs.Query(&Query{Where: where})
+		assert.ErrorIs(t, err, ErrUnsupportedValue)
+		_, err = cs.Prepare(&Query{Where: where})
+		assert.ErrorIs(t, err, ErrUnsupportedValue)
+	}
+	rows, err := cs.Query(&Query{Where: Where("n", ConditionEquals, "1")})
+	require.NoError(t, err)
+	assert.Len(t, rows, 1, "strings that parse are converted")
+	it, err := cs.QueryIter(&Query{Select: []string{"b"}})
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	var dst struct {
+		B time.Time `querystore:"b"`
+	}
+	assert.ErrorIs(t, it.ScanStruct(&dst), ErrUnsupportedValue)
+	require.NoError(t, it.Close())
+
+	// Results of mixed types sort by type.
+	require.NoError(t, cs.Append(map[string]any{"j": map[string]any{"v": "a"}}))
+	require.NoError(t, cs.Append(map[string]any{"j": map[string]any{"v": 2}}))
+	require.NoError(t, cs.Append(map[string]any{"j": map[string]any{"v": map[string]any{}}}))
+	res, err := cs.Query(&Query{Select: []string{"j.v"}, Filters: []Filter{{Attribute: "j.v", Condition: ConditionIsNotNull}}, OrderBy: []Order{{Attribute: "j.v"}}})
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	assert.Equal(t, []any{int64(2), "a", map[string]any{}}, []any{res[0]["j.v"], res[1]["j.v"], res[2]["j.v"]})
+	require.NoError(t, fs.Close())
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "x.zz.dat"), nil, 0644))
+	_, err = OpenColumnFS(dir)
+	assert.ErrorIs(t, err, ErrUnknownColumnType)
+	require.NoError(t, os.Remove(filepath.Join(dir, "x.zz.dat")))
+
+	// An index file whose records are not at the offsets of their rows is
+	// corrupt.
+	data, err := os.ReadFile(filepath.Join(dir, indexFileName))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, indexFileName), append(data, data[len(data)-48:len(data)-32]...), 0644))
+	_, err = OpenColumnFS(dir)
+	assert.ErrorIs(t, err, ErrCorruptIndex)
+	_, err = OpenColumnFSWithOptions(dir, Options{ReadOnly: true})
+	assert.ErrorIs(t, err, ErrCorruptIndex)
+}
+
+func TestTypeMode(t *testing.T) {
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "i", Type: ColumnTypeInt64},
+		{Name: "i32", Type: ColumnTypeInt32},
+		{Name: "u", Type: ColumnTypeUint64},
+		{Name: "f", Type: ColumnTypeFloat64},
+		{Name: "s", Type: ColumnTypeString},
+		{Name: "b", Type: ColumnTypeBool},
+		{Name: "t", Type: ColumnTypeTime},
+		{Name: "j", Type: ColumnTypeJSON},
+	}}
+	strict, err := OpenColumnFSWithOptions(t.TempDir(), Options{Schema: schema})
+	require.NoError(t, err)
+	defer strict.Close()
+	assert.ErrorIs(t, strict.WriteRows([]map[string]any{{"i": "5"}}), ErrTypeMismatch)
+	require.NoError(t, strict.WriteRows([]map[string]any{{"i32": 5, "u": uint8(5)}}), "integers fit in range")
+
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Schema: schema, TypeMode: TypeModeLenient})
+	require.NoError(t, err)
+	defer fs.Close()
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, fs.WriteRows([]map[string]any{
+		{"i": "5", "i32": 2.6, "u": "7", "f": 3, "s": 1.5, "b": "true", "t": ts.Format(time.RFC3339), "j": "x"},
+		{"i": true, "i32": "-3", "u": 7.2, "f": "2.5", "s": true, "b": 0, "t": ts.UnixNano(), "j": 4},
+		{"s": 1e-9},
+		{"s": 1.0},
+	}))
+	for _, row := range []map[string]any{
+		{"i": "5.5"},
+		{"i": map[string]any{"a": 1}},
+		{"i32": int64(math.MaxInt32 + 1)},
+		{"u": -1},
+		{"u": -1.5},
+		{"i": 1e30},
+		{"b": "maybe"},
+		{"b": ts},
+		{"t": 1.5},
+		{"t": "yesterday"},
+	} {
+		assert.ErrorIs(t, fs.WriteRows([]map[string]any{row}), ErrTypeMismatch, "%v", row)
+	}
+	res, err := NewColumnarStore(fs).Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	for _, row := range res {
+		delete(row, IndexColumn)
+		delete(row, TimestampColumn)
+	}
+	assert.Equal(t, map[string]any{"i": int64(5), "i32": int64(3), "u": uint64(7), "f": float64(3), "s": "1.5", "b": true, "t": ts, "j": "x"}, res[0])
+	assert.Equal(t, map[string]any{"i": int64(1), "i32": int64(-3), "u": uint64(7), "f": 2.5, "s": "true", "b": false, "t": ts, "j": float64(4)}, res[1])
+	assert.Equal(t, "1e-09", res[2]["s"], "floats keep their precision")
+	assert.Equal(t, "1", res[3]["s"])
+}
@@ -0,0 +1,151 @@
+package querystore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// SlogHandlerOptions configures a SlogHandler.
+type SlogHandlerOptions struct {
+	// Level is the minimum level of records appended. Defaults to
+	// slog.LevelInfo.
+	Level slog.Leveler
+	// AddSource appends the file and line of the logging call in the source
+	// column.
+	AddSource bool
+}
+
+// SlogHandler is a slog.Handler appending each record as a row. Rows hold
+// the record's time, level and message in the time, level and msg columns,
+// and each attribute in a column of its key, with the keys of groups joined
+// by dots, such as "req.method". Durations are stored as nanoseconds, errors
+// and fmt.Stringers as text, and other values that are not numbers, strings,
+// bools or times as JSON. Attributes named like the built-in columns are
+// overwritten by them, and those whose keys start with "__" are dropped.
+type SlogHandler struct {
+	s     *ColumnarStore
+	opts  SlogHandlerOptions
+	attrs map[string]any
+	group string
+}
+
+// NewSlogHandler returns a handler appending records to s.
+func NewSlogHandler(s *ColumnarStore, opts *SlogHandlerOptions) *SlogHandler {
+	h := &SlogHandler{s: s, attrs: map[string]any{}}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+func (h *SlogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	row := make(map[string]any, len(h.attrs)+r.NumAttrs()+4)
+	for k, v := range h.attrs {
+		row[k] = v
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addSlogAttr(row, h.group, a)
+		return true
+	})
+	if !r.Time.IsZero() {
+		row["time"] = r.Time
+	}
+	row["level"] = r.Level.String()
+	row["msg"] = r.Message
+	if h.opts.AddSource && r.PC != 0 {
+		f, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		row["source"] = fmt.Sprintf("%s:%d", f.File, f.Line)
+	}
+	return h.s.AppendContext(ctx, row)
+}
+
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = make(map[string]any, len(h.attrs)+len(attrs))
+	for k, v := range h.attrs {
+		h2.attrs[k] = v
+	}
+	for _, a := range attrs {
+		addSlogAttr(h2.attrs, h.group, a)
+	}
+	return &h2
+}
+
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+// addSlogAttr adds an attribute to a row under its key prefixed by group.
+func addSlogAttr(row map[string]any, group string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		prefix := group
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			addSlogAttr(row, prefix, ga)
+		}
+		return
+	}
+	key := group + a.Key
+	if a.Equal(slog.Attr{}) || strings.HasPrefix(key, "__") {
+		return
+	}
+	switch v.Kind() {
+	case slog.KindString:
+		row[key] = v.String()
+	case slog.KindInt64:
+		row[key] = v.Int64()
+	case slog.KindUint64:
+		row[key] = v.Uint64()
+	case slog.KindFloat64:
+		row[key] = v.Float64()
+	case slog.KindBool:
+		row[key] = v.Bool()
+	case slog.KindDuration:
+		row[key] = int64(v.Duration())
+	case slog.KindTime:
+		row[key] = v.Time()
+	default:
+		if av := slogAnyValue(v.Any()); av != nil {
+			row[key] = av
+		}
+	}
+}
+
+func slogAnyValue(v any) any {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	case time.Time, string:
+		return v
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return json.RawMessage(b)
+}
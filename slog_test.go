@@ -0,0 +1,42 @@
+package querystore
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlogHandler(t *testing.T) {
+	cs := newTestStore(t)
+	logger := slog.New(NewSlogHandler(cs, &SlogHandlerOptions{Level: slog.LevelDebug, AddSource: true}))
+	reqLogger := logger.With("service", "api").WithGroup("req").With("method", "GET")
+	reqLogger.Info("served", "status", 200, "took", 1500*time.Millisecond, slog.Group("user", "id", 7, "admin", true))
+	logger.Debug("cache miss", "err", io.EOF, "keys", []string{"a", "b"}, "__hidden", 1, "ratio", 0.5)
+	slog.New(NewSlogHandler(cs, nil)).Debug("dropped")
+
+	rows, err := cs.Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	served := rows[0]
+	assert.Equal(t, "INFO", served["level"])
+	assert.Equal(t, "served", served["msg"])
+	assert.Equal(t, "api", served["service"])
+	assert.Equal(t, "GET", served["req.method"])
+	assert.Equal(t, int64(200), served["req.status"])
+	assert.Equal(t, int64(1500*time.Millisecond), served["req.took"])
+	assert.Equal(t, int64(7), served["req.user.id"])
+	assert.Equal(t, true, served["req.user.admin"])
+	assert.IsType(t, time.Time{}, served["time"])
+	assert.Contains(t, served["source"], "slog_test.go:")
+
+	miss := rows[1]
+	assert.Equal(t, "DEBUG", miss["level"])
+	assert.Equal(t, "EOF", miss["err"])
+	assert.Equal(t, []any{"a", "b"}, miss["keys"])
+	assert.Equal(t, 0.5, miss["ratio"])
+	assert.Nil(t, miss["service"])
+}
@@ -0,0 +1,37 @@
+package querystore
+
+import "time"
+
+// SlowQuery describes a query that took at least Options.SlowQueryThreshold,
+// from QueryIter until its rows were closed.
+type SlowQuery struct {
+	Query        *Query
+	Duration     time.Duration
+	RowsScanned  int64
+	RowsReturned int
+	// Err is the error that ended the query, if any.
+	Err error
+}
+
+// finishQuery reports a query that ran from start to the store's metrics,
+// and to the slow query log if it was slow.
+func (fs *ColumnFS) finishQuery(q *Query, start time.Time, scanned int64, returned int, err error) {
+	d := time.Since(start)
+	if m := fs.opts.Metrics; m != nil {
+		m.Queried(d, scanned, err)
+	}
+	if fs.opts.SlowQueryThreshold <= 0 || d < fs.opts.SlowQueryThreshold {
+		return
+	}
+	slow := SlowQuery{Query: q, Duration: d, RowsScanned: scanned, RowsReturned: returned, Err: err}
+	if fs.opts.SlowQueryLog != nil {
+		fs.opts.SlowQueryLog(slow)
+		return
+	}
+	query, jsonErr := EncodeQueryJSON(q)
+	if jsonErr != nil {
+		query = []byte(jsonErr.Error())
+	}
+	fs.logger().Warn("querystore: slow query", "dir", fs.dir, "query", string(query), "duration", d,
+		"rows_scanned", scanned, "rows_returned", returned, "err", err)
+}
@@ -0,0 +1,64 @@
+package querystore
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlowQueryLog(t *testing.T) {
+	var slow []SlowQuery
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{
+		SlowQueryThreshold: time.Nanosecond,
+		SlowQueryLog:       func(q SlowQuery) { slow = append(slow, q) },
+	})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 20 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i)}))
+	}
+	q := &Query{
+		Select:    []string{"val"},
+		Filters:   []Filter{{Attribute: "val", Condition: ConditionLessThan, Value: int64(5)}},
+		Where:     Not(Where("val", ConditionIsNull, nil)),
+		OrderBy:   []Order{{Attribute: "val", Descending: true}},
+		Limit:     3,
+		TimeRange: TimeRange{Start: time.Unix(0, 1).UTC()},
+	}
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 3)
+	require.Len(t, slow, 1)
+	assert.Same(t, q, slow[0].Query)
+	assert.Equal(t, int64(20), slow[0].RowsScanned)
+	assert.Equal(t, 3, slow[0].RowsReturned)
+	assert.Positive(t, slow[0].Duration)
+
+	// The JSON form of the query decodes to the same query.
+	encoded, err := EncodeQueryJSON(q)
+	require.NoError(t, err)
+	decoded, err := DecodeQueryJSON(bytes.NewReader(encoded))
+	require.NoError(t, err)
+	assert.Equal(t, &Query{
+		Select:    q.Select,
+		Where:     And(Where("val", ConditionLessThan, int64(5)), q.Where),
+		OrderBy:   q.OrderBy,
+		Limit:     3,
+		TimeRange: q.TimeRange,
+	}, decoded)
+
+	// Without a callback, slow queries are logged.
+	var logs bytes.Buffer
+	fs.opts.SlowQueryLog = nil
+	fs.opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+	_, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}})
+	require.NoError(t, err)
+	assert.Contains(t, logs.String(), `msg="querystore: slow query"`)
+	assert.Contains(t, logs.String(), `query="{\"aggregations\":[{\"op\":\"count\"}]}"`)
+	assert.Contains(t, logs.String(), "rows_returned=1")
+}
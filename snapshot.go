@@ -0,0 +1,163 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// snapshotFile is a file of a store as of a snapshot: its first size bytes,
+// with the length of a run-length encoded run that later appends may extend
+// rewritten at patchOffset.
+type snapshotFile struct {
+	fp          BackendFile
+	name        string
+	size        int64
+	patchOffset int64
+	patch       []byte
+}
+
+// Snapshot writes a consistent copy of the store as of the call into
+// destDir, which must be empty or not exist, returning the number of rows
+// copied. Only opening the files holds up appends; their contents are copied
+// as they were when opened while appends continue. Block indexes, zone maps,
+// bloom filters and checksums are not copied, and are rebuilt when the copy
+// is first opened.
+func (fs *ColumnFS) Snapshot(destDir string) (int64, error) {
+	entries, err := os.ReadDir(destDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if len(entries) > 0 {
+		return 0, fmt.Errorf("snapshot directory %s is not empty", destDir)
+	}
+
+	fs.lock.Lock()
+	if err := fs.flushBuffer(); err != nil {
+		fs.lock.Unlock()
+		return 0, err
+	}
+	rows := fs.nextID
+	files, err := fs.snapshotFiles("")
+	fs.lock.Unlock()
+	defer func() {
+		for _, f := range files {
+			f.fp.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	dirs := map[string]bool{}
+	for _, f := range files {
+		dest := filepath.Join(destDir, f.name)
+		dirs[filepath.Dir(dest)] = true
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return 0, err
+		}
+		if err := f.copyTo(dest); err != nil {
+			return 0, fmt.Errorf("copying %s: %w", f.fp.Name(), err)
+		}
+	}
+	for dir := range dirs {
+		if err := syncDir(OSBackend{}, dir); err != nil {
+			return 0, err
+		}
+	}
+	return rows, nil
+}
+
+// snapshotFiles opens the files of the store, named relative to the
+// snapshot's directory under prefix. The caller must hold fs.lock.
+func (fs *ColumnFS) snapshotFiles(prefix string) ([]snapshotFile, error) {
+	var files []snapshotFile
+	open := func(b ColumnBackend, p, name string) (*snapshotFile, error) {
+		fp, err := b.OpenFile(p, os.O_RDONLY, 0)
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fi, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		files = append(files, snapshotFile{fp: fp, name: path.Join(prefix, name), size: fi.Size()})
+		return &files[len(files)-1], nil
+	}
+
+	for _, p := range fs.partitions {
+		name := path.Base(p.fs.dir)
+		if _, err := open(p.fs.backend, path.Join(p.fs.dir, partitionBaseFileName), path.Join(name, partitionBaseFileName)); err != nil {
+			return files, err
+		}
+		p.fs.lock.Lock()
+		pfiles, err := p.fs.snapshotFiles(path.Join(prefix, name))
+		p.fs.lock.Unlock()
+		files = append(files, pfiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+	if fs.rollups != nil {
+		fs.rollups.lock.Lock()
+		rfiles, err := fs.rollups.snapshotFiles(path.Join(prefix, rollupDirName))
+		fs.rollups.lock.Unlock()
+		files = append(files, rfiles...)
+		if err != nil {
+			return files, err
+		}
+	}
+	for _, name := range []string{prunedFileName, tombstoneFileName} {
+		if _, err := open(fs.backend, path.Join(fs.dir, name), name); err != nil {
+			return files, err
+		}
+	}
+	for _, ch := range fs.columnHandles {
+		if ch.rle() && ch.codec == nil {
+			// The length of the last run is rewritten in place by appends
+			// that extend it.
+			if err := ch.loadBlockIndex(); err != nil {
+				return files, err
+			}
+		}
+		f, err := open(fs.backend, ch.path, path.Base(ch.path))
+		if err != nil {
+			return files, err
+		}
+		if r := ch.lastRun; f != nil && r != nil && r.written && ch.rle() && ch.codec == nil {
+			f.patchOffset = r.countOffset
+			f.patch = binary.LittleEndian.AppendUint32(nil, uint32(r.end-r.start))
+		}
+	}
+	return files, nil
+}
+
+// copyTo copies the file as of the snapshot to dest, syncing the copy.
+func (f *snapshotFile) copyTo(dest string) error {
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(f.fp, 0, f.size))
+	if err == nil && f.patch != nil {
+		_, err = out.WriteAt(f.patch, f.patchOffset)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	return errors.Join(err, out.Close())
+}
+
+// Snapshot copies the store into destDir while appends continue. See
+// ColumnFS.Snapshot.
+func (s *ColumnarStore) Snapshot(destDir string) (int64, error) {
+	return s.fs.Snapshot(destDir)
+}
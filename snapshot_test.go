@@ -0,0 +1,54 @@
+package querystore
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	schema := &Schema{Columns: []ColumnSpec{{Name: "kind", Type: ColumnTypeString, Encoding: EncodingRLE}, {Name: "val", Type: ColumnTypeInt64}}}
+	fs, err := OpenColumnFSWithOptions(dir, Options{Schema: schema})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"kind": "a", "val": i}))
+	}
+	_, err = cs.Delete(&Query{Where: Where("val", ConditionEquals, 0)})
+	require.NoError(t, err)
+
+	// Appends during the copy are not part of the snapshot, including those
+	// extending the last run.
+	dest := filepath.Join(t.TempDir(), "snap")
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 50 {
+			assert.NoError(t, cs.Append(map[string]any{"kind": "a", "val": 10 + i}))
+		}
+	}()
+	n, err := cs.Snapshot(dest)
+	require.NoError(t, err)
+	wg.Wait()
+	assert.GreaterOrEqual(t, n, int64(10))
+
+	snap, err := OpenColumnFSWithOptions(dest, Options{Schema: schema})
+	require.NoError(t, err)
+	defer snap.Close()
+	rows, err := NewColumnarStore(snap).Query(&Query{Select: []string{"kind", "val"}})
+	require.NoError(t, err)
+	require.Len(t, rows, int(n)-1)
+	for i, row := range rows {
+		assert.Equal(t, "a", row["kind"])
+		assert.Equal(t, int64(i+1), row["val"])
+	}
+
+	_, err = cs.Snapshot(dest)
+	assert.ErrorContains(t, err, "not empty")
+}
@@ -0,0 +1,616 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// sqlToken is a token of a SQL statement.
+type sqlToken struct {
+	kind sqlTokenKind
+	text string
+	pos  int
+}
+
+type sqlTokenKind int
+
+const (
+	sqlEOF sqlTokenKind = iota
+	sqlIdent
+	sqlKeyword
+	sqlNumber
+	sqlString
+	sqlSymbol
+	sqlPlaceholder
+)
+
+var sqlKeywords = map[string]bool{
+	"SELECT": true, "FROM": true, "WHERE": true, "AND": true, "OR": true,
+	"NOT": true, "IS": true, "NULL": true, "TRUE": true, "FALSE": true,
+	"IN": true, "LIKE": true, "AS": true, "GROUP": true, "ORDER": true,
+	"BY": true, "ASC": true, "DESC": true, "LIMIT": true, "OFFSET": true,
+}
+
+// lexSQL splits a statement into tokens. Keywords are upper-cased; quoted
+// identifiers and strings are unquoted.
+func lexSQL(s string) ([]sqlToken, error) {
+	var toks []sqlToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '_' || unicode.IsLetter(c):
+			j := i
+			for j < len(s) && (s[j] == '_' || s[j] == '.' || unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j]))) {
+				j++
+			}
+			word := s[i:j]
+			if upper := strings.ToUpper(word); sqlKeywords[upper] {
+				toks = append(toks, sqlToken{sqlKeyword, upper, i})
+			} else {
+				toks = append(toks, sqlToken{sqlIdent, word, i})
+			}
+			i = j
+		case unicode.IsDigit(c) || (c == '-' || c == '.') && i+1 < len(s) && unicode.IsDigit(rune(s[i+1])):
+			j := i + 1
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || strings.ContainsRune(".eE", rune(s[j])) ||
+				(s[j] == '-' || s[j] == '+') && (s[j-1] == 'e' || s[j-1] == 'E')) {
+				j++
+			}
+			toks = append(toks, sqlToken{sqlNumber, s[i:j], i})
+			i = j
+		case c == '\'' || c == '"':
+			// Quotes are escaped by doubling them.
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return nil, fmt.Errorf("sql: unterminated quote at offset %d", i)
+				}
+				if s[j] == byte(c) {
+					if j+1 < len(s) && s[j+1] == byte(c) {
+						b.WriteByte(byte(c))
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+				j++
+			}
+			kind := sqlString
+			if c == '"' {
+				kind = sqlIdent
+			}
+			toks = append(toks, sqlToken{kind, b.String(), i})
+			i = j + 1
+		case c == '?':
+			toks = append(toks, sqlToken{sqlPlaceholder, "?", i})
+			i++
+		default:
+			n := 1
+			if i+1 < len(s) && slices.Contains([]string{"<=", ">=", "!=", "<>"}, s[i:i+2]) {
+				n = 2
+			}
+			if n == 1 && !strings.ContainsRune("=<>(),*;", c) {
+				return nil, fmt.Errorf("sql: unexpected character %q at offset %d", c, i)
+			}
+			toks = append(toks, sqlToken{sqlSymbol, s[i : i+n], i})
+			i += n
+		}
+	}
+	return append(toks, sqlToken{kind: sqlEOF, pos: len(s)}), nil
+}
+
+// sqlParam stands in for the value of the nth placeholder of a statement
+// until it is bound.
+type sqlParam int
+
+// sqlStatement is a parsed SELECT statement.
+type sqlStatement struct {
+	q *Query
+	// columns names the result columns in the order they are selected,
+	// unless the statement selects *.
+	columns []string
+	params  int
+}
+
+// sqlParser parses a SELECT statement into a Query.
+type sqlParser struct {
+	toks   []sqlToken
+	pos    int
+	params int
+}
+
+// QueryFromSQL parses a SQL SELECT statement into a Query. Statements take
+// the form
+//
+//	SELECT * | item, ... [FROM name]
+//	[WHERE condition]
+//	[GROUP BY column, ...]
+//	[ORDER BY column | aggregate [ASC | DESC], ...]
+//	[LIMIT n [OFFSET n]]
+//
+// where each item is a column or an aggregate, COUNT(*), COUNT(column),
+// SUM(column), MIN(column), MAX(column), AVG(column) or
+// APPROX_DISTINCT(column), optionally named with AS alias. Aggregate queries
+// may only select the GROUP BY column besides aggregates. Conditions compare a
+// column to a value with =, !=, <>, <, <=, > or >=, or test it with IS [NOT]
+// NULL, [NOT] IN (value, ...) or [NOT] LIKE pattern, and combine with AND, OR,
+// NOT and parentheses; NOT matches rows without a value for the columns it
+// negates conditions on, as Not does. Values are numbers, single-quoted
+// strings, TRUE or FALSE. Identifiers may be double-quoted, and are matched
+// case-sensitively; keywords are not. Columns ordered by but not selected are
+// added to the selected columns.
+func QueryFromSQL(sql string) (*Query, error) {
+	stmt, err := parseSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	if stmt.params > 0 {
+		return nil, errors.New("sql: statement has ? placeholders, which only the database/sql driver binds")
+	}
+	return stmt.q, nil
+}
+
+// parseSQL parses a statement as QueryFromSQL does, also allowing ?
+// placeholders for values.
+func parseSQL(s string) (*sqlStatement, error) {
+	toks, err := lexSQL(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &sqlParser{toks: toks}
+	stmt, err := p.parseSelect()
+	if err != nil {
+		return nil, err
+	}
+	stmt.params = p.params
+	return stmt, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	return p.toks[p.pos]
+}
+
+// accept consumes the next token if it is the keyword or symbol text.
+func (p *sqlParser) accept(text string) bool {
+	if tok := p.peek(); (tok.kind == sqlKeyword || tok.kind == sqlSymbol) && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + text)
+	}
+	return nil
+}
+
+func (p *sqlParser) unexpected(want string) error {
+	tok := p.peek()
+	if tok.kind == sqlEOF {
+		return fmt.Errorf("sql: %s, found end of statement", want)
+	}
+	return fmt.Errorf("sql: %s, found %q at offset %d", want, tok.text, tok.pos)
+}
+
+func (p *sqlParser) ident() (string, error) {
+	tok := p.peek()
+	if tok.kind != sqlIdent {
+		return "", p.unexpected("expected a column name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+func (p *sqlParser) parseSelect() (*sqlStatement, error) {
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	q := &Query{}
+	stmt := &sqlStatement{q: q}
+	var plain []string
+	for {
+		switch agg, ok, err := p.aggregate(); {
+		case err != nil:
+			return nil, err
+		case ok:
+			if p.accept("AS") {
+				if agg.Alias, err = p.ident(); err != nil {
+					return nil, err
+				}
+			}
+			q.Aggregations = append(q.Aggregations, agg)
+			stmt.columns = append(stmt.columns, agg.Name())
+		case p.accept("*"):
+			q.Select = append(q.Select, "*")
+		default:
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			q.Select = append(q.Select, col)
+			plain = append(plain, col)
+			stmt.columns = append(stmt.columns, col)
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	if p.accept("FROM") {
+		// There is a single table, whatever its name.
+		if _, err := p.ident(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("WHERE") {
+		where, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		q.Where = where
+	}
+	if p.accept("GROUP") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			col, err := p.ident()
+			if err != nil {
+				return nil, err
+			}
+			if q.GroupBy == "" {
+				q.GroupBy = col
+			} else {
+				q.GroupByColumns = append(q.GroupByColumns, col)
+			}
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("ORDER") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		for {
+			var order Order
+			if agg, ok, err := p.aggregate(); err != nil {
+				return nil, err
+			} else if ok {
+				order.Attribute = agg.Name()
+			} else if order.Attribute, err = p.ident(); err != nil {
+				return nil, err
+			}
+			if p.accept("DESC") {
+				order.Descending = true
+			} else {
+				p.accept("ASC")
+			}
+			q.OrderBy = append(q.OrderBy, order)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("LIMIT") {
+		n, err := p.count()
+		if err != nil {
+			return nil, err
+		}
+		q.Limit = n
+		if p.accept("OFFSET") {
+			if q.Offset, err = p.count(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	p.accept(";")
+	if p.peek().kind != sqlEOF {
+		return nil, p.unexpected("expected end of statement")
+	}
+
+	if len(q.Aggregations) == 0 {
+		if q.GroupBy != "" {
+			return nil, errors.New("sql: GROUP BY needs an aggregate to compute")
+		}
+		if slices.Contains(q.Select, "*") {
+			stmt.columns = nil
+			return stmt, nil
+		}
+		// Rows are sorted by their values, so ordering columns are selected
+		// too.
+		for _, o := range q.OrderBy {
+			if !slices.Contains(q.Select, o.Attribute) {
+				q.Select = append(q.Select, o.Attribute)
+			}
+		}
+		return stmt, nil
+	}
+	for _, col := range q.Select {
+		if col == "*" {
+			return nil, errors.New("sql: cannot select * with aggregates")
+		}
+	}
+	for _, col := range plain {
+		if !slices.Contains(q.groupColumns(), col) {
+			return nil, fmt.Errorf("sql: column %s must be grouped by to be selected with aggregates", col)
+		}
+	}
+	q.Select = nil
+	return stmt, nil
+}
+
+var sqlAggregators = map[string]AggregatorType{
+	"COUNT": AggregatorCount,
+	"SUM":   AggregatorSum,
+	"MIN":   AggregatorMin,
+	"MAX":   AggregatorMax,
+	"AVG":   AggregatorAvg,
+
+	"APPROX_DISTINCT": AggregatorApproxDistinct,
+}
+
+// aggregate parses an aggregate function call, if one is next.
+func (p *sqlParser) aggregate() (Aggregation, bool, error) {
+	tok, open := p.peek(), p.toks[min(p.pos+1, len(p.toks)-1)]
+	typ, ok := sqlAggregators[strings.ToUpper(tok.text)]
+	if tok.kind != sqlIdent || !ok || open.kind != sqlSymbol || open.text != "(" {
+		return Aggregation{}, false, nil
+	}
+	p.pos += 2
+	agg := Aggregation{Type: typ}
+	if typ != AggregatorCount || !p.accept("*") {
+		var err error
+		if agg.Attribute, err = p.ident(); err != nil {
+			return agg, false, err
+		}
+	}
+	return agg, true, p.expect(")")
+}
+
+var sqlOperators = map[string]ConditionType{
+	"=":  ConditionEquals,
+	"!=": ConditionNotEquals,
+	"<>": ConditionNotEquals,
+	"<":  ConditionLessThan,
+	"<=": ConditionLessThanOrEquals,
+	">":  ConditionGreaterThan,
+	">=": ConditionGreaterThanOrEquals,
+}
+
+func (p *sqlParser) parseOr() (*FilterExpression, error) {
+	var exprs []*FilterExpression
+	for {
+		e, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept("OR") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return Or(exprs...), nil
+}
+
+func (p *sqlParser) parseAnd() (*FilterExpression, error) {
+	var exprs []*FilterExpression
+	for {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept("AND") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return And(exprs...), nil
+}
+
+func (p *sqlParser) parseNot() (*FilterExpression, error) {
+	if p.accept("NOT") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return Not(e), nil
+	}
+	if p.accept("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	return p.parseCondition()
+}
+
+func (p *sqlParser) parseCondition() (*FilterExpression, error) {
+	col, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("IS") {
+		cond := ConditionIsNull
+		if p.accept("NOT") {
+			cond = ConditionIsNotNull
+		}
+		if err := p.expect("NULL"); err != nil {
+			return nil, err
+		}
+		return Where(col, cond, nil), nil
+	}
+	negate := p.accept("NOT")
+	switch {
+	case p.accept("IN"):
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		var values []any
+		for {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		if negate {
+			return Where(col, ConditionNotIn, values), nil
+		}
+		return Where(col, ConditionIn, values), nil
+	case p.accept("LIKE"):
+		tok := p.peek()
+		if tok.kind != sqlString {
+			return nil, p.unexpected("expected a LIKE pattern")
+		}
+		p.pos++
+		e := likeFilter(col, tok.text)
+		if negate {
+			return Not(e), nil
+		}
+		return e, nil
+	case negate:
+		return nil, p.unexpected("expected IN or LIKE")
+	}
+	tok := p.peek()
+	cond, ok := sqlOperators[tok.text]
+	if tok.kind != sqlSymbol || !ok {
+		return nil, p.unexpected("expected a comparison")
+	}
+	p.pos++
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return Where(col, cond, v), nil
+}
+
+// likeFilter returns a filter matching a LIKE pattern, where % matches any
+// text and _ any character.
+func likeFilter(col, pattern string) *FilterExpression {
+	inner := strings.Trim(pattern, "%")
+	if !strings.ContainsAny(inner, "%_") {
+		prefix, suffix := strings.HasPrefix(pattern, "%"), strings.HasSuffix(pattern, "%")
+		switch {
+		case prefix && suffix && len(pattern) > 1:
+			return Where(col, ConditionContains, inner)
+		case prefix:
+			return Where(col, ConditionEndsWith, inner)
+		case suffix:
+			return Where(col, ConditionStartsWith, inner)
+		default:
+			return Where(col, ConditionEquals, inner)
+		}
+	}
+	var re strings.Builder
+	re.WriteString("^(?s:")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			re.WriteString(".*")
+		case '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	re.WriteString(")$")
+	return Where(col, ConditionMatches, re.String())
+}
+
+// value parses a literal or placeholder.
+func (p *sqlParser) value() (any, error) {
+	tok := p.peek()
+	switch {
+	case tok.kind == sqlNumber:
+		p.pos++
+		if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("sql: invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return f, nil
+	case tok.kind == sqlString:
+		p.pos++
+		return tok.text, nil
+	case tok.kind == sqlPlaceholder:
+		p.pos++
+		p.params++
+		return sqlParam(p.params - 1), nil
+	case p.accept("TRUE"):
+		return true, nil
+	case p.accept("FALSE"):
+		return false, nil
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+func (p *sqlParser) count() (int, error) {
+	tok := p.peek()
+	n, err := strconv.Atoi(tok.text)
+	if tok.kind != sqlNumber || err != nil || n < 0 {
+		return 0, p.unexpected("expected a row count")
+	}
+	p.pos++
+	return n, nil
+}
+
+// bindSQLParams returns a copy of a filter expression with its placeholders
+// replaced by args.
+func bindSQLParams(e *FilterExpression, args []any) *FilterExpression {
+	switch {
+	case e == nil:
+		return nil
+	case e.Filter != nil:
+		f := *e.Filter
+		switch v := f.Value.(type) {
+		case sqlParam:
+			f.Value = args[v]
+		case []any:
+			values := make([]any, len(v))
+			for i, item := range v {
+				if n, ok := item.(sqlParam); ok {
+					item = args[n]
+				}
+				values[i] = item
+			}
+			f.Value = values
+		}
+		return &FilterExpression{Filter: &f}
+	case e.Not != nil:
+		return Not(bindSQLParams(e.Not, args))
+	}
+	bound := &FilterExpression{}
+	for _, sub := range e.And {
+		bound.And = append(bound.And, bindSQLParams(sub, args))
+	}
+	for _, sub := range e.Or {
+		bound.Or = append(bound.Or, bindSQLParams(sub, args))
+	}
+	return bound
+}
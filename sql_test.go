@@ -0,0 +1,52 @@
+package querystore
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryFromSQL(t *testing.T) {
+	cs := newTestStore(t)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"name": "n" + strconv.Itoa(i), "val": i, "region": []string{"us", "eu"}[i%2]}))
+	}
+
+	q, err := QueryFromSQL(`select name from t where (val < 2 or val > 7) and not name like 'n_' or name in ('n1', 'n9') order by val desc`)
+	require.NoError(t, err)
+	rows, err := cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"n9", "n1"}, lo.Map(rows, func(row map[string]any, _ int) string { return row["name"].(string) }))
+
+	q, err = QueryFromSQL(`SELECT region, COUNT(*), SUM(val) AS total FROM t WHERE name NOT IN ('n0') GROUP BY region ORDER BY total DESC LIMIT 1`)
+	require.NoError(t, err)
+	assert.Equal(t, "region", q.GroupBy)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, "eu", rows[0]["region"])
+	assert.EqualValues(t, 5, rows[0]["count"])
+	assert.EqualValues(t, 25, rows[0]["total"])
+
+	q, err = QueryFromSQL(`SELECT * FROM t WHERE name LIKE '%5' OR name LIKE 'n%8%'`)
+	require.NoError(t, err)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Len(t, rows, 2)
+
+	for sql, msg := range map[string]string{
+		"SELECT name, count(*) FROM t":           "must be grouped by",
+		"SELECT name FROM t GROUP BY name":       "GROUP BY needs an aggregate",
+		"SELECT name FROM t WHERE val = ?":       "placeholders",
+		"SELECT name FROM t WHERE (val = 1":      "expected )",
+		"SELECT name FROM t WHERE val NOT = 1":   "expected IN or LIKE",
+		"SELECT sum(*) FROM t":                   "expected a column name",
+		"SELECT name FROM t ORDER BY name LIMIT": "expected a row count",
+	} {
+		_, err := QueryFromSQL(sql)
+		assert.ErrorContains(t, err, msg, sql)
+	}
+}
@@ -0,0 +1,196 @@
+package querystore
+
+import (
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Stats describes the contents of a store, for capacity planning and
+// debugging.
+type Stats struct {
+	// Rows is the number of rows, not counting those pruned or deleted.
+	Rows int64
+	// Bytes is the size of the store's files, including indexes and logs.
+	Bytes int64
+	// LastAppend is when rows were last appended, or zero if never.
+	LastAppend time.Time
+	// Columns describes each column, sorted by name.
+	Columns []ColumnStats
+}
+
+// ColumnStats describes a column of a store in Stats.
+type ColumnStats struct {
+	Name string
+	Type ColumnType
+	// Values counts the rows with a value in the column, and Nulls those
+	// without.
+	Values int64
+	Nulls  int64
+	// Distinct estimates the number of distinct values, within about 2%.
+	Distinct int64
+	// Bytes is the size of the column file and its sidecars.
+	Bytes int64
+}
+
+// columnTally accumulates the stats of a column across partitions.
+type columnTally struct {
+	typ    ColumnType
+	values int64
+	bytes  int64
+	sketch hllSketch
+}
+
+// Stats reports the rows, columns and size of the store. It reads every
+// column file, so takes as long as a query scanning every column. Partitions
+// offloaded to an object store count only their rows.
+func (fs *ColumnFS) Stats() (Stats, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.flushBuffer(); err != nil {
+		return Stats{}, err
+	}
+
+	var s Stats
+	tallies := map[string]*columnTally{}
+	if fs.partitioning == PartitionNone {
+		s.Rows = fs.liveRows()
+		if err := fs.tallyColumns(tallies); err != nil {
+			return Stats{}, err
+		}
+	}
+	for _, p := range fs.partitions {
+		p.fs.lock.Lock()
+		s.Rows += p.fs.liveRows()
+		var err error
+		if !p.offloaded {
+			err = p.fs.tallyColumns(tallies)
+		}
+		p.fs.lock.Unlock()
+		if err != nil {
+			return Stats{}, err
+		}
+	}
+	if fs.nextID > 0 {
+		s.LastAppend = time.Unix(0, fs.lastTimestamp).UTC()
+	}
+	var err error
+	if s.Bytes, err = fs.dirSize(fs.dir); err != nil {
+		return Stats{}, err
+	}
+	s.Columns = []ColumnStats{}
+	for name, t := range tallies {
+		s.Columns = append(s.Columns, ColumnStats{
+			Name:     name,
+			Type:     t.typ,
+			Values:   t.values,
+			Nulls:    s.Rows - t.values,
+			Distinct: t.sketch.estimate(),
+			Bytes:    t.bytes,
+		})
+	}
+	slices.SortFunc(s.Columns, func(a, b ColumnStats) int { return strings.Compare(a.Name, b.Name) })
+	return s, nil
+}
+
+// liveRows returns the number of rows neither pruned nor deleted. The caller
+// must hold fs.lock.
+func (fs *ColumnFS) liveRows() int64 {
+	rows := fs.nextID - fs.pruned
+	if fs.tombstones != nil {
+		rows -= fs.tombstones.count(fs.pruned, fs.nextID)
+	}
+	return rows
+}
+
+// tallyColumns adds the values of the rows neither pruned nor deleted, and
+// the sizes of the files, of each column to tallies. Columns whose type
+// differs between partitions report that of the latest. The caller must hold
+// fs.lock.
+func (fs *ColumnFS) tallyColumns(tallies map[string]*columnTally) error {
+	for name, ch := range fs.columnHandles {
+		if strings.HasPrefix(name, "__") {
+			continue
+		}
+		t := tallies[name]
+		if t == nil {
+			t = &columnTally{}
+			tallies[name] = t
+		}
+		t.typ = ch.typ
+		for _, p := range append([]string{ch.path}, ch.sidecarPaths()...) {
+			fi, err := fs.backend.Stat(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil {
+				t.bytes += fi.Size()
+			}
+		}
+		if err := fs.tallyValues(ch, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tallyValues counts the values of a column in rows neither pruned nor
+// deleted, and adds them to the tally's sketch.
+func (fs *ColumnFS) tallyValues(ch *ColumnHandle, t *columnTally) error {
+	cr, err := ch.createReader()
+	if err != nil {
+		return err
+	}
+	defer cr.Close()
+	for {
+		index, v, run, err := cr.readRecord()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if index < fs.pruned {
+			run, index = max(run-(fs.pruned-index), 0), fs.pruned
+		}
+		if fs.tombstones != nil {
+			run -= fs.tombstones.count(index, index+run)
+		}
+		if run > 0 && v != nil {
+			t.values += run
+			t.sketch.add(v)
+		}
+	}
+}
+
+// dirSize returns the total size of the files under a directory.
+func (fs *ColumnFS) dirSize(dir string) (int64, error) {
+	entries, err := fs.backend.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, de := range entries {
+		p := path.Join(dir, de.Name())
+		if de.IsDir() {
+			n, err := fs.dirSize(p)
+			if err != nil {
+				return 0, err
+			}
+			size += n
+			continue
+		}
+		fi, err := fs.backend.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
@@ -0,0 +1,43 @@
+package querystore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	s, err := fs.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, Stats{Bytes: s.Bytes, Columns: []ColumnStats{}}, s)
+
+	cs := NewColumnarStore(fs)
+	for i := range 100 {
+		row := map[string]any{"n": int64(i % 10)}
+		if i%4 == 0 {
+			row["s"] = fmt.Sprint("s", i)
+		}
+		require.NoError(t, cs.Append(row))
+	}
+	n, err := cs.Delete(&Query{Where: Where("n", ConditionEquals, int64(0))})
+	require.NoError(t, err)
+	require.Equal(t, int64(10), n)
+
+	s, err = fs.Stats()
+	require.NoError(t, err)
+	assert.Equal(t, int64(90), s.Rows)
+	assert.Equal(t, now, s.LastAppend)
+	require.Len(t, s.Columns, 2)
+	assert.Equal(t, ColumnStats{Name: "n", Type: ColumnTypeInt64, Values: 90, Distinct: 9, Bytes: s.Columns[0].Bytes}, s.Columns[0])
+	// Rows 0, 20, 40, 60 and 80 of s are deleted.
+	assert.Equal(t, ColumnStats{Name: "s", Type: ColumnTypeString, Values: 20, Nulls: 70, Distinct: 20, Bytes: s.Columns[1].Bytes}, s.Columns[1])
+	assert.Greater(t, s.Columns[0].Bytes, int64(0))
+	assert.Greater(t, s.Bytes, s.Columns[0].Bytes+s.Columns[1].Bytes)
+}
@@ -1,13 +1,15 @@
 package querystore
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"math"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +20,11 @@ const (
 	indexFileName     = "__index" + "." + extension
 	timestampFileName = "__timestamp" + "." + extension
 	filePerm          = 0644
+
+	// IndexColumn and TimestampColumn are the reserved result fields holding
+	// a row's index and its append time in UnixNano.
+	IndexColumn     = "__index"
+	TimestampColumn = "__timestamp"
 )
 
 type ColumnType int
@@ -27,6 +34,16 @@ const (
 	ColumnTypeInt64
 	ColumnTypeFloat64
 	ColumnTypeString
+	// ColumnTypeTime stores time.Time values as UnixNano epochs.
+	ColumnTypeTime
+	ColumnTypeUint64
+	// ColumnTypeInt32 stores integers in 4 bytes. It is only used when
+	// declared in a schema, and its values are read back as int64.
+	ColumnTypeInt32
+	// ColumnTypeJSON stores maps, slices and structs as JSON documents.
+	// Nested values can be filtered with dotted attributes such as
+	// "payload.user.id".
+	ColumnTypeJSON
 )
 
 var columnTypeToSuffix = map[ColumnType]string{
@@ -34,264 +51,915 @@ var columnTypeToSuffix = map[ColumnType]string{
 	ColumnTypeInt64:   "int64",
 	ColumnTypeFloat64: "float64",
 	ColumnTypeString:  "str",
+	ColumnTypeTime:    "time",
+	ColumnTypeUint64:  "uint64",
+	ColumnTypeInt32:   "int32",
+	ColumnTypeJSON:    "json",
 }
 
 var columnSuffixToType = biMap(columnTypeToSuffix)
 
+func (t ColumnType) String() string {
+	if t == ColumnTypeString {
+		return "string"
+	}
+	if suffix, ok := columnTypeToSuffix[t]; ok {
+		return suffix
+	}
+	return fmt.Sprintf("ColumnType(%d)", int(t))
+}
+
 type ColumnHandle struct {
 	path    string
 	typ     ColumnType
-	writeFp *os.File
+	version int
+	flags   uint8
+	// dataOffset is where records start, after the file header if any.
+	dataOffset int64
+	writeFp    BackendFile
+	// stats is loaded from the file on first use, then kept current by
+	// appends.
+	stats *columnStats
+	// size is the size of the column file. It, and the block index below,
+	// are loaded by loadBlockIndex.
+	size         int64
+	blocks       []blockEntry
+	blockFill    int64
+	blocksLoaded bool
+	idxFp        BackendFile
+	// zones holds the zone of every block, including the open last block.
+	zones  []zone
+	zoneFp BackendFile
+	// blooms holds the bloom filter of every block, including the open last
+	// block, for columns whose schema sets a false positive rate.
+	bloomRate float64
+	blooms    []*bloomFilter
+	bloomFp   BackendFile
+	// sketches holds the distinct sketch of every block, including the open
+	// last block, for columns whose schema keeps them.
+	sketched bool
+	sketches []*hllSketch
+	sketchFp BackendFile
+	// sums holds the checksum of every completed block, and tail that of
+	// the open last block.
+	sums   []uint32
+	crcFp  BackendFile
+	tail   blockTail
+	tailFp BackendFile
+	// lastRun is the last run of a run-length encoded column.
+	lastRun *rleRun
+	// codec compresses the column's records, if set.
+	codec Codec
+	// values is the value index of an indexed column, and bitmaps that of a
+	// column with a bitmap index. Both are loaded along with the block index.
+	indexed   bool
+	values    map[any][]int64
+	bitmapped bool
+	bitmaps   map[any]*bitmap
+	// readOnly is set for the files of read-only stores, whose block indexes
+	// and sidecar files are rebuilt in memory but never written.
+	readOnly bool
+	// backend stores the column file and its sidecars.
+	backend ColumnBackend
 }
 
 func (ch *ColumnHandle) Write(b []byte) error {
 	if ch.writeFp == nil {
-		fp, err := os.OpenFile(ch.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+		fp, err := ch.openForAppend()
 		if err != nil {
 			return err
 		}
 		ch.writeFp = fp
+		if ch.version >= formatVersion {
+			fi, err := fp.Stat()
+			if err != nil {
+				return err
+			}
+			if fi.Size() == 0 {
+				if _, err := fp.Write(ch.header().encode()); err != nil {
+					return err
+				}
+				ch.dataOffset = headerSize
+				ch.size = headerSize
+				if ch.stats != nil {
+					ch.stats.size += headerSize
+				}
+			}
+		}
 	}
-	_, err := ch.writeFp.Write(b)
+	n, err := ch.writeFp.Write(b)
+	ch.size += int64(n)
 	return err
 }
 
 func (cf *ColumnHandle) IndexedWrite(index int64, v any) error {
-	// TODO: handle conversions where `v` does not match the expected type
+	p, err := cf.newPendingWrite()
+	if err != nil {
+		return err
+	}
+	if err := p.add(index, v); err != nil {
+		return err
+	}
+	return p.commit()
+}
 
-	var data []byte
+// appendRecord appends the encoded (index, value) record to dst.
+func (cf *ColumnHandle) appendRecord(dst []byte, index int64, v any) ([]byte, error) {
+	if v == nil {
+		return binary.LittleEndian.AppendUint64(dst, uint64(index)|nullIndexBit), nil
+	}
+	if !valueFitsColumnType(v, cf.typ) {
+		return nil, fmt.Errorf("%w: value of type %T does not match %s column file %s", ErrTypeMismatch, v, cf.typ, cf.path)
+	}
+	dst = binary.LittleEndian.AppendUint64(dst, uint64(index))
 	switch cf.typ {
 	case ColumnTypeBool:
-		var buf [9]byte
-		binary.LittleEndian.PutUint64(buf[:8], uint64(index))
 		if v.(bool) {
-			buf[8] = 1
+			dst = append(dst, 1)
 		} else {
-			buf[8] = 0
+			dst = append(dst, 0)
 		}
-		data = buf[:]
 	case ColumnTypeInt64:
-		var buf [16]byte
-		binary.LittleEndian.PutUint64(buf[:8], uint64(index))
-		binary.LittleEndian.PutUint64(buf[8:16], toUint64(v))
-		data = buf[:]
+		dst = binary.LittleEndian.AppendUint64(dst, toUint64(v))
 	case ColumnTypeFloat64:
-		var buf [16]byte
-		binary.LittleEndian.PutUint64(buf[:8], uint64(index))
-		binary.LittleEndian.PutUint64(buf[8:16], math.Float64bits(toFloat64(v)))
-		data = buf[:]
+		dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(toFloat64(v)))
 	case ColumnTypeString:
-		str := v.(string)
-		len := len(str)
-		buf := make([]byte, 8+2+len)
-		binary.LittleEndian.PutUint64(buf[:8], uint64(index))
-		binary.LittleEndian.PutUint16(buf[8:10], uint16(len))
-		copy(buf[10:], str)
-		data = buf[:]
+		return cf.appendBytes(dst, []byte(v.(string)))
+	case ColumnTypeJSON:
+		return cf.appendBytes(dst, encodeJSONValue(v))
+	case ColumnTypeTime:
+		dst = binary.LittleEndian.AppendUint64(dst, uint64(valueToTime(v).UnixNano()))
+	case ColumnTypeUint64:
+		dst = binary.LittleEndian.AppendUint64(dst, valueToUint64(v))
+	case ColumnTypeInt32:
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(int32(valueToInt64(v))))
 	}
-	return cf.Write(data[:])
+	return dst, nil
 }
 
-type ColumnReader struct {
-	fp       *os.File
-	typ      ColumnType
-	curIndex int64
-	curVal   any
-}
-
-func (cr *ColumnReader) SeekToIndex(targetIndex int64) (any, error) {
-	if targetIndex < cr.curIndex {
-		panic("cannot seek backwards")
-	}
-
-	if targetIndex == cr.curIndex {
-		return cr.curVal, nil
-	}
-
-	// TODO: read in chunks, of overreading then save the last index and value
-	var index int64
-	var val any
-	var err error
-	if cr.typ == ColumnTypeString {
-		var buf [10]byte
-		_, err = cr.fp.Read(buf[:])
-		index = int64(binary.LittleEndian.Uint64(buf[:8]))
-		len := int16(binary.LittleEndian.Uint16(buf[8:10]))
-		strBuf := make([]byte, len)
-		cr.fp.Read(strBuf[:])
-		val = string(strBuf)
+// appendBytes appends a length-prefixed variable-length value to dst.
+func (cf *ColumnHandle) appendBytes(dst []byte, b []byte) ([]byte, error) {
+	if cf.version < 2 {
+		if len(b) > math.MaxUint16 {
+			return nil, fmt.Errorf("value of %d bytes exceeds the limit of version 1 column file %s", len(b), cf.path)
+		}
+		dst = binary.LittleEndian.AppendUint16(dst, uint16(len(b)))
 	} else {
-		switch cr.typ {
-		case ColumnTypeBool:
-			var buf [9]byte
-			_, err = cr.fp.Read(buf[:])
-			index = int64(binary.LittleEndian.Uint64(buf[:8]))
-			val = buf[8] == 1
-		case ColumnTypeInt64:
-			var buf [16]byte
-			_, err = cr.fp.Read(buf[:])
-			index = int64(binary.LittleEndian.Uint64(buf[:8]))
-			val = int64(binary.LittleEndian.Uint64(buf[8:16]))
-		case ColumnTypeFloat64:
-			var buf [16]byte
-			_, err = cr.fp.Read(buf[:])
-			index = int64(binary.LittleEndian.Uint64(buf[:8]))
-			val = math.Float64frombits(binary.LittleEndian.Uint64(buf[8:16]))
-		}
-		if err == io.EOF {
-			return nil, nil
+		if len(b) > math.MaxUint32 {
+			return nil, fmt.Errorf("value of %d bytes is too large", len(b))
 		}
+		dst = binary.LittleEndian.AppendUint32(dst, uint32(len(b)))
 	}
-	if err != nil {
-		return nil, err
+	return append(dst, b...), nil
+}
+
+func (cf *ColumnHandle) Close() error {
+	var errs []error
+	if cf.idxFp != nil {
+		errs = append(errs, cf.idxFp.Close())
+		cf.idxFp = nil
 	}
-	if index == targetIndex {
-		return val, nil
+	if cf.zoneFp != nil {
+		errs = append(errs, cf.zoneFp.Close())
+		cf.zoneFp = nil
 	}
-	if index > targetIndex {
-		cr.curIndex = index
-		cr.curVal = val
+	if cf.bloomFp != nil {
+		errs = append(errs, cf.bloomFp.Close())
+		cf.bloomFp = nil
 	}
-	return nil, nil
-}
-
-func (cr *ColumnReader) Close() error {
-	if cr.fp != nil {
-		err := cr.fp.Close()
-		cr.fp = nil
-		return err
+	if cf.sketchFp != nil {
+		errs = append(errs, cf.sketchFp.Close())
+		cf.sketchFp = nil
 	}
-	return nil
-}
-
-func (ch *ColumnHandle) createReader() (*ColumnReader, error) {
-	fp, err := os.OpenFile(ch.path, os.O_RDONLY, filePerm)
-	if err != nil {
-		return nil, err
+	if cf.crcFp != nil {
+		errs = append(errs, cf.crcFp.Close())
+		cf.crcFp = nil
+	}
+	if cf.tailFp != nil {
+		errs = append(errs, cf.tailFp.Close())
+		cf.tailFp = nil
 	}
-	return &ColumnReader{fp: fp, typ: ch.typ, curIndex: -1}, nil
-}
-
-func (cf *ColumnHandle) Close() error {
 	if cf.writeFp != nil {
-		err := cf.writeFp.Close()
+		errs = append(errs, cf.writeFp.Close())
 		cf.writeFp = nil
-		return err
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
 type ColumnFS struct {
 	lock          sync.Mutex
 	dir           string
 	nextID        int64
+	lastTimestamp int64
+	walFp         BackendFile
+	// failed is set once a write fails and cannot be rolled back, keeping
+	// its log entry for the store's next open to complete. See
+	// ErrStoreFailed.
+	failed bool
+	// backend stores the store's files.
+	backend ColumnBackend
+	// lockFp holds the lock of the store's directory while it is open.
+	lockFp BackendFile
+	// indexInfo describes the index file of a read-only store as of its last
+	// refresh, which runs in the background until stopRefresh is closed.
+	indexInfo   os.FileInfo
+	stopRefresh chan struct{}
+	refreshDone chan struct{}
+	// dirty holds the files written since they were last synced. The
+	// background syncer of DurabilityInterval reports failures in syncErr.
+	dirty         map[*ColumnHandle]bool
+	syncErr       error
+	stopSync      chan struct{}
+	syncDone      chan struct{}
 	indexHandle   *ColumnHandle
 	columnHandles map[string]*ColumnHandle
+	schema        *Schema
+	opts          Options
+	// compactCodec is the codec the store was last compacted with, which
+	// reloads read the files it wrote with.
+	compactCodec Codec
+	// buffer holds the rows appended since the write buffer was last
+	// written. The background flusher writes it until stopFlush is closed,
+	// reporting failures in flushErr.
+	buffer    writeBuffer
+	stopFlush chan struct{}
+	flushDone chan struct{}
+	flushErr  error
+	// queries counts the queries in flight. Once shutdown is set, new
+	// queries and writes fail, and it is closed when none are in flight.
+	queries  int
+	shutdown chan struct{}
+	// partitions holds the partitions of a partitioned store, in time order.
+	// Their directories hold its rows, and the store has no columns of its
+	// own. Partitions are only written to under the store's lock.
+	partitioning Partitioning
+	partitions   []*partition
+	// objects reads the partitions offloaded to Options.ObjectStore.
+	objects *objectBackend
+	// pruned is the index of the first row kept by pruning. The background
+	// pruner runs until stopPrune is closed.
+	pruned    int64
+	stopPrune chan struct{}
+	pruneDone chan struct{}
+	// tombstones holds the deleted rows. It is replaced, not modified, when
+	// rows are deleted, so cursors can share it.
+	tombstones *bitmap
+	// appended, if set, is closed when rows are next appended.
+	appended chan struct{}
+	// rollups holds the rollup rows of a store configured with a Rollup,
+	// which are written by one rollup at a time under rollupLock.
+	rollups    *ColumnFS
+	rollupLock sync.Mutex
+	stopRollup chan struct{}
+	rollupDone chan struct{}
+	// cache holds the results of recent queries, if enabled, which changes
+	// counts the changes to rows and columns invalidating them.
+	cache   *queryCache
+	changes int64
+}
+
+// Options configures a ColumnFS.
+type Options struct {
+	// Schema, if set, declares the columns of the store. See Schema.
+	Schema *Schema
+	// TypeMode chooses whether appends reject or coerce values that do not
+	// match the type of their column. See TypeMode.
+	TypeMode TypeMode
+	// MemoryMap makes queries read column files through memory mappings
+	// instead of read calls, where the platform supports it.
+	MemoryMap bool
+	// Codec, if set, compresses new columns. Existing columns keep the codec
+	// they were created with. See Codec.
+	Codec Codec
+	// Durability chooses when writes are synced to stable storage. Unless it
+	// is DurabilityNone, Close also syncs.
+	Durability Durability
+	// SyncInterval is the sync period of DurabilityInterval, one second by
+	// default.
+	SyncInterval time.Duration
+	// Logger receives reports of repairs made when the store is opened, and
+	// of slow queries. It defaults to slog.Default().
+	Logger *slog.Logger
+	// Indexes names the columns that keep a value index, which resolves
+	// equality and IN filters on the column without scanning it. JSON
+	// columns are not indexed.
+	Indexes []string
+	// BitmapIndexes names the columns that keep a bitmap of the rows holding
+	// each of their values, which suits bool and low-cardinality columns.
+	// Queries filtering on several such columns combine their bitmaps before
+	// reading any column.
+	BitmapIndexes []string
+	// Partitioning splits the rows of new stores into a sub-directory per
+	// hour or day. Stores holding partitions are always opened partitioned.
+	// See Partitioning.
+	Partitioning Partitioning
+	// Clock returns the time rows are stamped with when appended. It defaults
+	// to time.Now.
+	Clock func() time.Time
+	// Retention is how long rows are kept by Prune. Unless it is zero,
+	// PruneInterval sets the period of a background Prune.
+	Retention     time.Duration
+	PruneInterval time.Duration
+	// PrimaryKey names the column identifying the rows written by Upsert,
+	// which keeps a value index.
+	PrimaryKey string
+	// Rollup, if set, downsamples old rows. See Rollup.
+	Rollup *Rollup
+	// LockTimeout is how long opening waits for a store that another writer
+	// has open, before failing with ErrStoreLocked. Negative values wait
+	// until it is closed.
+	LockTimeout time.Duration
+	// ReadOnly opens the store to follow another process writing it. The
+	// store is not locked, nothing is repaired or written, and writes fail
+	// with ErrStoreReadOnly. Rows appended by the writer are seen once the
+	// store is refreshed, every RefreshInterval if it is positive. See
+	// ColumnFS.Refresh.
+	ReadOnly        bool
+	RefreshInterval time.Duration
+	// WriteBufferRows and WriteBufferBytes, if positive, buffer appended
+	// rows in memory until that many rows, or about that many bytes
+	// of a column, are buffered, then write them together, so that appends
+	// of a row at a time reach the files in batches. Queries, Flush and
+	// Close write buffered rows first, so queries see every row appended.
+	// Buffered rows are lost if the process exits before they are written.
+	// A buffered write that fails reports the error to the call that made it
+	// and keeps the rows buffered, to be written by the next. Write buffers
+	// cannot be combined with DurabilityEveryWrite, which syncs each append
+	// before it returns.
+	WriteBufferRows  int
+	WriteBufferBytes int64
+	// FlushInterval, if positive, writes the rows of the write buffer every
+	// interval, bounding how long appended rows stay in memory.
+	FlushInterval time.Duration
+	// Metrics, if set, receives the counts of rows appended and queries
+	// run. See MetricsCollector.
+	Metrics Metrics
+	// Tracer, if set, traces the phases of queries. See Tracer.
+	Tracer Tracer
+	// SlowQueryThreshold, if positive, reports the queries that take at
+	// least this long to SlowQueryLog, or else logs them to Logger as
+	// warnings, holding the query in the JSON form of EncodeQueryJSON. To
+	// keep them in a file, pass a Logger writing to it.
+	SlowQueryThreshold time.Duration
+	SlowQueryLog       func(SlowQuery)
+	// QueryCacheSize, if positive, caches the results of that many recent
+	// queries run by ColumnarStore.Query, so that repeated queries over
+	// unchanged rows return without scanning. Results are keyed by the JSON
+	// form of the query, of EncodeQueryJSON, and the rows of the store, and
+	// appends, deletions and column changes invalidate them. Queries with
+	// enrichers are not cached.
+	QueryCacheSize int
+	// ColumnPolicies restrict sensitive columns in unauthorized queries. See
+	// ColumnPolicy.
+	ColumnPolicies []ColumnPolicy
+	// ObjectStore, if set, holds the sealed partitions of a partitioned
+	// store once they are offloaded, which are then read through a cache of
+	// ObjectCacheSize bytes, 64 MiB by default. See
+	// ColumnFS.OffloadPartitionsBefore.
+	ObjectStore     ObjectStore
+	ObjectCacheSize int64
+	// Backend stores the files of the store, in the operating system's file
+	// system if nil. See ColumnBackend.
+	Backend ColumnBackend
+}
+
+func (fs *ColumnFS) now() time.Time {
+	if fs.opts.Clock != nil {
+		return fs.opts.Clock()
+	}
+	return time.Now()
 }
 
 func OpenColumnFS(dir string) (*ColumnFS, error) {
-	exists, err := fileExists(dir)
+	return OpenColumnFSWithOptions(dir, Options{})
+}
+
+func OpenColumnFSWithOptions(dir string, opts Options) (*ColumnFS, error) {
+	if opts.Durability == DurabilityEveryWrite && (opts.WriteBufferRows > 0 || opts.WriteBufferBytes > 0) {
+		return nil, errors.New("write buffers cannot be used with DurabilityEveryWrite")
+	}
+	// Codecs are registered first, as column files are read with the codec
+	// under the ID in their header.
+	if err := registerStoreCodec(opts.Codec); err != nil {
+		return nil, err
+	}
+	if opts.Schema != nil {
+		for _, c := range opts.Schema.Columns {
+			if err := registerStoreCodec(c.Codec); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fs, err := openColumnFS(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.openPartitions(); err != nil {
+		fs.Close()
+		return nil, err
+	}
+	if opts.Rollup != nil {
+		if err := fs.openRollups(); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+	if opts.Retention > 0 && opts.PruneInterval > 0 && !opts.ReadOnly {
+		fs.startPruner()
+	}
+	if opts.ReadOnly && opts.RefreshInterval > 0 {
+		fs.startRefresher()
+	}
+	if !opts.ReadOnly && opts.FlushInterval > 0 && (opts.WriteBufferRows > 0 || opts.WriteBufferBytes > 0) {
+		fs.startFlusher()
+	}
+	if fs.partitioning != PartitionNone {
+		// Partitions apply the schema and durability policy themselves.
+		if opts.Schema != nil {
+			if err := opts.Schema.validate(); err != nil {
+				fs.Close()
+				return nil, err
+			}
+		}
+		return fs, nil
+	}
+	if opts.Schema != nil {
+		if err := fs.applySchema(opts.Schema); err != nil {
+			fs.Close()
+			return nil, err
+		}
+	}
+	if opts.Durability == DurabilityInterval {
+		fs.startSyncer()
+	}
+	return fs, nil
+}
+
+func openColumnFS(dir string, opts Options) (_ *ColumnFS, err error) {
+	b := opts.Backend
+	if b == nil {
+		b = OSBackend{}
+	}
+	exists, err := fileExists(b, dir)
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
-		if err := os.MkdirAll(dir, 0755); err != nil {
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("store %s does not exist", dir)
+		}
+		if err := b.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	fs := &ColumnFS{dir: dir, backend: b, opts: opts}
+	if opts.QueryCacheSize > 0 {
+		fs.cache = newQueryCache(opts.QueryCacheSize)
+	}
+	if opts.ReadOnly {
+		// The writer's rows are read as far as its index file reaches,
+		// without repairing or replaying anything.
+		if fs.indexInfo, err = b.Stat(path.Join(dir, indexFileName)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := fs.loadHandles(); err != nil {
+			return nil, err
+		}
+		if fs.nextID, err = fs.indexHandle.committedRows(); err != nil {
+			return nil, err
+		}
+	} else {
+		if fs.lockFp, err = lockDir(b, dir, opts.LockTimeout); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				fs.lockFp.Close()
+			}
+		}()
+		if err := replayWAL(b, dir); err != nil {
+			return nil, err
+		}
+		if err := fs.loadHandles(); err != nil {
+			return nil, err
+		}
+		if err := fs.recover(); err != nil {
+			return nil, err
+		}
+	}
+	if err := fs.loadPruned(); err != nil {
+		return nil, err
+	}
+	if err := fs.loadTombstones(); err != nil {
+		return nil, err
+	}
+	if fs.nextID > 0 {
+		if fs.lastTimestamp, err = fs.timestampAt(fs.nextID - 1); err != nil {
 			return nil, err
 		}
 	}
+	return fs, nil
+}
 
-	indexPath := path.Join(dir, indexFileName)
-	indexHandle := &ColumnHandle{path: indexPath, typ: ColumnTypeInt64}
+// loadHandles opens the handles of the index file and column files of the
+// store's directory.
+func (fs *ColumnFS) loadHandles() error {
+	indexHandle := &ColumnHandle{path: path.Join(fs.dir, indexFileName), typ: ColumnTypeInt64, version: 1, readOnly: fs.opts.ReadOnly, backend: fs.backend}
 	handles := map[string]*ColumnHandle{
 		indexFileName: indexHandle,
 	}
 
-	entries, err := os.ReadDir(dir)
+	entries, err := fs.backend.ReadDir(fs.dir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var indexSize int64
 	for _, de := range entries {
-		if !strings.HasSuffix(de.Name(), extension) {
+		if !strings.HasSuffix(de.Name(), extension) || de.Name() == indexFileName {
 			continue
 		}
-		if de.Name() == indexFileName {
-			fi, err := de.Info()
-			if err != nil {
-				return nil, err
-			}
-			indexSize = fi.Size()
-		}
-		colNameAndType := strings.TrimSuffix(de.Name(), "."+extension)
-		parts := strings.Split(colNameAndType, ".")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid column file name: %s", de.Name())
+		colName, colType, version, err := parseColumnFileName(de.Name())
+		if err != nil {
+			return err
 		}
-		colName := parts[0]
-		colType, ok := columnSuffixToType[parts[1]]
-		if !ok {
-			panic(fmt.Sprintf("unknown column type: %s", parts[1]))
+		ch := &ColumnHandle{path: path.Join(fs.dir, de.Name()), typ: colType, version: version, readOnly: fs.opts.ReadOnly, backend: fs.backend}
+		if err := ch.loadHeader(func(id uint8) (Codec, error) { return fs.codec(colName, id) }); err != nil {
+			return err
 		}
-		ch := &ColumnHandle{path: path.Join(dir, de.Name()), typ: colType}
 		handles[colName] = ch
 	}
 
-	if indexSize%16 != 0 {
-		panic("index file size is not a multiple of 16")
+	if err := indexHandle.loadHeader(codecByID); err != nil {
+		return err
+	}
+	for name, ch := range handles {
+		ch.indexed = fs.isIndexed(name, ch.typ)
+		ch.bitmapped = fs.hasBitmapIndex(name, ch.typ)
 	}
+	fs.indexHandle, fs.columnHandles = indexHandle, handles
+	return nil
+}
 
-	nextID := int64(indexSize / 16)
-	return &ColumnFS{dir: dir, indexHandle: indexHandle, columnHandles: handles, nextID: nextID}, nil
+func (fs *ColumnFS) newColumnHandle(name string, typ ColumnType) *ColumnHandle {
+	return &ColumnHandle{path: path.Join(fs.dir, makeColumnFileName(name, typ)), typ: typ, version: formatVersion, codec: fs.opts.Codec, indexed: fs.isIndexed(name, typ), bitmapped: fs.hasBitmapIndex(name, typ), readOnly: fs.opts.ReadOnly, backend: fs.backend}
 }
 
 func (fs *ColumnFS) WriteColumns(fields map[string]any) error {
+	return fs.WriteRows([]map[string]any{fields})
+}
+
+// WriteRows appends rows under a single lock acquisition. Records are encoded
+// into per-column buffers and each column file receives a single write. The
+// write is atomic: if any file write fails, the others are rolled back.
+func (fs *ColumnFS) WriteRows(rows []map[string]any) error {
+	return fs.WriteRowsContext(context.Background(), rows)
+}
+
+// WriteRowsContext is WriteRows with a context, which is checked before the
+// write starts. A write that has started always runs to completion.
+func (fs *ColumnFS) WriteRowsContext(ctx context.Context, rows []map[string]any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	fs.lock.Lock()
 	defer fs.lock.Unlock()
+	// The context may have ended while waiting for the lock.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fs.shutdown != nil {
+		return ErrStoreClosed
+	}
+	if fs.opts.WriteBufferRows > 0 || fs.opts.WriteBufferBytes > 0 {
+		return fs.bufferRows(rows)
+	}
+	return fs.write(rows)
+}
+
+// write appends rows stamped with the current time. The caller must hold
+// fs.lock.
+func (fs *ColumnFS) write(rows []map[string]any) error {
+	return fs.writeAt(rows, fs.nextTimestamp())
+}
+
+// nextTimestamp returns the timestamp of rows appended now. Timestamps never
+// go backwards, so rows are ordered by time as well as by index. The caller
+// must hold fs.lock.
+func (fs *ColumnFS) nextTimestamp() int64 {
+	ts := max(fs.now().UnixNano(), fs.lastTimestamp)
+	if n := len(fs.buffer.stamps); n > 0 {
+		ts = max(ts, fs.buffer.stamps[n-1])
+	}
+	return ts
+}
+
+// writeAt appends rows stamped with ts, which must not be before the last
+// timestamp, after any buffered rows. The caller must hold fs.lock.
+func (fs *ColumnFS) writeAt(rows []map[string]any, ts int64) error {
+	if fs.opts.ReadOnly {
+		return ErrStoreReadOnly
+	}
+	if err := fs.flushBuffer(); err != nil {
+		return err
+	}
+	return fs.commitRows(rows, slices.Repeat([]int64{ts}, len(rows)))
+}
+
+// commitRows appends rows, each stamped with the timestamp at its position
+// in stamps. The caller must hold fs.lock.
+func (fs *ColumnFS) commitRows(rows []map[string]any, stamps []int64) error {
+	fs.invalidateCache()
+	var err error
+	if fs.partitioning != PartitionNone {
+		err = fs.writePartitions(rows, stamps)
+	} else {
+		err = fs.writeStamped(rows, stamps)
+	}
+	if err == nil && fs.appended != nil {
+		close(fs.appended)
+		fs.appended = nil
+	}
+	return err
+}
 
-	for name, v := range fields {
-		if strings.HasPrefix(name, "__") {
-			return fmt.Errorf("column name cannot start with '__': %s", name)
+// writeStamped appends rows stamped with stamps. The caller must hold
+// fs.lock.
+func (fs *ColumnFS) writeStamped(rows []map[string]any, stamps []int64) error {
+	var created []string
+	err := fs.writeRows(rows, stamps, &created)
+	if err != nil {
+		// Columns are only created by writes that succeed.
+		for _, name := range created {
+			delete(fs.columnHandles, name)
 		}
-		ch := fs.columnHandles[name]
-		if ch == nil {
-			typ := valueColumnType(v)
-			fn := makeColumnFileName(name, typ)
-			ch := &ColumnHandle{path: path.Join(fs.dir, fn), typ: typ}
-			fs.columnHandles[name] = ch
+	}
+	return err
+}
+
+// checkColumnName fails if a name cannot be given to a column. Appends,
+// schemas and renames share it, so that every column is named by one rule.
+func checkColumnName(name string) error {
+	switch {
+	case name == "":
+		return errors.New("column name cannot be empty")
+	case strings.HasPrefix(name, "__"):
+		return fmt.Errorf("column name cannot start with '__': %s", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("column name cannot hold a path separator: %s", name)
+	}
+	return nil
+}
+
+// checkRows validates the column names of rows, and their values against
+// the schema if the store has one.
+func (fs *ColumnFS) checkRows(rows []map[string]any) error {
+	// Schemaless stores type new columns by their first value.
+	var types map[string]ColumnType
+	for _, fields := range rows {
+		for name, v := range fields {
+			if err := checkColumnName(name); err != nil {
+				return err
+			}
+			if !supportedValue(v) {
+				return fmt.Errorf("%w: column %s cannot hold a value of type %T", ErrUnsupportedValue, name, v)
+			}
+			switch {
+			case fs.schema != nil:
+				if err := fs.checkSchema(name, v); err != nil {
+					return err
+				}
+			case fs.partitioning != PartitionNone && fs.opts.Schema != nil:
+				// Partitioned stores leave the schema to their partitions.
+				spec, ok := fs.opts.Schema.column(name)
+				if !ok {
+					return fmt.Errorf("column %s is not declared in the schema", name)
+				}
+				if _, err := fs.columnValue(name, spec.Type, v); err != nil {
+					return err
+				}
+			case fs.partitioning == PartitionNone && v != nil:
+				typ, ok := types[name]
+				if !ok {
+					// Buffered rows type the columns they will create.
+					typ, ok = fs.buffer.types[name]
+				}
+				if ch := fs.columnHandles[name]; ch != nil {
+					typ, ok = ch.typ, true
+				}
+				if !ok {
+					if types == nil {
+						types = map[string]ColumnType{}
+					}
+					types[name] = valueColumnType(v)
+				} else if _, err := fs.columnValue(name, typ, v); err != nil {
+					return err
+				}
+			}
 		}
 	}
+	return nil
+}
 
-	index := fs.nextID
-	ts := time.Now().UnixNano()
+func (fs *ColumnFS) writeRows(rows []map[string]any, stamps []int64, created *[]string) error {
+	if fs.failed {
+		return ErrStoreFailed
+	}
+	if err := fs.checkRows(rows); err != nil {
+		return err
+	}
+	if fs.schema == nil {
+		// New columns take the type of their first value that is not null.
+		// Nulls for columns no value creates are left absent, which queries
+		// read the same way.
+		for _, fields := range rows {
+			for name, v := range fields {
+				if v != nil && fs.columnHandles[name] == nil {
+					fs.columnHandles[name] = fs.newColumnHandle(name, valueColumnType(v))
+					*created = append(*created, name)
+				}
+			}
+		}
+	}
 
-	var buf [16]byte
-	binary.LittleEndian.PutUint64(buf[:8], uint64(index))
-	binary.LittleEndian.PutUint64(buf[8:16], uint64(ts))
-	err := fs.indexHandle.Write(buf[:])
+	indexWrite, err := fs.indexHandle.newPendingWrite()
 	if err != nil {
 		return err
 	}
-	for name, v := range fields {
-		cf := fs.columnHandles[name]
-		if err := cf.IndexedWrite(index, v); err != nil {
+	pending := map[*ColumnHandle]*pendingWrite{}
+	for i, fields := range rows {
+		index := fs.nextID + int64(i)
+		if err := indexWrite.add(index, stamps[i]); err != nil {
+			return err
+		}
+		for name, v := range fields {
+			ch := fs.columnHandles[name]
+			if ch == nil {
+				continue
+			}
+			if v, err = fs.columnValue(name, ch.typ, v); err != nil {
+				return err
+			}
+			p := pending[ch]
+			if p == nil {
+				if p, err = ch.newPendingWrite(); err != nil {
+					return err
+				}
+				pending[ch] = p
+			}
+			if err := p.add(index, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	writes := []*pendingWrite{indexWrite}
+	for _, p := range pending {
+		writes = append(writes, p)
+	}
+	for _, p := range writes {
+		if err := p.prepare(); err != nil {
+			return err
+		}
+	}
+	if err := fs.logWrite(writes); err != nil {
+		return err
+	}
+	for i, p := range writes {
+		if err := p.commit(); err != nil {
+			return fs.rollback(writes[:i+1], err)
+		}
+	}
+	fs.markDirty(writes)
+	if m := fs.opts.Metrics; m != nil {
+		var size int64
+		for _, p := range writes {
+			size += int64(len(p.data))
+		}
+		m.Appended(int64(len(rows)), size)
+	}
+	if fs.opts.Durability == DurabilityEveryWrite {
+		if err := fs.syncDirty(); err != nil {
 			return err
 		}
+		if writes[0].offset == 0 || len(*created) > 0 {
+			// New files must also be durable in the directory.
+			if err := syncDir(fs.backend, fs.dir); err != nil {
+				return err
+			}
+		}
+	}
+	if err := fs.clearWAL(); err != nil {
+		return err
+	}
+	fs.nextID += int64(len(rows))
+	if len(stamps) > 0 {
+		fs.lastTimestamp = stamps[len(stamps)-1]
 	}
-	fs.nextID += 1
 	return nil
 }
 
+// columnNames returns the names of all user columns in the store, sorted.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) columnNames() []string {
+	names := make([]string, 0, len(fs.columnHandles))
+	for name := range fs.columnHandles {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	for _, p := range fs.partitions {
+		names = append(names, p.fs.columnNames()...)
+	}
+	// Columns may be created by the rows of the write buffer.
+	for name := range fs.buffer.sizes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
 func (fs *ColumnFS) Close() error {
-	var errs []error
+	fs.stopFlusher()
+	fs.stopRefresher()
+	fs.stopPruner()
+	rollupErr := fs.closeRollups()
+	fs.stopSyncer()
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// Buffered rows are written before the partitions they belong to close.
+	errs := []error{fs.flushBuffer(), fs.flushErr, fs.syncErr, rollupErr, fs.closePartitions()}
+	if fs.opts.Durability != DurabilityNone {
+		errs = append(errs, fs.syncDirty())
+	}
 	for _, f := range fs.columnHandles {
 		if err := f.Close(); err != nil {
 			errs = append(errs, err)
 		}
 	}
+	if fs.walFp != nil {
+		errs = append(errs, fs.walFp.Close())
+		fs.walFp = nil
+	}
+	if fs.lockFp != nil {
+		errs = append(errs, fs.lockFp.Close())
+		fs.lockFp = nil
+	}
 	return errors.Join(errs...)
 }
 
+// ErrStoreClosed is returned by queries and writes of a store that is
+// shutting down.
+var ErrStoreClosed = errors.New("store is closed")
+
+// Shutdown closes the store gracefully: new queries and writes fail with
+// ErrStoreClosed, and once the queries in flight are closed, buffered rows
+// are written, every file is synced whatever the durability policy, and the
+// store is closed. If ctx ends first, Shutdown returns its error and the
+// store stays open, refusing new queries and writes, so Shutdown can be
+// retried or the store closed.
+func (fs *ColumnFS) Shutdown(ctx context.Context) error {
+	fs.lock.Lock()
+	if fs.shutdown == nil {
+		fs.shutdown = make(chan struct{})
+		if fs.queries == 0 {
+			close(fs.shutdown)
+		}
+	}
+	drained := fs.shutdown
+	fs.lock.Unlock()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var syncErr error
+	if !fs.opts.ReadOnly {
+		syncErr = fs.Sync()
+	}
+	return errors.Join(syncErr, fs.Close())
+}
+
+// beginQuery counts a query in flight, failing once the store shuts down.
+func (fs *ColumnFS) beginQuery() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.shutdown != nil {
+		return ErrStoreClosed
+	}
+	fs.queries++
+	return nil
+}
+
+// endQuery counts the end of a query begun by beginQuery.
+func (fs *ColumnFS) endQuery() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.queries--; fs.queries == 0 && fs.shutdown != nil {
+		close(fs.shutdown)
+	}
+}
+
 type ColumnarStore struct {
 	fs *ColumnFS
 }
@@ -300,62 +968,146 @@ func (s *ColumnarStore) Append(fields map[string]any) error {
 	return s.fs.WriteColumns(fields)
 }
 
+// AppendContext is Append with a context. See ColumnFS.WriteRowsContext.
+func (s *ColumnarStore) AppendContext(ctx context.Context, fields map[string]any) error {
+	return s.fs.WriteRowsContext(ctx, []map[string]any{fields})
+}
+
+// Flush hands any data buffered by the store to the operating system. See
+// ColumnFS.Flush.
+func (s *ColumnarStore) Flush() error {
+	return s.fs.Flush()
+}
+
+// Sync flushes every write made so far to stable storage. See ColumnFS.Sync.
+func (s *ColumnarStore) Sync() error {
+	return s.fs.Sync()
+}
+
+// Prune deletes the rows older than the store's retention. See
+// ColumnFS.PruneBefore.
+func (s *ColumnarStore) Prune() (int64, error) {
+	return s.fs.Prune()
+}
+
+// Compact rewrites the store's column files densely. See ColumnFS.Compact.
+func (s *ColumnarStore) Compact() error {
+	return s.fs.Compact()
+}
+
+// AppendBatch appends many rows at once, which is much cheaper than calling
+// Append for each row.
+func (s *ColumnarStore) AppendBatch(rows []map[string]any) error {
+	return s.fs.WriteRows(rows)
+}
+
+// AppendBatchContext is AppendBatch with a context. See
+// ColumnFS.WriteRowsContext.
+func (s *ColumnarStore) AppendBatchContext(ctx context.Context, rows []map[string]any) error {
+	return s.fs.WriteRowsContext(ctx, rows)
+}
+
 func (s *ColumnarStore) Query(q *Query) ([]map[string]any, error) {
-	lastID := s.fs.nextID
+	return s.QueryContext(context.Background(), q)
+}
+
+// QueryContext is Query with a context. The scan stops with the context's
+// error once it is cancelled or its deadline passes.
+func (s *ColumnarStore) QueryContext(ctx context.Context, q *Query) ([]map[string]any, error) {
+	key, cached := s.fs.queryCacheKey(q)
+	if cached {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		if rows, ok := s.fs.cache.get(key); ok {
+			s.fs.finishQuery(q, start, 0, len(rows), nil)
+			return rows, nil
+		}
+	}
+	it, err := s.QueryIterContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
 
-	cols := map[string]bool{}
 	rows := []map[string]any{}
+	for it.Next() {
+		rows = append(rows, it.Row())
+	}
+	if err := it.Err(); err != nil {
+		return rows, err
+	}
+	if cached {
+		s.fs.cache.put(key, rows)
+	}
+	return rows, nil
+}
+
+// QueryIter runs a query and returns an iterator over its results. Row
+// queries in append order are streamed from the column files; aggregate,
+// sorted and parallel queries are computed in full before the first row is
+// returned.
+func (s *ColumnarStore) QueryIter(q *Query) (*Rows, error) {
+	return s.QueryIterContext(context.Background(), q)
+}
 
-	for _, f := range q.Filters {
-		cols[f.Attribute] = true
+// QueryIterContext is QueryIter with a context. The context is checked
+// between batches of rows, and iteration ends with its error once it is done.
+func (s *ColumnarStore) QueryIterContext(ctx context.Context, q *Query) (*Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
-	if q.AggregatorAttribute != "" {
-		cols[q.AggregatorAttribute] = true
+	if err := s.fs.beginQuery(); err != nil {
+		return nil, err
 	}
-	cf := map[string]*ColumnReader{}
-	for col := range cols {
-		ch := s.fs.columnHandles[col]
-		if ch == nil {
-			continue
-		}
-		cr, err := ch.createReader()
-		if err != nil {
+	start := time.Now()
+	ctx, span := s.fs.startSpan(ctx, "querystore.query")
+	_, plan := s.fs.startSpan(ctx, "querystore.plan")
+	cur, err := openCursor(ctx, s.fs, q)
+	plan.End(err)
+	if err != nil {
+		s.fs.finishQuery(q, start, 0, 0, err)
+		span.End(err)
+		s.fs.endQuery()
+		return nil, err
+	}
+	rows := &Rows{q: q, cur: cur, fs: s.fs, start: start, span: span}
+	if byIndex, descending := q.ordersByIndex(); cur.agg != nil || !byIndex || descending || q.Parallelism > 1 {
+		if err := rows.materialize(); err != nil {
+			rows.err = err
+			rows.Close()
 			return nil, err
 		}
-		cf[col] = cr
+	} else if q.ReuseRows {
+		cur.reuseRows()
 	}
-
-	for i := range lastID {
-		pass := true
-		row := map[string]any{
-			"__index":     i,
-			"__timestamp": 0,
-		}
-		for _, f := range q.Filters {
-			cr := cf[f.Attribute]
-			rowValue, err := cr.SeekToIndex(i)
-			if err != nil {
-				return nil, err
-			}
-			if rowValue == nil {
-				pass = false
-				break
-			}
-			filterValue := castValueToColumnType(f.Value, cr.typ)
-			if !conditionals[f.Condition][cr.typ](rowValue, filterValue) {
-				pass = false
-				break
-			}
-			row[f.Attribute] = rowValue
-		}
-		if pass {
-			rows = append(rows, row)
-		}
+	if !rows.materialized && cur.pred == nil && cur.parts == nil && q.Offset > 0 {
+		// Every row in range matches, so the offset is skipped without
+		// reading the rows; the readers then jump ahead via block indexes.
+		cur.next = min(cur.next+int64(q.Offset), cur.lastID)
+		rows.skipped = q.Offset
 	}
-
 	return rows, nil
 }
 
+// projectRow restricts a row to the selected columns, keeping the index and
+// timestamp. Selected columns without a value are reported as nil. The result
+// is stored in out, which is allocated if nil.
+func projectRow(out, row map[string]any, selected []string) map[string]any {
+	if out == nil {
+		out = make(map[string]any, len(selected)+2)
+	} else {
+		clear(out)
+	}
+	out[IndexColumn] = row[IndexColumn]
+	out[TimestampColumn] = row[TimestampColumn]
+	for _, col := range selected {
+		out[col] = row[col]
+	}
+	return out
+}
+
 func NewColumnarStore(fs *ColumnFS) *ColumnarStore {
 	return &ColumnarStore{fs: fs}
 }
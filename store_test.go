@@ -1,9 +1,14 @@
 package querystore
 
 import (
+	"context"
+	"encoding/binary"
 	"os"
+	"path"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/samber/lo"
@@ -46,3 +51,307 @@ func TestStore(t *testing.T) {
 	require.NoError(t, err)
 	spew.Dump(rows)
 }
+
+func newTestStore(t *testing.T) *ColumnarStore {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	t.Cleanup(func() { fs.Close() })
+	return NewColumnarStore(fs)
+}
+
+func TestQueryIter(t *testing.T) {
+	cs := newTestStore(t)
+
+	for i := range 20 {
+		require.NoError(t, cs.Append(map[string]any{"val": i}))
+	}
+
+	rows, err := cs.QueryIter(&Query{
+		Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 10}},
+		Offset:  2,
+		Limit:   5,
+	})
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var vals []int64
+	row := map[string]any{}
+	for rows.Next() {
+		require.NoError(t, rows.Scan(row))
+		vals = append(vals, row["val"].(int64))
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []int64{12, 13, 14, 15, 16}, vals)
+	assert.NoError(t, rows.Close())
+	assert.False(t, rows.Next())
+}
+
+func TestAppendBatch(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"val": -1}))
+	batch := make([]map[string]any, 100)
+	for i := range batch {
+		batch[i] = map[string]any{"val": i, "even": i%2 == 0}
+	}
+	require.NoError(t, cs.AppendBatch(batch))
+
+	rows, err := cs.Query(&Query{
+		Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorSum, Attribute: "val"}},
+		Filters:      []Filter{{Attribute: "even", Condition: ConditionEquals, Value: true}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(50), rows[0]["count"])
+	assert.Equal(t, int64(2450), rows[0]["sum(val)"])
+
+	rows, err = cs.Query(&Query{Limit: 1, Offset: 100})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), rows[0][IndexColumn])
+}
+
+func benchmarkRows(n int) []map[string]any {
+	rows := make([]map[string]any, n)
+	for i := range rows {
+		rows[i] = map[string]any{"val": i, "name": strconv.Itoa(i), "ok": true}
+	}
+	return rows
+}
+
+func BenchmarkAppend(b *testing.B) {
+	dir := b.TempDir()
+	fs := lo.Must(OpenColumnFS(dir))
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	rows := benchmarkRows(1000)
+	b.ResetTimer()
+	for range b.N {
+		for _, row := range rows {
+			if err := cs.Append(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAppendCompressed(b *testing.B) {
+	dir := b.TempDir()
+	fs := lo.Must(OpenColumnFSWithOptions(dir, Options{Codec: CodecFlate}))
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	rows := benchmarkRows(1000)
+	b.ResetTimer()
+	for range b.N {
+		for _, row := range rows {
+			if err := cs.Append(row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	dir := b.TempDir()
+	fs := lo.Must(OpenColumnFS(dir))
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	rows := benchmarkRows(1000)
+	b.ResetTimer()
+	for range b.N {
+		if err := cs.AppendBatch(rows); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestTimeColumn(t *testing.T) {
+	cs := newTestStore(t)
+
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := range 5 {
+		require.NoError(t, cs.Append(map[string]any{"at": base.Add(time.Duration(i) * time.Hour)}))
+	}
+
+	rows, err := cs.Query(&Query{
+		Filters: []Filter{{Attribute: "at", Condition: ConditionGreaterThanOrEquals, Value: base.Add(3 * time.Hour)}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, base.Add(3*time.Hour), rows[0]["at"])
+
+	rows, err = cs.Query(&Query{
+		Filters: []Filter{{Attribute: "at", Condition: ConditionEquals, Value: "2024-05-01T13:00:00Z"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, int64(1), rows[0][IndexColumn])
+
+	rows, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorMax, Attribute: "at"}}})
+	require.NoError(t, err)
+	assert.Equal(t, base.Add(4*time.Hour), rows[0]["max(at)"])
+
+	cols, err := cs.fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, ColumnTypeTime, cols[0].Type)
+}
+
+func TestLongStrings(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	// A version 1 file, with uint16 length prefixes, for row 0.
+	legacy := binary.LittleEndian.AppendUint64(nil, 0)
+	legacy = binary.LittleEndian.AppendUint16(legacy, 3)
+	legacy = append(legacy, "old"...)
+	require.NoError(t, os.WriteFile(path.Join(dir, "legacy.str.dat"), legacy, 0644))
+	index := binary.LittleEndian.AppendUint64(nil, 0)
+	index = binary.LittleEndian.AppendUint64(index, uint64(time.Now().UnixNano()))
+	require.NoError(t, os.WriteFile(path.Join(dir, indexFileName), index, 0644))
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	long := strings.Repeat("x", 100_000)
+	require.NoError(t, cs.Append(map[string]any{"legacy": "new", "body": long}))
+	assert.Error(t, cs.Append(map[string]any{"legacy": long}))
+
+	rows, err := cs.Query(&Query{Select: []string{"legacy", "body"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "old", rows[0]["legacy"])
+	assert.Equal(t, "new", rows[1]["legacy"])
+	assert.Equal(t, long, rows[1]["body"])
+	assert.FileExists(t, path.Join(dir, "body.str.dat"))
+
+	// Migrating adds headers to the legacy files, keeping their contents.
+	require.NoError(t, fs.MigrateFormat())
+	require.NoError(t, cs.Append(map[string]any{"legacy": long}))
+	rows, err = cs.Query(&Query{Select: []string{"legacy"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"old", "new", long}, lo.Map(rows, func(row map[string]any, _ int) any { return row["legacy"] }))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	assert.Equal(t, int64(3), fs.nextID)
+	for _, ch := range fs.columnHandles {
+		assert.Equal(t, formatVersion, ch.version)
+	}
+}
+
+func TestNulls(t *testing.T) {
+	cs := newTestStore(t)
+
+	require.NoError(t, cs.Append(map[string]any{"val": 1, "name": "a"}))
+	require.NoError(t, cs.Append(map[string]any{"val": nil, "name": "b"}))
+	require.NoError(t, cs.Append(map[string]any{"name": "c"}))
+	require.NoError(t, cs.Append(map[string]any{"val": 4, "name": nil}))
+
+	names := func(where *FilterExpression) []any {
+		rows, err := cs.Query(&Query{Select: []string{"name"}, Where: where})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row["name"] })
+	}
+	assert.Equal(t, []any{"b", "c"}, names(Where("val", ConditionIsNull, nil)))
+	assert.Equal(t, []any{"a", nil}, names(Where("val", ConditionIsNotNull, nil)))
+	assert.Equal(t, []any{"a", "b", "c", nil}, names(Where("missing", ConditionIsNull, nil)))
+	assert.Equal(t, []any{"a"}, names(Where("val", ConditionLessThan, 3)))
+
+	rows, err := cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount, Attribute: "val"}, {Type: AggregatorSum, Attribute: "val"}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rows[0]["count(val)"])
+	assert.Equal(t, int64(5), rows[0]["sum(val)"])
+}
+
+func TestNullFirstValues(t *testing.T) {
+	// Columns are typed by their first value that is not null.
+	cs := newTestStore(t)
+	require.NoError(t, cs.Append(map[string]any{"i": nil}))
+	require.NoError(t, cs.Append(map[string]any{"i": 5}))
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"j": nil}, {"j": 5}}))
+
+	cols, err := cs.fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, []ColumnType{ColumnTypeInt64, ColumnTypeInt64}, lo.Map(cols, func(c ColumnInfo, _ int) ColumnType { return c.Type }))
+	rows, err := cs.Query(&Query{Select: []string{"i", "j"}, Where: Where("j", ConditionIsNull, nil)})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(0), int64(1), int64(2)}, lo.Map(rows, func(row map[string]any, _ int) any { return row[IndexColumn] }))
+	rows, err = cs.Query(&Query{Where: Where("j", ConditionEquals, 5)})
+	require.NoError(t, err)
+	assert.Len(t, rows, 1)
+}
+
+func TestMemoryMappedQueries(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFSWithOptions(dir, Options{MemoryMap: true})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+
+	rows, err := cs.Query(&Query{})
+	require.NoError(t, err)
+	assert.Empty(t, rows)
+
+	require.NoError(t, cs.AppendBatch(benchmarkRows(5000)))
+	rows, err = cs.Query(&Query{
+		Select:  []string{"name"},
+		Filters: []Filter{{Attribute: "val", Condition: ConditionGreaterThanOrEquals, Value: 4998}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []any{"4998", "4999"}, lo.Map(rows, func(row map[string]any, _ int) any { return row["name"] }))
+	assert.NotNil(t, rows[0][TimestampColumn])
+}
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{WriteBufferRows: 1000, FlushInterval: 10 * time.Millisecond}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i)}))
+	}
+	assert.Eventually(t, func() bool {
+		fs.lock.Lock()
+		defer fs.lock.Unlock()
+		return len(fs.buffer.rows) == 0 && fs.nextID == 10
+	}, time.Second, time.Millisecond, "the background flusher writes buffered rows")
+	require.NoError(t, cs.Append(map[string]any{"val": int64(10)}))
+
+	it, err := cs.QueryIter(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, fs.Shutdown(ctx), context.DeadlineExceeded, "queries in flight are waited for")
+	assert.ErrorIs(t, cs.Append(map[string]any{"val": int64(11)}), ErrStoreClosed)
+	_, err = cs.Query(&Query{})
+	assert.ErrorIs(t, err, ErrStoreClosed)
+
+	n := 0
+	for it.Next() {
+		n++
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, 11, n)
+	done := make(chan error)
+	go func() { done <- fs.Shutdown(context.Background()) }()
+	require.NoError(t, it.Close())
+	require.NoError(t, <-done)
+
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	res, err := NewColumnarStore(fs).Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), res[0]["count"])
+}
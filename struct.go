@@ -0,0 +1,224 @@
+package querystore
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const structTag = "querystore"
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// structField maps an exported struct field to a column.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var structFieldCache sync.Map // map[reflect.Type][]structField
+
+// structFields returns the column mapping for a struct type. Fields are named
+// by their `querystore:"name"` tag, or the field name when untagged; a tag of
+// "-" skips the field and ",omitempty" skips zero values. Fields of embedded
+// structs are flattened into the parent.
+func structFields(t reflect.Type) []structField {
+	if cached, ok := structFieldCache.Load(t); ok {
+		return cached.([]structField)
+	}
+	var fields []structField
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		tag := sf.Tag.Get(structTag)
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if sf.Anonymous && name == "" && sf.Type.Kind() == reflect.Struct {
+			for _, f := range structFields(sf.Type) {
+				f.index = append([]int{i}, f.index...)
+				fields = append(fields, f)
+			}
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, structField{name: name, index: []int{i}, omitEmpty: opts == "omitempty"})
+	}
+	structFieldCache.Store(t, fields)
+	return fields
+}
+
+// structToFields converts a struct, or pointer to struct, into column values.
+// Nil pointer fields are omitted.
+func structToFields(v any) (map[string]any, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("cannot append nil %T", v)
+		}
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot append non-struct type %T", v)
+	}
+
+	fields := map[string]any{}
+	for _, f := range structFields(rv.Type()) {
+		fv := rv.FieldByIndex(f.index)
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		if fv.Type() == timeType {
+			fields[f.name] = fv.Interface()
+			continue
+		}
+		switch fv.Kind() {
+		case reflect.Bool:
+			fields[f.name] = fv.Bool()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			fields[f.name] = fv.Int()
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32:
+			fields[f.name] = int64(fv.Uint())
+		case reflect.Uint, reflect.Uint64:
+			fields[f.name] = fv.Uint()
+		case reflect.Float32, reflect.Float64:
+			fields[f.name] = fv.Float()
+		case reflect.String:
+			fields[f.name] = fv.String()
+		case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+			fields[f.name] = fv.Interface()
+		default:
+			return nil, fmt.Errorf("unsupported type %s for field %s", fv.Type(), f.name)
+		}
+	}
+	return fields, nil
+}
+
+// AppendStruct appends a struct as a row, mapping its exported fields to
+// columns. See structFields for the tag conventions.
+func (s *ColumnarStore) AppendStruct(v any) error {
+	fields, err := structToFields(v)
+	if err != nil {
+		return err
+	}
+	return s.Append(fields)
+}
+
+// AppendStructs appends a slice of structs as a single batch.
+func AppendStructs[T any](s *ColumnarStore, vs []T) error {
+	rows := make([]map[string]any, len(vs))
+	for i, v := range vs {
+		fields, err := structToFields(v)
+		if err != nil {
+			return err
+		}
+		rows[i] = fields
+	}
+	return s.AppendBatch(rows)
+}
+
+// fieldsToStruct populates the struct pointed to by dst from a result row.
+// Values are converted to the field types; fields whose column is absent from
+// the row are reset to their zero value.
+func fieldsToStruct(row map[string]any, dst any) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("scan destination must be a non-nil struct pointer, got %T", dst)
+	}
+	rv = rv.Elem()
+	for _, f := range structFields(rv.Type()) {
+		fv := rv.FieldByIndex(f.index)
+		v := row[f.name]
+		if v == nil {
+			fv.SetZero()
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		if err := setFieldValue(fv, v); err != nil {
+			return fmt.Errorf("scanning column %s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// setFieldValue sets a field to a value converted to its type. Maps, slices,
+// arrays and structs, which AppendStruct stores in JSON columns, are decoded
+// from the JSON form of the value, and values that overflow the field fail.
+func setFieldValue(fv reflect.Value, v any) error {
+	var typ ColumnType
+	switch {
+	case fv.Type() == timeType:
+		typ = ColumnTypeTime
+	case fv.Kind() == reflect.Bool:
+		typ = ColumnTypeBool
+	case fv.CanInt():
+		typ = ColumnTypeInt64
+	case fv.CanUint():
+		typ = ColumnTypeUint64
+	case fv.CanFloat():
+		typ = ColumnTypeFloat64
+	case fv.Kind() == reflect.String:
+		typ = ColumnTypeString
+	case fv.Kind() == reflect.Map, fv.Kind() == reflect.Slice, fv.Kind() == reflect.Array, fv.Kind() == reflect.Struct:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		dst := reflect.New(fv.Type())
+		if err := json.Unmarshal(b, dst.Interface()); err != nil {
+			return err
+		}
+		fv.Set(dst.Elem())
+		return nil
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	cv, err := convertValue(v, typ)
+	if err != nil {
+		return err
+	}
+	switch cv := cv.(type) {
+	case time.Time:
+		fv.Set(reflect.ValueOf(cv))
+	case bool:
+		fv.SetBool(cv)
+	case int64:
+		if fv.OverflowInt(cv) {
+			return fmt.Errorf("%d overflows %s", cv, fv.Type())
+		}
+		fv.SetInt(cv)
+	case uint64:
+		if fv.OverflowUint(cv) {
+			return fmt.Errorf("%d overflows %s", cv, fv.Type())
+		}
+		fv.SetUint(cv)
+	case float64:
+		if fv.OverflowFloat(cv) {
+			return fmt.Errorf("%v overflows %s", cv, fv.Type())
+		}
+		fv.SetFloat(cv)
+	case string:
+		fv.SetString(cv)
+	}
+	return nil
+}
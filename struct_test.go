@@ -0,0 +1,122 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testBase struct {
+	Region string `querystore:"region"`
+}
+
+type testEvent struct {
+	testBase
+	Status  string  `querystore:"status"`
+	Latency float64 `querystore:"latency_ms"`
+	Retries *int    `querystore:"retries"`
+	Note    string  `querystore:"note,omitempty"`
+	Secret  string  `querystore:"-"`
+	Count   uint16
+	hidden  int
+}
+
+func TestAppendStruct(t *testing.T) {
+	cs := newTestStore(t)
+
+	retries := 3
+	require.NoError(t, cs.AppendStruct(&testEvent{
+		testBase: testBase{Region: "us"},
+		Status:   "ok",
+		Latency:  1.5,
+		Retries:  &retries,
+		Secret:   "x",
+		Count:    7,
+		hidden:   1,
+	}))
+	require.NoError(t, AppendStructs(cs, []testEvent{{Status: "error", Note: "boom"}}))
+	assert.Error(t, cs.AppendStruct(42))
+
+	rows, err := cs.Query(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "us", rows[0]["region"])
+	assert.Equal(t, 1.5, rows[0]["latency_ms"])
+	assert.Equal(t, int64(3), rows[0]["retries"])
+	assert.Equal(t, int64(7), rows[0]["Count"])
+	assert.Nil(t, rows[0]["note"])
+	assert.NotContains(t, rows[0], "Secret")
+	assert.Equal(t, "boom", rows[1]["note"])
+	assert.Nil(t, rows[1]["retries"])
+}
+
+func TestScanStruct(t *testing.T) {
+	cs := newTestStore(t)
+
+	retries := 2
+	require.NoError(t, AppendStructs(cs, []testEvent{
+		{testBase: testBase{Region: "eu"}, Status: "ok", Latency: 12.5, Retries: &retries, Count: 4},
+		{Status: "error", Note: "boom"},
+	}))
+
+	rows, err := cs.QueryIter(&Query{Select: []string{"*", IndexColumn}})
+	require.NoError(t, err)
+	defer rows.Close()
+
+	type result struct {
+		Index   int64   `querystore:"__index"`
+		Region  string  `querystore:"region"`
+		Latency float32 `querystore:"latency_ms"`
+		Retries *int    `querystore:"retries"`
+		Count   string
+		Missing bool `querystore:"missing"`
+	}
+	var got []result
+	for rows.Next() {
+		var r result
+		require.NoError(t, rows.ScanStruct(&r))
+		got = append(got, r)
+	}
+	require.NoError(t, rows.Err())
+	require.Len(t, got, 2)
+	assert.Equal(t, int64(0), got[0].Index)
+	assert.Equal(t, "eu", got[0].Region)
+	assert.Equal(t, float32(12.5), got[0].Latency)
+	assert.Equal(t, 2, *got[0].Retries)
+	assert.Equal(t, "4", got[0].Count)
+	assert.Equal(t, int64(1), got[1].Index)
+	assert.Nil(t, got[1].Retries)
+}
+
+func TestScanStructJSON(t *testing.T) {
+	type point struct{ X, Y int }
+	type event struct {
+		Tags   map[string]string `querystore:"tags"`
+		Path   []point           `querystore:"path"`
+		Origin point             `querystore:"origin"`
+		Pair   [2]string         `querystore:"pair"`
+		Level  int64             `querystore:"level"`
+	}
+	cs := newTestStore(t)
+	in := event{Tags: map[string]string{"env": "prod"}, Path: []point{{1, 2}, {3, 4}}, Origin: point{5, 6}, Pair: [2]string{"a", "b"}, Level: 300}
+	require.NoError(t, cs.AppendStruct(in))
+
+	rows, err := cs.QueryIter(&Query{Select: []string{"*"}})
+	require.NoError(t, err)
+	defer rows.Close()
+	require.True(t, rows.Next())
+	out := event{Tags: map[string]string{"stale": "x"}}
+	require.NoError(t, rows.ScanStruct(&out))
+	assert.Equal(t, in, out)
+
+	// Values that overflow their field fail rather than wrapping.
+	var small struct {
+		Level int8 `querystore:"level"`
+	}
+	assert.ErrorContains(t, rows.ScanStruct(&small), "300 overflows int8")
+	var narrow struct {
+		Level uint8 `querystore:"level"`
+	}
+	assert.ErrorContains(t, rows.ScanStruct(&narrow), "300 overflows uint8")
+}
@@ -0,0 +1,128 @@
+package querystore
+
+import (
+	"context"
+	"time"
+)
+
+// Subscription delivers the rows of a store as they are appended. Use Next
+// to wait for each row, as with Rows.
+type Subscription struct {
+	ctx   context.Context
+	s     *ColumnarStore
+	where *FilterExpression
+	// next is the index of the first row not yet scanned.
+	next int64
+	it   *Rows
+	// end is the number of rows when it was opened, and wait is closed when
+	// rows are appended after that.
+	end  int64
+	wait <-chan struct{}
+	row  map[string]any
+	err  error
+}
+
+// Subscribe returns a subscription to the rows from fromIndex on, including
+// those appended later, that match where, which may be nil. Rows hold every
+// column, with their index in IndexColumn; resume a subscription from one
+// past the index of the last row handled. The subscription ends when ctx is
+// done.
+func (s *ColumnarStore) Subscribe(ctx context.Context, fromIndex int64, where *FilterExpression) *Subscription {
+	return &Subscription{ctx: ctx, s: s, where: where, next: max(fromIndex, 0)}
+}
+
+// Next waits for the next row, returning false once the subscription ends or
+// fails.
+func (sub *Subscription) Next() bool {
+	for sub.err == nil {
+		if sub.it == nil {
+			if sub.err = sub.open(); sub.err != nil {
+				break
+			}
+			if sub.it == nil {
+				select {
+				case <-sub.ctx.Done():
+					sub.err = sub.ctx.Err()
+				case <-sub.wait:
+				}
+				continue
+			}
+		}
+		for sub.it.Next() {
+			row := sub.it.Row()
+			index := row[IndexColumn].(int64)
+			if index < sub.next {
+				continue
+			}
+			sub.next, sub.row = index+1, row
+			return true
+		}
+		sub.err = sub.it.Err()
+		sub.it.Close()
+		sub.it = nil
+		sub.next = max(sub.next, sub.end)
+	}
+	return false
+}
+
+// open opens a query over the rows from next, or leaves it nil if there are
+// none yet.
+func (sub *Subscription) open() error {
+	sub.wait, sub.end = sub.s.fs.appendSignal()
+	if sub.next >= sub.end {
+		return nil
+	}
+	var err error
+	sub.it, err = sub.s.queryFrom(sub.ctx, &Query{Select: []string{"*"}, Where: sub.where}, sub.next)
+	return err
+}
+
+// appendSignal returns the number of rows and a channel closed when rows are
+// next appended.
+func (fs *ColumnFS) appendSignal() (<-chan struct{}, int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.appended == nil {
+		fs.appended = make(chan struct{})
+	}
+	return fs.appended, fs.nextID
+}
+
+// queryFrom runs a row query from the row at index from on. Rows are ordered
+// by time, so the scan starts at the time of that row, and may return rows
+// before it with the same time, which callers skip.
+func (s *ColumnarStore) queryFrom(ctx context.Context, q *Query, from int64) (*Rows, error) {
+	fs := s.fs
+	fs.lock.Lock()
+	ts, ok, err := fs.rowTimestamp(from)
+	fs.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	qc := *q
+	if ok {
+		qc.TimeRange.Start = time.Unix(0, ts)
+	}
+	return s.QueryIterContext(ctx, &qc)
+}
+
+// Row returns the current row.
+func (sub *Subscription) Row() map[string]any {
+	return sub.row
+}
+
+// Err returns the error that ended the subscription, which is the context's
+// error if it is done.
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Close releases the subscription's resources.
+func (sub *Subscription) Close() error {
+	if sub.it != nil {
+		err := sub.it.Close()
+		sub.it = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package querystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	cs := newTestStore(t)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": int64(1)}, {"val": int64(2)}}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := cs.Subscribe(ctx, 1, Where("val", ConditionNotEquals, int64(3)))
+	defer sub.Close()
+	go func() {
+		for _, v := range []int64{3, 4, 5} {
+			time.Sleep(time.Millisecond)
+			cs.Append(map[string]any{"val": v})
+		}
+	}()
+	var got []int64
+	for len(got) < 3 && sub.Next() {
+		got = append(got, sub.Row()["val"].(int64))
+	}
+	assert.Equal(t, []int64{2, 4, 5}, got)
+	assert.Equal(t, int64(4), sub.Row()[IndexColumn])
+
+	cancel()
+	assert.False(t, sub.Next())
+	assert.ErrorIs(t, sub.Err(), context.Canceled)
+
+	// Resuming from past the last row waits for new rows.
+	sub = cs.Subscribe(context.Background(), 5, nil)
+	defer sub.Close()
+	require.NoError(t, cs.Append(map[string]any{"val": int64(6)}))
+	require.True(t, sub.Next())
+	assert.Equal(t, int64(6), sub.Row()["val"])
+}
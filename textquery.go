@@ -0,0 +1,458 @@
+package querystore
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ParseQuery parses a query written in a compact text form, such as
+//
+//	status = "error" and latency > 500 | count, avg(latency) by region | sort count desc | limit 10
+//
+// A query is an optional filter followed by stages separated by |. Filters
+// compare a column to a value with =, !=, <, <=, >, >=, contains,
+// startswith, endswith or matches, test it with "in [value, ...]",
+// "is null" or "is not null", and combine with and, or, not and
+// parentheses. Values are numbers, strings quoted with " or ', true or
+// false. The stages are
+//
+//	select column, ...             return only these columns
+//	agg, ... [by group, ...]       aggregate, where agg is count, count(column),
+//	                               sum(column), min(column), max(column),
+//	                               avg(column), a percentile such as
+//	                               p95(column), histogram(column, bound, ...),
+//	                               or the top values by count or by the sum of
+//	                               another column, such as top10(column) or
+//	                               top10(column, weight), or the approximate
+//	                               count of distinct values,
+//	                               approx_distinct(column),
+//	                               optionally followed by "as name", and each
+//	                               group is a column or time(interval
+//	                               [, column]), grouping by the intervals of
+//	                               the time rows were appended or of a column
+//	sort column [desc], ...        order the results
+//	limit n [offset m]             return at most n results, after skipping m
+//	last duration                  only rows appended within the duration, as
+//	                               parsed by time.ParseDuration, before now
+//
+// Keywords are case-insensitive; column names are not.
+func ParseQuery(s string) (*Query, error) {
+	toks, err := lexTextQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &textQueryParser{toks: toks}
+	q := &Query{}
+	if !p.at("|") && !p.at("") {
+		if q.Where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	for p.accept("|") {
+		if err := p.parseStage(q); err != nil {
+			return nil, err
+		}
+	}
+	if !p.at("") {
+		return nil, p.unexpected("expected |")
+	}
+	return q, nil
+}
+
+type textToken struct {
+	text string
+	// quoted marks string literals, whose text is unquoted.
+	quoted bool
+	pos    int
+}
+
+func lexTextQuery(s string) ([]textToken, error) {
+	var toks []textToken
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(s) && rune(s[j]) != c; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("query: unterminated string at offset %d", i)
+			}
+			toks = append(toks, textToken{text: b.String(), quoted: true, pos: i})
+			i = j + 1
+		case strings.ContainsRune("|,()[]", c):
+			toks = append(toks, textToken{text: string(c), pos: i})
+			i++
+		case strings.ContainsRune("=!<>", c):
+			j := i + 1
+			if j < len(s) && s[j] == '=' {
+				j++
+			}
+			toks = append(toks, textToken{text: s[i:j], pos: i})
+			i = j
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("|,()[]=!<>\"'", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, textToken{text: s[i:j], pos: i})
+			i = j
+		}
+	}
+	return append(toks, textToken{pos: len(s)}), nil
+}
+
+type textQueryParser struct {
+	toks []textToken
+	pos  int
+}
+
+// at reports whether the next token is the unquoted word or symbol text,
+// ignoring case. The empty text matches the end of the query.
+func (p *textQueryParser) at(text string) bool {
+	tok := p.toks[p.pos]
+	return !tok.quoted && strings.EqualFold(tok.text, text)
+}
+
+func (p *textQueryParser) accept(text string) bool {
+	if p.at(text) && p.pos < len(p.toks)-1 {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *textQueryParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + text)
+	}
+	return nil
+}
+
+func (p *textQueryParser) unexpected(want string) error {
+	tok := p.toks[p.pos]
+	if p.pos == len(p.toks)-1 {
+		return fmt.Errorf("query: %s, found end of query", want)
+	}
+	return fmt.Errorf("query: %s, found %q at offset %d", want, tok.text, tok.pos)
+}
+
+var textQueryKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "is": true, "by": true, "as": true,
+}
+
+// word consumes a column name.
+func (p *textQueryParser) word() (string, error) {
+	tok := p.toks[p.pos]
+	if tok.quoted || tok.text == "" || strings.ContainsAny(tok.text, "|,()[]=!<>") || textQueryKeywords[strings.ToLower(tok.text)] {
+		return "", p.unexpected("expected a column name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+func (p *textQueryParser) parseOr() (*FilterExpression, error) {
+	var exprs []*FilterExpression
+	for {
+		e, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept("or") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return Or(exprs...), nil
+}
+
+func (p *textQueryParser) parseAnd() (*FilterExpression, error) {
+	var exprs []*FilterExpression
+	for {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+		if !p.accept("and") {
+			break
+		}
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return And(exprs...), nil
+}
+
+func (p *textQueryParser) parseNot() (*FilterExpression, error) {
+	if p.accept("not") {
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return Not(e), nil
+	}
+	if p.accept("(") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	}
+	return p.parseCondition()
+}
+
+var textQueryConditions = map[string]ConditionType{
+	"=":          ConditionEquals,
+	"==":         ConditionEquals,
+	"!=":         ConditionNotEquals,
+	"<":          ConditionLessThan,
+	"<=":         ConditionLessThanOrEquals,
+	">":          ConditionGreaterThan,
+	">=":         ConditionGreaterThanOrEquals,
+	"contains":   ConditionContains,
+	"startswith": ConditionStartsWith,
+	"endswith":   ConditionEndsWith,
+	"matches":    ConditionMatches,
+}
+
+func (p *textQueryParser) parseCondition() (*FilterExpression, error) {
+	col, err := p.word()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("is") {
+		cond := ConditionIsNull
+		if p.accept("not") {
+			cond = ConditionIsNotNull
+		}
+		return Where(col, cond, nil), p.expect("null")
+	}
+	cond := ConditionIn
+	if p.accept("not") {
+		cond = ConditionNotIn
+		if !p.at("in") {
+			return nil, p.unexpected("expected in")
+		}
+	}
+	if p.accept("in") {
+		if err := p.expect("["); err != nil {
+			return nil, err
+		}
+		var values []any
+		for !p.accept("]") {
+			if len(values) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return Where(col, cond, values), nil
+	}
+	tok := p.toks[p.pos]
+	cond, ok := textQueryConditions[strings.ToLower(tok.text)]
+	if tok.quoted || !ok {
+		return nil, p.unexpected("expected a comparison")
+	}
+	p.pos++
+	v, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	return Where(col, cond, v), nil
+}
+
+func (p *textQueryParser) value() (any, error) {
+	tok := p.toks[p.pos]
+	if tok.quoted {
+		p.pos++
+		return tok.text, nil
+	}
+	switch {
+	case p.accept("true"):
+		return true, nil
+	case p.accept("false"):
+		return false, nil
+	}
+	if n, err := strconv.ParseInt(tok.text, 10, 64); err == nil {
+		p.pos++
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(tok.text, 64); err == nil {
+		p.pos++
+		return f, nil
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+func (p *textQueryParser) count() (int, error) {
+	n, err := strconv.Atoi(p.toks[p.pos].text)
+	if err != nil || n < 0 || p.toks[p.pos].quoted {
+		return 0, p.unexpected("expected a count")
+	}
+	p.pos++
+	return n, nil
+}
+
+var textQueryAggregators = map[string]AggregatorType{
+	"count": AggregatorCount,
+	"sum":   AggregatorSum,
+	"min":   AggregatorMin,
+	"max":   AggregatorMax,
+	"avg":   AggregatorAvg,
+
+	"histogram":       AggregatorHistogram,
+	"approx_distinct": AggregatorApproxDistinct,
+}
+
+func (p *textQueryParser) parseStage(q *Query) error {
+	var err error
+	switch {
+	case p.accept("select"):
+		for {
+			col, err := p.word()
+			if err != nil {
+				return err
+			}
+			q.Select = append(q.Select, col)
+			if !p.accept(",") {
+				return nil
+			}
+		}
+	case p.accept("sort"):
+		for {
+			var o Order
+			if o.Attribute, err = p.word(); err != nil {
+				return err
+			}
+			if p.accept("desc") {
+				o.Descending = true
+			} else {
+				p.accept("asc")
+			}
+			q.OrderBy = append(q.OrderBy, o)
+			if !p.accept(",") {
+				return nil
+			}
+		}
+	case p.accept("limit"):
+		if q.Limit, err = p.count(); err != nil {
+			return err
+		}
+		if p.accept("offset") {
+			q.Offset, err = p.count()
+		}
+		return err
+	case p.accept("last"):
+		d, perr := time.ParseDuration(p.toks[p.pos].text)
+		if perr != nil || d <= 0 {
+			return p.unexpected("expected a duration")
+		}
+		p.pos++
+		q.TimeRange = TimeRange{Start: time.Now().Add(-d)}
+		return nil
+	}
+
+	for want := "expected a stage"; ; want = "expected an aggregation" {
+		name := strings.ToLower(p.toks[p.pos].text)
+		typ, ok := textQueryAggregators[name]
+		agg := Aggregation{Type: typ}
+		if pct, perr := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64); !ok && strings.HasPrefix(name, "p") && perr == nil {
+			agg = Aggregation{Type: AggregatorPercentile, Percentile: pct}
+			ok = true
+		}
+		if k, kerr := strconv.Atoi(strings.TrimPrefix(name, "top")); !ok && strings.HasPrefix(name, "top") && kerr == nil {
+			agg = Aggregation{Type: AggregatorTopK, K: k}
+			ok = true
+		}
+		if !ok || p.toks[p.pos].quoted {
+			return p.unexpected(want)
+		}
+		p.pos++
+		if p.accept("(") {
+			if agg.Attribute, err = p.word(); err != nil {
+				return err
+			}
+			for agg.Type == AggregatorHistogram && p.accept(",") {
+				v, err := p.value()
+				bound, isNum := numericValue(v)
+				if err != nil || !isNum {
+					return p.unexpected("expected a bucket bound")
+				}
+				agg.Buckets = append(agg.Buckets, bound)
+			}
+			if agg.Type == AggregatorTopK && p.accept(",") {
+				if agg.Weight, err = p.word(); err != nil {
+					return err
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+		} else if agg.Type != AggregatorCount {
+			return p.unexpected("expected (")
+		}
+		if p.accept("as") {
+			if agg.Alias, err = p.word(); err != nil {
+				return err
+			}
+		}
+		q.Aggregations = append(q.Aggregations, agg)
+		if !p.accept(",") {
+			break
+		}
+	}
+	if !p.accept("by") {
+		return nil
+	}
+	for {
+		if p.at("time") && p.toks[p.pos+1].text == "(" && !p.toks[p.pos+1].quoted {
+			p.pos += 2
+			d, perr := time.ParseDuration(p.toks[p.pos].text)
+			if perr != nil || d <= 0 || q.GroupByTime > 0 {
+				return p.unexpected("expected a duration")
+			}
+			p.pos++
+			q.GroupByTime = d
+			if p.accept(",") {
+				if q.GroupByTimeColumn, err = p.word(); err != nil {
+					return err
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+		} else {
+			col, err := p.word()
+			if err != nil {
+				return err
+			}
+			if q.GroupBy == "" {
+				q.GroupBy = col
+			} else {
+				q.GroupByColumns = append(q.GroupByColumns, col)
+			}
+		}
+		if !p.accept(",") {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	cs := newTestStore(t)
+	for i := range 10 {
+		status := "ok"
+		if i%3 == 0 {
+			status = "error"
+		}
+		require.NoError(t, cs.Append(map[string]any{"status": status, "latency": i * 100, "region": []string{"us", "eu"}[i%2]}))
+	}
+
+	q, err := ParseQuery(`status = "error" and latency > 200 | count, avg(latency) as mean by region | sort region`)
+	require.NoError(t, err)
+	rows, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "eu", rows[0]["region"])
+	assert.EqualValues(t, 2, rows[0]["count"])
+	assert.EqualValues(t, 600.0, rows[0]["mean"])
+	assert.EqualValues(t, 1, rows[1]["count"])
+
+	q, err = ParseQuery(`(region in ['eu'] or latency<=100) and not status startswith 'err' | select latency | sort latency desc | limit 2 offset 1`)
+	require.NoError(t, err)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(500), int64(100)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["latency"] }))
+
+	q, err = ParseQuery(`| count | last 1h`)
+	require.NoError(t, err)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, rows[0]["count"])
+
+	for query, msg := range map[string]string{
+		`status =`:               "expected a value, found end of query",
+		`status ~ 1`:             "expected a comparison",
+		`| frobnicate`:           "expected a stage",
+		`| sum`:                  "expected (",
+		`| last soon`:            "expected a duration",
+		`status = "error`:        "unterminated string",
+		`latency > 1 latency`:    "expected |",
+		`status not = "error"`:   "expected in",
+		`(status = "error"`:      "expected )",
+		`status is "error"`:      "expected null",
+		`| limit 2 offset three`: "expected a count",
+	} {
+		_, err := ParseQuery(query)
+		assert.ErrorContains(t, err, msg, query)
+	}
+}
@@ -0,0 +1,211 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// SeriesFunc computes a point of a series from the samples within a range.
+type SeriesFunc int
+
+const (
+	// SeriesRate is the per-second increase of a counter.
+	SeriesRate SeriesFunc = iota
+	// SeriesIncrease is the increase of a counter, allowing for resets.
+	SeriesIncrease
+	// SeriesAvgOverTime is the average value of the samples.
+	SeriesAvgOverTime
+)
+
+var seriesFuncNames = map[SeriesFunc]string{
+	SeriesRate:        "rate",
+	SeriesIncrease:    "increase",
+	SeriesAvgOverTime: "avg_over_time",
+}
+
+func (f SeriesFunc) String() string {
+	if name, ok := seriesFuncNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("SeriesFunc(%d)", int(f))
+}
+
+// maxRangePoints bounds the number of points per series of a range query.
+const maxRangePoints = 11000
+
+// RangeQuery evaluates a function over the samples of a numeric column at
+// regular steps, as PromQL range queries do, such as
+// rate(http_requests_total[5m]) evaluated every minute for an hour.
+type RangeQuery struct {
+	Func SeriesFunc
+	// Column holds the sample values.
+	Column string
+	// TimeColumn holds the sample times. Defaults to the time rows were
+	// appended; use RemoteWriteTimestampColumn for remote write samples.
+	TimeColumn string
+	// Where selects the rows holding samples.
+	Where *FilterExpression
+	// By lists the columns whose values identify a series. Without them, all
+	// samples form a single series.
+	By []string
+	// Points are computed at Start, Start+Step, ... up to End, each from the
+	// samples within (t-Range, t].
+	Start time.Time
+	End   time.Time
+	Step  time.Duration
+	Range time.Duration
+}
+
+// Series is the result of a range query for one set of By values.
+type Series struct {
+	Labels map[string]any
+	Points []Point
+}
+
+// Point is the value of a series at a step. Steps without enough samples
+// have no point.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+type seriesSample struct {
+	ts    int64
+	value float64
+}
+
+// QueryRange runs a range query, returning series ordered by their By
+// values. Unlike PromQL, rate and increase are not extrapolated to the edges
+// of the range, so they need two samples within it.
+func (s *ColumnarStore) QueryRange(rq *RangeQuery) ([]Series, error) {
+	if rq.Column == "" {
+		return nil, errors.New("range query needs a column")
+	}
+	if rq.Step <= 0 || rq.Range <= 0 {
+		return nil, errors.New("range query needs a positive step and range")
+	}
+	if rq.End.Before(rq.Start) {
+		return nil, errors.New("range query ends before it starts")
+	}
+	if rq.End.Sub(rq.Start)/rq.Step >= maxRangePoints {
+		return nil, fmt.Errorf("range query exceeds %d points per series", maxRangePoints)
+	}
+	if _, ok := seriesFuncNames[rq.Func]; !ok {
+		return nil, fmt.Errorf("unknown series function %s", rq.Func)
+	}
+
+	// Read the samples of every window, from the first through End.
+	start, end := rq.Start.Add(-rq.Range), rq.End.Add(1)
+	timeColumn := rq.TimeColumn
+	q := &Query{Where: rq.Where, ReuseRows: true}
+	if timeColumn == "" || timeColumn == TimestampColumn {
+		timeColumn = TimestampColumn
+		q.TimeRange = TimeRange{Start: start, End: end}
+	} else {
+		window := And(Where(timeColumn, ConditionGreaterThanOrEquals, start), Where(timeColumn, ConditionLessThan, end))
+		if q.Where != nil {
+			window = And(q.Where, window)
+		}
+		q.Where = window
+	}
+	q.Select = slices.Concat([]string{rq.Column, timeColumn}, rq.By)
+
+	it, err := s.QueryIter(q)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	type series struct {
+		labels  map[string]any
+		samples []seriesSample
+	}
+	bySeries := map[string]*series{}
+	for it.Next() {
+		row := it.Row()
+		v, t := row[rq.Column], row[timeColumn]
+		if v == nil || t == nil {
+			continue
+		}
+		switch valueColumnType(v) {
+		case ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64:
+		default:
+			return nil, fmt.Errorf("column %s holds a %T value, which is not numeric", rq.Column, v)
+		}
+		key := make([]any, len(rq.By))
+		for i, col := range rq.By {
+			key[i] = row[col]
+		}
+		k := fmt.Sprint(key...)
+		ser := bySeries[k]
+		if ser == nil {
+			ser = &series{labels: map[string]any{}}
+			for i, col := range rq.By {
+				if key[i] != nil {
+					ser.labels[col] = key[i]
+				}
+			}
+			bySeries[k] = ser
+		}
+		ser.samples = append(ser.samples, seriesSample{ts: valueToTime(t).UnixNano(), value: valueToFloat64(v)})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(bySeries))
+	for k := range bySeries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]Series, 0, len(keys))
+	for _, k := range keys {
+		ser := bySeries[k]
+		sort.SliceStable(ser.samples, func(i, j int) bool { return ser.samples[i].ts < ser.samples[j].ts })
+		out := Series{Labels: ser.labels}
+		for t := rq.Start; !t.After(rq.End); t = t.Add(rq.Step) {
+			first := sort.Search(len(ser.samples), func(i int) bool { return ser.samples[i].ts > t.Add(-rq.Range).UnixNano() })
+			end := sort.Search(len(ser.samples), func(i int) bool { return ser.samples[i].ts > t.UnixNano() })
+			if v, ok := rq.Func.eval(ser.samples[first:end], rq.Range); ok {
+				out.Points = append(out.Points, Point{Time: t, Value: v})
+			}
+		}
+		result = append(result, out)
+	}
+	return result, nil
+}
+
+// eval computes the function over the samples of a window.
+func (f SeriesFunc) eval(samples []seriesSample, window time.Duration) (float64, bool) {
+	switch f {
+	case SeriesAvgOverTime:
+		if len(samples) == 0 {
+			return 0, false
+		}
+		var sum float64
+		for _, s := range samples {
+			sum += s.value
+		}
+		return sum / float64(len(samples)), true
+	case SeriesRate, SeriesIncrease:
+		if len(samples) < 2 {
+			return 0, false
+		}
+		var increase float64
+		for i := 1; i < len(samples); i++ {
+			if d := samples[i].value - samples[i-1].value; d >= 0 {
+				increase += d
+			} else {
+				// The counter was reset, and counted up from zero since.
+				increase += samples[i].value
+			}
+		}
+		if f == SeriesRate {
+			return increase / window.Seconds(), true
+		}
+		return increase, true
+	}
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package querystore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryRange(t *testing.T) {
+	cs := newTestStore(t)
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var rows []map[string]any
+	for i := range 10 {
+		// Counters of two jobs; api resets after its fifth sample.
+		api := float64(i * 10)
+		if i >= 5 {
+			api = float64((i - 5) * 10)
+		}
+		at := t0.Add(time.Duration(i) * time.Minute)
+		rows = append(rows,
+			map[string]any{"metric": "requests", "job": "api", "value": api, "timestamp": at},
+			map[string]any{"metric": "requests", "job": "web", "value": float64(i), "timestamp": at},
+			map[string]any{"metric": "other", "job": "web", "value": 1000.0, "timestamp": at})
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	rq := &RangeQuery{
+		Func:       SeriesIncrease,
+		Column:     "value",
+		TimeColumn: "timestamp",
+		Where:      Where("metric", ConditionEquals, "requests"),
+		By:         []string{"job"},
+		Start:      t0,
+		End:        t0.Add(9 * time.Minute),
+		Step:       3 * time.Minute,
+		Range:      3 * time.Minute,
+	}
+	series, err := cs.QueryRange(rq)
+	require.NoError(t, err)
+	require.Len(t, series, 2)
+	assert.Equal(t, map[string]any{"job": "api"}, series[0].Labels)
+	// Windows hold three samples, and the first step's only one, so it has
+	// no point.
+	assert.Equal(t, []Point{{t0.Add(3 * time.Minute), 20}, {t0.Add(6 * time.Minute), 10}, {t0.Add(9 * time.Minute), 20}}, series[0].Points)
+	assert.Equal(t, []Point{{t0.Add(3 * time.Minute), 2}, {t0.Add(6 * time.Minute), 2}, {t0.Add(9 * time.Minute), 2}}, series[1].Points)
+
+	rq.Func = SeriesRate
+	series, err = cs.QueryRange(rq)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0/180, series[1].Points[0].Value)
+
+	rq.Func, rq.By, rq.Range = SeriesAvgOverTime, nil, time.Minute
+	series, err = cs.QueryRange(rq)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Empty(t, series[0].Labels)
+	assert.Equal(t, []Point{{t0, 0}, {t0.Add(3 * time.Minute), 16.5}, {t0.Add(6 * time.Minute), 8}, {t0.Add(9 * time.Minute), 24.5}}, series[0].Points)
+
+	// Samples timed by when they were appended.
+	series, err = cs.QueryRange(&RangeQuery{Func: SeriesAvgOverTime, Column: "value", Start: time.Now(), End: time.Now(), Step: time.Second, Range: time.Hour})
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.InDelta(t, (200.0+45+10000)/30, series[0].Points[0].Value, 1e-9)
+
+	rq.Func, rq.Column = SeriesRate, "metric"
+	_, err = cs.QueryRange(rq)
+	assert.ErrorContains(t, err, "not numeric")
+	rq.Column, rq.Step = "value", 0
+	_, err = cs.QueryRange(rq)
+	assert.Error(t, err)
+}
+
+func TestGroupByTime(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i, region := range []string{"us", "eu", "us", "us", "eu"} {
+		now = start.Add(time.Duration(i) * 40 * time.Second)
+		require.NoError(t, cs.Append(map[string]any{"region": region, "val": int64(i), "at": start.Add(-time.Duration(i) * time.Hour)}))
+	}
+	bucket := func(row map[string]any) int { return int(row[TimeBucketColumn].(time.Time).Sub(start) / time.Minute) }
+
+	q, err := ParseQuery("| count, sum(val) by time(1m)")
+	require.NoError(t, err)
+	for _, parallelism := range []int{1, 3} {
+		q.Parallelism = parallelism
+		rows, err := cs.Query(q)
+		require.NoError(t, err)
+		got := lo.Map(rows, func(row map[string]any, _ int) []any { return []any{bucket(row), row["count"], row["sum(val)"]} })
+		assert.Equal(t, [][]any{{0, int64(2), int64(1)}, {1, int64(1), int64(2)}, {2, int64(2), int64(7)}}, got)
+	}
+
+	q, err = ParseQuery(`| count by region, time(2m) | sort time, region`)
+	require.NoError(t, err)
+	rows, err := cs.Query(q)
+	require.NoError(t, err)
+	got := lo.Map(rows, func(row map[string]any, _ int) []any { return []any{bucket(row), row["region"], row["count"]} })
+	assert.Equal(t, [][]any{{0, "eu", int64(1)}, {0, "us", int64(2)}, {2, "eu", int64(1)}, {2, "us", int64(1)}}, got)
+
+	// Buckets of a time column.
+	q, err = NewQuery().Count().GroupByTime(2*time.Hour, "at").OrderBy(TimeBucketColumn).BuildFor(cs)
+	require.NoError(t, err)
+	rows, err = cs.Query(q)
+	require.NoError(t, err)
+	got = lo.Map(rows, func(row map[string]any, _ int) []any { return []any{bucket(row) / 60, row["count"]} })
+	assert.Equal(t, [][]any{{-4, int64(2)}, {-2, int64(2)}, {0, int64(1)}}, got)
+}
@@ -0,0 +1,244 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+)
+
+// tombstoneFileName names the file listing the rows deleted from a store,
+// each as a little-endian int64, in the order they were deleted. Queries skip
+// the rows it lists, and Compact drops their records from the column files.
+const tombstoneFileName = "__tombstones"
+
+// loadTombstones loads the set of deleted rows.
+func (fs *ColumnFS) loadTombstones() error {
+	tombstonePath := path.Join(fs.dir, tombstoneFileName)
+	data, err := readFile(fs.backend, tombstonePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data)%8 != 0 && fs.opts.ReadOnly {
+		// The writer is midway through an append.
+		data = data[:len(data)/8*8]
+	} else if len(data)%8 != 0 {
+		// The rows of a torn append were never reported deleted.
+		fs.logger().Warn("querystore: truncating torn tombstone", "file", tombstonePath, "size", len(data))
+		data = data[:len(data)/8*8]
+		if err := truncateFile(fs.backend, tombstonePath, int64(len(data))); err != nil {
+			return err
+		}
+	}
+	rows := make([]int64, len(data)/8)
+	for i := range rows {
+		rows[i] = int64(binary.LittleEndian.Uint64(data[8*i:]))
+	}
+	slices.Sort(rows)
+	fs.tombstones = &bitmap{}
+	for _, row := range slices.Compact(rows) {
+		fs.tombstones.add(row)
+	}
+	return nil
+}
+
+// deleteRows marks rows of the store as deleted, returning how many were not
+// deleted already. Rows are given by their index in the store.
+func (fs *ColumnFS) deleteRows(rows []int64) (int64, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.flushBuffer(); err != nil {
+		return 0, err
+	}
+	return fs.tombstoneRows(rows)
+}
+
+// tombstoneRows is deleteRows for callers holding fs.lock.
+func (fs *ColumnFS) tombstoneRows(rows []int64) (int64, error) {
+	fs.invalidateCache()
+	rows = slices.Clone(rows)
+	slices.Sort(rows)
+	rows = slices.Compact(rows)
+	if fs.partitioning == PartitionNone {
+		return fs.addTombstones(rows)
+	}
+	var n int64
+	for _, p := range fs.partitions {
+		var local []int64
+		for _, row := range rows {
+			if row >= p.base && row < p.base+p.fs.nextID {
+				local = append(local, row-p.base)
+			}
+		}
+		if len(local) == 0 {
+			continue
+		}
+		p.fs.lock.Lock()
+		added, err := p.fs.addTombstones(local)
+		p.fs.lock.Unlock()
+		n += added
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// addTombstones records sorted rows of an unpartitioned store as deleted.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) addTombstones(rows []int64) (int64, error) {
+	if fs.opts.ReadOnly {
+		return 0, ErrStoreReadOnly
+	}
+	added := &bitmap{}
+	var buf []byte
+	for _, row := range rows {
+		if row < 0 || row >= fs.nextID {
+			return 0, fmt.Errorf("cannot delete row %d of %d", row, fs.nextID)
+		}
+		if fs.tombstones != nil && fs.tombstones.contains(row) {
+			continue
+		}
+		added.add(row)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(row))
+	}
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	fp, err := fs.backend.OpenFile(path.Join(fs.dir, tombstoneFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm)
+	if err != nil {
+		return 0, err
+	}
+	_, err = fp.Write(buf)
+	if err == nil && fs.opts.Durability != DurabilityNone {
+		err = fp.Sync()
+	}
+	if err = errors.Join(err, fp.Close()); err != nil {
+		return 0, err
+	}
+	// Cursors share the set, so it is replaced rather than modified.
+	if fs.tombstones == nil {
+		fs.tombstones = added
+	} else {
+		fs.tombstones = orBitmaps(fs.tombstones, added)
+	}
+	return int64(len(buf) / 8), nil
+}
+
+// deletedRows returns the deleted rows of the store below end, in order.
+func (fs *ColumnFS) deletedRows(end int64) []int64 {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.partitioning == PartitionNone {
+		return bitmapRows(fs.tombstones, 0, end)
+	}
+	var rows []int64
+	for _, p := range fs.partitions {
+		p.fs.lock.Lock()
+		for _, row := range bitmapRows(p.fs.tombstones, 0, end-p.base) {
+			rows = append(rows, p.base+row)
+		}
+		p.fs.lock.Unlock()
+	}
+	return rows
+}
+
+// bitmapRows returns the rows of a bitmap, which may be nil, in [start, end).
+func bitmapRows(b *bitmap, start, end int64) []int64 {
+	if b == nil {
+		return nil
+	}
+	var rows []int64
+	for row := b.next(start); row < end; row = b.next(row + 1) {
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// deleted reports whether a row of an unpartitioned store was deleted. The
+// caller must hold fs.lock.
+func (fs *ColumnFS) deleted(row int64) bool {
+	return fs.tombstones != nil && fs.tombstones.contains(row)
+}
+
+// Delete deletes the rows matched by a query's filters and time range, or
+// by its first Limit rows after Offset in its order, returning how many were
+// deleted. Queries no longer return deleted rows, and Compact removes their
+// values from the column files.
+func (s *ColumnarStore) Delete(q *Query) (int64, error) {
+	if len(q.aggregations()) > 0 || len(q.groupColumns()) > 0 {
+		return 0, errors.New("delete query cannot aggregate")
+	}
+	matches := *q
+	matches.Select = []string{IndexColumn}
+	matches.ReuseRows = true
+	it, err := s.QueryIter(&matches)
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	var rows []int64
+	for it.Next() {
+		rows = append(rows, it.Row()[IndexColumn].(int64))
+	}
+	if err := it.Err(); err != nil {
+		return 0, err
+	}
+	return s.fs.deleteRows(rows)
+}
+
+// excludeDeleted makes a cursor skip the deleted rows in its range.
+func (c *cursor) excludeDeleted(deleted *bitmap) {
+	if deleted == nil || deleted.next(c.next) >= c.lastID {
+		return
+	}
+	batch := &batchDeleted{bits: deleted, mask: make([]bool, batchSize)}
+	switch {
+	case c.batch != nil:
+		c.batch = &batchCombination{ps: []batchPredicate{batch, c.batch}, mask: make([]bool, batchSize)}
+	case c.pred == nil:
+		c.batch = batch
+	}
+	if c.pred == nil {
+		c.pred = deletedPredicate{deleted}
+	} else {
+		c.pred = andPredicate{deletedPredicate{deleted}, c.pred}
+	}
+}
+
+// deletedPredicate matches the rows not in a set of deleted rows.
+type deletedPredicate struct {
+	bits *bitmap
+}
+
+func (p deletedPredicate) eval(i int64, row map[string]any) (bool, error) {
+	return !p.bits.contains(i), nil
+}
+
+func (p deletedPredicate) nextCandidate(i int64) int64 { return i + 1 }
+
+// batchDeleted is deletedPredicate for batches.
+type batchDeleted struct {
+	bits *bitmap
+	mask []bool
+}
+
+func (b *batchDeleted) evalBatch(start int64, n int) ([]bool, error) {
+	mask := b.mask[:n]
+	b.bits.fill(mask, start)
+	for j := range mask {
+		mask[j] = !mask[j]
+	}
+	return mask, nil
+}
+
+func (b *batchDeleted) record(j int, row map[string]any) error { return nil }
+
+func (b *batchDeleted) lastMask() []bool { return b.mask }
+
+func (b *batchDeleted) nextCandidate(end int64) int64 { return end }
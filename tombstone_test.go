@@ -0,0 +1,70 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelete(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch(lo.Times(100, func(i int) map[string]any { return map[string]any{"val": i} })))
+
+	n, err := cs.Delete(&Query{Where: Where("val", ConditionLessThan, 10)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), n)
+	n, err = cs.Delete(&Query{Limit: 2, OrderBy: []Order{{Attribute: IndexColumn, Descending: true}}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = cs.Delete(&Query{Where: Where("val", ConditionLessThan, 12)})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	check := func(cs *ColumnarStore) {
+		rows, err := cs.Query(&Query{Select: []string{"val"}, Offset: 1, Limit: 2})
+		require.NoError(t, err)
+		assert.Equal(t, []any{int64(13), int64(14)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+		rows, err = cs.Query(&Query{Where: Where("val", ConditionGreaterThan, 90)})
+		require.NoError(t, err)
+		assert.Len(t, rows, 7)
+		rows, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorCount, Attribute: "val"}}})
+		require.NoError(t, err)
+		assert.Equal(t, int64(86), rows[0]["count(val)"])
+	}
+	check(cs)
+	require.NoError(t, fs.Close())
+
+	// Deletes persist, and compaction removes the deleted values.
+	fs, err = OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	check(cs)
+	require.NoError(t, cs.Compact())
+	check(cs)
+	infos, err := fs.Columns()
+	require.NoError(t, err)
+	assert.Equal(t, int64(86), infos[0].Count)
+	_, err = cs.Delete(&Query{Aggregations: []Aggregation{{Type: AggregatorCount}}})
+	assert.ErrorContains(t, err, "cannot aggregate")
+
+	// Rows are deleted in the order of columns not selected by the query.
+	cs = newTestStore(t)
+	for _, v := range []int{5, 1, 9, 3, 7} {
+		require.NoError(t, cs.Append(map[string]any{"val": v}))
+	}
+	n, err = cs.Delete(&Query{OrderBy: []Order{{Attribute: "val", Descending: true}}, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	n, err = cs.Delete(&Query{OrderBy: []Order{{Attribute: "val"}}, Offset: 1, Limit: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	rows, err := cs.Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(5), int64(1), int64(7)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+}
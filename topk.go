@@ -0,0 +1,123 @@
+package querystore
+
+import (
+	"container/heap"
+	"slices"
+	"strings"
+)
+
+// maxTopK bounds the K of top-K aggregations.
+const maxTopK = 1000
+
+// topKCounters is the number of values a top-K accumulator counts for each
+// it returns. More counters make the counts of the top values more accurate.
+const topKCounters = 10
+
+type topKCounter struct {
+	key   any
+	value any
+	count float64
+	// index is the counter's position in the heap.
+	index int
+}
+
+// topKHeap is a min-heap of counters by count.
+type topKHeap []*topKCounter
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *topKHeap) Push(x any) {
+	c := x.(*topKCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+func (h *topKHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// topKAccumulator finds the most frequent values with the Space-Saving
+// algorithm: it counts a bounded number of values, and a value not counted
+// replaces the one with the least count, taking over its count. Values more
+// frequent than the least count are always counted, and counts are never
+// underestimated.
+type topKAccumulator struct {
+	k        int
+	weighted bool
+	counters map[any]*topKCounter
+	heap     topKHeap
+}
+
+func newTopKAccumulator(k int, weighted bool) *topKAccumulator {
+	return &topKAccumulator{k: k, weighted: weighted, counters: map[any]*topKCounter{}}
+}
+
+func (a *topKAccumulator) add(v any) {
+	a.addCount(v, 1)
+}
+
+func (a *topKAccumulator) addWeighted(v, weight any) {
+	if w, ok := numericValue(weight); ok && w > 0 {
+		a.addCount(v, w)
+	}
+}
+
+func (a *topKAccumulator) addCount(v any, n float64) {
+	key := v
+	switch v.(type) {
+	case []any, map[string]any:
+		// JSON values are not comparable, so they are counted by their
+		// encoding.
+		key = string(encodeJSONValue(v))
+	}
+	if c := a.counters[key]; c != nil {
+		c.count += n
+		heap.Fix(&a.heap, c.index)
+		return
+	}
+	if len(a.heap) < a.k*topKCounters {
+		c := &topKCounter{key: key, value: v, count: n}
+		a.counters[key] = c
+		heap.Push(&a.heap, c)
+		return
+	}
+	c := a.heap[0]
+	delete(a.counters, c.key)
+	c.key, c.value, c.count = key, v, c.count+n
+	a.counters[key] = c
+	heap.Fix(&a.heap, 0)
+}
+
+func (a *topKAccumulator) merge(o accumulator) {
+	for _, c := range o.(*topKAccumulator).heap {
+		a.addCount(c.value, c.count)
+	}
+}
+
+func (a *topKAccumulator) result() any {
+	top := slices.Clone(a.heap)
+	slices.SortFunc(top, func(x, y *topKCounter) int {
+		if x.count != y.count {
+			if x.count > y.count {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(formatTextValue(x.value), formatTextValue(y.value))
+	})
+	values := make([]map[string]any, 0, a.k)
+	for _, c := range top[:min(a.k, len(top))] {
+		if a.weighted {
+			values = append(values, map[string]any{"value": c.value, "sum": c.count})
+		} else {
+			values = append(values, map[string]any{"value": c.value, "count": int64(c.count)})
+		}
+	}
+	return values
+}
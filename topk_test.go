@@ -0,0 +1,60 @@
+package querystore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopK(t *testing.T) {
+	cs := newTestStore(t)
+	var rows []map[string]any
+	for i := range 1000 {
+		endpoint := fmt.Sprintf("/other/%d", i)
+		switch {
+		case i%5 < 2:
+			endpoint = "/a"
+		case i%5 == 2:
+			endpoint = "/b"
+		case i%10 == 3:
+			endpoint = "/c"
+		}
+		rows = append(rows, map[string]any{"endpoint": endpoint, "bytes": int64(i % 7), "status": []string{"ok", "error"}[i%2]})
+	}
+	require.NoError(t, cs.AppendBatch(rows))
+
+	q, err := ParseQuery("| top3(endpoint) as top, top1(endpoint, bytes)")
+	require.NoError(t, err)
+	res, err := cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	top := res[0]["top"].([]map[string]any)
+	assert.Equal(t, []any{"/a", "/b", "/c"}, lo.Map(top, func(v map[string]any, _ int) any { return v["value"] }))
+	assert.Equal(t, int64(400), top[0]["count"])
+	assert.Equal(t, int64(200), top[1]["count"])
+	assert.InDelta(t, 100, top[2]["count"], 40)
+	byBytes := res[0]["top1(endpoint, bytes)"].([]map[string]any)
+	require.Len(t, byBytes, 1)
+	assert.Equal(t, "/a", byBytes[0]["value"])
+
+	q, err = NewQuery().TopK("endpoint", 2).GroupBy("status").OrderBy("status").BuildFor(cs)
+	require.NoError(t, err)
+	res, err = cs.Query(q)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	assert.Equal(t, []map[string]any{{"value": "/a", "count": int64(200)}, {"value": "/b", "count": int64(100)}}, res[0]["top2(endpoint)"])
+
+	_, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorTopK, Attribute: "endpoint"}}})
+	assert.ErrorContains(t, err, "needs a K")
+
+	// Aggregations that cannot be computed from vectors read every column
+	// from rows.
+	require.NoError(t, cs.Append(map[string]any{"meta": map[string]any{"k": "x"}, "bytes": int64(5)}))
+	res, err = cs.Query(&Query{Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "bytes"}}, GroupBy: "meta.k"})
+	require.NoError(t, err)
+	assert.Equal(t, []any{nil, "x"}, lo.Map(res, func(row map[string]any, _ int) any { return row["meta.k"] }))
+	assert.Equal(t, int64(5), res[1]["sum(bytes)"])
+}
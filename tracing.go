@@ -0,0 +1,96 @@
+package querystore
+
+import (
+	"context"
+	"time"
+)
+
+// Tracer starts spans timing the phases of queries, so that slow queries can
+// be diagnosed in production. See Options.Tracer. Its methods mirror those of
+// OpenTelemetry tracers, to which it adapts in a few lines. A query traces:
+//
+//   - querystore.query, from QueryIter until the rows are closed, with the
+//     rows scanned and returned.
+//   - querystore.plan, opening the query: checking column policies, writing
+//     buffered rows, opening readers and compiling filters.
+//   - querystore.column, for each column read, open while its reader is,
+//     with the bytes read from its file and the time spent reading them.
+//   - querystore.scan, scanning the rows of queries whose results are
+//     sorted or read in parallel, with the rows matched.
+//   - querystore.aggregate, scanning and aggregating the rows of aggregate
+//     queries, with the method used and the groups found.
+//
+// The phases are started within the span of the query.
+type Tracer interface {
+	// Start starts a span within any span of ctx, returning a context of the
+	// new span that keeps the deadline and cancellation of ctx.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer. Attributes are ints, strings and
+// durations.
+type Span interface {
+	SetAttribute(key string, value any)
+	// End ends the span, with the error that ended its phase, if any.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) End(err error)                      {}
+
+// startSpan starts a span with the store's tracer, if any.
+func (fs *ColumnFS) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if fs.opts.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return fs.opts.Tracer.Start(ctx, name)
+}
+
+// traceReader starts the span of a column read by the cursor, which its
+// reader ends when closed.
+func (c *cursor) traceReader(fs *ColumnFS, col string, cr *ColumnReader) {
+	if fs.opts.Tracer == nil {
+		return
+	}
+	_, cr.span = fs.opts.Tracer.Start(c.ctx, "querystore.column")
+	cr.span.SetAttribute("column", col)
+}
+
+// endSpan ends the span of a reader, if traced.
+func (cr *ColumnReader) endSpan() {
+	if cr.span == nil {
+		return
+	}
+	cr.span.SetAttribute("bytes_read", cr.bytesRead)
+	cr.span.SetAttribute("read_time", cr.readTime)
+	cr.span.End(nil)
+	cr.span = nil
+}
+
+// aggregateMethod names how a cursor aggregates, for tracing.
+func (c *cursor) aggregateMethod() string {
+	switch {
+	case c.sketchAgg:
+		return "sketch"
+	case c.vectorAgg:
+		return "vector"
+	case c.parts != nil:
+		return "parts"
+	}
+	return "rows"
+}
+
+// readTimed reads from a reader's file, counting the bytes read and the time
+// taken for its span.
+func (cr *ColumnReader) readTimed(p []byte) (int, error) {
+	if cr.span == nil {
+		return cr.fp.Read(p)
+	}
+	start := time.Now()
+	n, err := cr.fp.Read(p)
+	cr.readTime += time.Since(start)
+	cr.bytesRead += int64(n)
+	return n, err
+}
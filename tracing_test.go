@@ -0,0 +1,83 @@
+package querystore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]any
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttribute(key string, value any) { s.attrs[key] = value }
+
+func (s *testSpan) End(err error) { s.err, s.ended = err, true }
+
+type testSpanKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	s := &testSpan{name: name, parent: parent, attrs: map[string]any{}}
+	t.spans = append(t.spans, s)
+	return context.WithValue(ctx, testSpanKey{}, s), s
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Tracer: tracer})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 100 {
+		require.NoError(t, cs.Append(map[string]any{"val": int64(i), "name": fmt.Sprint("n", i%4)}))
+	}
+
+	res, err := cs.Query(&Query{
+		GroupBy:      "name",
+		Aggregations: []Aggregation{{Type: AggregatorSum, Attribute: "val"}},
+	})
+	require.NoError(t, err)
+	require.Len(t, res, 4)
+	names := map[string]int{}
+	var query *testSpan
+	for _, s := range tracer.spans {
+		names[s.name]++
+		assert.True(t, s.ended, s.name)
+		if s.name == "querystore.query" {
+			query = s
+			assert.Nil(t, s.parent)
+		} else {
+			assert.Equal(t, query, s.parent, "%s is within the query", s.name)
+		}
+		if s.name == "querystore.column" {
+			assert.Positive(t, s.attrs["bytes_read"], s.attrs["column"])
+		}
+	}
+	assert.Equal(t, map[string]int{"querystore.query": 1, "querystore.plan": 1, "querystore.aggregate": 1, "querystore.column": 2}, names)
+	assert.Equal(t, 4, tracer.spans[len(tracer.spans)-1].attrs["groups"])
+	assert.Equal(t, int64(100), query.attrs["rows_scanned"])
+	assert.Equal(t, 4, query.attrs["rows"])
+
+	tracer.spans = nil
+	_, err = cs.Query(&Query{Select: []string{"missing"}, Computed: []ComputedColumn{{Name: "bad", Expr: "val +"}}})
+	require.Error(t, err)
+	require.Len(t, tracer.spans, 2)
+	assert.Error(t, tracer.spans[0].err)
+	assert.Error(t, tracer.spans[1].err)
+}
@@ -0,0 +1,95 @@
+package querystore
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// UpsertRows appends rows that supersede the rows holding the same value of
+// the primary key column named by Options.PrimaryKey, which are deleted. Of
+// rows written together with the same key, the last wins. Every row must
+// hold a key.
+func (fs *ColumnFS) UpsertRows(rows []map[string]any) error {
+	key := fs.opts.PrimaryKey
+	if key == "" {
+		return errors.New("no primary key is configured")
+	}
+	keys := make([]any, 0, len(rows))
+	for _, row := range rows {
+		v := row[key]
+		if v == nil {
+			return fmt.Errorf("row has no value for primary key %s", key)
+		}
+		keys = append(keys, v)
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.write(rows); err != nil {
+		return err
+	}
+	// The value index now lists the new rows, so every row of a key but the
+	// last is superseded.
+	var superseded []int64
+	latest := map[int64]bool{}
+	for _, v := range keys {
+		matches, err := fs.keyRows(v)
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 || latest[matches[len(matches)-1]] {
+			continue
+		}
+		latest[matches[len(matches)-1]] = true
+		superseded = append(superseded, matches[:len(matches)-1]...)
+	}
+	_, err := fs.tombstoneRows(superseded)
+	return err
+}
+
+// keyRows returns the rows holding a value of the primary key, in order. The
+// caller must hold fs.lock.
+func (fs *ColumnFS) keyRows(v any) ([]int64, error) {
+	if fs.partitioning != PartitionNone {
+		var rows []int64
+		for _, p := range fs.partitions {
+			p.fs.lock.Lock()
+			local, err := p.fs.keyRows(v)
+			p.fs.lock.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			for _, row := range local {
+				rows = append(rows, p.base+row)
+			}
+		}
+		return rows, nil
+	}
+	ch := fs.columnHandles[fs.opts.PrimaryKey]
+	if ch == nil {
+		return nil, nil
+	}
+	if !indexableType(ch.typ) {
+		return nil, fmt.Errorf("primary key %s is a %s column, which cannot be indexed", fs.opts.PrimaryKey, ch.typ)
+	}
+	if err := ch.loadBlockIndex(); err != nil {
+		return nil, err
+	}
+	key, err := convertValue(v, ch.typ)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clip(ch.values[indexKey(key)]), nil
+}
+
+// Upsert appends a row superseding the row with the same primary key. See
+// ColumnFS.UpsertRows.
+func (s *ColumnarStore) Upsert(fields map[string]any) error {
+	return s.fs.UpsertRows([]map[string]any{fields})
+}
+
+// UpsertBatch is Upsert for many rows at once.
+func (s *ColumnarStore) UpsertBatch(rows []map[string]any) error {
+	return s.fs.UpsertRows(rows)
+}
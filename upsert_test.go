@@ -0,0 +1,40 @@
+package querystore
+
+import (
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpsert(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{PrimaryKey: "id"}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.Upsert(map[string]any{"id": "a", "val": 1}))
+	require.NoError(t, cs.Upsert(map[string]any{"id": "b", "val": 2}))
+	require.NoError(t, cs.UpsertBatch([]map[string]any{{"id": "a", "val": 3}, {"id": "c", "val": 4}, {"id": "c", "val": 5}}))
+	require.NoError(t, cs.Append(map[string]any{"id": "b", "val": 6}))
+
+	latest := func(cs *ColumnarStore) []any {
+		rows, err := cs.Query(&Query{Select: []string{"id", "val"}})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return []any{row["id"], row["val"]} })
+	}
+	// Plain appends do not supersede rows.
+	assert.Equal(t, []any{[]any{"b", int64(2)}, []any{"a", int64(3)}, []any{"c", int64(5)}, []any{"b", int64(6)}}, latest(cs))
+	require.NoError(t, cs.Upsert(map[string]any{"id": "b", "val": 7}))
+	assert.Equal(t, []any{[]any{"a", int64(3)}, []any{"c", int64(5)}, []any{"b", int64(7)}}, latest(cs))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	require.NoError(t, cs.Upsert(map[string]any{"id": "c", "val": 8}))
+	assert.Equal(t, []any{[]any{"a", int64(3)}, []any{"b", int64(7)}, []any{"c", int64(8)}}, latest(cs))
+	assert.ErrorContains(t, cs.Upsert(map[string]any{"val": 9}), "no value for primary key id")
+}
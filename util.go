@@ -1,15 +1,28 @@
 package querystore
 
 import (
+	"bytes"
+	"cmp"
+	"errors"
 	"fmt"
 	"math"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
-func fileExists(path string) (bool, error) {
-	_, err := os.Stat(path)
+// ErrUnknownColumnType reports a column type this version does not know, such
+// as that of a column file written by a later version.
+var ErrUnknownColumnType = errors.New("unknown column type")
+
+// ErrUnsupportedValue reports a value that cannot be stored or compared, such
+// as one of a type with no column type, or one that does not match the type of
+// its column.
+var ErrUnsupportedValue = errors.New("unsupported value")
+
+func fileExists(b ColumnBackend, path string) (bool, error) {
+	_, err := b.Stat(path)
 	if err == nil {
 		return true, nil
 	}
@@ -19,7 +32,7 @@ func fileExists(path string) (bool, error) {
 	return false, err
 }
 
-// toUint64 converts an integer type value to uint64
+// toUint64 converts an integer type value to uint64, and other values to 0.
 func toUint64(val any) uint64 {
 	switch v := val.(type) {
 	case int:
@@ -43,11 +56,11 @@ func toUint64(val any) uint64 {
 	case uint64:
 		return v
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", val))
+		return 0
 	}
 }
 
-// toFloat64 converts an float type value to float64
+// toFloat64 converts an float type value to float64, and other values to 0.
 func toFloat64(val any) float64 {
 	switch v := val.(type) {
 	case float32:
@@ -55,7 +68,7 @@ func toFloat64(val any) float64 {
 	case float64:
 		return float64(v)
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", val))
+		return 0
 	}
 }
 
@@ -70,32 +83,96 @@ func biMap[K comparable, V comparable](m map[K]V) map[V]K {
 	return res
 }
 
+// castValueToColumnType converts a value to the type of the values of a
+// column. Values convertValue rejects convert to the zero value, and values
+// for JSON columns are returned as they are.
 func castValueToColumnType(v any, typ ColumnType) any {
 	switch typ {
 	case ColumnTypeBool:
 		return valueToBool(v)
 	case ColumnTypeString:
 		return valueToString(v)
-	case ColumnTypeInt64:
+	case ColumnTypeInt64, ColumnTypeInt32:
 		return valueToInt64(v)
+	case ColumnTypeUint64:
+		return valueToUint64(v)
 	case ColumnTypeFloat64:
 		return valueToFloat64(v)
+	case ColumnTypeTime:
+		return valueToTime(v)
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
+		return v
 	}
 }
 
+// convertValue is castValueToColumnType for values from callers, such as
+// those of filters, failing with ErrUnsupportedValue for values that cannot
+// be converted.
+func convertValue(v any, typ ColumnType) (any, error) {
+	ok := false
+	switch v.(type) {
+	case bool:
+		ok = typ != ColumnTypeTime
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, string:
+		ok = true
+	case float32, float64:
+		ok = typ != ColumnTypeTime
+	case time.Time:
+		ok = typ != ColumnTypeBool
+	}
+	if !ok || typ == ColumnTypeJSON {
+		return nil, fmt.Errorf("%w: cannot convert %T to %s", ErrUnsupportedValue, v, typ)
+	}
+	// Strings are parsed, rather than converting those that do not parse to
+	// the zero value.
+	if s, isString := v.(string); isString && typ != ColumnTypeString {
+		p, err := parseTextValue(s, typ)
+		if err != nil {
+			return nil, fmt.Errorf("%w: cannot convert %q to %s", ErrUnsupportedValue, s, typ)
+		}
+		v = p
+	}
+	return castValueToColumnType(v, typ), nil
+}
+
+// fractionalValue returns a float value that is not an integer, reporting
+// false for other values.
+func fractionalValue(v any) (float64, bool) {
+	switch v.(type) {
+	case float32, float64:
+		x := toFloat64(v)
+		return x, x != math.Trunc(x) && !math.IsNaN(x)
+	}
+	return 0, false
+}
+
+// supportedValue reports whether a value can be stored in a column.
+func supportedValue(v any) bool {
+	switch v.(type) {
+	case nil, bool, string, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, time.Time:
+		return true
+	}
+	return isJSONValue(v)
+}
+
 func valueColumnType(v any) ColumnType {
 	switch v.(type) {
 	case bool:
 		return ColumnTypeBool
 	case string:
 		return ColumnTypeString
-	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+	case uint, uint64:
+		return ColumnTypeUint64
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
 		return ColumnTypeInt64
 	case float32, float64:
 		return ColumnTypeFloat64
+	case time.Time:
+		return ColumnTypeTime
 	default:
+		if isJSONValue(v) {
+			return ColumnTypeJSON
+		}
 		return ColumnTypeString
 	}
 }
@@ -114,7 +191,7 @@ func valueToBool(v any) bool {
 		}
 		return false
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
+		return false
 	}
 }
 
@@ -131,6 +208,8 @@ func valueToInt64(v any) int64 {
 		return int64(toUint64(v))
 	case float32, float64:
 		return int64(math.Round(toFloat64(v)))
+	case time.Time:
+		return v.UnixNano()
 	case string:
 		i, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
@@ -138,7 +217,30 @@ func valueToInt64(v any) int64 {
 		}
 		return i
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
+		return 0
+	}
+}
+
+func valueToUint64(v any) uint64 {
+	switch v := v.(type) {
+	case uint64:
+		return v
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32:
+		return toUint64(v)
+	case string:
+		u, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return u
+	case float32, float64:
+		f := math.Round(toFloat64(v))
+		if f < 0 {
+			return 0
+		}
+		return uint64(f)
+	default:
+		return uint64(valueToInt64(v))
 	}
 }
 
@@ -149,12 +251,16 @@ func valueToFloat64(v any) float64 {
 			return 1
 		}
 		return 0
-	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+	case int, int8, int16, int32, int64:
+		return float64(valueToInt64(v))
+	case uint, uint8, uint16, uint32, uint64:
 		return float64(toUint64(v))
 	case float32:
 		return float64(v)
 	case float64:
 		return v
+	case time.Time:
+		return float64(v.UnixNano())
 	case string:
 		f, err := strconv.ParseFloat(v, 64)
 		if err != nil {
@@ -162,7 +268,7 @@ func valueToFloat64(v any) float64 {
 		}
 		return f
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
+		return 0
 	}
 }
 
@@ -175,15 +281,175 @@ func valueToString(v any) string {
 		return "false"
 	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
 		return fmt.Sprintf("%d", v)
-	case float32, float64:
-		return fmt.Sprintf("%f", v)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
 	case string:
 		return v
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
 	default:
-		panic(fmt.Sprintf("unsupported type: %T", v))
+		return ""
 	}
 }
 
+// valueFitsColumnType reports whether v can be stored in a column of type typ
+// without changing its value.
+func valueFitsColumnType(v any, typ ColumnType) bool {
+	if v == nil {
+		return true
+	}
+	vt := valueColumnType(v)
+	if vt != ColumnTypeInt64 && vt != ColumnTypeUint64 {
+		return vt == typ
+	}
+	switch typ {
+	case ColumnTypeInt64:
+		return vt == ColumnTypeInt64 || toUint64(v) <= math.MaxInt64
+	case ColumnTypeUint64:
+		return vt == ColumnTypeUint64 || valueToInt64(v) >= 0
+	case ColumnTypeInt32:
+		if vt == ColumnTypeUint64 {
+			return toUint64(v) <= math.MaxInt32
+		}
+		i := valueToInt64(v)
+		return i >= math.MinInt32 && i <= math.MaxInt32
+	}
+	return false
+}
+
+// valueToTime converts a value to a UTC time. Integers are taken as UnixNano
+// epochs and strings are parsed as RFC 3339.
+func valueToTime(v any) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return time.Unix(0, v.UnixNano()).UTC()
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return time.Unix(0, valueToInt64(v)).UTC()
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}
+		}
+		return valueToTime(t)
+	default:
+		return time.Time{}
+	}
+}
+
+// isVariableLength reports whether values of a column type are length-prefixed.
+func isVariableLength(typ ColumnType) bool {
+	return typ == ColumnTypeString || typ == ColumnTypeJSON
+}
+
 func makeColumnFileName(name string, typ ColumnType) string {
 	return name + "." + columnTypeToSuffix[typ] + "." + extension
 }
+
+// parseColumnFileName splits a column file name into the column name, type and
+// the format version implied by the name. Files without a version suffix are
+// version 1, or carry their actual version in their header.
+func parseColumnFileName(fileName string) (string, ColumnType, int, error) {
+	base := strings.TrimSuffix(fileName, "."+extension)
+	version := 1
+	if rest, suffix, ok := cutLast(base, "."); ok && len(suffix) > 1 && suffix[0] == 'v' {
+		if v, err := strconv.Atoi(suffix[1:]); err == nil {
+			base, version = rest, v
+		}
+	}
+	name, typeSuffix, ok := cutLast(base, ".")
+	if !ok {
+		return "", 0, 0, fmt.Errorf("invalid column file name: %s", fileName)
+	}
+	typ, ok := columnSuffixToType[typeSuffix]
+	if !ok {
+		return "", 0, 0, fmt.Errorf("%w %q in column file name: %s", ErrUnknownColumnType, typeSuffix, fileName)
+	}
+	if version < 1 || version > lastHeaderlessVersion {
+		return "", 0, 0, fmt.Errorf("unsupported format version %d for column file: %s", version, fileName)
+	}
+	return name, typ, version, nil
+}
+
+// compareValues orders two values, which are of the same type if decoded from
+// the same column. Values of different types, as the paths of JSON columns
+// may hold, are ordered by type, and JSON values by their encoding.
+func compareValues(a, b any) int {
+	switch a := a.(type) {
+	case bool:
+		if b, ok := b.(bool); ok {
+			if a == b {
+				return 0
+			}
+			if !a {
+				return -1
+			}
+			return 1
+		}
+	case int64:
+		if b, ok := b.(int64); ok {
+			return cmp.Compare(a, b)
+		}
+	case uint64:
+		if b, ok := b.(uint64); ok {
+			return cmp.Compare(a, b)
+		}
+	case float64:
+		if b, ok := b.(float64); ok {
+			return cmp.Compare(a, b)
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b)
+		}
+	}
+	if c := cmp.Compare(valueRank(a), valueRank(b)); c != 0 {
+		return c
+	}
+	return bytes.Compare(encodeJSONValue(a), encodeJSONValue(b))
+}
+
+// valueRank orders the types of values compared by compareValues.
+func valueRank(v any) int {
+	switch v.(type) {
+	case bool:
+		return 0
+	case int64:
+		return 1
+	case uint64:
+		return 2
+	case float64:
+		return 3
+	case string:
+		return 4
+	case time.Time:
+		return 5
+	}
+	return 6
+}
+
+// compareNullable is compareValues with nil ordered before any value.
+func compareNullable(a, b any) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	return compareValues(a, b)
+}
+
+// cutLast slices s around the last instance of sep.
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
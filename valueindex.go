@@ -0,0 +1,275 @@
+package querystore
+
+import (
+	"io"
+	"math"
+	"slices"
+	"time"
+)
+
+// Value indexes map each value of a column to the rows holding it, so that
+// equality and IN filters find their rows without scanning the column.
+// Columns named by Options.Indexes list the rows of each value, and those
+// named by Options.BitmapIndexes hold them in bitmaps. Indexes are held in
+// memory: they are built from the column on first use and kept current by
+// appends.
+
+// indexableType reports whether columns of a type can keep a value index.
+func indexableType(typ ColumnType) bool {
+	return typ != ColumnTypeJSON
+}
+
+// isIndexed reports whether a column keeps a value index.
+func (fs *ColumnFS) isIndexed(name string, typ ColumnType) bool {
+	return indexableType(typ) && (slices.Contains(fs.opts.Indexes, name) || name == fs.opts.PrimaryKey)
+}
+
+// hasBitmapIndex reports whether a column keeps a bitmap index.
+func (fs *ColumnFS) hasBitmapIndex(name string, typ ColumnType) bool {
+	return indexableType(typ) && slices.Contains(fs.opts.BitmapIndexes, name)
+}
+
+// indexKey returns the key of a value, cast to its column's type, in a value
+// index. Times are keyed by their UnixNano, as time.Time values with equal
+// instants may compare unequal.
+func indexKey(v any) any {
+	if t, ok := v.(time.Time); ok {
+		return t.UnixNano()
+	}
+	return v
+}
+
+// loadValueIndex builds the value indexes of a column by scanning it.
+func (ch *ColumnHandle) loadValueIndex() error {
+	if (!ch.indexed || ch.values != nil) && (!ch.bitmapped || ch.bitmaps != nil) {
+		return nil
+	}
+	values := map[any][]int64{}
+	if ch.size > ch.dataOffset {
+		cr, err := ch.createReaderAt(ch.dataOffset)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		for {
+			index, v, run, err := cr.readRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if v == nil {
+				continue
+			}
+			key := indexKey(castValueToColumnType(v, ch.typ))
+			for i := index; i < index+run; i++ {
+				values[key] = append(values[key], i)
+			}
+		}
+	}
+	if ch.indexed {
+		ch.values = values
+	}
+	if ch.bitmapped {
+		ch.bitmaps = map[any]*bitmap{}
+		ch.appendBitmaps(values)
+	}
+	return nil
+}
+
+// noteValue records a row of a pending write for the column's value index.
+func (p *pendingWrite) noteValue(index int64, v any) {
+	if !p.ch.indexed && !p.ch.bitmapped || v == nil {
+		return
+	}
+	if p.values == nil {
+		p.values = map[any][]int64{}
+	}
+	key := indexKey(castValueToColumnType(v, p.ch.typ))
+	p.values[key] = append(p.values[key], index)
+}
+
+// appendValues adds the rows of a committed write to the value indexes.
+func (ch *ColumnHandle) appendValues(p *pendingWrite) {
+	if ch.values != nil {
+		for key, rows := range p.values {
+			ch.values[key] = append(ch.values[key], rows...)
+		}
+	}
+	if ch.bitmaps != nil {
+		ch.appendBitmaps(p.values)
+	}
+}
+
+func (ch *ColumnHandle) appendBitmaps(values map[any][]int64) {
+	for key, rows := range values {
+		b := ch.bitmaps[key]
+		if b == nil {
+			b = &bitmap{}
+			ch.bitmaps[key] = b
+		}
+		for _, row := range rows {
+			b.add(row)
+		}
+	}
+}
+
+// lookupRows resolves an equality or IN filter to the rows it matches, using
+// the value index of its column if it has one. The caller must hold fs.lock,
+// as the index is shared with the column's handle.
+func (f *compiledFilter) lookupRows(cr *ColumnReader) {
+	if cr.bitmaps != nil {
+		f.lookupBitmap(cr)
+		return
+	}
+	if cr.values == nil {
+		return
+	}
+	switch f.Condition {
+	case ConditionEquals:
+		// Appends never modify the rows already listed.
+		f.rows = slices.Clip(cr.values[indexKey(f.value)])
+	case ConditionIn:
+		f.rows = nil
+		for v := range f.value.(valueSet) {
+			f.rows = append(f.rows, cr.values[indexKey(v)]...)
+		}
+		slices.Sort(f.rows)
+	default:
+		return
+	}
+	f.indexed = true
+}
+
+// lookupBitmap is lookupRows for columns with a bitmap index. Appends modify
+// bitmaps in place, so the filter keeps a snapshot.
+func (f *compiledFilter) lookupBitmap(cr *ColumnReader) {
+	bits := func(v any) *bitmap {
+		if b := cr.bitmaps[indexKey(v)]; b != nil {
+			return b
+		}
+		return &bitmap{}
+	}
+	switch f.Condition {
+	case ConditionEquals:
+		f.bits = bits(f.value).snapshot()
+	case ConditionIn:
+		f.bits = &bitmap{}
+		for v := range f.value.(valueSet) {
+			f.bits = orBitmaps(f.bits, bits(v))
+		}
+	default:
+		return
+	}
+	f.indexed = true
+}
+
+// nextRow returns the first row at or after i matched by an indexed filter,
+// or math.MaxInt64 if there is none.
+func (f *compiledFilter) nextRow(i int64) int64 {
+	if f.bits != nil {
+		return f.bits.next(i)
+	}
+	j, _ := slices.BinarySearch(f.rows, i)
+	if j == len(f.rows) {
+		return math.MaxInt64
+	}
+	return f.rows[j]
+}
+
+// countRows returns the number of rows in [start, end) matched by an indexed
+// filter.
+func (f *compiledFilter) countRows(start, end int64) int64 {
+	if f.bits != nil {
+		return f.bits.count(start, end)
+	}
+	i, _ := slices.BinarySearch(f.rows, start)
+	j, _ := slices.BinarySearch(f.rows, end)
+	return int64(j - i)
+}
+
+// candidateRows combines the bitmaps of a predicate's filters into the rows
+// it may match, returning the number of bitmaps combined. It returns nil if
+// the predicate can match rows outside the bitmaps.
+func candidateRows(p predicate) (*bitmap, int) {
+	switch p := p.(type) {
+	case *compiledFilter:
+		if p.bits != nil {
+			return p.bits, 1
+		}
+	case andPredicate:
+		var out *bitmap
+		var n int
+		for _, sub := range p {
+			if bits, m := candidateRows(sub); bits != nil {
+				if out == nil {
+					out = bits
+				} else {
+					out = andBitmaps(out, bits)
+				}
+				n += m
+			}
+		}
+		return out, n
+	case orPredicate:
+		out, n := &bitmap{}, 0
+		for _, sub := range p {
+			bits, m := candidateRows(sub)
+			if bits == nil {
+				return nil, 0
+			}
+			out, n = orBitmaps(out, bits), n+m
+		}
+		return out, n
+	}
+	return nil, 0
+}
+
+// restrictToBitmaps makes a cursor whose filters use several bitmaps check
+// their combination first, so rows it rules out are skipped without reading
+// any column.
+func (c *cursor) restrictToBitmaps() {
+	bits, n := candidateRows(c.pred)
+	if n < 2 {
+		return
+	}
+	c.pred = andPredicate{bitmapPredicate{bits}, c.pred}
+	if c.batch != nil {
+		c.batch = &batchCombination{
+			ps:   []batchPredicate{&batchBitmap{bits: bits, mask: make([]bool, batchSize)}, c.batch},
+			mask: make([]bool, batchSize),
+		}
+	}
+}
+
+// bitmapPredicate matches the rows of a bitmap.
+type bitmapPredicate struct {
+	bits *bitmap
+}
+
+func (p bitmapPredicate) eval(i int64, row map[string]any) (bool, error) {
+	return p.bits.contains(i), nil
+}
+
+func (p bitmapPredicate) nextCandidate(i int64) int64 {
+	return p.bits.next(i + 1)
+}
+
+// batchBitmap is bitmapPredicate for batches.
+type batchBitmap struct {
+	bits *bitmap
+	mask []bool
+}
+
+func (b *batchBitmap) evalBatch(start int64, n int) ([]bool, error) {
+	mask := b.mask[:n]
+	b.bits.fill(mask, start)
+	return mask, nil
+}
+
+func (b *batchBitmap) record(j int, row map[string]any) error { return nil }
+
+func (b *batchBitmap) lastMask() []bool { return b.mask }
+
+func (b *batchBitmap) nextCandidate(end int64) int64 { return b.bits.next(end) }
@@ -0,0 +1,85 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueIndexes(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 8
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	schema := &Schema{Columns: []ColumnSpec{
+		{Name: "val", Type: ColumnTypeInt64},
+		{Name: "name", Type: ColumnTypeString},
+		{Name: "flag", Type: ColumnTypeBool, Encoding: EncodingRLE},
+	}}
+	opts := Options{Schema: schema, Indexes: []string{"val", "flag"}}
+	fs, err := OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	var recs []map[string]any
+	for i := range 50 {
+		rec := map[string]any{"val": i % 7, "name": fmt.Sprintf("n%02d", i), "flag": i >= 45}
+		if i%5 == 0 {
+			delete(rec, "val")
+		}
+		require.NoError(t, cs.Append(rec))
+		recs = append(recs, rec)
+	}
+
+	check := func(cs *ColumnarStore) {
+		names := func(q *Query) []any {
+			q.Select = []string{"name"}
+			rows, err := cs.Query(q)
+			require.NoError(t, err)
+			return lo.Map(rows, func(row map[string]any, _ int) any { return row["name"] })
+		}
+		// Compare with the rows found by testing every record.
+		for _, tc := range []struct {
+			where *FilterExpression
+			match func(val any, flag bool, name string) bool
+		}{
+			{Where("val", ConditionEquals, 3), func(val any, _ bool, _ string) bool { return val == 3 }},
+			{Where("val", ConditionIn, []int{1, 6}), func(val any, _ bool, _ string) bool { return val == 1 || val == 6 }},
+			{And(Where("flag", ConditionEquals, true), Where("val", ConditionIn, []int{0, 2, 4})), func(val any, flag bool, _ string) bool {
+				return flag && (val == 0 || val == 2 || val == 4)
+			}},
+			{Or(Where("val", ConditionEquals, 9), Where("name", ConditionStartsWith, "n1")), func(_ any, _ bool, name string) bool { return strings.HasPrefix(name, "n1") }},
+		} {
+			var want []any
+			for _, rec := range recs {
+				if tc.match(rec["val"], rec["flag"].(bool), rec["name"].(string)) {
+					want = append(want, rec["name"])
+				}
+			}
+			assert.Equal(t, want, names(&Query{Where: tc.where}))
+		}
+		assert.Equal(t, []any{"n03", "n17", "n24", "n31", "n38"}, names(&Query{Where: Where("val", ConditionEquals, 3)}))
+		assert.Equal(t, []any{"n46", "n48"}, names(&Query{Where: And(Where("flag", ConditionEquals, true), Where("val", ConditionIn, []int{4, 6}))}))
+
+		p, err := cs.Plan(&Query{Where: Where("val", ConditionIn, []int{1, 6})})
+		require.NoError(t, err)
+		assert.True(t, p.Filters[0].Index)
+		assert.Equal(t, int64(12), p.EstimatedRows)
+	}
+	check(cs)
+	require.NoError(t, fs.Close())
+
+	// Indexes are rebuilt on open.
+	fs, err = OpenColumnFSWithOptions(dir, opts)
+	require.NoError(t, err)
+	defer fs.Close()
+	check(NewColumnarStore(fs))
+	assert.Len(t, fs.columnHandles["flag"].values[true], 5)
+	assert.Nil(t, fs.columnHandles["name"].values)
+}
@@ -0,0 +1,275 @@
+package querystore
+
+import (
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// VerifyProblem is a problem with a store's files found by Verify.
+type VerifyProblem struct {
+	File string
+	// Offset is the offset within the file of the problem, or -1 if it
+	// concerns the whole file.
+	Offset  int64
+	Message string
+}
+
+func (p VerifyProblem) String() string {
+	if p.Offset < 0 {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%s: offset %d: %s", p.File, p.Offset, p.Message)
+}
+
+// Verify checks the integrity of the store's files, returning the problems
+// found, sorted by file and offset. Every record of every column file is
+// read, checking that it is well framed, that row indexes increase, and that
+// no record is of a row missing from the index file. The entries of block
+// indexes must be at the records they name, and the blocks must match their
+// checksums. Missing block indexes and checksums are not problems, as they
+// are rebuilt on use. Stores opened with Options.ReadOnly are checked as they
+// are on disk, so their problems include the torn writes that opening the
+// store for writing would replay or truncate. Appends wait until it
+// completes. The error is set only if files cannot be read.
+func (fs *ColumnFS) Verify() ([]VerifyProblem, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	problems, err := fs.verifyWAL()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range fs.partitions {
+		if p.offloaded {
+			continue
+		}
+		found, err := p.fs.Verify()
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+	if fs.partitioning == PartitionNone {
+		for _, ch := range fs.columnHandles {
+			found, err := fs.verifyColumn(ch)
+			if err != nil {
+				return nil, err
+			}
+			problems = append(problems, found...)
+		}
+	}
+	slices.SortFunc(problems, func(a, b VerifyProblem) int {
+		if c := strings.Compare(a.File, b.File); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Offset, b.Offset)
+	})
+	return problems, nil
+}
+
+// verifyWAL reports a write left in the write-ahead log, which opening the
+// store for writing replays.
+func (fs *ColumnFS) verifyWAL() ([]VerifyProblem, error) {
+	walPath := path.Join(fs.dir, walFileName)
+	data, err := readFile(fs.backend, walPath)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return []VerifyProblem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if writes, ok := decodeWALEntry(data); ok {
+		return []VerifyProblem{{File: walPath, Offset: -1, Message: fmt.Sprintf("write to %d files not replayed", len(writes))}}, nil
+	}
+	return []VerifyProblem{{File: walPath, Offset: 0, Message: fmt.Sprintf("torn entry of %d bytes", len(data))}}, nil
+}
+
+// verifyColumn checks a column file, its block index and its checksums.
+// The caller must hold fs.lock.
+func (fs *ColumnFS) verifyColumn(ch *ColumnHandle) ([]VerifyProblem, error) {
+	var problems []VerifyProblem
+	report := func(file string, offset int64, format string, args ...any) {
+		problems = append(problems, VerifyProblem{File: file, Offset: offset, Message: fmt.Sprintf(format, args...)})
+	}
+	fi, err := ch.backend.Stat(ch.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	size := fi.Size()
+
+	blocks, err := fs.verifyBlockEntries(ch, size, report)
+	if err != nil {
+		return nil, err
+	}
+	// firstIndexes holds the index of the first record at the offset of each
+	// block entry, once read.
+	firstIndexes := map[int64]int64{}
+	for _, e := range blocks {
+		firstIndexes[e.offset] = -1
+	}
+
+	cr, err := ch.createReader()
+	if err != nil {
+		return nil, err
+	}
+	defer cr.Close()
+	isIndex := ch == fs.indexHandle
+	next := int64(0)
+	for {
+		offset := cr.position()
+		index, _, run, err := cr.readRecord()
+		if err == io.EOF {
+			if end := cr.position(); end < size {
+				report(ch.path, end, "truncated record of %d bytes at end of file", size-end)
+			}
+			break
+		}
+		if err != nil {
+			report(ch.path, offset, "malformed record: %v", err)
+			break
+		}
+		if first, ok := firstIndexes[offset]; ok && first < 0 {
+			firstIndexes[offset] = index
+		}
+		switch {
+		case isIndex && index != next:
+			report(ch.path, offset, "record of row %d where row %d is expected", index, next)
+		case index < next:
+			report(ch.path, offset, "record of row %d follows that of row %d", index, next-1)
+		case !isIndex && index+run > fs.nextID:
+			report(ch.path, offset, "record of row %d beyond the %d rows of the index file", index+run-1, fs.nextID)
+		}
+		next = max(next, index+run)
+	}
+
+	for i, e := range blocks {
+		if first := firstIndexes[e.offset]; first != e.firstIndex {
+			if first < 0 {
+				report(ch.blockIndexPath(), int64(16*i), "block %d at offset %d is not at a record", i, e.offset)
+			} else {
+				report(ch.blockIndexPath(), int64(16*i), "block %d starts at row %d, not %d", i, first, e.firstIndex)
+			}
+		}
+	}
+	if err := fs.verifyChecksums(ch, blocks, report); err != nil {
+		return nil, err
+	}
+	return problems, nil
+}
+
+// verifyBlockEntries reads a column's block index, reporting the first
+// malformed entry, and returns the entries before it.
+func (fs *ColumnFS) verifyBlockEntries(ch *ColumnHandle, size int64, report func(string, int64, string, ...any)) ([]blockEntry, error) {
+	data, err := readFile(ch.backend, ch.blockIndexPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var blocks []blockEntry
+	for i := 0; i+16 <= len(data); i += 16 {
+		e := blockEntry{
+			firstIndex: int64(binary.LittleEndian.Uint64(data[i:])),
+			offset:     int64(binary.LittleEndian.Uint64(data[i+8:])),
+		}
+		n := len(blocks)
+		switch {
+		case e.offset < ch.dataOffset || e.offset >= size:
+			report(ch.blockIndexPath(), int64(i), "block %d at offset %d is outside the column file", n, e.offset)
+		case n > 0 && (e.offset <= blocks[n-1].offset || e.firstIndex <= blocks[n-1].firstIndex):
+			report(ch.blockIndexPath(), int64(i), "block %d does not follow block %d", n, n-1)
+		default:
+			blocks = append(blocks, e)
+			continue
+		}
+		return blocks, nil
+	}
+	if rest := len(data) % 16; rest != 0 {
+		report(ch.blockIndexPath(), int64(len(data)-rest), "truncated entry of %d bytes", rest)
+	}
+	return blocks, nil
+}
+
+// verifyChecksums checks the blocks of a column against its checksum files.
+func (fs *ColumnFS) verifyChecksums(ch *ColumnHandle, blocks []blockEntry, report func(string, int64, string, ...any)) error {
+	if err := fs.verifyTail(ch, blocks, report); err != nil {
+		return err
+	}
+	data, err := readFile(ch.backend, ch.checksumPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rest := len(data) % 4; rest != 0 {
+		report(ch.checksumPath(), int64(len(data)-rest), "truncated checksum of %d bytes", rest)
+	}
+	fp, err := ch.backend.OpenFile(ch.path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var buf []byte
+	for i := 0; i+1 < len(blocks) && 4*i+4 <= len(data); i++ {
+		start, end := blocks[i].offset, blocks[i+1].offset
+		buf = slices.Grow(buf[:0], int(end-start))[:end-start]
+		if _, err := fp.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if crc32.Checksum(buf, crcTable) != binary.LittleEndian.Uint32(data[4*i:]) {
+			report(ch.path, start, "block %d: %v", i, ErrChecksumMismatch)
+		}
+	}
+	return nil
+}
+
+// verifyTail checks the open last block of a column against its tail
+// checksum file. A checksum ending before the end of the file covers the
+// start of the block.
+func (fs *ColumnFS) verifyTail(ch *ColumnHandle, blocks []blockEntry, report func(string, int64, string, ...any)) error {
+	data, err := readFile(ch.backend, ch.tailChecksumPath())
+	if os.IsNotExist(err) || len(blocks) == 0 {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t, ok := decodeBlockTail(data)
+	if !ok {
+		report(ch.tailChecksumPath(), -1, "malformed tail checksum of %d bytes", len(data))
+		return nil
+	}
+	i := len(blocks) - 1
+	if t.start != blocks[i].offset {
+		// Checksums of blocks since completed are in the checksum file.
+		return nil
+	}
+	fi, err := ch.backend.Stat(ch.path)
+	if err != nil {
+		return err
+	}
+	if t.end > fi.Size() {
+		report(ch.tailChecksumPath(), -1, "block %d ends at offset %d, past the end of the column file", i, t.end)
+		return nil
+	}
+	block, err := ch.readBlock(t.start, t.end)
+	if err != nil {
+		return err
+	}
+	if !t.matches(block, false) {
+		report(ch.path, t.start, "block %d: %v", i, ErrChecksumMismatch)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	for i := range 10 {
+		require.NoError(t, cs.Append(map[string]any{"n": int64(i), "s": fmt.Sprint("s", i)}))
+	}
+	problems, err := fs.Verify()
+	require.NoError(t, err)
+	assert.Empty(t, problems)
+
+	// Corrupt the last byte of the first block of n, and leave a torn record
+	// at its end and a torn entry in the block index of s.
+	ch := fs.columnHandles["n"]
+	require.NoError(t, ch.loadBlockIndex())
+	block := ch.blocks[1].offset
+	data, err := os.ReadFile(ch.path)
+	require.NoError(t, err)
+	data[block-1] ^= 0xff
+	require.NoError(t, os.WriteFile(ch.path, append(data, 1, 2, 3), 0o644))
+	idx, err := os.OpenFile(fs.columnHandles["s"].blockIndexPath(), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = idx.Write(make([]byte, 8))
+	require.NoError(t, err)
+	require.NoError(t, idx.Close())
+
+	problems, err = fs.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, []VerifyProblem{
+		{File: ch.path, Offset: ch.dataOffset, Message: "block 0: checksum mismatch"},
+		{File: ch.path, Offset: int64(len(data)), Message: "truncated record of 3 bytes at end of file"},
+		{File: fs.columnHandles["s"].blockIndexPath(), Offset: 48, Message: "truncated entry of 8 bytes"},
+	}, problems)
+	assert.Equal(t, fmt.Sprintf("%s: offset %d: block 0: checksum mismatch", ch.path, ch.dataOffset), problems[0].String())
+}
+
+func TestVerifyReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"v": int64(1)}, {"v": int64(2)}}))
+	ch := fs.columnHandles["v"]
+	require.NoError(t, fs.Close())
+
+	// Junk after the last record, and a write left in the log, are reported
+	// rather than repaired.
+	data, err := os.ReadFile(ch.path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(ch.path, append(data, make([]byte, 10)...), 0o644))
+	walPath := path.Join(dir, walFileName)
+	require.NoError(t, os.WriteFile(walPath, encodeWALEntry([]walWrite{{file: "v.int64.dat", offset: int64(len(data)), patchOffset: -1}}), 0o644))
+
+	fs, err = OpenColumnFSWithOptions(dir, Options{ReadOnly: true})
+	require.NoError(t, err)
+	defer fs.Close()
+	problems, err := fs.Verify()
+	require.NoError(t, err)
+	assert.Equal(t, []VerifyProblem{
+		{File: walPath, Offset: -1, Message: "write to 1 files not replayed"},
+		{File: ch.path, Offset: int64(len(data)), Message: "truncated record of 10 bytes at end of file"},
+	}, problems)
+	fi, err := os.Stat(ch.path)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)+10), fi.Size())
+}
@@ -0,0 +1,238 @@
+package querystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+// MaterializedView maintains the results of an aggregate query over a store
+// in a derived store as rows are appended, so readers query the derived store
+// instead of rescanning the rows, such as the count of requests by status
+// per minute.
+type MaterializedView struct {
+	src  *ColumnarStore
+	into *ColumnarStore
+	// scan reads the rows the view aggregates.
+	scan     *Query
+	aggs     []Aggregation
+	groupBy  []string
+	interval time.Duration
+
+	mu   sync.Mutex
+	next int64
+	// state holds the aggregates of the current bucket, which begins at
+	// bucket. Rows are appended in time order, so earlier buckets are final.
+	state  *aggregateState
+	bucket int64
+	dirty  map[any]bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Materialize registers a continuous query, maintaining its results in into
+// until the view is closed. The query must aggregate, and may filter and
+// group its rows; with a positive interval, rows are also bucketed by the
+// time they were appended, with the start of each bucket in TimeBucketColumn.
+//
+// into must be opened with a primary key, which the view fills with a key for
+// each bucket and group, and whose row for it is upserted whenever its
+// aggregates change. The view folds in every row of the store when it starts,
+// so rows deleted from the store are only left out of buckets still open
+// when a view is next materialized.
+func (s *ColumnarStore) Materialize(q *Query, interval time.Duration, into *ColumnarStore) (*MaterializedView, error) {
+	aggs := q.aggregations()
+	if len(aggs) == 0 {
+		return nil, errors.New("continuous queries must aggregate")
+	}
+	if _, err := newAggregateState(aggs, q.groupColumns()...); err != nil {
+		return nil, err
+	}
+	if len(q.OrderBy) > 0 || q.Limit > 0 || q.Offset > 0 {
+		return nil, errors.New("continuous queries cannot sort or limit their results")
+	}
+	if !q.TimeRange.IsZero() {
+		return nil, errors.New("continuous queries cover every row; bucket them by time with an interval")
+	}
+	if interval < 0 {
+		return nil, errors.New("negative interval")
+	}
+	if into == s || into.fs == s.fs {
+		return nil, errors.New("a view cannot be materialized into its own store")
+	}
+	key := into.fs.opts.PrimaryKey
+	if key == "" {
+		return nil, errors.New("the derived store of a view needs a primary key")
+	}
+	columns := q.groupColumns()
+	if interval > 0 {
+		columns = append(columns, TimeBucketColumn)
+	}
+	for _, a := range aggs {
+		columns = append(columns, a.Name())
+	}
+	seen := map[string]bool{key: true}
+	for _, col := range columns {
+		if seen[col] {
+			return nil, fmt.Errorf("view column %s is named more than once", col)
+		}
+		seen[col] = true
+	}
+
+	scan := &Query{Select: q.groupColumns(), Computed: q.Computed, Where: q.filterExpression(), ReuseRows: true}
+	for _, a := range aggs {
+		scan.Select = append(scan.Select, a.columns()...)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &MaterializedView{
+		src:      s,
+		into:     into,
+		scan:     scan,
+		aggs:     aggs,
+		groupBy:  q.groupColumns(),
+		interval: interval,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	v.reset(0)
+	go v.run(ctx)
+	return v, nil
+}
+
+// run refreshes the view whenever rows are appended, until ctx is done.
+func (v *MaterializedView) run(ctx context.Context) {
+	defer close(v.done)
+	for {
+		wait, _ := v.src.fs.appendSignal()
+		if err := v.Refresh(ctx); err != nil {
+			if ctx.Err() == nil {
+				v.err = err
+			}
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-wait:
+		}
+	}
+}
+
+// Refresh folds the rows appended since the last refresh into the view and
+// writes the aggregates that changed. Views refresh themselves as rows are
+// appended; Refresh brings one up to date before its derived store is read.
+// A refresh that fails leaves the view to be rebuilt from the first row.
+func (v *MaterializedView) Refresh(ctx context.Context) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	err := v.refresh(ctx)
+	if err != nil {
+		v.next = 0
+		v.reset(0)
+	}
+	return err
+}
+
+func (v *MaterializedView) refresh(ctx context.Context) error {
+	_, end := v.src.fs.appendSignal()
+	if v.next >= end {
+		return nil
+	}
+	it, err := v.src.queryFrom(ctx, v.scan, v.next)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	next := v.next
+	for it.Next() {
+		row := it.Row()
+		if row[IndexColumn].(int64) < v.next {
+			continue
+		}
+		next = row[IndexColumn].(int64) + 1
+		if b := v.bucketOf(row[TimestampColumn].(int64)); b != v.bucket {
+			if err := v.flush(); err != nil {
+				return err
+			}
+			v.reset(b)
+		}
+		v.state.add(row)
+		v.dirty[v.state.rowKey(row)] = true
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	if err := v.flush(); err != nil {
+		return err
+	}
+	// Rows up to end that did not match were scanned too.
+	v.next = max(next, end)
+	return nil
+}
+
+func (v *MaterializedView) bucketOf(ts int64) int64 {
+	if v.interval <= 0 {
+		return 0
+	}
+	return ts - ts%int64(v.interval)
+}
+
+// reset starts a new bucket.
+func (v *MaterializedView) reset(bucket int64) {
+	v.state, _ = newAggregateState(v.aggs, v.groupBy...)
+	v.bucket = bucket
+	v.dirty = map[any]bool{}
+}
+
+// flush upserts the rows of the groups of the current bucket that changed.
+func (v *MaterializedView) flush() error {
+	if len(v.dirty) == 0 {
+		return nil
+	}
+	var rows []map[string]any
+	for _, row := range v.state.results() {
+		if !v.dirty[v.state.rowKey(row)] {
+			continue
+		}
+		// Keys join the bucket and the values of the group, which is nil
+		// for ungrouped views.
+		group := []any{nil}
+		if len(v.groupBy) > 0 {
+			group = lo.Map(v.groupBy, func(col string, _ int) any { return row[col] })
+		}
+		key := fmt.Sprint(v.bucket)
+		for _, value := range group {
+			key += fmt.Sprintf("/%v", value)
+		}
+		for col, value := range row {
+			if value == nil {
+				delete(row, col)
+			}
+		}
+		if v.interval > 0 {
+			row[TimeBucketColumn] = time.Unix(0, v.bucket).UTC()
+		}
+		row[v.into.fs.opts.PrimaryKey] = key
+		rows = append(rows, row)
+	}
+	if err := v.into.UpsertBatch(rows); err != nil {
+		return err
+	}
+	clear(v.dirty)
+	return nil
+}
+
+// Close stops maintaining the view, returning the error that stopped it
+// earlier, if any.
+func (v *MaterializedView) Close() error {
+	v.cancel()
+	<-v.done
+	return v.err
+}
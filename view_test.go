@@ -0,0 +1,70 @@
+package querystore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaterializedView(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+	fs, err := OpenColumnFSWithOptions(t.TempDir(), Options{Clock: func() time.Time { return now }})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs := NewColumnarStore(fs)
+	into, err := OpenColumnFSWithOptions(t.TempDir(), Options{PrimaryKey: "key"})
+	require.NoError(t, err)
+	defer into.Close()
+	derived := NewColumnarStore(into)
+
+	require.NoError(t, cs.AppendBatch([]map[string]any{
+		{"status": int64(200), "latency": 1.0},
+		{"status": int64(500), "latency": 3.0},
+		{"status": int64(200), "latency": 2.0, "bot": true},
+	}))
+	q := &Query{
+		Where:        Where("bot", ConditionIsNull, nil),
+		GroupBy:      "status",
+		Aggregations: []Aggregation{{Type: AggregatorCount}, {Type: AggregatorAvg, Attribute: "latency", Alias: "latency"}},
+	}
+	view, err := cs.Materialize(q, time.Minute, derived)
+	require.NoError(t, err)
+	defer view.Close()
+
+	now = now.Add(time.Minute)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"status": int64(200), "latency": 4.0}}))
+	ctx := context.Background()
+	require.NoError(t, view.Refresh(ctx))
+	now = now.Add(10 * time.Second)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"status": int64(200), "latency": 6.0}, {"status": int64(404), "latency": 1.0}}))
+	require.NoError(t, view.Refresh(ctx))
+
+	rows, err := derived.Query(&Query{Select: []string{TimeBucketColumn, "status", "count", "latency"}, OrderBy: []Order{{Attribute: TimeBucketColumn}, {Attribute: "status"}}})
+	require.NoError(t, err)
+	got := lo.Map(rows, func(row map[string]any, _ int) []any {
+		return []any{row[TimeBucketColumn].(time.Time).Minute(), row["status"], row["count"], row["latency"]}
+	})
+	assert.Equal(t, [][]any{
+		{0, int64(200), int64(1), 1.0},
+		{0, int64(500), int64(1), 3.0},
+		{1, int64(200), int64(2), 5.0},
+		{1, int64(404), int64(1), 1.0},
+	}, got)
+
+	// The view keeps up with appends on its own.
+	require.NoError(t, cs.Append(map[string]any{"status": int64(404), "latency": 3.0}))
+	assert.Eventually(t, func() bool {
+		rows, err := derived.Query(&Query{Select: []string{"latency"}, Where: Where("status", ConditionEquals, int64(404))})
+		return err == nil && len(rows) == 1 && rows[0]["latency"] == 2.0
+	}, time.Second, time.Millisecond)
+	require.NoError(t, view.Close())
+
+	_, err = cs.Materialize(q, time.Minute, cs)
+	assert.ErrorContains(t, err, "its own store")
+	_, err = cs.Materialize(&Query{GroupBy: "status"}, 0, derived)
+	assert.ErrorContains(t, err, "must aggregate")
+}
@@ -0,0 +1,195 @@
+package querystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// The write-ahead log holds the file writes of the row write in progress. It
+// is written before any column file is touched and cleared once every file
+// has been written, so on open a non-empty log identifies a write that may be
+// torn. Replaying it truncates each file back to its size before the write and
+// redoes the write, which is safe whether or not the write reached the file.
+// A log entry that was itself torn is discarded, since no file was touched.
+//
+// An entry is:
+//
+//	magic [4]byte | payload length uint32 | payload CRC-32 uint32 | payload
+//
+// and its payload holds, for each file:
+//
+//	name length uint16 | name | offset int64 | data length uint32 | data |
+//	patch offset int64 | patch uint32
+//
+// where the optional patch updates the length of a run-length encoded run.
+const walFileName = "__wal.log"
+
+var walMagic = [4]byte{'Q', 'S', 'W', 'L'}
+
+// walWrite is a write of data to a file at offset.
+type walWrite struct {
+	file        string
+	offset      int64
+	data        []byte
+	patchOffset int64
+	patch       uint32
+}
+
+func encodeWALEntry(writes []walWrite) []byte {
+	var payload []byte
+	payload = binary.LittleEndian.AppendUint32(payload, uint32(len(writes)))
+	for _, w := range writes {
+		payload = binary.LittleEndian.AppendUint16(payload, uint16(len(w.file)))
+		payload = append(payload, w.file...)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(w.offset))
+		payload = binary.LittleEndian.AppendUint32(payload, uint32(len(w.data)))
+		payload = append(payload, w.data...)
+		payload = binary.LittleEndian.AppendUint64(payload, uint64(w.patchOffset))
+		payload = binary.LittleEndian.AppendUint32(payload, w.patch)
+	}
+	entry := make([]byte, 12, 12+len(payload))
+	copy(entry, walMagic[:])
+	binary.LittleEndian.PutUint32(entry[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(entry[8:12], crc32.ChecksumIEEE(payload))
+	return append(entry, payload...)
+}
+
+// decodeWALEntry decodes a log entry, reporting false if there is no complete
+// entry.
+func decodeWALEntry(b []byte) ([]walWrite, bool) {
+	if len(b) < 12 || !bytes.Equal(b[:4], walMagic[:]) {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint32(b[4:8]))
+	if len(b) < 12+n || crc32.ChecksumIEEE(b[12:12+n]) != binary.LittleEndian.Uint32(b[8:12]) {
+		return nil, false
+	}
+	p := b[12 : 12+n]
+	// The checksum guards against torn entries, so the payload is well formed.
+	count := binary.LittleEndian.Uint32(p)
+	p = p[4:]
+	writes := make([]walWrite, count)
+	for i := range writes {
+		w := &writes[i]
+		nameLen := int(binary.LittleEndian.Uint16(p))
+		w.file, p = string(p[2:2+nameLen]), p[2+nameLen:]
+		w.offset = int64(binary.LittleEndian.Uint64(p))
+		dataLen := int(binary.LittleEndian.Uint32(p[8:]))
+		w.data, p = p[12:12+dataLen], p[12+dataLen:]
+		w.patchOffset = int64(binary.LittleEndian.Uint64(p))
+		w.patch, p = binary.LittleEndian.Uint32(p[8:]), p[12:]
+	}
+	return writes, true
+}
+
+// replayWAL completes the write recorded in the log of a store directory, if
+// any, and clears the log.
+func replayWAL(b ColumnBackend, dir string) error {
+	walPath := path.Join(dir, walFileName)
+	data, err := readFile(b, walPath)
+	if os.IsNotExist(err) || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if writes, ok := decodeWALEntry(data); ok {
+		for _, w := range writes {
+			if err := w.apply(b, dir); err != nil {
+				return fmt.Errorf("replaying write-ahead log: %w", err)
+			}
+		}
+	}
+	return truncateFile(b, walPath, 0)
+}
+
+func (w walWrite) apply(b ColumnBackend, dir string) error {
+	if w.file != filepath.Base(w.file) {
+		return fmt.Errorf("invalid file name %q", w.file)
+	}
+	fp, err := b.OpenFile(path.Join(dir, w.file), os.O_WRONLY|os.O_CREATE, filePerm)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Truncate(w.offset); err != nil {
+		return err
+	}
+	if _, err := fp.WriteAt(w.data, w.offset); err != nil {
+		return err
+	}
+	if w.patchOffset >= 0 {
+		if _, err := fp.WriteAt(binary.LittleEndian.AppendUint32(nil, w.patch), w.patchOffset); err != nil {
+			return err
+		}
+	}
+	return fp.Sync()
+}
+
+// walWrite returns the file write a pending write will make.
+func (p *pendingWrite) walWrite() walWrite {
+	ch := p.ch
+	w := walWrite{file: filepath.Base(ch.path), offset: ch.size, data: p.data, patchOffset: -1}
+	if ch.size == 0 && ch.version >= formatVersion {
+		w.data = append(ch.header().encode(), p.data...)
+	}
+	if p.patch != nil {
+		w.patchOffset, w.patch = p.patch.countOffset, uint32(p.patch.end-p.patch.start)
+	}
+	return w
+}
+
+// logWrite records pending writes in the write-ahead log.
+func (fs *ColumnFS) logWrite(writes []*pendingWrite) error {
+	if fs.walFp == nil {
+		fp, err := fs.backend.OpenFile(path.Join(fs.dir, walFileName), os.O_RDWR|os.O_CREATE, filePerm)
+		if err != nil {
+			return err
+		}
+		fs.walFp = fp
+	}
+	ws := make([]walWrite, len(writes))
+	for i, p := range writes {
+		ws[i] = p.walWrite()
+	}
+	entry := encodeWALEntry(ws)
+	if _, err := fs.walFp.WriteAt(entry, 0); err != nil {
+		return err
+	}
+	if err := fs.walFp.Truncate(int64(len(entry))); err != nil {
+		return err
+	}
+	if fs.opts.Durability == DurabilityEveryWrite {
+		return fs.walFp.Sync()
+	}
+	return nil
+}
+
+// ErrStoreFailed is returned by writes to a store after a write failed and
+// could not be rolled back. The write-ahead log then holds the only record
+// of the files' state, so the store refuses writes that would replace it or
+// rewrite the files until it is reopened, which completes the write.
+var ErrStoreFailed = errors.New("store failed to roll back a write and must be reopened")
+
+// rollback undoes the writes of a failed row write, then clears the log. If
+// rolling back fails the log is kept, and the store fails until reopened.
+func (fs *ColumnFS) rollback(writes []*pendingWrite, cause error) error {
+	for _, p := range writes {
+		if err := p.rollback(); err != nil {
+			fs.failed = true
+			return errors.Join(cause, fmt.Errorf("rolling back write to %s: %w", p.ch.path, err), ErrStoreFailed)
+		}
+	}
+	return errors.Join(cause, fs.clearWAL())
+}
+
+// clearWAL empties the log once a write has reached every file.
+func (fs *ColumnFS) clearWAL() error {
+	return fs.walFp.Truncate(0)
+}
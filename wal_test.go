@@ -0,0 +1,169 @@
+package querystore
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 1}, {"val": 2}}))
+	indexPath, valPath := fs.indexHandle.path, fs.columnHandles["val"].path
+	indexSize, valSize := lo.Must(os.Stat(indexPath)).Size(), lo.Must(os.Stat(valPath)).Size()
+	require.NoError(t, cs.Append(map[string]any{"val": 3}))
+	require.NoError(t, fs.Close())
+
+	// Rebuild the log entry of the last write, then tear the write: the
+	// index file has it, the column file only has part of it.
+	indexData, valData := lo.Must(os.ReadFile(indexPath)), lo.Must(os.ReadFile(valPath))
+	entry := encodeWALEntry([]walWrite{
+		{file: path.Base(indexPath), offset: indexSize, data: indexData[indexSize:], patchOffset: -1},
+		{file: path.Base(valPath), offset: valSize, data: valData[valSize:], patchOffset: -1},
+	})
+	require.NoError(t, os.Truncate(valPath, valSize+5))
+	walPath := path.Join(dir, walFileName)
+	require.NoError(t, os.WriteFile(walPath, entry, filePerm))
+
+	vals := func() []any {
+		fs, err := OpenColumnFS(dir)
+		require.NoError(t, err)
+		defer fs.Close()
+		rows, err := NewColumnarStore(fs).Query(&Query{Select: []string{"val"}})
+		require.NoError(t, err)
+		return lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] })
+	}
+	assert.Equal(t, []any{int64(1), int64(2), int64(3)}, vals())
+	assert.Equal(t, int64(0), lo.Must(os.Stat(walPath)).Size())
+	assert.Equal(t, valData, lo.Must(os.ReadFile(valPath)))
+
+	// A torn log entry is discarded.
+	require.NoError(t, os.WriteFile(walPath, entry[:len(entry)-1], filePerm))
+	assert.Equal(t, []any{int64(1), int64(2), int64(3)}, vals())
+	assert.Equal(t, int64(0), lo.Must(os.Stat(walPath)).Size())
+}
+
+func TestWriteRollback(t *testing.T) {
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"val": 1}))
+	sizes := func() []int64 {
+		return lo.Map([]string{fs.indexHandle.path, fs.columnHandles["val"].path}, func(p string, _ int) int64 {
+			return lo.Must(os.Stat(p)).Size()
+		})
+	}
+	before := sizes()
+
+	// A directory in the way of a new column's file fails its write.
+	badPath := path.Join(dir, makeColumnFileName("bad", ColumnTypeInt64))
+	require.NoError(t, os.Mkdir(badPath, 0755))
+	assert.Error(t, cs.AppendBatch([]map[string]any{{"val": 2}, {"val": 3, "bad": 1}}))
+	assert.Equal(t, before, sizes())
+	assert.NotContains(t, fs.columnHandles, "bad")
+	assert.Equal(t, int64(1), fs.nextID)
+
+	require.NoError(t, os.Remove(badPath))
+	require.NoError(t, cs.AppendBatch([]map[string]any{{"val": 4}, {"val": 5, "bad": 1}}))
+	require.NoError(t, fs.Close())
+
+	fs, err = OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	rows, err := NewColumnarStore(fs).Query(&Query{Select: []string{"val", "bad"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(1), int64(4), int64(5)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+	assert.Equal(t, int64(1), rows[2]["bad"])
+}
+
+// failingBackend fails writes to files whose names contain *fail, if set.
+type failingBackend struct {
+	ColumnBackend
+	fail *string
+}
+
+func (b failingBackend) OpenFile(name string, flag int, perm os.FileMode) (BackendFile, error) {
+	fp, err := b.ColumnBackend.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return failingFile{BackendFile: fp, fail: b.fail}, nil
+}
+
+type failingFile struct {
+	BackendFile
+	fail *string
+}
+
+func (f failingFile) check() error {
+	if *f.fail != "" && strings.Contains(f.Name(), *f.fail) {
+		return errors.New("injected failure")
+	}
+	return nil
+}
+
+func (f failingFile) Write(b []byte) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.BackendFile.Write(b)
+}
+
+func (f failingFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+	return f.BackendFile.WriteAt(b, off)
+}
+
+func (f failingFile) Truncate(size int64) error {
+	if err := f.check(); err != nil {
+		return err
+	}
+	return f.BackendFile.Truncate(size)
+}
+
+func TestFailedRollback(t *testing.T) {
+	var fail string
+	backend := failingBackend{ColumnBackend: NewMemoryBackend(), fail: &fail}
+	fs, err := OpenColumnFSWithOptions("/db", Options{Backend: backend})
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"val": 1}))
+
+	// A write that cannot be rolled back fails the store, keeping its log
+	// entry.
+	fail = "val."
+	assert.ErrorIs(t, cs.Append(map[string]any{"val": 2}), ErrStoreFailed)
+	fail = ""
+	assert.ErrorIs(t, cs.Append(map[string]any{"val": 3}), ErrStoreFailed)
+	assert.ErrorIs(t, cs.Compact(), ErrStoreFailed)
+	wal, err := readFile(backend, path.Join("/db", walFileName))
+	require.NoError(t, err)
+	assert.NotEmpty(t, wal)
+	require.NoError(t, fs.Close())
+
+	// Reopening completes the write.
+	fs, err = OpenColumnFSWithOptions("/db", Options{Backend: backend})
+	require.NoError(t, err)
+	defer fs.Close()
+	cs = NewColumnarStore(fs)
+	require.NoError(t, cs.Append(map[string]any{"val": 4}))
+	rows, err := cs.Query(&Query{Select: []string{"val"}})
+	require.NoError(t, err)
+	assert.Equal(t, []any{int64(1), int64(2), int64(4)}, lo.Map(rows, func(row map[string]any, _ int) any { return row["val"] }))
+}
@@ -0,0 +1,194 @@
+package querystore
+
+import (
+	"encoding/binary"
+	"os"
+)
+
+// pendingWrite accumulates encoded records for a column until they are
+// written together.
+type pendingWrite struct {
+	ch     *ColumnHandle
+	buf    []byte
+	stats  *columnStats
+	blocks []blockEntry
+	// zones holds the zone of the block open before the write, if any,
+	// followed by those of the blocks started by it.
+	zones []zone
+	fill  int64
+	base  int64
+	// run is the last run of a run-length encoded column, and patch the run
+	// already in the file whose length the write extends, if any.
+	run   *rleRun
+	patch *rleRun
+	// data holds the bytes to append to the file once prepared, at offset.
+	// dataOffset and lastRun are the handle's state before the write, for
+	// rolling it back.
+	data       []byte
+	offset     int64
+	dataOffset int64
+	lastRun    *rleRun
+	// started is set once the file has been opened for the write.
+	started bool
+	// values holds the rows written with each value, for the value index.
+	values map[any][]int64
+	// blooms holds the bloom filters of the blocks written to, starting with
+	// a copy of the open block's if replacesOpen is set.
+	blooms       []*bloomFilter
+	replacesOpen bool
+	// sketches holds the distinct sketches of the blocks written to, like
+	// blooms.
+	sketches           []*hllSketch
+	replacesOpenSketch bool
+}
+
+func (ch *ColumnHandle) newPendingWrite() (*pendingWrite, error) {
+	if err := ch.loadBlockIndex(); err != nil {
+		return nil, err
+	}
+	p := &pendingWrite{ch: ch, stats: newColumnStats(), fill: ch.blockFill, base: ch.dataEnd()}
+	if len(ch.zones) > 0 {
+		p.zones = []zone{ch.zones[len(ch.zones)-1]}
+	}
+	if ch.lastRun != nil && ch.codec == nil {
+		run := *ch.lastRun
+		p.run = &run
+	}
+	return p, nil
+}
+
+func (p *pendingWrite) add(index int64, v any) error {
+	if p.ch.rle() {
+		return p.addRun(index, v)
+	}
+	offset := p.recordOffset()
+	buf, err := p.ch.appendRecord(p.buf, index, v)
+	if err != nil {
+		return err
+	}
+	p.noteRecord(index, v, offset)
+	p.noteValue(index, v)
+	p.buf = buf
+	p.stats.add(index)
+	return nil
+}
+
+// recordOffset returns the offset of the next record, or of the frame that
+// will hold it in compressed files.
+func (p *pendingWrite) recordOffset() int64 {
+	if p.ch.codec != nil {
+		return p.base
+	}
+	return p.base + int64(len(p.buf))
+}
+
+// noteRecord updates the block index and zone map for a record. Blocks of
+// compressed files start at frame boundaries.
+func (p *pendingWrite) noteRecord(index int64, v any, offset int64) {
+	lastOffset := int64(-1)
+	if n := len(p.blocks); n > 0 {
+		lastOffset = p.blocks[n-1].offset
+	} else if n := len(p.ch.blocks); n > 0 {
+		lastOffset = p.ch.blocks[n-1].offset
+	}
+	started := false
+	if p.fill >= blockIndexInterval && offset > lastOffset {
+		p.blocks = append(p.blocks, blockEntry{firstIndex: index, offset: offset})
+		p.zones = append(p.zones, zone{})
+		p.fill = 0
+		started = true
+	}
+	p.fill++
+	if p.ch.zoned() && v != nil {
+		p.zones[len(p.zones)-1].add(castValueToColumnType(v, p.ch.typ))
+	}
+	p.noteBloom(v, started)
+	p.noteSketch(v, started)
+}
+
+// prepare encodes the pending records into the bytes to append to the file.
+func (p *pendingWrite) prepare() error {
+	if err := p.flushRun(); err != nil {
+		return err
+	}
+	p.offset, p.dataOffset, p.lastRun = p.ch.size, p.ch.dataOffset, p.ch.lastRun
+	p.data = p.buf
+	if p.ch.codec != nil {
+		var err error
+		if p.data, err = encodeFrame(p.ch.codec, p.buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commit writes the pending records and updates the column's metadata.
+func (p *pendingWrite) commit() error {
+	ch := p.ch
+	if p.data == nil {
+		if err := p.prepare(); err != nil {
+			return err
+		}
+	}
+	data := p.data
+	err := ch.Write(data)
+	p.started = ch.writeFp != nil
+	if err != nil {
+		return err
+	}
+	if p.patch != nil {
+		if err := ch.patchRun(p.patch); err != nil {
+			return err
+		}
+	}
+	ch.lastRun = p.run
+	ch.noteAppend(p.stats, int64(len(data)))
+	ch.blockFill = p.fill
+	if err := ch.appendBlockEntries(p.blocks); err != nil {
+		return err
+	}
+	if err := ch.appendZones(p); err != nil {
+		return err
+	}
+	if err := ch.appendBlooms(p); err != nil {
+		return err
+	}
+	if err := ch.appendSketches(p); err != nil {
+		return err
+	}
+	ch.appendValues(p)
+	return ch.appendChecksums(data, p.patch)
+}
+
+// rollback undoes a write that was committed, or may have been partly
+// written, by truncating the file to its size before the write. Metadata
+// derived from the file is reloaded on next use.
+func (p *pendingWrite) rollback() error {
+	ch := p.ch
+	if !p.started {
+		return nil
+	}
+	if err := ch.Close(); err != nil {
+		return err
+	}
+	fp, err := ch.backend.OpenFile(ch.path, os.O_WRONLY, filePerm)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Truncate(p.offset); err != nil {
+		return err
+	}
+	if p.patch != nil {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(p.lastRun.end-p.lastRun.start))
+		if _, err := fp.WriteAt(b[:], p.patch.countOffset); err != nil {
+			return err
+		}
+	}
+	ch.dataOffset, ch.size, ch.stats = p.dataOffset, 0, nil
+	return ch.resetBlockIndex()
+}
@@ -0,0 +1,235 @@
+package querystore
+
+import (
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+)
+
+// zoneMapExt is appended to a column file's path to name its zone map, which
+// holds the minimum and maximum value of every completed block. Each zone is
+// stored as two records in the column's encoding, indexed by the first row of
+// the block; blocks without values have null records.
+const zoneMapExt = ".zone"
+
+// zone holds the range of values in a block. min and max are nil if the block
+// has no values.
+type zone struct {
+	min, max any
+}
+
+func (z *zone) add(v any) {
+	if v == nil {
+		return
+	}
+	if z.min == nil || compareValues(v, z.min) < 0 {
+		z.min = v
+	}
+	if z.max == nil || compareValues(v, z.max) > 0 {
+		z.max = v
+	}
+}
+
+// hasZoneMap reports whether blocks of a column type keep zone maps.
+func hasZoneMap(typ ColumnType) bool {
+	switch typ {
+	case ColumnTypeInt64, ColumnTypeInt32, ColumnTypeUint64, ColumnTypeFloat64, ColumnTypeString, ColumnTypeTime:
+		return true
+	}
+	return false
+}
+
+// zoned reports whether a column keeps a zone map. Encrypted columns do not,
+// as their zones would reveal their values.
+func (ch *ColumnHandle) zoned() bool {
+	return hasZoneMap(ch.typ) && !ch.encrypted()
+}
+
+func (ch *ColumnHandle) zoneMapPath() string {
+	return ch.path + zoneMapExt
+}
+
+// loadZones loads the zone map of a column whose block index is loaded,
+// computing zones missing from the zone map file by scanning their blocks.
+func (ch *ColumnHandle) loadZones() error {
+	if !ch.zoned() {
+		return nil
+	}
+	data, err := readFile(ch.backend, ch.zoneMapPath())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var zones []zone
+	for len(zones) < len(ch.blocks)-1 {
+		index, min, n, err := decodeRecord(ch.typ, ch.version, data)
+		if err != nil {
+			break
+		}
+		maxIndex, max, m, err := decodeRecord(ch.typ, ch.version, data[n:])
+		if err != nil || index != ch.blocks[len(zones)].firstIndex || maxIndex != index {
+			break
+		}
+		zones = append(zones, zone{min: min, max: max})
+		data = data[n+m:]
+	}
+	stale := len(data) > 0
+
+	if len(zones) < len(ch.blocks) {
+		cr, err := ch.createReaderAt(ch.blocks[len(zones)].offset)
+		if err != nil {
+			return err
+		}
+		defer cr.Close()
+		zones = append(zones, zone{})
+		for {
+			index, v, _, err := cr.readRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if len(zones) < len(ch.blocks) && index >= ch.blocks[len(zones)].firstIndex {
+				zones = append(zones, zone{})
+				stale = true
+			}
+			zones[len(zones)-1].add(v)
+		}
+	}
+
+	if stale && !ch.readOnly {
+		var buf []byte
+		for i, z := range zones[:len(zones)-1] {
+			if buf, err = ch.appendZone(buf, ch.blocks[i].firstIndex, z); err != nil {
+				return err
+			}
+		}
+		if err := writeFile(ch.backend, ch.zoneMapPath(), buf); err != nil {
+			return err
+		}
+	}
+	ch.zones = zones
+	return nil
+}
+
+func (ch *ColumnHandle) appendZone(dst []byte, firstIndex int64, z zone) ([]byte, error) {
+	dst, err := ch.appendRecord(dst, firstIndex, z.min)
+	if err != nil {
+		return nil, err
+	}
+	return ch.appendRecord(dst, firstIndex, z.max)
+}
+
+// appendZones records the zones of blocks written by p. The zone of the block
+// that was open before the write is updated, and the zones of blocks completed
+// by the write are appended to the zone map file.
+func (ch *ColumnHandle) appendZones(p *pendingWrite) error {
+	if !ch.zoned() || len(p.zones) == 0 {
+		return nil
+	}
+	zones := p.zones
+	if len(ch.zones) > 0 {
+		ch.zones[len(ch.zones)-1] = zones[0]
+		zones = zones[1:]
+	}
+	completed := len(ch.zones) - 1
+	ch.zones = append(ch.zones, zones...)
+	var buf []byte
+	var err error
+	for i := max(completed, 0); i < len(ch.zones)-1; i++ {
+		if buf, err = ch.appendZone(buf, ch.blocks[i].firstIndex, ch.zones[i]); err != nil {
+			return err
+		}
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if ch.zoneFp == nil {
+		if ch.zoneFp, err = ch.backend.OpenFile(ch.zoneMapPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, filePerm); err != nil {
+			return err
+		}
+	}
+	_, err = ch.zoneFp.Write(buf)
+	return err
+}
+
+// zoneSnapshot returns a copy of the zones of a column for a reader.
+func (ch *ColumnHandle) zoneSnapshot() []zone {
+	return slices.Clone(ch.zones)
+}
+
+// skipBlocks returns the first row at or after from that lies in a block that
+// may match, along with the end of that block. Rows before the first block
+// may always match.
+func (cr *ColumnReader) skipBlocks(from int64, mayMatch func(b int) bool) (int64, int64) {
+	b := sort.Search(len(cr.blocks), func(i int) bool { return cr.blocks[i].firstIndex > from }) - 1
+	if b < 0 {
+		if len(cr.blocks) == 0 {
+			return from, math.MaxInt64
+		}
+		return from, cr.blocks[0].firstIndex
+	}
+	for ; b < len(cr.blocks) && !mayMatch(b); b++ {
+		if b+1 == len(cr.blocks) {
+			return math.MaxInt64, math.MaxInt64
+		}
+		from = cr.blocks[b+1].firstIndex
+	}
+	if b+1 < len(cr.blocks) {
+		return from, cr.blocks[b+1].firstIndex
+	}
+	return from, math.MaxInt64
+}
+
+// blockMayMatch reports whether block b of a filter's column may hold a value
+// passing the filter, judging by its zone and bloom filter, if any.
+func (f *compiledFilter) blockMayMatch(b int) bool {
+	cr := f.reader.(*ColumnReader)
+	if b < len(cr.zones) && !f.zoneMayMatch(cr.zones[b]) {
+		return false
+	}
+	return b >= len(cr.blooms) || f.bloomMayMatch(cr.blooms[b])
+}
+
+// zoneMayMatch reports whether a block with the given zone may hold a value
+// passing the filter.
+func (f *compiledFilter) zoneMayMatch(z zone) bool {
+	if z.min == nil {
+		return false
+	}
+	switch f.Condition {
+	case ConditionEquals:
+		return compareValues(z.min, f.value) <= 0 && compareValues(z.max, f.value) >= 0
+	case ConditionLessThan:
+		return compareValues(z.min, f.value) < 0
+	case ConditionLessThanOrEquals:
+		return compareValues(z.min, f.value) <= 0
+	case ConditionGreaterThan:
+		return compareValues(z.max, f.value) > 0
+	case ConditionGreaterThanOrEquals:
+		return compareValues(z.max, f.value) >= 0
+	case ConditionIn:
+		for v := range f.value.(valueSet) {
+			if compareValues(z.min, v) <= 0 && compareValues(z.max, v) >= 0 {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// usesZones reports whether a filter can skip blocks using zone maps.
+func (f *compiledFilter) usesZones() bool {
+	cr, ok := f.reader.(*ColumnReader)
+	if !ok || !f.bound || len(cr.zones) == 0 {
+		return false
+	}
+	switch f.Condition {
+	case ConditionEquals, ConditionLessThan, ConditionLessThanOrEquals, ConditionGreaterThan, ConditionGreaterThanOrEquals, ConditionIn:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package querystore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneMaps(t *testing.T) {
+	defer func(n int64) { blockIndexInterval = n }(blockIndexInterval)
+	blockIndexInterval = 4
+
+	dir := lo.Must(os.MkdirTemp(os.TempDir(), "store*"))
+	defer os.RemoveAll(dir)
+
+	fs, err := OpenColumnFS(dir)
+	require.NoError(t, err)
+	cs := NewColumnarStore(fs)
+	for i := range 40 {
+		rec := map[string]any{"val": i % 20, "name": fmt.Sprintf("n%02d", i)}
+		if i%7 == 3 {
+			rec["val"] = nil
+		}
+		require.NoError(t, cs.AppendBatch([]map[string]any{rec}))
+	}
+	zones := fs.columnHandles["val"].zones
+	require.Len(t, zones, 10)
+	assert.Equal(t, zone{min: int64(0), max: int64(2)}, zones[0])
+	assert.Equal(t, zone{min: int64(16), max: int64(19)}, zones[4])
+
+	check := func(cs *ColumnarStore) {
+		names := func(where *FilterExpression) []any {
+			rows, err := cs.Query(&Query{Select: []string{"name"}, Where: where})
+			require.NoError(t, err)
+			return lo.Map(rows, func(row map[string]any, _ int) any { return row["name"] })
+		}
+		assert.Equal(t, []any{"n37"}, names(Where("val", ConditionEquals, 17)))
+		assert.Equal(t, []any{"n18", "n19", "n39"}, names(Where("val", ConditionGreaterThan, 17)))
+		assert.Equal(t, []any{"n00", "n01", "n02", "n20", "n21", "n22"}, names(And(Where("val", ConditionLessThan, 3), Where("val", ConditionIsNotNull, nil))))
+		assert.Equal(t, []any{"n05", "n25", "n30"}, names(Where("val", ConditionIn, []int{5, 10})))
+		assert.Equal(t, []any{"n39"}, names(Where("name", ConditionGreaterThanOrEquals, "n39")))
+	}
+	check(cs)
+	require.NoError(t, fs.Close())
+
+	// Lost zone maps are rebuilt on open.
+	require.NoError(t, os.Remove(fs.columnHandles["val"].zoneMapPath()))
+	fs, err = OpenColumnFS(dir)
+	require.NoError(t, err)
+	defer fs.Close()
+	check(NewColumnarStore(fs))
+	assert.Equal(t, zones, fs.columnHandles["val"].zones)
+}